@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Zac-Garby/tab-server/src"
+	"github.com/go-redis/redis"
+)
+
+// A command is one of the things the program can do, which is chosen by the
+// first argument, such as "tab-server rescan". Each command is given the
+// server, which has been set up in the same way whichever command is run,
+// and the arguments left after the flags.
+type command struct {
+	run func(s *src.Server, args []string) error
+
+	// args describes the arguments the command takes, and usage describes
+	// what it does.
+	args  string
+	usage string
+}
+
+// defaultCommand is the command which is run if none is given.
+const defaultCommand = "serve"
+
+// commands maps the name of each command to the command.
+var commands = map[string]command{
+	"serve": {
+		run:   serve,
+		usage: "start the web server (the default)",
+	},
+	"rescan": {
+		run:   rescan,
+		usage: "check every file in the tab directory for changes",
+	},
+	"set-password": {
+		run:   setPassword,
+		args:  "[password]",
+		usage: "change the admin password, reading it from the input if it isn't given",
+	},
+	"export": {
+		run:   exportLibrary,
+		args:  "[file]",
+		usage: "write every tab to a file as JSON, or to the output if no file is given",
+	},
+	"import": {
+		run:   importLibrary,
+		args:  "[file [plan]]",
+		usage: "add the tabs from an exported file, or from the input if no file is given, as the plan from preview-import says if one is given",
+	},
+	"preview-import": {
+		run:   previewImport,
+		args:  "[file]",
+		usage: "write a plan of where the tabs from an exported file would be added and what they would be parsed as, to be checked, changed, and given to import",
+	},
+	"migrate": {
+		run:   migrate,
+		args:  "[-from store] -to store",
+		usage: "copy the tabs, settings and tokens from one store into another, each of which is redis, a Redis URL such as redis://localhost:6379/1, memory or file:PATH",
+	},
+}
+
+// splitCommand finds the command in the program's arguments, returning its
+// name and the rest of the arguments. The command has to come before any of
+// the flags.
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+
+	return defaultCommand, args
+}
+
+// commandUsage describes each of the commands, for the program's usage
+// message.
+func commandUsage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var usage strings.Builder
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(&usage, "  %s\n    \t%s\n", strings.TrimSpace(name+" "+cmd.args), cmd.usage)
+	}
+
+	return usage.String()
+}
+
+// serve starts the web server, which only returns if it stops.
+func serve(s *src.Server, args []string) error {
+	return s.Listen()
+}
+
+// rescan checks every file in the tab directory for changes.
+func rescan(s *src.Server, args []string) error {
+	files, err := s.Rescan()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rescanned %d files.\n", files)
+	return nil
+}
+
+// setPassword changes the admin password to the one given as an argument,
+// or the first line of the input if there isn't one.
+func setPassword(s *src.Server, args []string) error {
+	var password string
+
+	if len(args) > 0 {
+		password = args[0]
+	} else {
+		fmt.Fprint(os.Stderr, "New admin password: ")
+
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if password == "" {
+		return errors.New("the password can't be empty")
+	}
+
+	if err := s.Store.SetPasswordHash(src.HashPassword(password)); err != nil {
+		return err
+	}
+
+	fmt.Println("The admin password has been changed.")
+	return nil
+}
+
+// exportLibrary writes every tab to the file given as an argument, or to the
+// output if there isn't one.
+func exportLibrary(s *src.Server, args []string) error {
+	if len(args) == 0 {
+		return s.Export(os.Stdout)
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.Export(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// importLibrary adds the tabs from the exported file given as an argument,
+// or from the input if there isn't one. If a plan written by preview-import is
+// given after the file, the tabs are added as it says.
+func importLibrary(s *src.Server, args []string) error {
+	input := io.Reader(os.Stdin)
+
+	if len(args) > 0 {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		input = file
+	}
+
+	var (
+		imported, skipped int
+		err               error
+	)
+
+	if len(args) > 1 {
+		plan, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer plan.Close()
+
+		imported, skipped, err = s.ImportPlanned(input, plan)
+		if err != nil {
+			return err
+		}
+	} else if imported, skipped, err = s.Import(input); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d tabs, and skipped %d which already had files or were left out.\n", imported, skipped)
+	return nil
+}
+
+// previewImport writes a plan for importing the exported file given as an
+// argument, or the input if there isn't one, to the output. Nothing is
+// imported until the plan is given to the import command.
+func previewImport(s *src.Server, args []string) error {
+	input := io.Reader(os.Stdin)
+
+	if len(args) > 0 {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		input = file
+	}
+
+	return s.PreviewImport(input, os.Stdout)
+}
+
+// These are the flags of the migrate command, which say which stores it
+// copies from and into. Each is one of:
+//
+//   - redis, the Redis database given by the Redis flags
+//   - a Redis URL, as redis://[:password@]host[:port][/db]
+//   - memory, the memory store, holding the tabs found in the tab directory
+//   - file:PATH, a dump written by the export command
+//
+// The memory store is lost when the program stops, so it can only be copied
+// from. A dump only holds the tabs, settings and tag rules, so the tokens,
+// setlists and everything else are left behind when copying into one, and
+// the tabs' files have to be in the tab directory when copying from one.
+var (
+	migrateFrom = flag.String("from", "", "the store for the migrate command to copy from, or nothing for the one given by -store")
+	migrateTo   = flag.String("to", "", "the store for the migrate command to copy into")
+)
+
+// migrate copies everything from one store into another, showing its
+// progress as it goes. The source's tab directory is rescanned first, so
+// that every file is cached and migrated, including when migrating from the
+// memory store, which starts out empty. The store to copy into used to be
+// given as an argument, which it still can be instead of with -to.
+func migrate(s *src.Server, args []string) error {
+	to := *migrateTo
+	if to == "" && len(args) > 0 {
+		to = args[0]
+	}
+
+	if to == "" {
+		return errors.New("the store to migrate to must be given with -to, such as -to redis://localhost:6379/1")
+	}
+
+	source := s
+	if *migrateFrom != "" {
+		var err error
+		if source, err = openMigrationSource(s, *migrateFrom); err != nil {
+			return err
+		}
+		defer source.Store.Close()
+	}
+
+	target, dump, err := openMigrationTarget(to)
+	if err != nil {
+		return err
+	}
+	defer target.Store.Close()
+
+	// A dump's tabs were read from their files as it was restored, and
+	// rescanning would add any other files in the tab directory too.
+	if !strings.HasPrefix(*migrateFrom, "file:") {
+		if _, err := source.Rescan(); err != nil {
+			return err
+		}
+	}
+
+	copied, err := source.MigrateTo(target, func(done, total int) {
+		if done%100 == 0 || done == total {
+			fmt.Fprintf(os.Stderr, "\rCopied %d of %d tabs...", done, total)
+		}
+	})
+
+	fmt.Fprintln(os.Stderr)
+
+	if err != nil {
+		return err
+	}
+
+	if dump != "" {
+		if err := exportLibrary(target, []string{dump}); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Migrated %d tabs to %s, and checked that they all match.\n", copied, to)
+	return nil
+}
+
+// openMigrationSource returns a server using the store to migrate from, as
+// given to the -from flag. Its settings are the ones in the store, or for
+// the memory store and dumps, the ones given by the flags.
+func openMigrationSource(s *src.Server, from string) (*src.Server, error) {
+	if from == "memory" {
+		return newMemoryServer(s.Settings), nil
+	}
+
+	if path := strings.TrimPrefix(from, "file:"); path != from {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		source := newMemoryServer(s.Settings)
+
+		restored, err := source.RestoreDump(file)
+		if err != nil {
+			source.Store.Close()
+			return nil, err
+		}
+
+		fmt.Fprintf(os.Stderr, "Restored %d tabs from %s.\n", restored, path)
+		return source, nil
+	}
+
+	source, err := openRedisServer(from)
+	if err != nil {
+		return nil, err
+	}
+
+	if source.Settings, err = source.Store.LoadSettings(); err == nil && source.Settings.PasswordHash == "" {
+		err = fmt.Errorf("%s hasn't been set up, so there is nothing to migrate", from)
+	}
+
+	if err != nil {
+		source.Store.Close()
+		return nil, err
+	}
+
+	return source, nil
+}
+
+// openMigrationTarget returns a server using the store to migrate into, as
+// given to the -to flag. If it is a dump, the server uses the memory store,
+// which is written to the dump's path, which is returned too, once
+// everything has been copied into it.
+func openMigrationTarget(to string) (*src.Server, string, error) {
+	if to == "memory" {
+		return nil, "", errors.New("the memory store is lost when the program stops, so it can't be migrated to, but a dump can be, with -to file:PATH")
+	}
+
+	if path := strings.TrimPrefix(to, "file:"); path != to {
+		return newMemoryServer(src.DefaultSettings()), path, nil
+	}
+
+	target, err := openRedisServer(to)
+	return target, "", err
+}
+
+// openRedisServer returns a server using the Redis database given by the
+// Redis flags, if name is "redis", or otherwise at the URL in name.
+func openRedisServer(name string) (*src.Server, error) {
+	var options *redis.Options
+
+	if name == "redis" {
+		db, err := strconv.Atoi(flag.Lookup("redis-db").Value.String())
+		if err != nil {
+			return nil, err
+		}
+
+		options = &redis.Options{
+			Addr:     flag.Lookup("redis-addr").Value.String(),
+			Password: flag.Lookup("redis-password").Value.String(),
+			DB:       db,
+		}
+	} else {
+		var err error
+		if options, err = redis.ParseURL(name); err != nil {
+			return nil, fmt.Errorf("%q isn't redis, memory, file:PATH or a Redis URL: %s", name, err)
+		}
+	}
+
+	db := redis.NewClient(options)
+
+	if err := db.Ping().Err(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not connect to %s: %s", options.Addr, err)
+	}
+
+	return &src.Server{
+		Store: src.NewRedisStore(db),
+	}, nil
+}
+
+// newMemoryServer returns a server using a new memory store, starting with a
+// copy of the given settings.
+func newMemoryServer(settings *src.Settings) *src.Server {
+	copied := *settings
+
+	return &src.Server{
+		Settings: &copied,
+		Store:    src.NewMemoryStore(&copied),
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A config file holds the same settings as the flags, for the ones which
+// the server needs before it can connect to the database. It is written in
+// a simple subset of TOML: each line is either a comment starting with '#',
+// a key and a value separated by '=', or a table header in square brackets.
+// Each key is the name of a flag, and keys in a table are prefixed with the
+// table's name, so these two files mean the same thing:
+//
+//	redis-addr = "localhost:6379"
+//
+//	[redis]
+//	addr = "localhost:6379"
+//
+// Values are either strings in double quotes, or bare numbers and booleans.
+
+// loadConfig reads the config file with the given filename, returning a map
+// from each flag name in it to its value.
+func loadConfig(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		values  = make(map[string]string)
+		table   = ""
+		scanner = bufio.NewScanner(file)
+		lineNum = 0
+	)
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key and a value separated by '='", filename, lineNum)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		if table != "" {
+			key = table + "-" + key
+		}
+
+		value, err := parseConfigValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, lineNum, err)
+		}
+
+		values[key] = value
+	}
+
+	return values, scanner.Err()
+}
+
+// parseConfigValue parses a value from a config file, which is either a
+// string in double quotes, which can be followed by a comment, or a bare
+// number or boolean.
+func parseConfigValue(raw string) (string, error) {
+	if !strings.HasPrefix(raw, `"`) {
+		if i := strings.Index(raw, "#"); i >= 0 {
+			raw = strings.TrimSpace(raw[:i])
+		}
+
+		if raw == "" {
+			return "", fmt.Errorf("missing value")
+		}
+
+		return raw, nil
+	}
+
+	// Find the closing quote, skipping any which are escaped, so the
+	// string can be unquoted with Go's rules, which are the same as TOML's
+	// for everything that matters here.
+	for i := 1; i < len(raw); i++ {
+		switch raw[i] {
+		case '\\':
+			i++
+
+		case '"':
+			rest := strings.TrimSpace(raw[i+1:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected %q after the string", rest)
+			}
+
+			return strconv.Unquote(raw[:i+1])
+		}
+	}
+
+	return "", fmt.Errorf("the string is never closed")
+}
+
+// applyConfig sets each flag in the config file to its value from the file,
+// unless it was given on the command line or by its environment variable,
+// which both take precedence over the config file.
+func applyConfig(values map[string]string) error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for name, value := range values {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown setting in the config file: %s", name)
+		}
+
+		if _, inEnv := os.LookupEnv(envName(name)); given[name] || inEnv {
+			continue
+		}
+
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value for %s in the config file: %s", name, err)
+		}
+	}
+
+	return nil
+}
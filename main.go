@@ -1,40 +1,396 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Zac-Garby/tab-server/src"
 	"github.com/go-redis/redis"
 )
 
-func main() {
-	// Open a connection to the Redis server so
-	// the data can be fetched.
-	db := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-
-	// Load the settings from the database, potentially
-	// handling an error. An error will cause the
-	// program to exit early without starting a web
-	// server.
-	settings, err := src.LoadSettings(db)
+// envPrefix is the prefix of the environment variables which can be used
+// instead of each flag. For example, TAB_SERVER_PORT can be used instead of
+// --port.
+const envPrefix = "TAB_SERVER_"
+
+// envString returns the value of the environment variable for the flag with
+// the given name, such as TAB_SERVER_REDIS_ADDR for "redis-addr", or def if
+// it isn't set. It is used as the flag's default, so a flag which is given
+// takes precedence over the environment variable, which takes precedence
+// over the config file and then the built-in default.
+func envString(name, def string) string {
+	if value, ok := os.LookupEnv(envName(name)); ok {
+		return value
+	}
+
+	return def
+}
+
+// envInt is like envString, but for flags which are whole numbers. If the
+// environment variable isn't a whole number, the program exits.
+func envInt(name string, def int) int {
+	value, ok := os.LookupEnv(envName(name))
+	if !ok {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		fmt.Println("Could not load settings. Reason:", err)
+		fmt.Printf("%s must be a whole number, not %q\n", envName(name), value)
+		os.Exit(1)
+	}
+
+	return n
+}
+
+// envBool is like envString, but for flags which are true or false. If the
+// environment variable isn't either, the program exits.
+func envBool(name string, def bool) bool {
+	value, ok := os.LookupEnv(envName(name))
+	if !ok {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		fmt.Printf("%s must be true or false, not %q\n", envName(name), value)
+		os.Exit(1)
+	}
+
+	return b
+}
+
+// envDuration is like envString, but for flags which are durations, such as
+// "2s". If the environment variable isn't a duration, the program exits.
+func envDuration(name string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(envName(name))
+	if !ok {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Printf("%s must be a duration, such as 2s, not %q\n", envName(name), value)
+		os.Exit(1)
+	}
+
+	return d
+}
+
+// splitList splits a list of values separated by commas, such as the value
+// of a flag, leaving out any which are empty.
+func splitList(list string) []string {
+	values := make([]string, 0)
+
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// envName converts a flag's name into the name of its environment variable.
+func envName(name string) string {
+	env := []rune(envPrefix)
+
+	for _, r := range name {
+		switch {
+		case r == '-':
+			env = append(env, '_')
+		case r >= 'a' && r <= 'z':
+			env = append(env, r-'a'+'A')
+		default:
+			env = append(env, r)
+		}
+	}
+
+	return string(env)
+}
+
+func main() {
+	var (
+		// config is the filename of the config file, which can hold any of
+		// the other flags.
+		config = flag.String("config", envString("config", ""), "the filename of a config file holding any of the other flags")
+
+		// These say where the server listens, and whether it uses HTTPS,
+		// which it does if both a certificate and a key are given.
+		addr    = flag.String("addr", envString("addr", ""), "the address to listen on, or nothing for any address")
+		port    = flag.Int("port", envInt("port", 8000), "the port to listen on")
+		tlsCert = flag.String("tls-cert", envString("tls-cert", ""), "the filename of the HTTPS certificate")
+		tlsKey  = flag.String("tls-key", envString("tls-key", ""), "the filename of the HTTPS key")
+
+		// redirectPort is the port to redirect plain HTTP requests to
+		// HTTPS from, when using HTTPS.
+		redirectPort = flag.Int("redirect-port", envInt("redirect-port", 0), "the port to redirect HTTP requests to HTTPS from, or 0 not to")
+
+		// staticDir is where the pages, scripts and styles are served from.
+		staticDir = flag.String("static-dir", envString("static-dir", "www"), "the directory to serve the static files from")
+
+		// recordingDir is where the rehearsal recordings are kept.
+		recordingDir = flag.String("recordings", envString("recordings", "recordings"), "the directory to keep rehearsal recordings in")
+
+		// diskConcurrency is how many requests which read a lot from the
+		// tab directory can run at once, which is worth lowering on a
+		// slow disk.
+		diskConcurrency = flag.Int("disk-concurrency", envInt("disk-concurrency", 2), "how many disk-heavy requests can run at once")
+
+		// These say how to connect to Redis.
+		redisAddr     = flag.String("redis-addr", envString("redis-addr", "localhost:6379"), "the address of the Redis server, when using the Redis store")
+		redisPassword = flag.String("redis-password", envString("redis-password", ""), "the password of the Redis server")
+		redisDB       = flag.Int("redis-db", envInt("redis-db", 0), "the number of the Redis database to use")
+
+		// These say how long the store and requests to particular routes
+		// can take, and when the store's circuit breaker opens, after
+		// which it is given up on for a while.
+		storeTimeout    = flag.Duration("store-timeout", envDuration("store-timeout", 2*time.Second), "how long each store operation, and each other Redis command, can take")
+		storeTimeouts   = flag.String("store-timeouts", envString("store-timeouts", ""), "the timeouts of particular store operations, such as GetTabs=10s,ResetTabs=1m")
+		routeTimeouts   = flag.String("route-timeouts", envString("route-timeouts", ""), "how long requests to particular routes can take, such as /api/v1/tabs=5s,/api/v1/search=2s")
+		breakerFailures = flag.Int("breaker-failures", envInt("breaker-failures", 5), "how many store operations in a row have to fail for the circuit breaker to open")
+		breakerCooldown = flag.Duration("breaker-cooldown", envDuration("breaker-cooldown", 30*time.Second), "how long the circuit breaker stays open for before trying the store again")
+
+		// These say which MQTT broker to publish events, and the tab which
+		// is being viewed or performed, to. Nothing is published unless a
+		// broker is given.
+		mqttBroker   = flag.String("mqtt-broker", envString("mqtt-broker", ""), "the address of the MQTT broker to publish to, as host:port, or nothing not to")
+		mqttPrefix   = flag.String("mqtt-prefix", envString("mqtt-prefix", "tab-server"), "the prefix of the MQTT topics")
+		mqttUsername = flag.String("mqtt-username", envString("mqtt-username", ""), "the username to log in to the MQTT broker with")
+		mqttPassword = flag.String("mqtt-password", envString("mqtt-password", ""), "the password to log in to the MQTT broker with")
+
+		// These are the commands to run for each hook, which are run with
+		// 'sh -c' and given the details as JSON on their input, and the
+		// URLs which the same details are sent to.
+		hookPostIngest         = flag.String("hook-post-ingest", envString("hook-post-ingest", ""), "the command to run after a tab is added or updated from its file")
+		hookPreDelete          = flag.String("hook-pre-delete", envString("hook-pre-delete", ""), "the command to run before the admin deletes a tab, which stops it being deleted if it fails")
+		hookPostSettingsChange = flag.String("hook-post-settings-change", envString("hook-post-settings-change", ""), "the command to run after the settings are changed")
+		hookIntegrityAlert     = flag.String("hook-integrity-alert", envString("hook-integrity-alert", ""), "the command to run when an integrity snapshot finds that a lot of tabs have disappeared or changed")
+		webhooks               = flag.String("webhooks", envString("webhooks", ""), "a comma-separated list of URLs which the post- hooks' payloads are POSTed to, signed with the webhook key")
+
+		// These say when the nightly integrity snapshot is taken, and how
+		// much of the collection has to disappear or change since the
+		// last one for it to raise an alert.
+		integrityTime      = flag.String("integrity-time", envString("integrity-time", "03:00"), "the time of day to take the integrity snapshot at, as HH:MM, or nothing not to")
+		integrityThreshold = flag.Int("integrity-threshold", envInt("integrity-threshold", 10), "the percentage of the tabs which have to disappear or change between integrity snapshots to raise an alert")
+
+		// secretRotation is how often the keys which sign sessions and
+		// shared links are replaced by themselves.
+		secretRotation = flag.Int("secret-rotation-days", envInt("secret-rotation-days", 0), "how many days to use each key which signs sessions and shared links for before rotating it, or 0 to only rotate them by hand")
+
+		// These say which other origins can use the API from a browser.
+		// The lists are separated by commas.
+		corsOrigins     = flag.String("cors-origins", envString("cors-origins", ""), "the origins which can use the API from a browser, such as https://tabs.example.com, or * for any")
+		corsMethods     = flag.String("cors-methods", envString("cors-methods", ""), "the methods which other origins can use, or nothing for GET, POST and DELETE")
+		corsHeaders     = flag.String("cors-headers", envString("cors-headers", ""), "the request headers which other origins can send, or nothing for the usual ones")
+		corsCredentials = flag.Bool("cors-credentials", envBool("cors-credentials", false), "whether other origins can send the session cookie")
+		corsMaxAge      = flag.Int("cors-max-age", envInt("cors-max-age", 0), "how many seconds browsers can remember what other origins can do for, or 0 for 10 minutes")
+
+		// These say how requests are logged.
+		logFormat = flag.String("log-format", envString("log-format", "logfmt"), "the format to log requests in: logfmt or json")
+		logLevel  = flag.String("log-level", envString("log-level", "info"), "the least severe requests to log: debug, info, warn, error or none")
+		logFile   = flag.String("log-file", envString("log-file", ""), "the file to append the request log to, or nothing for the standard error")
+
+		// The store decides where the tabs and settings are kept. "redis"
+		// keeps them in the Redis database, and "memory" keeps them in
+		// memory, starting with the settings given by the other flags,
+		// which is handy for demos but means everything is lost when the
+		// server stops.
+		storeType   = flag.String("store", envString("store", "redis"), "where to keep the tabs, settings and everything else: redis or memory")
+		tabDir      = flag.String("tabs", envString("tabs", "tabs"), "the tab directory, when using the memory store")
+		password    = flag.String("password", envString("password", ""), "the admin password, when using the memory store, or nothing for a random one")
+		filePattern = flag.String("pattern", envString("pattern", "[artist] - [title]"), "the filename pattern, when using the memory store")
+	)
+
+	// The command comes before the flags, so only the arguments after it
+	// are parsed as flags.
+	name, args := splitCommand(os.Args[1:])
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Printf("Unknown command: %s\n", name)
+		os.Exit(2)
+	}
+
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [command] [flags] [arguments]\n\nCommands:\n%s\nFlags:\n", os.Args[0], commandUsage())
+		flag.PrintDefaults()
+	}
+
+	flag.CommandLine.Parse(args)
+
+	if *config != "" {
+		values, err := loadConfig(*config)
+		if err == nil {
+			err = applyConfig(values)
+		}
+
+		if err != nil {
+			fmt.Println("Could not load the config file. Reason:", err)
+			os.Exit(1)
+		}
+	}
+
+	// The request log is appended to, so that it isn't lost when the
+	// server restarts.
+	logConfig := src.LogConfig{
+		Format: *logFormat,
+		Level:  *logLevel,
+	}
+
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Println("Could not open the log file. Reason:", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+
+		logConfig.Output = file
+	}
+
+	timeouts := src.TimeoutConfig{
+		Store:           *storeTimeout,
+		Operations:      *storeTimeouts,
+		Routes:          *routeTimeouts,
+		BreakerFailures: *breakerFailures,
+		BreakerCooldown: *breakerCooldown,
+	}
+
+	var store src.Store
+
+	switch *storeType {
+	case "redis":
+		// Open a connection to the Redis server so
+		// the data can be fetched. The tabs and settings
+		// are kept in the same Redis database as
+		// everything else, like sessions and the search
+		// index. The store is wrapped in a circuit breaker
+		// so that if Redis stops responding, requests give
+		// up quickly rather than piling up waiting for it,
+		// and the store's other operations have the same
+		// timeout.
+		db := redis.NewClient(&redis.Options{
+			Addr:         *redisAddr,
+			Password:     *redisPassword,
+			DB:           *redisDB,
+			ReadTimeout:  timeouts.DatabaseTimeout(),
+			WriteTimeout: timeouts.DatabaseTimeout(),
+		})
+
+		breaker := src.NewBreakerStore(src.NewRedisStore(db))
+
+		// A timeout which can't be parsed is reported with
+		// the rest of the configuration, below.
+		breaker.Configure(timeouts)
+
+		store = breaker
+
+	case "memory":
+		// Everything, including the sessions and the
+		// search index, is kept in maps in memory, so
+		// Redis isn't needed at all, and the Redis flags
+		// are ignored.
+		settings := src.DefaultSettings()
+		settings.TabDirectory = *tabDir
+		settings.FilenamePatterns = []string{*filePattern}
+
+		if *password != "" {
+			settings.PasswordHash = src.HashPassword(*password)
+		}
+
+		store = src.NewMemoryStore(settings)
+
+	default:
+		fmt.Println("Unknown store:", *storeType)
 		os.Exit(1)
 	}
 
-	// Make a new Server instance, addr = "" and
-	// port = 8000. Everything else is zero values
-	// of the respective types.
+	// Make a new Server instance from the flags. Every
+	// command uses it, not just the web server, so they
+	// all share the same store and settings.
 	s := &src.Server{
-		Address:  "",
-		Port:     8000,
-		Settings: settings,
-		Database: db,
+		Address:     *addr,
+		Port:        *port,
+		HTTPS:       *tlsCert != "",
+		Certificate: *tlsCert,
+		Key:         *tlsKey,
+
+		RedirectPort: *redirectPort,
+
+		StaticDirectory:    *staticDir,
+		RecordingDirectory: *recordingDir,
+
+		DiskConcurrency: *diskConcurrency,
+
+		Logging: logConfig,
+
+		CORS: src.CORSConfig{
+			Origins:     splitList(*corsOrigins),
+			Methods:     splitList(*corsMethods),
+			Headers:     splitList(*corsHeaders),
+			Credentials: *corsCredentials,
+			MaxAge:      *corsMaxAge,
+		},
+
+		Hooks: src.HookConfig{
+			PostIngest:         *hookPostIngest,
+			PreDelete:          *hookPreDelete,
+			PostSettingsChange: *hookPostSettingsChange,
+			IntegrityAlert:     *hookIntegrityAlert,
+			Webhooks:           splitList(*webhooks),
+		},
+
+		Integrity: src.IntegrityConfig{
+			Time:      *integrityTime,
+			Threshold: *integrityThreshold,
+		},
+
+		Secrets: src.SecretsConfig{
+			RotationDays: *secretRotation,
+		},
+
+		MQTT: src.MQTTConfig{
+			Broker:   *mqttBroker,
+			Prefix:   strings.Trim(*mqttPrefix, "/"),
+			Username: *mqttUsername,
+			Password: *mqttPassword,
+		},
+
+		Store:    store,
+		Timeouts: timeouts,
+	}
+
+	// Check the whole configuration, and load the settings
+	// from the store, before running the command. Every
+	// problem is reported at once, and any which aren't
+	// just warnings stop the program early. On the first
+	// run, the store is set up with the default settings
+	// and a random admin password, which is only ever
+	// shown here.
+	report, initialPassword := s.CheckStartup(name == "serve")
+	if len(report.Problems) > 0 {
+		fmt.Print(report)
+	}
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+
+	if initialPassword != "" {
+		fmt.Println("The settings have been set up for the first time.")
+		fmt.Println("The admin password is:", initialPassword)
+		fmt.Println("It won't be shown again, so change it to something memorable in the settings.")
 	}
 
-	// Start listening on port 8000.
-	s.Listen()
+	// Run the command.
+	if err := cmd.run(s, flag.Args()); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
 }
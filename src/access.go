@@ -0,0 +1,89 @@
+package src
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The same server can be a public mirror which anyone can read, or a band's
+// private archive which nobody can see without logging in. The access mode in
+// the settings says which, and is enforced for the whole API by the router's
+// middleware, rather than by each handler. The pages and static files are
+// always served, since they don't have any tabs in them, and they need to
+// load for anyone to be able to log in.
+const (
+	// accessPublic lets anyone read the collection, and use the few things
+	// which don't need a permission, such as starring tabs. It is the
+	// default, which is how the server always worked.
+	accessPublic = "public"
+
+	// accessLoginToRead only lets those who have logged in or have an API
+	// token read anything from the API, but leaves the things which don't
+	// read the collection as they were, so that the audience can still
+	// request songs in open mic mode.
+	accessLoginToRead = "login-to-read"
+
+	// accessLoginForAll only lets those who have logged in or have an API
+	// token use the API at all.
+	accessLoginForAll = "login-for-all"
+)
+
+// openAPIPaths are the paths in the API, below the version's prefix, which
+// anyone can use whatever the access mode is, since they are needed to log
+// in, or say nothing about the collection. The settings only tell those who
+// haven't logged in the public settings, which include the access mode.
+var openAPIPaths = map[string]bool{
+	"/login":      true,
+	"/logout":     true,
+	"/csrf-token": true,
+	"/settings":   true,
+	"/errors":     true,
+
+	// The webhook keys are public keys, which receivers need to check
+	// the deliveries, and say nothing about the collection.
+	"/webhooks/keys": true,
+}
+
+// validAccessMode says whether a mode is one of the access modes.
+func validAccessMode(mode string) bool {
+	return mode == accessPublic || mode == accessLoginToRead || mode == accessLoginForAll
+}
+
+// apiPath returns the path of an API request below its version's prefix, such
+// as "/tabs" for both /api/v1/tabs and /api/tabs. The second return value is
+// false if the request isn't for the API.
+func apiPath(path string) (string, bool) {
+	for _, prefix := range []string{"/api/v1", "/api"} {
+		if rest := strings.TrimPrefix(path, prefix); rest != path && (rest == "" || strings.HasPrefix(rest, "/")) {
+			return rest, true
+		}
+	}
+
+	return "", false
+}
+
+// enforceAccessMode is middleware for the router which refuses the API
+// requests which the access mode doesn't let anyone make without logging in,
+// unless they can be authenticated. A signed URL is as good as logging in for
+// reading, so that shared download links keep working in a private archive.
+func (s *Server) enforceAccessMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, isAPI := apiPath(r.URL.Path)
+		reading := r.Method == "GET" || r.Method == "HEAD"
+		mode := s.Settings.AccessMode
+
+		if isAPI && !openAPIPaths[rest] && (mode == accessLoginForAll || (mode == accessLoginToRead && reading)) {
+			authenticate := s.authenticate
+			if reading {
+				authenticate = s.authenticateSigned
+			}
+
+			if status, err := authenticate(r); err != nil {
+				writeError(w, status, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
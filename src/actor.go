@@ -0,0 +1,137 @@
+package src
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Every change to the collection is made by an actor, which is recorded with
+// the events and given to the hooks, so that changes which the admin made
+// can be told apart from the ones which the server made by itself, such as
+// when the file watcher notices a new file. An actor is encoded in JSON like
+// this:
+//
+//	{"kind": "token", "name": "backup-script", "role": "editor"}
+//	{"kind": "system", "name": "scanner", "job": "42"}
+//
+// The kind is one of the actor constants below. People have the name of the
+// API token they used, or "admin" if they were logged in, along with their
+// role. The server's own parts have one of the system actor names, and if
+// the change was made as part of a job, the job's ID, so that it can be
+// looked up in /api/v1/jobs.
+const (
+	// actorAdmin is the admin, logged in from a browser.
+	actorAdmin = "admin"
+
+	// actorToken is someone using an API token.
+	actorToken = "token"
+
+	// actorSystem is one of the parts of the server which make changes by
+	// themselves.
+	actorSystem = "system"
+)
+
+// These are the names of the system actors.
+const (
+	// systemWatcher is the file watcher, which applies changes to the files
+	// as soon as they happen.
+	systemWatcher = "watcher"
+
+	// systemScanner is what goes through the tab directory to bring the
+	// cache up to date with it, both in rescan jobs and when new files are
+	// found as the tabs are listed.
+	systemScanner = "scanner"
+
+	// systemImporter is the import command, which writes the tabs from an
+	// export into the tab directory.
+	systemImporter = "importer"
+
+	// systemMigration is the migrate command, which copies everything into
+	// another database.
+	systemMigration = "migration"
+)
+
+// jobActorNames maps each kind of job to the system actor which it runs as.
+// Kinds of job which aren't here run as an actor named after the kind.
+var jobActorNames = map[string]string{
+	"rescan": systemScanner,
+	"import": systemScanner,
+}
+
+// An actor is whoever or whatever made a change.
+type actor struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Role string `json:"role,omitempty"`
+	Job  string `json:"job,omitempty"`
+
+	// job is the job which the change was made as part of, if any. It might
+	// not have been stored yet, in which case its ID is reserved when the
+	// actor is first recorded.
+	job *job
+}
+
+// systemActor returns the system actor with the given name, which isn't part
+// of any job.
+func systemActor(name string) actor {
+	return actor{Kind: actorSystem, Name: name}
+}
+
+// jobActor returns the system actor which a job runs as.
+func jobActor(j *job) actor {
+	name, ok := jobActorNames[j.Kind]
+	if !ok {
+		name = j.Kind
+	}
+
+	return actor{Kind: actorSystem, Name: name, job: j}
+}
+
+// requestActor returns the actor who made a request, which must already have
+// been authenticated. If the actor can't be found out, such as when the
+// database can't be reached, they are recorded as an admin with an unknown
+// name rather than stopping the change.
+func (s *Server) requestActor(r *http.Request) actor {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return actor{Kind: actorAdmin, Name: "admin", Role: roleAdmin}
+	}
+
+	name, err := s.tokenName(r)
+	if err != nil {
+		return actor{Kind: actorToken, Name: "unknown"}
+	}
+
+	role, err := s.tokenRole(r)
+	if err != nil {
+		role = ""
+	}
+
+	return actor{Kind: actorToken, Name: name, Role: role}
+}
+
+// jobIDLock is held while an ID is being reserved for a job which is making
+// changes before it has been stored, since the changes might be made from
+// more than one goroutine at once.
+var jobIDLock sync.Mutex
+
+// record returns the actor as it is recorded, with the ID of its job, which
+// is reserved now if the job hasn't been given one yet. If it can't be
+// reserved, the actor is recorded without it.
+func (s *Server) record(by actor) actor {
+	if by.job == nil {
+		return by
+	}
+
+	jobIDLock.Lock()
+	defer jobIDLock.Unlock()
+
+	if by.job.ID == "" {
+		if err := s.reserveJobID(by.job); err != nil {
+			return by
+		}
+	}
+
+	by.Job = by.job.ID
+	return by
+}
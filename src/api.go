@@ -1,110 +1,164 @@
 package src
 
 import (
+	"context"
 	"crypto/sha512"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-// tabFilenames returns a list of the filenames in the tab directory.
+// tabFilenames returns a list of the filenames in the tab directory and the
+// folders inside it, down to the configured scan depth. Files in folders have
+// filenames relative to the tab directory, such as "artist/album/song.txt".
 func (s *Server) tabFilenames() ([]string, error) {
-	// Get a list of information about each file in the tab directory. If an
-	// error occurs - i.e. if the directory doesn't exist - that error is
-	// returned and the function exits early.
-	files, err := ioutil.ReadDir(s.Settings.TabDirectory)
+	filenames, _, err := scanDirectory(s.Settings.TabDirectory, s.Settings.ScanDepth, s.Settings.IgnorePatterns)
+	return filenames, err
+}
+
+// scanDirectory walks through the directory, and the folders inside it down to
+// the given depth, returning the filenames of the files it finds relative to
+// the directory, and the full paths of the folders it went into (including
+// the directory itself). Filenames always use '/' to separate folders, so
+// they are the same on every system. Files and folders matching any of the
+// ignore patterns are left out.
+func scanDirectory(dir string, depth int, ignorePatterns []string) (filenames, folders []string, err error) {
+	// Make a new list of strings, which the filenames will be appended to as
+	// the files are found.
+	filenames = make([]string, 0)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		// If an error occurs - i.e. if the directory doesn't exist - that
+		// error is returned and the walk stops early.
+		if err != nil {
+			return err
+		}
+
+		if path == dir {
+			folders = append(folders, path)
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		// If the name begins with a '.' character, ignore it. A '.' before a
+		// filename implies that it is hidden (in macOS, anyway), and thus
+		// shouldn't be processed by the program. The same goes for anything
+		// which the user has asked to be ignored. Ignored folders are skipped
+		// entirely.
+		if strings.HasPrefix(info.Name(), ".") || isIgnored(rel, ignorePatterns) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if info.IsDir() {
+			if folderDepth(rel) > depth {
+				return filepath.SkipDir
+			}
+
+			folders = append(folders, path)
+			return nil
+		}
+
+		// Append the filename to the filenames list.
+		filenames = append(filenames, rel)
+
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Make a new list of strings, allocating enough memory to store a string
-	// for each file in 'files'.
-	filenames := make([]string, 0, len(files))
+	return filenames, folders, nil
+}
+
+// isIgnored reports whether the file or folder with the given filename, which
+// is relative to the tab directory, matches any of the ignore patterns. A
+// pattern matches if it matches either the whole filename, such as
+// "drafts/*.txt", or just the last part of it, such as "*.bak".
+func isIgnored(filename string, ignorePatterns []string) bool {
+	name := path.Base(filename)
 
-	// Iterate through the file informations which are stored in 'files',
-	// keeping track the current iteration index and the file information
-	// on each iteration.
-	for _, file := range files {
-		// If the filename begins with a '.' character, ignore it. A '.'
-		// before a filename implies that it is hidden (in macOS, anyway),
-		// and thus shouldn't be processed by the program.
-		if strings.HasPrefix(file.Name(), ".") {
-			continue
+	for _, pattern := range ignorePatterns {
+		if matched, _ := path.Match(pattern, filename); matched {
+			return true
 		}
 
-		// Append the filename to the filenames list.
-		filenames = append(filenames, file.Name())
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
 	}
 
-	// Return the list of filenames, and a nil error since the function was
-	// successful.
-	return filenames, nil
+	return false
 }
 
-// filterFilenames returns two lists, one containing all filenames which need to
-// be processed further and one containing all filenames which have already been
-// cached and thus don't need any more processing (except from fetching the data
-// from the database).
-func (s *Server) filterFilenames(filenames []string) (toProcess, cached []string, err error) {
-	// Fetch the set containing all cached tab IDs from the database, which is
-	// stored inside the key 'tabs'. If there is an error, return it along with
-	// nil values for the two lists.
-	tabIDs, err := s.Database.SMembers("tabs").Result()
-	if err != nil {
-		return nil, nil, err
+// folderDepth returns how many levels of folders deep a folder is inside the
+// tab directory, given its path relative to it. For example, "artist" is 1
+// and "artist/album" is 2.
+func folderDepth(rel string) int {
+	return strings.Count(rel, "/") + 1
+}
+
+// tabFolders returns the names of the folders which the file with the given
+// filename is in, outermost first.
+func tabFolders(filename string) []string {
+	dir := path.Dir(filename)
+	if dir == "." {
+		return nil
 	}
 
-	// Initialise the cached filename list. Since we already have a list containing
-	// all of the tab IDs, we know that there will be len(tabIDs) tabs to put in
-	// the list, allowing the list to be initialised to the correct capacity
-	// beforehand, which will very slightly increase the performance because
-	// memory allocation takes time.
-	cached = make([]string, len(tabIDs))
-
-	// Iterate over each ID in the list of tab IDs, also keeping track of the current
-	// index of the iteration.
-	for index, id := range tabIDs {
-		// Find the filename corresponding to the current iteration's ID. If an
-		// error occurs, return from the function, returning the error. The tab's
-		// key is calculated as the concatenation of "tab:" and the ID. HGET is a
-		// Redis command which gets a particular value from a hashmap, in this
-		// case the value with the key "filename".
-		filename, err := s.Database.HGet("tab:"+id, "filename").Result()
-		if err != nil {
-			return nil, nil, err
-		}
+	return strings.Split(dir, "/")
+}
+
+// tabPath returns the path to the file with the given filename, which is
+// relative to the tab directory.
+func (s *Server) tabPath(filename string) string {
+	return filepath.Join(s.Settings.TabDirectory, filepath.FromSlash(filename))
+}
 
-		cached[index] = filename
+// filterFilenames returns two lists, one containing all filenames which need to
+// be processed further and one containing the IDs of the tabs whose files have
+// already been cached and thus don't need any more processing (except from
+// fetching the data from the database). Both are in the same order as the
+// given filenames.
+func (s *Server) filterFilenames(filenames []string) (toProcess, cachedIDs []string, err error) {
+	// Fetch the hashmap from filenames to the IDs of their tabs, which is
+	// stored inside the key 'filenames'. This gets every cached filename in
+	// one go, rather than looking up each tab separately. If there is an
+	// error, return it along with nil values for the two lists.
+	cached, err := s.Store.Filenames()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Create the list in which the filenames of files which need to be processed
-	// will be put.
+	// Create the lists in which the filenames of files which need to be
+	// processed and the IDs of cached tabs will be put.
 	toProcess = make([]string, 0)
+	cachedIDs = make([]string, 0, len(cached))
 
-	// Iterate through the given filenames to check which of them have been cached
-	// and which haven't yet. Also, label this loop as 'outerLoop' so it can be
-	// referenced by 'continue' statements.
-outerLoop:
+	// Iterate through the given filenames to check which of them have been
+	// cached and which haven't yet.
 	for _, filename := range filenames {
-		// Go through the list of filenames which have been cached, checking for
-		// each one if it is equal to the current iteration's filename. If it is,
-		// then this file has already been cached the the next iteration of the
-		// outer loop can be skipped to. This loop implements a linear search.
-		for _, existing := range cached {
-			if existing == filename {
-				continue outerLoop
-			}
+		if id, ok := cached[filename]; ok {
+			cachedIDs = append(cachedIDs, id)
+		} else {
+			toProcess = append(toProcess, filename)
 		}
-
-		// If the loop finished without and filename matching, this file needs
-		// to be processed further, and as such it is appended to the toProcess
-		// list.
-		toProcess = append(toProcess, filename)
 	}
 
 	// A return with no "arguments" here means that the two lists are returned
@@ -113,8 +167,26 @@ outerLoop:
 }
 
 // getTabs returns a list of all of the tabs in the system, getting cached ones
-// from the database and parsing new ones if necessary from the filesystem.
-func (s *Server) getTabs() (tabs []*Tab, err error) {
+// from the database and parsing new ones if necessary from the filesystem. If
+// the context is cancelled while new files are being parsed, it stops early,
+// returning the context's error. Any files which were cached before that will
+// still be there next time.
+func (s *Server) getTabs(ctx context.Context) (tabs []*Tab, err error) {
+	// Hold the cache lock for the whole time, so that the file watcher can't
+	// cache a new file in between it being found here and it being cached.
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	// If the tabs were got recently and nothing has changed since, the copy
+	// kept in memory can be used instead of going through everything again.
+	if tabs, ok := s.memoryTabs(); ok {
+		for _, tab := range tabs {
+			tab.applyTransformations(s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
+		}
+
+		return tabs, nil
+	}
+
 	// Initialise the tabs list, which was declared in the return parameters.
 	// It is defined as initially having a length of 0, because at this point
 	// we don't know how long it should be.
@@ -128,96 +200,135 @@ func (s *Server) getTabs() (tabs []*Tab, err error) {
 		return nil, err
 	}
 
+	// Keep a record of what happens to each of the files which have to be read
+	// from the disk, which is saved as an import job once they have all been
+	// dealt with, even if the function returns early because of an error. The
+	// changes are made by the scanner, as part of that job.
+	importJob := newJob("import")
+	scanner := jobActor(importJob)
+
+	defer func() {
+		if err != nil {
+			s.failJob(importJob, "The import stopped early: %s", err)
+		}
+
+		// Files which can't be parsed are tried again on every request, so a
+		// run which didn't change anything isn't saved, since otherwise they
+		// would quickly push everything else out of the history. A run which
+		// has been given an ID is always saved, since that means an event
+		// refers to it.
+		if importJob.ID == "" && importJob.Added == 0 && importJob.Updated == 0 && len(importJob.Errors) == 0 {
+			return
+		}
+
+		if err := s.saveJob(importJob); err != nil {
+			s.logMessage("error", "The import job could not be saved: %s", err)
+		}
+	}()
+
+	// Remove any cached tabs whose files have been deleted since they were
+	// cached, so they aren't returned any more. If the files have only gone
+	// because the tab directory isn't mounted, the cached tabs are returned
+	// as they are, since reading the directory would find nothing.
+	if _, err := s.pruneOrphans(filenames, scanner); err == errTabDirectoryUnmounted {
+		return s.cachedTabs()
+	} else if err != nil {
+		return nil, err
+	}
+
 	// Split the list of filenames into filenames which should be parsed from
 	// scratch and ones which have already been cached, again propogating any
 	// errors to the error return value of this function.
-	toProcess, cached, err := s.filterFilenames(filenames)
+	toProcess, cachedIDs, err := s.filterFilenames(filenames)
 	if err != nil {
 		return nil, err
 	}
 
-	// Iterate through the list of cached filenames, fetching the relavent data
-	// from the database and appending a new tab to 'tabs' for each cached item
-	for _, filename := range cached {
-		// Using the filenames hashmap in the database, find the ID corresponding
-		// to the current cached filename, which can be used to find the tab data
-		id, err := s.Database.HGet("filenames", filename).Result()
-		if err != nil {
-			return nil, err
-		}
+	// If none of the files have been cached, the store might have lost the
+	// tabs, such as if Redis has been flushed while the server is running,
+	// so they are put back from the manifest first to keep their IDs.
+	if len(cachedIDs) == 0 && len(toProcess) > 0 {
+		if restored, err := s.restoreFromManifest(); err != nil {
+			fmt.Println("warning: failed to restore the tabs from the manifest:", err)
+		} else if restored > 0 {
+			fmt.Printf("Restored %d tabs from the manifest.\n", restored)
 
-		// Fetch the tab with the ID from the database. If there is an error, return
-		// that error from the getTabs function, if the tab doesn't exist, something
-		// weird has happened so give the server a message saying that it should not
-		// happen and should be debugged. Otherwise, append the tab to the tab list.
-		tab, ok, err := s.fetchTab(id)
-		if err != nil {
-			return nil, err
-		} else if !ok {
-			fmt.Println("this point shouldn't be reached (Server.getTabs)")
-		} else {
-			tabs = append(tabs, tab)
+			if toProcess, cachedIDs, err = s.filterFilenames(filenames); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	// Convert the filename pattern from the settings into a list of tokens which
+	// Convert the filename patterns from the settings into lists of tokens which
 	// will be used to parse and extract the metadata from each of the filenames.
-	tokens := tokenizePattern(s.Settings.FilenamePattern)
-
-	// Iterate through the list of filenames which need to be parsed from the disk,
-	// for each one reading the file and extracting the metadata from the filename.
-	for _, filename := range toProcess {
-		// Extract the title, artist name, and list of tags from the filename, using
-		// the tokens lexed from the filename pattern earlier. If there is no parse,
-		// log a message to the server and skip to the next filename in the list.
-		title, artist, tags, ok := parseFilename(
-			strings.TrimSuffix(filename, filepath.Ext(filename)),
-			tokens,
-		)
-		if !ok {
-			fmt.Printf("The filename %s could not be parsed.\n", filename)
-			continue
-		}
+	patterns := tokenizePatterns(s.Settings.FilenamePatterns)
 
-		// Read the content of the file. If the file does not exist, and error will
-		// be returned and the function will exit early. The content is returned from
-		// this function as a list of bytes representing the characters instead of a
-		// string so it is converted to a string when the tab is created. Another thing
-		// to note is that the filepath of the file is calculated by joining the tab
-		// directory and the current filename, where the join function inserts a /
-		// or a \ between the two arguments based on the system on which it's running.
-		content, err := ioutil.ReadFile(filepath.Join(s.Settings.TabDirectory, filename))
-		if err != nil {
-			return nil, err
-		}
-
-		// Construct the tab instance, excluding the ID as this will be added when
-		// cacheNewTab is called.
-		tab := &Tab{
-			Title:    title,
-			Artist:   artist,
-			Tags:     tags,
-			Filename: filename,
-			Content:  string(content),
-		}
-
-		// Write the tab to the database and if there is an error, skip to the
-		// next filename to process, not adding this tab to the list of tabs.
-		// Also, write the error to the console.
-		if err := s.cacheNewTab(tab); err != nil {
-			fmt.Printf(
-				"The tab with filename %s could not be added to the database: %s\n",
-				filename,
-				err,
-			)
+	// Fetch all of the cached tabs from the database at once. If there is an
+	// error, return that error from the getTabs function. If any of the tabs
+	// don't exist, something weird has happened, so give the server a message
+	// saying that it should not happen and should be debugged.
+	cached, err := s.Store.GetTabs(cachedIDs)
+	if err != nil {
+		return nil, err
+	} else if len(cached) != len(cachedIDs) {
+		fmt.Println("this point shouldn't be reached (Server.getTabs)")
+	}
 
-			continue
+	for _, tab := range cached {
+		// Check whether the file has been edited since it was cached, and if it
+		// has, use the new version of the tab instead. If the file can't be read
+		// any more, the old version is still returned.
+		fresh, updated, err := s.refreshTab(tab, patterns, scanner)
+		if err != nil {
+			s.failJob(importJob, "The tab with filename %s could not be refreshed: %s", tab.Filename, err)
+		} else if updated {
+			tab = fresh
+			importJob.Updated++
 		}
 
-		// Append the tab to the list of tabs.
+		// Append the tab to the tab list.
 		tabs = append(tabs, tab)
 	}
 
+	// Parse the files which need to be read from the disk using a pool of
+	// workers, since reading and caching them one at a time is slow for big
+	// collections. The results are put in the same order as toProcess, so
+	// the tabs come out in the same order each time.
+	results, err := s.processFiles(ctx, toProcess, patterns, scanner)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, result := range results {
+		switch {
+		case result.readErr != nil:
+			// The file couldn't be read, so it is left out this time and
+			// tried again on the next scan, without stopping the others.
+			s.failJob(importJob, "The file %s could not be read: %s", toProcess[i], result.readErr)
+
+		case result.err != nil:
+			// The tab couldn't be written to the database, so skip to the
+			// next one, not adding this tab to the list of tabs.
+			s.failJob(
+				importJob,
+				"The tab with filename %s could not be added to the database: %s",
+				toProcess[i],
+				result.err,
+			)
+
+		case result.tab == nil:
+			importJob.Skipped++
+
+		default:
+			tabs = append(tabs, result.tab)
+			importJob.Added++
+		}
+	}
+
+	// Keep the tabs in memory before the transformations are applied, since
+	// the settings might change before they're used again.
+	s.rememberTabs(tabs)
+
 	for _, tab := range tabs {
 		tab.applyTransformations(s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
 	}
@@ -225,45 +336,421 @@ func (s *Server) getTabs() (tabs []*Tab, err error) {
 	return
 }
 
-func (s *Server) deleteTab(id string) error {
-	// Fetch the filename of the tab with the specified ID, so the filename-ID
-	// mapping can later be removed from the filename-ID hashmap.
-	filename, err := s.Database.HGet(fmt.Sprintf("tab:%s", id), "filename").Result()
+// parseWorkers is the number of files which processFiles reads and caches at
+// the same time.
+const parseWorkers = 8
+
+// A fileResult is what happened to one of the files given to processFiles.
+// If the filename couldn't be parsed, tab and both errors are nil. If the
+// file couldn't be read, readErr says why, and if the tab couldn't be cached,
+// err does.
+type fileResult struct {
+	tab     *Tab
+	readErr error
+	err     error
+}
+
+// processFiles reads, parses and caches each of the files with the given
+// filenames on behalf of the given actor, using parseWorkers goroutines at
+// once, and returns what happened to each of them in the same order as the
+// filenames. An error reading or caching one file only affects that file, so
+// the others carry on, but if the context is cancelled, the remaining files
+// are abandoned and its error is returned. Any tabs which were cached before
+// that will still be there next time.
+func (s *Server) processFiles(ctx context.Context, filenames []string, patterns []filenamePattern, by actor) ([]fileResult, error) {
+	var (
+		results = make([]fileResult, len(filenames))
+
+		// indexes hands out the positions of the files to the workers.
+		indexes = make(chan int)
+
+		wg sync.WaitGroup
+	)
+
+	for w := 0; w < parseWorkers; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				// Read the tab from its file, noting any error against
+				// this file. If the filename couldn't be parsed, the result
+				// is left empty.
+				tab, ok, err := s.readTab(filenames[i], patterns)
+				if err != nil {
+					results[i].readErr = err
+					continue
+				} else if !ok {
+					continue
+				}
+
+				// Write the tab to the database, noting any error against
+				// this tab so the others can carry on.
+				if err := s.cacheNewTab(tab, by); err != nil {
+					results[i].err = err
+					continue
+				}
+
+				results[i].tab = tab
+			}
+		}()
+	}
+
+	// Hand out the files until they've all been taken or the context is
+	// cancelled, for example because the client which asked for the tabs
+	// has gone away.
+feed:
+	for i := range filenames {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(indexes)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// parseTabFilename extracts the title, artist name, and list of tags from a
+// tab's filename, using the tokens lexed from the filename patterns, trying
+// each pattern in turn, and returns the pattern which matched. Only the name
+// of the file itself is parsed, but the names of the folders it's in are used
+// as extra metadata if the settings say to. If no pattern matches, ok is
+// false.
+func (s *Server) parseTabFilename(filename string, patterns []filenamePattern) (title, artist string, tags []string, pattern string, ok bool) {
+	return parseTabFilename(filename, patterns, s.Settings.FolderMetadata)
+}
+
+// parseTabFilename parses a tab's filename in the same way as the server's
+// method, but with the given folder metadata option rather than the one from
+// the settings.
+func parseTabFilename(filename string, patterns []filenamePattern, folderMetadata string) (title, artist string, tags []string, pattern string, ok bool) {
+	name := path.Base(filename)
+
+	for _, p := range patterns {
+		title, artist, tags, ok = parseFilename(
+			strings.TrimSuffix(name, path.Ext(name)),
+			p.matcher,
+		)
+
+		if ok {
+			pattern = p.pattern
+			break
+		}
+	}
+
+	if !ok {
+		return "", "", nil, "", false
+	}
+
+	folders := tabFolders(filename)
+
+	switch folderMetadata {
+	case folderMetadataTags:
+		tags = addTags(tags, folders)
+
+	case folderMetadataArtist:
+		if len(folders) > 0 {
+			artist = folders[0]
+			tags = addTags(tags, folders[1:])
+		}
+	}
+
+	return title, artist, tags, pattern, true
+}
+
+// readTab reads the file with the given filename from the tab directory and
+// parses its filename using the first of the given patterns (which will
+// probably have been returned from tokenizePatterns) which it matches,
+// returning a new tab without an ID. If the filename doesn't match any of
+// the patterns, the second return value will be false.
+func (s *Server) readTab(filename string, patterns []filenamePattern) (*Tab, bool, error) {
+	name := path.Base(filename)
+	title, artist, tags, pattern, parsed := s.parseTabFilename(filename, patterns)
+
+	// A MusicXML score says what it's called, so a file which looks like one
+	// is still read if its filename can't be parsed, and is given its name
+	// as its title until the score says otherwise.
+	if !parsed {
+		if !musicXMLExtensions[strings.ToLower(path.Ext(name))] {
+			s.logMessage("warn", "The filename %s could not be parsed.", filename)
+			return nil, false, nil
+		}
+
+		title = strings.TrimSuffix(name, path.Ext(name))
+	}
+
+	// Read the content of the file. If the file does not exist, and error will
+	// be returned. The content is returned from this function as a list of bytes
+	// representing the characters instead of a string so it is converted to a
+	// string when the tab is created. Another thing to note is that the filepath
+	// of the file is calculated by joining the tab directory and the filename,
+	// where tabPath inserts a / or a \ between the folders based on the system
+	// on which it's running.
+	filePath := s.tabPath(filename)
+
+	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
-	// Delete the tab's data hashmap and its tags set, returning any errors which
-	// are encountered.
-	if err := s.Database.Del(
-		fmt.Sprintf("tab:%s", id),
-		fmt.Sprintf("tab:%s:tags", id)).Err(); err != nil {
-		return err
+	// Find out when the file was last modified, which is used as the date
+	// that the tab was added to the collection.
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, false, err
 	}
 
-	// Remove the tab's ID from the ID set, meaning that it will no longer be
-	// included when looking up the list of all tabs.
-	if err := s.Database.SRem("tabs", id).Err(); err != nil {
-		return err
+	// Construct the tab instance, excluding the ID as this will be added when
+	// cacheNewTab is called.
+	tab := &Tab{
+		Title:    title,
+		Artist:   artist,
+		Tags:     tags,
+		Filename: filename,
+		Pattern:  pattern,
+		Added:    info.ModTime(),
+		Modified: info.ModTime(),
+	}
+
+	// If a binary file's metadata can't be read, the tab is still kept,
+	// with what the filename says.
+	if err := tab.setContent(content); err != nil {
+		s.logMessage("warn", "warning: the %s file %s couldn't be read: %s", tab.Format, filename, err)
+	}
+
+	if !parsed && !isMusicXMLFormat(tab.Format) {
+		s.logMessage("warn", "The filename %s could not be parsed.", filename)
+		return nil, false, nil
+	}
+
+	// Add the tags from the admin's auto-tag rules, before the transform
+	// script runs so that it can see them.
+	tab.applyAutoTags(s.Settings.AutoTagRules)
+
+	// Run the admin's transform script on the tab, if there is one. If it
+	// fails, the tab is kept as it was read rather than being left out, so a
+	// mistake in the script can't make tabs disappear.
+	transformed := *tab
+	if err := s.transformTab(&transformed); err != nil {
+		s.logMessage("warn", "warning: the transform script failed on %s: %s", filename, err)
+	} else {
+		tab = &transformed
+	}
+
+	// Rename, merge or delete the tags which the admin has changed across
+	// the collection, since the filename still has the old ones.
+	if tab.Tags, err = s.applyTagRules(tab.Tags); err != nil {
+		return nil, false, err
+	}
+
+	return tab, true, nil
+}
+
+// setContent sets the fields of a tab which come from its file's content: its
+// content hash and format, and either its content and the things detected
+// from it, or, for a binary file such as a Guitar Pro file, which isn't kept
+// as the tab's content, the title, artist and tuning read from it. An error
+// is returned if a binary file's metadata can't be read, in which case the
+// tab is left with the title and artist it already had.
+func (tab *Tab) setContent(content []byte) error {
+	tab.ContentHash = HashContent(content)
+	tab.Format = detectBinaryFormat(content)
+
+	if tab.Format != "" {
+		tab.Binary = true
+		return tab.applyBinaryMetadata(content)
+	}
+
+	tab.Content = string(content)
+	tab.Language = detectLanguage(tab.Content)
+	tab.Explicit = detectExplicit(tab.Content)
+	tab.Tuning, tab.Capo = detectTuning(tab.Content)
+	tab.Chords = detectChords(tab.Content)
+
+	return nil
+}
+
+// refreshTab checks whether the file of a cached tab has changed since it was
+// cached. Its modification time is checked first, and only if that differs is
+// the file read again and its content hash compared, so unchanged files cost
+// no more than a stat. If the content has changed, the file is parsed again,
+// the cached tab is updated on behalf of the given actor, and the new tab is
+// returned with updated = true.
+func (s *Server) refreshTab(tab *Tab, patterns []filenamePattern, by actor) (fresh *Tab, updated bool, err error) {
+	info, err := os.Stat(s.tabPath(tab.Filename))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if info.ModTime().Equal(tab.Modified) {
+		return tab, false, nil
+	}
+
+	fresh, ok, err := s.readTab(tab.Filename, patterns)
+	if err != nil {
+		return nil, false, err
+	} else if !ok {
+		return nil, false, fmt.Errorf("the filename %s no longer matches any of the patterns", tab.Filename)
+	}
+
+	// If only the modification time has changed, such as when a file has
+	// been saved without any changes, just remember the new time so the file
+	// isn't read again next time.
+	if fresh.ContentHash == tab.ContentHash {
+		tab.Modified = fresh.Modified
+		return tab, false, s.Store.SetModified(tab.ID, fresh.Modified)
+	}
+
+	if err := s.updateCachedTab(tab.ID, fresh, by); err != nil {
+		return nil, false, err
+	}
+
+	return fresh, true, nil
+}
+
+// deleteTab removes the tab with the given ID from the database and deletes
+// its file from the tab directory, on behalf of the given actor. If the trash
+// is being used, the file is moved into it instead, as described in trash.go.
+func (s *Server) deleteTab(id string, by actor) error {
+	if s.Settings.TrashDays > 0 {
+		return s.trashTab(id, by)
 	}
 
-	// Delete the filename from the hashmap in the database which maps the filenames
-	// to their tab IDs.
-	if err := s.Database.HDel("filenames", filename).Err(); err != nil {
+	// Take the tab out of the database, keeping hold of it so its file can be
+	// found afterwards.
+	tab, err := s.uncacheTab(id, by)
+	if err != nil {
 		return err
 	}
 
 	// Remove the file from the filesystem, calculating it's filepath relative to
 	// the working directory as <tab-directory>/<filename>.
-	if err := os.Remove(filepath.Join(s.Settings.TabDirectory, filename)); err != nil {
+	if err := os.Remove(s.tabPath(tab.Filename)); err != nil {
 		return err
 	}
 
+	return nil
+}
+
+// uncacheTab removes the tab with the given ID from the database, but leaves
+// its file alone. The removal is recorded as being made by the given actor.
+// The removed tab is returned.
+func (s *Server) uncacheTab(id string, by actor) (*Tab, error) {
+	// Fetch the tab with the specified ID, so the filename-ID mapping can
+	// later be removed from the filename-ID hashmap and the tab can be taken
+	// out of the statistics.
+	tab, ok, err := s.Store.GetTab(id)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("no tab with the ID %s", id)
+	}
+
+	// Take the tab out of the search index, which needs its set of trigrams
+	// so has to happen before the tab itself is deleted.
+	if err := s.unindexTab(id); err != nil {
+		return nil, err
+	}
+
+	// Delete the tab's data and tags, along with its ID and the mapping from
+	// its filename to its ID, so it will no longer be included when looking
+	// up the list of all tabs.
+	if err := s.Store.DeleteTab(id); err != nil {
+		return nil, err
+	}
+
+	// Take the tab out of the dated counters used for the statistics.
+	if err := s.recordStats(tab, -1); err != nil {
+		return nil, err
+	}
+
+	if err := s.removeFromBrowseIndex(tab); err != nil {
+		return nil, err
+	}
+
+	if err := s.removeFromSetlists(id); err != nil {
+		return nil, err
+	}
+
+	if err := s.unfulfilSongRequests(id); err != nil {
+		return nil, err
+	}
+
+	if err := s.replaceRecordingTab(id, ""); err != nil {
+		return nil, err
+	}
+
+	if err := s.Store.DeleteEditLock(id); err != nil {
+		return nil, err
+	}
+
+	if err := s.bumpCollectionVersion(); err != nil {
+		return nil, err
+	}
+
+	s.publishEvent(eventTabDeleted, by, tabEventData(tab))
+
 	// At this point, the tab has been completely removed from the database, as if
 	// it were never there. So, the function has completed successfully and can
 	// return a nil error meaning that there was no problem.
+	return tab, nil
+}
 
-	return nil
+// pruneOrphans removes every cached tab whose file isn't in the given list of
+// filenames, which will usually have come from tabFilenames. This happens when
+// a file is deleted while the server isn't running to notice. The tabs are
+// removed on behalf of the given actor, and the number which were removed is
+// returned.
+//
+// If the tab directory doesn't look mounted, nothing is removed, and
+// errTabDirectoryUnmounted is returned.
+func (s *Server) pruneOrphans(filenames []string, by actor) (int, error) {
+	// Put the filenames into a set, so each cached filename can be looked up
+	// quickly rather than searching through the list each time.
+	onDisk := make(map[string]bool, len(filenames))
+	for _, filename := range filenames {
+		onDisk[filename] = true
+	}
+
+	// The filenames hashmap maps the filename of every cached tab to its ID.
+	cached, err := s.Store.Filenames()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+
+	for filename, id := range cached {
+		if onDisk[filename] {
+			continue
+		}
+
+		// Only check that the directory is mounted once something would
+		// actually be removed, since that's the only time it matters.
+		if removed == 0 {
+			if err := s.checkMounted(); err != nil {
+				return 0, err
+			}
+		}
+
+		if _, err := s.uncacheTab(id, by); err != nil {
+			return removed, err
+		}
+
+		s.logMessage("info", "The file %s no longer exists, so it has been removed from the cache.", filename)
+		removed++
+	}
+
+	return removed, nil
 }
 
 // validatePassword gets the password from the given form field (specified in the
@@ -273,14 +760,14 @@ func (s *Server) validatePassword(r *http.Request, passwordField string) (int, e
 	// If the request method isn't POST, send an error back to the client
 	// telling them that only POST will work, with a Method Nod Allowed status.
 	if r.Method != "POST" {
-		return http.StatusMethodNotAllowed, errors.New("only POST is supported")
+		return http.StatusMethodNotAllowed, errOnlyPOST
 	}
 
 	// Get the entered password from the request form and fetch the hash of the
 	// password from the database.
 	var (
 		enteredPassword = r.PostFormValue(passwordField)
-		actualHash, err = s.Database.Get("password-hash").Result()
+		actualHash, err = s.Store.PasswordHash()
 	)
 
 	// If there is an error while fetching the password's hash from the
@@ -301,8 +788,20 @@ func (s *Server) validatePassword(r *http.Request, passwordField string) (int, e
 	// If the requested hash is not equal to the actual hash of the
 	// password, send an error telling the client exactly that, with
 	// a Bad Request status code.
+	//
+	// The failure is also counted against the client's IP address, so that
+	// it will be locked out if it keeps guessing.
 	if requestHash != actualHash {
-		return http.StatusBadRequest, errors.New("wrong password")
+		if err := s.recordFailedLogin(r); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		return http.StatusBadRequest, errWrongPassword
+	}
+
+	// The right password was entered, so forget any previous wrong ones.
+	if err := s.clearFailedLogins(r); err != nil {
+		return http.StatusInternalServerError, err
 	}
 
 	// No problems have come up so just return no error, along with an OK
@@ -310,98 +809,341 @@ func (s *Server) validatePassword(r *http.Request, passwordField string) (int, e
 	return http.StatusOK, nil
 }
 
+// settingBool returns the value of a setting in a request's form which is
+// given as "true" or "false", or current if it isn't given. An error with the
+// invalid_setting code is returned if it is anything else.
+func settingBool(r *http.Request, name string, current bool) (bool, error) {
+	switch value := r.PostFormValue(name); value {
+	case "":
+		return current, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, invalidSetting("the %s setting must be \"true\" or \"false\", not %q", name, value)
+	}
+}
+
 // changeSettings updates the server's settings, both in the database and also in
 // the Settings instance in s.Settings. An error will be returned if there is a
-// problem communicating with the database.
+// problem communicating with the database, or one with the invalid_setting
+// code if one of the new settings is invalid.
 func (s *Server) changeSettings(r *http.Request) error {
 	// Get all of the new settings values from the request form, except from
 	// non-capital-words. The set of non capital words is initialised as an empty
 	// list of strings.
 	var (
 		tabDirectory       = r.PostFormValue("tab-directory")
-		filenamePattern    = r.PostFormValue("filename-pattern")
+		filenamePatterns   = make([]string, 0)
 		nonCapitalWords    = make([]string, 0)
 		charactersToRemove = r.PostFormValue("characters-to-remove")
+		folderMetadata     = s.Settings.FolderMetadata
+		scanDepth          = s.Settings.ScanDepth
+		tabCacheTTL        = s.Settings.TabCacheTTL
 	)
 
+	// The scan depth is optional, and kept if it isn't given, so that older
+	// clients which don't know about it can still change the other settings.
+	if depth := r.PostFormValue("scan-depth"); depth != "" {
+		var err error
+		if scanDepth, err = strconv.Atoi(depth); err != nil {
+			return invalidSetting("the scan depth must be a whole number, at least 0")
+		}
+	}
+
+	// So is the folder metadata mode, which can be empty to take nothing
+	// from the folders, so it is only kept if it isn't in the form at all.
+	if _, ok := r.PostForm["folder-metadata"]; ok {
+		folderMetadata = r.PostFormValue("folder-metadata")
+	}
+
+	// So is the tab cache TTL, in seconds.
+	if ttl := r.PostFormValue("tab-cache-ttl"); ttl != "" {
+		var err error
+		if tabCacheTTL, err = strconv.Atoi(ttl); err != nil {
+			return invalidSetting("the tab cache TTL must be a whole number of seconds, at least 0")
+		}
+	}
+
+	// Hiding explicit tabs is optional too, and given as "true" or "false".
+	hideExplicit, err := settingBool(r, "hide-explicit", s.Settings.HideExplicit)
+	if err != nil {
+		return err
+	}
+
+	// So is the stale serving mode.
+	serveStale, err := settingBool(r, "serve-stale", s.Settings.ServeStale)
+	if err != nil {
+		return err
+	}
+
+	// The transform script is optional too, and is kept if it isn't given.
+	transformScript := s.Settings.TransformScript
+
+	if _, ok := r.PostForm["transform-script"]; ok {
+		transformScript = r.PostFormValue("transform-script")
+	}
+
+	// So is how long it can run for on each tab, in milliseconds.
+	transformScriptTimeout := s.Settings.TransformScriptTimeout
+
+	if timeout := r.PostFormValue("transform-script-timeout"); timeout != "" {
+		var err error
+		if transformScriptTimeout, err = strconv.Atoi(timeout); err != nil {
+			return invalidSetting("the transform script timeout must be a whole number of milliseconds, from 1 to %d", maxTransformScriptTimeout)
+		}
+	}
+
+	// Public mode is optional, and given as "true" or "false", and the
+	// allowed licenses are JSON-encoded like the ignore patterns, and kept
+	// if they aren't given.
+	publicMode := s.Settings.PublicMode
+
+	if value := r.PostFormValue("public-mode"); value != "" {
+		publicMode = value == "true"
+	}
+
+	allowedLicenses := s.Settings.AllowedLicenses
+
+	if _, ok := r.PostForm["allowed-licenses"]; ok {
+		licenses := make([]string, 0)
+
+		if err := json.Unmarshal(
+			[]byte(r.PostFormValue("allowed-licenses")), &licenses,
+		); err != nil {
+			return invalidSetting("the allowed licenses are invalid: %s", err)
+		}
+
+		allowedLicenses = make([]string, 0, len(licenses))
+		for _, license := range licenses {
+			if license = strings.TrimSpace(license); license != "" {
+				allowedLicenses = append(allowedLicenses, license)
+			}
+		}
+	}
+
+	// Open mic mode is optional too, and given in the same way.
+	openMic := s.Settings.OpenMic
+
+	if value := r.PostFormValue("open-mic"); value != "" {
+		openMic = value == "true"
+	}
+
+	// The access mode is optional too, and is one of the access constants.
+	accessMode := s.Settings.AccessMode
+
+	if value := r.PostFormValue("access-mode"); value != "" {
+		accessMode = value
+	}
+
+	// So is the number of days deleted tabs are kept in the trash for.
+	trashDays := s.Settings.TrashDays
+
+	if value := r.PostFormValue("trash-days"); value != "" {
+		var err error
+		if trashDays, err = strconv.Atoi(value); err != nil {
+			return invalidSetting("the trash days must be a whole number, at least 0")
+		}
+	}
+
+	// The auto-tag rules are a JSON-encoded list of objects, and are
+	// optional too.
+	autoTagRules := s.Settings.AutoTagRules
+
+	if _, ok := r.PostForm["auto-tag-rules"]; ok {
+		autoTagRules = make([]AutoTagRule, 0)
+
+		if err := json.Unmarshal(
+			[]byte(r.PostFormValue("auto-tag-rules")), &autoTagRules,
+		); err != nil {
+			return invalidSetting("the auto-tag rules are invalid: %s", err)
+		}
+
+		for i, rule := range autoTagRules {
+			autoTagRules[i].Tag = strings.TrimSpace(rule.Tag)
+		}
+	}
+
+	// The ignore patterns are JSON-encoded in the same way as the non-capital
+	// words, but they are optional, and the existing ones are kept if they
+	// aren't given.
+	ignorePatterns := s.Settings.IgnorePatterns
+
+	if _, ok := r.PostForm["ignore-patterns"]; ok {
+		ignorePatterns = make([]string, 0)
+
+		if err := json.Unmarshal(
+			[]byte(r.PostFormValue("ignore-patterns")), &ignorePatterns,
+		); err != nil {
+			return invalidSetting("the ignore patterns are invalid: %s", err)
+		}
+	}
+
+	// The filename patterns are JSON-encoded too, in the order they should be
+	// tried in. Older clients send a single pattern instead.
+	if _, ok := r.PostForm["filename-patterns"]; ok {
+		if err := json.Unmarshal(
+			[]byte(r.PostFormValue("filename-patterns")), &filenamePatterns,
+		); err != nil {
+			return invalidSetting("the filename patterns are invalid: %s", err)
+		}
+	} else {
+		filenamePatterns = append(filenamePatterns, r.PostFormValue("filename-pattern"))
+	}
+
+	patterns := make([]string, 0, len(filenamePatterns))
+	for _, pattern := range filenamePatterns {
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	filenamePatterns = patterns
+
 	// Parse the JSON-encoded non-capital-words into the nonCapitalWords list,
 	// returning an error if the JSON data is malformed.
 	if err := json.Unmarshal(
 		[]byte(r.PostFormValue("non-capital-words")), &nonCapitalWords,
 	); err != nil {
-		return err
+		return invalidSetting("the non-capital words are invalid: %s", err)
 	}
 
-	// Use the MSET command (sets multiple scalar values) to set the new settings
-	// data into the database.
-	if err := s.Database.MSet(
-		"tab-directory", tabDirectory,
-		"filename-pattern", filenamePattern,
-		"characters-to-remove", charactersToRemove,
-	).Err(); err != nil {
-		return err
+	settings := &Settings{
+		CharactersToRemove: charactersToRemove,
+		FilenamePatterns:   filenamePatterns,
+		NonCapitalWords:    nonCapitalWords,
+		PasswordHash:       s.Settings.PasswordHash,
+		TabDirectory:       tabDirectory,
+		ScanDepth:          scanDepth,
+		FolderMetadata:     folderMetadata,
+		IgnorePatterns:     ignorePatterns,
+		HideExplicit:       hideExplicit,
+		TabCacheTTL:        tabCacheTTL,
+		ServeStale:         serveStale,
+
+		TransformScript:        transformScript,
+		TransformScriptTimeout: transformScriptTimeout,
+		PublicMode:             publicMode,
+		AllowedLicenses:        allowedLicenses,
+		AutoTagRules:           autoTagRules,
+		OpenMic:                openMic,
+		AccessMode:             accessMode,
+		TrashDays:              trashDays,
 	}
 
-	// Remove the database's set of non capital words in preparation for when
-	// the new non-capital-words will be added.
-	if err := s.Database.Del("non-capital-words").Err(); err != nil {
+	// Every setting is checked once they have all been read, in the same
+	// way as the settings from anywhere else.
+	if err := settings.validate(); err != nil {
 		return err
 	}
 
-	// Create a list of type []interface{} containing the same data as
-	// nonCapitalWords but in the correct type to pass to the SADD command below.
-	nonCapitalWordsI := make([]interface{}, len(nonCapitalWords))
+	return s.applySettings(settings, s.requestActor(r))
+}
 
-	for i, s := range nonCapitalWords {
-		nonCapitalWordsI[i] = interface{}(s)
+// applySettings replaces the settings with new ones, which have already been
+// checked, on behalf of the given actor. Everything which depends on the
+// settings is told about the change, and the file watcher is pointed at the
+// new tab directory.
+func (s *Server) applySettings(settings *Settings, by actor) error {
+	// Store the new settings, returning any error which comes up.
+	if err := s.Store.SaveSettings(settings); err != nil {
+		return err
 	}
 
-	// Use the SADD command to add each of the non capital words to the database's
-	// non-capital-words set.
-	if err := s.Database.SAdd("non-capital-words", nonCapitalWordsI...).Err(); err != nil {
+	// The settings affect how the tabs are parsed and displayed, so changing
+	// them counts as a change to the collection.
+	if err := s.bumpCollectionVersion(); err != nil {
 		return err
 	}
 
 	// Now the database has been fully updated, also update the in-memory settings
 	// values to the new values.
-	s.Settings = &Settings{
-		CharactersToRemove: charactersToRemove,
-		FilenamePattern:    filenamePattern,
-		NonCapitalWords:    nonCapitalWords,
-		PasswordHash:       s.Settings.PasswordHash,
-		TabDirectory:       tabDirectory,
+	s.Settings = settings
+
+	// The tabs might have been put in memory again using the old settings
+	// since the collection version was bumped, so mark them as out of date
+	// again.
+	s.forgetTabs()
+
+	s.publishEvent(eventSettingsChanged, by, nil)
+	s.queueHook(hookPostSettingsChange, map[string]interface{}{
+		"actor":    by,
+		"settings": settingsHookData(settings),
+	})
+
+	// Point the file watcher at the new tab directory, and the folders in it
+	// which the new settings include. If it can't be watched, the settings
+	// are still changed, but changes to the files won't be noticed until the
+	// cache is reset.
+	if err := s.watchDirectory(settings.TabDirectory, settings.ScanDepth); err != nil {
+		fmt.Println("warning: failed to watch the new tab directory:", err)
 	}
 
 	return nil
 }
 
-// resetCache removes all tabs from the database, meaning they will have to be
-// reloaded when the first request is made.
-func (s *Server) resetCache() error {
-	// Remove all keys in the database with the prefix tab:*.
-	// If there is an error, it will be returned as a HTTP error
-	// with the status code 500, or Internal Server Error.
-	if err := s.Database.Eval(
-		`return redis.call('del', unpack(redis.call('keys', ARGV[1])))`,
-		nil, "tab:*",
-	).Err(); err != nil {
-		return err
+// A resetSummary says how much was removed when the cache was reset.
+type resetSummary struct {
+	// Tabs is the number of tabs which were removed from the store.
+	Tabs int `json:"tabs"`
+
+	// SearchKeys, BrowseKeys and StatsKeys are the numbers of keys which
+	// were removed from the database for the search index, the browse index
+	// and the statistics.
+	SearchKeys int64 `json:"searchKeys"`
+	BrowseKeys int64 `json:"browseKeys"`
+	StatsKeys  int64 `json:"statsKeys"`
+}
+
+// resetCache removes all tabs from the database on behalf of the given actor,
+// meaning they will have to be reloaded when the first request is made. It
+// returns a summary of what was removed.
+func (s *Server) resetCache(by actor) (*resetSummary, error) {
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	summary := &resetSummary{}
+
+	// The tabs are counted first, since the store can't say how many it
+	// removed.
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		return nil, err
 	}
 
-	// Empty the tab ID list and the filename-ID map.
-	// If there is an error, it will be returned as a HTTP error
-	// with the status code 500, or Internal Server Error.
-	if err := s.Database.Del("tabs", "filenames").Err(); err != nil {
-		return err
+	summary.Tabs = len(ids)
+
+	// Remove the search index, all of the tabs from the store, and the
+	// browse index, which will be rebuilt as the tabs are cached again. If
+	// there is an error, it will be returned as a HTTP error with the status
+	// code 500, or Internal Server Error.
+	//
+	// The search index goes first, since each tab's trigrams are kept in a
+	// tab:ID:trigrams key, which the store would remove without them being
+	// counted.
+	if summary.SearchKeys, err = s.resetSearchIndex(); err != nil {
+		return nil, err
 	}
 
-	// Reset the tab counter to 0, so the next tab will be
-	// assigned the ID of (0 + 1) = 1.
-	// If there is an error, it will be returned as a HTTP error
-	// with the status code 500, or Internal Server Error.
-	if err := s.Database.Set("tab-counter", 0, 0).Err(); err != nil {
-		return err
+	if err := s.Store.ResetTabs(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	if summary.BrowseKeys, err = s.resetBrowseIndex(); err != nil {
+		return nil, err
+	}
+
+	// The statistics are counted as the tabs are cached, so they must be
+	// reset too otherwise every tab would be counted twice.
+	if summary.StatsKeys, err = s.resetStats(); err != nil {
+		return nil, err
+	}
+
+	if err := s.bumpCollectionVersion(); err != nil {
+		return nil, err
+	}
+
+	s.publishEvent(eventCollectionReset, by, summary)
+	return summary, nil
 }
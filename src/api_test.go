@@ -0,0 +1,59 @@
+package src
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResetCacheSummary(t *testing.T) {
+	store := NewMemoryStore(DefaultSettings())
+	s := &Server{Store: store, Settings: DefaultSettings()}
+
+	for _, tab := range []*Tab{
+		{Title: "Waterloo", Artist: "Abba", Filename: "abba - waterloo.txt", Tags: []string{"pop"}, Added: time.Now()},
+		{Title: "SOS", Artist: "Abba", Filename: "abba - sos.txt", Added: time.Now()},
+	} {
+		if err := s.Store.PutTab(tab); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.indexTab(tab); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.addToBrowseIndex(tab); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.recordStats(tab, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each tab's own list of trigrams is counted along with the index
+	// itself, as the tab:ID:trigrams keys are in Redis.
+	searchKeys := int64(len(store.trigrams) + len(store.tabTrigrams))
+
+	summary, err := s.resetCache(actor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Tabs != 2 || summary.SearchKeys != searchKeys {
+		t.Errorf("expected 2 tabs and %d search keys to be removed, got %+v", searchKeys, summary)
+	}
+
+	if summary.BrowseKeys == 0 || summary.StatsKeys == 0 {
+		t.Errorf("expected the browse index and statistics to be removed, got %+v", summary)
+	}
+
+	// Nothing is left to be removed the second time.
+	again, err := s.resetCache(actor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *again != (resetSummary{}) {
+		t.Errorf("expected nothing to be removed again, got %+v", again)
+	}
+}
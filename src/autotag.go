@@ -0,0 +1,77 @@
+package src
+
+import (
+	"strings"
+)
+
+// These are the parts of a tab which an auto-tag rule can look in.
+const (
+	autoTagFilename = "filename"
+	autoTagTitle    = "title"
+	autoTagArtist   = "artist"
+	autoTagContent  = "content"
+)
+
+// An AutoTagRule adds a tag to every tab which has some text in one of its
+// parts, such as tagging every tab whose content mentions a capo with
+// "capo". The rules are part of the settings, and are checked whenever a
+// tab's file is read, so that new files are tagged consistently without
+// having to be named carefully.
+type AutoTagRule struct {
+	// Field is the part of the tab to look in, which is one of the
+	// autoTag constants.
+	Field string `json:"field"`
+
+	// Contains is the text to look for, ignoring case.
+	Contains string `json:"contains"`
+
+	// Tag is the tag which is added to the tabs which match.
+	Tag string `json:"tag"`
+}
+
+// validate returns an error if the rule can't be used.
+func (rule AutoTagRule) validate() error {
+	switch rule.Field {
+	case autoTagFilename, autoTagTitle, autoTagArtist, autoTagContent:
+	default:
+		return invalidSetting("unknown auto-tag field %q: it must be filename, title, artist or content", rule.Field)
+	}
+
+	if rule.Contains == "" {
+		return invalidSetting("each auto-tag rule needs some text to look for")
+	}
+
+	if strings.TrimSpace(rule.Tag) == "" {
+		return invalidSetting("each auto-tag rule needs a tag to add")
+	}
+
+	return nil
+}
+
+// matches reports whether the tab has the rule's text in the rule's field.
+func (rule AutoTagRule) matches(tab *Tab) bool {
+	var text string
+
+	switch rule.Field {
+	case autoTagFilename:
+		text = tab.Filename
+	case autoTagTitle:
+		text = tab.Title
+	case autoTagArtist:
+		text = tab.Artist
+	case autoTagContent:
+		text = tab.Content
+	}
+
+	return strings.Contains(strings.ToLower(text), strings.ToLower(rule.Contains))
+}
+
+// applyAutoTags adds the tag of each of the rules which the tab matches to
+// its tags.
+func (t *Tab) applyAutoTags(rules []AutoTagRule) {
+	for _, rule := range rules {
+		if rule.matches(t) {
+			t.Tags = addTags(t.Tags, []string{rule.Tag})
+		}
+	}
+}
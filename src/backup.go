@@ -0,0 +1,247 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The export and import commands back the collection up to a file and add it
+// to another server's, but they can only be run on the server's machine. The
+// same dump can be downloaded from /api/v1/export, and restored with
+// /api/v1/import, which puts the tabs back into the store with their IDs and
+// the admin's changes, such as after Redis has been flushed or when moving to
+// a new Redis instance. Unlike the import command, which writes new files and
+// caches them like any others, restoring expects the files to be on disk
+// already, unless it is asked to write them from the dump too.
+
+// A restoreSummary says what restoring a dump did.
+type restoreSummary struct {
+	// Restored is how many tabs were put back, and Skipped is how many
+	// weren't because their IDs or files were already cached, or their
+	// files don't match the filename patterns.
+	Restored int `json:"restored"`
+	Skipped  int `json:"skipped"`
+
+	// Missing is how many tabs weren't put back because their files
+	// weren't on disk, and FilesWritten is how many files were written
+	// from the dump.
+	Missing      int `json:"missing"`
+	FilesWritten int `json:"filesWritten"`
+
+	// Settings is whether the settings and tag rules were restored.
+	Settings bool `json:"settings"`
+}
+
+// restoreSettings replaces the settings and the tag rules with the ones from
+// a dump, on behalf of the given actor. The admin password and the tab
+// directory are kept as they are, since the password isn't in the dump, and
+// the tab directory is where the files are on this machine rather than the one
+// the dump came from. The settings are checked and applied in the same way as
+// ones from the settings page.
+func (s *Server) restoreSettings(settings *Settings, tagRules map[string]string, by actor) error {
+	restored := *settings
+	restored.PasswordHash = s.Settings.PasswordHash
+	restored.TabDirectory = s.Settings.TabDirectory
+
+	// Dumps from before there were access modes don't have one, and the
+	// collection was public then, and the same goes for the transform
+	// script timeout, which was the default.
+	if restored.AccessMode == "" {
+		restored.AccessMode = accessPublic
+	}
+
+	if restored.TransformScriptTimeout == 0 {
+		restored.TransformScriptTimeout = defaultTransformScriptTimeout
+	}
+
+	if err := restored.validate(); err != nil {
+		return err
+	}
+
+	if err := s.Store.ReplaceTagRules(tagRules); err != nil {
+		return err
+	}
+
+	return s.applySettings(&restored, by)
+}
+
+// writeRestoredFile writes a tab's file from a dump, replacing it if it's
+// already there, and gives it the date the tab was added.
+func (s *Server) writeRestoredFile(exported exportedTab) error {
+	filename, err := importFilename(exported.Filename)
+	if err != nil {
+		return err
+	}
+
+	content := []byte(exported.Content)
+	if exported.Binary {
+		if len(exported.File) == 0 {
+			return errors.New("the tab is binary, but its file wasn't exported")
+		}
+
+		content = exported.File
+	}
+
+	filePath := s.tabPath(filename)
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+		return err
+	}
+
+	if exported.Added.IsZero() {
+		return nil
+	}
+
+	return os.Chtimes(filePath, exported.Added, exported.Added)
+}
+
+// Restore puts the tabs from a library written by Export back into the store,
+// with the IDs, dates added and admin's changes they had, reading each one
+// from its file again. Tabs whose IDs or files are already cached are left
+// alone. If files is true, each tab's file is written from the dump first,
+// replacing what's on disk, and otherwise tabs whose files are missing are
+// left out. If settings is true, the settings and tag rules are restored
+// before any of the tabs, so that the files are read with them. The changes
+// are recorded as being made by the given actor.
+func (s *Server) Restore(lib *library, files, settings bool, by actor) (*restoreSummary, error) {
+	summary := &restoreSummary{}
+
+	if settings && lib.Settings != nil {
+		if err := s.restoreSettings(lib.Settings, lib.TagRules, by); err != nil {
+			return nil, err
+		}
+
+		summary.Settings = true
+	}
+
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	cached, err := s.Store.Filenames()
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := tokenizePatterns(s.Settings.FilenamePatterns)
+
+	for _, exported := range lib.Tabs {
+		if _, ok := cached[exported.Filename]; ok {
+			summary.Skipped++
+			continue
+		}
+
+		if _, ok, err := s.Store.GetTab(exported.ID); err != nil {
+			return summary, err
+		} else if ok {
+			summary.Skipped++
+			continue
+		}
+
+		if files {
+			if err := s.writeRestoredFile(exported); err != nil {
+				return summary, fmt.Errorf("%s: %s", exported.Filename, err)
+			}
+
+			summary.FilesWritten++
+		}
+
+		tab, ok, err := s.readTab(exported.Filename, patterns)
+		if os.IsNotExist(err) {
+			summary.Missing++
+			continue
+		} else if err != nil {
+			return summary, fmt.Errorf("%s: %s", exported.Filename, err)
+		} else if !ok {
+			summary.Skipped++
+			continue
+		}
+
+		entry := manifestEntry{
+			ID:               exported.ID,
+			Filename:         exported.Filename,
+			Added:            exported.Added,
+			ExplicitOverride: exported.ExplicitOverride,
+			ExtraTags:        exported.ExtraTags,
+			Source:           exported.Source,
+		}
+
+		if exported.Practice != (TabPractice{}) && exported.Practice.validate() == nil {
+			practice := exported.Practice
+			entry.Practice = &practice
+		}
+
+		if err := s.restoreTab(tab, entry); err != nil {
+			return summary, fmt.Errorf("%s: %s", exported.Filename, err)
+		}
+
+		cached[exported.Filename] = exported.ID
+		summary.Restored++
+	}
+
+	if summary.Restored == 0 {
+		return summary, nil
+	}
+
+	return summary, s.bumpCollectionVersion()
+}
+
+// handleExportAPI is called to respond to a HTTP request to /api/v1/export.
+// It responds with a dump of every cached tab, the settings and the tag rules,
+// encoded in JSON as an attachment, which can be restored with
+// /api/v1/import or imported with the import command.
+func (s *Server) handleExportAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"tab-server-%s.json\"", time.Now().Format("2006-01-02")))
+
+	// Once the dump has started to be written, an error can't be sent as
+	// a response any more, so it is only logged.
+	if err := s.Export(w); err != nil {
+		s.logMessage("warn", "warning: the export failed: %s", err)
+	}
+}
+
+// handleImportAPI is called to respond to a HTTP request to /api/v1/import.
+// It restores the dump in the request's body, which was written by
+// /api/v1/export or the export command, and responds with a summary of what
+// was restored, encoded in JSON. If the 'files' query value is "true", the
+// tabs' files are written from the dump, and if the 'settings' query value is
+// "true", the settings and tag rules are restored too.
+func (s *Server) handleImportAPI(w http.ResponseWriter, r *http.Request) {
+	lib, err := readLibrary(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("the dump couldn't be read: %s", err))
+		return
+	}
+
+	query := r.URL.Query()
+	by := s.requestActor(r)
+
+	summary, err := s.Restore(lib, query.Get("files") == "true", query.Get("settings") == "true", by)
+	if err != nil {
+		status := http.StatusInternalServerError
+
+		var coded *apiError
+		if errors.As(err, &coded) && coded.code == codeInvalidSetting {
+			status = http.StatusBadRequest
+		}
+
+		writeError(w, status, err)
+		return
+	}
+
+	s.publishEvent(eventCollectionRestored, by, summary)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,1018 @@
+package src
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Not every tab is text. Guitar Pro and Power Tab files hold a whole score,
+// with every note of every instrument, in a binary format which makes no sense
+// as a tab's content. They are recognised by how they start rather than by
+// their extensions, and are cached as binary tabs: they have no content, but
+// their title, artist and tuning are read from the file where the format
+// allows, and the file itself can be downloaded from /api/v1/tab/{id}/file to
+// be opened in the program which made it.
+const (
+	formatGuitarPro  = "guitar-pro"
+	formatGuitarPro3 = "guitar-pro-3"
+	formatGuitarPro4 = "guitar-pro-4"
+	formatGuitarPro5 = "guitar-pro-5"
+	formatGuitarPro6 = "guitar-pro-6"
+	formatGuitarPro7 = "guitar-pro-7"
+	formatPowerTab   = "power-tab"
+)
+
+// binaryContentTypes maps each binary format to the content type which its
+// files are downloaded with.
+var binaryContentTypes = map[string]string{
+	formatGuitarPro:  "application/x-guitar-pro",
+	formatGuitarPro3: "application/x-guitar-pro",
+	formatGuitarPro4: "application/x-guitar-pro",
+	formatGuitarPro5: "application/x-guitar-pro",
+	formatGuitarPro6: "application/x-guitar-pro",
+	formatGuitarPro7: "application/x-guitar-pro",
+	formatPowerTab:   "application/x-power-tab",
+
+	formatMusicXML:           musicXMLContentType,
+	formatCompressedMusicXML: "application/vnd.recordare.musicxml",
+}
+
+const (
+	// gpifPath is the path of the score inside a Guitar Pro 6 or 7 file,
+	// which is XML.
+	gpifPath = "Content/score.gpif"
+
+	// maxScoreSize is the most that a Guitar Pro 6 or 7 file's score is
+	// allowed to unpack to, so that a file which claims to be enormous
+	// can't use up the server's memory.
+	maxScoreSize = 64 << 20
+
+	// gpxSectorSize is the size of the sectors which a Guitar Pro 6 file
+	// is divided into once it has been unpacked.
+	gpxSectorSize = 0x1000
+)
+
+var (
+	// errBinaryTab is returned when a binary tab's content would have to be
+	// changed, such as by editing it or merging another tab's content into
+	// it.
+	errBinaryTab = newAPIError(codeBinaryTab, "the tab is a binary file, so its content can't be changed")
+
+	// errBadBinaryFile is returned when the metadata of a binary tab's file
+	// can't be read, because it is cut off or isn't laid out as expected.
+	errBadBinaryFile = errors.New("the file is cut off or laid out differently than expected")
+)
+
+// binaryMetadata is what can be read about a song from a binary tab's file.
+// Anything which the file doesn't say is left empty.
+type binaryMetadata struct {
+	Title  string
+	Artist string
+
+	// Tuning is the tuning of the file's first stringed instrument, in its
+	// standard form.
+	Tuning string
+
+	// Instruments are the names of the parts of the score, which only
+	// MusicXML files are read for.
+	Instruments []string
+}
+
+// detectBinaryFormat returns the binary format which a file's content is in,
+// or an empty string if it isn't in one.
+func detectBinaryFormat(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte("BCFZ")) || bytes.HasPrefix(content, []byte("BCFS")):
+		return formatGuitarPro6
+	case bytes.HasPrefix(content, []byte("ptab")):
+		return formatPowerTab
+	case bytes.HasPrefix(content, []byte("PK\x03\x04")):
+		// Guitar Pro 7 and compressed MusicXML files are ZIP files, but so
+		// are lots of other things, so the score has to be there too.
+		if archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content))); err == nil {
+			for _, file := range archive.File {
+				if file.Name == gpifPath {
+					return formatGuitarPro7
+				}
+			}
+
+			if musicXMLRootfile(archive) != "" {
+				return formatCompressedMusicXML
+			}
+		}
+
+		return ""
+
+	case isMusicXML(content):
+		return formatMusicXML
+	}
+
+	version, ok := guitarProVersion(content)
+	if !ok {
+		return ""
+	}
+
+	switch version[0] {
+	case '3':
+		return formatGuitarPro3
+	case '4':
+		return formatGuitarPro4
+	case '5':
+		return formatGuitarPro5
+	}
+
+	return formatGuitarPro
+}
+
+// guitarProVersion returns the version of a Guitar Pro 5 or older file, such
+// as "5.10", from the string which it starts with, like "FICHIER GUITAR PRO
+// v5.10". The second return value is false if the content doesn't start
+// with one.
+func guitarProVersion(content []byte) (string, bool) {
+	if len(content) < 31 || content[0] > 30 {
+		return "", false
+	}
+
+	header := string(content[1 : 1+content[0]])
+	if !strings.HasPrefix(header, "FICHIER GUITAR") {
+		return "", false
+	}
+
+	// The version is after the 'v', or an 'L' in some versions of Guitar
+	// Pro 4.
+	space := strings.LastIndexByte(header, ' ')
+	if space < 0 || len(header) < space+3 || (header[space+1] != 'v' && header[space+1] != 'L') {
+		return "", false
+	}
+
+	return header[space+2:], true
+}
+
+// readBinaryMetadata reads the title, artist, tuning and instruments from the
+// content of a file in the given binary format. Not every format says all of
+// them, and those which aren't known are left empty.
+func readBinaryMetadata(format string, content []byte) (*binaryMetadata, error) {
+	switch format {
+	case formatGuitarPro3, formatGuitarPro4, formatGuitarPro5:
+		return guitarProMetadata(content)
+
+	case formatGuitarPro6:
+		score, err := unpackGPX(content)
+		if err != nil {
+			return nil, err
+		}
+
+		return gpifMetadata(bytes.NewReader(score))
+
+	case formatGuitarPro7:
+		archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range archive.File {
+			if file.Name != gpifPath {
+				continue
+			}
+
+			score, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer score.Close()
+
+			return gpifMetadata(io.LimitReader(score, maxScoreSize))
+		}
+
+		return nil, errBadBinaryFile
+
+	case formatPowerTab:
+		return powerTabMetadata(content)
+
+	case formatMusicXML, formatCompressedMusicXML:
+		score, err := musicXMLScore(format, content)
+		if err != nil {
+			return nil, err
+		}
+
+		return musicXMLMetadata(bytes.NewReader(score))
+	}
+
+	return &binaryMetadata{}, nil
+}
+
+// applyBinaryMetadata reads a binary tab's title, artist, tuning and
+// instruments from the content of its file. They are written by whoever made
+// the file, so the title and the artist take precedence over the ones from
+// the filename.
+func (t *Tab) applyBinaryMetadata(content []byte) error {
+	meta, err := readBinaryMetadata(t.Format, content)
+	if err != nil {
+		return err
+	}
+
+	if meta.Title != "" {
+		t.Title = meta.Title
+	}
+
+	if meta.Artist != "" {
+		t.Artist = meta.Artist
+	}
+
+	t.Tuning = meta.Tuning
+	t.Instruments = meta.Instruments
+
+	return nil
+}
+
+// pitchesTuning returns the standard form of the tuning made up of the given
+// MIDI note numbers, from the lowest string up.
+func pitchesTuning(pitches []int) string {
+	notes := make([]string, 0, len(pitches))
+
+	for _, pitch := range pitches {
+		if pitch < 0 || pitch > 127 {
+			return ""
+		}
+
+		notes = append(notes, noteNames[pitch%12])
+	}
+
+	return canonicalTuning(strings.Join(notes, " "))
+}
+
+// decodeBinaryString turns the bytes of a string from a binary file into a
+// string. Older programs wrote them in Windows-1252 rather than UTF-8, which
+// is near enough to Latin-1 for names.
+func decodeBinaryString(b []byte) string {
+	if !utf8.Valid(b) {
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+
+		b = []byte(string(runes))
+	}
+
+	return strings.TrimSpace(strings.Trim(string(b), "\x00"))
+}
+
+// A binaryReader reads the little endian values which binary tab formats are
+// made of. Once it has run off the end of its data, everything it reads is
+// zero and err is set, so that a file can be read all the way through and
+// checked once at the end.
+type binaryReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+// skip moves past the next n bytes, returning them.
+func (br *binaryReader) skip(n int) []byte {
+	if br.err != nil || n < 0 || n > len(br.data)-br.pos {
+		br.err = errBadBinaryFile
+		return nil
+	}
+
+	b := br.data[br.pos : br.pos+n]
+	br.pos += n
+
+	return b
+}
+
+// readByte reads a single byte.
+func (br *binaryReader) readByte() byte {
+	if b := br.skip(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+// readShort reads an unsigned 16 bit integer.
+func (br *binaryReader) readShort() int {
+	if b := br.skip(2); b != nil {
+		return int(binary.LittleEndian.Uint16(b))
+	}
+
+	return 0
+}
+
+// readInt reads a signed 32 bit integer.
+func (br *binaryReader) readInt() int {
+	if b := br.skip(4); b != nil {
+		return int(int32(binary.LittleEndian.Uint32(b)))
+	}
+
+	return 0
+}
+
+// byteSizeString reads a string which is stored as its length in a byte,
+// followed by a block of the given size which it is at the start of.
+func (br *binaryReader) byteSizeString(size int) string {
+	length := int(br.readByte())
+
+	block := br.skip(size)
+	if length > len(block) {
+		length = len(block)
+	}
+
+	return decodeBinaryString(block[:length])
+}
+
+// intByteSizeString reads a string which is stored as the size of the rest
+// of it in an integer, followed by its length in a byte and then the string
+// itself.
+func (br *binaryReader) intByteSizeString() string {
+	size := br.readInt() - 1
+	if size < 0 {
+		br.err = errBadBinaryFile
+		return ""
+	}
+
+	return br.byteSizeString(size)
+}
+
+// intSizeString reads a string which is stored as its length in an integer,
+// followed by the string.
+func (br *binaryReader) intSizeString() string {
+	return decodeBinaryString(br.skip(br.readInt()))
+}
+
+// mfcString reads a string which is stored as Microsoft's MFC library stores
+// them: its length in a byte, or in the following 16 bit integer if the byte
+// is 0xFF, or in the following 32 bit integer if that is 0xFFFF, followed by
+// the string.
+func (br *binaryReader) mfcString() string {
+	length := int(br.readByte())
+
+	if length == 0xFF {
+		length = br.readShort()
+
+		if length == 0xFFFF {
+			length = br.readInt()
+		}
+	}
+
+	return decodeBinaryString(br.skip(length))
+}
+
+// guitarProMetadata reads the title, artist and tuning from a Guitar Pro 3, 4
+// or 5 file. The title and the artist are near the start, but the tuning is
+// part of the first track, which comes after everything about the song as a
+// whole and the header of every measure, so they all have to be read past.
+func guitarProMetadata(content []byte) (*binaryMetadata, error) {
+	version, ok := guitarProVersion(content)
+	if !ok {
+		return nil, errBadBinaryFile
+	}
+
+	major := version[0]
+	newer := version > "5.00"
+
+	br := &binaryReader{data: content}
+	br.skip(31)
+
+	meta := &binaryMetadata{}
+
+	// The song's information: its title, subtitle, artist, album and
+	// lyricist, then its composer in version 5, then its copyright, who
+	// wrote the tab, some instructions and any number of lines of notes.
+	meta.Title = br.intByteSizeString()
+	br.intByteSizeString()
+	meta.Artist = br.intByteSizeString()
+
+	fields := 5
+	if major == '5' {
+		fields = 6
+	}
+
+	for i := 0; i < fields; i++ {
+		br.intByteSizeString()
+	}
+
+	for notes := br.readInt(); notes > 0 && br.err == nil; notes-- {
+		br.intByteSizeString()
+	}
+
+	if br.err != nil {
+		return nil, br.err
+	}
+
+	switch major {
+	case '3':
+		// The triplet feel, tempo and key.
+		br.skip(9)
+
+	case '4':
+		br.skip(1)
+		br.skipGuitarProLyrics()
+
+		// The tempo, key and octave.
+		br.skip(9)
+
+	case '5':
+		br.skipGuitarProLyrics()
+
+		// Version 5.10 added the master effects, which are a volume, an
+		// unknown integer and 11 equaliser bands.
+		if newer {
+			br.skip(19)
+		}
+
+		// The page setup, which is seven integers for its size, margins
+		// and proportions, 16 bits of flags, and 10 strings for the header
+		// and footer.
+		br.skip(30)
+
+		for i := 0; i < 10; i++ {
+			br.intByteSizeString()
+		}
+
+		// The tempo's name, the tempo, and whether it's hidden, which was
+		// added in version 5.10.
+		br.intByteSizeString()
+		br.skip(4)
+
+		if newer {
+			br.skip(1)
+		}
+
+		// The key and octave.
+		br.skip(5)
+	}
+
+	// The 64 MIDI channels.
+	br.skip(64 * 12)
+
+	// Version 5 has the 19 musical directions, such as "Da Capo", and the
+	// master reverb.
+	if major == '5' {
+		br.skip(19*2 + 4)
+	}
+
+	measures, tracks := br.readInt(), br.readInt()
+	if br.err != nil || tracks < 1 {
+		return meta, br.err
+	}
+
+	for i := 0; i < measures && br.err == nil; i++ {
+		br.skipGuitarProMeasureHeader(major, i == 0)
+	}
+
+	// The first track starts with a byte which is always 0 in version 5,
+	// followed by some flags and its name.
+	if major == '5' {
+		br.skip(1)
+	}
+
+	br.skip(1)
+	br.byteSizeString(40)
+
+	// Then comes the number of strings, and the note of each of up to seven
+	// strings, from the highest down. Drums say they have strings too, but
+	// they're tuned to nothing.
+	stringCount := br.readInt()
+	pitches := make([]int, 7)
+
+	for i := range pitches {
+		pitches[i] = br.readInt()
+	}
+
+	if br.err != nil {
+		return nil, br.err
+	}
+
+	if stringCount >= 4 && stringCount <= 7 {
+		tuning := make([]int, stringCount)
+		for i := range tuning {
+			tuning[i] = pitches[stringCount-1-i]
+		}
+
+		meta.Tuning = pitchesTuning(tuning)
+	}
+
+	return meta, nil
+}
+
+// skipGuitarProLyrics reads past the lyrics of a Guitar Pro 4 or 5 file,
+// which are the track they go with, and five lines, each with the measure
+// which it starts on.
+func (br *binaryReader) skipGuitarProLyrics() {
+	br.skip(4)
+
+	for i := 0; i < 5; i++ {
+		br.skip(4)
+		br.intSizeString()
+	}
+}
+
+// skipGuitarProMeasureHeader reads past the header of a measure, which starts
+// with flags saying which of the things which can change from one measure to
+// the next do, such as the time signature, followed by the new values.
+func (br *binaryReader) skipGuitarProMeasureHeader(major byte, first bool) {
+	if major != '5' {
+		flags := br.readByte()
+
+		// The time signature's numerator and denominator, and the number
+		// of repeats and the alternative ending.
+		for _, flag := range []byte{0x01, 0x02, 0x08, 0x10} {
+			if flags&flag != 0 {
+				br.skip(1)
+			}
+		}
+
+		// A marker, with a name and a colour.
+		if flags&0x20 != 0 {
+			br.intByteSizeString()
+			br.skip(4)
+		}
+
+		// The key signature.
+		if flags&0x40 != 0 {
+			br.skip(2)
+		}
+
+		return
+	}
+
+	// In version 5, each measure after the first starts with a byte which is
+	// always 0, and the order is different.
+	if !first {
+		br.skip(1)
+	}
+
+	flags := br.readByte()
+
+	for _, flag := range []byte{0x01, 0x02, 0x08} {
+		if flags&flag != 0 {
+			br.skip(1)
+		}
+	}
+
+	if flags&0x20 != 0 {
+		br.intByteSizeString()
+		br.skip(4)
+	}
+
+	if flags&0x40 != 0 {
+		br.skip(2)
+	}
+
+	if flags&0x10 != 0 {
+		br.skip(1)
+	}
+
+	// How the beats are grouped, if the time signature changes.
+	if flags&0x03 != 0 {
+		br.skip(4)
+	}
+
+	// A byte which is always 0 if there isn't an alternative ending, and
+	// the triplet feel.
+	if flags&0x10 == 0 {
+		br.skip(1)
+	}
+
+	br.skip(1)
+}
+
+// A bitReader reads a Guitar Pro 6 file a bit at a time, starting with the
+// highest bit of each byte.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+// bit reads a single bit. The second return value is false if there are no
+// more.
+func (br *bitReader) bit() (int, bool) {
+	if br.pos >= len(br.data)*8 {
+		return 0, false
+	}
+
+	bit := int(br.data[br.pos/8]>>(7-uint(br.pos%8))) & 1
+	br.pos++
+
+	return bit, true
+}
+
+// bits reads a number made of the given number of bits, the highest first,
+// or the lowest first if reversed is true.
+func (br *bitReader) bits(count int, reversed bool) (int, bool) {
+	value := 0
+
+	for i := 0; i < count; i++ {
+		bit, ok := br.bit()
+		if !ok {
+			return 0, false
+		}
+
+		if reversed {
+			value |= bit << uint(i)
+		} else {
+			value |= bit << uint(count-1-i)
+		}
+	}
+
+	return value, true
+}
+
+// unpackGPX returns the score from a Guitar Pro 6 file. The file is a small
+// filesystem of its own, which is usually compressed.
+func unpackGPX(content []byte) ([]byte, error) {
+	var filesystem []byte
+
+	switch string(content[:4]) {
+	case "BCFS":
+		filesystem = content[4:]
+
+	case "BCFZ":
+		unpacked, err := decompressGPX(content[4:])
+		if err != nil {
+			return nil, err
+		}
+
+		// The decompressed data has the header of an uncompressed file.
+		if len(unpacked) < 4 || string(unpacked[:4]) != "BCFS" {
+			return nil, errBadBinaryFile
+		}
+
+		filesystem = unpacked[4:]
+
+	default:
+		return nil, errBadBinaryFile
+	}
+
+	return gpxFile(filesystem, path.Base(gpifPath))
+}
+
+// decompressGPX decompresses a Guitar Pro 6 file, which starts with how long
+// it is when it's decompressed. The rest is a series of chunks, each of which
+// is either some bytes to copy as they are, or where to find an earlier run
+// of bytes to repeat.
+func decompressGPX(compressed []byte) ([]byte, error) {
+	if len(compressed) < 4 {
+		return nil, errBadBinaryFile
+	}
+
+	expected := int(binary.LittleEndian.Uint32(compressed))
+	if expected > maxScoreSize {
+		return nil, fmt.Errorf("the file unpacks to more than %d MB", maxScoreSize>>20)
+	}
+
+	br := &bitReader{data: compressed[4:]}
+	unpacked := make([]byte, 0, expected)
+
+	for len(unpacked) < expected {
+		repeat, ok := br.bit()
+		if !ok {
+			break
+		}
+
+		if repeat == 1 {
+			width, _ := br.bits(4, false)
+			offset, _ := br.bits(width, true)
+			size, ok := br.bits(width, true)
+			if !ok {
+				break
+			}
+
+			start := len(unpacked) - offset
+			if start < 0 {
+				return nil, errBadBinaryFile
+			}
+
+			if size > offset {
+				size = offset
+			}
+
+			unpacked = append(unpacked, unpacked[start:start+size]...)
+			continue
+		}
+
+		size, _ := br.bits(2, true)
+		for i := 0; i < size; i++ {
+			b, ok := br.bits(8, false)
+			if !ok {
+				break
+			}
+
+			unpacked = append(unpacked, byte(b))
+		}
+	}
+
+	return unpacked, nil
+}
+
+// gpxFile returns the file with the given name from the filesystem inside a
+// Guitar Pro 6 file. The filesystem is divided into sectors, and each file
+// has a sector with its name, its size and the numbers of the sectors which
+// hold its data.
+func gpxFile(filesystem []byte, name string) ([]byte, error) {
+	integer := func(offset int) int {
+		if offset < 0 || offset+4 > len(filesystem) {
+			return 0
+		}
+
+		return int(int32(binary.LittleEndian.Uint32(filesystem[offset:])))
+	}
+
+	for offset := gpxSectorSize; offset+3 < len(filesystem); offset += gpxSectorSize {
+		// Only sectors which describe a file are of interest.
+		if integer(offset) != 2 {
+			continue
+		}
+
+		nameField := filesystem[offset+4:]
+		if len(nameField) > 127 {
+			nameField = nameField[:127]
+		}
+
+		if end := bytes.IndexByte(nameField, 0); end >= 0 {
+			nameField = nameField[:end]
+		}
+
+		size := integer(offset + 0x8C)
+		if size < 0 || size > maxScoreSize {
+			return nil, errBadBinaryFile
+		}
+
+		var data []byte
+
+		pointers := offset + 0x94
+		sectors := len(filesystem) / gpxSectorSize
+
+		// The sectors which have been read are kept track of, since a
+		// corrupt file could list a sector more than once, or list the
+		// sector which describes the file itself, and the walk would
+		// never end.
+		visited := map[int]bool{offset / gpxSectorSize: true}
+		last := offset
+
+		for i := 0; ; i++ {
+			sector := integer(pointers + 4*i)
+			if sector <= 0 {
+				break
+			}
+
+			if i >= sectors || visited[sector] || sector > sectors {
+				return nil, errBadBinaryFile
+			}
+
+			visited[sector] = true
+
+			position := sector * gpxSectorSize
+			if position > len(filesystem) {
+				return nil, errBadBinaryFile
+			}
+
+			if position > last {
+				last = position
+			}
+
+			end := position + gpxSectorSize
+			if end > len(filesystem) {
+				end = len(filesystem)
+			}
+
+			if string(nameField) == name {
+				data = append(data, filesystem[position:end]...)
+			}
+		}
+
+		// The next file's sector comes after this one's data. The outer
+		// walk only ever moves forwards, so that it ends even if the
+		// sectors point backwards.
+		offset = last
+
+		if string(nameField) == name {
+			if size < len(data) {
+				data = data[:size]
+			}
+
+			return data, nil
+		}
+	}
+
+	return nil, errBadBinaryFile
+}
+
+// gpifMetadata reads the title, artist and tuning from the score of a Guitar
+// Pro 6 or 7 file, which is XML. The tuning is the first one given to any
+// of its instruments, as the notes of each string from the lowest up.
+func gpifMetadata(score io.Reader) (*binaryMetadata, error) {
+	decoder := xml.NewDecoder(score)
+
+	var (
+		elements []string
+		property string
+		title    strings.Builder
+		artist   strings.Builder
+		pitches  strings.Builder
+	)
+
+	meta := &binaryMetadata{}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			elements = append(elements, t.Name.Local)
+
+			if t.Name.Local == "Property" {
+				property = ""
+
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "name" {
+						property = attr.Value
+					}
+				}
+			}
+
+		case xml.EndElement:
+			if len(elements) > 0 {
+				elements = elements[:len(elements)-1]
+			}
+
+			// The first tuning is the one which is kept.
+			if t.Name.Local == "Pitches" && meta.Tuning == "" && property == "Tuning" {
+				var notes []int
+
+				for _, field := range strings.Fields(pitches.String()) {
+					note, err := strconv.Atoi(field)
+					if err != nil {
+						notes = nil
+						break
+					}
+
+					notes = append(notes, note)
+				}
+
+				if len(notes) >= 4 {
+					meta.Tuning = pitchesTuning(notes)
+				}
+			}
+
+			pitches.Reset()
+
+		case xml.CharData:
+			path := strings.Join(elements, "/")
+
+			switch {
+			case path == "GPIF/Score/Title":
+				title.Write(t)
+			case path == "GPIF/Score/Artist":
+				artist.Write(t)
+			case strings.HasSuffix(path, "/Property/Pitches"):
+				pitches.Write(t)
+			}
+		}
+	}
+
+	meta.Title = decodeBinaryString([]byte(title.String()))
+	meta.Artist = decodeBinaryString([]byte(artist.String()))
+
+	return meta, nil
+}
+
+// powerTabMetadata reads the title and artist from a Power Tab file. They are
+// at the start of its header, but its tuning is deep inside the score, so it
+// isn't read.
+func powerTabMetadata(content []byte) (*binaryMetadata, error) {
+	br := &binaryReader{data: content}
+	br.skip(4)
+
+	version, fileType := br.readShort(), br.readShort()
+	meta := &binaryMetadata{}
+
+	// Since version 1.7, a file can be a song or a lesson. A song's header
+	// starts with what it has in it, and a lesson has no artist.
+	switch {
+	case version < 4:
+		meta.Title = br.mfcString()
+		meta.Artist = br.mfcString()
+
+	case fileType == 0:
+		br.skip(1)
+		meta.Title = br.mfcString()
+		meta.Artist = br.mfcString()
+
+	default:
+		meta.Title = br.mfcString()
+	}
+
+	if br.err != nil {
+		return nil, br.err
+	}
+
+	return meta, nil
+}
+
+// tabExtensionTypes maps the extensions of the files which tabs are usually
+// kept in to the content types they are downloaded with, since the system's
+// list of types doesn't know most of them. ChordPro files and the like are
+// plain text.
+var tabExtensionTypes = map[string]string{
+	".txt":      "text/plain; charset=utf-8",
+	".tab":      "text/plain; charset=utf-8",
+	".crd":      "text/plain; charset=utf-8",
+	".chopro":   "text/plain; charset=utf-8",
+	".cho":      "text/plain; charset=utf-8",
+	".pro":      "text/plain; charset=utf-8",
+	".gp":       "application/x-guitar-pro",
+	".gp3":      "application/x-guitar-pro",
+	".gp4":      "application/x-guitar-pro",
+	".gp5":      "application/x-guitar-pro",
+	".gpx":      "application/x-guitar-pro",
+	".ptb":      "application/x-power-tab",
+	".musicxml": musicXMLContentType,
+	".mxl":      "application/vnd.recordare.musicxml",
+}
+
+// tabFileContentType returns the content type which a tab's file is
+// downloaded with, which is worked out from its extension. If the extension
+// is missing or unknown, it is worked out from the tab's format instead.
+func tabFileContentType(tab *Tab) string {
+	ext := strings.ToLower(path.Ext(tab.Filename))
+
+	if contentType, ok := tabExtensionTypes[ext]; ok {
+		return contentType
+	}
+
+	if contentType := mime.TypeByExtension(ext); ext != "" && contentType != "" {
+		return contentType
+	}
+
+	if contentType, ok := binaryContentTypes[tab.Format]; ok {
+		return contentType
+	}
+
+	if tab.Binary {
+		return "application/octet-stream"
+	}
+
+	return "text/plain; charset=utf-8"
+}
+
+// serveTabFile responds with a tab's file, as an attachment named after it.
+func (s *Server) serveTabFile(w http.ResponseWriter, r *http.Request, tab *Tab) {
+	file, err := os.Open(s.tabPath(tab.Filename))
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, errors.New("the tab's file no longer exists"))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", tabFileContentType(tab))
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(path.Base(tab.Filename)))
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// handleTabFileAPI is called to respond to a HTTP request to
+// /api/v1/tab/{id}/file or /api/v1/tab/{id}/download. It responds with the
+// tab's file as it is on disk, so that it can be saved untouched. This is how
+// a binary tab, such as a Guitar Pro file, is downloaded, since it has no
+// content of its own.
+func (s *Server) handleTabFileAPI(w http.ResponseWriter, r *http.Request) {
+	tab, ok, err := s.Store.GetTab(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok || s.hidesTab(r, tab) {
+		writeError(w, http.StatusNotFound, errTabNotFound)
+		return
+	}
+
+	s.serveTabFile(w, r, tab)
+}
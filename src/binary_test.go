@@ -0,0 +1,96 @@
+package src
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// gpxFilesystem returns a Guitar Pro 6 filesystem with the given number of
+// sectors, and a function which describes a file in one of them.
+func gpxFilesystem(sectors int) ([]byte, func(at int, name string, size int, data ...int)) {
+	filesystem := make([]byte, sectors*gpxSectorSize)
+
+	describe := func(at int, name string, size int, data ...int) {
+		offset := at * gpxSectorSize
+
+		binary.LittleEndian.PutUint32(filesystem[offset:], 2)
+		copy(filesystem[offset+4:], name)
+		binary.LittleEndian.PutUint32(filesystem[offset+0x8C:], uint32(size))
+
+		for i, sector := range data {
+			binary.LittleEndian.PutUint32(filesystem[offset+0x94+4*i:], uint32(sector))
+		}
+	}
+
+	return filesystem, describe
+}
+
+// readGPXFile calls gpxFile, and fails the test if it doesn't return in time.
+func readGPXFile(t *testing.T, filesystem []byte, name string) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		data, err := gpxFile(filesystem, name)
+		done <- result{data, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.data, r.err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reading %s from the filesystem didn't finish", name)
+		return nil, nil
+	}
+}
+
+func TestGPXFile(t *testing.T) {
+	filesystem, describe := gpxFilesystem(3)
+	describe(1, "score.gpif", 5, 2)
+	copy(filesystem[2*gpxSectorSize:], "<gpif>")
+
+	data, err := readGPXFile(t, filesystem, "score.gpif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "<gpif" {
+		t.Errorf("expected the first 5 bytes of the data, got %q", data)
+	}
+
+	if _, err := readGPXFile(t, filesystem, "missing.gpif"); err != errBadBinaryFile {
+		t.Errorf("expected errBadBinaryFile for a missing file, got %v", err)
+	}
+}
+
+func TestGPXFileSectorLoops(t *testing.T) {
+	tests := []struct {
+		name     string
+		describe func(describe func(at int, name string, size int, data ...int))
+	}{
+		{"self-referencing sector", func(describe func(int, string, int, ...int)) {
+			describe(1, "other.gpif", 4, 1)
+		}},
+		{"sector pointing backwards", func(describe func(int, string, int, ...int)) {
+			describe(2, "other.gpif", 4, 1)
+		}},
+		{"sector listed twice", func(describe func(int, string, int, ...int)) {
+			describe(1, "other.gpif", 4, 2, 2)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filesystem, describe := gpxFilesystem(3)
+			test.describe(describe)
+
+			if _, err := readGPXFile(t, filesystem, "score.gpif"); err != errBadBinaryFile {
+				t.Errorf("expected errBadBinaryFile, got %v", err)
+			}
+		})
+	}
+}
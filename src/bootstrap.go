@@ -0,0 +1,74 @@
+package src
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"time"
+)
+
+// initialPasswordBytes is how many random bytes the initial admin password
+// is made from. It is shown in hexadecimal, so it is twice as many
+// characters long.
+const initialPasswordBytes = 8
+
+// DefaultSettings returns the settings which a fresh install starts off with.
+// They don't include an admin password, which Bootstrap generates.
+func DefaultSettings() *Settings {
+	return &Settings{
+		TabDirectory:     "tabs",
+		FilenamePatterns: []string{"[artist] - [title]"},
+		NonCapitalWords:  []string{"a", "an", "and", "the", "of", "in", "on", "to"},
+		FolderMetadata:   folderMetadataNone,
+		AccessMode:       accessPublic,
+		TabCacheTTL:      int(defaultTabCacheTTL / time.Second),
+
+		TransformScriptTimeout: defaultTransformScriptTimeout,
+	}
+}
+
+// HashPassword computes the hash of an admin password which is stored in
+// place of the password itself, which is the SHA-512 hash in hexadecimal.
+func HashPassword(password string) string {
+	return fmt.Sprintf("%x", sha512.Sum512([]byte(password)))
+}
+
+// Bootstrap loads the settings from the store, setting it up first if it
+// hasn't been already, which is the case when it doesn't have an admin
+// password. Setting it up saves the default settings in place of any which
+// are missing, along with a random admin password. That password is returned
+// so that it can be shown to the admin, since only its hash is stored and so
+// it can't be found out later. If the store was already set up, the returned
+// password is empty.
+func Bootstrap(store Store) (*Settings, string, error) {
+	settings, err := store.LoadSettings()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if settings.PasswordHash != "" {
+		return settings, "", nil
+	}
+
+	// The stores fill in the other missing settings with their defaults
+	// when loading them, but an empty set of non-capital words can't be
+	// told apart from a missing one, so that is only done here.
+	if len(settings.NonCapitalWords) == 0 {
+		settings.NonCapitalWords = DefaultSettings().NonCapitalWords
+	}
+
+	if err := store.SaveSettings(settings); err != nil {
+		return nil, "", err
+	}
+
+	password, err := randomHex(initialPasswordBytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	settings.PasswordHash = HashPassword(password)
+	if err := store.SetPasswordHash(settings.PasswordHash); err != nil {
+		return nil, "", err
+	}
+
+	return settings, password, nil
+}
@@ -0,0 +1,558 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	// errStoreTimeout is returned by a BreakerStore when an operation takes
+	// longer than its timeout.
+	errStoreTimeout = errors.New("the database took too long to respond")
+
+	// errCircuitOpen is returned by a BreakerStore, without trying the
+	// operation, while its circuit is open.
+	errCircuitOpen = errors.New("the database is unavailable, so it won't be used for a while")
+)
+
+// These are the defaults which NewBreakerStore uses.
+const (
+	defaultStoreTimeout     = 2 * time.Second
+	defaultFailureThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// defaultStoreTimeouts are the timeouts of the operations which can take
+// longer than defaultStoreTimeout, keyed by the names of their methods.
+var defaultStoreTimeouts = map[string]time.Duration{
+	"GetTabs":   10 * time.Second,
+	"ResetTabs": time.Minute,
+}
+
+// A BreakerStore wraps another Store, giving up on any operation which takes
+// longer than its timeout. Once FailureThreshold operations in a row have
+// failed because the store couldn't be reached, the circuit is opened, and
+// every operation fails straight away with errCircuitOpen until Cooldown has
+// passed. This way, if the database hangs, requests fail quickly instead of
+// each of them waiting for it and piling up. After the cooldown, the circuit
+// is half-open: exactly one operation is let through as a probe, while the
+// rest carry on failing straight away. If the probe succeeds the circuit is
+// closed, and otherwise it is opened for another cooldown.
+//
+// Only the operations on the tabs and settings go through the breaker. The
+// rest of the store's methods, such as those for the sessions and the search
+// index, are passed straight through to the wrapped store, so they don't trip
+// or wait for the breaker. Instead, the Redis client is given the default
+// store timeout as its read and write timeouts, so those calls give up just
+// as quickly, and while the circuit is open the requests which use them will
+// usually have failed on the tabs or settings first anyway.
+type BreakerStore struct {
+	// Store is the store which is wrapped.
+	Store
+
+	// Timeouts holds the timeouts of particular operations, keyed by the
+	// names of their methods, such as "GetTabs". Any operation which isn't
+	// in it uses DefaultTimeout.
+	Timeouts       map[string]time.Duration
+	DefaultTimeout time.Duration
+
+	// FailureThreshold is how many operations in a row have to fail before
+	// the circuit is opened, and Cooldown is how long it stays open for.
+	FailureThreshold int
+	Cooldown         time.Duration
+
+	// failures is the number of operations in a row which have failed, and
+	// openUntil is when the circuit becomes half-open. probing is whether
+	// the probe of a half-open circuit is running. lock is held while any
+	// of them is being used.
+	failures  int
+	openUntil time.Time
+	probing   bool
+	lock      sync.Mutex
+}
+
+// NewBreakerStore creates a BreakerStore wrapping the given store, with the
+// default timeouts and thresholds.
+func NewBreakerStore(store Store) *BreakerStore {
+	timeouts := make(map[string]time.Duration, len(defaultStoreTimeouts))
+	for op, timeout := range defaultStoreTimeouts {
+		timeouts[op] = timeout
+	}
+
+	return &BreakerStore{
+		Store:            store,
+		Timeouts:         timeouts,
+		DefaultTimeout:   defaultStoreTimeout,
+		FailureThreshold: defaultFailureThreshold,
+		Cooldown:         defaultBreakerCooldown,
+	}
+}
+
+// Configure sets the timeouts and thresholds given in the configuration,
+// leaving the defaults in place of any which aren't given.
+func (bs *BreakerStore) Configure(config TimeoutConfig) error {
+	operations, err := parseDurations(config.Operations)
+	if err != nil {
+		return err
+	}
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	if config.Store > 0 {
+		bs.DefaultTimeout = config.Store
+	}
+
+	for op, timeout := range operations {
+		bs.Timeouts[op] = timeout
+	}
+
+	if config.BreakerFailures > 0 {
+		bs.FailureThreshold = config.BreakerFailures
+	}
+
+	if config.BreakerCooldown > 0 {
+		bs.Cooldown = config.BreakerCooldown
+	}
+
+	return nil
+}
+
+// unreachable reports whether an error means that the store couldn't be
+// reached, rather than that the operation itself was wrong, like asking for
+// a tab which doesn't exist. Only these errors count towards opening the
+// circuit.
+func unreachable(err error) bool {
+	if err == errStoreTimeout || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// call runs the operation with the given name, unless the circuit is open,
+// and returns its error. If it doesn't finish in time, errStoreTimeout is
+// returned, and the operation is left to finish on its own; f mustn't change
+// anything which is used after call returns an error.
+func (bs *BreakerStore) call(op string, f func() error) error {
+	bs.lock.Lock()
+
+	probe := false
+	if bs.failures >= bs.FailureThreshold {
+		// Once the cooldown has passed, this operation is the probe,
+		// unless another one already is.
+		if time.Now().Before(bs.openUntil) || bs.probing {
+			bs.lock.Unlock()
+			return errCircuitOpen
+		}
+
+		bs.probing, probe = true, true
+	}
+
+	timeout, ok := bs.Timeouts[op]
+	if !ok {
+		timeout = bs.DefaultTimeout
+	}
+
+	bs.lock.Unlock()
+
+	// The channel is buffered, so the goroutine can still finish if nothing
+	// is waiting for it any more.
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	var err error
+
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = errStoreTimeout
+	}
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	if probe {
+		bs.probing = false
+	}
+
+	if unreachable(err) {
+		bs.failures++
+		if bs.failures >= bs.FailureThreshold {
+			bs.openUntil = time.Now().Add(bs.Cooldown)
+		}
+	} else {
+		bs.failures = 0
+	}
+
+	return err
+}
+
+// A TimeoutConfig says how long store operations, and requests to particular
+// routes, can take before they are given up on, and when the circuit breaker
+// opens.
+type TimeoutConfig struct {
+	// Store is how long each store operation can take, and Operations
+	// overrides it for particular operations, as a list such as
+	// "GetTabs=10s,ResetTabs=1m", keyed by the names of the Store methods.
+	// If Store is 0, defaultStoreTimeout is used, and the operations in
+	// defaultStoreTimeouts keep theirs unless they are listed.
+	Store      time.Duration
+	Operations string
+
+	// Routes is how long requests to particular routes can take, as a list
+	// such as "/api/v1/tabs=5s,/api/v1/search=2s", keyed by the routes'
+	// paths, with variables like {id} as they are in the router. A route's
+	// deprecated path under /api has the same timeout as its /api/v1 one.
+	// Requests which take longer are answered with a 503, and routes which
+	// stream their responses, like /api/v1/events, can't be given one.
+	// Routes which aren't listed can take as long as they need.
+	Routes string
+
+	// BreakerFailures is how many store operations in a row have to fail
+	// for the circuit to open, and BreakerCooldown is how long it stays
+	// open for. If either is 0, its default is used.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+// DatabaseTimeout returns the timeout which the Redis client should use for
+// reading and writing, which is the default store timeout, so that the store
+// operations which don't go through the circuit breaker give up as quickly as
+// the ones which do.
+func (c TimeoutConfig) DatabaseTimeout() time.Duration {
+	if c.Store > 0 {
+		return c.Store
+	}
+
+	return defaultStoreTimeout
+}
+
+// parseDurations parses a list of names and durations, such as
+// "GetTabs=10s,ResetTabs=1m", into a map from each name to its duration.
+func parseDurations(list string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("%q isn't a name and a duration separated by '='", item)
+		}
+
+		duration, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("%q isn't a duration, such as 5s", strings.TrimSpace(parts[1]))
+		}
+
+		durations[strings.TrimSpace(parts[0])] = duration
+	}
+
+	return durations, nil
+}
+
+// routeTimeouts returns the timeouts of the routes in the configuration,
+// keyed by routeKey.
+func (c TimeoutConfig) routeTimeouts() (map[string]time.Duration, error) {
+	listed, err := parseDurations(c.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts := make(map[string]time.Duration, len(listed))
+	for route, timeout := range listed {
+		timeouts[routeKey(route)] = timeout
+	}
+
+	return timeouts, nil
+}
+
+// routeKey returns the key which a route's timeout is kept under, which is
+// its path below the API's prefix for the API's routes, so that a route's
+// /api/v1 and deprecated /api paths share one, and otherwise its path.
+func routeKey(path string) string {
+	if rest, ok := apiPath(path); ok {
+		return "api:" + rest
+	}
+
+	return path
+}
+
+// limitRouteTimes is middleware for the router which gives up on requests to
+// the routes with timeouts once they have taken that long, answering them
+// with a 503, as described by TimeoutConfig.Routes. The handler carries on
+// until it notices that its request's context is done, but whatever it
+// writes afterwards is thrown away.
+func (s *Server) limitRouteTimes(next http.Handler) http.Handler {
+	// The timeouts have been checked along with the rest of the
+	// configuration, so there are only errors here if it wasn't checked.
+	timeouts, err := s.Timeouts.routeTimeouts()
+	if err != nil || len(timeouts) == 0 {
+		return next
+	}
+
+	body, _ := json.Marshal(&errorResponse{
+		Error: errorBody{Code: codeRequestTimeout, Message: "the request took too long, so it was given up on"},
+	})
+
+	limited := make(map[string]http.Handler, len(timeouts))
+	for route, timeout := range timeouts {
+		limited[route] = http.TimeoutHandler(next, timeout, string(body))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				if handler, ok := limited[routeKey(template)]; ok {
+					handler.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetTab returns the tab with the given ID.
+func (bs *BreakerStore) GetTab(id string) (*Tab, bool, error) {
+	var (
+		tab *Tab
+		ok  bool
+	)
+
+	if err := bs.call("GetTab", func() (err error) {
+		tab, ok, err = bs.Store.GetTab(id)
+		return
+	}); err != nil {
+		return nil, false, err
+	}
+
+	return tab, ok, nil
+}
+
+// GetTabs returns the tabs with each of the given IDs.
+func (bs *BreakerStore) GetTabs(ids []string) ([]*Tab, error) {
+	var tabs []*Tab
+
+	if err := bs.call("GetTabs", func() (err error) {
+		tabs, err = bs.Store.GetTabs(ids)
+		return
+	}); err != nil {
+		return nil, err
+	}
+
+	return tabs, nil
+}
+
+// PutTab stores a tab. The tab's ID is only set once the store has finished
+// with it, so that it isn't changed after the operation has timed out.
+func (bs *BreakerStore) PutTab(tab *Tab) error {
+	stored := *tab
+
+	if err := bs.call("PutTab", func() error {
+		return bs.Store.PutTab(&stored)
+	}); err != nil {
+		return err
+	}
+
+	tab.ID = stored.ID
+
+	return nil
+}
+
+// RestoreTab stores a tab under the ID it already has.
+func (bs *BreakerStore) RestoreTab(tab *Tab) error {
+	return bs.call("RestoreTab", func() error {
+		return bs.Store.RestoreTab(tab)
+	})
+}
+
+// DeleteTab removes the tab with the given ID.
+func (bs *BreakerStore) DeleteTab(id string) error {
+	return bs.call("DeleteTab", func() error {
+		return bs.Store.DeleteTab(id)
+	})
+}
+
+// ListIDs returns the IDs of every stored tab.
+func (bs *BreakerStore) ListIDs() ([]string, error) {
+	var ids []string
+
+	if err := bs.call("ListIDs", func() (err error) {
+		ids, err = bs.Store.ListIDs()
+		return
+	}); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// Filenames returns a map from the filename of every stored tab to its ID.
+func (bs *BreakerStore) Filenames() (map[string]string, error) {
+	var filenames map[string]string
+
+	if err := bs.call("Filenames", func() (err error) {
+		filenames, err = bs.Store.Filenames()
+		return
+	}); err != nil {
+		return nil, err
+	}
+
+	return filenames, nil
+}
+
+// TabID returns the ID of the tab with the given filename.
+func (bs *BreakerStore) TabID(filename string) (string, bool, error) {
+	var (
+		id string
+		ok bool
+	)
+
+	if err := bs.call("TabID", func() (err error) {
+		id, ok, err = bs.Store.TabID(filename)
+		return
+	}); err != nil {
+		return "", false, err
+	}
+
+	return id, ok, nil
+}
+
+// SetModified changes just the modification time of a tab.
+func (bs *BreakerStore) SetModified(id string, modified time.Time) error {
+	return bs.call("SetModified", func() error {
+		return bs.Store.SetModified(id, modified)
+	})
+}
+
+// RewriteTags replaces the tags and extra tags of several tabs at once.
+func (bs *BreakerStore) RewriteTags(tags, extraTags map[string][]string) error {
+	return bs.call("RewriteTags", func() error {
+		return bs.Store.RewriteTags(tags, extraTags)
+	})
+}
+
+// SetSource changes just the source of a tab.
+func (bs *BreakerStore) SetSource(id string, source TabSource) error {
+	return bs.call("SetSource", func() error {
+		return bs.Store.SetSource(id, source)
+	})
+}
+
+// SetPractice changes just the practice metadata of a tab.
+func (bs *BreakerStore) SetPractice(id string, practice TabPractice) error {
+	return bs.call("SetPractice", func() error {
+		return bs.Store.SetPractice(id, practice)
+	})
+}
+
+// SetExplicitOverride changes the explicit override of a tab.
+func (bs *BreakerStore) SetExplicitOverride(id, override string) error {
+	return bs.call("SetExplicitOverride", func() error {
+		return bs.Store.SetExplicitOverride(id, override)
+	})
+}
+
+// ExtraTags returns the extra tags of a tab.
+func (bs *BreakerStore) ExtraTags(id string) ([]string, error) {
+	var tags []string
+
+	if err := bs.call("ExtraTags", func() (err error) {
+		tags, err = bs.Store.ExtraTags(id)
+		return
+	}); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// AddExtraTags adds to the extra tags of a tab.
+func (bs *BreakerStore) AddExtraTags(id string, tags []string) error {
+	return bs.call("AddExtraTags", func() error {
+		return bs.Store.AddExtraTags(id, tags)
+	})
+}
+
+// CollectionVersion returns the collection version.
+func (bs *BreakerStore) CollectionVersion() (int64, error) {
+	var version int64
+
+	if err := bs.call("CollectionVersion", func() (err error) {
+		version, err = bs.Store.CollectionVersion()
+		return
+	}); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// BumpCollectionVersion increments the collection version.
+func (bs *BreakerStore) BumpCollectionVersion() error {
+	return bs.call("BumpCollectionVersion", bs.Store.BumpCollectionVersion)
+}
+
+// ResetTabs removes every tab.
+func (bs *BreakerStore) ResetTabs() error {
+	return bs.call("ResetTabs", bs.Store.ResetTabs)
+}
+
+// LoadSettings returns the stored settings.
+func (bs *BreakerStore) LoadSettings() (*Settings, error) {
+	var settings *Settings
+
+	if err := bs.call("LoadSettings", func() (err error) {
+		settings, err = bs.Store.LoadSettings()
+		return
+	}); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// SaveSettings stores all of the settings except from the password hash.
+func (bs *BreakerStore) SaveSettings(settings *Settings) error {
+	return bs.call("SaveSettings", func() error {
+		return bs.Store.SaveSettings(settings)
+	})
+}
+
+// PasswordHash returns the stored hash of the admin password.
+func (bs *BreakerStore) PasswordHash() (string, error) {
+	var hash string
+
+	if err := bs.call("PasswordHash", func() (err error) {
+		hash, err = bs.Store.PasswordHash()
+		return
+	}); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// SetPasswordHash changes the stored hash of the admin password.
+func (bs *BreakerStore) SetPasswordHash(hash string) error {
+	return bs.call("SetPasswordHash", func() error {
+		return bs.Store.SetPasswordHash(hash)
+	})
+}
@@ -0,0 +1,112 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// hangingStore is a Store whose GetTab waits until release is closed.
+type hangingStore struct {
+	Store
+	release chan struct{}
+}
+
+func (hs *hangingStore) GetTab(id string) (*Tab, bool, error) {
+	<-hs.release
+
+	return &Tab{ID: id}, true, nil
+}
+
+func TestBreakerStoreProbe(t *testing.T) {
+	hanging := &hangingStore{release: make(chan struct{})}
+
+	bs := NewBreakerStore(hanging)
+	bs.Configure(TimeoutConfig{
+		Store:           20 * time.Millisecond,
+		BreakerFailures: 1,
+		BreakerCooldown: 20 * time.Millisecond,
+	})
+
+	if _, _, err := bs.GetTab("1"); err != errStoreTimeout {
+		t.Fatalf("expected the operation to time out, got %v", err)
+	}
+
+	if _, _, err := bs.GetTab("1"); err != errCircuitOpen {
+		t.Fatalf("expected the circuit to be open, got %v", err)
+	}
+
+	// The probe is given long enough to be waited for.
+	bs.lock.Lock()
+	bs.DefaultTimeout = 5 * time.Second
+	bs.lock.Unlock()
+
+	time.Sleep(30 * time.Millisecond)
+
+	probed := make(chan error, 1)
+	go func() {
+		_, _, err := bs.GetTab("1")
+		probed <- err
+	}()
+
+	for probing := false; !probing; {
+		time.Sleep(time.Millisecond)
+
+		bs.lock.Lock()
+		probing = bs.probing
+		bs.lock.Unlock()
+	}
+
+	// Only one operation is let through while the circuit is half-open.
+	if _, _, err := bs.GetTab("1"); err != errCircuitOpen {
+		t.Errorf("expected only one probe at a time, got %v", err)
+	}
+
+	close(hanging.release)
+
+	if err := <-probed; err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+
+	if _, _, err := bs.GetTab("1"); err != nil {
+		t.Errorf("expected the circuit to be closed after the probe, got %v", err)
+	}
+}
+
+func TestLimitRouteTimes(t *testing.T) {
+	s := &Server{Timeouts: TimeoutConfig{Routes: "/api/v1/slow=10ms"}}
+
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}
+
+	r := mux.NewRouter()
+	r.Use(s.limitRouteTimes)
+	r.HandleFunc("/api/slow", slow)
+	r.HandleFunc("/api/v1/other", slow)
+
+	// The route's deprecated path has the same timeout.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/slow", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the request to be given up on, got %d", w.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/other", nil).WithContext(ctx))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected a route without a timeout to be left alone, got %d", w.Code)
+	}
+}
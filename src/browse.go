@@ -0,0 +1,325 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// browseIndexVersion is the version of the layout of the browse index. Like
+// the search index, it is built again from scratch when the server starts if
+// the one in the store was built with a different version.
+const browseIndexVersion = "2"
+
+// The browse index lets the tabs by one artist, or with one tag, be looked up
+// without going through the whole collection. It keeps the IDs of each
+// artist's tabs, and of the tabs with each tag, under their browseNames. It
+// also keeps each artist's name as it was written in one of their tabs, so
+// that it can be shown, and which tabs are explicit, so that they can be left
+// out of the counts. The index is updated whenever a tab is cached, updated
+// or removed, using the tab as it was, so unlike the search index nothing
+// else has to be kept to remove a tab again.
+
+// browseName normalises an artist or a tag for the browse index, so that
+// names which only differ by case or punctuation, such as "Guns N' Roses" and
+// "guns n roses", are looked up as the same one.
+func browseName(name string) string {
+	return strings.Join(searchWords(name), " ")
+}
+
+// addToBrowseIndex adds a tab, which must already have its ID, to the index
+// under its artist and each of its tags.
+func (s *Server) addToBrowseIndex(tab *Tab) error {
+	return s.Store.AddToBrowseIndex(tab)
+}
+
+// removeFromBrowseIndex takes a tab out of the index. The tab must be the
+// version which was added, so that it is removed from under the same artist
+// and tags. If it was its artist's last tab, the artist's name is forgotten
+// too.
+func (s *Server) removeFromBrowseIndex(tab *Tab) error {
+	return s.Store.RemoveFromBrowseIndex(tab)
+}
+
+// markBrowseExplicit notes in the browse index whether a tab is explicit,
+// which is needed when the admin changes their mind about it without the
+// tab being cached again.
+func (s *Server) markBrowseExplicit(tab *Tab) error {
+	return s.Store.MarkBrowseExplicit(tab.ID, tab.Explicit)
+}
+
+// resetBrowseIndex removes every tab from the browse index, and returns how
+// many things were removed.
+func (s *Server) resetBrowseIndex() (int64, error) {
+	return s.Store.ResetBrowseIndex()
+}
+
+// ensureBrowseIndex checks that the browse index in the store was built
+// with the current browseIndexVersion, and if it wasn't, builds it again from
+// the cached tabs, in the same way as ensureSearchIndex.
+func (s *Server) ensureBrowseIndex() error {
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	version, err := s.Store.IndexVersion(indexBrowse)
+	if err != nil {
+		return err
+	} else if version == browseIndexVersion {
+		return nil
+	}
+
+	fmt.Println("Building the browse index...")
+
+	if _, err := s.resetBrowseIndex(); err != nil {
+		return err
+	}
+
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		return err
+	}
+
+	tabs, err := s.Store.GetTabs(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, tab := range tabs {
+		if err := s.addToBrowseIndex(tab); err != nil {
+			return err
+		}
+	}
+
+	return s.Store.SetIndexVersion(indexBrowse, browseIndexVersion)
+}
+
+// browseTabs returns the tabs with the given IDs, such as the ones in the
+// browse index under an artist, sorted by title, with transformations
+// applied.
+func (s *Server) browseTabs(ids []string) ([]*Tab, error) {
+	tabs, err := s.Store.GetTabs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tab := range tabs {
+		tab.applyTransformations(s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
+	}
+
+	sort.Slice(tabs, func(i, j int) bool {
+		return tabs[i].Title < tabs[j].Title
+	})
+
+	return tabs, nil
+}
+
+// An artistCount is an artist, with transformations applied to their name,
+// along with the number of tabs by them.
+type artistCount struct {
+	Artist string `json:"artist"`
+	Count  int    `json:"count"`
+}
+
+// artists returns every artist in the browse index and how many tabs they
+// have, in alphabetical order. If explicit is false, explicit tabs aren't
+// counted, and artists who only have explicit tabs are left out. The counts
+// come from the browse index, so no tabs are fetched.
+func (s *Server) artists(explicit bool) ([]artistCount, error) {
+	indexed, err := s.Store.ArtistCounts(explicit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Artists whose names only differ by the characters which are removed
+	// end up with the same name once it is transformed, so they are
+	// counted together.
+	counts := make(map[string]int, len(indexed))
+
+	for name, count := range indexed {
+		counts[transformString(name, s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)] += count
+	}
+
+	return sortArtists(counts), nil
+}
+
+// licensedArtists is like artists, but only counts the tabs with an allowed
+// license, for public mode. The browse index doesn't know about licenses, so
+// the tabs are fetched and counted instead.
+func (s *Server) licensedArtists(ctx context.Context, explicit bool) ([]artistCount, error) {
+	tabs, err := s.getTabs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !explicit {
+		tabs = filterExplicit(tabs)
+	}
+
+	counts := make(map[string]int)
+	for _, tab := range s.filterLicensed(tabs) {
+		counts[tab.Artist]++
+	}
+
+	return sortArtists(counts), nil
+}
+
+// sortArtists returns the artists with a count above 0, in alphabetical
+// order.
+func sortArtists(counts map[string]int) []artistCount {
+	artists := make([]artistCount, 0, len(counts))
+	for name, count := range counts {
+		if count > 0 {
+			artists = append(artists, artistCount{Artist: name, Count: count})
+		}
+	}
+
+	sort.Slice(artists, func(i, j int) bool {
+		a, b := strings.ToLower(artists[i].Artist), strings.ToLower(artists[j].Artist)
+		if a != b {
+			return a < b
+		}
+
+		return artists[i].Artist < artists[j].Artist
+	})
+
+	return artists
+}
+
+// handleArtistsAPI is called to respond to a HTTP request to /api/v1/artists.
+// It responds with every artist in the collection and the number of tabs
+// they have, encoded in JSON, for browsing the collection by artist. Like
+// /api/v1/tags, explicit tabs are only counted for the clients which can see
+// them, as are unlicensed tabs in public mode, and a client which already
+// has the current list is sent 304 Not Modified instead.
+func (s *Server) handleArtistsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+
+	explicit := s.showsExplicit(r)
+	licensed := s.restrictsLicenses(r)
+
+	version, err := s.Store.CollectionVersion()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	modified, _, err := s.collectionModified()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	etag := tabsETag(version, explicit, licensed)
+	setValidators(w, etag, modified)
+
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var artists []artistCount
+
+	if licensed {
+		artists, err = s.licensedArtists(r.Context(), explicit)
+	} else {
+		artists, err = s.artists(explicit)
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(artists)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+// serveBrowse responds with the tabs in the browse index under the given
+// kind, which is "artist" or "tag", and name, encoded in JSON in the same way
+// as /api/v1/search does. A name which no tab has gives an empty list rather
+// than an error, since there's no list of artists or tags to check it
+// against which is any cheaper than the index itself.
+func (s *Server) serveBrowse(w http.ResponseWriter, r *http.Request, kind, name string) {
+	w.Header().Set("Cache-Control", "max-age=0")
+
+	normalised := browseName(name)
+	if normalised == "" {
+		writeError(w, http.StatusBadRequest, errors.New("the "+kind+" must have at least one letter or digit"))
+		return
+	}
+
+	ids, err := s.Store.BrowseIDs(kind, normalised)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	tabs, err := s.browseTabs(ids)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !s.showsExplicit(r) {
+		tabs = filterExplicit(tabs)
+	}
+
+	if s.restrictsLicenses(r) {
+		tabs = s.filterLicensed(tabs)
+	}
+
+	if lang := r.FormValue("lang"); lang != "" {
+		tabs = filterLanguage(tabs, lang)
+	}
+
+	if tuning := r.FormValue("tuning"); tuning != "" {
+		tabs = filterTuning(tabs, tuning)
+	}
+
+	if chords := r.Form["chord"]; len(chords) > 0 {
+		tabs = filterChords(tabs, chords)
+	}
+
+	favourites, err := s.favouriteIDs(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	markFavourites(tabs, favourites)
+
+	jsonData, err := json.Marshal(tabs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// handleTabsByTagAPI is called to respond to a HTTP request to
+// /api/v1/tabs/by-tag/{tag}. It responds with the tabs which have the tag,
+// ignoring case and punctuation, encoded in JSON.
+func (s *Server) handleTabsByTagAPI(w http.ResponseWriter, r *http.Request) {
+	s.serveBrowse(w, r, "tag", mux.Vars(r)["tag"])
+}
+
+// handleTabsByArtistAPI is called to respond to a HTTP request to
+// /api/v1/tabs/by-artist/{artist}. It responds with the tabs by the artist,
+// ignoring case and punctuation, encoded in JSON.
+func (s *Server) handleTabsByArtistAPI(w http.ResponseWriter, r *http.Request) {
+	s.serveBrowse(w, r, "artist", mux.Vars(r)["artist"])
+}
@@ -0,0 +1,175 @@
+package src
+
+import (
+	"strings"
+)
+
+// A tab's chords are picked out of its content when it is read, so that the
+// collection can be searched for the songs which use a chord, such as
+// /api/v1/search?chord=Em7. Chords are found in two places: lines made up of
+// nothing but chords, which are written above the lyrics in most tabs, and
+// chords in square brackets in the middle of the lyrics, like "[Am]Hello
+// [G]there", which is how ChordPro files write them.
+
+// chordLineMarkers are the things which can appear on a line of chords
+// without being chords themselves, such as bar lines and repeat markers.
+var chordLineMarkers = map[string]bool{
+	"|": true, "||": true, "|:": true, ":|": true, "-": true, "/": true,
+	"%": true, "x2": true, "x3": true, "x4": true, "(x2)": true, "(x3)": true,
+	"(x4)": true, "n.c.": true, "nc": true, "(n.c.)": true,
+}
+
+// nonChordLabels are the labels which start lines that look like lines of
+// chords, but are really saying something else about the tab, such as "Key:
+// G" or "Tuning: E A D G B E".
+var nonChordLabels = map[string]bool{
+	"key:": true, "tuning:": true, "tuned:": true, "capo:": true,
+}
+
+// detectChords returns the distinct chords which a tab's content uses, in
+// their standard form and in the order they first appear.
+func detectChords(content string) []string {
+	chords := []string{}
+	seen := make(map[string]bool)
+
+	add := func(chord string) {
+		chord = canonicalChord(chord)
+		if !seen[chord] {
+			seen[chord] = true
+			chords = append(chords, chord)
+		}
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if fields, ok := chordLine(line); ok {
+			for _, field := range fields {
+				add(field)
+			}
+
+			continue
+		}
+
+		// A line of lyrics can still have chords in square brackets, but
+		// section headings like "[Chorus]" aren't chords.
+		for _, part := range strings.Split(line, "[")[1:] {
+			end := strings.IndexByte(part, ']')
+			if end < 0 {
+				continue
+			}
+
+			if chord := part[:end]; isChord(chord) {
+				add(chord)
+			}
+		}
+	}
+
+	return chords
+}
+
+// chordLine reports whether a line of a tab is a line of chords, such as "Em7
+// G  D/F#  Cadd9", returning the chords in it if it is. A line which starts
+// with a label like "Intro:" counts, as long as everything after the label is
+// a chord or a marker like a bar line or "x2".
+func chordLine(line string) ([]string, bool) {
+	if tuningPattern.MatchString(line) {
+		return nil, false
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+		if nonChordLabels[strings.ToLower(fields[0])] {
+			return nil, false
+		}
+
+		fields = fields[1:]
+	}
+
+	var chords []string
+
+	for _, field := range fields {
+		if chordLineMarkers[strings.ToLower(field)] {
+			continue
+		}
+
+		if !isChord(field) {
+			return nil, false
+		}
+
+		chords = append(chords, field)
+	}
+
+	return chords, len(chords) > 0
+}
+
+// isChord reports whether some text in a tab is a chord. Chords are only
+// recognised with a capital letter, so that words in the lyrics like "am"
+// aren't mistaken for them.
+func isChord(text string) bool {
+	return text != "" && text[0] >= 'A' && text[0] <= 'G' && chordPattern.MatchString(canonicalChord(text))
+}
+
+// canonicalChord returns the standard form of a chord, so that chords which
+// were written differently can be compared: the root is given a capital
+// letter, "♯" and "♭" are written as "#" and "b", and "min" is written as
+// "m", so that "emin7" becomes "Em7". A major seventh is left as "maj7".
+func canonicalChord(chord string) string {
+	chord = strings.TrimSpace(chord)
+	chord = strings.NewReplacer("♯", "#", "♭", "b").Replace(chord)
+
+	if chord == "" {
+		return chord
+	}
+
+	if first := chord[0]; first >= 'a' && first <= 'g' {
+		chord = string(first-'a'+'A') + chord[1:]
+	}
+
+	// The bass note of a slash chord is written with a capital letter too.
+	if slash := strings.LastIndexByte(chord, '/'); slash >= 0 && slash+1 < len(chord) {
+		if bass := chord[slash+1]; bass >= 'a' && bass <= 'g' {
+			chord = chord[:slash+1] + string(bass-'a'+'A') + chord[slash+2:]
+		}
+	}
+
+	root := 1
+	if strings.HasPrefix(chord[root:], "#") || strings.HasPrefix(chord[root:], "b") {
+		root++
+	}
+
+	if strings.HasPrefix(chord[root:], "min") {
+		chord = chord[:root] + "m" + chord[root+len("min"):]
+	}
+
+	return chord
+}
+
+// filterChords returns the tabs which use every one of the given chords,
+// however they are written.
+func filterChords(tabs []*Tab, chords []string) []*Tab {
+	filtered := make([]*Tab, 0, len(tabs))
+
+tabs:
+	for _, tab := range tabs {
+		for _, chord := range chords {
+			if !tabUsesChord(tab, canonicalChord(chord)) {
+				continue tabs
+			}
+		}
+
+		filtered = append(filtered, tab)
+	}
+
+	return filtered
+}
+
+// tabUsesChord reports whether a tab uses the given chord, which must already
+// be in its standard form.
+func tabUsesChord(tab *Tab, chord string) bool {
+	for _, used := range tab.Chords {
+		if used == chord {
+			return true
+		}
+	}
+
+	return false
+}
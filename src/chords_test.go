@@ -0,0 +1,59 @@
+package src
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectChords(t *testing.T) {
+	cases := []struct {
+		name, content string
+		chords        []string
+	}{
+		{"chord line", "Em7  G  D/F#  Cadd9\nSome words go here", []string{"Em7", "G", "D/F#", "Cadd9"}},
+		{"labelled", "Intro: | Am | F | C G | x2", []string{"Am", "F", "C", "G"}},
+		{"bracketed", "[Am]Hello [G]there, [Fmaj7]friend", []string{"Am", "G", "Fmaj7"}},
+
+		// Each chord is only given once, in the order it first appears,
+		// however it was written.
+		{"duplicates", "Am  G  Am\n[Am]Hello [A♭]there [G#]and [Ab]again", []string{"Am", "G", "Ab", "G#"}},
+		{"written differently", "Emin7  F♯  Bbm/d", []string{"Em7", "F#", "Bbm/D"}},
+
+		// Section headings and words in the lyrics aren't chords.
+		{"section headings", "[Chorus]\n[Verse 2]\nI am a man", []string{}},
+		{"lyrics", "A day in the life\nam I here", []string{}},
+
+		// Neither are the notes of a tuning, or a key.
+		{"tuning", "Tuning: E A D G B E\nKey: G\nCapo: 2", []string{}},
+
+		{"empty", "", []string{}},
+	}
+
+	for _, c := range cases {
+		if chords := detectChords(c.content); !reflect.DeepEqual(chords, c.chords) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.chords, chords)
+		}
+	}
+}
+
+func TestCanonicalChord(t *testing.T) {
+	cases := map[string]string{
+		"Am":     "Am",
+		"am":     "Am",
+		"Amin":   "Am",
+		"F♯min7": "F#m7",
+		"B♭":     "Bb",
+		"bbmin":  "Bbm",
+		"Cmaj7":  "Cmaj7",
+		"d/f#":   "D/F#",
+		"G/b":    "G/B",
+		" C ":    "C",
+		"":       "",
+	}
+
+	for chord, expected := range cases {
+		if canonical := canonicalChord(chord); canonical != expected {
+			t.Errorf("%q: expected %q, got %q", chord, expected, canonical)
+		}
+	}
+}
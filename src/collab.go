@@ -0,0 +1,585 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+// A tab's content can be edited by several people at once, such as two band
+// members fixing a transcription together during a rehearsal. Each tab which
+// is being edited has a room, which holds the content as it is being edited
+// and the operations which have been made to it. The server is the authority
+// on what the content is: each client sends its changes as operations based
+// on the version of the content it last saw, and the server transforms them
+// against any operations which other clients made since then, applies them,
+// and sends them out to everyone in the room.
+//
+// A client joins a room by opening a WebSocket at /api/v1/tab/{id}/collab. The
+// first message it is sent is {"snapshot": ...}, holding the content and its
+// version, and each one after it is {"op": ...}, holding an operation which
+// was applied to it. It sends its own operations over the same WebSocket,
+// waiting for each one to come back applied before sending the next, and
+// transforming the ones which it hasn't sent yet against the operations it
+// receives in the meantime. If one of its operations can't be applied, it is
+// sent {"error": ...}, in the same shape as the API's other errors, and the
+// connection is closed, so that it joins the room again.
+//
+// The content is written to the tab's file a couple of seconds after it was
+// last changed, when everyone has left the room, and when the server shuts
+// down, which updates the cached tab in the same way as editing the file by
+// hand would. While a tab is being edited, the room is the authority on its
+// content too, so changes made to the file in other ways are overwritten
+// when the room is next saved.
+//
+// Positions in the content are counted in UTF-16 code units, as JavaScript's
+// strings are, so that browsers can use them as they are.
+const (
+	// collabHistory is how many of a room's most recent operations are
+	// kept for transforming the ones which arrive late. A client which is
+	// further behind than this has to join the room again.
+	collabHistory = 500
+
+	// collabSaveDelay is how long after the content was last changed that
+	// it is written to the tab's file.
+	collabSaveDelay = 2 * time.Second
+
+	// collabKeepAlive is how often an empty message is sent to the clients
+	// in a room when nothing else has been, so that proxies don't close the
+	// connection.
+	collabKeepAlive = 30 * time.Second
+
+	// maxCollabContent is the longest that a tab's content can be made by
+	// editing it, in UTF-16 code units.
+	maxCollabContent = 1 << 20
+
+	// maxCollabMessage is the most bytes which a client can send in one
+	// message, which is enough for an operation inserting the longest
+	// content, even if every code unit of it is escaped in the JSON.
+	maxCollabMessage = 6*maxCollabContent + 1024
+)
+
+// errCollabOutOfDate is returned when an operation is based on a version of
+// the content which is too old, or which doesn't exist yet.
+var errCollabOutOfDate = newAPIError(codeConflict, "the operation is based on a version of the content which the server doesn't have, so the room has to be joined again")
+
+// A collabOp is an operation on a tab's content, which replaces the Delete
+// code units starting at Pos with Insert. When it is sent by a client,
+// Version is the version of the content which it was made to, and when it
+// is sent out to the room, it is the version which applying it made.
+type collabOp struct {
+	Version int    `json:"version"`
+	Pos     int    `json:"pos"`
+	Delete  int    `json:"delete"`
+	Insert  string `json:"insert"`
+
+	// Client is an ID which the client which made the operation chose, so
+	// that it can recognise its own operations when they are sent back.
+	Client string `json:"client"`
+}
+
+// A collabSnapshot is the content of a room at a particular version.
+type collabSnapshot struct {
+	Version int    `json:"version"`
+	Content string `json:"content"`
+}
+
+// A collabRoom holds the content of a tab which is being edited, which is
+// only used while Server.collabLock is held.
+type collabRoom struct {
+	id       string
+	filename string
+	content  []uint16
+	version  int
+
+	// history holds the most recent operations, the last of which made
+	// the current version.
+	history []collabOp
+
+	// saved is the content which was last read from or written to the
+	// file, and editor is whoever made the last change, who the changes are
+	// made on behalf of when they are saved.
+	saved  string
+	editor actor
+
+	subscribers map[chan collabOp]bool
+	saveTimer   *time.Timer
+}
+
+// utf16Length returns the number of UTF-16 code units in the string.
+func utf16Length(text string) int {
+	return len(utf16.Encode([]rune(text)))
+}
+
+// transform changes the operation a, which was made to the same version of
+// the content as b, so that it does the same thing once b has been applied.
+// Clients transform the operations which they receive against their own in
+// the same way, only with their own going second when two would otherwise be
+// tied, so that everyone ends up with the same content whichever order they
+// apply them in:
+//
+//   - If both insert text at the same place, a's text goes after b's, since
+//     b was applied first.
+//
+//   - If their ranges overlap, the text which either of them deleted is
+//     deleted, and the text which they inserted goes in the order of their
+//     ranges.
+//
+//   - If one range is inside the other, the outer change wins, and the inner
+//     one is dropped, since otherwise there is nowhere sensible to put it.
+func (a collabOp) transform(b collabOp) collabOp {
+	aEnd, bEnd := a.Pos+a.Delete, b.Pos+b.Delete
+	inserted := utf16Length(b.Insert)
+
+	switch {
+	case a.Delete == 0 && b.Delete == 0 && a.Pos == b.Pos:
+		a.Pos += inserted
+
+	case aEnd <= b.Pos:
+		// a is entirely before b, so it isn't affected.
+
+	case a.Pos >= bEnd:
+		// a is entirely after b, so it just moves along.
+		a.Pos += inserted - b.Delete
+
+	case a.Pos >= b.Pos && aEnd >= bEnd:
+		// The ranges overlap with b's first, so a only deletes what is
+		// left of its range after b's, and its text goes after b's.
+		a.Pos, a.Delete = b.Pos+inserted, aEnd-bEnd
+
+	case a.Pos <= b.Pos && aEnd <= bEnd:
+		// The ranges overlap with a's first, so it only deletes up to
+		// where b's starts.
+		a.Delete = b.Pos - a.Pos
+
+	case a.Pos < b.Pos:
+		// b is inside a, so a deletes b's text too.
+		a.Delete += inserted - b.Delete
+
+	default:
+		// a is inside b, so it is dropped.
+		a.Pos, a.Delete, a.Insert = b.Pos, 0, ""
+	}
+
+	return a
+}
+
+// collabRoom returns the room for the tab with the given ID, opening it with
+// the content of the tab's file if nobody has been editing it. The second
+// return value is false if there is no such tab, and errBinaryTab is returned
+// if the tab is binary. collabLock must be held.
+func (s *Server) collabRoom(id string) (*collabRoom, bool, error) {
+	if room, ok := s.collabRooms[id]; ok {
+		return room, true, nil
+	}
+
+	tab, ok, err := s.Store.GetTab(id)
+	if err != nil || !ok {
+		return nil, false, err
+	} else if tab.Binary {
+		return nil, true, errBinaryTab
+	}
+
+	// The content is read from the file, rather than taken from the cached
+	// tab, since the cached content has had the transform script run on
+	// it.
+	content, err := ioutil.ReadFile(s.tabPath(tab.Filename))
+	if err != nil {
+		return nil, false, err
+	}
+
+	room := &collabRoom{
+		id:          id,
+		filename:    tab.Filename,
+		content:     utf16.Encode([]rune(string(content))),
+		saved:       string(content),
+		subscribers: make(map[chan collabOp]bool),
+	}
+
+	// The version carries on from where the content was last edited, so
+	// that a client which missed the room closing can't mistake the new
+	// room's versions for the old one's.
+	if version, ok, err := s.Store.CollabVersion(id); err == nil && ok {
+		room.version = version
+	}
+
+	if s.collabRooms == nil {
+		s.collabRooms = make(map[string]*collabRoom)
+	}
+
+	s.collabRooms[id] = room
+	return room, true, nil
+}
+
+// applyCollabOp transforms the operation against the ones which were applied
+// since the version it was made to, applies it to the room, and sends it out
+// to everyone in the room. The operation as it was applied is returned.
+// collabLock must be held.
+func (s *Server) applyCollabOp(room *collabRoom, op collabOp, by actor) (collabOp, error) {
+	oldest := room.version - len(room.history)
+	if op.Version < oldest || op.Version > room.version {
+		return op, errCollabOutOfDate
+	}
+
+	for _, applied := range room.history[op.Version-oldest:] {
+		op = op.transform(applied)
+	}
+
+	if op.Pos < 0 || op.Delete < 0 || op.Pos+op.Delete > len(room.content) {
+		return op, fmt.Errorf("the operation is outside the content, which is %d long", len(room.content))
+	}
+
+	inserted := utf16.Encode([]rune(op.Insert))
+	if len(room.content)-op.Delete+len(inserted) > maxCollabContent {
+		return op, fmt.Errorf("the content can't be made longer than %d characters", maxCollabContent)
+	}
+
+	content := make([]uint16, 0, len(room.content)-op.Delete+len(inserted))
+	content = append(content, room.content[:op.Pos]...)
+	content = append(content, inserted...)
+	content = append(content, room.content[op.Pos+op.Delete:]...)
+
+	room.content = content
+	room.version++
+	room.editor = by
+
+	op.Version = room.version
+
+	room.history = append(room.history, op)
+	if len(room.history) > collabHistory {
+		room.history = room.history[len(room.history)-collabHistory:]
+	}
+
+	// A client which isn't keeping up is dropped, rather than holding up
+	// everyone else, and will join the room again.
+	for subscriber := range room.subscribers {
+		select {
+		case subscriber <- op:
+		default:
+			delete(room.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+
+	if room.saveTimer == nil {
+		room.saveTimer = time.AfterFunc(collabSaveDelay, func() {
+			s.collabLock.Lock()
+			defer s.collabLock.Unlock()
+
+			room.saveTimer = nil
+
+			if err := s.saveCollabRoom(room); err != nil {
+				s.logMessage("error", "The edits to the tab with the ID %s couldn't be saved: %s", room.id, err)
+			}
+
+			// A room whose clients have all gone isn't needed once it has
+			// been saved.
+			if len(room.subscribers) == 0 {
+				s.closeCollabRoom(room)
+			}
+		})
+	} else {
+		room.saveTimer.Reset(collabSaveDelay)
+	}
+
+	return op, nil
+}
+
+// saveCollabRoom writes the room's content to the tab's file if it has
+// changed, and updates the cached tab. If the tab has been deleted or renamed
+// since the room was opened, the changes are dropped and the room is closed,
+// since otherwise the file would be brought back. collabLock must be held.
+func (s *Server) saveCollabRoom(room *collabRoom) error {
+	content := string(utf16.Decode(room.content))
+
+	if err := s.Store.SetCollabVersion(room.id, room.version); err != nil {
+		return err
+	}
+
+	if content == room.saved {
+		return nil
+	}
+
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	tab, ok, err := s.Store.GetTab(room.id)
+	if err != nil {
+		return err
+	} else if !ok || tab.Filename != room.filename {
+		s.closeCollabRoom(room)
+		return errors.New("the tab has been deleted or renamed while it was being edited")
+	}
+
+	if err := ioutil.WriteFile(s.tabPath(room.filename), []byte(content), 0644); err != nil {
+		return err
+	}
+
+	room.saved = content
+
+	fresh, ok, err := s.readTab(room.filename, tokenizePatterns(s.Settings.FilenamePatterns))
+	if err != nil || !ok {
+		return err
+	}
+
+	return s.updateCachedTab(room.id, fresh, room.editor)
+}
+
+// closeCollabRoom sends everyone away from the room and forgets it.
+// collabLock must be held.
+func (s *Server) closeCollabRoom(room *collabRoom) {
+	for subscriber := range room.subscribers {
+		close(subscriber)
+	}
+
+	room.subscribers = make(map[chan collabOp]bool)
+
+	if room.saveTimer != nil {
+		room.saveTimer.Stop()
+		room.saveTimer = nil
+	}
+
+	if s.collabRooms[room.id] == room {
+		delete(s.collabRooms, room.id)
+	}
+}
+
+// leaveCollabRoom takes a subscriber out of the room. If it was the last one,
+// the content is saved and the room is closed.
+func (s *Server) leaveCollabRoom(room *collabRoom, subscriber chan collabOp) {
+	s.collabLock.Lock()
+	defer s.collabLock.Unlock()
+
+	if room.subscribers[subscriber] {
+		delete(room.subscribers, subscriber)
+		close(subscriber)
+	}
+
+	if len(room.subscribers) > 0 || s.collabRooms[room.id] != room {
+		return
+	}
+
+	if err := s.saveCollabRoom(room); err != nil {
+		s.logMessage("error", "The edits to the tab with the ID %s couldn't be saved: %s", room.id, err)
+	}
+
+	s.closeCollabRoom(room)
+}
+
+// endCollabStreams sends everyone away from every room, so that the server
+// can shut down without waiting for them. Each room is saved as its last
+// client leaves. It is called when the server starts shutting down.
+func (s *Server) endCollabStreams() {
+	s.collabLock.Lock()
+	defer s.collabLock.Unlock()
+
+	for _, room := range s.collabRooms {
+		for subscriber := range room.subscribers {
+			delete(room.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// saveCollabRooms saves and closes every room which is still open, such as
+// the ones whose content was changed without anyone following along. It is
+// called when the server has stopped handling requests.
+func (s *Server) saveCollabRooms() {
+	s.collabLock.Lock()
+	defer s.collabLock.Unlock()
+
+	for _, room := range s.collabRooms {
+		if err := s.saveCollabRoom(room); err != nil {
+			s.logMessage("error", "The edits to the tab with the ID %s couldn't be saved: %s", room.id, err)
+		}
+
+		s.closeCollabRoom(room)
+	}
+}
+
+// handleEdit is called to respond to a HTTP request to /edit/{id}. The page
+// lets several people edit the content of the tab with the given ID at once,
+// through the tab's room.
+func (s *Server) handleEdit(w http.ResponseWriter, r *http.Request) {
+	//  Disable caching for this route.
+	w.Header().Set("Cache-Control", "max-age=0")
+
+	http.ServeFile(w, r, s.staticPath("html/edit.html"))
+}
+
+// handleCollabAPI is called to respond to a HTTP request to
+// /api/v1/tab/{id}/collab. A GET request responds with a snapshot of the tab's
+// content as it is being edited, encoded in JSON. If the request asks to be
+// upgraded to a WebSocket, it joins the tab's room instead, as described at
+// the top of this file.
+func (s *Server) handleCollabAPI(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	s.collabLock.Lock()
+
+	room, ok, err := s.collabRoom(id)
+	if err != nil || !ok {
+		s.collabLock.Unlock()
+
+		if err == errBinaryTab {
+			writeError(w, http.StatusConflict, err)
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		} else {
+			writeError(w, http.StatusNotFound, errTabNotFound)
+		}
+
+		return
+	}
+
+	snapshot := collabSnapshot{Version: room.version, Content: string(utf16.Decode(room.content))}
+
+	if !isWebSocketRequest(r) {
+		// Nobody is in a room which has just been opened to take a
+		// snapshot, so it is closed again straight away.
+		if len(room.subscribers) == 0 && room.saveTimer == nil {
+			s.closeCollabRoom(room)
+		}
+
+		s.collabLock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+		return
+	}
+
+	// The client joins the room before the connection is upgraded, so that
+	// it doesn't miss any operations which are applied in between, and
+	// leaves it again whether or not the upgrade works.
+	ops := make(chan collabOp, 64)
+	room.subscribers[ops] = true
+
+	s.collabLock.Unlock()
+	defer s.leaveCollabRoom(room, ops)
+
+	s.serveWebSocket(w, r, func(ws *websocket.Conn) {
+		s.followCollabRoom(ws, r, id, snapshot, ops)
+	})
+}
+
+// A collabMessage is a message sent to a client in a tab's room, which has
+// exactly one of its fields set, other than the empty messages which keep the
+// connection open.
+type collabMessage struct {
+	Snapshot *collabSnapshot `json:"snapshot,omitempty"`
+	Op       *collabOp       `json:"op,omitempty"`
+	Error    *errorBody      `json:"error,omitempty"`
+}
+
+// followCollabRoom sends the snapshot to a client which has joined a tab's
+// room over a WebSocket, followed by each operation on the given channel,
+// while applying the operations which the client sends. It returns when
+// either the client or the room goes away.
+func (s *Server) followCollabRoom(ws *websocket.Conn, r *http.Request, id string, snapshot collabSnapshot, ops chan collabOp) {
+	ws.MaxPayloadBytes = maxCollabMessage
+
+	if err := websocket.JSON.Send(ws, collabMessage{Snapshot: &snapshot}); err != nil {
+		return
+	}
+
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		s.receiveCollabOps(ws, r, id)
+	}()
+
+	keepAlive := time.NewTicker(collabKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var message collabMessage
+
+		select {
+		case op, ok := <-ops:
+			if !ok {
+				return
+			}
+
+			message.Op = &op
+
+		case <-keepAlive.C:
+
+		case <-received:
+			return
+		}
+
+		if err := websocket.JSON.Send(ws, message); err != nil {
+			return
+		}
+	}
+}
+
+// receiveCollabOps applies each operation which the client sends over the
+// WebSocket to the room of the tab with the given ID, until the connection
+// closes. If one can't be applied, the client is sent the error, and the
+// connection is closed, since the client's content can't be trusted to match
+// the room's any more, so it has to join the room again.
+func (s *Server) receiveCollabOps(ws *websocket.Conn, r *http.Request, id string) {
+	for {
+		var op collabOp
+
+		err := websocket.JSON.Receive(ws, &op)
+		if err == io.EOF {
+			return
+		}
+
+		status := http.StatusBadRequest
+		if err != nil {
+			err = errors.New("each message must be an operation encoded in JSON")
+		} else {
+			_, status, err = s.receiveCollabOp(r, id, op)
+		}
+
+		if err != nil {
+			body := newErrorBody(status, err)
+			websocket.JSON.Send(ws, collabMessage{Error: &body})
+			return
+		}
+	}
+}
+
+// receiveCollabOp applies an operation which a client in the room of the tab
+// with the given ID sent, on behalf of whoever made the request which opened
+// the client's connection, and returns it as it was applied. If it can't be
+// applied, an error and error status are returned.
+func (s *Server) receiveCollabOp(r *http.Request, id string, op collabOp) (collabOp, int, error) {
+	if status, err := s.checkEditLock(r, id); err != nil {
+		return op, status, err
+	}
+
+	s.collabLock.Lock()
+	defer s.collabLock.Unlock()
+
+	room, ok, err := s.collabRoom(id)
+	if err == errBinaryTab {
+		return op, http.StatusConflict, err
+	} else if err != nil {
+		return op, http.StatusInternalServerError, err
+	} else if !ok {
+		return op, http.StatusNotFound, errTabNotFound
+	}
+
+	applied, err := s.applyCollabOp(room, op, s.requestActor(r))
+	if err == errCollabOutOfDate {
+		return op, http.StatusConflict, err
+	} else if err != nil {
+		return op, http.StatusBadRequest, err
+	}
+
+	return applied, http.StatusOK, nil
+}
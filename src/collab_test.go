@@ -0,0 +1,125 @@
+package src
+
+import (
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// applyCollabOps applies operations to some content, one after another, in
+// the same way as a room does.
+func applyCollabOps(content string, ops ...collabOp) string {
+	units := utf16.Encode([]rune(content))
+
+	for _, op := range ops {
+		edited := append([]uint16{}, units[:op.Pos]...)
+		edited = append(edited, utf16.Encode([]rune(op.Insert))...)
+		units = append(edited, units[op.Pos+op.Delete:]...)
+	}
+
+	return string(utf16.Decode(units))
+}
+
+func TestUTF16Length(t *testing.T) {
+	// A combining accent is a code unit of its own, as it is in a
+	// JavaScript string.
+	cases := map[string]int{
+		"":         0,
+		"[C]My my": 8,
+		"E♭":       2,
+		"🎸 riff":   7,
+		"e\u0301":  2,
+	}
+
+	for text, expected := range cases {
+		if length := utf16Length(text); length != expected {
+			t.Errorf("%q: expected %d, got %d", text, expected, length)
+		}
+	}
+}
+
+func TestCollabTransform(t *testing.T) {
+	cases := []struct {
+		name     string
+		content  string
+		a, b     collabOp
+		expected string
+	}{
+		{"a before b", "abcdef", collabOp{Pos: 0, Insert: "X"}, collabOp{Pos: 4, Insert: "Y"}, "XabcdYef"},
+		{"a after b", "abcdef", collabOp{Pos: 4, Delete: 1}, collabOp{Pos: 1, Delete: 2, Insert: "ZZZ"}, "aZZZdf"},
+
+		// b was applied first, so its text goes first.
+		{"same place", "abc", collabOp{Pos: 1, Insert: "A"}, collabOp{Pos: 1, Insert: "B"}, "aBAbc"},
+
+		// Whatever either deleted is deleted, and the text goes in the
+		// order of their ranges.
+		{"overlapping, b first", "abcdef", collabOp{Pos: 2, Delete: 3, Insert: "A"}, collabOp{Pos: 1, Delete: 2, Insert: "B"}, "aBAf"},
+		{"overlapping, a first", "abcdef", collabOp{Pos: 1, Delete: 2, Insert: "A"}, collabOp{Pos: 2, Delete: 3, Insert: "B"}, "aABf"},
+
+		// The outer change wins.
+		{"b inside a", "abcdef", collabOp{Pos: 1, Delete: 4, Insert: "A"}, collabOp{Pos: 2, Delete: 1, Insert: "BB"}, "aAf"},
+		{"a inside b", "abcdef", collabOp{Pos: 2, Delete: 1, Insert: "AA"}, collabOp{Pos: 1, Delete: 4, Insert: "B"}, "aBf"},
+
+		// Positions are in UTF-16 code units, so text outside the Basic
+		// Multilingual Plane counts twice.
+		{"astral", "ab", collabOp{Pos: 1, Insert: "X"}, collabOp{Pos: 0, Insert: "🎸"}, "🎸aXb"},
+	}
+
+	for _, c := range cases {
+		if edited := applyCollabOps(c.content, c.b, c.a.transform(c.b)); edited != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, edited)
+		}
+	}
+}
+
+func TestApplyCollabOp(t *testing.T) {
+	s := &Server{}
+
+	// The room's save timer is never due, so that nothing is written.
+	room := &collabRoom{
+		content:   utf16.Encode([]rune("[C]My my")),
+		saveTimer: time.NewTimer(time.Hour),
+	}
+	defer room.saveTimer.Stop()
+
+	subscriber := make(chan collabOp, 2)
+	room.subscribers = map[chan collabOp]bool{subscriber: true}
+
+	if _, err := s.applyCollabOp(room, collabOp{Version: 0, Pos: 8, Insert: "!"}, actor{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An operation made to the version before the last one is transformed
+	// against it.
+	applied, err := s.applyCollabOp(room, collabOp{Version: 0, Pos: 1, Delete: 1, Insert: "G"}, actor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content := string(utf16.Decode(room.content)); content != "[G]My my!" || applied.Version != 2 {
+		t.Errorf("expected version 2 to be \"[G]My my!\", got version %d: %q", applied.Version, content)
+	}
+
+	if len(subscriber) != 2 {
+		t.Errorf("expected both operations to be sent to the room, got %d", len(subscriber))
+	}
+
+	cases := []struct {
+		name string
+		op   collabOp
+	}{
+		{"version which doesn't exist yet", collabOp{Version: 3, Insert: "x"}},
+		{"outside the content", collabOp{Version: 2, Pos: 20, Insert: "x"}},
+		{"deleting past the end", collabOp{Version: 2, Pos: 5, Delete: 10}},
+	}
+
+	for _, c := range cases {
+		if _, err := s.applyCollabOp(room, c.op, actor{}); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+
+	if room.version != 2 {
+		t.Errorf("expected the refused operations not to change the content, got version %d", room.version)
+	}
+}
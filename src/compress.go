@@ -0,0 +1,307 @@
+package src
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// These are the encodings which responses can be compressed with, in the
+// order they are preferred in when the client accepts more than one equally.
+// Brotli makes the tabs' content noticeably smaller than gzip does, but every
+// browser which supports it also supports gzip, so it is only an improvement.
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// supportedEncodings lists the encodings in order of preference.
+var supportedEncodings = []string{encodingBrotli, encodingGzip}
+
+const (
+	// minCompressSize is how many bytes a response must be before it is
+	// compressed. Smaller ones are sent as they are, since compressing them
+	// saves hardly anything, and can even make them bigger.
+	minCompressSize = 1024
+
+	// brotliLevel is how hard brotli tries to compress the responses. The
+	// highest levels are too slow to use on every response.
+	brotliLevel = 5
+)
+
+// incompressibleTypes are the prefixes of the content types which are already
+// compressed, so aren't worth compressing again.
+var incompressibleTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"audio/",
+	"video/",
+	"application/zip",
+	"application/gzip",
+	"font/woff",
+}
+
+// An encoder compresses a response with one of the supported encodings.
+type encoder interface {
+	Write(b []byte) (int, error)
+	Flush() error
+	Close() error
+}
+
+// newEncoder returns an encoder which compresses everything written to it
+// with the given encoding and writes it to w.
+func newEncoder(encoding string, w http.ResponseWriter) encoder {
+	if encoding == encodingBrotli {
+		return brotli.NewWriterLevel(w, brotliLevel)
+	}
+
+	return gzip.NewWriter(w)
+}
+
+// compressWriter wraps a ResponseWriter to compress the response. Whether to
+// compress it is decided when the status is written, since that's when the
+// headers are known, but a response which might be compressed is held back
+// until it is at least minCompressSize bytes, so that small ones can still be
+// sent as they are.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	// status is the status of the response, which is only written once it
+	// is known whether the response will be compressed.
+	status  int
+	decided bool
+
+	// buffer holds the start of a response which might be compressed, while
+	// buffering is true. Once the response is big enough, enc compresses it.
+	buffer    []byte
+	buffering bool
+	enc       encoder
+}
+
+// WriteHeader decides whether the response might be compressed. If it can't
+// be, the status is written straight away. Otherwise, it is held back with
+// the response until it is known whether it is big enough.
+func (c *compressWriter) WriteHeader(status int) {
+	if c.decided {
+		return
+	}
+
+	c.decided = true
+	c.status = status
+
+	if !compressible(status, c.Header()) {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	c.buffering = true
+}
+
+// Write writes some of the response, compressing it if it was decided to.
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.decided {
+		// The content type is sniffed in the same way as it would be
+		// without compression, so that it is set before the decision.
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.buffering {
+		c.buffer = append(c.buffer, b...)
+
+		if len(c.buffer) >= minCompressSize {
+			if err := c.startCompressing(); err != nil {
+				return 0, err
+			}
+		}
+
+		return len(b), nil
+	}
+
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+
+	return c.ResponseWriter.Write(b)
+}
+
+// startCompressing writes the status of a response which is big enough to be
+// compressed, along with the headers saying that it is, and then compresses
+// the part of it which was held back.
+func (c *compressWriter) startCompressing() error {
+	header := c.Header()
+	header.Set("Content-Encoding", c.encoding)
+	header.Del("Content-Length")
+
+	c.ResponseWriter.WriteHeader(c.status)
+	c.enc = newEncoder(c.encoding, c.ResponseWriter)
+
+	buffered := c.buffer
+	c.buffer = nil
+	c.buffering = false
+
+	_, err := c.enc.Write(buffered)
+	return err
+}
+
+// sendUncompressed writes the status of a response which is too small to be
+// compressed, and the part of it which was held back, as they are.
+func (c *compressWriter) sendUncompressed() {
+	c.ResponseWriter.WriteHeader(c.status)
+
+	buffered := c.buffer
+	c.buffer = nil
+	c.buffering = false
+
+	if len(buffered) > 0 {
+		c.ResponseWriter.Write(buffered)
+	}
+}
+
+// Flush sends everything which has been written so far, so that responses
+// which are streamed still arrive as they are written. A response which is
+// still too small to be compressed when it is flushed is sent uncompressed.
+func (c *compressWriter) Flush() {
+	if c.buffering {
+		c.sendUncompressed()
+	}
+
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes hijacking on, so that connections can still be taken over,
+// such as to upgrade them to WebSockets, which browsers ask for with the same
+// Accept-Encoding header as any other request.
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the connection can't be hijacked")
+	}
+
+	return hijacker.Hijack()
+}
+
+// close finishes the response, either by finishing the compression or by
+// sending the response as it is if it turned out to be too small.
+func (c *compressWriter) close() {
+	if c.buffering {
+		c.sendUncompressed()
+	}
+
+	if c.enc != nil {
+		c.enc.Close()
+	}
+}
+
+// compressible reports whether a response with the given status and headers
+// might be compressed. Responses which are known to be smaller than
+// minCompressSize aren't.
+func compressible(status int, header http.Header) bool {
+	// Responses without a body, and ones which are already encoded,
+	// are left alone.
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	} else if header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < minCompressSize {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compressResponses is middleware for the router which compresses responses
+// with brotli or gzip for the clients which can decompress them, which makes
+// the JSON and the tabs' content much smaller to download on a slow
+// connection. Requests for part of a file are left alone, since the range
+// would be of the file rather than the compressed response.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := acceptedEncoding(r)
+		if encoding == "" || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptedEncoding returns the supported encoding which the client said it
+// prefers in its Accept-Encoding header, or an empty string if it doesn't
+// accept any of them. Encodings with a higher quality value are preferred,
+// and ones with the same quality are chosen in the order of
+// supportedEncodings. A quality of zero means that the encoding isn't
+// accepted.
+func acceptedEncoding(r *http.Request) string {
+	qualities := make(map[string]float64)
+
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(encoding, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		quality := 1.0
+
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+				quality = q
+			}
+		}
+
+		qualities[name] = quality
+	}
+
+	best, bestQuality := "", 0.0
+
+	for _, encoding := range supportedEncodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			// A wildcard stands for every encoding which isn't listed.
+			if quality, ok = qualities["*"]; !ok {
+				continue
+			}
+		}
+
+		if quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,148 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The list of tabs rarely changes, but clients ask for it every time they
+// are opened, so /api/v1/tabs sends an ETag made from the collection version,
+// and a Last-Modified time from when the version was last bumped. A client
+// which sends either back, in If-None-Match or If-Modified-Since, is told
+// 304 Not Modified if nothing has changed since, rather than being sent the
+// whole list again. The time is kept in the store alongside the version, to
+// the second.
+
+// noteCollectionModified records that the collection has just changed.
+func (s *Server) noteCollectionModified() error {
+	return s.Store.SetCollectionModified(time.Now())
+}
+
+// collectionModified returns when the collection last changed. The second
+// return value is false if that isn't known, such as when the collection was
+// cached by an older version.
+func (s *Server) collectionModified() (time.Time, bool, error) {
+	return s.Store.CollectionModified()
+}
+
+// tabsETag returns the ETag of the list of tabs at the given collection
+// version. Clients which can see the explicit tabs get a different list to
+// the ones which can't, and so do the ones which can only see the licensed
+// tabs in public mode, so they get a different ETag too. It is a weak ETag,
+// since the envelope's generation time changes even when the tabs don't.
+func tabsETag(version int64, explicit, licensed bool) string {
+	visibility := "clean"
+	if explicit {
+		visibility = "all"
+	}
+
+	if licensed {
+		visibility += "-licensed"
+	}
+
+	return fmt.Sprintf(`W/"%d-%s"`, version, visibility)
+}
+
+// notModified reports whether a request's conditional headers say that the
+// client already has the response with the given ETag and modification time,
+// so it can be sent 304 Not Modified. If-None-Match takes precedence over
+// If-Modified-Since, as in RFC 7232. A zero modification time is never
+// matched by If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, etag)
+	}
+
+	if modified.IsZero() {
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// etagMatches reports whether an If-None-Match header matches the ETag. The
+// comparison is weak, so "W/" prefixes are ignored.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setValidators sets the ETag and, if it is known, the Last-Modified time of
+// a response.
+func setValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Images which the server draws, such as the scale diagrams, only depend on
+// their URL and the server's code, so they can be cached for much longer.
+// Each one is sent with an ETag made from a hash of its content, and with a
+// Content-Location header giving its URL with the hash added in the 'v' query
+// value. That URL only ever refers to that exact image, so it is cached
+// forever, while the plain URL is cached for derivedMaxAge, in case a new
+// version of the server draws it differently. Either way, a client which
+// sends the ETag back is told 304 Not Modified if the image hasn't changed.
+const (
+	// derivedMaxAge is how many seconds derived images can be cached for
+	// at their plain URLs.
+	derivedMaxAge = 24 * 60 * 60
+
+	// immutableMaxAge is how many seconds derived images can be cached for
+	// at their hashed URLs, which is a year, the longest which is usually
+	// allowed.
+	immutableMaxAge = 365 * 24 * 60 * 60
+)
+
+// serveDerived responds with an image or anything else which is derived from
+// the request's URL alone, with the given content type, as described above.
+func serveDerived(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:8])
+	etag := `W/"` + hash + `"`
+
+	query := r.URL.Query()
+	hashed := query.Get("v") == hash
+
+	query.Set("v", hash)
+	location := *r.URL
+	location.RawQuery = query.Encode()
+
+	header := w.Header()
+	header.Set("Content-Location", location.RequestURI())
+
+	if hashed {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", immutableMaxAge))
+	} else {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", derivedMaxAge))
+	}
+
+	setValidators(w, etag, time.Time{})
+
+	if notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Type", contentType)
+	w.Write(body)
+}
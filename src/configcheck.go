@@ -0,0 +1,320 @@
+package src
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// The server used to check its configuration a piece at a time as it started
+// up, so a mistake was only found once everything before it had worked, and
+// a Redis server which couldn't be reached was reported as a bare error from
+// the first thing which was read from it. Instead, the whole configuration is
+// checked before anything is started, and every problem which is found is
+// reported at once, named by the flag which would fix it.
+//
+// Problems with the settings in the store are only warnings, since the server
+// has to start for them to be fixed on the settings page.
+
+// A ConfigProblem is something wrong with one of the server's flags, or with
+// the settings in the store.
+type ConfigProblem struct {
+	// Setting is the name of the flag or setting, such as "tls-cert".
+	Setting string
+
+	// Problem describes what is wrong with it.
+	Problem string
+
+	// Warning is whether the server can start anyway.
+	Warning bool
+}
+
+// A ConfigReport is every problem found with the configuration.
+type ConfigReport struct {
+	Problems []ConfigProblem
+}
+
+// add adds a problem with a setting to the report.
+func (r *ConfigReport) add(setting, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, ConfigProblem{
+		Setting: setting,
+		Problem: fmt.Sprintf(format, args...),
+	})
+}
+
+// warn adds a problem with a setting to the report, which doesn't stop the
+// server from starting.
+func (r *ConfigReport) warn(setting, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, ConfigProblem{
+		Setting: setting,
+		Problem: fmt.Sprintf(format, args...),
+		Warning: true,
+	})
+}
+
+// count returns the number of problems which are warnings, or which aren't.
+func (r *ConfigReport) count(warnings bool) int {
+	n := 0
+	for _, problem := range r.Problems {
+		if problem.Warning == warnings {
+			n++
+		}
+	}
+
+	return n
+}
+
+// OK reports whether the server can start, which it can as long as the only
+// problems are warnings.
+func (r *ConfigReport) OK() bool {
+	return r.count(false) == 0
+}
+
+// String describes every problem in the report, one per line, with the ones
+// which stop the server from starting first. It is empty if there aren't any.
+func (r *ConfigReport) String() string {
+	var report strings.Builder
+
+	for _, warnings := range []bool{false, true} {
+		n := r.count(warnings)
+		if n == 0 {
+			continue
+		}
+
+		kind := "problem"
+		if warnings {
+			kind = "warning"
+		}
+
+		if report.Len() > 0 {
+			report.WriteString("\n")
+		}
+
+		if n == 1 {
+			fmt.Fprintf(&report, "There is a %s with the configuration:\n\n", kind)
+		} else {
+			fmt.Fprintf(&report, "There are %d %ss with the configuration:\n\n", n, kind)
+		}
+
+		for _, problem := range r.Problems {
+			if problem.Warning == warnings {
+				fmt.Fprintf(&report, "  %s: %s\n", problem.Setting, problem.Problem)
+			}
+		}
+	}
+
+	return report.String()
+}
+
+// checkDirectory adds a problem to a report with its add or warn method if the
+// path exists but isn't a directory, or if it has to exist and doesn't.
+func checkDirectory(add func(setting, format string, args ...interface{}), setting, dir string, mustExist bool) {
+	info, err := os.Stat(dir)
+
+	switch {
+	case os.IsNotExist(err):
+		if mustExist {
+			add(setting, "%s doesn't exist", dir)
+		}
+
+	case err != nil:
+		add(setting, "%s can't be read: %s", dir, err)
+
+	case !info.IsDir():
+		add(setting, "%s isn't a directory", dir)
+	}
+}
+
+// checkPort adds a problem to the report if a port number isn't one which
+// can be listened on.
+func (r *ConfigReport) checkPort(setting string, port int) {
+	if port < 1 || port > 65535 {
+		r.add(setting, "%d isn't a port number, which must be from 1 to 65535", port)
+	}
+}
+
+// CheckConfig checks everything in the server's configuration which doesn't
+// need the database, and returns a report of every problem which was found.
+// If server is true, the things only the web server needs, such as the port
+// and the HTTPS certificate, are checked as well, and otherwise, such as when
+// running a command, they're left alone.
+func (s *Server) CheckConfig(server bool) *ConfigReport {
+	report := &ConfigReport{}
+
+	if server {
+		s.checkServerConfig(report)
+	}
+
+	// The log format and level are checked one at a time, so that each
+	// problem is put down to the right flag.
+	if _, err := newRequestLogger(LogConfig{Format: s.Logging.Format}); err != nil {
+		report.add("log-format", "%s", err)
+	}
+
+	if _, err := newRequestLogger(LogConfig{Level: s.Logging.Level}); err != nil {
+		report.add("log-level", "%s", err)
+	}
+
+	if s.DiskConcurrency < 0 {
+		report.add("disk-concurrency", "it must be at least 1, not %d", s.DiskConcurrency)
+	}
+
+	if _, _, _, err := s.Integrity.integrityTime(); err != nil {
+		report.add("integrity-time", "%s", err)
+	}
+
+	if s.Integrity.Threshold < 0 || s.Integrity.Threshold > 100 {
+		report.add("integrity-threshold", "it must be a percentage from 0 to 100, not %d", s.Integrity.Threshold)
+	}
+
+	if s.Secrets.RotationDays < 0 {
+		report.add("secret-rotation-days", "it must be a whole number of days, at least 0, not %d", s.Secrets.RotationDays)
+	}
+
+	if s.Timeouts.Store < 0 {
+		report.add("store-timeout", "it can't be negative")
+	}
+
+	if _, err := parseDurations(s.Timeouts.Operations); err != nil {
+		report.add("store-timeouts", "%s", err)
+	}
+
+	if _, err := s.Timeouts.routeTimeouts(); err != nil {
+		report.add("route-timeouts", "%s", err)
+	}
+
+	if s.Timeouts.BreakerFailures < 0 {
+		report.add("breaker-failures", "it must be at least 1, not %d", s.Timeouts.BreakerFailures)
+	}
+
+	if s.Timeouts.BreakerCooldown < 0 {
+		report.add("breaker-cooldown", "it can't be negative")
+	}
+
+	if s.MQTT.Broker != "" {
+		if _, _, err := net.SplitHostPort(s.MQTT.Broker); err != nil {
+			report.add("mqtt-broker", "%q isn't an address in the form host:port", s.MQTT.Broker)
+		}
+	}
+
+	return report
+}
+
+// checkServerConfig checks the parts of the configuration which only the web
+// server needs.
+func (s *Server) checkServerConfig(report *ConfigReport) {
+	report.checkPort("port", s.Port)
+
+	if s.HTTPS || s.Certificate != "" || s.Key != "" {
+		if s.Certificate == "" {
+			report.add("tls-cert", "a certificate is needed to use HTTPS, since a key was given")
+		} else if s.Key == "" {
+			report.add("tls-key", "a key is needed to use HTTPS, since a certificate was given")
+		} else if _, err := s.tlsConfig(); err != nil {
+			report.add("tls-cert", "%s", err)
+		}
+	}
+
+	if s.RedirectPort != 0 {
+		report.checkPort("redirect-port", s.RedirectPort)
+
+		if !s.HTTPS {
+			report.add("redirect-port", "requests are only redirected when using HTTPS, so a certificate and a key are needed too")
+		} else if s.RedirectPort == s.Port {
+			report.add("redirect-port", "it can't be the same as the port the server listens on")
+		}
+	}
+
+	if s.CORS.Credentials && s.CORS.allowsAnyOrigin() {
+		report.add("cors-credentials", "credentials can't be allowed for any origin, since any site could then act as the admin, so list the origins which need them in cors-origins instead")
+	}
+
+	checkDirectory(report.add, "static-dir", s.StaticDirectory, true)
+	checkDirectory(report.add, "recordings", s.recordingDirectory(), false)
+}
+
+// checkFilenamePattern returns an error describing what is wrong with a
+// filename pattern, or nil if nothing is.
+func checkFilenamePattern(pattern string) error {
+	var (
+		variables, groups int
+		check             func(tokens []patternToken) error
+	)
+
+	check = func(tokens []patternToken) error {
+		for _, token := range tokens {
+			if !token.variable && token.text == "" {
+				groups++
+
+				if err := check(token.optional); err != nil {
+					return err
+				}
+
+				continue
+			} else if !token.variable {
+				continue
+			}
+
+			variables++
+
+			switch token.text {
+			case "[title]", "[artist]", "[tag]":
+			default:
+				if _, isList := tagListDelimiter(token.text); !isList {
+					return fmt.Errorf("%s isn't a variable: they are [title], [artist], [tag], [tags] and [tags:DELIMITER]", token.text)
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if err := check(tokenizePattern(pattern)); err != nil {
+		return err
+	} else if variables == 0 {
+		return fmt.Errorf("it doesn't have any variables, such as [title]")
+	} else if groups > maxPatternGroups {
+		return fmt.Errorf("it has %d optional groups, and can't have more than %d", groups, maxPatternGroups)
+	}
+
+	return nil
+}
+
+// checkSettings adds warnings about any problems with the settings to the
+// report, such as a tab directory which doesn't exist, or any of the ones
+// which changing the settings would refuse.
+func (s *Server) checkSettings(report *ConfigReport, settings *Settings) {
+	checkDirectory(report.warn, "tab directory", settings.TabDirectory, true)
+	settings.check(report.warn)
+}
+
+// CheckStartup checks the whole configuration, as described at the top of
+// this file, and loads the settings from the store into the server, setting
+// it up first if it needs to be, as Bootstrap does. It returns the report of
+// every problem which was found, and the initial admin password if the store
+// was set up. If the report isn't OK, the server shouldn't be started, and
+// its settings might not have been loaded. If server is true, the things
+// which only the web server needs are checked too.
+func (s *Server) CheckStartup(server bool) (*ConfigReport, string) {
+	report := s.CheckConfig(server)
+
+	// The store is pinged rather than read from first, so that a database
+	// which can't be reached is described as such, rather than by the
+	// error from whatever happened to be read first.
+	if err := s.Store.Ping(); err != nil {
+		report.add("redis-addr", "%s", err)
+		return report, ""
+	}
+
+	settings, initialPassword, err := Bootstrap(s.Store)
+	if err != nil {
+		report.add("store", "the settings couldn't be loaded: %s", err)
+		return report, ""
+	}
+
+	s.Settings = settings
+	s.checkSettings(report, settings)
+
+	return report, initialPassword
+}
@@ -0,0 +1,184 @@
+package src
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Browsers block a page on one origin from reading the responses to its
+// requests to another unless the server says that it's allowed, with
+// cross-origin resource sharing (CORS). This lets a separate front-end, on a
+// domain of its own, use the API. Only the origins in the CORS config are
+// allowed, and none are unless it says so. A browser asks first, with an
+// OPTIONS request called a preflight, before sending a request which isn't
+// "simple", such as one with an Authorization header, and the preflight is
+// answered here without going to the router at all.
+//
+// If credentials are allowed, the browser sends the session cookie along
+// with the requests, so a front-end on another origin can log in as the
+// admin. Over HTTPS, the cookie is then sent on requests from other sites,
+// which it otherwise isn't. API tokens work either way, since they are sent
+// in the Authorization header. Credentials can't be allowed along with any
+// origin, since any site at all could then act as the admin while they are
+// logged in, so the server refuses to start with both.
+
+// defaultCORSMethods and defaultCORSHeaders are the methods and request
+// headers which are allowed if the CORS config doesn't say.
+var (
+	defaultCORSMethods = []string{"GET", "POST", "DELETE"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "If-None-Match", "If-Modified-Since", csrfHeader}
+)
+
+// exposedHeaders are the response headers which scripts on other origins are
+// allowed to read, on top of the few which they always can.
+var exposedHeaders = []string{
+	"Content-Disposition",
+	"Content-Location",
+	"Deprecation",
+	"ETag",
+	"Link",
+	"Retry-After",
+	"X-Request-ID",
+}
+
+// defaultCORSMaxAge is how many seconds browsers can remember the answer to a
+// preflight for if the CORS config doesn't say.
+const defaultCORSMaxAge = 600
+
+// A CORSConfig says which other origins can use the API.
+type CORSConfig struct {
+	// Origins are the origins which are allowed, such as
+	// "https://tabs.example.com". "*" allows any origin, but not with
+	// credentials. If there aren't any, no other origins are allowed.
+	Origins []string
+
+	// Methods are the methods which are allowed. If there aren't any,
+	// defaultCORSMethods are.
+	Methods []string
+
+	// Headers are the request headers which are allowed. If there aren't
+	// any, defaultCORSHeaders are.
+	Headers []string
+
+	// Credentials is whether the browser can send the session cookie with
+	// the requests.
+	Credentials bool
+
+	// MaxAge is how many seconds browsers can remember the answer to a
+	// preflight for. If it is 0, defaultCORSMaxAge is used.
+	MaxAge int
+}
+
+// allowsOrigin reports whether the config allows requests from the origin.
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.Origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsAnyOrigin reports whether the config allows requests from any origin.
+func (c CORSConfig) allowsAnyOrigin() bool {
+	for _, allowed := range c.Origins {
+		if allowed == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsCredentials reports whether the config lets other origins send the
+// session cookie, which it only does if they are listed one by one.
+func (c CORSConfig) allowsCredentials() bool {
+	return c.Credentials && len(c.Origins) > 0 && !c.allowsAnyOrigin()
+}
+
+// handleCORS is middleware which adds the CORS headers to the responses to
+// requests from the allowed origins, and answers their preflights. Requests
+// from other origins, and ones without an Origin header, are passed on as
+// they are, so the browser blocks the responses to the ones which came from
+// other origins.
+func (s *Server) handleCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if len(s.CORS.Origins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The response depends on the origin, so caches mustn't give it
+		// to requests from other origins.
+		w.Header().Add("Vary", "Origin")
+
+		if origin == "" || !s.CORS.allowsOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+
+		// The origin is never echoed back when any origin is allowed,
+		// even if the config allows credentials too, which the startup
+		// check refuses, since browsers refuse credentials along with a
+		// wildcard, and echoing it would let any site use the session.
+		if s.CORS.allowsAnyOrigin() {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+
+			if s.CORS.Credentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		// A preflight is an OPTIONS request which says which method it is
+		// asking about. It is answered here, whether or not the method
+		// is allowed, since the browser checks the answer itself.
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+
+			methods := s.CORS.Methods
+			if len(methods) == 0 {
+				methods = defaultCORSMethods
+			}
+
+			headers := s.CORS.Headers
+			if len(headers) == 0 {
+				headers = defaultCORSHeaders
+			}
+
+			maxAge := s.CORS.MaxAge
+			if maxAge <= 0 {
+				maxAge = defaultCORSMaxAge
+			}
+
+			header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			header.Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		header.Set("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionSameSite returns the SameSite mode of the session cookie. It is
+// strict, unless particular other origins are allowed to send it, in which
+// case it has to be sent on requests from other sites. Browsers only accept
+// that over HTTPS.
+func (s *Server) sessionSameSite() http.SameSite {
+	if s.CORS.allowsCredentials() && s.HTTPS {
+		return http.SameSiteNoneMode
+	}
+
+	return http.SameSiteStrictMode
+}
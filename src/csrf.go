@@ -0,0 +1,127 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Since a logged in browser sends the session cookie with every request to
+// the server, a page on another site could make it send a request which
+// changes something, such as deleting a tab, without the admin knowing. To
+// stop that, requests which use a session, and aren't GET, HEAD or OPTIONS
+// requests, must also send the session's CSRF token, either in the
+// X-CSRF-Token header or in the 'csrf-token' form value. Other sites can't
+// find out the token, so they can't send it.
+//
+// The token is the session ID signed in the same way as the session cookie,
+// so it doesn't need to be stored. When the admin logs in, it is put in the
+// csrf-token cookie, which the pages' scripts can read, unlike the session
+// cookie. It can also be fetched from /api/v1/csrf-token, such as by a
+// front-end on another origin, which can't read the cookie. Requests which
+// use API tokens don't need a CSRF token, since browsers don't send those by
+// themselves.
+const (
+	csrfCookie = "csrf-token"
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf-token"
+)
+
+// errInvalidCSRFToken is returned when a request which needs a CSRF token
+// doesn't have the right one.
+var errInvalidCSRFToken = newAPIError(codeInvalidCSRFToken, "the CSRF token is missing or wrong")
+
+// csrfToken returns the CSRF token of the session with the given ID.
+func (s *Server) csrfToken(sessionID string) (string, error) {
+	secret, err := s.sessionSecret()
+	if err != nil {
+		return "", err
+	}
+
+	return signSession("csrf:"+sessionID, secret), nil
+}
+
+// setCSRFCookie sets the cookie holding the CSRF token on the response, so
+// that the pages' scripts can send it back. If token is empty, the client is
+// told to forget the cookie instead.
+func (s *Server) setCSRFCookie(w http.ResponseWriter, token string) {
+	cookie := &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(sessionDuration),
+		Secure:   s.HTTPS,
+		SameSite: s.sessionSameSite(),
+	}
+
+	if token == "" {
+		cookie.Expires = time.Time{}
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(w, cookie)
+}
+
+// checkCSRF checks that a request which uses the session with the given ID
+// has the session's CSRF token, unless it is a GET, HEAD or OPTIONS request,
+// which shouldn't change anything. If it doesn't, an error and error status
+// are returned.
+func (s *Server) checkCSRF(r *http.Request, sessionID string) (int, error) {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return http.StatusOK, nil
+	}
+
+	given := r.Header.Get(csrfHeader)
+	if given == "" {
+		given = r.PostFormValue(csrfField)
+	}
+
+	if given == "" {
+		return http.StatusForbidden, errInvalidCSRFToken
+	}
+
+	// The token is accepted if it was made with any of the session keys, so
+	// that rotating the current key doesn't stop pages which are already
+	// open from working.
+	ok, err := s.checkSignature(secretSession, given, func(secret string) string {
+		return signSession("csrf:"+sessionID, secret)
+	})
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !ok {
+		return http.StatusForbidden, errInvalidCSRFToken
+	}
+
+	return http.StatusOK, nil
+}
+
+// handleCSRFTokenAPI is called to respond to a HTTP request to
+// /api/v1/csrf-token. It responds with the CSRF token of the request's
+// session, encoded in JSON, and sets the csrf-token cookie to it again. Only
+// a logged in browser can use it.
+func (s *Server) handleCSRFTokenAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.validateSession(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	id, _, err := s.sessionID(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	token, err := s.csrfToken(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.setCSRFCookie(w, token)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
@@ -0,0 +1,242 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// When a tab's file is edited, clients which already have the old version
+// only need to download what changed. The old content is kept for a while
+// under the tab's ID and its hash, so that only the tab which had it can be
+// asked for it, and /api/v1/tab/{id}/delta responds with the lines which have
+// to be kept, deleted or inserted to turn it into the current content.
+const (
+	// previousContentTTL is how long the old content of an edited tab is
+	// kept, which is how long a client can go without syncing and still
+	// get a delta.
+	previousContentTTL = 30 * 24 * time.Hour
+
+	// maxDeltaEdits is the most lines which can be inserted or deleted in
+	// a delta. If the content has changed more than that, the delta just
+	// replaces all of it, since working out the smallest set of changes
+	// takes longer the more there are, and there isn't much to save.
+	maxDeltaEdits = 1000
+)
+
+// A deltaOp is one step of a delta, applied to the old content's lines in
+// order. Exactly one of its fields is set: Keep copies that many lines from
+// the old content, Delete skips that many, and Insert adds new lines.
+type deltaOp struct {
+	Keep   int      `json:"keep,omitempty"`
+	Delete int      `json:"delete,omitempty"`
+	Insert []string `json:"insert,omitempty"`
+}
+
+// A contentDelta turns a tab's old content into its current content.
+type contentDelta struct {
+	// From and To are the hashes of the old and current content.
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Ops are the steps which turn the old content into the current
+	// content. The content is split into lines at each '\n', and joined
+	// back together in the same way.
+	Ops []deltaOp `json:"ops"`
+}
+
+// keepPreviousContent stores the content of a tab which is about to be
+// replaced by a new version, so that clients which have it can be sent a
+// delta.
+func (s *Server) keepPreviousContent(old *Tab) error {
+	return s.Store.KeepPreviousContent(old.ID, old.ContentHash, old.Content, previousContentTTL)
+}
+
+// contentByHash returns the content with the given hash, if it is either the
+// tab's current content or some of its old content which is still being kept.
+// The second return value is false if it isn't either, including when the
+// content was another tab's.
+func (s *Server) contentByHash(tab *Tab, hash string) (string, bool, error) {
+	if hash == tab.ContentHash {
+		return tab.Content, true, nil
+	}
+
+	return s.Store.PreviousContent(tab.ID, hash)
+}
+
+// diffLines works out the steps to turn the lines before into the lines after,
+// using Myers' algorithm, which finds the fewest lines to insert and delete.
+// If more than maxEdits are needed, the steps just replace everything.
+func diffLines(before, after []string, maxEdits int) []deltaOp {
+	n, m := len(before), len(after)
+
+	limit := n + m
+	if limit > maxEdits {
+		limit = maxEdits
+	}
+
+	// v[k] holds how far through the lines before the furthest path on
+	// diagonal k has reached, where k is the number of lines before minus
+	// the number of lines after which have been used so far. A copy of the
+	// diagonals which could have been reached is kept after each number of
+	// edits, to trace the path back afterwards.
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	trace := make([][]int, 0)
+
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			// Either move down from diagonal k+1 by inserting a line,
+			// or right from diagonal k-1 by deleting one, whichever
+			// has got further.
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+
+			// Then follow any lines which are the same in both.
+			y := x - k
+			for x < n && y < m && before[x] == after[y] {
+				x++
+				y++
+			}
+
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrackDiff(before, after, trace)
+			}
+		}
+	}
+
+	// Too many edits are needed, so everything is replaced.
+	ops := make([]deltaOp, 0, 2)
+	if n > 0 {
+		ops = append(ops, deltaOp{Delete: n})
+	}
+	if m > 0 {
+		ops = append(ops, deltaOp{Insert: after})
+	}
+
+	return ops
+}
+
+// backtrackDiff follows the path found by diffLines backwards from the end,
+// using the copies of the diagonals from each step, and returns the steps
+// along it in order. trace[d] holds diagonals -d-1 to d+1 as they were
+// before the dth edit.
+func backtrackDiff(before, after []string, trace [][]int) []deltaOp {
+	var (
+		x, y = len(before), len(after)
+		ops  = make([]deltaOp, 0)
+	)
+
+	// The steps are found backwards, so they are added to the front.
+	// Steps of the same kind next to each other are combined.
+	add := func(op deltaOp) {
+		if len(ops) > 0 {
+			first := &ops[0]
+
+			switch {
+			case op.Keep > 0 && first.Keep > 0:
+				first.Keep += op.Keep
+				return
+			case op.Delete > 0 && first.Delete > 0:
+				first.Delete += op.Delete
+				return
+			case op.Insert != nil && first.Insert != nil:
+				first.Insert = append(op.Insert, first.Insert...)
+				return
+			}
+		}
+
+		ops = append([]deltaOp{op}, ops...)
+	}
+
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		// The lines which are the same were followed after the edit,
+		// so they come off first.
+		for x > prevX && y > prevY {
+			add(deltaOp{Keep: 1})
+			x--
+			y--
+		}
+
+		if d > 0 {
+			if x == prevX {
+				add(deltaOp{Insert: []string{after[y-1]}})
+			} else {
+				add(deltaOp{Delete: 1})
+			}
+		}
+
+		x, y = prevX, prevY
+	}
+
+	return ops
+}
+
+// handleTabDeltaAPI is called to respond to a HTTP request to
+// /api/v1/tab/{id}/delta. It responds with a contentDelta, encoded in JSON,
+// which turns the content with the hash in the 'from' query value into the
+// tab's current content. If that content isn't known any more, the response
+// is 404 Not Found, and the client should fetch the whole tab instead.
+func (s *Server) handleTabDeltaAPI(w http.ResponseWriter, r *http.Request) {
+	tab, ok, err := s.Store.GetTab(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok || s.hidesTab(r, tab) {
+		writeError(w, http.StatusNotFound, errTabNotFound)
+		return
+	}
+
+	from := r.FormValue("from")
+
+	old, ok, err := s.contentByHash(tab, from)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errVersionNotFound)
+		return
+	}
+
+	delta := &contentDelta{
+		From: from,
+		To:   tab.ContentHash,
+		Ops:  diffLines(strings.Split(old, "\n"), strings.Split(tab.Content, "\n"), maxDeltaEdits),
+	}
+
+	jsonData, err := json.Marshal(delta)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
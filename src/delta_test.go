@@ -0,0 +1,105 @@
+package src
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// applyDelta applies a delta's steps to the lines before, as a client does.
+func applyDelta(before []string, ops []deltaOp) []string {
+	after := make([]string, 0)
+
+	for _, op := range ops {
+		switch {
+		case op.Keep > 0:
+			after = append(after, before[:op.Keep]...)
+			before = before[op.Keep:]
+		case op.Delete > 0:
+			before = before[op.Delete:]
+		default:
+			after = append(after, op.Insert...)
+		}
+	}
+
+	return after
+}
+
+func TestDiffLines(t *testing.T) {
+	cases := []struct {
+		name, before, after string
+		maxEdits            int
+		edits               int
+	}{
+		{"same", "a\nb\nc", "a\nb\nc", 100, 0},
+		{"changed line", "[C]My my\nAt Waterloo", "[G]My my\nAt Waterloo", 100, 2},
+		{"inserted", "a\nc", "a\nb\nc", 100, 1},
+		{"deleted", "a\nb\nc", "a\nc", 100, 1},
+		{"moved", "a\nb\nc\nd", "b\nc\nd\na", 100, 2},
+		{"from nothing", "", "a\nb", 100, 3},
+
+		// When more edits are needed than allowed, everything is
+		// replaced, which still gives the right content.
+		{"too many edits", "a\nb\nc\nd", "w\nx\ny\nz", 2, 8},
+	}
+
+	for _, c := range cases {
+		before, after := strings.Split(c.before, "\n"), strings.Split(c.after, "\n")
+		ops := diffLines(before, after, c.maxEdits)
+
+		if applied := applyDelta(before, ops); !reflect.DeepEqual(applied, after) {
+			t.Errorf("%s: expected the delta to give %q, got %q", c.name, after, applied)
+		}
+
+		edits := 0
+		for _, op := range ops {
+			edits += op.Delete + len(op.Insert)
+		}
+
+		if edits != c.edits {
+			t.Errorf("%s: expected %d lines to be inserted or deleted, got %d: %+v", c.name, c.edits, edits, ops)
+		}
+	}
+}
+
+func TestContentByHash(t *testing.T) {
+	s := &Server{Store: NewMemoryStore(DefaultSettings())}
+
+	waterloo := &Tab{ID: "1", Content: "[C]My my", ContentHash: HashContent([]byte("[C]My my"))}
+	sos := &Tab{ID: "2", Content: "[Dm]Where are those happy days", ContentHash: HashContent([]byte("[Dm]Where are those happy days"))}
+
+	if err := s.keepPreviousContent(waterloo); err != nil {
+		t.Fatal(err)
+	}
+
+	old := waterloo.ContentHash
+	waterloo.Content = "[G]My my"
+	waterloo.ContentHash = HashContent([]byte(waterloo.Content))
+
+	cases := []struct {
+		name    string
+		tab     *Tab
+		hash    string
+		content string
+		found   bool
+	}{
+		{"current content", waterloo, waterloo.ContentHash, "[G]My my", true},
+		{"old content", waterloo, old, "[C]My my", true},
+
+		// Another tab's old content isn't given away by asking for a
+		// delta from it to a tab which never had it.
+		{"another tab's old content", sos, old, "", false},
+		{"unknown", waterloo, "missing", "", false},
+	}
+
+	for _, c := range cases {
+		content, found, err := s.contentByHash(c.tab, c.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if found != c.found || content != c.content {
+			t.Errorf("%s: expected %q and %v, got %q and %v", c.name, c.content, c.found, content, found)
+		}
+	}
+}
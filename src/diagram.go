@@ -0,0 +1,174 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// standardTuning is the pitch class of each string of a guitar in standard
+// tuning, from the lowest string to the highest: E A D G B E.
+var standardTuning = []int{4, 9, 2, 7, 11, 4}
+
+// The dimensions, in pixels, used when rendering a fretboard diagram.
+const (
+	diagramMargin     = 30
+	diagramFretWidth  = 50
+	diagramStringGap  = 24
+	diagramDotRadius  = 9
+	diagramInlayLabel = 12
+)
+
+// A fretMarker is a single dot drawn on a fretboard diagram.
+type fretMarker struct {
+	// String is the index of the string, where 0 is the lowest string.
+	String int
+
+	// Fret is the fret number of the marker, where 0 is an open string.
+	Fret int
+
+	// Label is the text to draw inside the dot, usually a note name.
+	Label string
+
+	// Root says whether the marker should be highlighted as the root.
+	Root bool
+}
+
+// A fretboard holds everything needed to render a fretboard diagram.
+type fretboard struct {
+	// Tuning is the pitch class of each string, lowest first.
+	Tuning []int
+
+	// Frets is the number of frets to draw, not including the nut.
+	Frets int
+
+	// Markers is the list of dots to draw on the fretboard.
+	Markers []fretMarker
+}
+
+// newScaleFretboard creates a fretboard with a marker on every position,
+// up to the given fret, whose note is in the set of pitches.
+func newScaleFretboard(tuning []int, frets, root int, pitches map[int]bool) *fretboard {
+	board := &fretboard{
+		Tuning: tuning,
+		Frets:  frets,
+	}
+
+	// Go through each position on each string, checking if the note at
+	// that position is part of the scale and adding a marker if it is.
+	for str, open := range tuning {
+		for fret := 0; fret <= frets; fret++ {
+			pitch := (open + fret) % 12
+			if !pitches[pitch] {
+				continue
+			}
+
+			board.Markers = append(board.Markers, fretMarker{
+				String: str,
+				Fret:   fret,
+				Label:  noteNames[pitch],
+				Root:   pitch == root,
+			})
+		}
+	}
+
+	return board
+}
+
+// renderSVG draws the fretboard as an SVG image. The strings are drawn
+// horizontally with the highest string at the top, as in a tab, and the
+// open strings are drawn to the left of the nut.
+func (f *fretboard) renderSVG() []byte {
+	var (
+		buf    bytes.Buffer
+		width  = diagramMargin*2 + diagramFretWidth*(f.Frets+1)
+		height = diagramMargin*2 + diagramStringGap*(len(f.Tuning)-1) + diagramInlayLabel
+		nutX   = diagramMargin + diagramFretWidth
+		bottom = diagramMargin + diagramStringGap*(len(f.Tuning)-1)
+	)
+
+	// stringY returns the y coordinate of a string, flipping the order so
+	// the lowest string is drawn at the bottom.
+	stringY := func(str int) int {
+		return diagramMargin + diagramStringGap*(len(f.Tuning)-1-str)
+	}
+
+	// fretX returns the x coordinate at which to draw a marker on the
+	// given fret, which is halfway between the fret and the previous one.
+	fretX := func(fret int) int {
+		return nutX + diagramFretWidth*fret - diagramFretWidth/2
+	}
+
+	fmt.Fprintf(&buf,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif">`,
+		width, height, width, height,
+	)
+
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="white"/>`, width, height)
+
+	// Draw the nut, which is thicker than the other frets, and then each
+	// of the frets along with its number underneath.
+	fmt.Fprintf(&buf,
+		`<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="black" stroke-width="4"/>`,
+		nutX, diagramMargin, nutX, bottom,
+	)
+
+	for fret := 1; fret <= f.Frets; fret++ {
+		x := nutX + diagramFretWidth*fret
+
+		fmt.Fprintf(&buf,
+			`<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#888" stroke-width="2"/>`,
+			x, diagramMargin, x, bottom,
+		)
+
+		fmt.Fprintf(&buf,
+			`<text x="%d" y="%d" font-size="%d" text-anchor="middle" fill="#666">%d</text>`,
+			fretX(fret), bottom+diagramMargin/2+diagramInlayLabel/2, diagramInlayLabel, fret,
+		)
+	}
+
+	// Draw each string, along with the name of its open note to the far
+	// left of the diagram.
+	for str, open := range f.Tuning {
+		y := stringY(str)
+
+		fmt.Fprintf(&buf,
+			`<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="black" stroke-width="1"/>`,
+			nutX, y, width-diagramMargin, y,
+		)
+
+		fmt.Fprintf(&buf,
+			`<text x="%d" y="%d" font-size="%d" text-anchor="middle" fill="#666">%s</text>`,
+			diagramMargin/2, y+diagramInlayLabel/3, diagramInlayLabel, noteNames[open],
+		)
+	}
+
+	// Finally, draw the markers on top of everything else. Root notes are
+	// filled in black, and every other note is outlined.
+	for _, marker := range f.Markers {
+		var (
+			x         = fretX(marker.Fret)
+			y         = stringY(marker.String)
+			fill      = "white"
+			textColor = "black"
+		)
+
+		if marker.Root {
+			fill = "black"
+			textColor = "white"
+		}
+
+		fmt.Fprintf(&buf,
+			`<circle cx="%d" cy="%d" r="%d" fill="%s" stroke="black" stroke-width="1.5"/>`,
+			x, y, diagramDotRadius, fill,
+		)
+
+		fmt.Fprintf(&buf,
+			`<text x="%d" y="%d" font-size="9" text-anchor="middle" fill="%s">%s</text>`,
+			x, y+3, textColor, marker.Label,
+		)
+	}
+
+	buf.WriteString("</svg>")
+
+	return buf.Bytes()
+}
@@ -0,0 +1,257 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// The tab which is on show is kept in the 'now-showing' hashmap, which maps
+// each state, "viewing" or "performing", to the ID of the tab. It is set from
+// the main page, and followed by the display view, which shows whichever tab
+// is being performed when it is opened at /display/live, so that it can be
+// cast to a TV and moved on from another device. The display follows it over
+// a WebSocket at /api/v1/now-showing, which is sent the tabs on show as soon
+// as they change. Each change is also published to the event log, so that
+// clients which can't keep a WebSocket open can long-poll for it instead,
+// and to the MQTT broker, if there is one.
+
+// nowShowingKeepAlive is how often the tabs on show are sent again to the
+// clients following them when they haven't changed, so that proxies don't
+// close the connection.
+const nowShowingKeepAlive = 30 * time.Second
+
+// nowShowingStates maps each state which a tab can be on show in to the MQTT
+// topic which it is published to.
+var nowShowingStates = map[string]string{
+	"viewing":    "now-viewing",
+	"performing": "now-performing",
+}
+
+// nowShowing returns the ID of the tab on show in each state. States with no
+// tab on show are left out.
+func (s *Server) nowShowing() (map[string]string, error) {
+	return s.Store.NowShowing()
+}
+
+// setNowShowing sets the tab which is on show in the given state, which is
+// either "viewing" or "performing", on behalf of the given actor. An empty ID
+// means that no tab is. If it can't be set, an error and error status are
+// returned.
+func (s *Server) setNowShowing(state, id string, by actor) (int, error) {
+	topic, ok := nowShowingStates[state]
+	if !ok {
+		return http.StatusBadRequest, errors.New("the state must be viewing or performing")
+	}
+
+	if id == "" {
+		if err := s.Store.SetNowShowing(state, ""); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		s.pushNowShowing()
+		s.publishMQTT(topic, nil, true)
+		s.publishEvent(eventNowShowingChanged, by, map[string]string{"state": state, "id": ""})
+
+		return http.StatusOK, nil
+	}
+
+	tab, exists, err := s.Store.GetTab(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !exists {
+		return http.StatusNotFound, errTabNotFound
+	}
+
+	if err := s.Store.SetNowShowing(state, id); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	s.pushNowShowing()
+	s.publishMQTT(topic, tabEventData(tab), true)
+	s.publishEvent(eventNowShowingChanged, by, map[string]string{"state": state, "id": id})
+
+	return http.StatusOK, nil
+}
+
+// pushNowShowing sends the tabs which are on show to every client following
+// them. They are read while nowShowingLock is held, so that when two changes
+// are made at once, the last tabs sent are the ones from after both.
+func (s *Server) pushNowShowing() {
+	s.nowShowingLock.Lock()
+	defer s.nowShowingLock.Unlock()
+
+	if len(s.nowShowingFollowers) == 0 {
+		return
+	}
+
+	showing, err := s.nowShowing()
+	if err != nil {
+		s.logMessage("error", "The tabs on show couldn't be sent to the displays following them: %s", err)
+		return
+	}
+
+	// Each follower only needs the latest tabs, so ones which haven't been
+	// sent yet are replaced rather than waited for.
+	for follower := range s.nowShowingFollowers {
+		select {
+		case <-follower:
+		default:
+		}
+
+		follower <- showing
+	}
+}
+
+// endNowShowingStreams sends away every client following the tabs on show,
+// so that the server can shut down without waiting for them. It is called
+// when the server starts shutting down.
+func (s *Server) endNowShowingStreams() {
+	s.nowShowingLock.Lock()
+	defer s.nowShowingLock.Unlock()
+
+	for follower := range s.nowShowingFollowers {
+		delete(s.nowShowingFollowers, follower)
+		close(follower)
+	}
+}
+
+// A nowShowingMessage is a message sent to a client following the tabs on
+// show.
+type nowShowingMessage struct {
+	Showing map[string]string `json:"showing"`
+}
+
+// followNowShowing upgrades the request to a WebSocket, and sends the tabs on
+// show over it, as {"showing": {"performing": "12"}}, followed by the tabs on
+// show again each time they change, until the client goes away.
+func (s *Server) followNowShowing(w http.ResponseWriter, r *http.Request) {
+	updates := make(chan map[string]string, 1)
+
+	// The client starts following before the tabs on show are read, so
+	// that a change in between isn't missed.
+	s.nowShowingLock.Lock()
+
+	showing, err := s.nowShowing()
+	if err != nil {
+		s.nowShowingLock.Unlock()
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if s.nowShowingFollowers == nil {
+		s.nowShowingFollowers = make(map[chan map[string]string]bool)
+	}
+
+	s.nowShowingFollowers[updates] = true
+	updates <- showing
+
+	s.nowShowingLock.Unlock()
+
+	defer func() {
+		s.nowShowingLock.Lock()
+		defer s.nowShowingLock.Unlock()
+
+		delete(s.nowShowingFollowers, updates)
+	}()
+
+	s.serveWebSocket(w, r, func(ws *websocket.Conn) {
+		// Nothing is expected from the client, so its messages are only
+		// read to find out when it goes away.
+		ws.MaxPayloadBytes = 1024
+
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+
+			for {
+				var ignored []byte
+				if err := websocket.Message.Receive(ws, &ignored); err != nil {
+					return
+				}
+			}
+		}()
+
+		keepAlive := time.NewTicker(nowShowingKeepAlive)
+		defer keepAlive.Stop()
+
+		var sent map[string]string
+
+		for {
+			select {
+			case showing, ok := <-updates:
+				if !ok {
+					return
+				}
+
+				sent = showing
+
+			case <-keepAlive.C:
+
+			case <-gone:
+				return
+			}
+
+			if err := websocket.JSON.Send(ws, nowShowingMessage{Showing: sent}); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// handleNowShowingAPI is called to respond to a HTTP request to
+// /api/v1/now-showing. A GET request responds with a JSON object mapping each
+// state to the ID of the tab on show in it, such as {"performing": "12"}, or
+// follows it over a WebSocket if it asks to be upgraded to one, and a POST
+// request changes it, if the role which made it has permission to.
+func (s *Server) handleNowShowingAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if isWebSocketRequest(r) {
+			s.followNowShowing(w, r)
+			return
+		}
+	case "POST":
+		s.requirePermission(permissionPerform, s.handleSetNowShowingAPI)(w, r)
+		return
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET and POST are supported"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+
+	showing, err := s.nowShowing()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(showing)
+}
+
+// handleSetNowShowingAPI is called by handleNowShowingAPI to respond to a POST
+// request. It sets the tab with the ID in the 'id' form field as the one being
+// viewed or performed, according to the 'state' form field, or that no tab is
+// if the ID is empty.
+func (s *Server) handleSetNowShowingAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.setNowShowing(r.PostFormValue("state"), r.PostFormValue("id"), s.requestActor(r)); err != nil {
+		writeError(w, status, err)
+		return
+	}
+}
+
+// handleDisplay is called to respond to a HTTP request to /display/{id}. The
+// page shows the tab with the given ID in large type, scrolling through it on
+// its own, for casting to a TV. If the ID is "live", it shows whichever tab is
+// being performed, and follows along as the performance moves on.
+func (s *Server) handleDisplay(w http.ResponseWriter, r *http.Request) {
+	//  Disable caching for this route.
+	w.Header().Set("Cache-Control", "max-age=0")
+
+	http.ServeFile(w, r, s.staticPath("html/display.html"))
+}
@@ -0,0 +1,84 @@
+package src
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSetNowShowing(t *testing.T) {
+	s := &Server{Store: NewMemoryStore(DefaultSettings())}
+
+	tab := &Tab{Title: "Waterloo", Artist: "Abba", Filename: "abba - waterloo.txt"}
+	if err := s.Store.PutTab(tab); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name, state, id string
+		status          int
+		showing         map[string]string
+	}{
+		{"performing", "performing", tab.ID, http.StatusOK, map[string]string{"performing": tab.ID}},
+		{"viewing", "viewing", tab.ID, http.StatusOK, map[string]string{"performing": tab.ID, "viewing": tab.ID}},
+		{"nothing performed", "performing", "", http.StatusOK, map[string]string{"viewing": tab.ID}},
+		{"unknown state", "listening", tab.ID, http.StatusBadRequest, map[string]string{"viewing": tab.ID}},
+		{"unknown tab", "performing", "missing", http.StatusNotFound, map[string]string{"viewing": tab.ID}},
+	}
+
+	for _, c := range cases {
+		status, _ := s.setNowShowing(c.state, c.id, actor{})
+		if status != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, status)
+		}
+
+		showing, err := s.nowShowing()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(showing) != len(c.showing) {
+			t.Errorf("%s: expected %v to be on show, got %v", c.name, c.showing, showing)
+			continue
+		}
+
+		for state, id := range c.showing {
+			if showing[state] != id {
+				t.Errorf("%s: expected %v to be on show, got %v", c.name, c.showing, showing)
+			}
+		}
+	}
+}
+
+func TestPushNowShowingSendsTheLatest(t *testing.T) {
+	s := &Server{Store: NewMemoryStore(DefaultSettings())}
+
+	first := &Tab{Title: "Waterloo", Artist: "Abba", Filename: "abba - waterloo.txt"}
+	second := &Tab{Title: "SOS", Artist: "Abba", Filename: "abba - sos.txt"}
+
+	for _, tab := range []*Tab{first, second} {
+		if err := s.Store.PutTab(tab); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	follower := make(chan map[string]string, 1)
+	s.nowShowingFollowers = map[chan map[string]string]bool{follower: true}
+
+	// A follower which hasn't caught up is only sent the tabs on show after
+	// the last change, rather than holding up the changes.
+	for _, tab := range []*Tab{first, second} {
+		if status, err := s.setNowShowing("performing", tab.ID, actor{}); err != nil {
+			t.Fatalf("expected %s to be put on show, got %d: %v", tab.Title, status, err)
+		}
+	}
+
+	if showing := <-follower; showing["performing"] != second.ID {
+		t.Errorf("expected %s to be performed, got %v", second.ID, showing)
+	}
+
+	select {
+	case showing := <-follower:
+		t.Errorf("expected only the latest tabs to be sent, got %v as well", showing)
+	default:
+	}
+}
@@ -0,0 +1,259 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Someone who is about to change a tab can check it out by taking its edit
+// lock, so that other people's clients can warn them that, say, "Dave is
+// editing this tab", and so that nobody else's changes can overwrite theirs
+// in the meantime. While a tab is locked, the endpoints which change it,
+// such as /api/v1/update-tab and posting to the tab's collaborative editing
+// room, refuse to unless the request has the lock's token in its 'lock'
+// form value.
+//
+// A lock only lasts for a few minutes, so that one which was forgotten about
+// doesn't keep the tab locked forever, and whoever holds it renews it while
+// they carry on editing. The store forgets each lock once it expires.
+const (
+	// defaultEditLockDuration is how long a lock lasts after it was last
+	// taken or renewed, unless the client asks for something else.
+	defaultEditLockDuration = 5 * time.Minute
+
+	// minEditLockDuration and maxEditLockDuration are the shortest and
+	// longest that a client can ask for a lock to last.
+	minEditLockDuration = 30 * time.Second
+	maxEditLockDuration = time.Hour
+
+	// maxEditLockNameLength is the most characters which the name of whoever
+	// holds a lock can have.
+	maxEditLockNameLength = 50
+)
+
+// An editLock is a lock on a tab, held by whoever is editing it.
+type editLock struct {
+	// Token is what the holder proves that they hold the lock with. It is
+	// only ever sent to them.
+	Token string `json:"token,omitempty"`
+
+	// Name is the name which the holder gave, to be shown to everyone else,
+	// and By is who they logged in as.
+	Name string `json:"name"`
+	By   actor  `json:"by"`
+
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// An editLockStatus says whether a tab is locked, and if it is, by whom.
+type editLockStatus struct {
+	Locked bool      `json:"locked"`
+	Lock   *editLock `json:"lock,omitempty"`
+}
+
+// errNotEditLockHolder is returned when a lock is released with the wrong
+// token.
+var errNotEditLockHolder = newAPIError(codeTabLocked, "the tab is locked by someone else, so only they can unlock it")
+
+// tabLockedError returns the error which a change to a tab is refused with
+// while someone else holds its lock.
+func tabLockedError(lock *editLock) error {
+	return newAPIError(codeTabLocked, fmt.Sprintf("%s is editing this tab, so it can't be changed until they have finished", lock.Name))
+}
+
+// editLock returns the lock of the tab with the given ID. The second return
+// value is false if it isn't locked.
+func (s *Server) editLock(id string) (*editLock, bool, error) {
+	return s.Store.EditLock(id)
+}
+
+// acquireEditLock locks the tab with the given ID for the given duration, on
+// behalf of the given actor under the given name. If the token is the one of
+// the tab's current lock, the lock is renewed instead, keeping its token. If
+// someone else holds the lock, an error saying who is returned.
+func (s *Server) acquireEditLock(id, token, name string, duration time.Duration, by actor) (*editLock, error) {
+	s.editLocksLock.Lock()
+	defer s.editLocksLock.Unlock()
+
+	lock, locked, err := s.editLock(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if locked && lock.Token == token {
+		// A lock which is being renewed keeps its name unless a new one
+		// was given.
+		if name != "" {
+			lock.Name = name
+		}
+	} else if locked {
+		return nil, tabLockedError(lock)
+	} else {
+		if token, err = randomHex(16); err != nil {
+			return nil, err
+		}
+
+		if name == "" {
+			name = by.Name
+		}
+
+		lock = &editLock{Token: token, Name: name, By: by, Acquired: now}
+	}
+
+	lock.Expires = now.Add(duration)
+
+	if err := s.Store.PutEditLock(id, lock, duration); err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// releaseEditLock unlocks the tab with the given ID, if the token is the one
+// of its lock or force is true. Releasing a lock which has already expired
+// does nothing.
+func (s *Server) releaseEditLock(id, token string, force bool) error {
+	s.editLocksLock.Lock()
+	defer s.editLocksLock.Unlock()
+
+	lock, locked, err := s.editLock(id)
+	if err != nil || !locked {
+		return err
+	}
+
+	if lock.Token != token && !force {
+		return errNotEditLockHolder
+	}
+
+	return s.Store.DeleteEditLock(id)
+}
+
+// checkEditLock checks that the tab with the given ID can be changed by the
+// request, which it can't be if someone else holds its lock. If it can't, an
+// error saying who holds it is returned, along with the HTTP status which it
+// should be reported with.
+func (s *Server) checkEditLock(r *http.Request, id string) (int, error) {
+	lock, locked, err := s.editLock(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if locked && lock.Token != r.FormValue("lock") {
+		return http.StatusConflict, tabLockedError(lock)
+	}
+
+	return http.StatusOK, nil
+}
+
+// editLockFromForm returns the token, name and duration of the lock which the
+// request asks for, from its 'lock', 'name' and 'duration' form values, where
+// the duration is in seconds.
+func editLockFromForm(r *http.Request) (string, string, time.Duration, error) {
+	token := r.PostFormValue("lock")
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	duration := defaultEditLockDuration
+
+	if utf8.RuneCountInString(name) > maxEditLockNameLength {
+		return "", "", 0, fmt.Errorf("the name can't be longer than %d characters", maxEditLockNameLength)
+	}
+
+	if text := r.PostFormValue("duration"); text != "" {
+		seconds, err := strconv.Atoi(text)
+		if err != nil {
+			return "", "", 0, errors.New("the duration must be a whole number of seconds")
+		}
+
+		duration = time.Duration(seconds) * time.Second
+
+		if duration < minEditLockDuration || duration > maxEditLockDuration {
+			return "", "", 0, fmt.Errorf("the duration must be between %d and %d seconds", int(minEditLockDuration.Seconds()), int(maxEditLockDuration.Seconds()))
+		}
+	}
+
+	return token, name, duration, nil
+}
+
+// handleEditLockAPI is called to respond to a HTTP request to
+// /api/v1/tab/{id}/lock. A GET request responds with whether the tab is
+// locked, and if it is, who by and until when, encoded in JSON. A POST
+// request locks the tab under the name in the 'name' form value, for the
+// number of seconds in the 'duration' form value, or five minutes if it isn't
+// given. If the 'lock' form value is the token of the tab's lock, the lock is
+// renewed instead. It responds with the lock, including its token, which has
+// to be given in the 'lock' form value of any changes to the tab. A DELETE
+// request unlocks the tab, if the 'lock' query value is the lock's token, or
+// if 'force' is "1", which breaks someone else's lock.
+func (s *Server) handleEditLockAPI(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if _, ok, err := s.Store.GetTab(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errTabNotFound)
+		return
+	}
+
+	var result interface{}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		lock, locked, err := s.editLock(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if locked {
+			lock.Token = ""
+		}
+
+		result = editLockStatus{Locked: locked, Lock: lock}
+
+	case "POST":
+		token, name, duration, err := editLockFromForm(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		lock, err := s.acquireEditLock(id, token, name, duration, s.requestActor(r))
+		if _, refused := err.(*apiError); refused {
+			writeError(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		result = lock
+
+	case "DELETE":
+		err := s.releaseEditLock(id, r.FormValue("lock"), r.FormValue("force") == "1")
+		if err == errNotEditLockHolder {
+			writeError(w, http.StatusConflict, err)
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		}
+
+		return
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET, POST and DELETE are supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
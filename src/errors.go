@@ -0,0 +1,300 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The API responds to every request which fails with a JSON object like this,
+// with a status to match:
+//
+//	{"error": {"code": "tab_not_found", "message": "no tab with that ID"}}
+//
+// The code is one of the codes in the catalogue below, which clients can rely
+// on staying the same, and the message is meant for people, so it might
+// change. The whole catalogue can be fetched from /api/v1/errors.
+const (
+	codeBadRequest          = "bad_request"
+	codeInvalidSetting      = "invalid_setting"
+	codeNotLoggedIn         = "not_logged_in"
+	codeSessionExpired      = "session_expired"
+	codeInvalidToken        = "invalid_token"
+	codeInvalidCSRFToken    = "invalid_csrf_token"
+	codeWrongPassword       = "wrong_password"
+	codeForbidden           = "forbidden"
+	codeSongRequestsClosed  = "song_requests_closed"
+	codeNotFound            = "not_found"
+	codeTabNotFound         = "tab_not_found"
+	codeTabLocked           = "tab_locked"
+	codeTagNotFound         = "tag_not_found"
+	codeJobNotFound         = "job_not_found"
+	codeRoleNotFound        = "role_not_found"
+	codeViewNotFound        = "view_not_found"
+	codeSetlistNotFound     = "setlist_not_found"
+	codeSongRequestNotFound = "song_request_not_found"
+	codeRecordingNotFound   = "recording_not_found"
+	codeTokenNotFound       = "token_not_found"
+	codeVersionNotFound     = "version_not_found"
+	codeMethodNotAllowed    = "method_not_allowed"
+	codeConflict            = "conflict"
+	codeWishlistFull        = "wishlist_full"
+	codeRecordingTooLarge   = "recording_too_large"
+	codeUnsupportedAudio    = "unsupported_audio"
+	codeArchiveTooLarge     = "archive_too_large"
+	codeInvalidArchive      = "invalid_archive"
+	codeImportNotFound      = "import_not_found"
+	codeInvalidImportPlan   = "invalid_import_plan"
+	codeBinaryTab           = "binary_tab"
+	codeHookRefused         = "hook_refused"
+	codeTooManyRequests     = "too_many_requests"
+	codeInternal            = "internal_error"
+	codeDatabaseUnavailable = "database_unavailable"
+	codeRequestTimeout      = "request_timeout"
+
+	codeTabDirectoryUnmounted = "tab_directory_unmounted"
+)
+
+// An errorCode describes one of the codes in the catalogue.
+type errorCode struct {
+	Code        string `json:"code"`
+	Status      int    `json:"status"`
+	Description string `json:"description"`
+}
+
+// errorCatalogue lists every error code which the API uses, along with the
+// status which it is usually sent with.
+var errorCatalogue = []errorCode{
+	{codeBadRequest, http.StatusBadRequest, "The request was missing something or had an invalid value"},
+	{codeInvalidSetting, http.StatusBadRequest, "One of the new settings was invalid, so none of them were changed"},
+	{codeNotLoggedIn, http.StatusUnauthorized, "The request needs a session or an API token, and had neither"},
+	{codeSessionExpired, http.StatusUnauthorized, "The session has expired, so the admin has to log in again"},
+	{codeInvalidToken, http.StatusUnauthorized, "The API token doesn't exist or has been revoked"},
+	{codeInvalidCSRFToken, http.StatusForbidden, "The request used a session, but didn't have its CSRF token"},
+	{codeWrongPassword, http.StatusBadRequest, "The admin password was wrong"},
+	{codeForbidden, http.StatusForbidden, "The role which made the request doesn't have permission to do it"},
+	{codeSongRequestsClosed, http.StatusForbidden, "Songs can only be requested while open mic mode is on"},
+	{codeNotFound, http.StatusNotFound, "There is nothing at that path, or the thing asked for doesn't exist"},
+	{codeTabNotFound, http.StatusNotFound, "There is no tab with that ID, or its file has gone"},
+	{codeTagNotFound, http.StatusNotFound, "No tab has that tag"},
+	{codeJobNotFound, http.StatusNotFound, "There is no job with that ID"},
+	{codeRoleNotFound, http.StatusNotFound, "There is no role with that name"},
+	{codeViewNotFound, http.StatusNotFound, "There is no view with that name"},
+	{codeSetlistNotFound, http.StatusNotFound, "There is no setlist with that ID"},
+	{codeSongRequestNotFound, http.StatusNotFound, "There is no song on the wishlist with that ID"},
+	{codeRecordingNotFound, http.StatusNotFound, "There is no recording with that ID"},
+	{codeTokenNotFound, http.StatusNotFound, "There is no API token with that name"},
+	{codeVersionNotFound, http.StatusNotFound, "The old version of a tab which a delta was asked for isn't known any more"},
+	{codeMethodNotAllowed, http.StatusMethodNotAllowed, "The path doesn't support the request's method"},
+	{codeConflict, http.StatusConflict, "The request can't be done in the current state, such as cancelling a finished job"},
+	{codeTabLocked, http.StatusConflict, "Someone else is editing the tab, so it can't be changed until they unlock it"},
+	{codeWishlistFull, http.StatusConflict, "The wishlist is full, so no more songs can be requested until some are cleared"},
+	{codeRecordingTooLarge, http.StatusRequestEntityTooLarge, "The recording is larger than recordings can be"},
+	{codeUnsupportedAudio, http.StatusUnsupportedMediaType, "Recordings can only be WAV, MP3, Ogg, Opus, FLAC, AAC, M4A or WebM files"},
+	{codeArchiveTooLarge, http.StatusRequestEntityTooLarge, "The zip archive, or the files in it, are larger than can be imported at once"},
+	{codeInvalidArchive, http.StatusBadRequest, "The upload isn't a zip archive which can be read"},
+	{codeImportNotFound, http.StatusNotFound, "There is no pending import with that ID, or it has expired"},
+	{codeInvalidImportPlan, http.StatusBadRequest, "The import plan couldn't be read, or one of the tabs it imports still has a problem"},
+	{codeBinaryTab, http.StatusConflict, "The tab is a binary file, such as a Guitar Pro file, so its content can't be edited or replaced"},
+	{codeHookRefused, http.StatusConflict, "The pre-delete hook failed, so the tab wasn't deleted"},
+	{codeTooManyRequests, http.StatusTooManyRequests, "Too many requests were made, or the IP address is locked out for now"},
+	{codeInternal, http.StatusInternalServerError, "Something went wrong in the server"},
+	{codeDatabaseUnavailable, http.StatusInternalServerError, "The database can't be reached at the moment"},
+	{codeRequestTimeout, http.StatusServiceUnavailable, "The request took longer than requests to its route are allowed to"},
+	{codeTabDirectoryUnmounted, http.StatusServiceUnavailable, "The tab directory doesn't look mounted, so tabs whose files have gone weren't removed"},
+}
+
+// statusCodes are the codes which are used for errors which don't have one
+// of their own, depending on the status they are sent with.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          codeBadRequest,
+	http.StatusUnauthorized:        codeNotLoggedIn,
+	http.StatusForbidden:           codeForbidden,
+	http.StatusNotFound:            codeNotFound,
+	http.StatusMethodNotAllowed:    codeMethodNotAllowed,
+	http.StatusConflict:            codeConflict,
+	http.StatusTooManyRequests:     codeTooManyRequests,
+	http.StatusInternalServerError: codeInternal,
+}
+
+// An apiError is an error with its own code from the catalogue.
+type apiError struct {
+	code    string
+	message string
+}
+
+// Error returns the error's message.
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// newAPIError returns an error with the given code and message.
+func newAPIError(code, message string) error {
+	return &apiError{code: code, message: message}
+}
+
+// invalidSetting returns an error with the invalid_setting code, formatted
+// like fmt.Sprintf.
+func invalidSetting(format string, args ...interface{}) error {
+	return newAPIError(codeInvalidSetting, fmt.Sprintf(format, args...))
+}
+
+// These are errors which are returned from more than one place.
+var (
+	errTabNotFound     = newAPIError(codeTabNotFound, "no tab with that ID")
+	errOnlyPOST        = errors.New("only POST is supported")
+	errWrongPassword   = newAPIError(codeWrongPassword, "wrong password")
+	errNotLoggedIn     = newAPIError(codeNotLoggedIn, "not logged in")
+	errSessionExpired  = newAPIError(codeSessionExpired, "session has expired")
+	errInvalidToken    = newAPIError(codeInvalidToken, "invalid API token")
+	errTagNotFound     = newAPIError(codeTagNotFound, "no tab has that tag")
+	errJobNotFound     = newAPIError(codeJobNotFound, "no job with that ID")
+	errRoleNotFound    = newAPIError(codeRoleNotFound, "no role with that name")
+	errViewNotFound    = newAPIError(codeViewNotFound, "no view with that name")
+	errTokenNotFound   = newAPIError(codeTokenNotFound, "no token with that name")
+	errVersionNotFound = newAPIError(codeVersionNotFound, "that version of the tab isn't known")
+	errNoSuchPath      = newAPIError(codeNotFound, "there is nothing at that path")
+)
+
+// An errorResponse is the body of a response to a request which failed.
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+// errorBody is the error in an errorResponse.
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError responds to a request which failed with the given status and a
+// JSON error.
+func writeError(w http.ResponseWriter, status int, err error) {
+	// The length which the handler might have set for a successful
+	// response doesn't apply any more.
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(&errorResponse{Error: newErrorBody(status, err)})
+}
+
+// newErrorBody returns the body of the error which a request which failed with
+// the given status is sent. The error's code is its own if it has one, and
+// otherwise it depends on the status.
+func newErrorBody(status int, err error) errorBody {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = codeBadRequest
+		if status >= 500 {
+			code = codeInternal
+		}
+	}
+
+	var coded *apiError
+	if errors.As(err, &coded) {
+		code = coded.code
+	} else if err == errCircuitOpen || err == errStoreTimeout {
+		code = codeDatabaseUnavailable
+	}
+
+	return errorBody{Code: code, Message: err.Error()}
+}
+
+// handleErrorsAPI is called to respond to a HTTP request to /api/v1/errors. It
+// responds with the catalogue of error codes, encoded in JSON.
+func (s *Server) handleErrorsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(errorCatalogue)
+}
+
+// handleNotFound responds to requests for paths which the router doesn't
+// have a route for. The API's paths get a JSON error like every other API
+// error, and the rest get a plain one.
+func (s *Server) handleNotFound(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeError(w, http.StatusNotFound, errNoSuchPath)
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// unmatchedRequests returns the handler for requests which don't match any of
+// the router's routes. If the router does have a route for the path, but not
+// with the request's method, the client is told which methods the path does
+// support in the Allow header, along with 405 Method Not Allowed, except for
+// OPTIONS requests, which are asking for exactly that, so are answered with
+// no content. Otherwise, the path isn't found.
+//
+// The router can tell when only the method didn't match itself, but not
+// reliably for the routes in its subrouters, so the routes are looked
+// through again here instead.
+func (s *Server) unmatchedRequests(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods := allowedMethods(router, r.URL.Path)
+		if len(methods) == 0 {
+			s.handleNotFound(w, r)
+			return
+		}
+
+		allowed := strings.Join(methods, ", ")
+		w.Header().Set("Allow", allowed)
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeError(w, http.StatusMethodNotAllowed, newAPIError(
+				codeMethodNotAllowed, fmt.Sprintf("%s isn't supported here; use %s", r.Method, allowed),
+			))
+			return
+		}
+
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})
+}
+
+// allowedMethods returns the methods which the router's routes for the path
+// accept, in alphabetical order.
+func allowedMethods(router *mux.Router, path string) []string {
+	found := make(map[string]bool)
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		pattern, err := route.GetPathRegexp()
+		if err != nil {
+			return nil
+		}
+
+		if matched, _ := regexp.MatchString(pattern, path); matched {
+			for _, method := range methods {
+				found[method] = true
+			}
+		}
+
+		return nil
+	})
+
+	methods := make([]string, 0, len(found))
+	for method := range found {
+		methods = append(methods, method)
+	}
+
+	sort.Strings(methods)
+
+	return methods
+}
@@ -0,0 +1,165 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The event log is kept in the store, and every change to the collection is
+// added to it. With the RedisStore, it is a Redis Stream, called "events", so
+// that other programs can follow the changes without polling the HTTP API.
+// Since it's a stream, they can read it with XREAD, or with XREADGROUP using
+// a consumer group to share the events out and keep track of which ones have
+// been dealt with.
+//
+// Each entry has these fields:
+//
+//	schema  the version of this format, currently "1"
+//	type    the kind of event, which is one of the event constants below
+//	time    when it happened, in RFC 3339 format
+//	actor   a JSON object saying who or what made the change, as described
+//	        in actor.go
+//	data    a JSON object with the details, described by each constant
+//
+// The stream is trimmed to roughly maxEvents entries, so consumers which
+// fall further behind than that will miss the oldest events.
+const (
+	maxEvents = 10000
+
+	// eventSchema is increased if the format changes in a way which would
+	// break existing consumers.
+	eventSchema = "1"
+)
+
+// These are the types of event. The data of every tab event has the "id",
+// "filename", "title" and "artist" of the tab, without any transformations
+// applied.
+const (
+	// eventTabAdded is published when a new tab is cached.
+	eventTabAdded = "tab.added"
+
+	// eventTabUpdated is published when a cached tab changes, such as
+	// when its file is edited or the admin overrides whether it's
+	// explicit.
+	eventTabUpdated = "tab.updated"
+
+	// eventTabDeleted is published when a tab is removed from the cache,
+	// such as when its file is deleted.
+	eventTabDeleted = "tab.deleted"
+
+	// eventTagsChanged is published when the admin renames, merges or
+	// deletes a tag. Its data has the old tag, "from", the tag which
+	// replaced it, "to", which is empty if it was deleted, and the number
+	// of "tabs" which had it. No tab.updated events are published for the
+	// tabs.
+	eventTagsChanged = "tags.changed"
+
+	// eventCollectionReset is published when every tab is removed from the
+	// cache at once, so that they can be read again from their files. Its
+	// data is the same summary of what was removed which the reset-cache
+	// endpoint responds with, and no tab.deleted events are published for
+	// the tabs.
+	eventCollectionReset = "collection.reset"
+
+	// eventSettingsChanged is published when the settings are changed. Its
+	// data is empty, and the new settings can be fetched from
+	// /api/v1/settings.
+	eventSettingsChanged = "settings.changed"
+
+	// eventJobFinished is published when a job finishes, however it ends.
+	// Its data has the job's "id", "kind" and "status".
+	eventJobFinished = "job.finished"
+
+	// eventIntegrityAlert is published when an integrity snapshot finds
+	// that a lot of tabs or files have disappeared or changed. Its data is
+	// the snapshot, which has the "alerts" describing what was found.
+	eventIntegrityAlert = "integrity.alert"
+
+	// eventCollectionMigrated is published to the new database once the
+	// migrate command has copied everything into it. Its data has the
+	// number of "tabs" which were copied, and no tab.added events are
+	// published for them.
+	eventCollectionMigrated = "collection.migrated"
+
+	// eventCollectionRestored is published when a dump is restored with
+	// /api/v1/import. Its data is the same summary of what was restored
+	// which the endpoint responds with, and no tab.added events are
+	// published for the tabs.
+	eventCollectionRestored = "collection.restored"
+
+	// eventNowShowingChanged is published when the tab which is being
+	// viewed or performed changes. Its data has the "state", which is
+	// "viewing" or "performing", and the "id" of the tab, which is empty if
+	// no tab is on show any more. Anyone can poll for it, so that the
+	// display can follow along without logging in.
+	eventNowShowingChanged = "now-showing.changed"
+
+	// eventSongRequested is published when someone asks for a song which
+	// the collection doesn't have a tab for. Its data has the wishlist
+	// entry's "id", the "song" and its "artist", and the number of "votes"
+	// it now has.
+	eventSongRequested = "song.requested"
+
+	// eventSongFulfilled is published when a tab is added for a song on the
+	// wishlist. Its data has the wishlist entry's "id", the "song", and the
+	// "tab" which fulfilled it.
+	eventSongFulfilled = "song.fulfilled"
+
+	// eventRecordingAdded is published when a rehearsal recording is
+	// uploaded. Its data has the recording's "id" and "title", and the ID
+	// of the "tab" or "setlist" which it is attached to.
+	eventRecordingAdded = "recording.added"
+)
+
+// tabEventData returns the data of an event about the tab.
+func tabEventData(tab *Tab) map[string]string {
+	return map[string]string{
+		"id":       tab.ID,
+		"filename": tab.Filename,
+		"title":    tab.Title,
+		"artist":   tab.Artist,
+	}
+}
+
+// publishEvent adds an event about a change made by the given actor to the
+// event log, and publishes it to the MQTT broker if there is one. The change
+// which the event is about has already happened by the time it is published,
+// so a failure is only written to the console rather than returned.
+func (s *Server) publishEvent(kind string, by actor, data interface{}) {
+	if data == nil {
+		data = struct{}{}
+	}
+
+	now := time.Now().Format(time.RFC3339Nano)
+	by = s.record(by)
+
+	s.publishMQTT("events/"+kind, map[string]interface{}{
+		"type":  kind,
+		"time":  now,
+		"actor": by,
+		"data":  data,
+	}, false)
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		fmt.Printf("warning: the %s event could not be encoded: %s\n", kind, err)
+		return
+	}
+
+	encodedActor, err := json.Marshal(by)
+	if err != nil {
+		fmt.Printf("warning: the %s event's actor could not be encoded: %s\n", kind, err)
+		return
+	}
+
+	if err := s.Store.AddEvent(loggedEvent{
+		Schema: eventSchema,
+		Type:   kind,
+		Time:   now,
+		Actor:  string(encodedActor),
+		Data:   string(encoded),
+	}, maxEvents); err != nil {
+		fmt.Printf("warning: the %s event could not be published: %s\n", kind, err)
+	}
+}
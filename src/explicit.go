@@ -0,0 +1,161 @@
+package src
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// explicitWords are the words which mark a tab's lyrics as explicit. A tab
+// with any of them in its lyrics is flagged, although the admin can always
+// override that either way.
+var explicitWords = map[string]bool{
+	"fuck": true, "fucking": true, "fucked": true, "fucker": true, "motherfucker": true,
+	"shit": true, "shitty": true, "bullshit": true,
+	"bitch": true, "bitches": true,
+	"cunt": true, "dick": true, "cock": true, "pussy": true,
+	"bastard": true, "asshole": true, "nigga": true, "whore": true, "slut": true,
+	"puta": true, "mierda": true, "joder": true, "coño": true,
+	"merde": true, "putain": true, "scheiße": true, "scheisse": true, "cazzo": true,
+}
+
+// These are the values of a tab's explicit override, which is set by the
+// admin to overrule the heuristic.
+const (
+	explicitOverrideNone     = ""
+	explicitOverrideExplicit = "explicit"
+	explicitOverrideClean    = "clean"
+)
+
+// detectExplicit reports whether the lyrics in a tab's content contain any
+// of the explicit words.
+func detectExplicit(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if !lyricLine(line) {
+			continue
+		}
+
+		words := strings.FieldsFunc(strings.ToLower(line), func(r rune) bool {
+			return !unicode.IsLetter(r)
+		})
+
+		for _, word := range words {
+			if explicitWords[word] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// applyExplicitOverride sets t.Explicit according to the admin's override,
+// if there is one. Otherwise, t.Explicit is left as whatever was detected.
+func (t *Tab) applyExplicitOverride() {
+	switch t.ExplicitOverride {
+	case explicitOverrideExplicit:
+		t.Explicit = true
+	case explicitOverrideClean:
+		t.Explicit = false
+	}
+}
+
+// setExplicitOverride sets the explicit override of the tab with the given
+// ID. The override "auto" removes any existing override, so the heuristic is
+// used again. The change is recorded as being made by the given actor. If it
+// can't be set, an error and error status are returned.
+func (s *Server) setExplicitOverride(id, override string, by actor) (int, error) {
+	_, exists, err := s.Store.GetTab(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !exists {
+		return http.StatusNotFound, errTabNotFound
+	}
+
+	switch override {
+	case "auto":
+		override = explicitOverrideNone
+
+	case explicitOverrideExplicit, explicitOverrideClean:
+
+	default:
+		return http.StatusBadRequest, errors.New("the value must be explicit, clean or auto")
+	}
+
+	if err := s.Store.SetExplicitOverride(id, override); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// The browse index keeps track of which tabs are explicit, so that they
+	// can be left out of the counts of each artist's tabs.
+	if tab, ok, err := s.Store.GetTab(id); err != nil {
+		return http.StatusInternalServerError, err
+	} else if ok {
+		if err := s.markBrowseExplicit(tab); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if err := s.bumpCollectionVersion(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if tab, ok, err := s.Store.GetTab(id); err == nil && ok {
+		s.publishEvent(eventTabUpdated, by, tabEventData(tab))
+	}
+
+	return http.StatusOK, nil
+}
+
+// showsExplicit reports whether explicit tabs should be included in the
+// response to the request. If the settings say to hide them, only the admin
+// can see them, which they do unless they ask not to with the query value
+// 'explicit=0'.
+func (s *Server) showsExplicit(r *http.Request) bool {
+	if !s.Settings.HideExplicit {
+		return true
+	}
+
+	if r.FormValue("explicit") == "0" {
+		return false
+	}
+
+	_, err := s.authenticate(r)
+	return err == nil
+}
+
+// filterExplicit returns the tabs which aren't explicit.
+func filterExplicit(tabs []*Tab) []*Tab {
+	filtered := make([]*Tab, 0, len(tabs))
+
+	for _, tab := range tabs {
+		if !tab.Explicit {
+			filtered = append(filtered, tab)
+		}
+	}
+
+	return filtered
+}
+
+// handleSetExplicitAPI is called to respond to a HTTP request to
+// /api/v1/set-explicit. It sets the explicit override of the tab with the ID
+// in the 'id' form field to the 'value' form field, which is one of
+// 'explicit', 'clean' or 'auto'. It will only accept POST requests from a
+// logged in admin.
+func (s *Server) handleSetExplicitAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if status, err := s.checkEditLock(r, r.PostFormValue("id")); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if status, err := s.setExplicitOverride(r.PostFormValue("id"), r.PostFormValue("value"), s.requestActor(r)); err != nil {
+		writeError(w, status, err)
+		return
+	}
+}
@@ -0,0 +1,46 @@
+package src_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Zac-Garby/tab-server/src/tabtest"
+)
+
+func TestHiddenExplicitTabsShownToAdmin(t *testing.T) {
+	settings := tabtest.NewSettings().HideExplicit(true).Build()
+
+	_, handler := tabtest.NewServer(t, settings,
+		tabtest.NewTab("Abba", "Waterloo").Build(),
+		tabtest.NewTab("Cee Lo Green", "Forget You").Explicit(true).Build(),
+	)
+
+	cookies := tabtest.LogIn(t, handler, tabtest.Password)
+
+	cases := []struct {
+		target   string
+		loggedIn bool
+		explicit bool
+	}{
+		{"/api/v1/tabs", false, false},
+		{"/api/v1/tabs?explicit=1", false, false},
+		{"/api/v1/tabs", true, true},
+		{"/api/v1/tabs?explicit=0", true, false},
+	}
+
+	for _, c := range cases {
+		var sent []*http.Cookie
+		if c.loggedIn {
+			sent = cookies
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, tabtest.NewRequest("GET", c.target, nil, sent))
+
+		if body := w.Body.String(); !strings.Contains(body, "Waterloo") || strings.Contains(body, "Forget You") == !c.explicit {
+			t.Errorf("%s (logged in: %v): expected explicit tabs to be shown: %v, got %s", c.target, c.loggedIn, c.explicit, body)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportVersion is the version of the export format. It is increased if the
+// format changes in a way which older versions couldn't import.
+const exportVersion = 1
+
+// A library is a dump of every tab in the collection, which Export writes
+// and Import reads, so that a collection can be backed up or moved to
+// another server.
+type library struct {
+	Version  int           `json:"version"`
+	Exported time.Time     `json:"exported"`
+	Tabs     []exportedTab `json:"tabs"`
+
+	// Settings and TagRules are the settings, without the admin password,
+	// and the admin's renamed and merged tags, which backup.go can restore.
+	// Import leaves them alone, since it only adds tabs.
+	Settings *Settings         `json:"settings,omitempty"`
+	TagRules map[string]string `json:"tagRules,omitempty"`
+}
+
+// An exportedTab is a tab as it is exported, along with the things the admin
+// has changed about it, which aren't normally sent to clients.
+type exportedTab struct {
+	*Tab
+
+	ExplicitOverride string   `json:"explicitOverride,omitempty"`
+	ExtraTags        []string `json:"extraTags,omitempty"`
+
+	// File is the file of a binary tab, which has no content of its own.
+	// It is encoded in base64.
+	File []byte `json:"file,omitempty"`
+}
+
+// Rescan checks every file in the tab directory against the cache straight
+// away, rather than as a background job, and returns how many files were
+// checked. It is still recorded as a job, so it shows up with the others.
+// Any files which couldn't be rescanned are written to the console.
+func (s *Server) Rescan() (int, error) {
+	j := newJob("rescan")
+	j.Status = jobQueued
+
+	if err := s.createJob(j); err != nil {
+		return 0, err
+	}
+
+	if err := s.runJob(j.ID); err != nil {
+		return 0, err
+	}
+
+	j, ok, err := s.fetchJob(j.ID)
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, errors.New("the job's record no longer exists")
+	}
+
+	if j.Status == jobFailed && len(j.Errors) > 0 {
+		return j.Done, errors.New(j.Errors[len(j.Errors)-1])
+	}
+
+	return j.Done, nil
+}
+
+// Export writes every cached tab to w as JSON, without any transformations
+// applied, in order of filename, along with the files of the binary tabs,
+// the settings and the tag rules.
+// Only tabs which have been cached are exported, so files which have been
+// added since the tabs were last listed should be picked up with a rescan
+// first.
+func (s *Server) Export(w io.Writer) error {
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		return err
+	}
+
+	tabs, err := s.Store.GetTabs(ids)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(tabs, func(i, j int) bool {
+		return tabs[i].Filename < tabs[j].Filename
+	})
+
+	tagRules, err := s.Store.TagRules()
+	if err != nil {
+		return err
+	}
+
+	lib := library{
+		Version:  exportVersion,
+		Exported: time.Now(),
+		Tabs:     make([]exportedTab, len(tabs)),
+		Settings: s.Settings,
+		TagRules: tagRules,
+	}
+
+	for i, tab := range tabs {
+		extraTags, err := s.Store.ExtraTags(tab.ID)
+		if err != nil {
+			return err
+		}
+
+		lib.Tabs[i] = exportedTab{
+			Tab:              tab,
+			ExplicitOverride: tab.ExplicitOverride,
+			ExtraTags:        extraTags,
+		}
+
+		if tab.Binary {
+			if lib.Tabs[i].File, err = ioutil.ReadFile(s.tabPath(tab.Filename)); err != nil {
+				return err
+			}
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+
+	return encoder.Encode(lib)
+}
+
+// Import reads a library written by Export from r, and writes each of its
+// tabs to its file in the tab directory, which is then cached like any other
+// file. Files which already exist are left alone, so importing the same
+// library twice doesn't change anything. The number of tabs which were
+// imported and the number which were skipped are returned.
+func (s *Server) Import(r io.Reader) (imported, skipped int, err error) {
+	lib, err := readLibrary(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return s.importTabs(lib.Tabs)
+}
+
+// readLibrary reads a library written by Export from r, leaving out any tabs
+// which are missing.
+func readLibrary(r io.Reader) (*library, error) {
+	var lib library
+	if err := json.NewDecoder(r).Decode(&lib); err != nil {
+		return nil, err
+	}
+
+	if lib.Version > exportVersion {
+		return nil, fmt.Errorf("the library is from a newer version (%d) which can't be imported", lib.Version)
+	}
+
+	tabs := lib.Tabs[:0]
+	for _, exported := range lib.Tabs {
+		if exported.Tab != nil {
+			tabs = append(tabs, exported)
+		}
+	}
+
+	lib.Tabs = tabs
+
+	return &lib, nil
+}
+
+// importTabs imports each of the given tabs, returning the number which were
+// imported and the number which were skipped because their files already
+// existed.
+func (s *Server) importTabs(tabs []exportedTab) (imported, skipped int, err error) {
+	for _, exported := range tabs {
+		ok, err := s.importTab(exported)
+		if err != nil {
+			return imported, skipped, fmt.Errorf("%s: %s", exported.Filename, err)
+		}
+
+		if ok {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+
+	return imported, skipped, nil
+}
+
+// importFilename cleans the filename which a tab is to be imported to. The
+// filename comes from outside the server, so it mustn't be allowed to point
+// anywhere outside of the tab directory, or into any of the hidden files and
+// directories inside it, such as the trash and the pending imports, which the
+// server keeps for itself.
+func importFilename(filename string) (string, error) {
+	filename = path.Clean(filename)
+	if filename == "." || path.IsAbs(filename) || filename == ".." || strings.HasPrefix(filename, "../") {
+		return "", errors.New("the filename isn't inside the tab directory")
+	}
+
+	for _, component := range strings.Split(filename, "/") {
+		if strings.HasPrefix(component, ".") {
+			return "", errors.New("the filename is in a hidden file or directory")
+		}
+	}
+
+	return filename, nil
+}
+
+// importTab writes an exported tab to its file and caches it. If the file
+// already exists, nothing is done and false is returned.
+func (s *Server) importTab(exported exportedTab) (bool, error) {
+	filename, err := importFilename(exported.Filename)
+	if err != nil {
+		return false, err
+	}
+
+	filePath := s.tabPath(filename)
+
+	if _, err := os.Stat(filePath); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return false, err
+	}
+
+	content := []byte(exported.Content)
+	if exported.Binary {
+		if len(exported.File) == 0 {
+			return false, errors.New("the tab is binary, but its file wasn't exported")
+		}
+
+		content = exported.File
+	}
+
+	if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+		return false, err
+	}
+
+	// The date a tab was added is taken from its file's modification time,
+	// so the file is given the original date.
+	if !exported.Added.IsZero() {
+		if err := os.Chtimes(filePath, exported.Added, exported.Added); err != nil {
+			return false, err
+		}
+	}
+
+	if err := s.syncFile(filename, systemActor(systemImporter)); err != nil {
+		return false, err
+	}
+
+	// Restore the admin's changes to the tab, if it was cached. It might not
+	// have been if it doesn't match the current settings.
+	id, cached, err := s.Store.TabID(filename)
+	if err != nil || !cached {
+		return true, err
+	}
+
+	// The tab is recorded as having been imported, but the credit for it
+	// is carried over from the export.
+	if exported.Source.URL != "" || exported.Source.Author != "" || exported.Source.License != "" {
+		source := TabSource{Kind: sourceImport, URL: exported.Source.URL, Author: exported.Source.Author, License: exported.Source.License}
+		if !validSourceURL(source.URL) {
+			source.URL = ""
+		}
+
+		if err := s.Store.SetSource(id, source); err != nil {
+			return true, err
+		}
+	}
+
+	// So is the practice metadata, unless it is invalid, such as from an
+	// export which was edited by hand.
+	if exported.Practice != (TabPractice{}) && exported.Practice.validate() == nil {
+		if err := s.Store.SetPractice(id, exported.Practice); err != nil {
+			return true, err
+		}
+	}
+
+	if len(exported.ExtraTags) == 0 && exported.ExplicitOverride == "" {
+		return true, nil
+	}
+
+	if err := s.Store.SetExplicitOverride(id, exported.ExplicitOverride); err != nil {
+		return true, err
+	}
+
+	if err := s.Store.AddExtraTags(id, exported.ExtraTags); err != nil {
+		return true, err
+	}
+
+	// Sync the file again, which adds the extra tags to the tab's tags and
+	// notes that the collection has changed.
+	return true, s.syncFile(filename, systemActor(systemImporter))
+}
@@ -0,0 +1,38 @@
+package src
+
+import "testing"
+
+func TestImportFilename(t *testing.T) {
+	cases := []struct {
+		filename, expected string
+		ok                 bool
+	}{
+		{"Abba - SOS.txt", "Abba - SOS.txt", true},
+		{"abba/sos.txt", "abba/sos.txt", true},
+		{"abba/../sos.txt", "sos.txt", true},
+		{"./abba/sos.txt", "abba/sos.txt", true},
+
+		// Anything outside of the tab directory is rejected.
+		{"../sos.txt", "", false},
+		{"/etc/passwd", "", false},
+		{"abba/../../sos.txt", "", false},
+		{".", "", false},
+		{"", "", false},
+
+		// So is anything in the hidden directories which the server keeps
+		// for itself, or any other hidden file.
+		{".trash/x.txt", "", false},
+		{".imports/x/y.txt", "", false},
+		{"abba/.hidden.txt", "", false},
+		{"abba/.secret/sos.txt", "", false},
+	}
+
+	for _, c := range cases {
+		filename, err := importFilename(c.filename)
+		if c.ok && (err != nil || filename != c.expected) {
+			t.Errorf("%q: expected %q, got %q and %v", c.filename, c.expected, filename, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%q: expected it to be rejected, got %q", c.filename, filename)
+		}
+	}
+}
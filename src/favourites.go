@@ -0,0 +1,327 @@
+package src
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Anyone can star the tabs they like, so that they can find them again. The
+// server doesn't have user accounts, so the favourites belong to whatever
+// identifies whoever is asking: the name of the API token for requests which
+// use one, and otherwise a random viewer ID which is given to each browser
+// in the viewer cookie the first time it stars a tab. Each owner's
+// favourites are a set of tab IDs, and the owners are written as viewer:<ID>
+// or token:<name>. The viewers' favourites expire along with their cookies,
+// so that the ones from browsers which never come back don't build up.
+const (
+	// viewerCookie is the name of the cookie which holds the viewer ID.
+	viewerCookie = "viewer"
+
+	// viewerDuration is how long the viewer cookie, and the favourites
+	// which go with it, last after a tab was last starred or unstarred.
+	viewerDuration = 365 * 24 * time.Hour
+)
+
+func init() {
+	tabReferenceMovers = append(tabReferenceMovers, (*Server).moveFavourites)
+}
+
+// viewerID returns the viewer ID in the request's cookie, having checked its
+// signature, which is made in the same way as the session cookie's, with any
+// of the session keys which haven't retired yet. If there is no cookie or the
+// signature is wrong, the second return value is false. The third is true if
+// it was signed with a key other than the current one, in which case it
+// should be signed again before that key retires, since the cookie lasts
+// much longer than the keys do.
+func (s *Server) viewerID(r *http.Request) (string, bool, bool, error) {
+	cookie, err := r.Cookie(viewerCookie)
+	if err != nil {
+		return "", false, false, nil
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return "", false, false, nil
+	}
+
+	sign := func(secret string) string {
+		return signSession("viewer:"+parts[0], secret)
+	}
+
+	ok, err := s.checkSignature(secretSession, parts[1], sign)
+	if err != nil || !ok {
+		return "", false, false, err
+	}
+
+	secret, err := s.sessionSecret()
+	if err != nil {
+		return "", false, false, err
+	}
+
+	return parts[0], true, !hmac.Equal([]byte(parts[1]), []byte(sign(secret))), nil
+}
+
+// setViewerCookie sets the viewer cookie holding the given viewer ID on the
+// response.
+func (s *Server) setViewerCookie(w http.ResponseWriter, id string) error {
+	secret, err := s.sessionSecret()
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     viewerCookie,
+		Value:    id + "." + signSession("viewer:"+id, secret),
+		Path:     "/",
+		Expires:  time.Now().Add(viewerDuration),
+		HttpOnly: true,
+		Secure:   s.HTTPS,
+		SameSite: s.sessionSameSite(),
+	})
+
+	return nil
+}
+
+// favouritesOwner returns the owner of the favourites of whoever made the
+// request. If create is true and they are a browser without a viewer ID
+// yet, they are given one in a cookie on the response. Otherwise, the second
+// return value is false if they don't have any favourites to look up. If
+// they gave an API token which doesn't exist, an error and error status are
+// returned.
+func (s *Server) favouritesOwner(w http.ResponseWriter, r *http.Request, create bool) (string, bool, int, error) {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		if status, err := s.validateToken(r); err != nil {
+			return "", false, status, err
+		}
+
+		name, err := s.tokenName(r)
+		if err != nil {
+			return "", false, http.StatusInternalServerError, err
+		}
+
+		return "token:" + name, true, http.StatusOK, nil
+	}
+
+	id, ok, stale, err := s.viewerID(r)
+	if err != nil {
+		return "", false, http.StatusInternalServerError, err
+	}
+
+	if !ok {
+		if !create {
+			return "", false, http.StatusOK, nil
+		}
+
+		if id, err = randomHex(16); err != nil {
+			return "", false, http.StatusInternalServerError, err
+		}
+	}
+
+	owner := "viewer:" + id
+
+	// The cookie is set again even if it was already there, so that it
+	// lasts for viewerDuration after the favourites last changed. It is
+	// also set again whenever it was signed with an older key, so that it
+	// is signed with the current one, and the favourites are kept for as
+	// long as the new cookie lasts.
+	if create || (stale && w != nil) {
+		if err := s.setViewerCookie(w, id); err != nil {
+			return "", false, http.StatusInternalServerError, err
+		}
+	}
+
+	if stale && w != nil && !create {
+		if err := s.Store.ExpireFavourites(owner, viewerDuration); err != nil {
+			return "", false, http.StatusInternalServerError, err
+		}
+	}
+
+	return owner, true, http.StatusOK, nil
+}
+
+// favouriteIDs returns the set of the IDs of the tabs which whoever made the
+// request has starred. It is empty if they haven't starred any, or can't be
+// identified.
+func (s *Server) favouriteIDs(r *http.Request) (map[string]bool, error) {
+	owner, ok, _, err := s.favouritesOwner(nil, r, false)
+	if err != nil {
+		// A request with a bad token just doesn't have any favourites,
+		// rather than failing, since the tabs don't need a token.
+		if _, isAPIError := err.(*apiError); isAPIError {
+			return map[string]bool{}, nil
+		}
+
+		return nil, err
+	} else if !ok {
+		return map[string]bool{}, nil
+	}
+
+	ids, err := s.Store.Favourites(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	favourites := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		favourites[id] = true
+	}
+
+	return favourites, nil
+}
+
+// markFavourites sets IsFavourite on each of the tabs which is one of the
+// favourites.
+func markFavourites(tabs []*Tab, favourites map[string]bool) {
+	for _, tab := range tabs {
+		tab.IsFavourite = favourites[tab.ID]
+	}
+}
+
+// favouritesETag returns the ETag of a list of tabs with the given ETag once
+// it has been marked with the favourites, which changes whenever they do.
+// Nothing is added when there aren't any, so that the ETags which were
+// sent before favourites existed stay the same.
+func favouritesETag(etag string, favourites map[string]bool) string {
+	if len(favourites) == 0 {
+		return etag
+	}
+
+	ids := make([]string, 0, len(favourites))
+	for id := range favourites {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	sum := sha256.Sum256([]byte(strings.Join(ids, ",")))
+	return fmt.Sprintf(`%s-%x"`, strings.TrimSuffix(etag, `"`), sum[:4])
+}
+
+// moveFavourites moves every favourite of the tab with the ID from over to
+// the tab with the ID to, for when the tabs are merged.
+func (s *Server) moveFavourites(from, to string) error {
+	return s.Store.MoveFavourites(from, to)
+}
+
+// favouritesExpiry returns how long the owner's favourites last after they
+// last changed, or 0 if they are kept for good.
+func favouritesExpiry(owner string) time.Duration {
+	if strings.HasPrefix(owner, "viewer:") {
+		return viewerDuration
+	}
+
+	return 0
+}
+
+// setFavourite stars or unstars the tab with the ID in the 'id' form value
+// for whoever made the request. If there is an error, the HTTP status which
+// it should be reported with is returned along with it.
+func (s *Server) setFavourite(w http.ResponseWriter, r *http.Request, favourite bool) (int, error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, errOnlyPOST
+	}
+
+	id := r.PostFormValue("id")
+
+	// Only the tabs which they can see can be starred, but any tab can be
+	// unstarred, so that the ones which have since been hidden or deleted
+	// can be cleared out.
+	if favourite {
+		tab, ok, err := s.Store.GetTab(id)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		} else if !ok || s.hidesTab(r, tab) {
+			return http.StatusNotFound, errTabNotFound
+		}
+	}
+
+	owner, _, status, err := s.favouritesOwner(w, r, true)
+	if err != nil {
+		return status, err
+	}
+
+	if favourite {
+		err = s.Store.AddFavourites(owner, []string{id}, favouritesExpiry(owner))
+	} else {
+		err = s.Store.RemoveFavourite(owner, id, favouritesExpiry(owner))
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// handleFavouriteAPI is called to respond to a HTTP request to
+// /api/v1/favourite. It stars the tab with the ID in the 'id' form value for
+// whoever made the request. It only accepts POST requests, but anyone can
+// make them.
+func (s *Server) handleFavouriteAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.setFavourite(w, r, true); err != nil {
+		writeError(w, status, err)
+	}
+}
+
+// handleUnfavouriteAPI is called to respond to a HTTP request to
+// /api/v1/unfavourite. It unstars the tab with the ID in the 'id' form value
+// for whoever made the request, in the same way as /api/v1/favourite.
+func (s *Server) handleUnfavouriteAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.setFavourite(w, r, false); err != nil {
+		writeError(w, status, err)
+	}
+}
+
+// handleFavouritesAPI is called to respond to a HTTP request to
+// /api/v1/favourites. It responds with the tabs which whoever made the
+// request has starred, sorted by title, encoded in JSON in the same way as
+// /api/v1/search does. The tabs which have since been deleted, or which they
+// can no longer see, are left out.
+func (s *Server) handleFavouritesAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	owner, ok, status, err := s.favouritesOwner(w, r, false)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	tabs := make([]*Tab, 0)
+
+	if ok {
+		ids, err := s.Store.Favourites(owner)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if tabs, err = s.browseTabs(ids); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	visible := make([]*Tab, 0, len(tabs))
+
+	for _, tab := range tabs {
+		if !s.hidesTab(r, tab) {
+			tab.IsFavourite = true
+			visible = append(visible, tab)
+		}
+	}
+
+	jsonData, err := json.Marshal(visible)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
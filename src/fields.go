@@ -0,0 +1,113 @@
+package src
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Clients which only show a few fields of what they fetch, such as a list of
+// titles on a slow connection, can ask for just those fields with the
+// 'fields' query value, like ?fields=title,artist,tags. The selection works
+// on the JSON of any response to a GET request, so the handlers don't know
+// about it: a list has each of its elements cut down, an object keeps only
+// the fields which were asked for, and a field of a field can be picked out
+// with a dot, like ?fields=total,tabs.title. Fields which don't exist are
+// ignored, and errors are always sent in full.
+
+// A fieldSelection maps the names of the fields which were asked for to the
+// fields which were asked for within them, which is nil if the whole field
+// was.
+type fieldSelection map[string]fieldSelection
+
+// parseFields parses the values of the 'fields' query value, each of which is
+// a comma separated list of fields. If a field is asked for as a whole and
+// as one of its parts, the whole of it is kept.
+func parseFields(values []string) fieldSelection {
+	selection := fieldSelection{}
+
+	for _, value := range values {
+		for _, path := range strings.Split(value, ",") {
+			path = strings.TrimSpace(path)
+			if path != "" {
+				selection.add(strings.Split(path, "."))
+			}
+		}
+	}
+
+	return selection
+}
+
+// add adds the field at the given path to the selection.
+func (sel fieldSelection) add(path []string) {
+	name := path[0]
+	if name == "" {
+		return
+	}
+
+	if len(path) == 1 {
+		sel[name] = nil
+		return
+	}
+
+	child, ok := sel[name]
+	if ok && child == nil {
+		// The whole field has already been asked for.
+		return
+	}
+
+	if !ok {
+		child = fieldSelection{}
+		sel[name] = child
+	}
+
+	child.add(path[1:])
+}
+
+// apply cuts a decoded JSON value down to the selected fields. A list has
+// each of its elements cut down, and anything which isn't an object or a list
+// is left as it is.
+func (sel fieldSelection) apply(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i, element := range v {
+			v[i] = sel.apply(element)
+		}
+
+	case map[string]interface{}:
+		for key, element := range v {
+			child, ok := sel[key]
+			if !ok {
+				delete(v, key)
+			} else if child != nil {
+				v[key] = child.apply(element)
+			}
+		}
+	}
+
+	return value
+}
+
+// selectFields is middleware for the router which cuts the JSON responses to
+// GET requests down to the fields in the 'fields' query value, if there is
+// one. Any other request is passed on as it is, so that streamed responses
+// can still be flushed.
+func selectFields(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selection := parseFields(r.URL.Query()["fields"])
+		if (r.Method != "GET" && r.Method != "HEAD") || len(selection) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rw := &jsonRewriter{ResponseWriter: w, rewrite: func(status int, value interface{}) interface{} {
+			if status < 200 || status >= 300 {
+				return value
+			}
+
+			return selection.apply(value)
+		}}
+		defer rw.close()
+
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,225 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Hooks are commands which the server runs at certain points, so that the
+// admin can script things of their own, such as regenerating a static copy of
+// the site whenever a tab is added, without changing the server. Each hook
+// is run with 'sh -c', with a JSON object describing what happened on its
+// standard input, like this:
+//
+//	{"hook": "post-ingest", "time": "...", "event": "tab.added",
+//	 "actor": {...}, "tab": {...}}
+//
+// The actor is who or what made the change, in the same form as in the
+// events.
+// The name of the hook is also in the TAB_SERVER_HOOK environment variable.
+// Anything the command writes is copied to the console.
+//
+// These are the hooks:
+//
+//	post-ingest           after a tab is read from its file, either for the
+//	                      first time or after it changes; "event" is
+//	                      "tab.added" or "tab.updated", and "tab" has the
+//	                      same data as tab events
+//	pre-delete            before the admin deletes a tab; "tab" is the tab
+//	                      which is about to be deleted, and if the command
+//	                      fails, the tab isn't deleted
+//	post-settings-change  after the settings are changed; "settings" has
+//	                      the new settings, without the password hash
+//	integrity-alert       after an integrity snapshot finds something
+//	                      unexpected, as described in integrity.go;
+//	                      "snapshot" has the snapshot and its alerts
+//
+// The post- hooks are run one at a time in the background, in the order they
+// happened, so that they don't hold up the requests which cause them. Their
+// payloads are also sent to the webhooks, as described in webhook.go.
+const (
+	hookPostIngest         = "post-ingest"
+	hookPreDelete          = "pre-delete"
+	hookPostSettingsChange = "post-settings-change"
+	hookIntegrityAlert     = "integrity-alert"
+
+	// hookTimeout is how long a hook can run for before it is killed.
+	hookTimeout = 30 * time.Second
+
+	// hookQueueSize is how many post- hooks can be waiting to run. Any more
+	// than that are dropped, rather than holding up the requests which
+	// cause them.
+	hookQueueSize = 1000
+)
+
+// A HookConfig says which command to run for each hook. A hook with an empty
+// command isn't run.
+type HookConfig struct {
+	PostIngest         string
+	PreDelete          string
+	PostSettingsChange string
+	IntegrityAlert     string
+
+	// Webhooks are the URLs which each post- hook's payload is POSTed to,
+	// whether or not the hook has a command.
+	Webhooks []string
+}
+
+// command returns the command for the hook with the given name.
+func (c HookConfig) command(hook string) string {
+	switch hook {
+	case hookPostIngest:
+		return c.PostIngest
+	case hookPreDelete:
+		return c.PreDelete
+	case hookPostSettingsChange:
+		return c.PostSettingsChange
+	case hookIntegrityAlert:
+		return c.IntegrityAlert
+	}
+
+	return ""
+}
+
+// A hookRun is a post- hook which is waiting to run.
+type hookRun struct {
+	hook    string
+	payload map[string]interface{}
+}
+
+// startHooks starts running the post- hooks in the background, until the
+// server shuts down. Until it is called, such as when a command is run rather
+// than the web server, they are run straight away instead.
+func (s *Server) startHooks() {
+	s.hookQueue = make(chan hookRun, hookQueueSize)
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+
+		stopping := s.background().Done()
+
+		for {
+			select {
+			case <-stopping:
+				if waiting := len(s.hookQueue); waiting > 0 {
+					s.logMessage("warn", "warning: %d hooks weren't run because the server is shutting down", waiting)
+				}
+
+				return
+
+			case run := <-s.hookQueue:
+				s.runPostHook(run.hook, run.payload)
+			}
+		}
+	}()
+}
+
+// queueHook runs a post- hook in the background, if it has a command or there
+// are webhooks. The payload is given to the command and the webhooks along
+// with the hook's name and the time.
+func (s *Server) queueHook(hook string, payload map[string]interface{}) {
+	if s.Hooks.command(hook) == "" && len(s.Hooks.Webhooks) == 0 {
+		return
+	}
+
+	payload["time"] = time.Now().Format(time.RFC3339Nano)
+
+	if s.hookQueue == nil {
+		s.runPostHook(hook, payload)
+		return
+	}
+
+	select {
+	case s.hookQueue <- hookRun{hook: hook, payload: payload}:
+	default:
+		s.logMessage("warn", "warning: the %s hook was dropped because too many are waiting", hook)
+	}
+}
+
+// runPostHook runs a post- hook's command and sends its payload to the
+// webhooks, logging any errors, since nothing is waiting for it.
+func (s *Server) runPostHook(hook string, payload map[string]interface{}) {
+	if err := s.runHook(hook, payload); err != nil {
+		s.logMessage("error", "warning: the %s hook failed: %s", hook, err)
+	}
+
+	if err := s.deliverWebhooks(hook, payload); err != nil {
+		s.logMessage("error", "warning: the %s webhook failed: %s", hook, err)
+	}
+}
+
+// runHook runs the command for the hook with the given name, if it has one,
+// and waits for it to finish. An error is returned if it fails, or takes
+// longer than hookTimeout.
+func (s *Server) runHook(hook string, payload map[string]interface{}) error {
+	command := s.Hooks.command(hook)
+	if command == "" {
+		return nil
+	}
+
+	payload["hook"] = hook
+	if _, ok := payload["time"]; !ok {
+		payload["time"] = time.Now().Format(time.RFC3339Nano)
+	}
+
+	input, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	var output bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(), "TAB_SERVER_HOOK="+hook)
+
+	err = cmd.Run()
+
+	for _, line := range strings.Split(strings.TrimRight(output.String(), "\n"), "\n") {
+		if line != "" {
+			s.logMessage("info", "[%s hook] %s", hook, line)
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("it took longer than %s", hookTimeout)
+	}
+
+	return err
+}
+
+// checkDelete runs the pre-delete hook for a tab which the given actor is
+// about to delete. If the hook fails, an error with the hook_refused code is
+// returned, and the tab mustn't be deleted.
+func (s *Server) checkDelete(tab *Tab, by actor) error {
+	err := s.runHook(hookPreDelete, map[string]interface{}{
+		"actor": s.record(by),
+		"tab":   tabEventData(tab),
+	})
+
+	if err != nil {
+		return newAPIError(codeHookRefused, fmt.Sprintf("the pre-delete hook refused to let the tab be deleted: %s", err))
+	}
+
+	return nil
+}
+
+// settingsHookData returns the settings as they are given to the
+// post-settings-change hook, without the password hash.
+func settingsHookData(settings *Settings) Settings {
+	data := *settings
+	data.PasswordHash = ""
+	return data
+}
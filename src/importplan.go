@@ -0,0 +1,217 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Importing a library straight away writes every one of its tabs into the tab
+// directory, which is hard to undo if the library was laid out differently,
+// such as with filenames that don't match this server's patterns. Instead, it
+// can be imported in two steps: PreviewImport writes a plan which says where
+// each tab would be written and what its filename would be parsed as, which
+// the admin can check and change, and ImportPlanned then imports the library
+// as the plan says. Only the targets and whether to skip each tab are read
+// back from the plan, since the rest comes from the target. Imports over the
+// API are done in the same two steps, as described in pendingimport.go.
+
+// importPlanVersion is the version of the format of import plans.
+const importPlanVersion = 1
+
+// An importPlan says what importing a library would do with each of its tabs.
+type importPlan struct {
+	Version int              `json:"version"`
+	Tabs    []*plannedImport `json:"tabs"`
+}
+
+// A plannedImport says what importing a tab from a library would do.
+type plannedImport struct {
+	// Filename is the tab's filename in the library, which identifies it,
+	// and Target is where it is to be written in the tab directory, which
+	// can be changed. If Skip is true, the tab isn't imported at all.
+	Filename string `json:"filename"`
+	Target   string `json:"target"`
+	Skip     bool   `json:"skip"`
+
+	// The title, artist and tags which the target would be parsed as, and
+	// the pattern which it matches.
+	Title   string   `json:"title"`
+	Artist  string   `json:"artist"`
+	Tags    []string `json:"tags"`
+	Pattern string   `json:"pattern"`
+
+	// Exists is whether there is already a file at the target, in which
+	// case the tab would be skipped anyway.
+	Exists bool `json:"exists"`
+
+	// Problems says what is wrong with the target, if anything. A tab with
+	// problems is skipped until they are fixed.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// planImport works out where a tab would be imported to, and what it would be
+// parsed as, given the targets which earlier tabs in the plan are using.
+func (s *Server) planImport(planned *plannedImport, format string, patterns []filenamePattern, targets map[string]bool) {
+	planned.Title, planned.Artist, planned.Tags, planned.Pattern = "", "", nil, ""
+	planned.Exists, planned.Problems = false, nil
+
+	target, err := importFilename(planned.Target)
+	if err != nil {
+		planned.Problems = append(planned.Problems, err.Error())
+		return
+	}
+
+	planned.Target = target
+
+	var ok bool
+	planned.Title, planned.Artist, planned.Tags, planned.Pattern, ok = s.parseTabFilename(target, patterns)
+
+	// MusicXML scores are read whatever their filenames are, as described
+	// in musicxml.go.
+	if !ok && isMusicXMLFormat(format) && musicXMLExtensions[strings.ToLower(path.Ext(target))] {
+		name := path.Base(target)
+		planned.Title, ok = strings.TrimSuffix(name, path.Ext(name)), true
+	}
+
+	if !ok {
+		planned.Problems = append(planned.Problems, "the filename doesn't match any of the filename patterns, so the tab wouldn't be listed")
+	}
+
+	if targets[target] {
+		planned.Problems = append(planned.Problems, "another tab in the library is being imported to the same file")
+	}
+
+	if _, err := os.Stat(s.tabPath(target)); err == nil {
+		planned.Exists = true
+	} else if !os.IsNotExist(err) {
+		planned.Problems = append(planned.Problems, err.Error())
+	}
+
+	targets[target] = true
+}
+
+// PreviewImport reads a library written by Export from r, and writes a plan
+// for importing it to w as JSON, without changing anything.
+func (s *Server) PreviewImport(r io.Reader, w io.Writer) error {
+	lib, err := readLibrary(r)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+
+	return encoder.Encode(s.planLibraryImport(lib))
+}
+
+// planLibraryImport returns a plan for importing a library. Each tab is to be
+// imported to the same filename as in the library, unless there is a problem
+// with it, in which case it is skipped.
+func (s *Server) planLibraryImport(lib *library) *importPlan {
+	patterns := tokenizePatterns(s.Settings.FilenamePatterns)
+	targets := make(map[string]bool)
+
+	plan := &importPlan{
+		Version: importPlanVersion,
+		Tabs:    make([]*plannedImport, len(lib.Tabs)),
+	}
+
+	for i, exported := range lib.Tabs {
+		planned := &plannedImport{Filename: exported.Filename, Target: exported.Filename}
+		s.planImport(planned, exported.Format, patterns, targets)
+
+		planned.Skip = planned.Exists || len(planned.Problems) > 0
+		plan.Tabs[i] = planned
+	}
+
+	return plan
+}
+
+// readImportPlan reads a plan written by PreviewImport, or returned when an
+// import is previewed over the API, from r.
+func readImportPlan(r io.Reader) (*importPlan, error) {
+	var plan importPlan
+	if err := json.NewDecoder(r).Decode(&plan); err != nil {
+		return nil, invalidImportPlan("the plan couldn't be read: %s", err)
+	}
+
+	if plan.Version > importPlanVersion {
+		return nil, invalidImportPlan("the plan is from a newer version (%d) which can't be used", plan.Version)
+	}
+
+	return &plan, nil
+}
+
+// invalidImportPlan returns an error with the invalid_import_plan code,
+// formatted like fmt.Sprintf.
+func invalidImportPlan(format string, args ...interface{}) error {
+	return newAPIError(codeInvalidImportPlan, fmt.Sprintf(format, args...))
+}
+
+// ImportPlanned reads a library written by Export from r, and imports the tabs
+// which the plan written by PreviewImport, and perhaps changed since, says to
+// import, to the targets it gives. Tabs which aren't in the plan are skipped.
+// Every target is checked again before anything is written, so nothing is
+// imported if any of them still has a problem. Targets whose files already
+// exist are skipped, like with Import.
+func (s *Server) ImportPlanned(r io.Reader, planReader io.Reader) (imported, skipped int, err error) {
+	lib, err := readLibrary(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	plan, err := readImportPlan(planReader)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return s.importPlannedLibrary(lib, plan)
+}
+
+// importPlannedLibrary imports the tabs from a library as the plan says, as
+// described by ImportPlanned. If the plan itself is the problem, the error
+// has the invalid_import_plan code.
+func (s *Server) importPlannedLibrary(lib *library, plan *importPlan) (imported, skipped int, err error) {
+	exported := make(map[string]exportedTab, len(lib.Tabs))
+	for _, tab := range lib.Tabs {
+		exported[tab.Filename] = tab
+	}
+
+	var (
+		patterns = tokenizePatterns(s.Settings.FilenamePatterns)
+		targets  = make(map[string]bool)
+		tabs     []exportedTab
+	)
+
+	for _, planned := range plan.Tabs {
+		tab, ok := exported[planned.Filename]
+		if !ok {
+			return 0, 0, invalidImportPlan("%s: the tab isn't in the library", planned.Filename)
+		}
+
+		delete(exported, planned.Filename)
+
+		if planned.Skip {
+			skipped++
+			continue
+		}
+
+		s.planImport(planned, tab.Format, patterns, targets)
+
+		if len(planned.Problems) > 0 {
+			return 0, 0, invalidImportPlan("%s: %s", planned.Target, planned.Problems[0])
+		}
+
+		tab.Filename = planned.Target
+		tabs = append(tabs, tab)
+	}
+
+	skipped += len(exported)
+
+	added, existing, err := s.importTabs(tabs)
+	return added, skipped + existing, err
+}
@@ -0,0 +1,203 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxInferredPatterns is the most suggestions /api/v1/pattern/infer gives.
+const maxInferredPatterns = 10
+
+// inferSeparators are the pieces of text which commonly separate the parts
+// of a tab's filename, in the order they are preferred in. Longer ones come
+// first, so that " - " is tried before "-".
+var inferSeparators = []string{" - ", " – ", " — ", " by ", "_-_", "__", " _ ", "_", "-", ", "}
+
+// inferLayouts are the ways the parts of a filename can be arranged, which
+// are turned into patterns by putting a separator between the parts.
+var inferLayouts = [][]string{
+	{"[artist]", "[title]"},
+	{"[title]", "[artist]"},
+	{"[artist]", "[title]", "[tag]"},
+	{"[title]", "[artist]", "[tag]"},
+	{"[artist]", "[title]", "[tags]"},
+}
+
+// inferTagSuffixes are optional groups which are added to the end of the
+// two part layouts, for collections where some filenames end with a tag.
+var inferTagSuffixes = []string{
+	` ([tag])`,
+	` \[[tag]\]`,
+}
+
+// An inferredPattern is a suggested filename pattern, along with how much of
+// the tab directory it matches, and an example of how it parses a filename.
+type inferredPattern struct {
+	Pattern    string           `json:"pattern"`
+	Matched    int              `json:"matched"`
+	Percentage float64          `json:"percentage"`
+	Example    *inferredExample `json:"example,omitempty"`
+
+	// captures is how many values the pattern's variables captured from
+	// all of the filenames it matched, which is used to put the patterns
+	// which get the most out of the filenames first when they match just
+	// as many of them.
+	captures int
+}
+
+// An inferredExample shows how a suggested pattern parses the first
+// filename it matches.
+type inferredExample struct {
+	Filename string   `json:"filename"`
+	Title    string   `json:"title"`
+	Artist   string   `json:"artist"`
+	Tags     []string `json:"tags"`
+}
+
+// candidatePatterns returns the patterns which are worth trying on the
+// given filenames (without their folders or extensions), which are the
+// layouts joined by each of the separators found in any of them.
+func candidatePatterns(names []string) []string {
+	candidates := make([]string, 0)
+
+	for _, separator := range inferSeparators {
+		found := false
+		for _, name := range names {
+			if strings.Contains(name, separator) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			continue
+		}
+
+		// Separators which are also special in patterns are escaped.
+		escaped := strings.NewReplacer(`\`, `\\`, "[", `\[`, "(", `\(`).Replace(separator)
+
+		for _, layout := range inferLayouts {
+			pattern := strings.Join(layout, escaped)
+			candidates = append(candidates, pattern)
+
+			if len(layout) == 2 {
+				for _, suffix := range inferTagSuffixes {
+					candidates = append(candidates, pattern+"("+suffix+")?")
+				}
+			}
+		}
+	}
+
+	return candidates
+}
+
+// cleanCaptures reports whether none of the captured values are empty or
+// start or end with a space. If they do, the pattern has split the filename
+// in the wrong place, like "[artist]-[title]" splitting "Oasis - Wonderwall"
+// into "Oasis " and " Wonderwall", so it isn't counted as a match.
+func cleanCaptures(captures []patternCapture) bool {
+	for _, capture := range captures {
+		if capture.value == "" || strings.TrimSpace(capture.value) != capture.value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// inferPatterns suggests filename patterns for the given filenames, with the
+// ones which match the most of them first. Patterns which don't match any
+// are left out.
+func inferPatterns(filenames []string) []inferredPattern {
+	names := make([]string, len(filenames))
+	for i, filename := range filenames {
+		name := path.Base(filename)
+		names[i] = strings.TrimSuffix(name, path.Ext(name))
+	}
+
+	suggestions := make([]inferredPattern, 0)
+
+	for _, pattern := range candidatePatterns(names) {
+		matcher := compilePattern(tokenizePattern(pattern))
+		suggestion := inferredPattern{Pattern: pattern}
+
+		for i, name := range names {
+			// Only a match of the whole name counts, otherwise every
+			// pattern would match anything with its first separator.
+			captures, ok := matcher.match(name, true)
+			if !ok || !cleanCaptures(captures) {
+				continue
+			}
+
+			suggestion.Matched++
+			suggestion.captures += len(captures)
+
+			if suggestion.Example == nil {
+				title, artist, tags, _ := parseFilename(name, matcher)
+				suggestion.Example = &inferredExample{
+					Filename: filenames[i],
+					Title:    title,
+					Artist:   artist,
+					Tags:     tags,
+				}
+			}
+		}
+
+		if suggestion.Matched == 0 {
+			continue
+		}
+
+		suggestion.Percentage = 100 * float64(suggestion.Matched) / float64(len(names))
+		suggestions = append(suggestions, suggestion)
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if suggestions[i].Matched != suggestions[j].Matched {
+			return suggestions[i].Matched > suggestions[j].Matched
+		}
+
+		return suggestions[i].captures > suggestions[j].captures
+	})
+
+	if len(suggestions) > maxInferredPatterns {
+		suggestions = suggestions[:maxInferredPatterns]
+	}
+
+	return suggestions
+}
+
+// handleInferPatternAPI is called to respond to a HTTP request to
+// /api/v1/pattern/infer. It looks at the filenames in the tab directory and
+// responds with the suggested patterns, so that the admin can pick one
+// instead of writing it by hand. Only the admin can use it, since it shows
+// the names of files which might not match the current patterns.
+func (s *Server) handleInferPatternAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	filenames, err := s.tabFilenames()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(struct {
+		Files    int               `json:"files"`
+		Patterns []inferredPattern `json:"patterns"`
+	}{
+		Files:    len(filenames),
+		Patterns: inferPatterns(filenames),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
@@ -0,0 +1,370 @@
+package src
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Integrity snapshots catch the collection silently losing tabs, such as
+// when the disk holding the tab directory isn't mounted and the file watcher
+// sees every file disappear. Once a day, an integrity job counts the cached
+// tabs and the files in the tab directory, and compares each tab's content
+// hash with the ones from the last snapshot. If a lot more tabs or files have
+// gone, or changed, than would be expected from the admin's own changes, it
+// raises an alert: the integrity.alert event is published, the
+// integrity-alert hook is run and its payload is sent to the webhooks, signed
+// as described in webhook.go, and the alert is logged as an error.
+//
+// The store keeps the most recent snapshots, along with the content hashes
+// from the latest one, by the tabs' IDs. The snapshots can be fetched from
+// /api/v1/integrity, and a snapshot can be taken straight away by queueing
+// an integrity job. The latest snapshot's counts are also given as metrics
+// at /api/v1/integrity/metrics, in the Prometheus text format, so that
+// monitoring which is already scraping the server can alert on the deltas
+// too, with thresholds of its own.
+const (
+	// maxIntegritySnapshots is the number of snapshots which are kept.
+	maxIntegritySnapshots = 30
+
+	// integrityMinDelta is the fewest tabs or files which have to go, or
+	// change, for an alert to be raised, however small the collection is,
+	// so that deleting a couple of tabs from a small one doesn't count.
+	integrityMinDelta = 10
+
+	// defaultIntegrityThreshold is the percentage of the collection which
+	// has to go, or change, between two snapshots for an alert to be
+	// raised, if the config doesn't say.
+	defaultIntegrityThreshold = 10
+)
+
+// An IntegrityConfig says when the integrity snapshots are taken and how big
+// a change has to be to raise an alert.
+type IntegrityConfig struct {
+	// Time is the time of day, as HH:MM in the server's time zone, at
+	// which a snapshot is taken every day. If it is empty, they are only
+	// taken when an integrity job is queued by hand.
+	Time string
+
+	// Threshold is the percentage of the tabs or files in the previous
+	// snapshot which have to go, or change, to raise an alert. If it is 0,
+	// defaultIntegrityThreshold is used.
+	Threshold int
+}
+
+// An integritySnapshot is what was found by one integrity job, compared with
+// the snapshot before it.
+type integritySnapshot struct {
+	Time time.Time `json:"time"`
+
+	// Tabs is the number of cached tabs, and Files is the number of files
+	// in the tab directory. Hash is a hash of every tab's ID and content
+	// hash, which only stays the same if nothing has changed.
+	Tabs  int    `json:"tabs"`
+	Files int    `json:"files"`
+	Hash  string `json:"hash"`
+
+	// Added, Removed and Changed are the numbers of tabs which have been
+	// added, removed, or had their content changed since the previous
+	// snapshot.
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	Changed int `json:"changed"`
+
+	// Alerts describe anything unexpected about the changes. It is empty
+	// if everything looks fine.
+	Alerts []string `json:"alerts"`
+}
+
+// integrityTime parses the time of day in the config, returning the hour and
+// minute. ok is false if snapshots aren't taken at a particular time.
+func (c IntegrityConfig) integrityTime() (hour, minute int, ok bool, err error) {
+	if c.Time == "" {
+		return 0, 0, false, nil
+	}
+
+	parsed, err := time.Parse("15:04", c.Time)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("the integrity snapshot time must be HH:MM, such as 03:00, not %q", c.Time)
+	}
+
+	return parsed.Hour(), parsed.Minute(), true, nil
+}
+
+// nextIntegrityRun returns the next time after now at which a snapshot
+// should be taken.
+func nextIntegrityRun(now time.Time, hour, minute int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+
+	return next
+}
+
+// startIntegrityChecks queues an integrity job at the configured time every
+// day, until the server shuts down.
+func (s *Server) startIntegrityChecks() {
+	hour, minute, ok, err := s.Integrity.integrityTime()
+	if err != nil || !ok {
+		return
+	}
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+
+		stopping := s.background().Done()
+
+		for {
+			timer := time.NewTimer(time.Until(nextIntegrityRun(time.Now(), hour, minute)))
+
+			select {
+			case <-stopping:
+				timer.Stop()
+				return
+
+			case <-timer.C:
+				if _, err := s.enqueueJob("integrity"); err != nil {
+					s.logMessage("error", "warning: failed to queue the integrity snapshot: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// integrityHash returns a hash of the tabs' IDs and content hashes, which
+// doesn't depend on the order of the hashes.
+func integrityHash(hashes map[string]string) string {
+	ids := make([]string, 0, len(hashes))
+	for id := range hashes {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	sum := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintf(sum, "%s:%s\n", id, hashes[id])
+	}
+
+	return fmt.Sprintf("%x", sum.Sum(nil))
+}
+
+// integrityLimit returns how many tabs or files out of the previous count
+// have to go, or change, to raise an alert.
+func (s *Server) integrityLimit(previous int) int {
+	threshold := s.Integrity.Threshold
+	if threshold <= 0 {
+		threshold = defaultIntegrityThreshold
+	}
+
+	limit := previous * threshold / 100
+	if limit < integrityMinDelta {
+		limit = integrityMinDelta
+	}
+
+	return limit
+}
+
+// latestIntegritySnapshot returns the most recent snapshot. The second return
+// value is false if none have been taken yet.
+func (s *Server) latestIntegritySnapshot() (*integritySnapshot, bool, error) {
+	snapshots, err := s.integritySnapshots(1)
+	if err != nil || len(snapshots) == 0 {
+		return nil, false, err
+	}
+
+	return snapshots[0], true, nil
+}
+
+// integritySnapshots returns up to the given number of the most recent
+// snapshots, newest first.
+func (s *Server) integritySnapshots(count int) ([]*integritySnapshot, error) {
+	return s.Store.IntegritySnapshots(count)
+}
+
+// takeIntegritySnapshot counts the tabs and files, compares them with the
+// previous snapshot, and stores the new snapshot. Any alerts are raised on
+// behalf of the given actor before it is returned.
+func (s *Server) takeIntegritySnapshot(by actor) (*integritySnapshot, error) {
+	previous, hasPrevious, err := s.latestIntegritySnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	oldHashes, err := s.Store.IntegrityHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	tabs, err := s.Store.GetTabs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string, len(tabs))
+	for _, tab := range tabs {
+		hashes[tab.ID] = tab.ContentHash
+	}
+
+	snapshot := &integritySnapshot{
+		Time:   time.Now(),
+		Tabs:   len(tabs),
+		Hash:   integrityHash(hashes),
+		Alerts: make([]string, 0),
+	}
+
+	// A tab directory which can't be read at all is the most likely cause
+	// of tabs disappearing, so it is an alert in itself.
+	filenames, err := s.tabFilenames()
+	if err != nil {
+		snapshot.Alerts = append(snapshot.Alerts, fmt.Sprintf("The tab directory can't be read: %s", err))
+	}
+
+	snapshot.Files = len(filenames)
+
+	for id, hash := range hashes {
+		if oldHash, ok := oldHashes[id]; !ok {
+			snapshot.Added++
+		} else if oldHash != hash {
+			snapshot.Changed++
+		}
+	}
+
+	for id := range oldHashes {
+		if _, ok := hashes[id]; !ok {
+			snapshot.Removed++
+		}
+	}
+
+	// Nothing can have gone unexpectedly before the first snapshot, which
+	// everything is counted as added in.
+	if hasPrevious {
+		tabLimit := s.integrityLimit(previous.Tabs)
+
+		if snapshot.Removed >= tabLimit {
+			snapshot.Alerts = append(snapshot.Alerts, fmt.Sprintf("%d of the %d tabs have disappeared since the last snapshot", snapshot.Removed, previous.Tabs))
+		}
+
+		if snapshot.Changed >= tabLimit {
+			snapshot.Alerts = append(snapshot.Alerts, fmt.Sprintf("%d of the %d tabs have changed since the last snapshot", snapshot.Changed, previous.Tabs))
+		}
+
+		if lost := previous.Files - snapshot.Files; lost >= s.integrityLimit(previous.Files) {
+			snapshot.Alerts = append(snapshot.Alerts, fmt.Sprintf("%d of the %d files in the tab directory have disappeared since the last snapshot", lost, previous.Files))
+		}
+	}
+
+	if err := s.Store.AddIntegritySnapshot(snapshot, hashes, maxIntegritySnapshots); err != nil {
+		return nil, err
+	}
+
+	if len(snapshot.Alerts) > 0 {
+		s.raiseIntegrityAlert(snapshot, by)
+	}
+
+	return snapshot, nil
+}
+
+// raiseIntegrityAlert tells the admin about a snapshot with alerts, in every
+// way the server can: the console and log tail, the event log, and the
+// integrity-alert hook and the webhooks.
+func (s *Server) raiseIntegrityAlert(snapshot *integritySnapshot, by actor) {
+	for _, alert := range snapshot.Alerts {
+		s.logMessage("error", "integrity alert: %s", alert)
+	}
+
+	s.publishEvent(eventIntegrityAlert, by, snapshot)
+	s.queueHook(hookIntegrityAlert, map[string]interface{}{
+		"actor":    s.record(by),
+		"snapshot": snapshot,
+	})
+}
+
+// runIntegrity is the runner for integrity jobs, which take a snapshot.
+func (s *Server) runIntegrity(ctx context.Context, j *job) error {
+	snapshot, err := s.takeIntegritySnapshot(jobActor(j))
+	if err != nil {
+		return err
+	}
+
+	return s.setJobProgress(j, snapshot.Tabs, snapshot.Tabs)
+}
+
+// handleIntegrityAPI is called to respond to a HTTP request to
+// /api/v1/integrity. It responds with the integrity snapshots which have been
+// kept, newest first, encoded in JSON.
+func (s *Server) handleIntegrityAPI(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := s.integritySnapshots(maxIntegritySnapshots)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+// integrityMetrics are the metrics given for the latest snapshot, with their
+// help text and the value from the snapshot.
+var integrityMetrics = []struct {
+	name, help string
+	value      func(snapshot *integritySnapshot) float64
+}{
+	{"tab_server_integrity_snapshot_timestamp_seconds", "The Unix time the latest integrity snapshot was taken at.", func(snapshot *integritySnapshot) float64 { return float64(snapshot.Time.UnixNano()) / 1e9 }},
+	{"tab_server_integrity_tabs", "The number of cached tabs in the latest integrity snapshot.", func(snapshot *integritySnapshot) float64 { return float64(snapshot.Tabs) }},
+	{"tab_server_integrity_files", "The number of files in the tab directory in the latest integrity snapshot.", func(snapshot *integritySnapshot) float64 { return float64(snapshot.Files) }},
+	{"tab_server_integrity_added", "The number of tabs added since the snapshot before the latest one.", func(snapshot *integritySnapshot) float64 { return float64(snapshot.Added) }},
+	{"tab_server_integrity_removed", "The number of tabs removed since the snapshot before the latest one.", func(snapshot *integritySnapshot) float64 { return float64(snapshot.Removed) }},
+	{"tab_server_integrity_changed", "The number of tabs changed since the snapshot before the latest one.", func(snapshot *integritySnapshot) float64 { return float64(snapshot.Changed) }},
+	{"tab_server_integrity_alerts", "The number of alerts raised by the latest integrity snapshot.", func(snapshot *integritySnapshot) float64 { return float64(len(snapshot.Alerts)) }},
+}
+
+// writeIntegrityMetrics writes the latest snapshot's metrics as gauges, in the
+// Prometheus text format. If there isn't a snapshot yet, only the help text
+// and types are written, so that there are no values to be mistaken for an
+// empty collection.
+func writeIntegrityMetrics(w io.Writer, snapshot *integritySnapshot) error {
+	for _, metric := range integrityMetrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name); err != nil {
+			return err
+		}
+
+		if snapshot == nil {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, "%s %g\n", metric.name, metric.value(snapshot)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleIntegrityMetricsAPI is called to respond to a HTTP request to
+// /api/v1/integrity/metrics. It responds with the latest snapshot's counts,
+// in the Prometheus text format.
+func (s *Server) handleIntegrityMetricsAPI(w http.ResponseWriter, r *http.Request) {
+	snapshot, _, err := s.latestIntegritySnapshot()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeIntegrityMetrics(w, snapshot)
+}
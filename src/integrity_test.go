@@ -0,0 +1,55 @@
+package src
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteIntegrityMetrics(t *testing.T) {
+	snapshot := &integritySnapshot{
+		Time:    time.Unix(1700000000, 0),
+		Tabs:    120,
+		Files:   118,
+		Added:   2,
+		Removed: 40,
+		Changed: 1,
+		Alerts:  []string{"40 of the 158 tabs have disappeared since the last snapshot"},
+	}
+
+	var out bytes.Buffer
+	if err := writeIntegrityMetrics(&out, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"# TYPE tab_server_integrity_removed gauge",
+		"tab_server_integrity_snapshot_timestamp_seconds 1.7e+09",
+		"tab_server_integrity_tabs 120",
+		"tab_server_integrity_files 118",
+		"tab_server_integrity_added 2",
+		"tab_server_integrity_removed 40",
+		"tab_server_integrity_changed 1",
+		"tab_server_integrity_alerts 1",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected %q in the metrics, got:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestWriteIntegrityMetricsWithoutSnapshot(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeIntegrityMetrics(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the help text and types are given, not values of 0 which would
+	// look like every tab had gone.
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if !strings.HasPrefix(line, "# ") {
+			t.Errorf("expected no values without a snapshot, got %q", line)
+		}
+	}
+}
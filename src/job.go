@@ -0,0 +1,443 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxJobHistory is the number of job records which are kept. When a new
+// job is created, the oldest records past this limit are removed.
+const maxJobHistory = 100
+
+// jobWorkers is the number of background jobs which can run at once.
+const jobWorkers = 2
+
+// The statuses which a job can have. A job starts off queued, and finishes
+// as either done, failed, or cancelled.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// A jobRunner carries out a particular kind of background job. It should
+// report its progress with setJobProgress and check the context regularly,
+// stopping early with the context's error once it has been cancelled.
+type jobRunner func(s *Server, ctx context.Context, j *job) error
+
+// jobKinds maps the name of each kind of background job to the function
+// which carries it out. Features which need to do long-running work in the
+// background add a kind here rather than starting their own goroutines.
+var jobKinds = map[string]jobRunner{
+	"rescan":    (*Server).runRescan,
+	"integrity": (*Server).runIntegrity,
+}
+
+// A job is a record of a single run of an import, rescan or other
+// long-running task, which is kept so that admins can see its progress
+// while it is running and what happened during it afterwards.
+type job struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"`
+	Status  string    `json:"status"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Done    int       `json:"done"`
+	Total   int       `json:"total"`
+	Added   int       `json:"added"`
+	Updated int       `json:"updated"`
+	Skipped int       `json:"skipped"`
+	Errors  []string  `json:"errors"`
+
+	// CancelRequested is true once the admin has asked for the job to be
+	// cancelled, even if it hasn't stopped yet.
+	CancelRequested bool `json:"cancelRequested"`
+}
+
+// newJob creates a new job record of the given kind, starting now.
+func newJob(kind string) *job {
+	return &job{
+		Kind:   kind,
+		Status: jobRunning,
+		Start:  time.Now(),
+		Errors: make([]string, 0),
+	}
+}
+
+// failJob adds an error message to the job's record, formatted like
+// fmt.Sprintf, and also logs it.
+func (s *Server) failJob(j *job, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	s.logMessage("error", "%s", message)
+	j.Errors = append(j.Errors, message)
+}
+
+// reserveJobID assigns the job the next job ID, without storing it yet.
+func (s *Server) reserveJobID(j *job) error {
+	id, err := s.Store.NextID(counterJobs)
+	if err != nil {
+		return err
+	}
+
+	j.ID = id
+	return nil
+}
+
+// createJob assigns the job the next job ID, unless one has already been
+// reserved for it, and stores it as the most recent job. Only the
+// maxJobHistory most recent jobs are kept.
+func (s *Server) createJob(j *job) error {
+	if j.ID == "" {
+		if err := s.reserveJobID(j); err != nil {
+			return err
+		}
+	}
+
+	return s.Store.CreateJob(j, maxJobHistory)
+}
+
+// updateJob stores the job's current state. The cancel request flag isn't
+// stored, since it is only ever set by cancelJob.
+func (s *Server) updateJob(j *job) error {
+	return s.Store.UpdateJob(j)
+}
+
+// saveJob finishes a job which was run straight away rather than through
+// the queue, such as an import while fetching the tabs, and stores it.
+func (s *Server) saveJob(j *job) error {
+	j.End = time.Now()
+	j.Status = jobDone
+
+	return s.createJob(j)
+}
+
+// fetchJob finds the job with the given ID. If it doesn't exist, the second
+// return value will be false.
+func (s *Server) fetchJob(id string) (*job, bool, error) {
+	return s.Store.Job(id)
+}
+
+// listJobs returns the records of all the jobs which are still kept, with
+// the most recent first.
+func (s *Server) listJobs() ([]*job, error) {
+	return s.Store.Jobs()
+}
+
+// enqueueJob creates a new job of the given kind and adds it to the end of
+// the queue, where it will be picked up by the next free worker.
+func (s *Server) enqueueJob(kind string) (*job, error) {
+	if _, ok := jobKinds[kind]; !ok {
+		return nil, fmt.Errorf("unknown job kind: %s", kind)
+	}
+
+	j := newJob(kind)
+	j.Status = jobQueued
+
+	if err := s.createJob(j); err != nil {
+		return nil, err
+	}
+
+	if err := s.Store.QueueJob(j.ID); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// setJobProgress records how far through a running job is, so it can be
+// shown to the admin while they wait.
+func (s *Server) setJobProgress(j *job, done, total int) error {
+	j.Done = done
+	j.Total = total
+
+	return s.Store.SetJobProgress(j.ID, done, total)
+}
+
+// cancelJob asks for the job with the given ID to be cancelled. A queued job
+// is cancelled before it starts, and a running job has its context cancelled
+// so it stops at the next opportunity. If the job doesn't exist or has
+// already finished, an error and error status will be returned.
+func (s *Server) cancelJob(id string) (int, error) {
+	j, ok, err := s.fetchJob(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !ok {
+		return http.StatusNotFound, errJobNotFound
+	}
+
+	if j.Status != jobQueued && j.Status != jobRunning {
+		return http.StatusConflict, fmt.Errorf("the job has already finished (%s)", j.Status)
+	}
+
+	if err := s.Store.RequestJobCancel(id); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// If the job is running, cancel its context. Otherwise, the flag which
+	// was just set will stop it from starting.
+	s.runningJobsLock.Lock()
+	defer s.runningJobsLock.Unlock()
+
+	if cancel, running := s.runningJobs[id]; running {
+		cancel()
+	}
+
+	return http.StatusOK, nil
+}
+
+// startJobWorkers starts the goroutines which take jobs off the queue and
+// run them.
+func (s *Server) startJobWorkers() {
+	for i := 0; i < jobWorkers; i++ {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.jobWorker()
+		}()
+	}
+}
+
+// jobWorker takes jobs off the front of the queue one at a time and runs
+// them, until the server shuts down.
+func (s *Server) jobWorker() {
+	stopping := s.background().Done()
+
+	for {
+		select {
+		case <-stopping:
+			return
+		default:
+		}
+
+		// The store waits for up to the timeout for a job to be queued, so
+		// workers don't have to keep polling it.
+		id, ok, err := s.Store.NextQueuedJob(5 * time.Second)
+		if err != nil {
+			s.logMessage("warn", "warning: failed to take a job off the queue: %s", err)
+
+			select {
+			case <-stopping:
+			case <-time.After(5 * time.Second):
+			}
+
+			continue
+		} else if !ok {
+			continue
+		}
+
+		if err := s.runJob(id); err != nil {
+			s.logMessage("error", "warning: job %s could not be run: %s", id, err)
+		}
+	}
+}
+
+// runJob runs the queued job with the given ID, recording its outcome.
+func (s *Server) runJob(id string) error {
+	j, ok, err := s.fetchJob(id)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("the job's record no longer exists")
+	}
+
+	run, ok := jobKinds[j.Kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind: %s", j.Kind)
+	}
+
+	// A job which was cancelled while it was still in the queue is never
+	// started at all.
+	if j.CancelRequested {
+		j.Status = jobCancelled
+		j.End = time.Now()
+		return s.finishJob(j)
+	}
+
+	j.Status = jobRunning
+	j.Start = time.Now()
+	if err := s.updateJob(j); err != nil {
+		return err
+	}
+
+	// Give the job a context which cancelJob can cancel, by keeping its
+	// cancel function in the map of running jobs until it has finished.
+	// It is also cancelled if the server shuts down.
+	ctx, cancel := context.WithCancel(s.background())
+
+	s.runningJobsLock.Lock()
+	if s.runningJobs == nil {
+		s.runningJobs = make(map[string]context.CancelFunc)
+	}
+	s.runningJobs[j.ID] = cancel
+	s.runningJobsLock.Unlock()
+
+	defer func() {
+		s.runningJobsLock.Lock()
+		delete(s.runningJobs, j.ID)
+		s.runningJobsLock.Unlock()
+
+		cancel()
+	}()
+
+	err = run(s, ctx, j)
+
+	switch {
+	case ctx.Err() != nil:
+		j.Status = jobCancelled
+	case err != nil:
+		s.failJob(j, "The job failed: %s", err)
+		j.Status = jobFailed
+	default:
+		j.Status = jobDone
+	}
+
+	j.End = time.Now()
+
+	return s.finishJob(j)
+}
+
+// finishJob saves the record of a job which has finished, and publishes an
+// event saying so.
+func (s *Server) finishJob(j *job) error {
+	if err := s.updateJob(j); err != nil {
+		return err
+	}
+
+	s.publishEvent(eventJobFinished, jobActor(j), map[string]string{
+		"id":     j.ID,
+		"kind":   j.Kind,
+		"status": j.Status,
+	})
+
+	return nil
+}
+
+// runRescan is the runner for rescan jobs. It goes through every file in
+// the tab directory and brings the cache up to date with it, in the same
+// way as the file watcher does when it notices a change, and then removes
+// any cached tabs whose files have gone.
+func (s *Server) runRescan(ctx context.Context, j *job) error {
+	filenames, err := s.tabFilenames()
+	if err != nil {
+		return err
+	}
+
+	for index, filename := range filenames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := s.syncFile(filename, jobActor(j)); err != nil {
+			s.failJob(j, "The file %s could not be rescanned: %s", filename, err)
+		}
+
+		if err := s.setJobProgress(j, index+1, len(filenames)); err != nil {
+			return err
+		}
+	}
+
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	_, err = s.pruneOrphans(filenames, jobActor(j))
+	return err
+}
+
+// handleJobsAPI is called to respond to a HTTP request to /api/v1/jobs. A GET
+// request responds with the list of recent jobs, encoded in JSON, and a POST
+// request queues a new job of the kind given in the 'kind' form value and
+// responds with its record. Only the admin can see or start jobs.
+func (s *Server) handleJobsAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.authenticate(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	var result interface{}
+
+	switch r.Method {
+	case "GET":
+		jobs, err := s.listJobs()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		result = jobs
+
+	case "POST":
+		j, err := s.enqueueJob(r.PostFormValue("kind"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result = j
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET and POST are supported"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleJobAPI is called to respond to a HTTP request to /api/v1/jobs/{id}. A
+// GET request responds with the full record of a single job, including its
+// status and progress, encoded in JSON. A DELETE request cancels the job, in
+// the same way as /api/v1/jobs/{id}/cancel.
+func (s *Server) handleJobAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		s.handleCancelJobAPI(w, r)
+		return
+	}
+
+	if status, err := s.authenticate(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	j, ok, err := s.fetchJob(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errJobNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
+
+// handleCancelJobAPI is called to respond to a HTTP request to
+// /api/v1/jobs/{id}/cancel, or a DELETE request to /api/v1/jobs/{id}. It asks
+// for the job to be cancelled, which a running job will notice the next time
+// it checks its context.
+func (s *Server) handleCancelJobAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only POST and DELETE are supported"))
+		return
+	}
+
+	if status, err := s.authenticate(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if status, err := s.cancelJob(mux.Vars(r)["id"]); err != nil {
+		writeError(w, status, err)
+		return
+	}
+}
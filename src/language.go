@@ -0,0 +1,122 @@
+package src
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// languageStopwords holds some of the most common words in each of the
+// languages which can be detected, keyed by ISO 639-1 code. Words which are
+// also chord names, like the Italian 'e', are left out, since chords are all
+// over the place in tabs.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "you", "that", "it", "is", "me", "my", "to", "of", "in", "your", "i'm", "don't", "all", "love", "what", "this", "with", "be"},
+	"es": {"el", "la", "que", "de", "y", "en", "los", "las", "por", "con", "una", "mi", "tu", "te", "yo", "es", "del", "pero", "amor", "como"},
+	"fr": {"le", "la", "les", "et", "je", "tu", "de", "des", "que", "qui", "est", "pas", "dans", "une", "mon", "ma", "pour", "sur", "moi", "toi"},
+	"de": {"der", "die", "das", "und", "ich", "du", "nicht", "ist", "ein", "eine", "mit", "mich", "dich", "mein", "dein", "wir", "auf", "zu", "sie", "es"},
+	"it": {"il", "la", "che", "di", "è", "non", "per", "un", "una", "mi", "ti", "io", "sei", "del", "con", "sono", "della", "ma", "amore", "come"},
+	"pt": {"os", "que", "de", "é", "não", "um", "uma", "eu", "você", "meu", "minha", "com", "para", "do", "da", "as", "se", "mais", "te", "amor"},
+	"nl": {"de", "het", "een", "en", "ik", "je", "niet", "van", "dat", "is", "mijn", "jij", "wat", "met", "op", "voor", "zijn", "maar", "ook", "naar"},
+}
+
+// sentenceCaseLanguages are the languages in which titles are written in
+// sentence case, with only the first word capitalised, rather than in title
+// case like in English.
+var sentenceCaseLanguages = map[string]bool{
+	"es": true,
+	"fr": true,
+	"it": true,
+	"pt": true,
+	"nl": true,
+}
+
+// minLanguageHits is the smallest number of stopwords which have to be found
+// before a language is detected. Tabs with fewer than this usually don't have
+// any lyrics at all.
+const minLanguageHits = 5
+
+// chordPattern matches chord symbols such as "Am", "F#m7", "G/B", "Cadd9" and
+// "Am7b5".
+var chordPattern = regexp.MustCompile(`^[A-G][#b]?(m|maj|min|dim|aug|sus|add)?[0-9]*((sus|add|b|#)[0-9]+)*(/[A-G][#b]?)?$`)
+
+// lyricLine reports whether a line of a tab looks like it has lyrics in it,
+// rather than being a line of chords or a line of tablature.
+func lyricLine(line string) bool {
+	if strings.Contains(line, "--") || strings.Contains(line, "|") {
+		return false
+	}
+
+	fields := strings.Fields(line)
+	for _, field := range fields {
+		if !chordPattern.MatchString(field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// detectLanguage works out which language the lyrics in a tab's content are
+// in, by counting how many of each language's stopwords appear in it. The
+// ISO 639-1 code of the language is returned, or an empty string if there
+// weren't enough lyrics to tell.
+func detectLanguage(content string) string {
+	hits := make(map[string]int)
+
+	// Put every language's stopwords into one map from each word to the
+	// languages it is a stopword in, so each word of the lyrics only has to
+	// be looked up once.
+	stopwords := make(map[string][]string)
+	for lang, words := range languageStopwords {
+		for _, word := range words {
+			stopwords[word] = append(stopwords[word], lang)
+		}
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if !lyricLine(line) {
+			continue
+		}
+
+		words := strings.FieldsFunc(strings.ToLower(line), func(r rune) bool {
+			return !unicode.IsLetter(r) && r != '\''
+		})
+
+		for _, word := range words {
+			for _, lang := range stopwords[word] {
+				hits[lang]++
+			}
+		}
+	}
+
+	// Find the language with the most hits. If two languages are tied, it
+	// is too close to call.
+	best, bestHits, tied := "", 0, false
+	for lang, count := range hits {
+		switch {
+		case count > bestHits:
+			best, bestHits, tied = lang, count, false
+		case count == bestHits:
+			tied = true
+		}
+	}
+
+	if bestHits < minLanguageHits || tied {
+		return ""
+	}
+
+	return best
+}
+
+// sentenceCase capitalises the first letter of str, leaving the rest of it
+// as it is.
+func sentenceCase(str string) string {
+	first, size := utf8.DecodeRuneInString(str)
+	if size == 0 {
+		return str
+	}
+
+	return string(unicode.ToUpper(first)) + str[size:]
+}
@@ -0,0 +1,34 @@
+package src
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	cases := []struct {
+		name, content, lang string
+	}{
+		{"english", "Am              G\nI love you and you love me\nC\nThat is all the world to me", "en"},
+		{"spanish", "[Am]Yo te quiero y tu me quieres\nPero el amor es como la luna", "es"},
+		{"french", "Je suis dans la rue et tu es pas là\nMoi et toi pour toujours", "fr"},
+		{"german", "Ich liebe dich und du liebst mich nicht\nDas ist mein Lied", "de"},
+
+		// Lines of chords and tablature aren't lyrics, even where chords
+		// like "Em" and "D" look like words.
+		{"chords", "Em  D  C  G\nAm  G  D/F#  Em\nC  G  D  Em", ""},
+		{"tablature", "e|--the--and--you--|\nB|--the--and--you--|\nG|--that--it--is--|", ""},
+
+		// A few words aren't enough to tell.
+		{"too few words", "I love you", ""},
+
+		// Words which are stopwords in more than one language don't decide
+		// it either way.
+		{"tied", "que de que de que de", ""},
+
+		{"empty", "", ""},
+	}
+
+	for _, c := range cases {
+		if lang := detectLanguage(c.content); lang != c.lang {
+			t.Errorf("%s: expected %q, got %q", c.name, c.lang, lang)
+		}
+	}
+}
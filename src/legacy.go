@@ -0,0 +1,119 @@
+package src
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// The first version of the API named the fields of its JSON inconsistently:
+// a tab's ID was "ID" while its other fields were camelCase, and the
+// settings were kebab-case. Version 1 uses camelCase throughout, but the
+// deprecated paths straight under /api still respond in the old shapes, so
+// that the clients which haven't moved to /api/v1 yet keep working. Rather
+// than every handler knowing about both, the responses to those paths are
+// rewritten on the way out.
+
+// legacySettingsFields maps the settings' JSON fields to their old names.
+// The password hash isn't sent by either version.
+var legacySettingsFields = map[string]string{
+	"tabDirectory":           "tab-directory",
+	"filenamePatterns":       "filename-patterns",
+	"nonCapitalWords":        "non-capital-words",
+	"charactersToRemove":     "characters-to-remove",
+	"scanDepth":              "scan-depth",
+	"folderMetadata":         "folder-metadata",
+	"ignorePatterns":         "ignore-patterns",
+	"hideExplicit":           "hide-explicit",
+	"tabCacheTTL":            "tab-cache-ttl",
+	"serveStale":             "serve-stale",
+	"transformScript":        "transform-script",
+	"transformScriptTimeout": "transform-script-timeout",
+	"autoTagRules":           "auto-tag-rules",
+	"publicMode":             "public-mode",
+	"allowedLicenses":        "allowed-licenses",
+	"openMic":                "open-mic",
+	"accessMode":             "access-mode",
+	"trashDays":              "trash-days",
+}
+
+// legacySettingsPaths are the deprecated paths which respond with the
+// settings, which are the only responses whose fields were kebab-case.
+var legacySettingsPaths = map[string]bool{
+	"/api/settings": true,
+}
+
+// legacyRawPaths are the deprecated paths whose responses are sent as they
+// are. An export is restored by /api/v1/import, which only understands the
+// current shape, and the downloads are files rather than API responses.
+// Either can be large, so they shouldn't be held back in memory anyway.
+var legacyRawPaths = map[string]bool{
+	"/api/export":                true,
+	"/api/download/{id}":         true,
+	"/api/tab/{id}/file":         true,
+	"/api/tab/{id}/download":     true,
+	"/api/tab/{id}/musicxml":     true,
+	"/api/recordings/{id}/audio": true,
+}
+
+// legacyShape rewrites a decoded JSON value into its old shape. Tabs are
+// recognised by their content hashes, which every tab and list of hashes
+// has. If settings is true, the value is the settings, whose fields are given
+// their old names too.
+func legacyShape(value interface{}, settings bool) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i, element := range v {
+			v[i] = legacyShape(element, false)
+		}
+
+	case map[string]interface{}:
+		for key, element := range v {
+			v[key] = legacyShape(element, false)
+		}
+
+		if _, ok := v["contentHash"]; ok {
+			if id, ok := v["id"]; ok {
+				delete(v, "id")
+				v["ID"] = id
+			}
+		}
+
+		if settings {
+			for field, old := range legacySettingsFields {
+				if setting, ok := v[field]; ok {
+					delete(v, field)
+					v[old] = setting
+				}
+			}
+		}
+	}
+
+	return value
+}
+
+// legacyShapes is middleware for the router which rewrites the JSON responses
+// to the deprecated API paths into the shapes they had before version 1,
+// other than the ones to legacyRawPaths.
+func legacyShapes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var template string
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ = route.GetPathTemplate()
+		}
+
+		if legacyRawPaths[template] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		settings := legacySettingsPaths[template]
+
+		rw := &jsonRewriter{ResponseWriter: w, rewrite: func(status int, value interface{}) interface{} {
+			return legacyShape(value, settings)
+		}}
+		defer rw.close()
+
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,117 @@
+package src
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Public mode is for collections which are open to anyone, but which should
+// only show them the tabs which are known to be allowed to be shared, so
+// that an archive can be semi-public without hosting tabs which might have
+// to be taken down. Each tab can be given a license, such as "CC-BY-4.0",
+// as part of its source, and when public mode is on, the tabs whose
+// licenses aren't in the settings' allowed licenses are hidden from anyone
+// who isn't logged in, in the same way as explicit tabs are. Tabs without a
+// license are always hidden in public mode.
+
+// restrictsLicenses reports whether only the tabs with an allowed license
+// should be included in the response to the request, which is the case in
+// public mode unless the request is from someone who is logged in or has an
+// API token.
+func (s *Server) restrictsLicenses(r *http.Request) bool {
+	if !s.Settings.PublicMode {
+		return false
+	}
+
+	_, err := s.authenticate(r)
+	return err != nil
+}
+
+// hidesTab reports whether the tab should be left out of the response to the
+// request, either because it's explicit and they can't see explicit tabs, or
+// because it doesn't have an allowed license in public mode.
+func (s *Server) hidesTab(r *http.Request, tab *Tab) bool {
+	if tab.Explicit && !s.showsExplicit(r) {
+		return true
+	}
+
+	return s.restrictsLicenses(r) && !s.allowsLicense(tab)
+}
+
+// allowsLicense reports whether the tab's license is one of the allowed
+// licenses, ignoring case.
+func (s *Server) allowsLicense(tab *Tab) bool {
+	license := strings.TrimSpace(tab.Source.License)
+	if license == "" {
+		return false
+	}
+
+	for _, allowed := range s.Settings.AllowedLicenses {
+		if strings.EqualFold(license, strings.TrimSpace(allowed)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterLicensed returns the tabs which have an allowed license.
+func (s *Server) filterLicensed(tabs []*Tab) []*Tab {
+	filtered := make([]*Tab, 0, len(tabs))
+
+	for _, tab := range tabs {
+		if s.allowsLicense(tab) {
+			filtered = append(filtered, tab)
+		}
+	}
+
+	return filtered
+}
+
+// setTabLicense changes the license of the source of the tab with the given
+// ID, on behalf of the given actor. An empty license means that it isn't
+// known. If there is an error, the HTTP status which it should be reported
+// with is returned along with it.
+func (s *Server) setTabLicense(id, license string, by actor) (int, error) {
+	tab, exists, err := s.Store.GetTab(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !exists {
+		return http.StatusNotFound, errTabNotFound
+	}
+
+	tab.Source.License = strings.TrimSpace(license)
+
+	if err := s.Store.SetSource(id, tab.Source); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if err := s.bumpCollectionVersion(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	s.publishEvent(eventTabUpdated, by, tabEventData(tab))
+
+	return http.StatusOK, nil
+}
+
+// handleSetLicenseAPI is called to respond to a HTTP request to
+// /api/v1/set-license. It sets the license of the tab with the ID in the 'id'
+// form value to the 'license' form value, which can be empty to forget it.
+// It will only accept POST requests from a logged in admin.
+func (s *Server) handleSetLicenseAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if status, err := s.checkEditLock(r, r.PostFormValue("id")); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if status, err := s.setTabLicense(r.PostFormValue("id"), r.PostFormValue("license"), s.requestActor(r)); err != nil {
+		writeError(w, status, err)
+		return
+	}
+}
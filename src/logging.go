@@ -0,0 +1,263 @@
+package src
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every request is logged as a single line, either as a JSON object or in
+// logfmt, with these fields:
+//
+//	time        when the request finished, in RFC 3339 format
+//	level       debug, info, warn or error, depending on the response
+//	request_id  the request's ID, which is also sent back in the
+//	            X-Request-ID header
+//	method      the request's method
+//	path        the request's path, without the query
+//	status      the status of the response
+//	latency_ms  how long the response took, in milliseconds
+//	ip          the IP address which the request came from
+//
+// Requests for static files are logged as debug, responses with a 4xx
+// status as warn, ones with a 5xx status as error, and everything else as
+// info. Only the requests at or above the configured level are logged.
+
+// These are the formats which requests can be logged in.
+const (
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+)
+
+// logLevels maps each level, and "none", which turns logging off, to how
+// severe it is.
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+	"none":  4,
+}
+
+// A LogConfig says how requests are logged.
+type LogConfig struct {
+	// Format is either "json" or "logfmt". If it is empty, "logfmt" is
+	// used.
+	Format string
+
+	// Level is the least severe level which is logged. If it is empty,
+	// "info" is used.
+	Level string
+
+	// Output is where the log is written to. If it is nil, the standard
+	// error is used.
+	Output io.Writer
+}
+
+// requestLogger writes log lines for requests to the output. writeLock is
+// held while a line is being written, so that lines from requests which
+// finish at the same time don't get mixed up.
+type requestLogger struct {
+	format    string
+	level     int
+	output    io.Writer
+	writeLock sync.Mutex
+}
+
+// newRequestLogger checks the logging config, returning a logger which uses
+// it if it is valid.
+func newRequestLogger(config LogConfig) (*requestLogger, error) {
+	logger := &requestLogger{
+		format: config.Format,
+		output: config.Output,
+	}
+
+	switch logger.format {
+	case "":
+		logger.format = logFormatLogfmt
+	case logFormatJSON, logFormatLogfmt:
+	default:
+		return nil, fmt.Errorf("unknown log format %q: it must be json or logfmt", config.Format)
+	}
+
+	level := config.Level
+	if level == "" {
+		level = "info"
+	}
+
+	var ok bool
+	if logger.level, ok = logLevels[level]; !ok {
+		return nil, fmt.Errorf("unknown log level %q: it must be debug, info, warn, error or none", config.Level)
+	}
+
+	if logger.output == nil {
+		logger.output = os.Stderr
+	}
+
+	return logger, nil
+}
+
+// A loggedRequest holds the fields which are logged for a request, in the
+// order they are written in.
+type loggedRequest struct {
+	Time      string  `json:"time"`
+	Level     string  `json:"level"`
+	RequestID string  `json:"request_id"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	IP        string  `json:"ip"`
+}
+
+// statusRecorder wraps a ResponseWriter to remember the status which was
+// written, which is 200 if the handler never wrote one explicitly.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader remembers the status before writing it.
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write remembers that the status is 200, if nothing was written yet.
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes on, so that responses which are streamed, such as
+// exports, still work.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes hijacking on, so that connections can still be taken over.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the connection can't be hijacked")
+	}
+
+	return hijacker.Hijack()
+}
+
+// logRequests is middleware for the router which logs each request once its
+// response has been written. Each request is given an ID, unless it came
+// with one in the X-Request-ID header, such as from a proxy, so that it can
+// be matched up with the proxy's logs.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id, _ = randomHex(8)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		logged := loggedRequest{
+			Time:      time.Now().Format(time.RFC3339Nano),
+			Level:     requestLevel(r, recorder.status),
+			RequestID: id,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    recorder.status,
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			IP:        clientIP(r),
+		}
+
+		s.logger.log(logged)
+		s.logRequestEntry(logged)
+	})
+}
+
+// requestLevel returns the level which a request is logged at.
+func requestLevel(r *http.Request, status int) string {
+	switch {
+	case status >= 500:
+		return "error"
+	case status >= 400:
+		return "warn"
+	case strings.HasPrefix(r.URL.Path, "/static/"):
+		return "debug"
+	default:
+		return "info"
+	}
+}
+
+// log writes a line for the request, if its level is logged.
+func (l *requestLogger) log(req loggedRequest) {
+	if logLevels[req.Level] < l.level {
+		return
+	}
+
+	var line []byte
+
+	if l.format == logFormatJSON {
+		var err error
+		if line, err = json.Marshal(req); err != nil {
+			return
+		}
+	} else {
+		line = []byte(strings.Join([]string{
+			"time=" + req.Time,
+			"level=" + req.Level,
+			"request_id=" + logfmtValue(req.RequestID),
+			"method=" + logfmtValue(req.Method),
+			"path=" + logfmtValue(req.Path),
+			"status=" + strconv.Itoa(req.Status),
+			"latency_ms=" + strconv.FormatFloat(req.LatencyMS, 'f', 3, 64),
+			"ip=" + logfmtValue(req.IP),
+		}, " "))
+	}
+
+	l.writeLock.Lock()
+	defer l.writeLock.Unlock()
+
+	l.output.Write(append(line, '\n'))
+}
+
+// logfmtValue quotes a value for logfmt if it is empty, or if it has any
+// spaces, quotes, equals signs or control characters in it.
+func logfmtValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+
+	for _, r := range value {
+		if r <= ' ' || r == '"' || r == '=' || r == '\\' || r == 0x7f {
+			return strconv.Quote(value)
+		}
+	}
+
+	return value
+}
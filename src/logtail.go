@@ -0,0 +1,338 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The log tail keeps the most recent log entries in memory, so that the admin
+// can see what the server has been doing from the web UI, such as why a tab
+// didn't appear, without needing a shell on the machine it runs on. It holds
+// the requests which are logged at info or above and the messages which the
+// server writes to the console about the tabs and the background work, and
+// they can be followed live from /api/v1/admin/logs.
+const (
+	// logTailSize is how many entries are kept. Older ones are forgotten.
+	logTailSize = 1000
+
+	// logTailLevel is the least severe level of request which is kept, so
+	// that requests for static files don't push everything else out.
+	logTailLevel = "info"
+
+	// logSubscriberBuffer is how many entries can be waiting to be sent to
+	// a client which is following the log. If it falls further behind than
+	// that, the entries it misses are dropped, which it can tell from the
+	// gap in their IDs.
+	logSubscriberBuffer = 64
+
+	// logKeepAlive is how often a comment is sent to a client following
+	// the log when nothing has been logged, so that proxies don't close the
+	// connection for being idle.
+	logKeepAlive = 30 * time.Second
+)
+
+// A logEntry is a single entry in the log tail. Each entry has the next ID,
+// starting from 1, so that a client which reconnects can carry on from the
+// last entry it saw. Request is only set for the entries which log requests.
+type logEntry struct {
+	ID      int64          `json:"id"`
+	Time    string         `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"message"`
+	Request *loggedRequest `json:"request,omitempty"`
+}
+
+// A logTail holds the most recent log entries in a ring, along with the
+// channels of the clients which are following them. All of its methods can
+// be called on a nil logTail, which keeps nothing.
+type logTail struct {
+	lock sync.Mutex
+
+	// entries is the ring of entries, where the entry with each ID is kept
+	// at the index of its ID modulo the size of the ring. next is the ID
+	// which the next entry will be given.
+	entries []logEntry
+	next    int64
+
+	// subscribers are the channels which new entries are sent to, and
+	// closed is true once they have all been closed because the server is
+	// stopping.
+	subscribers map[chan logEntry]bool
+	closed      bool
+}
+
+// newLogTail creates a log tail which keeps the given number of entries.
+func newLogTail(size int) *logTail {
+	return &logTail{
+		entries:     make([]logEntry, size),
+		next:        1,
+		subscribers: make(map[chan logEntry]bool),
+	}
+}
+
+// add gives the entry its ID, and the current time if it doesn't have one,
+// keeps it, and sends it to the clients which are following the log.
+func (t *logTail) add(entry logEntry) {
+	if t == nil {
+		return
+	}
+
+	if entry.Time == "" {
+		entry.Time = time.Now().Format(time.RFC3339Nano)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entry.ID = t.next
+	t.next++
+	t.entries[entry.ID%int64(len(t.entries))] = entry
+
+	for subscriber := range t.subscribers {
+		select {
+		case subscriber <- entry:
+		default:
+		}
+	}
+}
+
+// since returns the entries which are still kept and came after the one
+// with the given ID, oldest first. The lock must be held.
+func (t *logTail) since(after int64) []logEntry {
+	oldest := t.next - int64(len(t.entries))
+	if after+1 > oldest {
+		oldest = after + 1
+	}
+
+	if oldest < 1 {
+		oldest = 1
+	}
+
+	entries := make([]logEntry, 0)
+	for id := oldest; id < t.next; id++ {
+		entries = append(entries, t.entries[id%int64(len(t.entries))])
+	}
+
+	return entries
+}
+
+// recent returns the entries which are still kept and came after the one
+// with the given ID, oldest first.
+func (t *logTail) recent(after int64) []logEntry {
+	if t == nil {
+		return []logEntry{}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.since(after)
+}
+
+// subscribe starts following the log, returning the entries after the one
+// with the given ID which are already kept, and a channel which every entry
+// after them is sent to. Nothing is missed in between, since both are done
+// at once. The channel is closed when the server stops, and unsubscribe must
+// be called once the client has stopped following.
+func (t *logTail) subscribe(after int64) ([]logEntry, chan logEntry) {
+	subscriber := make(chan logEntry, logSubscriberBuffer)
+
+	if t == nil {
+		close(subscriber)
+		return []logEntry{}, subscriber
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		close(subscriber)
+	} else {
+		t.subscribers[subscriber] = true
+	}
+
+	return t.since(after), subscriber
+}
+
+// unsubscribe stops sending entries to the channel.
+func (t *logTail) unsubscribe(subscriber chan logEntry) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.subscribers, subscriber)
+}
+
+// close closes every subscriber's channel, so that the clients following
+// the log are disconnected and the server can stop without waiting for
+// them.
+func (t *logTail) close() {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for subscriber := range t.subscribers {
+		close(subscriber)
+		delete(t.subscribers, subscriber)
+	}
+
+	t.closed = true
+}
+
+// logMessage writes a message, formatted like fmt.Sprintf, to the console
+// and keeps it in the log tail at the given level.
+func (s *Server) logMessage(level, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Println(message)
+
+	s.logTail.add(logEntry{Level: level, Message: message})
+}
+
+// logRequestEntry keeps a request which has been logged in the log tail, if
+// it is severe enough.
+func (s *Server) logRequestEntry(req loggedRequest) {
+	if logLevels[req.Level] < logLevels[logTailLevel] {
+		return
+	}
+
+	s.logTail.add(logEntry{
+		Time:    req.Time,
+		Level:   req.Level,
+		Message: fmt.Sprintf("%s %s %d", req.Method, req.Path, req.Status),
+		Request: &req,
+	})
+}
+
+// filterLogLevel returns the entries which are at least as severe as the
+// given level.
+func filterLogLevel(entries []logEntry, level int) []logEntry {
+	filtered := make([]logEntry, 0, len(entries))
+
+	for _, entry := range entries {
+		if logLevels[entry.Level] >= level {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered
+}
+
+// writeLogEvent writes an entry as a server-sent event, with its ID so that
+// the browser sends it back in Last-Event-ID when it reconnects.
+func writeLogEvent(w http.ResponseWriter, entry logEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", entry.ID, data)
+	return err
+}
+
+// handleLogsAPI is called to respond to a HTTP request to /api/v1/admin/logs.
+// It responds with the recent log entries at or above the level in the
+// 'level' query value, which is "debug" if it isn't given, encoded in JSON.
+// If the request accepts text/event-stream, the entries are sent as
+// server-sent events instead, and the response carries on with each new
+// entry as it is logged, until the client goes away. Either way, only the
+// entries after the one with the ID in the 'after' query value, or the
+// Last-Event-ID header, are sent.
+func (s *Server) handleLogsAPI(w http.ResponseWriter, r *http.Request) {
+	level := 0
+
+	if name := r.FormValue("level"); name != "" {
+		var ok bool
+		if level, ok = logLevels[name]; !ok || name == "none" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown log level %q: it must be debug, info, warn or error", name))
+			return
+		}
+	}
+
+	var after int64
+
+	cursor := r.FormValue("after")
+	if cursor == "" {
+		cursor = r.Header.Get("Last-Event-ID")
+	}
+
+	if cursor != "" {
+		var err error
+		if after, err = strconv.ParseInt(cursor, 10, 64); err != nil || after < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%q isn't a log entry's ID", cursor))
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(filterLogLevel(s.logTail.recent(after), level))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("the log can't be streamed over this connection"))
+		return
+	}
+
+	backlog, entries := s.logTail.subscribe(after)
+	defer s.logTail.unsubscribe(entries)
+
+	// Proxies such as nginx hold back responses until they are finished
+	// unless they are told not to, which would stop the entries arriving
+	// as they are logged.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	for _, entry := range filterLogLevel(backlog, level) {
+		if err := writeLogEvent(w, entry); err != nil {
+			return
+		}
+	}
+
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(logKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+
+			if logLevels[entry.Level] < level {
+				continue
+			}
+
+			if err := writeLogEvent(w, entry); err != nil {
+				return
+			}
+
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,289 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The manifest is a small file in the tab directory, called
+// .tab-server-manifest.json, which records the ID and the date added of each
+// cached tab, along with the admin's changes to it. If the store loses the
+// tabs, such as when Redis is flushed or evicts them, they are put back from
+// the manifest when the server starts, so that they keep the same IDs and
+// dates rather than being cached again from scratch. Since its name begins
+// with a '.', it is never mistaken for a tab.
+const manifestFilename = ".tab-server-manifest.json"
+
+// manifestDelay is how long the server waits after the collection changes
+// before writing the manifest, so that lots of changes at once, such as
+// during a rescan, only cause it to be written once.
+const manifestDelay = 5 * time.Second
+
+// A tabManifest lists what is needed to restore each cached tab, apart from
+// what can be read from its file again.
+type tabManifest struct {
+	Written time.Time       `json:"written"`
+	Tabs    []manifestEntry `json:"tabs"`
+}
+
+// A manifestEntry is the part of a tab which is kept in the manifest.
+type manifestEntry struct {
+	ID               string    `json:"id"`
+	Filename         string    `json:"filename"`
+	Added            time.Time `json:"added"`
+	ExplicitOverride string    `json:"explicitOverride,omitempty"`
+	ExtraTags        []string  `json:"extraTags,omitempty"`
+	Source           TabSource `json:"source"`
+
+	// Practice is left out for the tabs which don't have any practice
+	// metadata, which is most of them.
+	Practice *TabPractice `json:"practice,omitempty"`
+}
+
+// newManifestEntry returns the manifest entry for a cached tab, which has the
+// given extra tags.
+func newManifestEntry(tab *Tab, extraTags []string) manifestEntry {
+	entry := manifestEntry{
+		ID:               tab.ID,
+		Filename:         tab.Filename,
+		Added:            tab.Added,
+		ExplicitOverride: tab.ExplicitOverride,
+		ExtraTags:        extraTags,
+		Source:           tab.Source,
+	}
+
+	if tab.Practice != (TabPractice{}) {
+		practice := tab.Practice
+		entry.Practice = &practice
+	}
+
+	return entry
+}
+
+// manifestPath returns the path to the manifest in the tab directory.
+func (s *Server) manifestPath() string {
+	return filepath.Join(s.Settings.TabDirectory, manifestFilename)
+}
+
+// startManifestWriter starts writing the manifest in the background whenever
+// the collection changes, until the server shuts down.
+func (s *Server) startManifestWriter() {
+	s.manifestChanged = make(chan struct{}, 1)
+
+	// It is written once to begin with, in case it doesn't exist yet.
+	s.noteManifestChanged()
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		s.manifestWriter()
+	}()
+}
+
+// noteManifestChanged tells the manifest writer that the collection has
+// changed. If it already knows, nothing happens, since the change will be
+// written along with the others.
+func (s *Server) noteManifestChanged() {
+	if s.manifestChanged == nil {
+		return
+	}
+
+	select {
+	case s.manifestChanged <- struct{}{}:
+	default:
+	}
+}
+
+// manifestWriter writes the manifest a little while after each change to the
+// collection. When the server shuts down, any change which hasn't been
+// written yet is written straight away.
+func (s *Server) manifestWriter() {
+	stopping := s.background().Done()
+
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-s.manifestChanged:
+		}
+
+		select {
+		case <-stopping:
+		case <-time.After(manifestDelay):
+		}
+
+		if err := s.writeManifest(); err != nil {
+			s.logMessage("warn", "warning: failed to write the manifest: %s", err)
+		}
+	}
+}
+
+// writeManifest writes the manifest for every cached tab. It is written to
+// a temporary file first and then moved into place, so that the manifest is
+// never left half written.
+func (s *Server) writeManifest() error {
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		return err
+	}
+
+	tabs, err := s.Store.GetTabs(ids)
+	if err != nil {
+		return err
+	}
+
+	// A manifest is never replaced by an empty one, since that would only
+	// happen if the tabs had been lost, and then it is needed to put them
+	// back. If every file really has gone, the manifest doesn't do any harm.
+	if len(tabs) == 0 {
+		if _, err := os.Stat(s.manifestPath()); err == nil {
+			return nil
+		}
+	}
+
+	manifest := &tabManifest{
+		Written: time.Now(),
+		Tabs:    make([]manifestEntry, len(tabs)),
+	}
+
+	for i, tab := range tabs {
+		extraTags, err := s.Store.ExtraTags(tab.ID)
+		if err != nil {
+			return err
+		}
+
+		manifest.Tabs[i] = newManifestEntry(tab, extraTags)
+	}
+
+	sort.Slice(manifest.Tabs, func(i, j int) bool {
+		return manifest.Tabs[i].Filename < manifest.Tabs[j].Filename
+	})
+
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(s.Settings.TabDirectory, manifestFilename+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	return os.Rename(temp.Name(), s.manifestPath())
+}
+
+// restoreFromManifest puts the tabs in the manifest back into the store, if
+// the store doesn't have any tabs at all, which means that it has lost them.
+// Each tab is read from its file again, and given its old ID, date added and
+// the admin's changes. Tabs whose files have gone, or which don't match the
+// filename patterns any more, are left out. The number of tabs restored is
+// returned. The cache lock must be held while it runs.
+func (s *Server) restoreFromManifest() (int, error) {
+	ids, err := s.Store.ListIDs()
+	if err != nil || len(ids) > 0 {
+		return 0, err
+	}
+
+	data, err := ioutil.ReadFile(s.manifestPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var manifest tabManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return 0, fmt.Errorf("the manifest is invalid: %s", err)
+	}
+
+	patterns := tokenizePatterns(s.Settings.FilenamePatterns)
+	restored := 0
+
+	for _, entry := range manifest.Tabs {
+		// A file which can't be read is skipped rather than stopping the
+		// others from being restored, and the scan will note its error.
+		tab, ok, err := s.readTab(entry.Filename, patterns)
+		if os.IsNotExist(err) || (err == nil && !ok) {
+			continue
+		} else if err != nil {
+			s.logMessage("warn", "warning: %s could not be restored from the manifest: %s", entry.Filename, err)
+			continue
+		}
+
+		if err := s.restoreTab(tab, entry); err != nil {
+			return restored, err
+		}
+
+		restored++
+	}
+
+	if restored == 0 {
+		return 0, nil
+	}
+
+	return restored, s.bumpCollectionVersion()
+}
+
+// restoreTab stores a tab which has just been read from its file, giving it
+// the ID, date added and admin's changes from its manifest entry.
+func (s *Server) restoreTab(tab *Tab, entry manifestEntry) error {
+	tab.ID = entry.ID
+	tab.Tags = addTags(tab.Tags, entry.ExtraTags)
+
+	if !entry.Added.IsZero() {
+		tab.Added = entry.Added
+	}
+
+	// Manifests written before sources were recorded don't have them.
+	tab.Source = entry.Source
+	if tab.Source.Kind == "" {
+		tab.Source.Kind = sourceScan
+	}
+
+	if entry.Practice != nil {
+		tab.Practice = *entry.Practice
+	}
+
+	if err := s.Store.RestoreTab(tab); err != nil {
+		return err
+	}
+
+	if entry.ExplicitOverride != explicitOverrideNone {
+		if err := s.Store.SetExplicitOverride(tab.ID, entry.ExplicitOverride); err != nil {
+			return err
+		}
+
+		tab.ExplicitOverride = entry.ExplicitOverride
+		tab.applyExplicitOverride()
+	}
+
+	if err := s.Store.AddExtraTags(tab.ID, entry.ExtraTags); err != nil {
+		return err
+	}
+
+	if err := s.recordStats(tab, 1); err != nil {
+		return err
+	}
+
+	if err := s.indexTab(tab); err != nil {
+		return err
+	}
+
+	return s.addToBrowseIndex(tab)
+}
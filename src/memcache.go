@@ -0,0 +1,172 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// defaultTabCacheTTL is how long the list of tabs is kept in memory for if
+// the setting hasn't been set yet.
+const defaultTabCacheTTL = 10 * time.Second
+
+// staleHeader is the header which is set on responses made from tabs kept in
+// memory which might be out of date.
+const staleHeader = "X-Stale"
+
+// The list of tabs is kept in memory for a short time after it is made, so
+// that lots of requests close together don't each have to go through the
+// tab directory and the database. Anything which changes the collection
+// calls bumpCollectionVersion, which also marks the copy in memory as out of
+// date, so the only way for it to go stale without being marked is for a
+// file to change without the file watcher noticing, which is what the TTL is
+// for. Even once it is out of date, the copy is kept, so that there is still
+// something to serve if the database can't be reached.
+
+// memoryTabs returns copies of the tabs kept in memory, without
+// transformations applied, if there are any which haven't expired.
+func (s *Server) memoryTabs() ([]*Tab, bool) {
+	s.tabCacheLock.Lock()
+	defer s.tabCacheLock.Unlock()
+
+	if s.tabCache == nil || time.Now().After(s.tabCacheExpiry) {
+		return nil, false
+	}
+
+	return copyTabs(s.tabCache), true
+}
+
+// memoryState reports whether there are tabs kept in memory at all, and
+// whether they are up to date.
+func (s *Server) memoryState() (present, fresh bool) {
+	s.tabCacheLock.Lock()
+	defer s.tabCacheLock.Unlock()
+
+	present = s.tabCache != nil
+	return present, present && !time.Now().After(s.tabCacheExpiry)
+}
+
+// staleTabs returns copies of the tabs kept in memory, without
+// transformations applied, even if they are out of date. If there aren't any
+// at all, the second return value is false.
+func (s *Server) staleTabs() ([]*Tab, bool) {
+	s.tabCacheLock.Lock()
+	defer s.tabCacheLock.Unlock()
+
+	if s.tabCache == nil {
+		return nil, false
+	}
+
+	return copyTabs(s.tabCache), true
+}
+
+// rememberTabs keeps copies of the tabs in memory, which are used until the
+// TTL runs out. If the TTL is zero, they are only ever used as stale tabs.
+func (s *Server) rememberTabs(tabs []*Tab) {
+	ttl := time.Duration(s.Settings.TabCacheTTL) * time.Second
+
+	s.tabCacheLock.Lock()
+	defer s.tabCacheLock.Unlock()
+
+	s.tabCache = copyTabs(tabs)
+	s.tabCacheExpiry = time.Now().Add(ttl)
+}
+
+// forgetTabs marks the tabs kept in memory as out of date, so the next
+// request gets them from the database again.
+func (s *Server) forgetTabs() {
+	s.tabCacheLock.Lock()
+	defer s.tabCacheLock.Unlock()
+
+	s.tabCacheExpiry = time.Time{}
+}
+
+// copyTabs makes a copy of each of the tabs, so that the copies can be
+// changed, by having transformations applied for example, without changing
+// the originals.
+func copyTabs(tabs []*Tab) []*Tab {
+	copies := make([]*Tab, len(tabs))
+
+	for i, tab := range tabs {
+		copied := *tab
+		copied.Tags = append([]string(nil), tab.Tags...)
+		copied.Chords = append([]string(nil), tab.Chords...)
+		copies[i] = &copied
+	}
+
+	return copies
+}
+
+// getTabsOrStale returns the list of tabs in the same way as getTabs, except
+// that sometimes the tabs kept in memory are returned even though they are
+// out of date, in which case the second return value is true. This happens
+// if the circuit around the database is open, and in the stale serving mode,
+// whenever the tabs in memory are out of date or the tabs can't be fetched,
+// so that clients always get something quickly. The tabs are then refreshed
+// in the background. If there aren't any tabs in memory, the error is
+// returned as usual.
+func (s *Server) getTabsOrStale(ctx context.Context) ([]*Tab, bool, error) {
+	if s.Settings.ServeStale {
+		if present, fresh := s.memoryState(); present && !fresh {
+			s.refreshInBackground()
+			return s.transformedStaleTabs()
+		}
+	}
+
+	tabs, err := s.getTabs(ctx)
+	if err == nil || (err != errCircuitOpen && !s.Settings.ServeStale) {
+		return tabs, false, err
+	}
+
+	if present, _ := s.memoryState(); !present {
+		return nil, false, err
+	}
+
+	s.logMessage("warn", "warning: serving tabs which might be out of date, since they could not be fetched: %s", err)
+	s.refreshInBackground()
+
+	return s.transformedStaleTabs()
+}
+
+// transformedStaleTabs returns the tabs kept in memory, with transformations
+// applied. The second return value is always true, so that it can be
+// returned straight from getTabsOrStale.
+func (s *Server) transformedStaleTabs() ([]*Tab, bool, error) {
+	tabs, _ := s.staleTabs()
+
+	for _, tab := range tabs {
+		tab.applyTransformations(s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
+	}
+
+	return tabs, true, nil
+}
+
+// refreshInBackground starts getting the tabs again in the background, which
+// puts the new list in memory once it is done, unless that is already
+// happening.
+func (s *Server) refreshInBackground() {
+	s.tabCacheLock.Lock()
+	defer s.tabCacheLock.Unlock()
+
+	if s.refreshingTabs {
+		return
+	}
+
+	s.refreshingTabs = true
+
+	go func() {
+		if _, err := s.getTabs(context.Background()); err != nil {
+			s.logMessage("warn", "warning: the tabs could not be refreshed in the background: %s", err)
+		}
+
+		s.tabCacheLock.Lock()
+		s.refreshingTabs = false
+		s.tabCacheLock.Unlock()
+	}()
+}
+
+// markStale sets the header which tells the client that the response was
+// made from tabs which might be out of date.
+func markStale(w http.ResponseWriter) {
+	w.Header().Set(staleHeader, "1")
+}
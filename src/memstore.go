@@ -0,0 +1,2319 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store which keeps everything in memory, so it is all lost
+// when the server stops. It doesn't need a database, which makes it useful
+// for demos and tests. Everything is kept in maps, guarded by one lock, and
+// the things which Redis would expire, such as the sessions, are kept in
+// memoryExpiring maps so that they expire in the same way.
+type MemoryStore struct {
+	// tabs maps each tab's ID to its tab, with its detected explicitness
+	// rather than the override applied. filenames maps each tab's filename
+	// to its ID, and extraTags maps tab IDs to their extra tags.
+	tabs      map[string]*Tab
+	filenames map[string]string
+	extraTags map[string][]string
+
+	// counter is the last ID which was given out, and version is the
+	// collection version.
+	counter int64
+	version int64
+
+	settings *Settings
+
+	// counters holds the counters which NextID gives out IDs from, by
+	// name. The zero time in collectionModified means that it isn't known.
+	counters           map[string]int64
+	nowShowing         map[string]string
+	collectionModified time.Time
+	mountSentinel      string
+
+	// generation is the current generation of sessions, and sessions maps
+	// each session's ID to the generation it was made in.
+	generation int64
+	sessions   *memoryExpiring
+
+	// requests and failedLogins hold the number of rate limited requests
+	// and wrong passwords from each IP address, as int64s, and lockouts
+	// holds the IP addresses which are locked out.
+	requests     *memoryExpiring
+	failedLogins *memoryExpiring
+	lockouts     *memoryExpiring
+
+	// tokens maps the hash of each API token to its name, and tokenRoles
+	// maps their names to their roles. roles is nil until the roles are
+	// first saved.
+	tokens     map[string]string
+	tokenRoles map[string]string
+	roles      map[string][]string
+
+	// secrets maps each purpose to its keyring, by the keys' IDs.
+	secrets map[string]map[string]signingSecret
+
+	// The trash, recordings, setlists, song requests and views are kept
+	// encoded in JSON, as they are in Redis, so that nothing which stores
+	// one or is given one can change the stored copy. waveforms holds the
+	// recordings' waveforms, which are JSON already.
+	trash        map[string][]byte
+	recordings   map[string][]byte
+	waveforms    map[string][]byte
+	setlists     map[string][]byte
+	songRequests map[string][]byte
+	voters       map[string][]string
+	views        map[string][]byte
+
+	// jobs maps each job's ID to a copy of it, and jobOrder holds the IDs
+	// of the jobs which are kept, most recent first. jobQueue holds the IDs
+	// of the queued jobs, and a value is sent on jobQueued, without
+	// waiting, whenever one is queued, to wake up NextQueuedJob.
+	jobs      map[string]*job
+	jobOrder  []string
+	jobQueue  []string
+	jobQueued chan struct{}
+
+	// events is the event log, oldest first, and lastEvent is the ID of
+	// the last event which was added, as its two numbers.
+	events    []loggedEvent
+	lastEvent [2]int64
+
+	// stats holds the dated counters. trigrams maps each trigram in the
+	// search index to the set of IDs of the tabs indexed under it, and
+	// tabTrigrams maps each tab's ID to the trigrams it was indexed under.
+	// browse maps each kind and browseName in the browse index, such as
+	// "artist:abba", to the set of IDs of its tabs, artistNames maps each
+	// artist's browseName to their name as it was written, and explicit
+	// holds the IDs of the explicit tabs.
+	stats          statCounters
+	trigrams       map[string]map[string]bool
+	tabTrigrams    map[string][]string
+	browse         map[string]map[string]bool
+	artistNames    map[string]string
+	browseExplicit map[string]bool
+	indexVersions  map[string]string
+
+	// snapshots holds the integrity snapshots, newest first, encoded in
+	// JSON, and hashes the content hashes from the latest one.
+	snapshots [][]byte
+	hashes    map[string]string
+
+	// favourites maps each owner to the set of IDs of their favourite tabs,
+	// as a map[string]bool.
+	favourites *memoryExpiring
+
+	tagRules map[string]string
+
+	// editLocks holds the tabs' edit locks, encoded in JSON, and
+	// previousContent holds their previous content, keyed by ID and hash
+	// as ID:HASH.
+	editLocks       *memoryExpiring
+	collabVersions  map[string]int
+	previousContent *memoryExpiring
+
+	// lock is held for reading or writing while any of the above are being
+	// used.
+	lock sync.RWMutex
+}
+
+// NewMemoryStore creates an empty MemoryStore which starts off with the
+// given settings.
+func NewMemoryStore(settings *Settings) *MemoryStore {
+	return &MemoryStore{
+		tabs:      make(map[string]*Tab),
+		filenames: make(map[string]string),
+		extraTags: make(map[string][]string),
+		settings:  copySettings(settings),
+
+		counters:   make(map[string]int64),
+		nowShowing: make(map[string]string),
+
+		sessions:     newMemoryExpiring(),
+		requests:     newMemoryExpiring(),
+		failedLogins: newMemoryExpiring(),
+		lockouts:     newMemoryExpiring(),
+
+		tokens:     make(map[string]string),
+		tokenRoles: make(map[string]string),
+		secrets:    make(map[string]map[string]signingSecret),
+		trash:      make(map[string][]byte),
+		waveforms:  make(map[string][]byte),
+
+		jobs:      make(map[string]*job),
+		jobQueued: make(chan struct{}, 1),
+
+		stats:          newStatCounters(),
+		trigrams:       make(map[string]map[string]bool),
+		tabTrigrams:    make(map[string][]string),
+		browse:         make(map[string]map[string]bool),
+		artistNames:    make(map[string]string),
+		browseExplicit: make(map[string]bool),
+		indexVersions:  make(map[string]string),
+
+		recordings:   make(map[string][]byte),
+		setlists:     make(map[string][]byte),
+		songRequests: make(map[string][]byte),
+		voters:       make(map[string][]string),
+		views:        make(map[string][]byte),
+		hashes:       make(map[string]string),
+
+		favourites:      newMemoryExpiring(),
+		tagRules:        make(map[string]string),
+		editLocks:       newMemoryExpiring(),
+		collabVersions:  make(map[string]int),
+		previousContent: newMemoryExpiring(),
+	}
+}
+
+// newStatCounters returns a set of empty dated counters.
+func newStatCounters() statCounters {
+	return statCounters{
+		Months:  make(map[string]int64),
+		Artists: make(map[string]map[string]int64),
+		Tags:    make(map[string]map[string]int64),
+	}
+}
+
+// copySettings makes a copy of the settings, so the copy can be changed
+// without changing the original.
+func copySettings(settings *Settings) *Settings {
+	copied := *settings
+	copied.FilenamePatterns = append([]string(nil), settings.FilenamePatterns...)
+	copied.NonCapitalWords = append([]string(nil), settings.NonCapitalWords...)
+	copied.IgnorePatterns = append([]string(nil), settings.IgnorePatterns...)
+	copied.AllowedLicenses = append([]string(nil), settings.AllowedLicenses...)
+	copied.AutoTagRules = append([]AutoTagRule(nil), settings.AutoTagRules...)
+
+	return &copied
+}
+
+// GetTab returns the tab with the given ID. If there is no such tab, the
+// second return value is false.
+func (ms *MemoryStore) GetTab(id string) (*Tab, bool, error) {
+	tabs, err := ms.GetTabs([]string{id})
+	if err != nil || len(tabs) == 0 {
+		return nil, false, err
+	}
+
+	return tabs[0], true, nil
+}
+
+// GetTabs returns copies of the tabs with each of the given IDs, in the same
+// order, leaving out any which don't exist.
+func (ms *MemoryStore) GetTabs(ids []string) ([]*Tab, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	tabs := make([]*Tab, 0, len(ids))
+
+	for _, id := range ids {
+		tab, ok := ms.tabs[id]
+		if !ok {
+			continue
+		}
+
+		copied := copyTabs([]*Tab{tab})[0]
+		copied.applyExplicitOverride()
+
+		tabs = append(tabs, copied)
+	}
+
+	return tabs, nil
+}
+
+// PutTab stores a copy of a tab. If the tab's ID is empty, it is stored as a
+// new tab and its ID is set to the next available one. Otherwise, it replaces
+// the tab with that ID, which must already exist.
+func (ms *MemoryStore) PutTab(tab *Tab) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if tab.ID == "" {
+		ms.counter++
+		tab.ID = strconv.FormatInt(ms.counter, 10)
+	} else {
+		old, ok := ms.tabs[tab.ID]
+		if !ok {
+			return fmt.Errorf("no tab with the ID %s", tab.ID)
+		}
+
+		delete(ms.filenames, old.Filename)
+	}
+
+	stored := copyTabs([]*Tab{tab})[0]
+
+	// The explicit override is only changed by SetExplicitOverride, so the
+	// one which is already stored is kept.
+	stored.ExplicitOverride = ""
+	if old, ok := ms.tabs[tab.ID]; ok {
+		stored.ExplicitOverride = old.ExplicitOverride
+	}
+
+	ms.tabs[tab.ID] = stored
+	ms.filenames[tab.Filename] = tab.ID
+
+	return nil
+}
+
+// RestoreTab stores a tab under the ID it already has, raising the counter to
+// that ID if it is lower.
+func (ms *MemoryStore) RestoreTab(tab *Tab) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	id, err := strconv.ParseInt(tab.ID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("the tab ID %q isn't a number", tab.ID)
+	} else if _, ok := ms.tabs[tab.ID]; ok {
+		return fmt.Errorf("the tab ID %s is already in use", tab.ID)
+	}
+
+	if ms.counter < id {
+		ms.counter = id
+	}
+
+	stored := copyTabs([]*Tab{tab})[0]
+	stored.ExplicitOverride = ""
+
+	ms.tabs[tab.ID] = stored
+	ms.filenames[tab.Filename] = tab.ID
+
+	return nil
+}
+
+// DeleteTab removes the tab with the given ID.
+func (ms *MemoryStore) DeleteTab(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	tab, ok := ms.tabs[id]
+	if !ok {
+		return fmt.Errorf("no tab with the ID %s", id)
+	}
+
+	delete(ms.tabs, id)
+	delete(ms.filenames, tab.Filename)
+	delete(ms.extraTags, id)
+
+	return nil
+}
+
+// ListIDs returns the IDs of every stored tab, in no particular order.
+func (ms *MemoryStore) ListIDs() ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	ids := make([]string, 0, len(ms.tabs))
+	for id := range ms.tabs {
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// Filenames returns a map from the filename of every stored tab to its ID.
+func (ms *MemoryStore) Filenames() (map[string]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	filenames := make(map[string]string, len(ms.filenames))
+	for filename, id := range ms.filenames {
+		filenames[filename] = id
+	}
+
+	return filenames, nil
+}
+
+// TabID returns the ID of the tab with the given filename. If there is no
+// such tab, the second return value is false.
+func (ms *MemoryStore) TabID(filename string) (string, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	id, ok := ms.filenames[filename]
+	return id, ok, nil
+}
+
+// SetModified changes just the modification time of the tab with the given
+// ID.
+func (ms *MemoryStore) SetModified(id string, modified time.Time) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if tab, ok := ms.tabs[id]; ok {
+		tab.Modified = modified
+	}
+
+	return nil
+}
+
+// SetSource changes just the source of the tab with the given ID.
+func (ms *MemoryStore) SetSource(id string, source TabSource) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if tab, ok := ms.tabs[id]; ok {
+		tab.Source = source
+	}
+
+	return nil
+}
+
+// SetPractice changes just the practice metadata of the tab with the given
+// ID.
+func (ms *MemoryStore) SetPractice(id string, practice TabPractice) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if tab, ok := ms.tabs[id]; ok {
+		tab.Practice = practice
+	}
+
+	return nil
+}
+
+// SetExplicitOverride changes the explicit override of the tab with the
+// given ID. An empty override removes it.
+func (ms *MemoryStore) SetExplicitOverride(id, override string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if tab, ok := ms.tabs[id]; ok {
+		tab.ExplicitOverride = override
+	}
+
+	return nil
+}
+
+// ExtraTags returns the tags which have been added to the tab with the given
+// ID on top of the ones from its file.
+func (ms *MemoryStore) ExtraTags(id string) ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return append([]string(nil), ms.extraTags[id]...), nil
+}
+
+// AddExtraTags adds to the extra tags of the tab with the given ID.
+func (ms *MemoryStore) AddExtraTags(id string, tags []string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.extraTags[id] = addTags(ms.extraTags[id], tags)
+
+	return nil
+}
+
+// RewriteTags replaces the tags and extra tags of several tabs at once.
+func (ms *MemoryStore) RewriteTags(tags, extraTags map[string][]string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for id, newTags := range tags {
+		if tab, ok := ms.tabs[id]; ok {
+			tab.Tags = append([]string{}, newTags...)
+		}
+	}
+
+	for id, newTags := range extraTags {
+		if len(newTags) == 0 {
+			delete(ms.extraTags, id)
+		} else {
+			ms.extraTags[id] = append([]string(nil), newTags...)
+		}
+	}
+
+	return nil
+}
+
+// CollectionVersion returns the collection version, which is 0 before
+// anything has changed.
+func (ms *MemoryStore) CollectionVersion() (int64, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return ms.version, nil
+}
+
+// BumpCollectionVersion increments the collection version.
+func (ms *MemoryStore) BumpCollectionVersion() error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.version++
+
+	return nil
+}
+
+// ResetTabs removes every tab, so that the next tab stored gets the first ID
+// again.
+func (ms *MemoryStore) ResetTabs() error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.tabs = make(map[string]*Tab)
+	ms.filenames = make(map[string]string)
+	ms.extraTags = make(map[string][]string)
+	ms.counter = 0
+
+	return nil
+}
+
+// LoadSettings returns a copy of the stored settings.
+func (ms *MemoryStore) LoadSettings() (*Settings, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return copySettings(ms.settings), nil
+}
+
+// SaveSettings stores all of the settings except from the password hash.
+func (ms *MemoryStore) SaveSettings(settings *Settings) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	saved := copySettings(settings)
+	saved.PasswordHash = ms.settings.PasswordHash
+	ms.settings = saved
+
+	return nil
+}
+
+// PasswordHash returns the stored hash of the admin password.
+func (ms *MemoryStore) PasswordHash() (string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return ms.settings.PasswordHash, nil
+}
+
+// SetPasswordHash changes the stored hash of the admin password.
+func (ms *MemoryStore) SetPasswordHash(hash string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.settings.PasswordHash = hash
+
+	return nil
+}
+
+// A memoryExpiring is a map whose entries can expire, as keys can in Redis.
+// An entry which has expired is treated as missing straight away, and is
+// removed the next time the map grows, so that they don't build up. Its
+// MemoryStore's lock has to be held while it is used.
+type memoryExpiring struct {
+	values  map[string]interface{}
+	expires map[string]time.Time
+
+	// pruneAt is how many entries the map has to grow to before the ones
+	// which have expired are removed.
+	pruneAt int
+}
+
+// minPruneAt is the least number of entries which a memoryExpiring has to
+// have before the ones which have expired are removed. After they are, it
+// has to grow to twice as many as are left, so that the time spent removing
+// them stays proportional to the number of entries added.
+const minPruneAt = 64
+
+// newMemoryExpiring returns an empty memoryExpiring.
+func newMemoryExpiring() *memoryExpiring {
+	return &memoryExpiring{
+		values:  make(map[string]interface{}),
+		expires: make(map[string]time.Time),
+		pruneAt: minPruneAt,
+	}
+}
+
+// get returns the value of the entry with the given key. The second return
+// value is false if there is no such entry, or it has expired.
+func (me *memoryExpiring) get(key string) (interface{}, bool) {
+	value, ok := me.values[key]
+	if !ok || me.expired(key, time.Now()) {
+		return nil, false
+	}
+
+	return value, true
+}
+
+// expired reports whether the entry with the given key had expired by the
+// given time.
+func (me *memoryExpiring) expired(key string, now time.Time) bool {
+	expires, ok := me.expires[key]
+	return ok && !now.Before(expires)
+}
+
+// set stores a value under the given key, which expires once the duration
+// has passed, or never if it is 0.
+func (me *memoryExpiring) set(key string, value interface{}, duration time.Duration) {
+	if _, ok := me.values[key]; !ok && len(me.values) >= me.pruneAt {
+		me.prune()
+	}
+
+	me.values[key] = value
+	delete(me.expires, key)
+	me.expire(key, duration)
+}
+
+// expire makes the entry with the given key, if there is one, expire once
+// the duration has passed, or never if it is 0.
+func (me *memoryExpiring) expire(key string, duration time.Duration) {
+	if _, ok := me.get(key); !ok {
+		return
+	}
+
+	if duration == 0 {
+		delete(me.expires, key)
+	} else {
+		me.expires[key] = time.Now().Add(duration)
+	}
+}
+
+// ttl returns how long is left until the entry with the given key expires,
+// or 0 if there is no such entry or it never expires.
+func (me *memoryExpiring) ttl(key string) time.Duration {
+	if _, ok := me.get(key); !ok {
+		return 0
+	}
+
+	if expires, ok := me.expires[key]; ok {
+		return time.Until(expires)
+	}
+
+	return 0
+}
+
+// remove removes the entry with the given key.
+func (me *memoryExpiring) remove(key string) {
+	delete(me.values, key)
+	delete(me.expires, key)
+}
+
+// keys returns the keys of every entry which hasn't expired, in no
+// particular order.
+func (me *memoryExpiring) keys() []string {
+	now := time.Now()
+	keys := make([]string, 0, len(me.values))
+
+	for key := range me.values {
+		if !me.expired(key, now) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// prune removes every entry which has expired.
+func (me *memoryExpiring) prune() {
+	now := time.Now()
+
+	for key := range me.expires {
+		if me.expired(key, now) {
+			me.remove(key)
+		}
+	}
+
+	me.pruneAt = 2 * len(me.values)
+	if me.pruneAt < minPruneAt {
+		me.pruneAt = minPruneAt
+	}
+}
+
+// NextID increments the counter with the given name, and returns its new
+// value.
+func (ms *MemoryStore) NextID(counter string) (string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.counters[counter]++
+
+	return strconv.FormatInt(ms.counters[counter], 10), nil
+}
+
+// IDCounter returns the value of the counter with the given name, which is 0
+// if no IDs have been given out yet.
+func (ms *MemoryStore) IDCounter(counter string) (int64, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return ms.counters[counter], nil
+}
+
+// SetIDCounter changes the value of the counter with the given name.
+func (ms *MemoryStore) SetIDCounter(counter string, value int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.counters[counter] = value
+
+	return nil
+}
+
+// NowShowing returns the ID of the tab on show in each state.
+func (ms *MemoryStore) NowShowing() (map[string]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return copyStrings(ms.nowShowing), nil
+}
+
+// SetNowShowing changes the tab on show in one state. An empty ID means that
+// nothing is.
+func (ms *MemoryStore) SetNowShowing(state, id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if id == "" {
+		delete(ms.nowShowing, state)
+	} else {
+		ms.nowShowing[state] = id
+	}
+
+	return nil
+}
+
+// CollectionModified returns when the collection last changed. The second
+// return value is false if that isn't known.
+func (ms *MemoryStore) CollectionModified() (time.Time, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return ms.collectionModified, !ms.collectionModified.IsZero(), nil
+}
+
+// SetCollectionModified records when the collection last changed. Only the
+// second is kept, as it is by the Redis store.
+func (ms *MemoryStore) SetCollectionModified(modified time.Time) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.collectionModified = time.Unix(modified.Unix(), 0)
+
+	return nil
+}
+
+// MountSentinel returns the tab directory which the mount sentinel was last
+// seen in, or an empty string if it hasn't been seen.
+func (ms *MemoryStore) MountSentinel() (string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return ms.mountSentinel, nil
+}
+
+// SetMountSentinel changes the tab directory which the mount sentinel was
+// last seen in.
+func (ms *MemoryStore) SetMountSentinel(dir string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.mountSentinel = dir
+
+	return nil
+}
+
+// Ping checks that the store can be reached, which it always can.
+func (ms *MemoryStore) Ping() error {
+	return nil
+}
+
+// Close does nothing, since the store doesn't hold on to anything but
+// memory.
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+// SessionGeneration returns the current generation of sessions, which is "0"
+// until EndAllSessions is first called.
+func (ms *MemoryStore) SessionGeneration() (string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return strconv.FormatInt(ms.generation, 10), nil
+}
+
+// EndAllSessions moves on to the next generation of sessions.
+func (ms *MemoryStore) EndAllSessions() error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.generation++
+
+	return nil
+}
+
+// CreateSession stores a session made in the given generation, which is
+// forgotten once the duration has passed.
+func (ms *MemoryStore) CreateSession(id, generation string, duration time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.sessions.set(id, generation, duration)
+
+	return nil
+}
+
+// Session returns the generation which the session with the given ID was
+// made in. The second return value is false if there is no such session.
+func (ms *MemoryStore) Session(id string) (string, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	generation, ok := ms.sessions.get(id)
+	if !ok {
+		return "", false, nil
+	}
+
+	return generation.(string), true, nil
+}
+
+// DeleteSession removes the session with the given ID.
+func (ms *MemoryStore) DeleteSession(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.sessions.remove(id)
+
+	return nil
+}
+
+// CountRequest counts a request from the IP address in the current window,
+// which starts with the first request and lasts for the given duration. The
+// return value is true if there have been more than limit requests in the
+// window, along with how long is left of it.
+func (ms *MemoryStore) CountRequest(ip string, limit int64, window time.Duration) (bool, time.Duration, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	// The first request in a window starts it, and the rest replace the
+	// count without changing when it ends.
+	var count int64 = 1
+	if counted, ok := ms.requests.get(ip); ok {
+		count += counted.(int64)
+		ms.requests.values[ip] = count
+	} else {
+		ms.requests.set(ip, count, window)
+	}
+
+	if count <= limit {
+		return false, 0, nil
+	}
+
+	return true, ms.requests.ttl(ip), nil
+}
+
+// Lockout returns how long is left of the IP address's lockout, or 0 if it
+// isn't locked out.
+func (ms *MemoryStore) Lockout(ip string) (time.Duration, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return ms.lockouts.ttl(ip), nil
+}
+
+// LockOut locks out the IP address for the given duration.
+func (ms *MemoryStore) LockOut(ip string, duration time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.lockouts.set(ip, true, duration)
+
+	return nil
+}
+
+// CountFailedLogin counts a wrong password entered from the IP address, and
+// returns how many there have been. They are forgotten once the given
+// duration has passed without another one.
+func (ms *MemoryStore) CountFailedLogin(ip string, memory time.Duration) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	var failures int64 = 1
+	if count, ok := ms.failedLogins.get(ip); ok {
+		failures += count.(int64)
+	}
+
+	ms.failedLogins.set(ip, failures, memory)
+
+	return failures, nil
+}
+
+// ClearFailedLogins forgets the wrong passwords entered from the IP address.
+func (ms *MemoryStore) ClearFailedLogins(ip string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.failedLogins.remove(ip)
+
+	return nil
+}
+
+// PutToken stores a token under its hash, with a name and a role. If the
+// role is empty, none is stored.
+func (ms *MemoryStore) PutToken(hash, name, role string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if role != "" {
+		ms.tokenRoles[name] = role
+	}
+
+	ms.tokens[hash] = name
+
+	return nil
+}
+
+// Tokens returns a map from the hash of every token to its name.
+func (ms *MemoryStore) Tokens() (map[string]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return copyStrings(ms.tokens), nil
+}
+
+// TokenName returns the name of the token with the given hash. The second
+// return value is false if there is no such token.
+func (ms *MemoryStore) TokenName(hash string) (string, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	name, ok := ms.tokens[hash]
+	return name, ok, nil
+}
+
+// TokenRoles returns a map from the name of every token which has a role to
+// its role.
+func (ms *MemoryStore) TokenRoles() (map[string]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return copyStrings(ms.tokenRoles), nil
+}
+
+// TokenRole returns the role of the token with the given name. The second
+// return value is false if it doesn't have one.
+func (ms *MemoryStore) TokenRole(name string) (string, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	role, ok := ms.tokenRoles[name]
+	return role, ok, nil
+}
+
+// DeleteToken removes the token with the given hash and name.
+func (ms *MemoryStore) DeleteToken(hash, name string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.tokens, hash)
+	delete(ms.tokenRoles, name)
+
+	return nil
+}
+
+// Roles returns the permissions of every role. The second return value is
+// false if they have never been saved.
+func (ms *MemoryStore) Roles() (map[string][]string, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	if ms.roles == nil {
+		return nil, false, nil
+	}
+
+	return copyRoles(ms.roles), true, nil
+}
+
+// SaveRoles replaces every role.
+func (ms *MemoryStore) SaveRoles(roles map[string][]string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.roles = copyRoles(roles)
+
+	return nil
+}
+
+// copyRoles makes a copy of the roles' permissions, which is never nil, and
+// in which no role's permissions are nil either.
+func copyRoles(roles map[string][]string) map[string][]string {
+	copied := make(map[string][]string, len(roles))
+	for role, permissions := range roles {
+		copied[role] = append([]string{}, permissions...)
+	}
+
+	return copied
+}
+
+// copyStrings makes a copy of a map of strings.
+func copyStrings(strs map[string]string) map[string]string {
+	copied := make(map[string]string, len(strs))
+	for key, value := range strs {
+		copied[key] = value
+	}
+
+	return copied
+}
+
+// Secrets returns every key in a purpose's keyring, in no particular order.
+func (ms *MemoryStore) Secrets(purpose string) ([]signingSecret, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	secrets := make([]signingSecret, 0, len(ms.secrets[purpose]))
+	for _, secret := range ms.secrets[purpose] {
+		secrets = append(secrets, copySecret(secret))
+	}
+
+	return secrets, nil
+}
+
+// PutSecrets adds or replaces keys in a purpose's keyring.
+func (ms *MemoryStore) PutSecrets(purpose string, secrets ...signingSecret) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, secret := range secrets {
+		ms.putSecret(purpose, secret)
+	}
+
+	return nil
+}
+
+// putSecret adds or replaces a key in a purpose's keyring. The lock must be
+// held for writing.
+func (ms *MemoryStore) putSecret(purpose string, secret signingSecret) {
+	if ms.secrets[purpose] == nil {
+		ms.secrets[purpose] = make(map[string]signingSecret)
+	}
+
+	ms.secrets[purpose][secret.ID] = copySecret(secret)
+}
+
+// copySecret makes a copy of a key, so the copy can be changed without
+// changing the original.
+func copySecret(secret signingSecret) signingSecret {
+	if secret.Retires != nil {
+		retires := *secret.Retires
+		secret.Retires = &retires
+	}
+
+	return secret
+}
+
+// AddInitialSecret adds the first key to a purpose's keyring, unless it
+// already has a key with the same ID. There is never a key from before there
+// were keyrings, since nothing is kept between runs.
+func (ms *MemoryStore) AddInitialSecret(purpose string, secret signingSecret) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if _, ok := ms.secrets[purpose][secret.ID]; !ok {
+		ms.putSecret(purpose, secret)
+	}
+
+	return nil
+}
+
+// ReplaceSecrets replaces a purpose's whole keyring with the one key.
+func (ms *MemoryStore) ReplaceSecrets(purpose string, secret signingSecret) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.secrets, purpose)
+	ms.putSecret(purpose, secret)
+
+	return nil
+}
+
+// DeleteSecrets removes the keys with the given IDs from a purpose's
+// keyring, and returns how many there were.
+func (ms *MemoryStore) DeleteSecrets(purpose string, ids ...string) (int, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	removed := 0
+
+	for _, id := range ids {
+		if _, ok := ms.secrets[purpose][id]; ok {
+			delete(ms.secrets[purpose], id)
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// getJSON decodes the JSON in the given map under the given key into v. If
+// there is no such key, v is left alone and false is returned.
+func getJSON(values map[string][]byte, key string, v interface{}) (bool, error) {
+	encoded, ok := values[key]
+	if !ok {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(encoded, v)
+}
+
+// putJSON stores v, encoded as JSON, in the given map under the given key.
+func putJSON(values map[string][]byte, key string, v interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	values[key] = encoded
+
+	return nil
+}
+
+// TrashedTabs returns every tab in the trash, in no particular order.
+func (ms *MemoryStore) TrashedTabs() ([]*trashedTab, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	trashed := make([]*trashedTab, 0, len(ms.trash))
+
+	for id := range ms.trash {
+		tab := &trashedTab{}
+		if _, err := getJSON(ms.trash, id, tab); err != nil {
+			return nil, err
+		}
+
+		trashed = append(trashed, tab)
+	}
+
+	return trashed, nil
+}
+
+// TrashedTab returns the tab in the trash with the given ID. The second
+// return value is false if there is no such tab.
+func (ms *MemoryStore) TrashedTab(id string) (*trashedTab, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	tab := &trashedTab{}
+	ok, err := getJSON(ms.trash, id, tab)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return tab, true, nil
+}
+
+// PutTrashedTab puts a tab in the trash under the given ID.
+func (ms *MemoryStore) PutTrashedTab(id string, tab *trashedTab) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return putJSON(ms.trash, id, tab)
+}
+
+// DeleteTrashedTab takes the tab with the given ID out of the trash.
+func (ms *MemoryStore) DeleteTrashedTab(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.trash, id)
+
+	return nil
+}
+
+// CreateJob stores a new job as the most recent one. Only the given number
+// of the most recent jobs are kept.
+func (ms *MemoryStore) CreateJob(j *job, keep int) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.updateJob(j)
+	ms.jobOrder = append([]string{j.ID}, ms.jobOrder...)
+
+	if len(ms.jobOrder) > keep {
+		for _, old := range ms.jobOrder[keep:] {
+			delete(ms.jobs, old)
+		}
+
+		ms.jobOrder = ms.jobOrder[:keep]
+	}
+
+	return nil
+}
+
+// UpdateJob stores the job's current state, except from whether it has been
+// asked to cancel.
+func (ms *MemoryStore) UpdateJob(j *job) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.updateJob(j)
+
+	return nil
+}
+
+// updateJob stores a copy of the job, keeping whether it has been asked to
+// cancel. The lock must be held for writing.
+func (ms *MemoryStore) updateJob(j *job) {
+	stored := *j
+	stored.Errors = append(make([]string, 0, len(j.Errors)), j.Errors...)
+	stored.CancelRequested = false
+
+	if old, ok := ms.jobs[j.ID]; ok {
+		stored.CancelRequested = old.CancelRequested
+	}
+
+	ms.jobs[j.ID] = &stored
+}
+
+// SetJobProgress changes just how far through the job with the given ID is.
+func (ms *MemoryStore) SetJobProgress(id string, done, total int) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if j, ok := ms.jobs[id]; ok {
+		j.Done, j.Total = done, total
+	}
+
+	return nil
+}
+
+// RequestJobCancel notes that the job with the given ID has been asked to
+// cancel.
+func (ms *MemoryStore) RequestJobCancel(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if j, ok := ms.jobs[id]; ok {
+		j.CancelRequested = true
+	}
+
+	return nil
+}
+
+// Job returns a copy of the job with the given ID. The second return value
+// is false if there is no such job.
+func (ms *MemoryStore) Job(id string) (*job, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	j, ok := ms.jobs[id]
+	if !ok {
+		return nil, false, nil
+	}
+
+	return copyJob(j), true, nil
+}
+
+// Jobs returns copies of every job which is still kept, most recent first.
+func (ms *MemoryStore) Jobs() ([]*job, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	jobs := make([]*job, 0, len(ms.jobOrder))
+	for _, id := range ms.jobOrder {
+		if j, ok := ms.jobs[id]; ok {
+			jobs = append(jobs, copyJob(j))
+		}
+	}
+
+	return jobs, nil
+}
+
+// copyJob makes a copy of a job, so the copy can be changed without changing
+// the original.
+func copyJob(j *job) *job {
+	copied := *j
+	copied.Errors = append(make([]string, 0, len(j.Errors)), j.Errors...)
+
+	return &copied
+}
+
+// QueueJob adds the job with the given ID to the end of the queue, and wakes
+// up NextQueuedJob if it is waiting.
+func (ms *MemoryStore) QueueJob(id string) error {
+	ms.lock.Lock()
+	ms.jobQueue = append(ms.jobQueue, id)
+	ms.lock.Unlock()
+
+	ms.signalJobQueued()
+
+	return nil
+}
+
+// signalJobQueued sends a value on jobQueued, unless one is already waiting
+// to be received.
+func (ms *MemoryStore) signalJobQueued() {
+	select {
+	case ms.jobQueued <- struct{}{}:
+	default:
+	}
+}
+
+// NextQueuedJob takes the job at the front of the queue off it, waiting for
+// up to the given duration for there to be one. The second return value is
+// false if there still wasn't one.
+func (ms *MemoryStore) NextQueuedJob(wait time.Duration) (string, bool, error) {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		ms.lock.Lock()
+
+		if len(ms.jobQueue) > 0 {
+			id := ms.jobQueue[0]
+			ms.jobQueue = ms.jobQueue[1:]
+			left := len(ms.jobQueue)
+			ms.lock.Unlock()
+
+			// Only one value is ever waiting on jobQueued, so if there
+			// are more jobs, another waiting worker is woken up for them.
+			if left > 0 {
+				ms.signalJobQueued()
+			}
+
+			return id, true, nil
+		}
+
+		ms.lock.Unlock()
+
+		select {
+		case <-ms.jobQueued:
+		case <-timeout.C:
+			return "", false, nil
+		}
+	}
+}
+
+// parseEventID parses an event ID into its two numbers. The second can be
+// left out, in which case it is 0.
+func parseEventID(id string) ([2]int64, error) {
+	var parsed [2]int64
+
+	parts := strings.SplitN(id, "-", 2)
+
+	for i, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || n < 0 {
+			return parsed, fmt.Errorf("%q isn't the ID of an event", id)
+		}
+
+		parsed[i] = n
+	}
+
+	return parsed, nil
+}
+
+// eventIDAfter reports whether the event ID a is after b.
+func eventIDAfter(a, b [2]int64) bool {
+	return a[0] > b[0] || (a[0] == b[0] && a[1] > b[1])
+}
+
+// AddEvent adds an event to the end of the log, giving it an ID made from
+// the current time in milliseconds and a sequence number, as Redis does,
+// which is always after the last event's. Once the log is a quarter longer
+// than the given length, the oldest events are removed to bring it back down
+// to it.
+func (ms *MemoryStore) AddEvent(event loggedEvent, max int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	id := [2]int64{time.Now().UnixNano() / int64(time.Millisecond), 0}
+	if !eventIDAfter(id, ms.lastEvent) {
+		id = [2]int64{ms.lastEvent[0], ms.lastEvent[1] + 1}
+	}
+
+	ms.lastEvent = id
+	event.ID = fmt.Sprintf("%d-%d", id[0], id[1])
+	ms.events = append(ms.events, event)
+
+	if excess := int64(len(ms.events)) - max; excess > 0 && excess >= max/4 {
+		ms.events = append([]loggedEvent(nil), ms.events[excess:]...)
+	}
+
+	return nil
+}
+
+// LatestEventID returns the ID of the newest event, or "0-0" if there aren't
+// any.
+func (ms *MemoryStore) LatestEventID() (string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	if len(ms.events) == 0 {
+		return "0-0", nil
+	}
+
+	return ms.events[len(ms.events)-1].ID, nil
+}
+
+// EventsAfter returns up to count of the events after the one with the given
+// ID, oldest first.
+func (ms *MemoryStore) EventsAfter(id string, count int64) ([]loggedEvent, error) {
+	after, err := parseEventID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	// The events are in order of ID, so the first one after the given ID
+	// can be found with a binary search. Every stored ID is valid.
+	start := sort.Search(len(ms.events), func(i int) bool {
+		parsed, _ := parseEventID(ms.events[i].ID)
+		return eventIDAfter(parsed, after)
+	})
+
+	end := len(ms.events)
+	if count > 0 && int64(end-start) > count {
+		end = start + int(count)
+	}
+
+	if start == end {
+		return nil, nil
+	}
+
+	return append([]loggedEvent(nil), ms.events[start:end]...), nil
+}
+
+// RecordStats adds delta to each of the counters which the tab counts
+// towards.
+func (ms *MemoryStore) RecordStats(tab *Tab, delta int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.recordStats(tab, delta)
+
+	return nil
+}
+
+// recordStats does what RecordStats does, for when the lock is already held
+// for writing.
+func (ms *MemoryStore) recordStats(tab *Tab, delta int64) {
+	month := tab.Added.Format("2006-01")
+
+	ms.stats.Months[month] += delta
+	addToCounter(ms.stats.Artists, tab.Artist, month, delta)
+
+	for _, tag := range tab.Tags {
+		addToCounter(ms.stats.Tags, tag, month, delta)
+	}
+}
+
+// addToCounter adds delta to the count of the given month in the counter of
+// the given name, making the counter if there isn't one yet.
+func addToCounter(counters map[string]map[string]int64, name, month string, delta int64) {
+	if counters[name] == nil {
+		counters[name] = make(map[string]int64)
+	}
+
+	counters[name][month] += delta
+}
+
+// StatCounters returns a copy of every counter.
+func (ms *MemoryStore) StatCounters() (*statCounters, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	counters := newStatCounters()
+
+	for month, count := range ms.stats.Months {
+		counters.Months[month] = count
+	}
+
+	for _, group := range []struct {
+		from, into map[string]map[string]int64
+	}{
+		{ms.stats.Artists, counters.Artists},
+		{ms.stats.Tags, counters.Tags},
+	} {
+		for name, months := range group.from {
+			for month, count := range months {
+				addToCounter(group.into, name, month, count)
+			}
+		}
+	}
+
+	return &counters, nil
+}
+
+// ResetStats removes every counter, and returns how many there were.
+func (ms *MemoryStore) ResetStats() (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	removed := int64(len(ms.stats.Artists) + len(ms.stats.Tags))
+	if len(ms.stats.Months) > 0 {
+		removed++
+	}
+
+	ms.stats = newStatCounters()
+
+	return removed, nil
+}
+
+// IndexTab adds a tab to the search index under the trigrams of its
+// searchText.
+func (ms *MemoryStore) IndexTab(tab *Tab) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.indexTab(tab)
+
+	return nil
+}
+
+// indexTab does what IndexTab does, for when the lock is already held for
+// writing.
+func (ms *MemoryStore) indexTab(tab *Tab) {
+	trigrams := indexTrigrams(searchText(tab))
+
+	for trigram := range trigrams {
+		if ms.trigrams[trigram] == nil {
+			ms.trigrams[trigram] = make(map[string]bool)
+		}
+
+		ms.trigrams[trigram][tab.ID] = true
+		ms.tabTrigrams[tab.ID] = append(ms.tabTrigrams[tab.ID], trigram)
+	}
+}
+
+// UnindexTab removes the tab with the given ID from the search index.
+func (ms *MemoryStore) UnindexTab(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.unindexTab(id)
+
+	return nil
+}
+
+// unindexTab does what UnindexTab does, for when the lock is already held
+// for writing. Trigrams which no tabs are indexed under any more are
+// forgotten.
+func (ms *MemoryStore) unindexTab(id string) {
+	for _, trigram := range ms.tabTrigrams[id] {
+		delete(ms.trigrams[trigram], id)
+
+		if len(ms.trigrams[trigram]) == 0 {
+			delete(ms.trigrams, trigram)
+		}
+	}
+
+	delete(ms.tabTrigrams, id)
+}
+
+// SearchIDs returns the IDs of the tabs indexed under every one of the given
+// trigrams.
+func (ms *MemoryStore) SearchIDs(trigrams []string) ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	if len(trigrams) == 0 {
+		return nil, nil
+	}
+
+	// Only the tabs under the first trigram can be under all of them, so
+	// each of those is checked against the rest.
+	ids := make([]string, 0)
+
+	for id := range ms.trigrams[trigrams[0]] {
+		found := true
+		for _, trigram := range trigrams[1:] {
+			found = found && ms.trigrams[trigram][id]
+		}
+
+		if found {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// ResetSearchIndex removes every tab from the search index, and returns how
+// many trigrams and tabs were in it.
+func (ms *MemoryStore) ResetSearchIndex() (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	removed := int64(len(ms.trigrams) + len(ms.tabTrigrams))
+
+	ms.trigrams = make(map[string]map[string]bool)
+	ms.tabTrigrams = make(map[string][]string)
+
+	return removed, nil
+}
+
+// browseEntries returns the entries in the browse index which the tab
+// belongs under: "artist:" followed by the browseName of its artist, and
+// "tag:" followed by that of each of its tags.
+func browseEntries(tab *Tab) []string {
+	entries := make([]string, 0, len(tab.Tags)+1)
+
+	if artist := browseName(tab.Artist); artist != "" {
+		entries = append(entries, "artist:"+artist)
+	}
+
+	for _, tag := range tab.Tags {
+		if tag := browseName(tag); tag != "" {
+			entries = append(entries, "tag:"+tag)
+		}
+	}
+
+	return entries
+}
+
+// AddToBrowseIndex adds a tab to the browse index, under its artist and each
+// of its tags.
+func (ms *MemoryStore) AddToBrowseIndex(tab *Tab) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.addToBrowseIndex(tab)
+
+	return nil
+}
+
+// addToBrowseIndex does what AddToBrowseIndex does, for when the lock is
+// already held for writing.
+func (ms *MemoryStore) addToBrowseIndex(tab *Tab) {
+	for _, entry := range browseEntries(tab) {
+		if ms.browse[entry] == nil {
+			ms.browse[entry] = make(map[string]bool)
+		}
+
+		ms.browse[entry][tab.ID] = true
+	}
+
+	if artist := browseName(tab.Artist); artist != "" {
+		ms.artistNames[artist] = tab.Artist
+	}
+
+	if tab.Explicit {
+		ms.browseExplicit[tab.ID] = true
+	}
+}
+
+// RemoveFromBrowseIndex takes a tab out of the browse index. If it was its
+// artist's last tab, the artist's name is forgotten too.
+func (ms *MemoryStore) RemoveFromBrowseIndex(tab *Tab) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.removeFromBrowseIndex(tab)
+
+	if artist := browseName(tab.Artist); artist != "" && len(ms.browse["artist:"+artist]) == 0 {
+		delete(ms.artistNames, artist)
+	}
+
+	return nil
+}
+
+// removeFromBrowseIndex takes a tab out of the browse index, for when the
+// lock is already held for writing. Unlike RemoveFromBrowseIndex, the
+// artist's name is kept, so it should only be used when the tab is added
+// again under the same artist.
+func (ms *MemoryStore) removeFromBrowseIndex(tab *Tab) {
+	for _, entry := range browseEntries(tab) {
+		delete(ms.browse[entry], tab.ID)
+
+		if len(ms.browse[entry]) == 0 {
+			delete(ms.browse, entry)
+		}
+	}
+
+	delete(ms.browseExplicit, tab.ID)
+}
+
+// MarkBrowseExplicit changes whether the browse index counts the tab with
+// the given ID as explicit.
+func (ms *MemoryStore) MarkBrowseExplicit(id string, explicit bool) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if explicit {
+		ms.browseExplicit[id] = true
+	} else {
+		delete(ms.browseExplicit, id)
+	}
+
+	return nil
+}
+
+// BrowseIDs returns the IDs of the tabs in the browse index under the given
+// kind and browseName.
+func (ms *MemoryStore) BrowseIDs(kind, name string) ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	tabs := ms.browse[kind+":"+name]
+	ids := make([]string, 0, len(tabs))
+
+	for id := range tabs {
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// ArtistCounts returns a map from each artist in the browse index, as their
+// name was written, to how many tabs they have. If explicit is false,
+// explicit tabs aren't counted, and the artists who only have explicit tabs
+// are left out.
+func (ms *MemoryStore) ArtistCounts(explicit bool) (map[string]int, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	counts := make(map[string]int, len(ms.artistNames))
+
+	for artist, name := range ms.artistNames {
+		count := 0
+		for id := range ms.browse["artist:"+artist] {
+			if explicit || !ms.browseExplicit[id] {
+				count++
+			}
+		}
+
+		if explicit || count > 0 {
+			counts[name] += count
+		}
+	}
+
+	return counts, nil
+}
+
+// ResetBrowseIndex removes every tab from the browse index, and returns how
+// many artists and tags were in it, counting the artists' names and the
+// explicit tabs as one each.
+func (ms *MemoryStore) ResetBrowseIndex() (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	removed := int64(len(ms.browse))
+	if len(ms.artistNames) > 0 {
+		removed++
+	}
+
+	if len(ms.browseExplicit) > 0 {
+		removed++
+	}
+
+	ms.browse = make(map[string]map[string]bool)
+	ms.artistNames = make(map[string]string)
+	ms.browseExplicit = make(map[string]bool)
+
+	return removed, nil
+}
+
+// ReindexTabs replaces the counters and index entries of each tab in old
+// with the ones of the tab with the same ID in current, while holding the
+// lock, so that nothing sees some of them changed and others not.
+func (ms *MemoryStore) ReindexTabs(old []*Tab, current map[string]*Tab) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, tab := range old {
+		ms.recordStats(tab, -1)
+		ms.unindexTab(tab.ID)
+		ms.removeFromBrowseIndex(tab)
+
+		if now, ok := current[tab.ID]; ok {
+			ms.recordStats(now, 1)
+			ms.indexTab(now)
+			ms.addToBrowseIndex(now)
+		}
+	}
+
+	return nil
+}
+
+// IndexVersion returns the version of the layout which the index with the
+// given name was built with, or an empty string if it hasn't been built.
+func (ms *MemoryStore) IndexVersion(index string) (string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return ms.indexVersions[index], nil
+}
+
+// SetIndexVersion changes the version of the layout which the index with the
+// given name was built with. An empty version means that it hasn't been
+// built.
+func (ms *MemoryStore) SetIndexVersion(index, version string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if version == "" {
+		delete(ms.indexVersions, index)
+	} else {
+		ms.indexVersions[index] = version
+	}
+
+	return nil
+}
+
+// Recordings returns every recording, in no particular order.
+func (ms *MemoryStore) Recordings() ([]*Recording, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	recordings := make([]*Recording, 0, len(ms.recordings))
+
+	for id := range ms.recordings {
+		recording := &Recording{}
+		if _, err := getJSON(ms.recordings, id, recording); err != nil {
+			return nil, err
+		}
+
+		recordings = append(recordings, recording)
+	}
+
+	return recordings, nil
+}
+
+// Recording returns the recording with the given ID. The second return value
+// is false if there is no such recording.
+func (ms *MemoryStore) Recording(id string) (*Recording, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	recording := &Recording{}
+	ok, err := getJSON(ms.recordings, id, recording)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return recording, true, nil
+}
+
+// PutRecording stores a recording, which must already have an ID.
+func (ms *MemoryStore) PutRecording(recording *Recording) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return putJSON(ms.recordings, recording.ID, recording)
+}
+
+// DeleteRecording removes the recording with the given ID, along with its
+// waveform.
+func (ms *MemoryStore) DeleteRecording(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.recordings, id)
+	delete(ms.waveforms, id)
+
+	return nil
+}
+
+// Waveform returns the JSON of the waveform of the recording with the given
+// ID. The second return value is false if it doesn't have one.
+func (ms *MemoryStore) Waveform(id string) ([]byte, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	waveform, ok := ms.waveforms[id]
+	if !ok {
+		return nil, false, nil
+	}
+
+	return append([]byte(nil), waveform...), true, nil
+}
+
+// PutWaveform stores the JSON of the waveform of the recording with the given
+// ID.
+func (ms *MemoryStore) PutWaveform(id string, waveform []byte) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.waveforms[id] = append([]byte(nil), waveform...)
+
+	return nil
+}
+
+// IntegritySnapshots returns up to the given number of the most recent
+// snapshots, newest first.
+func (ms *MemoryStore) IntegritySnapshots(count int) ([]*integritySnapshot, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	encoded := ms.snapshots
+	if count >= 0 && count < len(encoded) {
+		encoded = encoded[:count]
+	}
+
+	snapshots := make([]*integritySnapshot, 0, len(encoded))
+
+	for _, data := range encoded {
+		snapshot := new(integritySnapshot)
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
+// IntegrityHashes returns a map from the ID of every tab in the latest
+// snapshot to its content hash.
+func (ms *MemoryStore) IntegrityHashes() (map[string]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return copyStrings(ms.hashes), nil
+}
+
+// AddIntegritySnapshot stores a snapshot as the latest one, along with the
+// content hashes which were found. Only the given number of the most recent
+// snapshots are kept.
+func (ms *MemoryStore) AddIntegritySnapshot(snapshot *integritySnapshot, hashes map[string]string, keep int) error {
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.snapshots = append([][]byte{encoded}, ms.snapshots...)
+	if len(ms.snapshots) > keep {
+		ms.snapshots = ms.snapshots[:keep]
+	}
+
+	ms.hashes = copyStrings(hashes)
+
+	return nil
+}
+
+// Setlists returns every setlist, in no particular order.
+func (ms *MemoryStore) Setlists() ([]*Setlist, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	setlists := make([]*Setlist, 0, len(ms.setlists))
+
+	for id := range ms.setlists {
+		setlist := &Setlist{}
+		if _, err := getJSON(ms.setlists, id, setlist); err != nil {
+			return nil, err
+		}
+
+		setlists = append(setlists, setlist)
+	}
+
+	return setlists, nil
+}
+
+// Setlist returns the setlist with the given ID. The second return value is
+// false if there is no such setlist.
+func (ms *MemoryStore) Setlist(id string) (*Setlist, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	setlist := &Setlist{}
+	ok, err := getJSON(ms.setlists, id, setlist)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return setlist, true, nil
+}
+
+// PutSetlist stores a setlist, which must already have an ID.
+func (ms *MemoryStore) PutSetlist(setlist *Setlist) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return putJSON(ms.setlists, setlist.ID, setlist)
+}
+
+// DeleteSetlist removes the setlist with the given ID.
+func (ms *MemoryStore) DeleteSetlist(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.setlists, id)
+
+	return nil
+}
+
+// SongRequests returns every song on the wishlist, in no particular order.
+func (ms *MemoryStore) SongRequests() ([]*SongRequest, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	requests := make([]*SongRequest, 0, len(ms.songRequests))
+
+	for id := range ms.songRequests {
+		request := &SongRequest{}
+		if _, err := getJSON(ms.songRequests, id, request); err != nil {
+			return nil, err
+		}
+
+		requests = append(requests, request)
+	}
+
+	return requests, nil
+}
+
+// SongRequestIDs returns the IDs of every song on the wishlist.
+func (ms *MemoryStore) SongRequestIDs() ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	ids := make([]string, 0, len(ms.songRequests))
+	for id := range ms.songRequests {
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// SongRequest returns the song on the wishlist with the given ID. The second
+// return value is false if there is no such song.
+func (ms *MemoryStore) SongRequest(id string) (*SongRequest, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	request := &SongRequest{}
+	ok, err := getJSON(ms.songRequests, id, request)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return request, true, nil
+}
+
+// PutSongRequest stores a song request, which must already have an ID.
+func (ms *MemoryStore) PutSongRequest(request *SongRequest) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return putJSON(ms.songRequests, request.ID, request)
+}
+
+// DeleteSongRequests takes the songs with the given IDs off the wishlist,
+// along with who voted for them.
+func (ms *MemoryStore) DeleteSongRequests(ids ...string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, id := range ids {
+		delete(ms.songRequests, id)
+		delete(ms.voters, id)
+	}
+
+	return nil
+}
+
+// SongRequestVoters returns everyone who has voted for the song with the
+// given ID.
+func (ms *MemoryStore) SongRequestVoters(id string) ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return append([]string{}, ms.voters[id]...), nil
+}
+
+// SetSongRequestVoters changes who has voted for the song with the given ID.
+func (ms *MemoryStore) SetSongRequestVoters(id string, voters []string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.voters[id] = append([]string{}, voters...)
+
+	return nil
+}
+
+// Views returns every view, by name.
+func (ms *MemoryStore) Views() (map[string]*view, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	views := make(map[string]*view, len(ms.views))
+
+	for name := range ms.views {
+		v := &view{}
+		if _, err := getJSON(ms.views, name, v); err != nil {
+			return nil, err
+		}
+
+		views[name] = v
+	}
+
+	return views, nil
+}
+
+// View returns the view with the given name. The second return value is
+// false if there is no such view.
+func (ms *MemoryStore) View(name string) (*view, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	v := &view{}
+	ok, err := getJSON(ms.views, name, v)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return v, true, nil
+}
+
+// PutView stores a view, replacing any which already has the same name.
+func (ms *MemoryStore) PutView(name string, v *view) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return putJSON(ms.views, name, v)
+}
+
+// DeleteView removes the view with the given name. The return value is false
+// if there was no such view.
+func (ms *MemoryStore) DeleteView(name string) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	_, ok := ms.views[name]
+	delete(ms.views, name)
+
+	return ok, nil
+}
+
+// Favourites returns the IDs of the owner's favourite tabs.
+func (ms *MemoryStore) Favourites(owner string) ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	ids := make([]string, 0)
+
+	if favourites, ok := ms.favourites.get(owner); ok {
+		for id := range favourites.(map[string]bool) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// AddFavourites adds to the owner's favourites. If expiry isn't 0, they are
+// forgotten once it has passed without them changing again.
+func (ms *MemoryStore) AddFavourites(owner string, ids []string, expiry time.Duration) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	favourites, ok := ms.favourites.get(owner)
+	if !ok {
+		favourites = make(map[string]bool)
+		ms.favourites.set(owner, favourites, 0)
+	}
+
+	for _, id := range ids {
+		favourites.(map[string]bool)[id] = true
+	}
+
+	if expiry != 0 {
+		ms.favourites.expire(owner, expiry)
+	}
+
+	return nil
+}
+
+// RemoveFavourite takes a tab out of the owner's favourites. If expiry isn't
+// 0, the rest are forgotten once it has passed without them changing again.
+// An owner with no favourites left is forgotten straight away.
+func (ms *MemoryStore) RemoveFavourite(owner, id string, expiry time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	favourites, ok := ms.favourites.get(owner)
+	if !ok {
+		return nil
+	}
+
+	delete(favourites.(map[string]bool), id)
+
+	if len(favourites.(map[string]bool)) == 0 {
+		ms.favourites.remove(owner)
+	} else if expiry != 0 {
+		ms.favourites.expire(owner, expiry)
+	}
+
+	return nil
+}
+
+// ExpireFavourites makes the owner's favourites last for the given duration
+// from now.
+func (ms *MemoryStore) ExpireFavourites(owner string, expiry time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.favourites.expire(owner, expiry)
+
+	return nil
+}
+
+// FavouriteOwners returns everyone who has any favourites.
+func (ms *MemoryStore) FavouriteOwners() ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return ms.favourites.keys(), nil
+}
+
+// MoveFavourites replaces the tab with the ID from with the tab with the ID
+// to in everyone's favourites.
+func (ms *MemoryStore) MoveFavourites(from, to string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, owner := range ms.favourites.keys() {
+		favourites, _ := ms.favourites.get(owner)
+
+		if set := favourites.(map[string]bool); set[from] {
+			delete(set, from)
+			set[to] = true
+		}
+	}
+
+	return nil
+}
+
+// TagRules returns every tag rule.
+func (ms *MemoryStore) TagRules() (map[string]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return copyStrings(ms.tagRules), nil
+}
+
+// UpdateTagRules removes the rules for the tags in removed, and then adds or
+// changes the ones in changed.
+func (ms *MemoryStore) UpdateTagRules(changed map[string]string, removed []string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, tag := range removed {
+		delete(ms.tagRules, tag)
+	}
+
+	for tag, to := range changed {
+		ms.tagRules[tag] = to
+	}
+
+	return nil
+}
+
+// ReplaceTagRules replaces every tag rule.
+func (ms *MemoryStore) ReplaceTagRules(rules map[string]string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.tagRules = copyStrings(rules)
+
+	return nil
+}
+
+// EditLock returns the lock of the tab with the given ID. The second return
+// value is false if it isn't locked.
+func (ms *MemoryStore) EditLock(id string) (*editLock, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	encoded, ok := ms.editLocks.get(id)
+	if !ok {
+		return nil, false, nil
+	}
+
+	lock := &editLock{}
+	if err := json.Unmarshal(encoded.([]byte), lock); err != nil {
+		return nil, false, err
+	}
+
+	return lock, true, nil
+}
+
+// PutEditLock locks the tab with the given ID until the duration has passed.
+func (ms *MemoryStore) PutEditLock(id string, lock *editLock, duration time.Duration) error {
+	encoded, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.editLocks.set(id, encoded, duration)
+
+	return nil
+}
+
+// DeleteEditLock unlocks the tab with the given ID.
+func (ms *MemoryStore) DeleteEditLock(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.editLocks.remove(id)
+
+	return nil
+}
+
+// CollabVersion returns the version of the room of the tab with the given ID
+// when it was last saved. The second return value is false if it has never
+// been saved.
+func (ms *MemoryStore) CollabVersion(id string) (int, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	version, ok := ms.collabVersions[id]
+	return version, ok, nil
+}
+
+// SetCollabVersion changes the version of the room of the tab with the given
+// ID.
+func (ms *MemoryStore) SetCollabVersion(id string, version int) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.collabVersions[id] = version
+
+	return nil
+}
+
+// KeepPreviousContent keeps some old content of the tab with the given ID,
+// which has the given hash, until the duration has passed.
+func (ms *MemoryStore) KeepPreviousContent(id, hash, content string, duration time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.previousContent.set(id+":"+hash, content, duration)
+
+	return nil
+}
+
+// PreviousContent returns the old content with the given hash of the tab
+// with the given ID. The second return value is false if it isn't being kept.
+func (ms *MemoryStore) PreviousContent(id, hash string) (string, bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	content, ok := ms.previousContent.get(id + ":" + hash)
+	if !ok {
+		return "", false, nil
+	}
+
+	return content.(string), true, nil
+}
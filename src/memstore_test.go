@@ -0,0 +1,177 @@
+package src
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTabs(t *testing.T) {
+	store := NewMemoryStore(DefaultSettings())
+
+	tab := &Tab{Title: "Help", Artist: "The Beatles", Filename: "the beatles - help.txt"}
+	if err := store.PutTab(tab); err != nil {
+		t.Fatal(err)
+	}
+
+	if tab.ID != "1" {
+		t.Errorf("expected the first tab to get the ID 1, got %q", tab.ID)
+	}
+
+	if id, ok, _ := store.TabID(tab.Filename); !ok || id != "1" {
+		t.Errorf("expected the filename to map to 1, got %q", id)
+	}
+
+	restored := &Tab{ID: "5", Title: "Waterloo", Artist: "Abba", Filename: "abba - waterloo.txt"}
+	if err := store.RestoreTab(restored); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RestoreTab(&Tab{ID: "5", Filename: "other.txt"}); err == nil {
+		t.Error("expected restoring a tab with an ID in use to fail")
+	}
+
+	next := &Tab{Title: "SOS", Artist: "Abba", Filename: "abba - sos.txt"}
+	if err := store.PutTab(next); err != nil {
+		t.Fatal(err)
+	}
+
+	if next.ID != "6" {
+		t.Errorf("expected new tabs to be given IDs after the restored one, got %q", next.ID)
+	}
+
+	if err := store.AddExtraTags("1", []string{"favourite"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteTab("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := store.GetTab("1"); ok {
+		t.Error("expected the deleted tab to be gone")
+	}
+
+	if tags, _ := store.ExtraTags("1"); len(tags) != 0 {
+		t.Errorf("expected the deleted tab's extra tags to be gone, got %v", tags)
+	}
+}
+
+func TestMemoryStoreEvents(t *testing.T) {
+	store := NewMemoryStore(DefaultSettings())
+
+	for _, kind := range []string{"first", "second", "third", "fourth", "fifth"} {
+		if err := store.AddEvent(loggedEvent{Type: kind}, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	latest, _ := store.LatestEventID()
+
+	all, err := store.EventsAfter("0-0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The log is only trimmed once it is a quarter too long, which it
+	// becomes with the fifth event.
+	if len(all) != 4 || all[0].Type != "second" || all[3].ID != latest {
+		t.Fatalf("expected the four newest events, got %v", all)
+	}
+
+	for i := 1; i < len(all); i++ {
+		before, _ := parseEventID(all[i-1].ID)
+		after, _ := parseEventID(all[i].ID)
+
+		if !eventIDAfter(after, before) {
+			t.Errorf("expected %s to be after %s", all[i].ID, all[i-1].ID)
+		}
+	}
+
+	cases := []struct {
+		after string
+		count int64
+		types []string
+	}{
+		{all[0].ID, 10, []string{"third", "fourth", "fifth"}},
+		{all[0].ID, 1, []string{"third"}},
+		{latest, 10, nil},
+	}
+
+	for _, c := range cases {
+		events, err := store.EventsAfter(c.after, c.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var types []string
+		for _, event := range events {
+			types = append(types, event.Type)
+		}
+
+		if fmt.Sprint(types) != fmt.Sprint(c.types) {
+			t.Errorf("after %s: expected %v, got %v", c.after, c.types, types)
+		}
+	}
+
+	if _, err := store.EventsAfter("latest", 10); err == nil {
+		t.Error("expected an ID which isn't one to be rejected")
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	store := NewMemoryStore(DefaultSettings())
+
+	store.CreateSession("short", "0", time.Millisecond)
+	store.CreateSession("long", "0", time.Hour)
+	store.AddFavourites("viewer:1", []string{"1"}, time.Millisecond)
+	store.AddFavourites("token:band", []string{"1"}, 0)
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok, _ := store.Session("short"); ok {
+		t.Error("expected the short session to have expired")
+	}
+
+	if _, ok, _ := store.Session("long"); !ok {
+		t.Error("expected the long session not to have expired")
+	}
+
+	if owners, _ := store.FavouriteOwners(); len(owners) != 1 || owners[0] != "token:band" {
+		t.Errorf("expected only the token's favourites to be left, got %v", owners)
+	}
+
+	// The rate limit's window starts with the first request, and isn't
+	// moved on by the rest.
+	for i := 1; i <= 3; i++ {
+		limited, wait, _ := store.CountRequest("1.2.3.4", 2, time.Minute)
+
+		if limited != (i > 2) {
+			t.Errorf("request %d: expected limited to be %v", i, i > 2)
+		}
+
+		if limited && (wait <= 0 || wait > time.Minute) {
+			t.Errorf("request %d: expected to wait for the rest of the minute, got %s", i, wait)
+		}
+	}
+}
+
+func TestMemoryStoreJobQueue(t *testing.T) {
+	store := NewMemoryStore(DefaultSettings())
+
+	if _, ok, _ := store.NextQueuedJob(time.Millisecond); ok {
+		t.Fatal("expected the queue to start off empty")
+	}
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		store.QueueJob("1")
+		store.QueueJob("2")
+	}()
+
+	for _, expected := range []string{"1", "2"} {
+		if id, ok, _ := store.NextQueuedJob(time.Second); !ok || id != expected {
+			t.Errorf("expected job %s to be next, got %q", expected, id)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+// A tabReferenceMover moves everything which refers to the tab with the ID
+// from over to the tab with the ID to. When two tabs are merged, each of
+// tabReferenceMovers is called so that nothing is left pointing at the tab
+// which is removed. Anything which stores tab IDs, such as favourites or
+// setlists, should add a mover here.
+type tabReferenceMover func(s *Server, from, to string) error
+
+// tabReferenceMovers are all of the functions which move references from one
+// tab to another. The files which define them add them in their init
+// functions.
+var tabReferenceMovers []tabReferenceMover
+
+// mergeTabs merges the tab with the ID remove into the tab with the ID keep.
+// The kept tab keeps its ID, filename and metadata, and gains all of the
+// removed tab's tags. If useRemovedContent is true, the removed tab's content
+// is written into the kept tab's file, replacing its own. Anything referring
+// to the removed tab is moved over to the kept tab, and finally the removed
+// tab and its file are deleted. The pre-delete hook is run for the removed tab
+// before anything is changed, and since it can take a while, the cache lock
+// is only taken once it has finished, and held from then on, so nothing else
+// can see the tabs part way through being merged. If anything goes wrong
+// before the removed tab is deleted, it is left as it was, and an error and
+// error status are returned. The changes are recorded as being made by the
+// given actor.
+func (s *Server) mergeTabs(keep, remove string, useRemovedContent bool, by actor) (*Tab, int, error) {
+	if keep == remove {
+		return nil, http.StatusBadRequest, errors.New("a tab can't be merged with itself")
+	}
+
+	_, removed, status, err := s.tabsToMerge(keep, remove)
+	if err != nil {
+		return nil, status, err
+	}
+
+	if err := s.checkDelete(removed, by); err != nil {
+		return nil, http.StatusConflict, err
+	}
+
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	// Either tab could have been deleted, or changed, while the hook was
+	// running, so they are fetched again now that nothing else can change
+	// them.
+	kept, removed, status, err := s.tabsToMerge(keep, remove)
+	if err != nil {
+		return nil, status, err
+	}
+
+	// A binary tab's file can't be given another tab's content, and has no
+	// content to give.
+	if useRemovedContent && (kept.Binary || removed.Binary) {
+		return nil, http.StatusConflict, errBinaryTab
+	}
+
+	if useRemovedContent {
+		if err := ioutil.WriteFile(s.tabPath(kept.Filename), []byte(removed.Content), 0644); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	// The removed tab's tags are remembered as extra tags of the kept tab,
+	// so that they are added back whenever its file is parsed again.
+	if err := s.Store.AddExtraTags(keep, removed.Tags); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Read the kept tab's file again, which picks up the new content and the
+	// extra tags, and updates the statistics and the search index.
+	fresh, ok, err := s.readTab(kept.Filename, tokenizePatterns(s.Settings.FilenamePatterns))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	} else if !ok {
+		return nil, http.StatusInternalServerError, errors.New("the kept tab's filename no longer matches any of the patterns")
+	}
+
+	if err := s.updateCachedTab(keep, fresh, by); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	for _, move := range tabReferenceMovers {
+		if err := move(s, remove, keep); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	if err := s.deleteTab(remove, by); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	fresh.applyTransformations(s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
+
+	return fresh, http.StatusOK, nil
+}
+
+// tabsToMerge returns the tabs with the IDs keep and remove, or an error and
+// error status if either of them doesn't exist.
+func (s *Server) tabsToMerge(keep, remove string) (*Tab, *Tab, int, error) {
+	kept, ok, err := s.Store.GetTab(keep)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	} else if !ok {
+		return nil, nil, http.StatusNotFound, newAPIError(codeTabNotFound, "no tab with the ID "+keep)
+	}
+
+	removed, ok, err := s.Store.GetTab(remove)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	} else if !ok {
+		return nil, nil, http.StatusNotFound, newAPIError(codeTabNotFound, "no tab with the ID "+remove)
+	}
+
+	return kept, removed, http.StatusOK, nil
+}
+
+// handleMergeTabsAPI is called to respond to a HTTP request to
+// /api/v1/merge-tabs. It merges the tab with the ID in the 'remove' form field
+// into the one with the ID in the 'keep' form field, using the removed tab's
+// content if the 'content' form field is 'remove', and responds with the
+// merged tab encoded in JSON. It will only accept POST requests from a logged
+// in admin.
+func (s *Server) handleMergeTabsAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	var useRemovedContent bool
+
+	switch r.PostFormValue("content") {
+	case "", "keep":
+	case "remove":
+		useRemovedContent = true
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("the content must be from the kept tab or the removed tab"))
+		return
+	}
+
+	tab, status, err := s.mergeTabs(r.PostFormValue("keep"), r.PostFormValue("remove"), useRemovedContent, s.requestActor(r))
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tab)
+}
@@ -0,0 +1,498 @@
+package src
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MigrateTo copies everything from the server's store into another server's, so that the collection can be moved to a new backend
+// without being cached again from scratch. Each tab keeps its ID, its date
+// added and the admin's changes to it, and the settings and admin password
+// are copied too. The target's store mustn't have any tabs yet. progress is
+// called after each tab is copied, with the number copied so far and the
+// total. Once everything has been copied, each tab is read back from the
+// target and checked against the original. The number of tabs copied is
+// returned.
+func (s *Server) MigrateTo(target *Server, progress func(done, total int)) (int, error) {
+	if existing, err := target.Store.ListIDs(); err != nil {
+		return 0, err
+	} else if len(existing) > 0 {
+		return 0, fmt.Errorf("the target already has %d tabs, so it can't be migrated to", len(existing))
+	}
+
+	settings, err := s.Store.LoadSettings()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := target.Store.SaveSettings(settings); err != nil {
+		return 0, err
+	}
+
+	passwordHash, err := s.Store.PasswordHash()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := target.Store.SetPasswordHash(passwordHash); err != nil {
+		return 0, err
+	}
+
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	// The tabs are copied in order of ID, so that if the migration stops
+	// part of the way through, it's easy to see how far it got.
+	sort.Slice(ids, func(i, j int) bool {
+		return len(ids[i]) < len(ids[j]) || (len(ids[i]) == len(ids[j]) && ids[i] < ids[j])
+	})
+
+	copied := 0
+
+	for _, id := range ids {
+		ok, err := s.migrateTab(target, id)
+		if err != nil {
+			return copied, fmt.Errorf("tab %s: %s", id, err)
+		}
+
+		// A tab which was deleted while the others were being copied is
+		// just left out.
+		if ok {
+			copied++
+		}
+
+		if progress != nil {
+			progress(copied, len(ids))
+		}
+	}
+
+	if err := s.migrateData(target); err != nil {
+		return copied, err
+	}
+
+	// The search and browse indexes are built again the next time the
+	// target's server starts.
+	for _, index := range []string{indexSearch, indexBrowse} {
+		if err := target.Store.SetIndexVersion(index, ""); err != nil {
+			return copied, err
+		}
+	}
+
+	if err := target.Store.BumpCollectionVersion(); err != nil {
+		return copied, err
+	}
+
+	if err := s.verifyMigration(target); err != nil {
+		return copied, err
+	}
+
+	// The tabs are copied without publishing an event for each of them, so
+	// consumers of the target's events are told about the whole collection
+	// at once instead.
+	target.publishEvent(eventCollectionMigrated, systemActor(systemMigration), map[string]int{
+		"tabs": copied,
+	})
+
+	return copied, nil
+}
+
+// migrateTab copies the tab with the given ID into the target's store, along
+// with the admin's changes to it, and counts it in the target's statistics.
+// If the tab doesn't exist any more, false is returned.
+func (s *Server) migrateTab(target *Server, id string) (bool, error) {
+	tab, ok, err := s.Store.GetTab(id)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	extraTags, err := s.Store.ExtraTags(id)
+	if err != nil {
+		return false, err
+	}
+
+	// The tab comes back with the admin's override applied, but the store
+	// keeps whether it was detected as explicit, so that is worked out again
+	// for the override to be applied on top of.
+	if tab.ExplicitOverride != explicitOverrideNone {
+		tab.Explicit = detectExplicit(tab.Content)
+	}
+
+	if err := target.Store.RestoreTab(tab); err != nil {
+		return false, err
+	}
+
+	if tab.ExplicitOverride != explicitOverrideNone {
+		if err := target.Store.SetExplicitOverride(tab.ID, tab.ExplicitOverride); err != nil {
+			return false, err
+		}
+	}
+
+	if err := target.Store.AddExtraTags(tab.ID, extraTags); err != nil {
+		return false, err
+	}
+
+	return true, target.recordStats(tab, 1)
+}
+
+// migrateData copies everything else which is worth moving to a new store
+// into the target's, replacing anything the target already has of the same
+// name: the API tokens, the roles' permissions, the views, the setlists, the
+// wishlist of requested songs, the rehearsal recordings, the admin's tag
+// rules, the deleted tabs in the trash, everyone's favourites, the directory
+// the mount sentinel was seen in, the counters which the IDs of the
+// recordings, setlists and song requests are given out from, and the keys
+// which sign shared links and viewer cookies, so that links which have
+// already been shared keep working and viewers keep their favourites. The
+// recordings' files stay in the recording directory, and the trash's files
+// in the tab directory.
+//
+// The rest is either rebuilt from the tabs, like the search and browse
+// indexes and the statistics, or doesn't matter for long, like the sessions,
+// the jobs and the login lockouts, so it isn't copied.
+func (s *Server) migrateData(target *Server) error {
+	for _, migrate := range []func(*Server) error{
+		s.migrateTokens,
+		s.migrateViews,
+		s.migrateSetlists,
+		s.migrateSongRequests,
+		s.migrateRecordings,
+		s.migrateTrash,
+		s.migrateFavourites,
+		s.migrateSecrets,
+		s.migrateMisc,
+	} {
+		if err := migrate(target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateTokens copies the API tokens and the roles' permissions, if they
+// have been changed from the defaults.
+func (s *Server) migrateTokens(target *Server) error {
+	tokens, err := s.Store.Tokens()
+	if err != nil {
+		return err
+	}
+
+	roles, err := s.Store.TokenRoles()
+	if err != nil {
+		return err
+	}
+
+	for hash, name := range tokens {
+		if err := target.Store.PutToken(hash, name, roles[name]); err != nil {
+			return err
+		}
+	}
+
+	permissions, ok, err := s.Store.Roles()
+	if err != nil || !ok {
+		return err
+	}
+
+	return target.Store.SaveRoles(permissions)
+}
+
+// migrateViews copies the saved views.
+func (s *Server) migrateViews(target *Server) error {
+	views, err := s.Store.Views()
+	if err != nil {
+		return err
+	}
+
+	for name, v := range views {
+		if err := target.Store.PutView(name, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateSetlists copies the setlists.
+func (s *Server) migrateSetlists(target *Server) error {
+	setlists, err := s.Store.Setlists()
+	if err != nil {
+		return err
+	}
+
+	for _, setlist := range setlists {
+		if err := target.Store.PutSetlist(setlist); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateSongRequests copies the requested songs, along with who has voted
+// for each of them.
+func (s *Server) migrateSongRequests(target *Server) error {
+	requests, err := s.Store.SongRequests()
+	if err != nil {
+		return err
+	}
+
+	for _, request := range requests {
+		if err := target.Store.PutSongRequest(request); err != nil {
+			return err
+		}
+
+		voters, err := s.Store.SongRequestVoters(request.ID)
+		if err != nil {
+			return err
+		}
+
+		if len(voters) > 0 {
+			if err := target.Store.SetSongRequestVoters(request.ID, voters); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateRecordings copies the recordings, along with their waveforms.
+func (s *Server) migrateRecordings(target *Server) error {
+	recordings, err := s.Store.Recordings()
+	if err != nil {
+		return err
+	}
+
+	for _, recording := range recordings {
+		if err := target.Store.PutRecording(recording); err != nil {
+			return err
+		}
+
+		waveform, ok, err := s.Store.Waveform(recording.ID)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+
+		if err := target.Store.PutWaveform(recording.ID, waveform); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateTrash copies the deleted tabs in the trash.
+func (s *Server) migrateTrash(target *Server) error {
+	trashed, err := s.Store.TrashedTabs()
+	if err != nil {
+		return err
+	}
+
+	for _, tab := range trashed {
+		if err := target.Store.PutTrashedTab(tab.ID, tab); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateFavourites copies everyone's favourites. A viewer's favourites
+// expire as long after the migration as they would after the viewer last
+// changed them.
+func (s *Server) migrateFavourites(target *Server) error {
+	owners, err := s.Store.FavouriteOwners()
+	if err != nil {
+		return err
+	}
+
+	for _, owner := range owners {
+		ids, err := s.Store.Favourites(owner)
+		if err != nil {
+			return err
+		}
+
+		if err := target.Store.AddFavourites(owner, ids, favouritesExpiry(owner)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateSecrets copies the keyring of each purpose.
+func (s *Server) migrateSecrets(target *Server) error {
+	for purpose := range secretPurposes {
+		secrets, err := s.Store.Secrets(purpose)
+		if err != nil {
+			return err
+		}
+
+		if err := target.Store.PutSecrets(purpose, secrets...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateMisc copies the tag rules, the mount sentinel and the ID counters.
+func (s *Server) migrateMisc(target *Server) error {
+	rules, err := s.Store.TagRules()
+	if err != nil {
+		return err
+	}
+
+	if err := target.Store.ReplaceTagRules(rules); err != nil {
+		return err
+	}
+
+	sentinel, err := s.Store.MountSentinel()
+	if err != nil {
+		return err
+	}
+
+	if sentinel != "" {
+		if err := target.Store.SetMountSentinel(sentinel); err != nil {
+			return err
+		}
+	}
+
+	for _, counter := range []string{counterRecordings, counterSetlists, counterSongRequests} {
+		value, err := s.Store.IDCounter(counter)
+		if err != nil {
+			return err
+		}
+
+		if err := target.Store.SetIDCounter(counter, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyMigration checks that the target has exactly the same tabs as the
+// server, with the same files, content and admin's changes. If anything is
+// different, an error describes how many tabs are.
+func (s *Server) verifyMigration(target *Server) error {
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		return err
+	}
+
+	targetIDs, err := target.Store.ListIDs()
+	if err != nil {
+		return err
+	}
+
+	if len(ids) != len(targetIDs) {
+		return fmt.Errorf("the target has %d tabs, but there are %d to migrate", len(targetIDs), len(ids))
+	}
+
+	different := 0
+
+	for _, id := range ids {
+		same, err := s.sameTab(target, id)
+		if err != nil {
+			return err
+		}
+
+		if !same {
+			different++
+		}
+	}
+
+	if different > 0 {
+		return fmt.Errorf("%d tabs are different in the target", different)
+	}
+
+	return nil
+}
+
+// sameTab reports whether the tab with the given ID is the same in the
+// server's store and the target's.
+func (s *Server) sameTab(target *Server, id string) (bool, error) {
+	tab, ok, err := s.Store.GetTab(id)
+	if err != nil {
+		return false, err
+	}
+
+	migrated, migratedOK, err := target.Store.GetTab(id)
+	if err != nil {
+		return false, err
+	} else if ok != migratedOK {
+		return false, nil
+	} else if !ok {
+		return true, nil
+	}
+
+	// The date added is only compared to the second, since that's all
+	// which the Redis store keeps.
+	if tab.Filename != migrated.Filename ||
+		tab.ContentHash != migrated.ContentHash ||
+		tab.Explicit != migrated.Explicit ||
+		tab.ExplicitOverride != migrated.ExplicitOverride ||
+		tab.Source != migrated.Source ||
+		tab.Practice != migrated.Practice ||
+		tab.Added.Unix() != migrated.Added.Unix() {
+		return false, nil
+	}
+
+	extraTags, err := s.Store.ExtraTags(id)
+	if err != nil {
+		return false, err
+	}
+
+	migratedTags, err := target.Store.ExtraTags(id)
+	if err != nil {
+		return false, err
+	}
+
+	return sameStrings(extraTags, migratedTags), nil
+}
+
+// sameStrings reports whether a and b hold the same strings, in any order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[string]int, len(a))
+	for _, str := range a {
+		counts[str]++
+	}
+
+	for _, str := range b {
+		if counts[str] == 0 {
+			return false
+		}
+
+		counts[str]--
+	}
+
+	return true
+}
+
+// RestoreDump restores the tabs, settings and tag rules from a dump written
+// by Export, so that the migrate command can copy them from one, reading each
+// tab from its file in the tab directory, which isn't changed. Tabs whose
+// files are missing are left out. The number of tabs restored is returned.
+func (s *Server) RestoreDump(r io.Reader) (int, error) {
+	lib, err := readLibrary(r)
+	if err != nil {
+		return 0, err
+	}
+
+	summary, err := s.Restore(lib, false, true, systemActor(systemMigration))
+	if err != nil {
+		return 0, err
+	}
+
+	return summary.Restored, nil
+}
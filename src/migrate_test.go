@@ -0,0 +1,121 @@
+package src_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/Zac-Garby/tab-server/src/tabtest"
+)
+
+func TestMigrateCopiesData(t *testing.T) {
+	settings := tabtest.NewSettings().TrashDays(30).Build()
+
+	s, handler := tabtest.NewServer(t, settings,
+		tabtest.NewTab("Abba", "Waterloo").ID("1").Content("[C]My my").Tags("live").Build(),
+		tabtest.NewTab("Abba", "SOS").ID("2").Build(),
+	)
+
+	cookies := tabtest.LogIn(t, handler, tabtest.Password)
+
+	// As much as possible is done, so that the server keeps every kind of
+	// data which is migrated.
+	requests := []struct {
+		path string
+		form url.Values
+	}{
+		{"/api/v1/login", url.Values{"password": {"wrong"}}},
+		{"/api/v1/tokens", url.Values{"name": {"band"}, "role": {"viewer"}}},
+		{"/api/v1/views", url.Values{"name": {"recent"}, "view": {`{"sort":"-added"}`}}},
+		{"/api/v1/setlists", url.Values{"name": {"Gig"}, "tabs": {`["1"]`}}},
+		{"/api/v1/song-requests", url.Values{"song": {"Dancing Queen"}, "artist": {"Abba"}}},
+		{"/api/v1/favourite", url.Values{"id": {"1"}}},
+		{"/api/v1/now-showing", url.Values{"state": {"viewing"}, "id": {"1"}}},
+		{"/api/v1/tab/1/lock", url.Values{}},
+		{"/api/v1/sign-url", url.Values{"path": {"/api/v1/download/1"}}},
+		{"/api/v1/rename-tag", url.Values{"tag": {"live"}, "to": {"unplugged"}}},
+		{"/api/v1/delete-tab", url.Values{"id": {"2"}}},
+		{"/api/v1/jobs", url.Values{"kind": {"rescan"}}},
+	}
+
+	for _, request := range requests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, tabtest.NewRequest("POST", request.path, request.form, cookies))
+
+		if w.Code != http.StatusOK && request.path != "/api/v1/login" {
+			t.Errorf("%s: expected 200, got %d: %s", request.path, w.Code, w.Body)
+		}
+	}
+
+	// Changing a tab's file keeps its previous content.
+	if err := ioutil.WriteFile(filepath.Join(s.Settings.TabDirectory, "Abba - Waterloo.txt"), []byte("[G]My my"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Rescan()
+
+	target, _ := tabtest.NewServer(t, tabtest.NewSettings().Build())
+
+	copied, err := s.MigrateTo(target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if copied != 1 {
+		t.Errorf("expected 1 tab to be copied, got %d", copied)
+	}
+
+	counts := map[string]func() (int, error){
+		"tokens": func() (int, error) {
+			tokens, err := target.Store.Tokens()
+			return len(tokens), err
+		},
+		"views": func() (int, error) {
+			views, err := target.Store.Views()
+			return len(views), err
+		},
+		"setlists": func() (int, error) {
+			setlists, err := target.Store.Setlists()
+			return len(setlists), err
+		},
+		"song requests": func() (int, error) {
+			requests, err := target.Store.SongRequests()
+			return len(requests), err
+		},
+		"trashed tabs": func() (int, error) {
+			trashed, err := target.Store.TrashedTabs()
+			return len(trashed), err
+		},
+		"favourites": func() (int, error) {
+			owners, err := target.Store.FavouriteOwners()
+			return len(owners), err
+		},
+		"tag rules": func() (int, error) {
+			rules, err := target.Store.TagRules()
+			return len(rules), err
+		},
+		"URL signing keys": func() (int, error) {
+			secrets, err := target.Store.Secrets("url-signing")
+			return len(secrets), err
+		},
+	}
+
+	for name, count := range counts {
+		if n, err := count(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if n == 0 {
+			t.Errorf("expected the %s to be migrated", name)
+		}
+	}
+
+	// The setlist's ID is given out again from where the source got to,
+	// rather than starting again and replacing it.
+	if counter, err := target.Store.IDCounter("setlist-id"); err != nil {
+		t.Fatal(err)
+	} else if counter != 1 {
+		t.Errorf("expected the setlist counter to be 1, got %d", counter)
+	}
+}
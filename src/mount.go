@@ -0,0 +1,253 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// The tab directory is often a network share, and if it isn't mounted, the
+// folder it would be mounted on is usually still there, but empty. From the
+// server's point of view, that looks the same as every file having been
+// deleted, so without checking, it would remove every tab from the cache. So,
+// before removing any tabs because their files have gone, the server checks
+// that the directory looks mounted:
+//
+//   - If the admin has put a sentinel file, called .tab-server-mounted, in the
+//     tab directory, the server remembers that it has seen it, and from then
+//     on the directory only counts as mounted while the file is there. This is
+//     the reliable way, since it works however many files have gone.
+//
+//   - Otherwise, a sample of the cached tabs' files is checked. If all of them
+//     have gone, or at least unmountedFraction of them in a collection of at
+//     least minMountCheckTabs tabs, the directory is taken to be unmounted,
+//     since most of a collection is very rarely deleted on purpose. This also
+//     catches a folder inside the tab directory which is a mount of its own.
+//     Tabs can still be deleted one at a time through the API, and an admin
+//     who does want to delete most of the files at once can add the sentinel.
+//
+// While the directory doesn't look mounted, nothing is removed from the cache,
+// the cached tabs carry on being served, and the problem is reported by
+// /readyz and /api/v1/admin/overview.
+const (
+	mountSentinel = ".tab-server-mounted"
+
+	// mountCheckSample is the most cached tabs whose files are checked, so
+	// that the check stays quick for large collections.
+	mountCheckSample = 200
+
+	// unmountedFraction is the fraction of the files checked which have to
+	// have gone for the directory to be taken to be unmounted, as long as
+	// at least minMountCheckTabs were checked. With fewer than that, every
+	// one of them has to have gone.
+	unmountedFraction = 0.5
+	minMountCheckTabs = 10
+)
+
+// errTabDirectoryUnmounted is returned instead of removing tabs whose files
+// have gone, when that's because the tab directory doesn't look mounted.
+var errTabDirectoryUnmounted = newAPIError(codeTabDirectoryUnmounted, "the tab directory doesn't look mounted, so no tabs have been removed")
+
+// mountProblem checks that the tab directory looks mounted, returning why it
+// doesn't, or an empty string if it does.
+func (s *Server) mountProblem() (string, error) {
+	dir := s.Settings.TabDirectory
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Sprintf("The tab directory %s can't be read: %s", dir, err), nil
+	} else if !info.IsDir() {
+		return fmt.Sprintf("The tab directory %s isn't a directory", dir), nil
+	}
+
+	// The sentinel is remembered along with the directory it was seen in,
+	// so that changing the tab directory doesn't make the new one need a
+	// sentinel too.
+	seenIn, err := s.Store.MountSentinel()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, mountSentinel)); err == nil {
+		if seenIn != dir {
+			if err := s.Store.SetMountSentinel(dir); err != nil {
+				return "", err
+			}
+		}
+
+		return "", nil
+	} else if seenIn == dir {
+		return fmt.Sprintf("The sentinel file %s has gone from the tab directory %s, so it probably isn't mounted", mountSentinel, dir), nil
+	}
+
+	// The filenames come out of the map in no particular order, so the
+	// sample is spread across the whole collection.
+	filenames, err := s.Store.Filenames()
+	if err != nil {
+		return "", err
+	}
+
+	checked, missing := 0, 0
+
+	for filename := range filenames {
+		if checked == mountCheckSample {
+			break
+		}
+
+		checked++
+
+		if _, err := os.Lstat(s.tabPath(filename)); os.IsNotExist(err) {
+			missing++
+		}
+	}
+
+	if checked > 0 && missing == checked {
+		return fmt.Sprintf("None of the files of the %d cached tabs which were checked are in the tab directory %s, so it probably isn't mounted", checked, dir), nil
+	} else if checked >= minMountCheckTabs && float64(missing) >= unmountedFraction*float64(checked) {
+		return fmt.Sprintf("The files of %d of the %d cached tabs which were checked have gone from the tab directory %s, so it, or a folder in it, probably isn't mounted", missing, checked, dir), nil
+	}
+
+	return "", nil
+}
+
+// checkMounted returns errTabDirectoryUnmounted, and logs why, if the tab
+// directory doesn't look mounted. It is called before removing any tabs
+// whose files have gone.
+func (s *Server) checkMounted() error {
+	problem, err := s.mountProblem()
+	if err != nil {
+		return err
+	} else if problem == "" {
+		return nil
+	}
+
+	s.logMessage("warn", "warning: %s. No tabs will be removed until it is.", problem)
+	return errTabDirectoryUnmounted
+}
+
+// cachedTabs returns every cached tab, with transformations applied, without
+// looking at the tab directory at all. It is used in place of getTabs while
+// the directory doesn't look mounted.
+func (s *Server) cachedTabs() ([]*Tab, error) {
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	tabs, err := s.Store.GetTabs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tab := range tabs {
+		tab.applyTransformations(s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
+	}
+
+	return tabs, nil
+}
+
+// A readiness is the body of the response from /readyz.
+type readiness struct {
+	// Status is "ready" if everything is fine, "warning" if the server
+	// can serve requests but something needs looking at, and "unavailable"
+	// if it can't serve them properly.
+	Status   string   `json:"status"`
+	Warnings []string `json:"warnings"`
+}
+
+// handleReadyz is called to respond to a HTTP request to /readyz, which load
+// balancers and orchestrators can use to tell whether the server is ready to
+// be sent requests. It responds with 503 Service Unavailable if the database
+// can't be reached, and otherwise 200 OK, with any warnings, such as the tab
+// directory not looking mounted, in the body. The cached tabs can still be
+// served while the directory isn't mounted, so that doesn't make it
+// unavailable.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+
+	ready := readiness{Status: "ready", Warnings: make([]string, 0)}
+
+	// Anyone can ask, so the warnings don't say any more than what's wrong.
+	// The admin can find out the details from /api/v1/admin/overview.
+	if err := s.Store.Ping(); err != nil {
+		ready.Status = "unavailable"
+		ready.Warnings = append(ready.Warnings, "The database can't be reached")
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ready)
+		return
+	}
+
+	if problem, err := s.mountProblem(); err != nil {
+		ready.Status = "warning"
+		ready.Warnings = append(ready.Warnings, "The tab directory couldn't be checked")
+	} else if problem != "" {
+		ready.Status = "warning"
+		ready.Warnings = append(ready.Warnings, "The tab directory doesn't look mounted")
+	}
+
+	json.NewEncoder(w).Encode(ready)
+}
+
+// An overview summarises the state of the server for the admin.
+type overview struct {
+	TabDirectory      string `json:"tabDirectory"`
+	Tabs              int    `json:"tabs"`
+	CollectionVersion int64  `json:"collectionVersion"`
+
+	// Warnings describe anything which needs the admin's attention, such
+	// as the tab directory not looking mounted. It is empty if everything
+	// looks fine.
+	Warnings []string `json:"warnings"`
+
+	// Integrity is the most recent integrity snapshot, or nil if none have
+	// been taken yet.
+	Integrity *integritySnapshot `json:"integrity"`
+}
+
+// handleOverviewAPI is called to respond to a HTTP request to
+// /api/v1/admin/overview. It responds with an overview of the server's state,
+// encoded in JSON.
+func (s *Server) handleOverviewAPI(w http.ResponseWriter, r *http.Request) {
+	summary := overview{
+		TabDirectory: s.Settings.TabDirectory,
+		Warnings:     make([]string, 0),
+	}
+
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	summary.Tabs = len(ids)
+
+	if summary.CollectionVersion, err = s.Store.CollectionVersion(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	problem, err := s.mountProblem()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if problem != "" {
+		summary.Warnings = append(summary.Warnings, problem)
+	}
+
+	snapshot, ok, err := s.latestIntegritySnapshot()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if ok {
+		summary.Integrity = snapshot
+		summary.Warnings = append(summary.Warnings, snapshot.Alerts...)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,57 @@
+package src_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Zac-Garby/tab-server/src"
+	"github.com/Zac-Garby/tab-server/src/tabtest"
+)
+
+func TestPruneRefusedWhenMostFilesHaveGone(t *testing.T) {
+	var tabs []*src.Tab
+	for i := 1; i <= 12; i++ {
+		tabs = append(tabs, tabtest.NewTab("Abba", fmt.Sprintf("Song %d", i)).Build())
+	}
+
+	s, handler := tabtest.NewServer(t, nil, tabs...)
+	cookies := tabtest.LogIn(t, handler, tabtest.Password)
+
+	remove := func(from, to int) {
+		for i := from; i <= to; i++ {
+			if err := os.Remove(filepath.Join(s.Settings.TabDirectory, fmt.Sprintf("Abba - Song %d.txt", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	prune := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, tabtest.NewRequest("POST", "/api/v1/prune-orphans", url.Values{}, cookies))
+		return w
+	}
+
+	// A single file going is an ordinary deletion.
+	remove(1, 1)
+
+	if w := prune(); w.Code != http.StatusOK {
+		t.Fatalf("expected one tab to be pruned, got %d: %s", w.Code, w.Body)
+	}
+
+	// Most of the rest going at once looks like an unmounted folder, even
+	// though the tab directory isn't empty.
+	remove(2, 8)
+
+	if w := prune(); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the prune to be refused, got %d: %s", w.Code, w.Body)
+	}
+
+	if ids, _ := s.Store.ListIDs(); len(ids) != 11 {
+		t.Errorf("expected 11 tabs to be left cached, got %d", len(ids))
+	}
+}
@@ -0,0 +1,365 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// The server can publish to an MQTT broker, so that home automation, such
+// as Home Assistant or stage lighting, can react to what's happening. Only
+// the small part of MQTT 3.1.1 which is needed to publish is implemented, so
+// that the server doesn't need a client library for it. Everything is sent
+// with QoS 0, so a message which is published while the broker can't be
+// reached is lost, apart from the retained state which is sent again when
+// the connection comes back.
+//
+// These topics are published to, each under the configured prefix:
+//
+//	status              "online", or "offline" if the server goes away;
+//	                    retained
+//	events/<type>       every event which is added to the event log, as a
+//	                    JSON object with its "type", "time" and "data"
+//	now-viewing         the tab which is being viewed, with the same data
+//	                    as tab events; retained, and empty when nothing is
+//	now-performing      the same, for the tab which is being performed
+const (
+	// mqttKeepAlive is how often the broker is pinged while nothing else
+	// is being sent, so that it knows the server is still there.
+	mqttKeepAlive = 30 * time.Second
+
+	// mqttTimeout is how long connecting to the broker, and sending each
+	// packet to it, can take before the connection is given up on.
+	mqttTimeout = 10 * time.Second
+
+	// mqttRetryDelay is how long the server waits before trying to
+	// connect to the broker again after failing to.
+	mqttRetryDelay = 15 * time.Second
+
+	// mqttQueueSize is how many messages can be waiting to be sent. Any
+	// more than that are dropped, rather than holding up the requests
+	// which publish them.
+	mqttQueueSize = 100
+)
+
+// These are the types of the MQTT packets which are sent and received.
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPingReq    = 12
+	mqttDisconnect = 14
+)
+
+// An mqttMessage is a message waiting to be published.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// An MQTTConfig says which broker to publish to.
+type MQTTConfig struct {
+	// Broker is the address of the broker, as host:port. If it is empty,
+	// nothing is published.
+	Broker string
+
+	// Prefix is put before each topic, separated by a '/'.
+	Prefix string
+
+	// Username and Password are used to log in to the broker, unless
+	// Username is empty.
+	Username string
+	Password string
+}
+
+// mqttPublisher sends messages to the broker in the background.
+type mqttPublisher struct {
+	config MQTTConfig
+	queue  chan mqttMessage
+
+	// retained holds the latest message to each retained topic, so they
+	// can be sent again whenever the server connects to the broker.
+	retained     map[string]mqttMessage
+	retainedLock sync.Mutex
+}
+
+// startMQTT starts publishing to the MQTT broker, if there is one, in the
+// background until the server shuts down.
+func (s *Server) startMQTT() {
+	if s.MQTT.Broker == "" {
+		return
+	}
+
+	s.mqtt = &mqttPublisher{
+		config:   s.MQTT,
+		queue:    make(chan mqttMessage, mqttQueueSize),
+		retained: make(map[string]mqttMessage),
+	}
+
+	s.mqtt.retain(mqttMessage{topic: s.mqtt.topic("status"), payload: []byte("online"), retain: true})
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		s.mqtt.run(s.background().Done())
+	}()
+}
+
+// publishMQTT queues a message to be published to the topic under the
+// prefix, if there is a broker. The payload is encoded as JSON unless it is
+// nil, in which case an empty message is sent, which removes the retained
+// message from a topic.
+func (s *Server) publishMQTT(topic string, payload interface{}, retain bool) {
+	if s.mqtt == nil {
+		return
+	}
+
+	var encoded []byte
+
+	if payload != nil {
+		var err error
+		if encoded, err = json.Marshal(payload); err != nil {
+			fmt.Printf("warning: the MQTT message to %s could not be encoded: %s\n", topic, err)
+			return
+		}
+	}
+
+	msg := mqttMessage{topic: s.mqtt.topic(topic), payload: encoded, retain: retain}
+
+	if retain {
+		s.mqtt.retain(msg)
+	}
+
+	select {
+	case s.mqtt.queue <- msg:
+	default:
+		fmt.Printf("warning: the MQTT message to %s was dropped because too many are waiting\n", topic)
+	}
+}
+
+// topic returns the full name of the topic under the prefix.
+func (p *mqttPublisher) topic(name string) string {
+	if p.config.Prefix == "" {
+		return name
+	}
+
+	return p.config.Prefix + "/" + name
+}
+
+// retain remembers a retained message, so that it can be sent again after
+// reconnecting.
+func (p *mqttPublisher) retain(msg mqttMessage) {
+	p.retainedLock.Lock()
+	defer p.retainedLock.Unlock()
+
+	p.retained[msg.topic] = msg
+}
+
+// retainedMessages returns the latest message to each retained topic.
+func (p *mqttPublisher) retainedMessages() []mqttMessage {
+	p.retainedLock.Lock()
+	defer p.retainedLock.Unlock()
+
+	msgs := make([]mqttMessage, 0, len(p.retained))
+	for _, msg := range p.retained {
+		msgs = append(msgs, msg)
+	}
+
+	return msgs
+}
+
+// run keeps a connection to the broker open, reconnecting whenever it is
+// lost, and sends the queued messages over it until stopping is closed.
+func (p *mqttPublisher) run(stopping <-chan struct{}) {
+	for {
+		err := p.session(stopping)
+		if err == nil {
+			return
+		}
+
+		fmt.Printf("warning: lost the connection to the MQTT broker, retrying in %s: %s\n", mqttRetryDelay, err)
+
+		select {
+		case <-stopping:
+			return
+		case <-time.After(mqttRetryDelay):
+		}
+	}
+}
+
+// session connects to the broker and sends messages to it until either the
+// connection fails, in which case the error is returned, or until stopping
+// is closed, in which case it disconnects cleanly and nil is returned.
+func (p *mqttPublisher) session(stopping <-chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", p.config.Broker, mqttTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := p.connect(conn); err != nil {
+		return err
+	}
+
+	// Nothing else which the broker sends matters, since only QoS 0 is
+	// used, so the rest is read and thrown away, just to notice when the
+	// connection closes.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	// Anything retained is sent again, since it might have been changed
+	// while the server was disconnected.
+	for _, msg := range p.retainedMessages() {
+		if err := writePacket(conn, mqttPublish<<4|retainFlag(msg.retain), publishBody(msg)); err != nil {
+			return err
+		}
+	}
+
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-stopping:
+			// Disconnecting cleanly means the broker won't publish
+			// the will, so the status is set to offline here.
+			writePacket(conn, mqttPublish<<4|retainFlag(true), publishBody(mqttMessage{
+				topic:   p.topic("status"),
+				payload: []byte("offline"),
+			}))
+			writePacket(conn, mqttDisconnect<<4, nil)
+			return nil
+
+		case <-closed:
+			return errors.New("the broker closed the connection")
+
+		case msg := <-p.queue:
+			err = writePacket(conn, mqttPublish<<4|retainFlag(msg.retain), publishBody(msg))
+
+		case <-ping.C:
+			err = writePacket(conn, mqttPingReq<<4, nil)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// connect sends the CONNECT packet and waits for the broker to accept it.
+// The server's status is set as the will, so that the broker marks it as
+// offline if the connection is lost.
+func (p *mqttPublisher) connect(conn net.Conn) error {
+	clientID, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+
+	// Clean session, and a retained will with QoS 0.
+	var flags byte = 0x02 | 0x04 | 0x20
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4) // The protocol level of MQTT 3.1.1.
+	flagsAt := len(body)
+	body = append(body, flags)
+	body = appendUint16(body, int(mqttKeepAlive/time.Second))
+
+	body = appendString(body, "tab-server-"+clientID)
+	body = appendString(body, p.topic("status"))
+	body = appendString(body, "offline")
+
+	if p.config.Username != "" {
+		body[flagsAt] |= 0x80 | 0x40
+		body = appendString(body, p.config.Username)
+		body = appendString(body, p.config.Password)
+	}
+
+	if err := writePacket(conn, mqttConnect<<4, body); err != nil {
+		return err
+	}
+
+	// The CONNACK packet is always four bytes long, and its last byte
+	// is the return code, which is 0 if the connection was accepted.
+	conn.SetReadDeadline(time.Now().Add(mqttTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return err
+	} else if ack[0]>>4 != mqttConnAck {
+		return errors.New("the broker didn't acknowledge the connection")
+	}
+
+	switch ack[3] {
+	case 0:
+		return nil
+	case 4, 5:
+		return errors.New("the broker refused the username or password")
+	default:
+		return fmt.Errorf("the broker refused the connection with code %d", ack[3])
+	}
+}
+
+// publishBody returns the body of a PUBLISH packet for the message.
+func publishBody(msg mqttMessage) []byte {
+	return append(appendString(nil, msg.topic), msg.payload...)
+}
+
+// retainFlag returns the flag which marks a PUBLISH packet as retained.
+func retainFlag(retain bool) byte {
+	if retain {
+		return 1
+	}
+
+	return 0
+}
+
+// appendString appends a string prefixed by its length, which is how MQTT
+// encodes strings.
+func appendString(b []byte, s string) []byte {
+	return append(appendUint16(b, len(s)), s...)
+}
+
+// appendUint16 appends a number as two bytes, most significant first.
+func appendUint16(b []byte, n int) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+// writePacket writes a packet with the given first byte, which holds its
+// type and flags, followed by its length and then its body.
+func writePacket(conn net.Conn, header byte, body []byte) error {
+	packet := []byte{header}
+
+	// The length is written 7 bits at a time, with the top bit of each
+	// byte saying whether there are more to come.
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+
+		if length > 0 {
+			b |= 0x80
+		}
+
+		packet = append(packet, b)
+
+		if length == 0 {
+			break
+		}
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	_, err := conn.Write(append(packet, body...))
+	return err
+}
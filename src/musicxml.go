@@ -0,0 +1,395 @@
+package src
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// MusicXML is the format which notation programs like MuseScore and Sibelius
+// share scores in. A .musicxml file is XML, and a .mxl file is a ZIP file with
+// the XML inside it. Neither makes sense as a tab's content, so they are
+// cached like the binary formats in binary.go, with their title, composer,
+// instruments and tuning read from the score, and the score itself can be
+// fetched from /api/v1/tab/{id}/musicxml to be shown by something which
+// understands it.
+const (
+	formatMusicXML           = "musicxml"
+	formatCompressedMusicXML = "musicxml-compressed"
+)
+
+const (
+	// musicXMLContentType is the content type of an uncompressed MusicXML
+	// score.
+	musicXMLContentType = "application/vnd.recordare.musicxml+xml"
+
+	// musicXMLContainerPath is the path of the file inside a compressed
+	// MusicXML file which says where its score is.
+	musicXMLContainerPath = "META-INF/container.xml"
+
+	// musicXMLSniffSize is how much of a file is looked at to tell whether
+	// it is an uncompressed MusicXML score, which is plenty for the XML
+	// declaration, the doctype and the start of the root element.
+	musicXMLSniffSize = 4096
+)
+
+// musicXMLExtensions are the extensions of MusicXML files. A file with one
+// of them is kept even if its filename doesn't match any of the patterns,
+// since its score says what it's called.
+var musicXMLExtensions = map[string]bool{
+	".musicxml": true,
+	".mxl":      true,
+}
+
+// errNotMusicXML is returned when a tab's MusicXML score is asked for, but
+// the tab isn't a MusicXML file.
+var errNotMusicXML = errors.New("the tab isn't a MusicXML score")
+
+// isMusicXMLFormat says whether a format is one of the kinds of MusicXML.
+func isMusicXMLFormat(format string) bool {
+	return format == formatMusicXML || format == formatCompressedMusicXML
+}
+
+// isMusicXML says whether a file's content is an uncompressed MusicXML score,
+// which is XML whose root element is a score.
+func isMusicXML(content []byte) bool {
+	if len(content) > musicXMLSniffSize {
+		content = content[:musicXMLSniffSize]
+	}
+
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(bytes.TrimSpace(content), []byte("<")) {
+		return false
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local == "score-partwise" || start.Name.Local == "score-timewise"
+		}
+	}
+}
+
+// musicXMLRootfile returns the path of the score inside a compressed MusicXML
+// file, from its container, or an empty string if it isn't one. The first
+// rootfile is the score, and any others are other versions of it, such as a
+// PDF.
+func musicXMLRootfile(archive *zip.Reader) string {
+	for _, file := range archive.File {
+		if file.Name != musicXMLContainerPath {
+			continue
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			return ""
+		}
+		defer reader.Close()
+
+		var container struct {
+			Rootfiles []struct {
+				FullPath string `xml:"full-path,attr"`
+			} `xml:"rootfiles>rootfile"`
+		}
+
+		if err := xml.NewDecoder(io.LimitReader(reader, maxScoreSize)).Decode(&container); err != nil || len(container.Rootfiles) == 0 {
+			return ""
+		}
+
+		return container.Rootfiles[0].FullPath
+	}
+
+	return ""
+}
+
+// musicXMLScore returns the uncompressed score of a MusicXML file, which is
+// the file itself unless it's compressed.
+func musicXMLScore(format string, content []byte) ([]byte, error) {
+	if format != formatCompressedMusicXML {
+		return content, nil
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+
+	rootfile := musicXMLRootfile(archive)
+
+	for _, file := range archive.File {
+		if file.Name != rootfile {
+			continue
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		return ioutil.ReadAll(io.LimitReader(reader, maxScoreSize))
+	}
+
+	return nil, errBadBinaryFile
+}
+
+// musicXMLMetadata reads the title, composer, instruments and tuning from a
+// MusicXML score. The title is the work's, or the movement's if the work
+// doesn't have one, and the composer is taken to be the artist. The tuning
+// is the first one given to a staff of tablature, as the notes of each line
+// from the lowest string up.
+func musicXMLMetadata(score io.Reader) (*binaryMetadata, error) {
+	decoder := xml.NewDecoder(score)
+
+	var (
+		elements []string
+		creator  string
+		text     strings.Builder
+
+		title, movement, composer, anyCreator string
+
+		// partName is the name of the part being read, and instrument is
+		// the name of its first instrument, in case it doesn't have one.
+		partName, instrument string
+
+		// staffLines maps the lines of the staff being read to their pitches,
+		// and line, step, alter and octave are the string being read.
+		staffLines                map[int]int
+		line, step, alter, octave string
+	)
+
+	meta := &binaryMetadata{}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			elements = append(elements, t.Name.Local)
+			text.Reset()
+
+			switch t.Name.Local {
+			case "creator":
+				creator = ""
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "type" {
+						creator = attr.Value
+					}
+				}
+
+			case "score-part":
+				partName, instrument = "", ""
+
+			case "staff-details":
+				staffLines = make(map[int]int)
+
+			case "staff-tuning":
+				line, step, alter, octave = "", "", "", ""
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "line" {
+						line = attr.Value
+					}
+				}
+			}
+
+		case xml.CharData:
+			text.Write(t)
+
+		case xml.EndElement:
+			// Paths are taken from below the root element, since a score
+			// can be partwise or timewise.
+			path := ""
+			if len(elements) > 1 {
+				path = strings.Join(elements[1:], "/")
+			}
+
+			value := strings.TrimSpace(text.String())
+			text.Reset()
+
+			switch {
+			case path == "work/work-title":
+				title = value
+			case path == "movement-title":
+				movement = value
+			case path == "identification/creator":
+				if creator == "composer" && composer == "" {
+					composer = value
+				} else if anyCreator == "" {
+					anyCreator = value
+				}
+
+			case path == "part-list/score-part/part-name":
+				partName = value
+			case path == "part-list/score-part/score-instrument/instrument-name" && instrument == "":
+				instrument = value
+			case path == "part-list/score-part":
+				if partName == "" {
+					partName = instrument
+				}
+
+				if partName != "" {
+					meta.Instruments = append(meta.Instruments, partName)
+				}
+
+			case strings.HasSuffix(path, "/staff-tuning/tuning-step"):
+				step = value
+			case strings.HasSuffix(path, "/staff-tuning/tuning-alter"):
+				alter = value
+			case strings.HasSuffix(path, "/staff-tuning/tuning-octave"):
+				octave = value
+			case strings.HasSuffix(path, "/staff-details/staff-tuning"):
+				if pitch, ok := musicXMLPitch(step, alter, octave); ok && staffLines != nil {
+					number, err := strconv.Atoi(line)
+					if err == nil {
+						staffLines[number] = pitch
+					}
+				}
+
+			// The first tuning is the one which is kept.
+			case strings.HasSuffix(path, "/staff-details"):
+				if meta.Tuning == "" && len(staffLines) >= 4 {
+					meta.Tuning = musicXMLTuning(staffLines)
+				}
+
+				staffLines = nil
+			}
+
+			if len(elements) > 0 {
+				elements = elements[:len(elements)-1]
+			}
+		}
+	}
+
+	meta.Title = title
+	if meta.Title == "" {
+		meta.Title = movement
+	}
+
+	meta.Artist = composer
+	if meta.Artist == "" {
+		meta.Artist = anyCreator
+	}
+
+	return meta, nil
+}
+
+// musicXMLPitch returns the MIDI note number of a pitch in a MusicXML score,
+// which is written as its step, such as "E", how many semitones it is altered
+// by, and its octave. The second return value is false if it isn't a pitch.
+func musicXMLPitch(step, alter, octave string) (int, bool) {
+	class, ok := parseNote(step)
+	if !ok || len(step) != 1 {
+		return 0, false
+	}
+
+	number, err := strconv.Atoi(octave)
+	if err != nil {
+		return 0, false
+	}
+
+	// The alteration can be a fraction for microtones, which are rounded
+	// away, since a string can't be tuned to one anyway.
+	semitones := 0
+	if alter != "" {
+		value, err := strconv.ParseFloat(alter, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		semitones = int(value)
+	}
+
+	return (number+1)*12 + class + semitones, true
+}
+
+// musicXMLTuning returns the standard form of the tuning of a staff, given
+// the pitches of its lines. The first line is the lowest string.
+func musicXMLTuning(lines map[int]int) string {
+	numbers := make([]int, 0, len(lines))
+	for number := range lines {
+		numbers = append(numbers, number)
+	}
+
+	sort.Ints(numbers)
+
+	pitches := make([]int, len(numbers))
+	for i, number := range numbers {
+		pitches[i] = lines[number]
+	}
+
+	return pitchesTuning(pitches)
+}
+
+// handleMusicXMLAPI is called to respond to a HTTP request to
+// /api/v1/tab/{id}/musicxml. It responds with the score of a MusicXML tab,
+// uncompressed if its file is compressed, so that it can be shown by
+// something which reads MusicXML. Unlike /api/v1/tab/{id}/file, the score
+// isn't sent as an attachment.
+func (s *Server) handleMusicXMLAPI(w http.ResponseWriter, r *http.Request) {
+	tab, ok, err := s.Store.GetTab(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok || s.hidesTab(r, tab) {
+		writeError(w, http.StatusNotFound, errTabNotFound)
+		return
+	} else if !isMusicXMLFormat(tab.Format) {
+		writeError(w, http.StatusNotFound, errNotMusicXML)
+		return
+	}
+
+	filePath := s.tabPath(tab.Filename)
+
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, errors.New("the tab's file no longer exists"))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	score, err := musicXMLScore(tab.Format, content)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// The score is named after the tab's file, with the extension of an
+	// uncompressed score.
+	name := path.Base(tab.Filename)
+	name = strings.TrimSuffix(name, path.Ext(name)) + ".musicxml"
+
+	w.Header().Set("Content-Type", musicXMLContentType)
+	w.Header().Set("Content-Disposition", "inline; filename="+strconv.Quote(name))
+
+	http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(score))
+}
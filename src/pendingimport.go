@@ -0,0 +1,377 @@
+package src
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Imports over the API are done in two steps, in the same way as with the
+// preview-import and import commands described in importplan.go, so that
+// nothing is written until what would be written has been checked. Uploading
+// a library written by Export to /api/v1/import/preview, or a zip archive to
+// /api/v1/import/zip, doesn't change anything. Instead, the upload is kept in
+// the .imports folder in the tab directory under a new ID, and the response
+// is that ID along with a plan of where each tab would be written and what it
+// would be parsed as. The plan, perhaps with some of the targets changed or
+// some of the tabs skipped, is then posted to /api/v1/import/{id}/commit,
+// which imports the upload as it says, or the upload can be thrown away with
+// a DELETE request to /api/v1/import/{id}. Like the trash, the folder's name
+// begins with a '.', so the uploads in it are never mistaken for tabs.
+const (
+	// importsFolder is the folder in the tab directory which pending
+	// imports are kept in, each in a folder named after its ID.
+	importsFolder = ".imports"
+
+	// pendingImportLifetime is how long a pending import is kept for if it
+	// isn't committed or thrown away. Old ones are thrown away whenever a
+	// new one is made.
+	pendingImportLifetime = time.Hour
+
+	// maxLibraryImportSize is the largest library which can be uploaded,
+	// in bytes.
+	maxLibraryImportSize = 100 << 20
+
+	// uploadMemory is how much of a multipart upload is kept in memory
+	// before the rest is written to a temporary file.
+	uploadMemory = 32 << 20
+)
+
+// These are the kinds of upload which can be imported.
+const (
+	importKindLibrary = "library"
+	importKindZip     = "zip"
+)
+
+var (
+	// errImportNotFound is returned when a pending import which doesn't
+	// exist, or which has expired, is committed or thrown away.
+	errImportNotFound = newAPIError(codeImportNotFound, "there is no pending import with that ID")
+
+	// errLibraryTooLarge is returned when a library is uploaded which is
+	// larger than maxLibraryImportSize.
+	errLibraryTooLarge = fmt.Errorf("libraries can't be larger than %d MB", maxLibraryImportSize>>20)
+)
+
+// A pendingImport is an upload which is waiting to be committed, along with
+// the plan for importing it which was made when it was uploaded.
+type pendingImport struct {
+	ID       string      `json:"id"`
+	Kind     string      `json:"kind"`
+	Uploaded time.Time   `json:"uploaded"`
+	Expires  time.Time   `json:"expires"`
+	Plan     *importPlan `json:"plan"`
+}
+
+// pendingImportPath returns the path of the file with the given name in the
+// folder of the pending import with the given ID. The upload itself is kept
+// in 'upload', and the pendingImport in 'import.json'.
+func (s *Server) pendingImportPath(id, name string) string {
+	return filepath.Join(s.Settings.TabDirectory, importsFolder, id, name)
+}
+
+// pendingImport returns the pending import with the given ID, or
+// errImportNotFound if there isn't one, or if it has expired.
+func (s *Server) pendingImport(id string) (*pendingImport, error) {
+	encoded, err := ioutil.ReadFile(s.pendingImportPath(id, "import.json"))
+	if os.IsNotExist(err) {
+		return nil, errImportNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	pending := &pendingImport{}
+	if err := json.Unmarshal(encoded, pending); err != nil {
+		return nil, fmt.Errorf("the pending import with the ID %s is corrupt: %s", id, err)
+	}
+
+	if time.Now().After(pending.Expires) {
+		return nil, errImportNotFound
+	}
+
+	return pending, nil
+}
+
+// purgePendingImports throws away the pending imports which have expired.
+func (s *Server) purgePendingImports() {
+	folders, err := ioutil.ReadDir(filepath.Join(s.Settings.TabDirectory, importsFolder))
+	if err != nil {
+		return
+	}
+
+	for _, folder := range folders {
+		if time.Since(folder.ModTime()) > pendingImportLifetime {
+			os.RemoveAll(filepath.Join(s.Settings.TabDirectory, importsFolder, folder.Name()))
+		}
+	}
+}
+
+// saveUpload writes the file uploaded with a request, either as the 'file'
+// form value of a multipart form, or as the whole body, to the given path.
+// If the file is larger than the limit, tooLarge is returned. If there is an
+// error, the HTTP status which it should be reported with is returned along
+// with it.
+func saveUpload(w http.ResponseWriter, r *http.Request, filePath string, limit int64, tooLarge error) (int, error) {
+	// A little is allowed on top of the file for the rest of the form.
+	if r.ContentLength > limit+1<<20 {
+		return http.StatusRequestEntityTooLarge, tooLarge
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+
+	upload := io.Reader(r.Body)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(uploadMemory); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("the upload couldn't be read: %s", err)
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return http.StatusBadRequest, errors.New("the file needs to be uploaded as 'file'")
+		}
+		defer file.Close()
+
+		upload = file
+	}
+
+	saved, err := os.Create(filePath)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer saved.Close()
+
+	if n, err := io.Copy(saved, io.LimitReader(upload, limit+1)); err != nil {
+		return http.StatusRequestEntityTooLarge, tooLarge
+	} else if n > limit {
+		return http.StatusRequestEntityTooLarge, tooLarge
+	}
+
+	return http.StatusOK, saved.Close()
+}
+
+// stageImport keeps the upload of the given kind sent with a request as a new
+// pending import, and responds with it, encoded in JSON. The plan for
+// importing it is made by calling plan with the path which the upload was
+// saved to. If the upload can't be planned, it isn't kept.
+func (s *Server) stageImport(w http.ResponseWriter, r *http.Request, kind string, plan func(uploadPath string) (*importPlan, int, error)) {
+	s.purgePendingImports()
+
+	id, err := randomHex(8)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	folder := filepath.Join(s.Settings.TabDirectory, importsFolder, id)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status, err := http.StatusOK, error(nil)
+
+	defer func() {
+		if err != nil {
+			os.RemoveAll(folder)
+			writeError(w, status, err)
+		}
+	}()
+
+	limit, tooLarge := int64(maxLibraryImportSize), errLibraryTooLarge
+	if kind == importKindZip {
+		limit, tooLarge = maxZipImportSize, errArchiveTooLarge
+	}
+
+	uploadPath := s.pendingImportPath(id, "upload")
+
+	if status, err = saveUpload(w, r, uploadPath, limit, tooLarge); err != nil {
+		return
+	}
+
+	pending := &pendingImport{
+		ID:       id,
+		Kind:     kind,
+		Uploaded: time.Now(),
+		Expires:  time.Now().Add(pendingImportLifetime),
+	}
+
+	if pending.Plan, status, err = plan(uploadPath); err != nil {
+		return
+	}
+
+	var encoded []byte
+	if encoded, err = json.Marshal(pending); err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+
+	if err = ioutil.WriteFile(s.pendingImportPath(id, "import.json"), encoded, 0644); err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encoded)
+}
+
+// commitImport imports the pending import with the given ID as the plan says,
+// on behalf of the given actor, and returns what happened, which is a
+// zipImportReport for a zip archive, and the numbers of tabs imported and
+// skipped for a library. Once it has been imported, the pending import is
+// thrown away, but if the plan has a problem it is kept, so that the plan can
+// be fixed and committed again. If there is an error, the HTTP status which
+// it should be reported with is returned along with it.
+func (s *Server) commitImport(id string, plan *importPlan, by actor) (interface{}, int, error) {
+	s.importLock.Lock()
+	defer s.importLock.Unlock()
+
+	pending, err := s.pendingImport(id)
+	if err == errImportNotFound {
+		return nil, http.StatusNotFound, err
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if plan == nil {
+		plan = pending.Plan
+	}
+
+	var result interface{}
+
+	switch pending.Kind {
+	case importKindZip:
+		archive, err := zip.OpenReader(s.pendingImportPath(id, "upload"))
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		defer archive.Close()
+
+		result, err = s.importPlannedZip(&archive.Reader, plan, by)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+	case importKindLibrary:
+		file, err := os.Open(s.pendingImportPath(id, "upload"))
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		defer file.Close()
+
+		lib, err := readLibrary(file)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		imported, skipped, err := s.importPlannedLibrary(lib, plan)
+		if err != nil {
+			status := http.StatusInternalServerError
+
+			var coded *apiError
+			if errors.As(err, &coded) && coded.code == codeInvalidImportPlan {
+				status = http.StatusBadRequest
+			}
+
+			return nil, status, err
+		}
+
+		result = map[string]int{"imported": imported, "skipped": skipped}
+
+	default:
+		return nil, http.StatusInternalServerError, fmt.Errorf("the pending import with the ID %s is of an unknown kind: %s", id, pending.Kind)
+	}
+
+	if err := os.RemoveAll(filepath.Join(s.Settings.TabDirectory, importsFolder, id)); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return result, http.StatusOK, nil
+}
+
+// handleImportPreviewAPI is called to respond to a HTTP request to
+// /api/v1/import/preview. It keeps the uploaded library, which is either the
+// 'file' form value of a multipart form or the whole body, as a pending
+// import, and responds with a plan for importing it, as described at the top
+// of this file. Nothing is imported until the plan is committed.
+func (s *Server) handleImportPreviewAPI(w http.ResponseWriter, r *http.Request) {
+	s.stageImport(w, r, importKindLibrary, func(uploadPath string) (*importPlan, int, error) {
+		file, err := os.Open(uploadPath)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		defer file.Close()
+
+		lib, err := readLibrary(file)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("the library couldn't be read: %s", err)
+		}
+
+		return s.planLibraryImport(lib), http.StatusOK, nil
+	})
+}
+
+// handleCommitImportAPI is called to respond to a HTTP request to
+// /api/v1/import/{id}/commit. It imports the pending import with the ID in
+// the URL as the plan in the body says, or as the plan made when it was
+// uploaded if the body is empty, and responds with what happened, encoded in
+// JSON.
+func (s *Server) handleCommitImportAPI(w http.ResponseWriter, r *http.Request) {
+	var plan *importPlan
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(bytes.TrimSpace(body)) > 0 {
+		if plan, err = readImportPlan(bytes.NewReader(body)); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	result, status, err := s.commitImport(mux.Vars(r)["id"], plan, s.requestActor(r))
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleDiscardImportAPI is called to respond to a DELETE request to
+// /api/v1/import/{id}. It throws away the pending import with the ID in the
+// URL without importing anything.
+func (s *Server) handleDiscardImportAPI(w http.ResponseWriter, r *http.Request) {
+	s.importLock.Lock()
+	defer s.importLock.Unlock()
+
+	id := mux.Vars(r)["id"]
+
+	if _, err := s.pendingImport(id); err == errImportNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := os.RemoveAll(filepath.Join(s.Settings.TabDirectory, importsFolder, id)); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
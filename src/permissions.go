@@ -0,0 +1,336 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// These are the things which a role can be allowed to do. Each admin-only
+// endpoint needs one of them, which requirePermission checks.
+const (
+	// permissionEdit allows changing tabs, such as merging them or
+	// overriding whether they are explicit.
+	permissionEdit = "edit"
+
+	// permissionDelete allows deleting tabs, restoring them from the trash
+	// and pruning orphaned ones.
+	permissionDelete = "delete"
+
+	// permissionSettings allows changing the settings and revoking the
+	// download links.
+	permissionSettings = "settings"
+
+	// permissionJobs allows seeing, starting and cancelling jobs, following
+	// the event log, and resetting the cache.
+	permissionJobs = "jobs"
+
+	// permissionShare allows signing download links.
+	permissionShare = "share"
+
+	// permissionPerform allows saying which tab is being viewed or
+	// performed, which is published to the MQTT broker.
+	permissionPerform = "perform"
+
+	// permissionSetlists allows creating, changing and deleting setlists.
+	// Anyone can see them.
+	permissionSetlists = "setlists"
+
+	// permissionRequests allows seeing, adding to, voting on and clearing
+	// the wishlist of songs which still need tabs. Anyone can request songs
+	// in open mic mode.
+	permissionRequests = "requests"
+
+	// permissionRecordings allows listening to, uploading and deleting
+	// rehearsal recordings.
+	permissionRecordings = "recordings"
+
+	// permissionAdmin allows managing the API tokens, the roles and the
+	// admin password. Only the admin role has it, and it can't be given
+	// to any other role.
+	permissionAdmin = "admin"
+)
+
+// permissionDescriptions describes each of the permissions which can be
+// given to a role, for the admin API.
+var permissionDescriptions = map[string]string{
+	permissionEdit:       "Change tabs, such as merging them or marking them as explicit",
+	permissionDelete:     "Delete tabs, restore them from the trash and prune orphaned ones",
+	permissionSettings:   "Change the settings and revoke download links",
+	permissionJobs:       "See, start and cancel jobs, follow the event log, and reset the cache",
+	permissionShare:      "Sign download links",
+	permissionPerform:    "Say which tab is being viewed or performed",
+	permissionSetlists:   "Create, change and delete setlists",
+	permissionRequests:   "See, add to, vote on and clear the wishlist of requested songs",
+	permissionRecordings: "Listen to, upload and delete rehearsal recordings",
+}
+
+// roleAdmin is the role which has every permission. The logged in admin
+// always has it, and so do API tokens which were created without a role,
+// which includes every token created before there were roles.
+const roleAdmin = "admin"
+
+// defaultRoles are the roles, apart from the admin role, which are used
+// until the admin changes any of them.
+var defaultRoles = map[string][]string{
+	"editor": {permissionEdit, permissionDelete, permissionJobs, permissionShare, permissionPerform, permissionSetlists, permissionRequests, permissionRecordings},
+	"viewer": {permissionShare, permissionPerform},
+}
+
+// roles returns the permissions of every role apart from the admin role. If
+// they have never been saved, the default roles are returned.
+func (s *Server) roles() (map[string][]string, error) {
+	roles, saved, err := s.Store.Roles()
+	if err != nil || saved {
+		return roles, err
+	}
+
+	roles = make(map[string][]string, len(defaultRoles))
+	for role, permissions := range defaultRoles {
+		roles[role] = append([]string(nil), permissions...)
+	}
+
+	return roles, nil
+}
+
+// setRole changes the permissions of a role, creating it if it doesn't exist
+// yet. The admin role can't be changed.
+func (s *Server) setRole(role string, permissions []string) error {
+	if role == "" {
+		return errors.New("a role name is required")
+	} else if role == roleAdmin {
+		return errors.New("the admin role can't be changed")
+	}
+
+	for _, permission := range permissions {
+		if _, ok := permissionDescriptions[permission]; !ok {
+			return fmt.Errorf("unknown permission: %s", permission)
+		}
+	}
+
+	roles, err := s.roles()
+	if err != nil {
+		return err
+	}
+
+	roles[role] = permissions
+
+	return s.saveRoles(roles)
+}
+
+// deleteRole removes a role. Any API tokens which had it are left without
+// any permissions. The second return value is false if there was no such
+// role.
+func (s *Server) deleteRole(role string) (bool, error) {
+	roles, err := s.roles()
+	if err != nil {
+		return false, err
+	} else if _, ok := roles[role]; !ok {
+		return false, nil
+	}
+
+	delete(roles, role)
+
+	return true, s.saveRoles(roles)
+}
+
+// saveRoles replaces every role in the store. The whole set of roles is
+// saved, rather than just the one which changed, so that the default roles
+// are saved the first time one of them is changed. Once they have been
+// saved, the defaults don't come back, even if every role is deleted.
+func (s *Server) saveRoles(roles map[string][]string) error {
+	return s.Store.SaveRoles(roles)
+}
+
+// hasPermission reports whether the role has the given permission.
+func (s *Server) hasPermission(role, permission string) (bool, error) {
+	if role == roleAdmin {
+		return true, nil
+	} else if permission == permissionAdmin {
+		return false, nil
+	}
+
+	roles, err := s.roles()
+	if err != nil {
+		return false, err
+	}
+
+	for _, granted := range roles[role] {
+		if granted == permission {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// requestRole authenticates a request in the same way as authenticate, and
+// returns the role of whoever made it. The logged in admin has the admin
+// role, and an API token has the role it was given when it was created.
+func (s *Server) requestRole(r *http.Request) (string, int, error) {
+	if status, err := s.authenticate(r); err != nil {
+		return "", status, err
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return roleAdmin, http.StatusOK, nil
+	}
+
+	role, err := s.tokenRole(r)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	return role, http.StatusOK, nil
+}
+
+// requirePermission wraps a handler so that it can only be used by someone
+// whose role has the given permission. Anyone else gets an Unauthorized
+// error if they aren't authenticated at all, or a Forbidden error if they
+// are but their role doesn't allow it.
+func (s *Server) requirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, status, err := s.requestRole(r)
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+
+		allowed, err := s.hasPermission(role, permission)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if !allowed {
+			writeError(w, http.StatusForbidden, fmt.Errorf("the %s role doesn't have the %s permission", role, permission))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// handlePermissionsAPI is called to respond to a HTTP request to
+// /api/v1/permissions. A GET request responds with the permissions which roles
+// can have, the permissions of each role, and the role of each API token,
+// encoded in JSON. A POST request sets the permissions of the role in the
+// 'role' form value to the JSON list in the 'permissions' form value, and a
+// DELETE request removes the role in the 'role' query value. Only the admin
+// can use it.
+func (s *Server) handlePermissionsAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		roles, err := s.roles()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		tokens, err := s.tokenRoles()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		permissions := make([]string, 0, len(permissionDescriptions))
+		for permission := range permissionDescriptions {
+			permissions = append(permissions, permission)
+		}
+
+		sort.Strings(permissions)
+
+		descriptions := make([]map[string]string, len(permissions))
+		for i, permission := range permissions {
+			descriptions[i] = map[string]string{
+				"name":        permission,
+				"description": permissionDescriptions[permission],
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"permissions": descriptions,
+			"roles":       roles,
+			"tokens":      tokens,
+		})
+
+	case "POST":
+		permissions := make([]string, 0)
+
+		if err := json.Unmarshal([]byte(r.PostFormValue("permissions")), &permissions); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("the permissions must be a JSON list"))
+			return
+		}
+
+		if err := s.setRole(r.PostFormValue("role"), permissions); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+	case "DELETE":
+		found, err := s.deleteRole(r.FormValue("role"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if !found {
+			writeError(w, http.StatusNotFound, errRoleNotFound)
+			return
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET, POST and DELETE are supported"))
+	}
+}
+
+// tokenName returns the name of the API token in the request, which must
+// already have been validated.
+func (s *Server) tokenName(r *http.Request) (string, error) {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+
+	name, _, err := s.Store.TokenName(hashToken(token))
+	return name, err
+}
+
+// tokenRole returns the role of the API token in the request, which must
+// already have been validated. Tokens without a role have the admin role.
+func (s *Server) tokenRole(r *http.Request) (string, error) {
+	name, err := s.tokenName(r)
+	if err != nil {
+		return "", err
+	}
+
+	role, ok, err := s.Store.TokenRole(name)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return roleAdmin, nil
+	}
+
+	return role, nil
+}
+
+// tokenRoles returns a map from the name of each API token to its role.
+func (s *Server) tokenRoles() (map[string]string, error) {
+	names, err := s.tokenNames()
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := s.Store.TokenRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]string, len(names))
+	for _, name := range names {
+		if role, ok := roles[name]; ok {
+			tokens[name] = role
+		} else {
+			tokens[name] = roleAdmin
+		}
+	}
+
+	return tokens, nil
+}
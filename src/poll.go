@@ -0,0 +1,249 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clients which want to hear about changes as they happen, such as the
+// display following a performance, can't always keep a stream open: school
+// and work networks often have proxies which buffer server-sent events until
+// the response ends, or cut off connections which stay open for long. Instead,
+// they can long-poll the event log at /api/v1/events. Each request waits until
+// there are events after the cursor it gives, or until the wait is up, and
+// responds with them and the cursor to give next time, so nothing is missed
+// between requests, as long as the client doesn't fall further behind than
+// the log is trimmed to.
+//
+// The cursor is the ID of the last event the client has seen. A client which
+// doesn't have one yet leaves it out, and is given the ID of the newest event,
+// so that it starts from now rather than from the beginning of the log.
+const (
+	// defaultPollWait is how long a request waits for events if it doesn't
+	// say, which is a little less than the thirty seconds which proxies
+	// commonly allow a response to take.
+	defaultPollWait = 25 * time.Second
+
+	// maxPollWait is the longest a request can wait for events.
+	maxPollWait = 55 * time.Second
+
+	// pollInterval is how often the event log is checked for new events
+	// while a request is waiting. It is read rather than blocked on so that
+	// the waiting requests don't each hold one of the database connections.
+	pollInterval = 250 * time.Millisecond
+
+	// maxPollEvents is the most events which are read at a time. A client
+	// which is further behind than this gets the rest with its next
+	// request.
+	maxPollEvents = 100
+)
+
+// publicEventTypes are the types of event which anyone can poll for, since
+// they say nothing which can't be read from the API already. Following the
+// rest of the event log needs the jobs permission.
+var publicEventTypes = map[string]bool{
+	eventNowShowingChanged: true,
+}
+
+// eventCursorPattern matches the IDs of the entries in the event log.
+var eventCursorPattern = regexp.MustCompile(`^\d+-\d+$`)
+
+// A polledEvent is an event in the event log, as it is sent to a client
+// which is polling for them. Actor is left out of the public events, so that
+// the names of the API tokens aren't given away.
+type polledEvent struct {
+	ID    string          `json:"id"`
+	Type  string          `json:"type"`
+	Time  string          `json:"time"`
+	Actor json.RawMessage `json:"actor,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// A pollResult is the response to a request polling for events.
+type pollResult struct {
+	Cursor string        `json:"cursor"`
+	Events []polledEvent `json:"events"`
+}
+
+// latestEventID returns the ID of the newest event in the event log, or
+// "0-0" if there aren't any, so that reading from it only finds events which
+// are published from now on.
+func (s *Server) latestEventID() (string, error) {
+	return s.Store.LatestEventID()
+}
+
+// readEvents returns the events after the cursor whose types are in the
+// given set, or every event if it is empty, along with the cursor to read
+// from next. The cursor moves past the events which are left out as well, so
+// that they aren't read again.
+func (s *Server) readEvents(cursor string, types map[string]bool, actors bool) ([]polledEvent, string, error) {
+	logged, err := s.Store.EventsAfter(cursor, maxPollEvents)
+	if err != nil {
+		return nil, cursor, err
+	}
+
+	var events []polledEvent
+
+	for _, entry := range logged {
+		cursor = entry.ID
+
+		if len(types) > 0 && !types[entry.Type] {
+			continue
+		}
+
+		event := polledEvent{
+			ID:   entry.ID,
+			Type: entry.Type,
+			Time: entry.Time,
+			Data: json.RawMessage(entry.Data),
+		}
+
+		if actors && entry.Actor != "" {
+			event.Actor = json.RawMessage(entry.Actor)
+		}
+
+		events = append(events, event)
+	}
+
+	return events, cursor, nil
+}
+
+// endPolls stops every request which is waiting for events, so that the
+// server can shut down without waiting for them. It is called when the server
+// starts shutting down.
+func (s *Server) endPolls() {
+	ended := s.pollsEndedChan()
+
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+
+	select {
+	case <-ended:
+	default:
+		close(ended)
+	}
+}
+
+// pollsEndedChan returns the channel which is closed when the server starts
+// shutting down, by endPolls.
+func (s *Server) pollsEndedChan() chan struct{} {
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+
+	if s.pollsEnded == nil {
+		s.pollsEnded = make(chan struct{})
+	}
+
+	return s.pollsEnded
+}
+
+// handleEventsAPI is called to respond to a HTTP request to /api/v1/events.
+// It waits for events after the one in the 'cursor' query value, for up to
+// the number of seconds in the 'wait' query value, and responds with them
+// and the cursor to give next time, encoded in JSON. If the 'types' query
+// value is given, only the events of those types, separated by commas, are
+// sent. Anyone can poll for the public event types, and the others need the
+// jobs permission.
+func (s *Server) handleEventsAPI(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	types := make(map[string]bool)
+	public := query.Get("types") != ""
+
+	for _, kind := range strings.Split(query.Get("types"), ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			types[kind] = true
+			public = public && publicEventTypes[kind]
+		}
+	}
+
+	if public {
+		s.pollEvents(w, r, types, false)
+		return
+	}
+
+	s.requirePermission(permissionJobs, func(w http.ResponseWriter, r *http.Request) {
+		s.pollEvents(w, r, types, true)
+	})(w, r)
+}
+
+// pollEvents responds to a request polling for events of the given types, as
+// described by handleEventsAPI. If actors is false, who caused each event is
+// left out.
+func (s *Server) pollEvents(w http.ResponseWriter, r *http.Request, types map[string]bool, actors bool) {
+	query := r.URL.Query()
+
+	wait := defaultPollWait
+	if value := query.Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxPollWait {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("the wait must be a whole number of seconds, from 0 to %d", maxPollWait/time.Second))
+			return
+		}
+
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	result := pollResult{Cursor: query.Get("cursor"), Events: []polledEvent{}}
+
+	if result.Cursor == "" {
+		// A client without a cursor starts from now, so it is given one
+		// straight away, rather than waiting for the first event.
+		cursor, err := s.latestEventID()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		result.Cursor = cursor
+		wait = 0
+	} else if !eventCursorPattern.MatchString(result.Cursor) {
+		writeError(w, http.StatusBadRequest, errors.New("the cursor must be the ID of an event, such as 1526919030474-55"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	ended := s.pollsEndedChan()
+
+waiting:
+	for {
+		events, cursor, err := s.readEvents(result.Cursor, types, actors)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		result.Cursor = cursor
+
+		if len(events) > 0 {
+			result.Events = events
+			break
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			break waiting
+		case <-ended:
+			break waiting
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
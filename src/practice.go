@@ -0,0 +1,190 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// These are the limits on the details in a tab's practice metadata, which
+// are generous, but stop a mistake from storing something silly.
+const (
+	// maxCapo is the highest fret a capo can be put on.
+	maxCapo = 24
+
+	// maxTempo is the fastest tempo, in beats per minute.
+	maxTempo = 1000
+
+	// maxTuningLength and maxPracticeNotesLength are the most characters
+	// which the tuning and the notes can have.
+	maxTuningLength        = 100
+	maxPracticeNotesLength = 10000
+)
+
+// A TabPractice holds the details which help with playing a tab, like where
+// to put the capo and how fast it goes. They are kept with the cached tab
+// rather than in its file, so that they don't have to be written into the
+// content, and they stay the same when the file is edited or read again. Each
+// of them is optional, and they are changed through /api/v1/update-tab.
+type TabPractice struct {
+	// Capo is the fret which the capo goes on, or 0 if there isn't one.
+	Capo int `json:"capo"`
+
+	// Tuning is what the instrument should be tuned to, such as "Drop D" or
+	// "DADGAD", or empty if it isn't known.
+	Tuning string `json:"tuning"`
+
+	// Tempo is how fast the song goes, in beats per minute, or 0 if it
+	// isn't known.
+	Tempo int `json:"tempo"`
+
+	// Notes are whatever else is worth remembering about playing the tab,
+	// such as which verse to skip.
+	Notes string `json:"notes"`
+}
+
+// validate returns an error describing what's wrong with the practice
+// metadata, or nil if it is fine.
+func (p TabPractice) validate() error {
+	switch {
+	case p.Capo < 0 || p.Capo > maxCapo:
+		return fmt.Errorf("the capo must be between 0 and %d", maxCapo)
+
+	case p.Tempo < 0 || p.Tempo > maxTempo:
+		return fmt.Errorf("the tempo must be between 0 and %d beats per minute", maxTempo)
+
+	case utf8.RuneCountInString(p.Tuning) > maxTuningLength:
+		return fmt.Errorf("the tuning can't be longer than %d characters", maxTuningLength)
+
+	case utf8.RuneCountInString(p.Notes) > maxPracticeNotesLength:
+		return fmt.Errorf("the notes can't be longer than %d characters", maxPracticeNotesLength)
+	}
+
+	return nil
+}
+
+// practiceData returns the fields of a tab's hashmap in the database which
+// hold its practice metadata.
+func practiceData(practice TabPractice) map[string]interface{} {
+	return map[string]interface{}{
+		"capo":   practice.Capo,
+		"tuning": practice.Tuning,
+		"tempo":  practice.Tempo,
+		"notes":  practice.Notes,
+	}
+}
+
+// practiceFromData constructs a tab's practice metadata from the fields of its
+// hashmap in the database. Tabs cached before practice metadata existed don't
+// have the fields, which leaves them empty.
+func practiceFromData(data map[string]string) TabPractice {
+	capo, _ := strconv.Atoi(data["capo"])
+	tempo, _ := strconv.Atoi(data["tempo"])
+
+	return TabPractice{
+		Capo:   capo,
+		Tuning: data["tuning"],
+		Tempo:  tempo,
+		Notes:  data["notes"],
+	}
+}
+
+// practiceFromForm changes the practice metadata to have the capo, tuning,
+// tempo and notes in the request's 'capo', 'tuning', 'tempo' and 'notes' form
+// values. Only the values which were given are changed, and an empty capo or
+// tempo clears it, in the same way as 0 does.
+func practiceFromForm(r *http.Request, practice *TabPractice) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	changed := *practice
+
+	for field, value := range map[string]*int{"capo": &changed.Capo, "tempo": &changed.Tempo} {
+		if _, ok := r.PostForm[field]; !ok {
+			continue
+		}
+
+		text := strings.TrimSpace(r.PostFormValue(field))
+		if text == "" {
+			*value = 0
+			continue
+		}
+
+		number, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("the %s must be a whole number", field)
+		}
+
+		*value = number
+	}
+
+	if _, ok := r.PostForm["tuning"]; ok {
+		changed.Tuning = strings.TrimSpace(r.PostFormValue("tuning"))
+	}
+
+	if _, ok := r.PostForm["notes"]; ok {
+		changed.Notes = r.PostFormValue("notes")
+	}
+
+	if err := changed.validate(); err != nil {
+		return err
+	}
+
+	*practice = changed
+	return nil
+}
+
+// updateTab changes the practice metadata of the tab with the given ID to the
+// values in the request's form, on behalf of the given actor. If there is an
+// error, the HTTP status which it should be reported with is returned along
+// with it.
+func (s *Server) updateTab(id string, r *http.Request, by actor) (int, error) {
+	tab, exists, err := s.Store.GetTab(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !exists {
+		return http.StatusNotFound, errTabNotFound
+	}
+
+	if err := practiceFromForm(r, &tab.Practice); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if err := s.Store.SetPractice(id, tab.Practice); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if err := s.bumpCollectionVersion(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	s.publishEvent(eventTabUpdated, by, tabEventData(tab))
+
+	return http.StatusOK, nil
+}
+
+// handleUpdateTabAPI is called to respond to a HTTP request to
+// /api/v1/update-tab. It changes the practice metadata of the tab with the ID
+// in the 'id' form value to whichever of the 'capo', 'tuning', 'tempo' and
+// 'notes' form values are given, leaving the others as they were. The tab's
+// file isn't touched. It will only accept POST requests from a logged in
+// admin.
+func (s *Server) handleUpdateTabAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if status, err := s.checkEditLock(r, r.PostFormValue("id")); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if status, err := s.updateTab(r.PostFormValue("id"), r, s.requestActor(r)); err != nil {
+		writeError(w, status, err)
+		return
+	}
+}
@@ -0,0 +1,261 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultStaticDirectory is the directory which the static files are served
+// from if the server's StaticDirectory isn't set.
+const defaultStaticDirectory = "www"
+
+// staticDirectory returns the directory which the static files are served
+// from.
+func (s *Server) staticDirectory() string {
+	if s.StaticDirectory == "" {
+		return defaultStaticDirectory
+	}
+
+	return s.StaticDirectory
+}
+
+// staticPath returns the path to the static file with the given slash
+// separated name, such as "html/index.html".
+func (s *Server) staticPath(name string) string {
+	return filepath.Join(s.staticDirectory(), filepath.FromSlash(name))
+}
+
+// A webManifest describes the web app to browsers, so that they can offer to
+// install it. See https://www.w3.org/TR/appmanifest/.
+type webManifest struct {
+	Name            string         `json:"name"`
+	ShortName       string         `json:"short_name"`
+	StartURL        string         `json:"start_url"`
+	Scope           string         `json:"scope"`
+	Display         string         `json:"display"`
+	BackgroundColor string         `json:"background_color"`
+	ThemeColor      string         `json:"theme_color"`
+	Icons           []manifestIcon `json:"icons"`
+}
+
+// A manifestIcon is one of the icons listed in a webManifest.
+type manifestIcon struct {
+	Src   string `json:"src"`
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+// A precacheManifest lists everything which the service worker should keep
+// a copy of so that the web app works offline. Version changes whenever any
+// of the assets or tabs do, so the service worker knows when to update its
+// copies.
+type precacheManifest struct {
+	Version string          `json:"version"`
+	Assets  []precacheAsset `json:"assets"`
+	Tabs    []precacheTab   `json:"tabs"`
+}
+
+// A precacheAsset is a URL which should be cached, along with the hash of
+// the file it serves.
+type precacheAsset struct {
+	URL  string `json:"url"`
+	Hash string `json:"hash"`
+}
+
+// A precacheTab is the ID and content hash of one of the tabs. The content
+// itself is fetched and stored by the web app, which uses the hashes to tell
+// which tabs it already has.
+type precacheTab struct {
+	ID          string `json:"id"`
+	ContentHash string `json:"contentHash"`
+}
+
+// hashFile computes the SHA-256 hash of a file's content, in hexadecimal.
+func hashFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return HashContent(content), nil
+}
+
+// precacheAssets returns every URL which the web app needs to work offline:
+// the pages, the service worker, and every static file apart from hidden
+// ones. They are sorted by URL, so the list is always in the same order.
+func (s *Server) precacheAssets() ([]precacheAsset, error) {
+	assets := make([]precacheAsset, 0)
+	dir := s.staticDirectory()
+
+	// The pages and the service worker aren't under /static/, so they are
+	// listed separately along with the files which they serve.
+	for url, path := range map[string]string{
+		"/":         "html/index.html",
+		"/settings": "html/settings.html",
+		"/sw.js":    "js/sw.js",
+	} {
+		hash, err := hashFile(s.staticPath(path))
+		if err != nil {
+			return nil, err
+		}
+
+		assets = append(assets, precacheAsset{URL: url, Hash: hash})
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(info.Name(), ".") && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+
+		assets = append(assets, precacheAsset{
+			URL:  "/static/" + filepath.ToSlash(rel),
+			Hash: hash,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].URL < assets[j].URL
+	})
+
+	return assets, nil
+}
+
+// getPrecacheManifest builds the precache manifest from the static files and
+// the tabs in the collection. Its version is the hash of everything else in
+// it, so it only changes when something which needs to be cached does.
+func (s *Server) getPrecacheManifest(r *http.Request) (*precacheManifest, error) {
+	assets, err := s.precacheAssets()
+	if err != nil {
+		return nil, err
+	}
+
+	tabs, err := s.getTabs(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.showsExplicit(r) {
+		tabs = filterExplicit(tabs)
+	}
+
+	if s.restrictsLicenses(r) {
+		tabs = s.filterLicensed(tabs)
+	}
+
+	manifest := &precacheManifest{
+		Assets: assets,
+		Tabs:   make([]precacheTab, len(tabs)),
+	}
+
+	for i, tab := range tabs {
+		manifest.Tabs[i] = precacheTab{ID: tab.ID, ContentHash: tab.ContentHash}
+	}
+
+	sort.Slice(manifest.Tabs, func(i, j int) bool {
+		return manifest.Tabs[i].ID < manifest.Tabs[j].ID
+	})
+
+	// Hash the JSON encoding of the manifest before the version is set, which
+	// covers every asset and tab hash.
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	manifest.Version = hex.EncodeToString(sum[:8])
+
+	return manifest, nil
+}
+
+// handleWebManifest is called to respond to a HTTP request to
+// /manifest.webmanifest, which lets browsers install the web app.
+func (s *Server) handleWebManifest(w http.ResponseWriter, r *http.Request) {
+	manifest := &webManifest{
+		Name:            "Tab Server",
+		ShortName:       "Tabs",
+		StartURL:        "/",
+		Scope:           "/",
+		Display:         "standalone",
+		BackgroundColor: "#ffffff",
+		ThemeColor:      "#323232",
+		Icons: []manifestIcon{
+			{Src: "/static/img/icon.svg", Sizes: "any", Type: "image/svg+xml"},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/manifest+json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// handlePrecacheAPI is called to respond to a HTTP request to
+// /api/v1/precache. It responds with the precache manifest encoded in JSON,
+// using its version as the ETag so that the service worker can check cheaply
+// whether anything has changed.
+func (s *Server) handlePrecacheAPI(w http.ResponseWriter, r *http.Request) {
+	// Disable caching for this request - caching will be managed
+	// manually by this program.
+	w.Header().Set("Cache-Control", "max-age=0")
+
+	manifest, err := s.getPrecacheManifest(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	etag := `"` + manifest.Version + `"`
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// handleServiceWorker is called to respond to a HTTP request to /sw.js. The
+// service worker has to be served from the root so that it can control every
+// page, rather than just the ones under /static/.
+func (s *Server) handleServiceWorker(w http.ResponseWriter, r *http.Request) {
+	// Disable caching for this route, so that browsers always notice when
+	// the service worker changes.
+	w.Header().Set("Cache-Control", "max-age=0")
+
+	http.ServeFile(w, r, s.staticPath("js/sw.js"))
+}
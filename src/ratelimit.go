@@ -0,0 +1,126 @@
+package src
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// rateLimitWindow is the length of the window in which requests from
+	// each IP address are counted.
+	rateLimitWindow = time.Minute
+
+	// rateLimitRequests is the number of requests which one IP address can
+	// make to a rate limited endpoint in each window.
+	rateLimitRequests = 20
+
+	// lockoutThreshold is the number of wrong passwords an IP address can
+	// enter before it is locked out.
+	lockoutThreshold = 5
+
+	// lockoutBase is how long the first lockout lasts. Each subsequent
+	// wrong password doubles it, up to lockoutMax.
+	lockoutBase = 30 * time.Second
+
+	// lockoutMax is the longest that an IP address can be locked out for.
+	lockoutMax = 24 * time.Hour
+
+	// failedLoginMemory is how long wrong passwords are remembered for
+	// after the most recent one.
+	failedLoginMemory = 24 * time.Hour
+)
+
+// clientIP returns the IP address which the request came from, without the
+// port. X-Forwarded-For isn't trusted, since any client could set it to get
+// around the rate limit.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// tooManyRequests responds with a Too Many Requests status, telling the
+// client how long it should wait before trying again.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, http.StatusTooManyRequests, fmt.Errorf("too many requests, try again in %d seconds", seconds))
+}
+
+// rateLimit wraps a handler so that each IP address can only make a limited
+// number of requests to it per minute, and so that IP addresses which have
+// been locked out for entering too many wrong passwords can't use it at all.
+// It is used on the endpoints which check the admin password, and on the one
+// which anyone can request songs with.
+func (s *Server) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+
+		// If the IP address is locked out, what is left of its lockout is
+		// how long it has to wait.
+		wait, err := s.Store.Lockout(ip)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if wait > 0 {
+			tooManyRequests(w, wait)
+			return
+		}
+
+		// Count the request in the current window.
+		limited, wait, err := s.Store.CountRequest(ip, rateLimitRequests, rateLimitWindow)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if limited {
+			tooManyRequests(w, wait)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// recordFailedLogin counts a wrong password entered from the request's IP
+// address. Once there have been lockoutThreshold of them, the address is
+// locked out, for twice as long after each further wrong password.
+func (s *Server) recordFailedLogin(r *http.Request) error {
+	ip := clientIP(r)
+
+	failures, err := s.Store.CountFailedLogin(ip, failedLoginMemory)
+	if err != nil {
+		return err
+	}
+
+	if failures < lockoutThreshold {
+		return nil
+	}
+
+	// Work out the length of the lockout, being careful not to overflow
+	// when the number of failures gets large.
+	lockout := lockoutMax
+	if exponent := failures - lockoutThreshold; exponent < 32 {
+		if d := lockoutBase * time.Duration(1<<uint(exponent)); d < lockoutMax {
+			lockout = d
+		}
+	}
+
+	return s.Store.LockOut(ip, lockout)
+}
+
+// clearFailedLogins forgets the wrong passwords entered from the request's
+// IP address, which is done when the right password is entered.
+func (s *Server) clearFailedLogins(r *http.Request) error {
+	return s.Store.ClearFailedLogins(clientIP(r))
+}
@@ -0,0 +1,561 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Recordings are audio files from rehearsals, such as a take of a song or a
+// run through a whole set, which are attached to the tab or the setlist they
+// belong to so that they can be played next to the chart. The files are kept
+// in the recording directory, named after their IDs, and the rest is kept in
+// the 'recordings' hashmap, which maps each recording's ID to it encoded in
+// JSON. The last ID which was given out is kept in 'recording-id', and the
+// recordings' waveforms are kept in the 'recording-waveforms' hashmap.
+//
+// When a tab or a setlist is deleted, its recordings are kept but no longer
+// attached to anything, so that they can be attached to something else, and
+// when a tab is merged into another, its recordings move with it.
+const (
+	// defaultRecordingDirectory is the directory which the recordings are
+	// kept in if the server's RecordingDirectory isn't set.
+	defaultRecordingDirectory = "recordings"
+
+	// maxRecordingSize is the largest recording which can be uploaded, in
+	// bytes, which is enough for a couple of hours of MP3 or half an hour
+	// of WAV.
+	maxRecordingSize = 500 << 20
+
+	// recordingUploadMemory is how much of an upload is kept in memory
+	// before the rest is written to a temporary file.
+	recordingUploadMemory = 32 << 20
+
+	// maxRecordingTitleLength is the most characters a recording's title
+	// can have.
+	maxRecordingTitleLength = 100
+)
+
+// recordingTypes maps the extensions of the audio files which can be
+// uploaded to their content types.
+var recordingTypes = map[string]string{
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".webm": "audio/webm",
+}
+
+// A Recording is an audio file attached to a tab or a setlist.
+type Recording struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+
+	// TabID and SetlistID are the IDs of the tab or setlist which the
+	// recording is attached to. At most one of them is set, and neither is
+	// once what it was attached to has been deleted.
+	TabID     string `json:"tabId"`
+	SetlistID string `json:"setlistId"`
+
+	// Filename is the name of the file which was uploaded, which it is
+	// downloaded as. Its extension says what kind of audio it is.
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+
+	// Duration is how long the recording is in seconds, and Waveform is
+	// whether it has a waveform. Both are only known if the waveform could
+	// be worked out.
+	Duration float64 `json:"duration"`
+	Waveform bool    `json:"waveform"`
+
+	UploadedBy string    `json:"uploadedBy"`
+	Uploaded   time.Time `json:"uploaded"`
+}
+
+var (
+	// errRecordingNotFound is returned when there is no recording with the
+	// ID which was asked for.
+	errRecordingNotFound = newAPIError(codeRecordingNotFound, "no recording with that ID")
+
+	// errRecordingTooLarge is returned when a recording is uploaded which is
+	// larger than maxRecordingSize.
+	errRecordingTooLarge = newAPIError(codeRecordingTooLarge, fmt.Sprintf("recordings can't be larger than %d MB", maxRecordingSize>>20))
+
+	// errWaveformNotFound is returned when a recording's waveform is asked
+	// for, but it couldn't be worked out when it was uploaded.
+	errWaveformNotFound = newAPIError(codeNotFound, "the recording has no waveform")
+)
+
+func init() {
+	tabReferenceMovers = append(tabReferenceMovers, (*Server).moveRecordingTabs)
+}
+
+// recordingDirectory returns the directory which the recordings are kept in.
+func (s *Server) recordingDirectory() string {
+	if s.RecordingDirectory == "" {
+		return defaultRecordingDirectory
+	}
+
+	return s.RecordingDirectory
+}
+
+// recordingPath returns the path of a recording's file, which is named after
+// its ID and keeps the extension of the file which was uploaded.
+func (s *Server) recordingPath(recording *Recording) string {
+	return filepath.Join(s.recordingDirectory(), recording.ID+strings.ToLower(filepath.Ext(recording.Filename)))
+}
+
+// recordings returns every recording, newest first.
+func (s *Server) recordings() ([]*Recording, error) {
+	recordings, err := s.Store.Recordings()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Uploaded.After(recordings[j].Uploaded)
+	})
+
+	return recordings, nil
+}
+
+// getRecording returns the recording with the given ID. The second return
+// value is false if there is no such recording.
+func (s *Server) getRecording(id string) (*Recording, bool, error) {
+	return s.Store.Recording(id)
+}
+
+// saveRecording stores a recording, which must already have an ID.
+func (s *Server) saveRecording(recording *Recording) error {
+	return s.Store.PutRecording(recording)
+}
+
+// removeRecording deletes a recording, along with its file and waveform.
+func (s *Server) removeRecording(recording *Recording) error {
+	if err := os.Remove(s.recordingPath(recording)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.Store.DeleteRecording(recording.ID)
+}
+
+// reattachRecordings changes what every recording which matches is attached
+// to, and saves the ones which changed.
+func (s *Server) reattachRecordings(change func(recording *Recording) bool) error {
+	s.recordingLock.Lock()
+	defer s.recordingLock.Unlock()
+
+	recordings, err := s.recordings()
+	if err != nil {
+		return err
+	}
+
+	for _, recording := range recordings {
+		if !change(recording) {
+			continue
+		}
+
+		if err := s.saveRecording(recording); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceRecordingTab attaches every recording which was attached to the tab
+// with the ID from to the tab with the ID to instead, or to nothing if to is
+// empty.
+func (s *Server) replaceRecordingTab(from, to string) error {
+	return s.reattachRecordings(func(recording *Recording) bool {
+		if recording.TabID != from {
+			return false
+		}
+
+		recording.TabID = to
+		return true
+	})
+}
+
+// moveRecordingTabs moves the recordings of the tab with the ID from to the
+// tab with the ID to, when the two tabs are merged.
+func (s *Server) moveRecordingTabs(from, to string) error {
+	return s.replaceRecordingTab(from, to)
+}
+
+// detachSetlistRecordings leaves the recordings which were attached to the
+// setlist with the given ID attached to nothing, once it has been deleted.
+func (s *Server) detachSetlistRecordings(id string) error {
+	return s.reattachRecordings(func(recording *Recording) bool {
+		if recording.SetlistID != id {
+			return false
+		}
+
+		recording.SetlistID = ""
+		return true
+	})
+}
+
+// recordingAttachmentFromForm attaches the recording to the tab or setlist
+// with the ID in the request's 'tab' or 'setlist' form value. If neither is
+// given, it is left as it is, unless required is true, in which case it is an
+// error. If there is an error, the HTTP status which it should be reported
+// with is returned along with it.
+func (s *Server) recordingAttachmentFromForm(r *http.Request, recording *Recording, required bool) (int, error) {
+	tabID, setlistID := r.FormValue("tab"), r.FormValue("setlist")
+
+	switch {
+	case tabID != "" && setlistID != "":
+		return http.StatusBadRequest, errors.New("a recording can't be attached to a tab and a setlist at once")
+
+	case tabID != "":
+		if _, ok, err := s.Store.GetTab(tabID); err != nil {
+			return http.StatusInternalServerError, err
+		} else if !ok {
+			return http.StatusBadRequest, newAPIError(codeTabNotFound, "no tab with the ID "+tabID)
+		}
+
+		recording.TabID, recording.SetlistID = tabID, ""
+
+	case setlistID != "":
+		if _, ok, err := s.getSetlist(setlistID); err != nil {
+			return http.StatusInternalServerError, err
+		} else if !ok {
+			return http.StatusBadRequest, newAPIError(codeSetlistNotFound, "no setlist with the ID "+setlistID)
+		}
+
+		recording.TabID, recording.SetlistID = "", setlistID
+
+	case required:
+		return http.StatusBadRequest, errors.New("a recording has to be attached to a tab or a setlist")
+	}
+
+	return http.StatusOK, nil
+}
+
+// recordingTitleFromForm returns the title in the request's 'title' form
+// value, or the given one if there isn't one.
+func recordingTitleFromForm(r *http.Request, title string) (string, error) {
+	if value := strings.TrimSpace(r.FormValue("title")); value != "" {
+		title = value
+	}
+
+	if utf8.RuneCountInString(title) > maxRecordingTitleLength {
+		return "", fmt.Errorf("the title can't be longer than %d characters", maxRecordingTitleLength)
+	}
+
+	return title, nil
+}
+
+// uploadRecording stores the audio file in the request's 'file' form value as
+// a new recording, with the title in the 'title' form value, or the file's
+// name if there isn't one, attached to the tab or setlist in the 'tab' or
+// 'setlist' form value. Its waveform is worked out straight away. If there is
+// an error, the HTTP status which it should be reported with is returned
+// along with it.
+func (s *Server) uploadRecording(w http.ResponseWriter, r *http.Request) (*Recording, int, error) {
+	// A little is allowed on top of the recording for the rest of the
+	// form.
+	limit := int64(maxRecordingSize + 1<<20)
+	if r.ContentLength > limit {
+		return nil, http.StatusRequestEntityTooLarge, errRecordingTooLarge
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	if err := r.ParseMultipartForm(recordingUploadMemory); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("the upload couldn't be read: %s", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("a recording needs to be uploaded as 'file'")
+	}
+	defer file.Close()
+
+	filename := filepath.Base(header.Filename)
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	contentType, ok := recordingTypes[ext]
+	if !ok {
+		return nil, http.StatusUnsupportedMediaType, newAPIError(codeUnsupportedAudio, "recordings can't be "+ext+" files")
+	}
+
+	title, err := recordingTitleFromForm(r, strings.TrimSuffix(filename, filepath.Ext(filename)))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	recording := &Recording{
+		Title:       title,
+		Filename:    filename,
+		ContentType: contentType,
+		UploadedBy:  s.requestActor(r).Name,
+		Uploaded:    time.Now(),
+	}
+
+	if status, err := s.recordingAttachmentFromForm(r, recording, true); err != nil {
+		return nil, status, err
+	}
+
+	recording.ID, err = s.Store.NextID(counterRecordings)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := os.MkdirAll(s.recordingDirectory(), 0755); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	path := s.recordingPath(recording)
+
+	out, err := os.Create(path)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	recording.Size, err = io.Copy(out, file)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(path)
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// A recording without a waveform can still be played, so it is kept
+	// even if its waveform can't be worked out.
+	waveform, err := makeWaveform(path, ext)
+	if err == nil {
+		encoded, err := json.Marshal(waveform)
+		if err != nil {
+			os.Remove(path)
+			return nil, http.StatusInternalServerError, err
+		}
+
+		if err := s.Store.PutWaveform(recording.ID, encoded); err != nil {
+			os.Remove(path)
+			return nil, http.StatusInternalServerError, err
+		}
+
+		recording.Duration = waveform.Duration
+		recording.Waveform = true
+	} else if err != errNoWaveform {
+		s.logMessage("warn", "warning: the waveform of recording %s couldn't be worked out: %s", recording.ID, err)
+	}
+
+	if err := s.saveRecording(recording); err != nil {
+		os.Remove(path)
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return recording, http.StatusOK, nil
+}
+
+// handleRecordings is called to respond to a HTTP request to /recordings. The
+// page plays the recordings attached to the tab or setlist with the ID in the
+// 'tab' or 'setlist' query value, and lets more be uploaded.
+func (s *Server) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	//  Disable caching for this route.
+	w.Header().Set("Cache-Control", "max-age=0")
+
+	http.ServeFile(w, r, s.staticPath("html/recordings.html"))
+}
+
+// handleRecordingsAPI is called to respond to a HTTP request to
+// /api/v1/recordings. A GET request responds with every recording, newest
+// first, encoded in JSON, or only the ones attached to the tab or setlist
+// with the ID in the 'tab' or 'setlist' query value. A POST request uploads
+// a recording, as described by uploadRecording, and responds with it.
+func (s *Server) handleRecordingsAPI(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		recordings, err := s.recordings()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		tabID, setlistID := r.FormValue("tab"), r.FormValue("setlist")
+		if tabID != "" || setlistID != "" {
+			filtered := make([]*Recording, 0, len(recordings))
+
+			for _, recording := range recordings {
+				if (tabID == "" || recording.TabID == tabID) && (setlistID == "" || recording.SetlistID == setlistID) {
+					filtered = append(filtered, recording)
+				}
+			}
+
+			recordings = filtered
+		}
+
+		result = recordings
+
+	case "POST":
+		recording, status, err := s.uploadRecording(w, r)
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+
+		s.publishEvent(eventRecordingAdded, s.requestActor(r), map[string]interface{}{
+			"id":      recording.ID,
+			"title":   recording.Title,
+			"tab":     recording.TabID,
+			"setlist": recording.SetlistID,
+		})
+
+		result = recording
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET and POST are supported"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleRecordingAPI is called to respond to a HTTP request to
+// /api/v1/recordings/{id}. A GET request responds with the recording, encoded
+// in JSON. A POST request changes its title to the 'title' form value, or
+// attaches it to the tab or setlist in the 'tab' or 'setlist' form value, if
+// they are given, and responds with the changed recording. A DELETE request
+// deletes it, along with its file.
+func (s *Server) handleRecordingAPI(w http.ResponseWriter, r *http.Request) {
+	s.recordingLock.Lock()
+	defer s.recordingLock.Unlock()
+
+	recording, ok, err := s.getRecording(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errRecordingNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+
+	case "POST":
+		title, err := recordingTitleFromForm(r, recording.Title)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if status, err := s.recordingAttachmentFromForm(r, recording, false); err != nil {
+			writeError(w, status, err)
+			return
+		}
+
+		recording.Title = title
+
+		if err := s.saveRecording(recording); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+	case "DELETE":
+		if err := s.removeRecording(recording); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		}
+
+		return
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET, POST and DELETE are supported"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recording)
+}
+
+// handleRecordingAudioAPI is called to respond to a HTTP request to
+// /api/v1/recordings/{id}/audio. It responds with the recording's audio,
+// which can be asked for a part at a time with the Range header, so that it
+// can be skipped through without downloading all of it first.
+func (s *Server) handleRecordingAudioAPI(w http.ResponseWriter, r *http.Request) {
+	recording, ok, err := s.getRecording(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errRecordingNotFound)
+		return
+	}
+
+	file, err := os.Open(s.recordingPath(recording))
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, errors.New("the recording's file no longer exists"))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", recording.ContentType)
+	w.Header().Set("Content-Disposition", "inline; filename="+strconv.Quote(recording.Filename))
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// handleRecordingWaveformAPI is called to respond to a HTTP request to
+// /api/v1/recordings/{id}/waveform. It responds with the recording's
+// waveform, encoded in JSON.
+func (s *Server) handleRecordingWaveformAPI(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if _, ok, err := s.getRecording(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errRecordingNotFound)
+		return
+	}
+
+	waveform, ok, err := s.Store.Waveform(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errWaveformNotFound)
+		return
+	}
+
+	// A recording's audio never changes, so neither does its waveform.
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(waveform)
+}
@@ -0,0 +1,2575 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisStore is a Store which keeps everything in a Redis database.
+//
+// Each tab's data is kept in a hashmap in the key tab:ID, and its tags in a
+// set in tab:ID:tags, with any extra tags in tab:ID:extra-tags. The set
+// 'tabs' holds the IDs of every tab, the hashmap 'filenames' maps each tab's
+// filename to its ID, and 'tab-counter' is the last ID which was given out.
+// Each setting is in a key of the same name as its JSON field. Where the rest
+// of the data is kept is described by the methods which use it.
+type RedisStore struct {
+	db *redis.Client
+}
+
+// NewRedisStore creates a RedisStore which keeps everything in the given
+// database.
+func NewRedisStore(db *redis.Client) *RedisStore {
+	return &RedisStore{db: db}
+}
+
+// GetTab returns the tab with the given ID. If there is no such tab, the
+// second return value is false.
+func (rs *RedisStore) GetTab(id string) (*Tab, bool, error) {
+	tabs, err := rs.GetTabs([]string{id})
+	if err != nil {
+		return nil, false, err
+	} else if len(tabs) == 0 {
+		return nil, false, nil
+	}
+
+	return tabs[0], true, nil
+}
+
+// GetTabs returns the tabs with each of the given IDs, in the same order,
+// leaving out any which don't exist. All of the commands are sent in a
+// pipeline, so no matter how many tabs there are, it only takes one round
+// trip to the database (or two, if some of the tabs were cached by an older
+// version and need updating).
+func (rs *RedisStore) GetTabs(ids []string) ([]*Tab, error) {
+	var (
+		dataCmds = make([]*redis.StringStringMapCmd, len(ids))
+		tagCmds  = make([]*redis.StringSliceCmd, len(ids))
+	)
+
+	// Use the HGETALL Redis command to get all key-value pairs from each
+	// tab's hashmap, and SMEMBERS to get each tab's set of tags, which is
+	// stored in a separate key. A tab which doesn't exist has no hashmap,
+	// so HGETALL gives an empty map for it.
+	_, err := rs.db.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			dataCmds[i] = pipe.HGetAll("tab:" + id)
+			tagCmds[i] = pipe.SMembers("tab:" + id + ":tags")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tabs := make([]*Tab, 0, len(ids))
+
+	// Fields which older versions didn't store are filled in here, and
+	// saved in another pipeline afterwards.
+	updates := make(map[string]map[string]interface{})
+
+	for i, id := range ids {
+		data := dataCmds[i].Val()
+		if len(data) == 0 {
+			continue
+		}
+
+		tab, missing := tabFromData(data, tagCmds[i].Val())
+		if len(missing) > 0 {
+			updates["tab:"+id] = missing
+		}
+
+		tabs = append(tabs, tab)
+	}
+
+	if len(updates) > 0 {
+		_, err := rs.db.Pipelined(func(pipe redis.Pipeliner) error {
+			for key, fields := range updates {
+				pipe.HMSet(key, fields)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tabs, nil
+}
+
+// tabFromData constructs a tab from the fields of its hashmap in the database
+// and its tags. Any fields which tabs cached by older versions don't have
+// are worked out from the tab's content, and returned so they can be saved.
+func tabFromData(data map[string]string, tags []string) (*Tab, map[string]interface{}) {
+	// Create the tab to return. If the added time can't be parsed, it will
+	// be left as the zero time.
+	added, _ := time.Parse(time.RFC3339, data["added"])
+	modified, _ := time.Parse(time.RFC3339Nano, data["modified"])
+
+	tab := &Tab{
+		ID:       data["id"],
+		Artist:   data["artist"],
+		Content:  data["content"],
+		Title:    data["title"],
+		Filename: data["filename"],
+		Pattern:  data["pattern"],
+		Tags:     tags,
+		Added:    added,
+
+		Modified:    modified,
+		ContentHash: data["hash"],
+		Language:    data["lang"],
+
+		Explicit:         data["explicit"] == "1",
+		ExplicitOverride: data["explicit-override"],
+
+		Tuning: data["detected-tuning"],
+		Chords: strings.Fields(data["chords"]),
+
+		Binary: data["format"] != "",
+		Format: data["format"],
+
+		Instruments: splitInstruments(data["instruments"]),
+
+		Source: TabSource{
+			Kind:    data["source"],
+			URL:     data["source-url"],
+			Author:  data["source-author"],
+			License: data["source-license"],
+		},
+
+		Practice: practiceFromData(data),
+	}
+
+	missing := make(map[string]interface{})
+
+	// Tabs cached before languages were detected don't have one yet, so
+	// detect it now and remember it for next time.
+	if _, ok := data["lang"]; !ok {
+		tab.Language = detectLanguage(tab.Content)
+		missing["lang"] = tab.Language
+	}
+
+	// The same goes for whether the tab is explicit.
+	if _, ok := data["explicit"]; !ok {
+		tab.Explicit = detectExplicit(tab.Content)
+		missing["explicit"] = boolString(tab.Explicit)
+	}
+
+	// And the tuning and capo which its content says to use.
+	if _, ok := data["detected-tuning"]; ok {
+		tab.Capo, _ = strconv.Atoi(data["detected-capo"])
+	} else {
+		tab.Tuning, tab.Capo = detectTuning(tab.Content)
+		missing["detected-tuning"] = tab.Tuning
+		missing["detected-capo"] = tab.Capo
+	}
+
+	// And the chords it uses, which are kept separated by spaces.
+	if _, ok := data["chords"]; !ok {
+		tab.Chords = detectChords(tab.Content)
+		missing["chords"] = strings.Join(tab.Chords, " ")
+	}
+
+	// Tabs cached before binary files were recognised have the whole file
+	// as their content, along with whatever was detected from it, so that
+	// is all cleared out. Their titles and artists are read from their files
+	// the next time they change. MusicXML files were cached as text until
+	// they were recognised too, and they start with a '<', which few text
+	// tabs do.
+	format, ok := data["format"]
+	if !ok || (format == "" && strings.HasPrefix(strings.TrimSpace(tab.Content), "<")) {
+		tab.Format = detectBinaryFormat([]byte(tab.Content))
+		missing["format"] = tab.Format
+
+		if tab.Format != "" {
+			content := []byte(tab.Content)
+
+			tab.Binary = true
+			tab.Content, tab.Language, tab.Explicit, tab.Chords = "", "", false, nil
+			tab.Tuning, tab.Capo = "", 0
+
+			if meta, err := readBinaryMetadata(tab.Format, content); err == nil {
+				tab.Tuning = meta.Tuning
+				tab.Instruments = meta.Instruments
+			}
+
+			missing["content"] = ""
+			missing["lang"] = ""
+			missing["explicit"] = boolString(false)
+			missing["detected-tuning"] = tab.Tuning
+			missing["detected-capo"] = 0
+			missing["chords"] = ""
+			missing["instruments"] = strings.Join(tab.Instruments, "\n")
+		}
+	}
+
+	// Tabs cached before sources were recorded were almost certainly found
+	// in the tab directory.
+	if tab.Source.Kind == "" {
+		tab.Source.Kind = sourceScan
+		missing["source"] = sourceScan
+	}
+
+	// The detected value is what's stored, so the admin's override is
+	// applied on top of it.
+	tab.applyExplicitOverride()
+
+	return tab, missing
+}
+
+// splitInstruments returns the names of a tab's instruments from its hashmap
+// in the database, where they are kept on separate lines, since they can
+// have spaces in them.
+func splitInstruments(field string) []string {
+	if field == "" {
+		return nil
+	}
+
+	return strings.Split(field, "\n")
+}
+
+// tabData returns the fields of a tab's hashmap in the database. The tab's
+// explicit override isn't included, since it is only ever changed on its
+// own.
+func tabData(tab *Tab) map[string]interface{} {
+	data := map[string]interface{}{
+		"title":    tab.Title,
+		"artist":   tab.Artist,
+		"content":  tab.Content,
+		"id":       tab.ID,
+		"filename": tab.Filename,
+		"pattern":  tab.Pattern,
+		"added":    tab.Added.Format(time.RFC3339),
+		"modified": tab.Modified.Format(time.RFC3339Nano),
+		"hash":     tab.ContentHash,
+		"lang":     tab.Language,
+		"explicit": boolString(tab.Explicit),
+
+		"detected-tuning": tab.Tuning,
+		"detected-capo":   tab.Capo,
+		"chords":          strings.Join(tab.Chords, " "),
+
+		"format":      tab.Format,
+		"instruments": strings.Join(tab.Instruments, "\n"),
+	}
+
+	for field, value := range sourceData(tab.Source) {
+		data[field] = value
+	}
+
+	for field, value := range practiceData(tab.Practice) {
+		data[field] = value
+	}
+
+	return data
+}
+
+// sourceData returns the fields of a tab's hashmap in the database which
+// hold its source.
+func sourceData(source TabSource) map[string]interface{} {
+	return map[string]interface{}{
+		"source":         source.Kind,
+		"source-url":     source.URL,
+		"source-author":  source.Author,
+		"source-license": source.License,
+	}
+}
+
+// PutTab stores a tab. If the tab's ID is empty, it is stored as a new tab
+// and its ID is set to the next available one. Otherwise, it replaces the tab
+// with that ID, which must already exist.
+func (rs *RedisStore) PutTab(tab *Tab) error {
+	if tab.ID == "" {
+		return rs.putNewTab(tab)
+	}
+
+	key := "tab:" + tab.ID
+
+	// Find the tab's old filename, so the filename-ID mapping can be moved
+	// if the file has been renamed.
+	oldFilename, err := rs.db.HGet(key, "filename").Result()
+	if err == redis.Nil {
+		return fmt.Errorf("no tab with the ID %s", tab.ID)
+	} else if err != nil {
+		return err
+	}
+
+	if err := rs.db.HMSet(key, tabData(tab)).Err(); err != nil {
+		return err
+	}
+
+	if oldFilename != tab.Filename {
+		if err := rs.db.HDel("filenames", oldFilename).Err(); err != nil {
+			return err
+		}
+
+		if err := rs.db.HSet("filenames", tab.Filename, tab.ID).Err(); err != nil {
+			return err
+		}
+	}
+
+	// The tags are replaced completely rather than worked out from the
+	// differences, since there are only ever a handful of them.
+	if err := rs.db.Del(key + ":tags").Err(); err != nil {
+		return err
+	}
+
+	if len(tab.Tags) > 0 {
+		if err := rs.db.SAdd(key+":tags", interfaces(tab.Tags)...).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putNewTab stores a tab which hasn't been stored before, setting its ID to
+// the next available ID.
+func (rs *RedisStore) putNewTab(tab *Tab) error {
+	// Increment the tab-counter in the database, using the new value
+	// as the ID.
+	id, err := rs.db.Incr("tab-counter").Result()
+	if err != nil {
+		return err
+	}
+
+	// Set the tab's ID to the ID from the database, converted to a
+	// string first.
+	tab.ID = fmt.Sprintf("%v", id)
+
+	// Append the ID to the tabs set.
+	if err := rs.db.SAdd("tabs", id).Err(); err != nil {
+		return err
+	}
+
+	// Add the filename-ID mapping to the filenames hashmap.
+	if err := rs.db.HSet("filenames", tab.Filename, id).Err(); err != nil {
+		return err
+	}
+
+	// Create the tab's data hashmap, in the tab:ID key.
+	if err := rs.db.HMSet("tab:"+tab.ID, tabData(tab)).Err(); err != nil {
+		return err
+	}
+
+	if len(tab.Tags) > 0 {
+		// Create the tab's tag set, in the tab:ID:tags key.
+		if err := rs.db.SAdd("tab:"+tab.ID+":tags", interfaces(tab.Tags)...).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// maxRestoreAttempts is how many times RestoreTab tries to store a tab when
+// the keys it watches keep being changed.
+const maxRestoreAttempts = 5
+
+// RestoreTab stores a tab under the ID it already has, and raises the
+// tab-counter to that ID if it is lower, so that new tabs are given higher
+// IDs. The tab's key and the counter are watched while they are checked, and
+// the tab is written in a transaction, so that a tab which is stored under
+// the same ID in the meantime can't be overwritten, and a counter which is
+// raised in the meantime can't be lowered again. If the counter was raised,
+// it is checked again.
+func (rs *RedisStore) RestoreTab(tab *Tab) error {
+	id, err := strconv.ParseInt(tab.ID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("the tab ID %q isn't a number", tab.ID)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := rs.db.Watch(func(tx *redis.Tx) error {
+			return restoreTab(tx, tab, id)
+		}, "tab:"+tab.ID, "tab-counter")
+
+		if err != redis.TxFailedErr || attempt == maxRestoreAttempts-1 {
+			return err
+		}
+	}
+}
+
+// restoreTab checks that the tab's ID isn't in use, and stores the tab under
+// it in a transaction, which fails if the watched keys were changed.
+func restoreTab(tx *redis.Tx, tab *Tab, id int64) error {
+	if exists, err := tx.Exists("tab:" + tab.ID).Result(); err != nil {
+		return err
+	} else if exists > 0 {
+		return fmt.Errorf("the tab ID %s is already in use", tab.ID)
+	}
+
+	counter, err := tx.Get("tab-counter").Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+		if counter < id {
+			pipe.Set("tab-counter", id, 0)
+		}
+
+		pipe.SAdd("tabs", tab.ID)
+		pipe.HSet("filenames", tab.Filename, tab.ID)
+		pipe.HMSet("tab:"+tab.ID, tabData(tab))
+
+		if len(tab.Tags) > 0 {
+			pipe.SAdd("tab:"+tab.ID+":tags", interfaces(tab.Tags)...)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// DeleteTab removes the tab with the given ID.
+func (rs *RedisStore) DeleteTab(id string) error {
+	filename, err := rs.db.HGet("tab:"+id, "filename").Result()
+	if err == redis.Nil {
+		return fmt.Errorf("no tab with the ID %s", id)
+	} else if err != nil {
+		return err
+	}
+
+	// Delete the tab's data hashmap and its tags sets.
+	if err := rs.db.Del("tab:"+id, "tab:"+id+":tags", "tab:"+id+":extra-tags").Err(); err != nil {
+		return err
+	}
+
+	// Remove the tab's ID from the ID set, meaning that it will no longer be
+	// included when looking up the list of all tabs.
+	if err := rs.db.SRem("tabs", id).Err(); err != nil {
+		return err
+	}
+
+	// Delete the filename from the hashmap which maps the filenames to their
+	// tab IDs.
+	return rs.db.HDel("filenames", filename).Err()
+}
+
+// ListIDs returns the IDs of every stored tab, in no particular order.
+func (rs *RedisStore) ListIDs() ([]string, error) {
+	return rs.db.SMembers("tabs").Result()
+}
+
+// Filenames returns a map from the filename of every stored tab to its ID.
+func (rs *RedisStore) Filenames() (map[string]string, error) {
+	return rs.db.HGetAll("filenames").Result()
+}
+
+// TabID returns the ID of the tab with the given filename. If there is no
+// such tab, the second return value is false.
+func (rs *RedisStore) TabID(filename string) (string, bool, error) {
+	id, err := rs.db.HGet("filenames", filename).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return id, true, nil
+}
+
+// SetModified changes just the modification time of the tab with the given
+// ID.
+func (rs *RedisStore) SetModified(id string, modified time.Time) error {
+	return rs.db.HSet("tab:"+id, "modified", modified.Format(time.RFC3339Nano)).Err()
+}
+
+// SetSource changes just the source of the tab with the given ID.
+func (rs *RedisStore) SetSource(id string, source TabSource) error {
+	return rs.db.HMSet("tab:"+id, sourceData(source)).Err()
+}
+
+// SetPractice changes just the practice metadata of the tab with the given
+// ID.
+func (rs *RedisStore) SetPractice(id string, practice TabPractice) error {
+	return rs.db.HMSet("tab:"+id, practiceData(practice)).Err()
+}
+
+// SetExplicitOverride changes the explicit override of the tab with the
+// given ID. An empty override removes it.
+func (rs *RedisStore) SetExplicitOverride(id, override string) error {
+	if override == explicitOverrideNone {
+		return rs.db.HDel("tab:"+id, "explicit-override").Err()
+	}
+
+	return rs.db.HSet("tab:"+id, "explicit-override", override).Err()
+}
+
+// ExtraTags returns the tags which have been added to the tab with the given
+// ID on top of the ones from its file.
+func (rs *RedisStore) ExtraTags(id string) ([]string, error) {
+	return rs.db.SMembers("tab:" + id + ":extra-tags").Result()
+}
+
+// AddExtraTags adds to the extra tags of the tab with the given ID.
+func (rs *RedisStore) AddExtraTags(id string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	return rs.db.SAdd("tab:"+id+":extra-tags", interfaces(tags)...).Err()
+}
+
+// RewriteTags replaces the tags and extra tags of several tabs at once. The
+// commands are sent in a transaction, so that nothing sees some of the tabs
+// changed and others not.
+func (rs *RedisStore) RewriteTags(tags, extraTags map[string][]string) error {
+	_, err := rs.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		for id, newTags := range tags {
+			pipe.Del("tab:" + id + ":tags")
+
+			if len(newTags) > 0 {
+				pipe.SAdd("tab:"+id+":tags", interfaces(newTags)...)
+			}
+		}
+
+		for id, newTags := range extraTags {
+			pipe.Del("tab:" + id + ":extra-tags")
+
+			if len(newTags) > 0 {
+				pipe.SAdd("tab:"+id+":extra-tags", interfaces(newTags)...)
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// CollectionVersion returns the collection version, which is 0 before
+// anything has changed.
+func (rs *RedisStore) CollectionVersion() (int64, error) {
+	version, err := rs.db.Get("collection-version").Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	return version, err
+}
+
+// BumpCollectionVersion increments the collection version.
+func (rs *RedisStore) BumpCollectionVersion() error {
+	return rs.db.Incr("collection-version").Err()
+}
+
+// ResetTabs removes every tab, so that the next tab stored gets the first ID
+// again.
+func (rs *RedisStore) ResetTabs() error {
+	// Remove all keys in the database with the prefix tab:*, which holds
+	// every tab's data and tags.
+	if _, err := deleteMatching(rs.db, "tab:*"); err != nil {
+		return err
+	}
+
+	// Empty the tab ID list and the filename-ID map.
+	if err := rs.db.Del("tabs", "filenames").Err(); err != nil {
+		return err
+	}
+
+	// Reset the tab counter to 0, so the next tab will be
+	// assigned the ID of (0 + 1) = 1.
+	return rs.db.Set("tab-counter", 0, 0).Err()
+}
+
+// LoadSettings creates a new instance of Settings by fetching
+// the settings from the database. If there is an error while
+// fetching the data, an error will be returned.
+func (rs *RedisStore) LoadSettings() (*Settings, error) {
+	db := rs.db
+
+	// The settings which a fresh install starts with are used
+	// for any which are missing.
+	defaults := DefaultSettings()
+
+	// Get the password's SHA256 hash from the database, and
+	// check for any errors. If there is an error, this is
+	// returned from the function. If there is no password yet,
+	// the database hasn't been set up, which Bootstrap will do,
+	// so the hash is left empty.
+	pw, err := db.Get("password-hash").Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	// The same thing is done for each other field which must
+	// be fetched, except that their defaults are used if they
+	// are missing.
+	dir, err := getOr(db, "tab-directory", defaults.TabDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	// The filename patterns are a list, since the order they
+	// are tried in matters. Older versions only had a single
+	// pattern, which is used if there isn't a list yet.
+	patterns, err := db.LRange("filename-patterns", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(patterns) == 0 {
+		pattern, err := getOr(db, "filename-pattern", defaults.FilenamePatterns[0])
+		if err != nil {
+			return nil, err
+		}
+
+		patterns = []string{pattern}
+	}
+
+	// This field is slightly different in that it is a set of
+	// strings instead of just a single string, which means
+	// that a different function must be used to fetch it.
+	nonCap, err := db.SMembers("non-capital-words").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	charsToRemove, err := getOr(db, "characters-to-remove", defaults.CharactersToRemove)
+	if err != nil {
+		return nil, err
+	}
+
+	// The folder settings were added later, so they might not
+	// exist in the database yet, in which case the defaults
+	// are used, which behave like older versions did.
+	scanDepth, err := db.Get("scan-depth").Result()
+	if err == redis.Nil {
+		scanDepth = "0"
+	} else if err != nil {
+		return nil, err
+	}
+
+	depth, err := strconv.Atoi(scanDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	folderMetadata, err := db.Get("folder-metadata").Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	// Like the non-capital words, the ignore patterns are a set.
+	// If there aren't any yet, this will just be empty.
+	ignorePatterns, err := db.SMembers("ignore-patterns").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// This is stored as "1" or "0", and is off if it hasn't been
+	// set yet.
+	hideExplicit, err := db.Get("hide-explicit").Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	// The tab cache TTL is in seconds, and uses the default if it
+	// hasn't been set yet.
+	tabCacheTTL, err := db.Get("tab-cache-ttl").Result()
+	if err == redis.Nil {
+		tabCacheTTL = strconv.Itoa(int(defaultTabCacheTTL / time.Second))
+	} else if err != nil {
+		return nil, err
+	}
+
+	ttl, err := strconv.Atoi(tabCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like hiding explicit tabs, this is off if it hasn't been
+	// set yet.
+	serveStale, err := db.Get("serve-stale").Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	// There is no transform script until the admin gives one, and
+	// its timeout is in milliseconds, using the default if it
+	// hasn't been set yet.
+	transformScript, err := getOr(db, "transform-script", "")
+	if err != nil {
+		return nil, err
+	}
+
+	transformScriptTimeout, err := getOr(db, "transform-script-timeout", strconv.Itoa(defaultTransformScriptTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	scriptTimeout, err := strconv.Atoi(transformScriptTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like hiding explicit tabs, public mode is off if it hasn't
+	// been set yet, and like the ignore patterns, the allowed
+	// licenses are a set.
+	publicMode, err := getOr(db, "public-mode", "0")
+	if err != nil {
+		return nil, err
+	}
+
+	allowedLicenses, err := db.SMembers("allowed-licenses").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Open mic mode is off until the admin turns it on too.
+	openMic, err := getOr(db, "open-mic", "0")
+	if err != nil {
+		return nil, err
+	}
+
+	// Anyone could read the collection before there were access modes.
+	accessMode, err := getOr(db, "access-mode", accessPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deleted tabs were always deleted straight away before there was a
+	// trash.
+	trashDaysValue, err := getOr(db, "trash-days", "0")
+	if err != nil {
+		return nil, err
+	}
+
+	trashDays, err := strconv.Atoi(trashDaysValue)
+	if err != nil {
+		return nil, err
+	}
+
+	// The auto-tag rules are JSON-encoded, since each one has a few
+	// parts, and there aren't any until the admin adds some.
+	autoTagData, err := getOr(db, "auto-tag-rules", "[]")
+	if err != nil {
+		return nil, err
+	}
+
+	autoTagRules := make([]AutoTagRule, 0)
+	if err := json.Unmarshal([]byte(autoTagData), &autoTagRules); err != nil {
+		return nil, err
+	}
+
+	// Create a new Settings instance populated with the fetched
+	// fields and return it.
+	return &Settings{
+		PasswordHash:       pw,
+		TabDirectory:       dir,
+		FilenamePatterns:   patterns,
+		NonCapitalWords:    nonCap,
+		CharactersToRemove: charsToRemove,
+		ScanDepth:          depth,
+		FolderMetadata:     folderMetadata,
+		IgnorePatterns:     ignorePatterns,
+		HideExplicit:       hideExplicit == "1",
+		TabCacheTTL:        ttl,
+		ServeStale:         serveStale == "1",
+
+		TransformScript:        transformScript,
+		TransformScriptTimeout: scriptTimeout,
+		PublicMode:             publicMode == "1",
+		AllowedLicenses:        allowedLicenses,
+		AutoTagRules:           autoTagRules,
+		OpenMic:                openMic == "1",
+		AccessMode:             accessMode,
+		TrashDays:              trashDays,
+	}, nil
+}
+
+// getOr gets the string with the given key from the database, or def if
+// there isn't one.
+func getOr(db *redis.Client, key, def string) (string, error) {
+	value, err := db.Get(key).Result()
+	if err == redis.Nil {
+		return def, nil
+	}
+
+	return value, err
+}
+
+// hget gets the given field of the hashmap with the given key. If there is
+// no such field, the second return value is false.
+func hget(db *redis.Client, key, field string) (string, bool, error) {
+	value, err := db.HGet(key, field).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return value, true, nil
+}
+
+// hgetJSON decodes the JSON in the given field of the hashmap with the given
+// key into v. If there is no such field, v is left alone and false is
+// returned.
+func hgetJSON(db *redis.Client, key, field string, v interface{}) (bool, error) {
+	encoded, err := db.HGet(key, field).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal(encoded, v)
+}
+
+// hsetJSON stores v, encoded as JSON, in the given field of the hashmap with
+// the given key.
+func hsetJSON(db *redis.Client, key, field string, v interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return db.HSet(key, field, encoded).Err()
+}
+
+// SaveSettings stores all of the settings except from the password hash.
+func (rs *RedisStore) SaveSettings(settings *Settings) error {
+	autoTagRules := settings.AutoTagRules
+	if autoTagRules == nil {
+		autoTagRules = []AutoTagRule{}
+	}
+
+	autoTagData, err := json.Marshal(autoTagRules)
+	if err != nil {
+		return err
+	}
+
+	// Use the MSET command (sets multiple scalar values) to set the new
+	// settings data into the database.
+	if err := rs.db.MSet(
+		"tab-directory", settings.TabDirectory,
+		// The first filename pattern is also stored on its own, so
+		// that older versions, which only had one pattern, still work.
+		"filename-pattern", firstString(settings.FilenamePatterns),
+		"characters-to-remove", settings.CharactersToRemove,
+		"scan-depth", settings.ScanDepth,
+		"folder-metadata", settings.FolderMetadata,
+		"hide-explicit", boolString(settings.HideExplicit),
+		"tab-cache-ttl", settings.TabCacheTTL,
+		"serve-stale", boolString(settings.ServeStale),
+		"transform-script", settings.TransformScript,
+		"transform-script-timeout", settings.TransformScriptTimeout,
+		"public-mode", boolString(settings.PublicMode),
+		"auto-tag-rules", string(autoTagData),
+		"open-mic", boolString(settings.OpenMic),
+		"access-mode", settings.AccessMode,
+		"trash-days", settings.TrashDays,
+	).Err(); err != nil {
+		return err
+	}
+
+	// The sets are replaced completely, by removing the old ones and then
+	// adding each of the new members. SADD needs at least one member, so
+	// it isn't used for empty sets.
+	sets := map[string][]string{
+		"non-capital-words": settings.NonCapitalWords,
+		"ignore-patterns":   settings.IgnorePatterns,
+		"allowed-licenses":  settings.AllowedLicenses,
+	}
+
+	for key, members := range sets {
+		if err := rs.db.Del(key).Err(); err != nil {
+			return err
+		}
+
+		if len(members) > 0 {
+			if err := rs.db.SAdd(key, interfaces(members)...).Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The filename patterns are replaced in the same way, but as a list,
+	// so that their order is kept.
+	if err := rs.db.Del("filename-patterns").Err(); err != nil {
+		return err
+	}
+
+	if len(settings.FilenamePatterns) > 0 {
+		return rs.db.RPush("filename-patterns", interfaces(settings.FilenamePatterns)...).Err()
+	}
+
+	return nil
+}
+
+// firstString returns the first string in the list, or an empty string if
+// the list is empty.
+func firstString(strs []string) string {
+	if len(strs) == 0 {
+		return ""
+	}
+
+	return strs[0]
+}
+
+// PasswordHash returns the stored hash of the admin password.
+func (rs *RedisStore) PasswordHash() (string, error) {
+	return rs.db.Get("password-hash").Result()
+}
+
+// SetPasswordHash changes the stored hash of the admin password.
+func (rs *RedisStore) SetPasswordHash(hash string) error {
+	return rs.db.Set("password-hash", hash, 0).Err()
+}
+
+// NextID increments the counter with the given name, which is kept in the key
+// of the same name, and returns its new value.
+func (rs *RedisStore) NextID(counter string) (string, error) {
+	id, err := rs.db.Incr(counter).Result()
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(id, 10), nil
+}
+
+// IDCounter returns the value of the counter with the given name, which is 0
+// if no IDs have been given out yet.
+func (rs *RedisStore) IDCounter(counter string) (int64, error) {
+	value, err := rs.db.Get(counter).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	return value, err
+}
+
+// SetIDCounter changes the value of the counter with the given name.
+func (rs *RedisStore) SetIDCounter(counter string, value int64) error {
+	return rs.db.Set(counter, value, 0).Err()
+}
+
+// NowShowing returns the ID of the tab on show in each state, which are kept
+// in the 'now-showing' hashmap.
+func (rs *RedisStore) NowShowing() (map[string]string, error) {
+	return rs.db.HGetAll("now-showing").Result()
+}
+
+// SetNowShowing changes the tab on show in one state. An empty ID means that
+// nothing is.
+func (rs *RedisStore) SetNowShowing(state, id string) error {
+	if id == "" {
+		return rs.db.HDel("now-showing", state).Err()
+	}
+
+	return rs.db.HSet("now-showing", state, id).Err()
+}
+
+// CollectionModified returns when the collection last changed, which is kept
+// in 'collection-modified' as a Unix time. The second return value is false
+// if that isn't known.
+func (rs *RedisStore) CollectionModified() (time.Time, bool, error) {
+	seconds, err := rs.db.Get("collection-modified").Int64()
+	if err == redis.Nil {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return time.Unix(seconds, 0), true, nil
+}
+
+// SetCollectionModified records when the collection last changed.
+func (rs *RedisStore) SetCollectionModified(modified time.Time) error {
+	return rs.db.Set("collection-modified", modified.Unix(), 0).Err()
+}
+
+// MountSentinel returns the tab directory which the mount sentinel was last
+// seen in, which is kept in 'mount-sentinel', or an empty string if it hasn't
+// been seen.
+func (rs *RedisStore) MountSentinel() (string, error) {
+	dir, err := rs.db.Get("mount-sentinel").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	return dir, err
+}
+
+// SetMountSentinel changes the tab directory which the mount sentinel was
+// last seen in.
+func (rs *RedisStore) SetMountSentinel(dir string) error {
+	return rs.db.Set("mount-sentinel", dir, 0).Err()
+}
+
+// Ping checks that Redis can be reached.
+func (rs *RedisStore) Ping() error {
+	if err := rs.db.Ping().Err(); err != nil {
+		return fmt.Errorf("Redis can't be reached at %s: %s", rs.db.Options().Addr, err)
+	}
+
+	return nil
+}
+
+// Close closes the connections to Redis.
+func (rs *RedisStore) Close() error {
+	return rs.db.Close()
+}
+
+// SessionGeneration returns the current generation of sessions, which is
+// kept in 'session-generation' and is "0" until EndAllSessions is first
+// called.
+func (rs *RedisStore) SessionGeneration() (string, error) {
+	generation, err := rs.db.Get("session-generation").Result()
+	if err == redis.Nil {
+		return "0", nil
+	}
+
+	return generation, err
+}
+
+// EndAllSessions moves on to the next generation of sessions.
+func (rs *RedisStore) EndAllSessions() error {
+	return rs.db.Incr("session-generation").Err()
+}
+
+// CreateSession stores a session in the key session:ID, which holds the
+// generation it was made in and expires once the duration has passed, so
+// that old sessions don't build up.
+func (rs *RedisStore) CreateSession(id, generation string, duration time.Duration) error {
+	return rs.db.Set("session:"+id, generation, duration).Err()
+}
+
+// Session returns the generation which the session with the given ID was
+// made in. The second return value is false if there is no such session.
+func (rs *RedisStore) Session(id string) (string, bool, error) {
+	generation, err := rs.db.Get("session:" + id).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return generation, true, nil
+}
+
+// DeleteSession removes the session with the given ID.
+func (rs *RedisStore) DeleteSession(id string) error {
+	return rs.db.Del("session:" + id).Err()
+}
+
+// CountRequest counts a request from the IP address in the key ratelimit:IP,
+// which expires at the end of the window. The return value is true if there
+// have been more than limit requests in the window, along with how long is
+// left of it.
+func (rs *RedisStore) CountRequest(ip string, limit int64, window time.Duration) (bool, time.Duration, error) {
+	key := "ratelimit:" + ip
+
+	count, err := rs.db.Incr(key).Result()
+	if err != nil {
+		return false, 0, err
+	}
+
+	// The first request in a window creates the counter, so that is when
+	// its expiry is set.
+	if count == 1 {
+		if err := rs.db.Expire(key, window).Err(); err != nil {
+			return false, 0, err
+		}
+	}
+
+	if count <= limit {
+		return false, 0, nil
+	}
+
+	wait, err := rs.db.TTL(key).Result()
+	if err != nil {
+		return false, 0, err
+	}
+
+	return true, wait, nil
+}
+
+// Lockout returns how long is left of the IP address's lockout, which is the
+// remaining time to live of the key lockout:IP, or 0 if it isn't locked out.
+func (rs *RedisStore) Lockout(ip string) (time.Duration, error) {
+	wait, err := rs.db.TTL("lockout:" + ip).Result()
+	if err != nil || wait < 0 {
+		return 0, err
+	}
+
+	return wait, nil
+}
+
+// LockOut locks out the IP address for the given duration.
+func (rs *RedisStore) LockOut(ip string, duration time.Duration) error {
+	return rs.db.Set("lockout:"+ip, 1, duration).Err()
+}
+
+// CountFailedLogin counts a wrong password entered from the IP address in the
+// key failed-logins:IP, which expires once the given duration has passed
+// without another one, and returns how many there have been.
+func (rs *RedisStore) CountFailedLogin(ip string, memory time.Duration) (int64, error) {
+	key := "failed-logins:" + ip
+
+	failures, err := rs.db.Incr(key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	return failures, rs.db.Expire(key, memory).Err()
+}
+
+// ClearFailedLogins forgets the wrong passwords entered from the IP address.
+func (rs *RedisStore) ClearFailedLogins(ip string) error {
+	return rs.db.Del("failed-logins:" + ip).Err()
+}
+
+// PutToken stores a token in the 'api-tokens' hashmap, which maps the hashes
+// of the tokens to their names, and its role in the 'api-token-roles'
+// hashmap, which maps their names to their roles.
+func (rs *RedisStore) PutToken(hash, name, role string) error {
+	if role != "" {
+		if err := rs.db.HSet("api-token-roles", name, role).Err(); err != nil {
+			return err
+		}
+	}
+
+	return rs.db.HSet("api-tokens", hash, name).Err()
+}
+
+// Tokens returns a map from the hash of every token to its name.
+func (rs *RedisStore) Tokens() (map[string]string, error) {
+	return rs.db.HGetAll("api-tokens").Result()
+}
+
+// TokenName returns the name of the token with the given hash. The second
+// return value is false if there is no such token.
+func (rs *RedisStore) TokenName(hash string) (string, bool, error) {
+	return hget(rs.db, "api-tokens", hash)
+}
+
+// TokenRoles returns a map from the name of every token which has a role to
+// its role.
+func (rs *RedisStore) TokenRoles() (map[string]string, error) {
+	return rs.db.HGetAll("api-token-roles").Result()
+}
+
+// TokenRole returns the role of the token with the given name. The second
+// return value is false if it doesn't have one.
+func (rs *RedisStore) TokenRole(name string) (string, bool, error) {
+	return hget(rs.db, "api-token-roles", name)
+}
+
+// DeleteToken removes the token with the given hash and name.
+func (rs *RedisStore) DeleteToken(hash, name string) error {
+	if err := rs.db.HDel("api-tokens", hash).Err(); err != nil {
+		return err
+	}
+
+	return rs.db.HDel("api-token-roles", name).Err()
+}
+
+// Roles returns the permissions of every role, which are kept in the
+// 'role-permissions' hashmap as JSON lists. The second return value is false
+// if it doesn't exist.
+func (rs *RedisStore) Roles() (map[string][]string, bool, error) {
+	data, err := rs.db.HGetAll("role-permissions").Result()
+	if err != nil || len(data) == 0 {
+		return nil, false, err
+	}
+
+	roles := make(map[string][]string, len(data))
+
+	for role, encoded := range data {
+		// The placeholder which SaveRoles stores when there are no roles
+		// isn't a role itself.
+		if role == "" {
+			continue
+		}
+
+		var permissions []string
+		if err := json.Unmarshal([]byte(encoded), &permissions); err != nil {
+			return nil, false, err
+		}
+
+		roles[role] = permissions
+	}
+
+	return roles, true, nil
+}
+
+// SaveRoles replaces every role. If there are no roles at all, an empty
+// placeholder is stored so that the hashmap still exists.
+func (rs *RedisStore) SaveRoles(roles map[string][]string) error {
+	fields := make(map[string]interface{}, len(roles))
+
+	for role, permissions := range roles {
+		if permissions == nil {
+			permissions = make([]string, 0)
+		}
+
+		encoded, err := json.Marshal(permissions)
+		if err != nil {
+			return err
+		}
+
+		fields[role] = string(encoded)
+	}
+
+	if err := rs.db.Del("role-permissions").Err(); err != nil {
+		return err
+	}
+
+	if len(fields) == 0 {
+		return rs.db.HSet("role-permissions", "", "[]").Err()
+	}
+
+	return rs.db.HMSet("role-permissions", fields).Err()
+}
+
+// secretsKey returns the key of a purpose's keyring, which is a hashmap
+// mapping each key's ID to the key, encoded in JSON.
+func secretsKey(purpose string) string {
+	return "secrets:" + purpose
+}
+
+// legacySecretKeys are the keys which held each purpose's single key before
+// there were keyrings.
+var legacySecretKeys = map[string]string{
+	secretSession:    "session-secret",
+	secretURLSigning: "url-signing-key",
+}
+
+// Secrets returns every key in a purpose's keyring, in no particular order.
+func (rs *RedisStore) Secrets(purpose string) ([]signingSecret, error) {
+	fields, err := rs.db.HGetAll(secretsKey(purpose)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make([]signingSecret, 0, len(fields))
+
+	for id, encoded := range fields {
+		var secret signingSecret
+		if err := json.Unmarshal([]byte(encoded), &secret); err != nil {
+			return nil, fmt.Errorf("the %s key %s is corrupt: %s", purpose, id, err)
+		}
+
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, nil
+}
+
+// PutSecrets adds or replaces keys in a purpose's keyring.
+func (rs *RedisStore) PutSecrets(purpose string, secrets ...signingSecret) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	fields := make(map[string]interface{}, len(secrets))
+
+	for _, secret := range secrets {
+		encoded, err := json.Marshal(secret)
+		if err != nil {
+			return err
+		}
+
+		fields[secret.ID] = string(encoded)
+	}
+
+	return rs.db.HMSet(secretsKey(purpose), fields).Err()
+}
+
+// AddInitialSecret adds the first key to a purpose's keyring, using HSETNX so
+// that if two things do so at the same time, they both end up with the same
+// key. If the purpose's key from before there were keyrings is still there,
+// its value is used instead, and it is removed, so that it can't be used as
+// the first key again once it has been rotated away.
+func (rs *RedisStore) AddInitialSecret(purpose string, secret signingSecret) error {
+	legacyKey, hasLegacy := legacySecretKeys[purpose]
+
+	if hasLegacy {
+		legacy, err := rs.db.Get(legacyKey).Result()
+		if err == nil {
+			secret.Key = legacy
+		} else if err != redis.Nil {
+			return err
+		}
+	}
+
+	encoded, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+
+	if err := rs.db.HSetNX(secretsKey(purpose), secret.ID, string(encoded)).Err(); err != nil {
+		return err
+	}
+
+	if !hasLegacy {
+		return nil
+	}
+
+	return rs.db.Del(legacyKey).Err()
+}
+
+// ReplaceSecrets replaces a purpose's whole keyring with the one key, in a
+// transaction, so that nothing can find it empty and make a key of its own in
+// between.
+func (rs *RedisStore) ReplaceSecrets(purpose string, secret signingSecret) error {
+	encoded, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = rs.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(secretsKey(purpose))
+		pipe.HSet(secretsKey(purpose), secret.ID, string(encoded))
+		return nil
+	})
+
+	return err
+}
+
+// DeleteSecrets removes the keys with the given IDs from a purpose's keyring,
+// and returns how many there were.
+func (rs *RedisStore) DeleteSecrets(purpose string, ids ...string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	removed, err := rs.db.HDel(secretsKey(purpose), ids...).Result()
+	return int(removed), err
+}
+
+// TrashedTabs returns every tab in the trash, which is kept in the 'trash'
+// hashmap, mapping each deleted tab's ID to it, encoded in JSON.
+func (rs *RedisStore) TrashedTabs() ([]*trashedTab, error) {
+	fields, err := rs.db.HGetAll("trash").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	trashed := make([]*trashedTab, 0, len(fields))
+
+	for id, encoded := range fields {
+		tab := &trashedTab{}
+		if err := json.Unmarshal([]byte(encoded), tab); err != nil {
+			return nil, fmt.Errorf("the deleted tab with the ID %s is corrupt: %s", id, err)
+		}
+
+		trashed = append(trashed, tab)
+	}
+
+	return trashed, nil
+}
+
+// TrashedTab returns the tab in the trash with the given ID. The second
+// return value is false if there is no such tab.
+func (rs *RedisStore) TrashedTab(id string) (*trashedTab, bool, error) {
+	encoded, ok, err := hget(rs.db, "trash", id)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	tab := &trashedTab{}
+	if err := json.Unmarshal([]byte(encoded), tab); err != nil {
+		return nil, false, fmt.Errorf("the deleted tab with the ID %s is corrupt: %s", id, err)
+	}
+
+	return tab, true, nil
+}
+
+// PutTrashedTab puts a tab in the trash under the given ID.
+func (rs *RedisStore) PutTrashedTab(id string, tab *trashedTab) error {
+	encoded, err := json.Marshal(tab)
+	if err != nil {
+		return err
+	}
+
+	return rs.db.HSet("trash", id, string(encoded)).Err()
+}
+
+// DeleteTrashedTab takes the tab with the given ID out of the trash.
+func (rs *RedisStore) DeleteTrashedTab(id string) error {
+	return rs.db.HDel("trash", id).Err()
+}
+
+// CreateJob stores a new job in the hashmap job:ID, and adds its ID to the
+// front of the 'jobs' list, which holds the IDs of the jobs with the most
+// recent first. The records of the jobs which are now too old to be kept are
+// removed, and then trimmed off the end of the list.
+func (rs *RedisStore) CreateJob(j *job, keep int) error {
+	if err := rs.UpdateJob(j); err != nil {
+		return err
+	}
+
+	if err := rs.db.LPush("jobs", j.ID).Err(); err != nil {
+		return err
+	}
+
+	old, err := rs.db.LRange("jobs", int64(keep), -1).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, oldID := range old {
+		if err := rs.db.Del("job:" + oldID).Err(); err != nil {
+			return err
+		}
+	}
+
+	return rs.db.LTrim("jobs", 0, int64(keep)-1).Err()
+}
+
+// UpdateJob writes the job's current state to its hashmap. The cancel field
+// isn't written, since it is only ever set by RequestJobCancel.
+func (rs *RedisStore) UpdateJob(j *job) error {
+	errorsJSON, err := json.Marshal(j.Errors)
+	if err != nil {
+		return err
+	}
+
+	return rs.db.HMSet("job:"+j.ID, map[string]interface{}{
+		"id":      j.ID,
+		"kind":    j.Kind,
+		"status":  j.Status,
+		"start":   j.Start.Format(time.RFC3339Nano),
+		"end":     j.End.Format(time.RFC3339Nano),
+		"done":    j.Done,
+		"total":   j.Total,
+		"added":   j.Added,
+		"updated": j.Updated,
+		"skipped": j.Skipped,
+		"errors":  string(errorsJSON),
+	}).Err()
+}
+
+// SetJobProgress changes just how far through the job with the given ID is.
+func (rs *RedisStore) SetJobProgress(id string, done, total int) error {
+	return rs.db.HMSet("job:"+id, map[string]interface{}{
+		"done":  done,
+		"total": total,
+	}).Err()
+}
+
+// RequestJobCancel sets the cancel field of the job with the given ID.
+func (rs *RedisStore) RequestJobCancel(id string) error {
+	return rs.db.HSet("job:"+id, "cancel", "1").Err()
+}
+
+// Job returns the job with the given ID. The second return value is false if
+// there is no such job.
+func (rs *RedisStore) Job(id string) (*job, bool, error) {
+	data, err := rs.db.HGetAll("job:" + id).Result()
+	if err != nil {
+		return nil, false, err
+	} else if len(data) == 0 {
+		return nil, false, nil
+	}
+
+	// Since everything in a Redis hashmap is a string, each of the fields
+	// has to be parsed back into its proper type. If any of them are
+	// malformed they are left as their zero values.
+	j := &job{
+		ID:     data["id"],
+		Kind:   data["kind"],
+		Status: data["status"],
+		Errors: make([]string, 0),
+
+		CancelRequested: data["cancel"] == "1",
+	}
+
+	j.Start, _ = time.Parse(time.RFC3339Nano, data["start"])
+	j.End, _ = time.Parse(time.RFC3339Nano, data["end"])
+	j.Done, _ = strconv.Atoi(data["done"])
+	j.Total, _ = strconv.Atoi(data["total"])
+	j.Added, _ = strconv.Atoi(data["added"])
+	j.Updated, _ = strconv.Atoi(data["updated"])
+	j.Skipped, _ = strconv.Atoi(data["skipped"])
+	json.Unmarshal([]byte(data["errors"]), &j.Errors)
+
+	return j, true, nil
+}
+
+// Jobs returns every job which is still kept, most recent first.
+func (rs *RedisStore) Jobs() ([]*job, error) {
+	ids, err := rs.db.LRange("jobs", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*job, 0, len(ids))
+	for _, id := range ids {
+		j, ok, err := rs.Job(id)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			jobs = append(jobs, j)
+		}
+	}
+
+	return jobs, nil
+}
+
+// QueueJob adds the job with the given ID to the end of the 'job-queue' list.
+func (rs *RedisStore) QueueJob(id string) error {
+	return rs.db.RPush("job-queue", id).Err()
+}
+
+// NextQueuedJob takes the job at the front of the queue off it. BLPOP waits
+// for up to the given duration for something to be pushed onto the list, so
+// the workers don't have to keep polling the database.
+func (rs *RedisStore) NextQueuedJob(wait time.Duration) (string, bool, error) {
+	result, err := rs.db.BLPop(wait, "job-queue").Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	// The result is the name of the list followed by the popped value,
+	// which is the ID of the job.
+	return result[1], true, nil
+}
+
+// AddEvent adds an event to the end of the 'events' stream, which is trimmed
+// to roughly the given length. Redis gives the event its ID.
+func (rs *RedisStore) AddEvent(event loggedEvent, max int64) error {
+	return rs.db.XAdd(&redis.XAddArgs{
+		Stream:       "events",
+		MaxLenApprox: max,
+		ID:           "*",
+		Values: map[string]interface{}{
+			"schema": event.Schema,
+			"type":   event.Type,
+			"time":   event.Time,
+			"actor":  event.Actor,
+			"data":   event.Data,
+		},
+	}).Err()
+}
+
+// LatestEventID returns the ID of the newest event, or "0-0" if there aren't
+// any.
+func (rs *RedisStore) LatestEventID() (string, error) {
+	messages, err := rs.db.XRevRangeN("events", "+", "-", 1).Result()
+	if err != nil || len(messages) == 0 {
+		return "0-0", err
+	}
+
+	return messages[0].ID, nil
+}
+
+// EventsAfter returns up to count of the events after the one with the given
+// ID, oldest first.
+func (rs *RedisStore) EventsAfter(id string, count int64) ([]loggedEvent, error) {
+	streams, err := rs.db.XRead(&redis.XReadArgs{
+		Streams: []string{"events", id},
+		Count:   count,
+		Block:   -1,
+	}).Result()
+
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var events []loggedEvent
+
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			event := loggedEvent{ID: message.ID}
+			event.Schema, _ = message.Values["schema"].(string)
+			event.Type, _ = message.Values["type"].(string)
+			event.Time, _ = message.Values["time"].(string)
+			event.Actor, _ = message.Values["actor"].(string)
+			event.Data, _ = message.Values["data"].(string)
+
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// Recordings returns every recording, which are kept in the 'recordings'
+// hashmap, mapping each recording's ID to it, encoded in JSON.
+func (rs *RedisStore) Recordings() ([]*Recording, error) {
+	data, err := rs.db.HGetAll("recordings").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := make([]*Recording, 0, len(data))
+
+	for _, encoded := range data {
+		recording := &Recording{}
+		if err := json.Unmarshal([]byte(encoded), recording); err != nil {
+			return nil, err
+		}
+
+		recordings = append(recordings, recording)
+	}
+
+	return recordings, nil
+}
+
+// Recording returns the recording with the given ID. The second return value
+// is false if there is no such recording.
+func (rs *RedisStore) Recording(id string) (*Recording, bool, error) {
+	recording := &Recording{}
+	ok, err := hgetJSON(rs.db, "recordings", id, recording)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return recording, true, nil
+}
+
+// PutRecording stores a recording, which must already have an ID.
+func (rs *RedisStore) PutRecording(recording *Recording) error {
+	return hsetJSON(rs.db, "recordings", recording.ID, recording)
+}
+
+// DeleteRecording removes the recording with the given ID, along with its
+// waveform.
+func (rs *RedisStore) DeleteRecording(id string) error {
+	if err := rs.db.HDel("recording-waveforms", id).Err(); err != nil {
+		return err
+	}
+
+	return rs.db.HDel("recordings", id).Err()
+}
+
+// Waveform returns the JSON of the waveform of the recording with the given
+// ID, which are kept in the 'recording-waveforms' hashmap. The second return
+// value is false if it doesn't have one.
+func (rs *RedisStore) Waveform(id string) ([]byte, bool, error) {
+	waveform, err := rs.db.HGet("recording-waveforms", id).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	return waveform, true, nil
+}
+
+// PutWaveform stores the JSON of the waveform of the recording with the given
+// ID.
+func (rs *RedisStore) PutWaveform(id string, waveform []byte) error {
+	return rs.db.HSet("recording-waveforms", id, waveform).Err()
+}
+
+// Setlists returns every setlist, which are kept in the 'setlists' hashmap,
+// mapping each setlist's ID to it, encoded in JSON.
+func (rs *RedisStore) Setlists() ([]*Setlist, error) {
+	data, err := rs.db.HGetAll("setlists").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	setlists := make([]*Setlist, 0, len(data))
+
+	for _, encoded := range data {
+		setlist := &Setlist{}
+		if err := json.Unmarshal([]byte(encoded), setlist); err != nil {
+			return nil, err
+		}
+
+		setlists = append(setlists, setlist)
+	}
+
+	return setlists, nil
+}
+
+// Setlist returns the setlist with the given ID. The second return value is
+// false if there is no such setlist.
+func (rs *RedisStore) Setlist(id string) (*Setlist, bool, error) {
+	setlist := &Setlist{}
+	ok, err := hgetJSON(rs.db, "setlists", id, setlist)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return setlist, true, nil
+}
+
+// PutSetlist stores a setlist, which must already have an ID.
+func (rs *RedisStore) PutSetlist(setlist *Setlist) error {
+	return hsetJSON(rs.db, "setlists", setlist.ID, setlist)
+}
+
+// DeleteSetlist removes the setlist with the given ID.
+func (rs *RedisStore) DeleteSetlist(id string) error {
+	return rs.db.HDel("setlists", id).Err()
+}
+
+// SongRequests returns every song on the wishlist, which is kept in the
+// 'song-requests' hashmap, mapping each request's ID to it, encoded in JSON.
+func (rs *RedisStore) SongRequests() ([]*SongRequest, error) {
+	data, err := rs.db.HGetAll("song-requests").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]*SongRequest, 0, len(data))
+
+	for _, encoded := range data {
+		request := &SongRequest{}
+		if err := json.Unmarshal([]byte(encoded), request); err != nil {
+			return nil, err
+		}
+
+		requests = append(requests, request)
+	}
+
+	return requests, nil
+}
+
+// SongRequestIDs returns the IDs of every song on the wishlist.
+func (rs *RedisStore) SongRequestIDs() ([]string, error) {
+	return rs.db.HKeys("song-requests").Result()
+}
+
+// SongRequest returns the song on the wishlist with the given ID. The second
+// return value is false if there is no such song.
+func (rs *RedisStore) SongRequest(id string) (*SongRequest, bool, error) {
+	request := &SongRequest{}
+	ok, err := hgetJSON(rs.db, "song-requests", id, request)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return request, true, nil
+}
+
+// PutSongRequest stores a song request, which must already have an ID.
+func (rs *RedisStore) PutSongRequest(request *SongRequest) error {
+	return hsetJSON(rs.db, "song-requests", request.ID, request)
+}
+
+// DeleteSongRequests takes the songs with the given IDs off the wishlist,
+// along with who voted for them.
+func (rs *RedisStore) DeleteSongRequests(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := rs.db.HDel("song-request-voters", ids...).Err(); err != nil {
+		return err
+	}
+
+	return rs.db.HDel("song-requests", ids...).Err()
+}
+
+// SongRequestVoters returns everyone who has voted for the song with the
+// given ID, which are kept in the 'song-request-voters' hashmap as JSON
+// lists.
+func (rs *RedisStore) SongRequestVoters(id string) ([]string, error) {
+	voters := []string{}
+	if _, err := hgetJSON(rs.db, "song-request-voters", id, &voters); err != nil {
+		return nil, err
+	}
+
+	return voters, nil
+}
+
+// SetSongRequestVoters changes who has voted for the song with the given ID.
+func (rs *RedisStore) SetSongRequestVoters(id string, voters []string) error {
+	return hsetJSON(rs.db, "song-request-voters", id, voters)
+}
+
+// Views returns every view, which are kept in the 'views' hashmap, mapping
+// each view's name to it, encoded in JSON.
+func (rs *RedisStore) Views() (map[string]*view, error) {
+	data, err := rs.db.HGetAll("views").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	views := make(map[string]*view, len(data))
+
+	for name, encoded := range data {
+		v := &view{}
+		if err := json.Unmarshal([]byte(encoded), v); err != nil {
+			return nil, err
+		}
+
+		views[name] = v
+	}
+
+	return views, nil
+}
+
+// View returns the view with the given name. The second return value is
+// false if there is no such view.
+func (rs *RedisStore) View(name string) (*view, bool, error) {
+	v := &view{}
+	ok, err := hgetJSON(rs.db, "views", name, v)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return v, true, nil
+}
+
+// PutView stores a view, replacing any which already has the same name.
+func (rs *RedisStore) PutView(name string, v *view) error {
+	return hsetJSON(rs.db, "views", name, v)
+}
+
+// DeleteView removes the view with the given name. The return value is false
+// if there was no such view.
+func (rs *RedisStore) DeleteView(name string) (bool, error) {
+	removed, err := rs.db.HDel("views", name).Result()
+	return removed > 0, err
+}
+
+// Favourites returns the IDs of the owner's favourite tabs, which are kept in
+// a set in the key favourites:OWNER.
+func (rs *RedisStore) Favourites(owner string) ([]string, error) {
+	return rs.db.SMembers("favourites:" + owner).Result()
+}
+
+// AddFavourites adds to the owner's favourites. If expiry isn't 0, they are
+// forgotten once it has passed without them changing again.
+func (rs *RedisStore) AddFavourites(owner string, ids []string, expiry time.Duration) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	key := "favourites:" + owner
+
+	_, err := rs.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(key, interfaces(ids)...)
+
+		if expiry != 0 {
+			pipe.Expire(key, expiry)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// RemoveFavourite takes a tab out of the owner's favourites. If expiry isn't
+// 0, the rest are forgotten once it has passed without them changing again.
+func (rs *RedisStore) RemoveFavourite(owner, id string, expiry time.Duration) error {
+	key := "favourites:" + owner
+
+	_, err := rs.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SRem(key, id)
+
+		if expiry != 0 {
+			pipe.Expire(key, expiry)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// ExpireFavourites makes the owner's favourites last for the given duration
+// from now.
+func (rs *RedisStore) ExpireFavourites(owner string, expiry time.Duration) error {
+	return rs.db.Expire("favourites:"+owner, expiry).Err()
+}
+
+// FavouriteOwners returns everyone who has any favourites.
+func (rs *RedisStore) FavouriteOwners() ([]string, error) {
+	var (
+		cursor uint64
+		owners []string
+	)
+
+	for {
+		keys, next, err := rs.db.Scan(cursor, "favourites:*", scanBatchSize).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			owners = append(owners, strings.TrimPrefix(key, "favourites:"))
+		}
+
+		if next == 0 {
+			return owners, nil
+		}
+
+		cursor = next
+	}
+}
+
+// MoveFavourites replaces the tab with the ID from with the tab with the ID to
+// in everyone's favourites.
+func (rs *RedisStore) MoveFavourites(from, to string) error {
+	var cursor uint64
+
+	for {
+		keys, next, err := rs.db.Scan(cursor, "favourites:*", scanBatchSize).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			removed, err := rs.db.SRem(key, from).Result()
+			if err != nil {
+				return err
+			}
+
+			if removed > 0 {
+				if err := rs.db.SAdd(key, to).Err(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+
+		cursor = next
+	}
+}
+
+// RecordStats adds delta to each of the counters which the tab counts
+// towards. The counters are hashmaps from months to counts: 'stats:months'
+// for the whole collection, and stats:artist:ARTIST and stats:tag:TAG for
+// each artist and tag, and the 'stats:artists' and 'stats:tags' sets keep
+// track of which artists and tags have counters.
+func (rs *RedisStore) RecordStats(tab *Tab, delta int64) error {
+	_, err := rs.db.Pipelined(func(pipe redis.Pipeliner) error {
+		pipeStats(pipe, tab, delta)
+		return nil
+	})
+
+	return err
+}
+
+// pipeStats adds the commands which RecordStats sends to a pipeline, so that
+// they can be sent along with others, such as in a transaction.
+func pipeStats(pipe redis.Pipeliner, tab *Tab, delta int64) {
+	month := tab.Added.Format("2006-01")
+
+	pipe.HIncrBy("stats:months", month, delta)
+	pipe.SAdd("stats:artists", tab.Artist)
+	pipe.HIncrBy("stats:artist:"+tab.Artist, month, delta)
+
+	for _, tag := range tab.Tags {
+		pipe.SAdd("stats:tags", tag)
+		pipe.HIncrBy("stats:tag:"+tag, month, delta)
+	}
+}
+
+// StatCounters returns every counter.
+func (rs *RedisStore) StatCounters() (*statCounters, error) {
+	months, err := rs.monthCounter("stats:months")
+	if err != nil {
+		return nil, err
+	}
+
+	counters := &statCounters{
+		Months:  months,
+		Artists: make(map[string]map[string]int64),
+		Tags:    make(map[string]map[string]int64),
+	}
+
+	// The artists and tags are handled in exactly the same way, so this
+	// loop goes through both of them, filling in the appropriate map.
+	for _, group := range []struct {
+		set, prefix string
+		into        map[string]map[string]int64
+	}{
+		{"stats:artists", "stats:artist:", counters.Artists},
+		{"stats:tags", "stats:tag:", counters.Tags},
+	} {
+		names, err := rs.db.SMembers(group.set).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			if group.into[name], err = rs.monthCounter(group.prefix + name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return counters, nil
+}
+
+// monthCounter reads a counter hashmap.
+func (rs *RedisStore) monthCounter(key string) (map[string]int64, error) {
+	fields, err := rs.db.HGetAll(key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(fields))
+
+	for month, value := range fields {
+		if counts[month], err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, nil
+}
+
+// ResetStats removes every counter, and returns how many keys were removed.
+func (rs *RedisStore) ResetStats() (int64, error) {
+	keys := []string{"stats:months", "stats:artists", "stats:tags"}
+
+	artists, err := rs.db.SMembers("stats:artists").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, artist := range artists {
+		keys = append(keys, "stats:artist:"+artist)
+	}
+
+	tags, err := rs.db.SMembers("stats:tags").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, tag := range tags {
+		keys = append(keys, "stats:tag:"+tag)
+	}
+
+	return rs.db.Del(keys...).Result()
+}
+
+// IndexTab adds a tab to the search index. For each trigram, the set
+// search:trigram:TRIGRAM holds the IDs of the tabs containing it, and for
+// each tab, tab:ID:trigrams holds the trigrams it was indexed under, so they
+// can be removed again later. All of the commands are sent in one pipeline,
+// since a tab's content can have a lot of trigrams.
+func (rs *RedisStore) IndexTab(tab *Tab) error {
+	_, err := rs.db.Pipelined(func(pipe redis.Pipeliner) error {
+		pipeIndexTab(pipe, tab)
+		return nil
+	})
+
+	return err
+}
+
+// pipeIndexTab adds the commands which IndexTab sends to a pipeline, so that
+// they can be sent along with others, such as in a transaction.
+func pipeIndexTab(pipe redis.Pipeliner, tab *Tab) {
+	trigrams := indexTrigrams(searchText(tab))
+	if len(trigrams) == 0 {
+		return
+	}
+
+	members := make([]interface{}, 0, len(trigrams))
+
+	for trigram := range trigrams {
+		pipe.SAdd("search:trigram:"+trigram, tab.ID)
+		members = append(members, trigram)
+	}
+
+	pipe.SAdd("tab:"+tab.ID+":trigrams", members...)
+}
+
+// UnindexTab removes the tab with the given ID from the search index.
+func (rs *RedisStore) UnindexTab(id string) error {
+	trigrams, err := rs.db.SMembers("tab:" + id + ":trigrams").Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = rs.db.Pipelined(func(pipe redis.Pipeliner) error {
+		pipeUnindexTab(pipe, id, trigrams)
+		return nil
+	})
+
+	return err
+}
+
+// pipeUnindexTab adds the commands which remove the tab with the given ID
+// from the search index to a pipeline, given the trigrams it was indexed
+// under, which have to be read beforehand.
+func pipeUnindexTab(pipe redis.Pipeliner, id string, trigrams []string) {
+	for _, trigram := range trigrams {
+		pipe.SRem("search:trigram:"+trigram, id)
+	}
+
+	pipe.Del("tab:" + id + ":trigrams")
+}
+
+// SearchIDs returns the IDs of the tabs indexed under every one of the given
+// trigrams, which is the intersection of their sets.
+func (rs *RedisStore) SearchIDs(trigrams []string) ([]string, error) {
+	keys := make([]string, len(trigrams))
+	for i, trigram := range trigrams {
+		keys[i] = "search:trigram:" + trigram
+	}
+
+	return rs.db.SInter(keys...).Result()
+}
+
+// ResetSearchIndex removes every tab from the search index, and returns how
+// many keys were removed.
+func (rs *RedisStore) ResetSearchIndex() (int64, error) {
+	index, err := deleteMatching(rs.db, "search:*")
+	if err != nil {
+		return index, err
+	}
+
+	trigrams, err := deleteMatching(rs.db, "tab:*:trigrams")
+	return index + trigrams, err
+}
+
+// browseKeys returns the keys of the sets in the browse index which the tab
+// belongs in. For each artist, the set browse:artist:ARTIST holds the IDs of
+// their tabs, and for each tag, browse:tag:TAG holds the IDs of the tabs
+// which have it, where the artists and tags are their browseNames.
+func browseKeys(tab *Tab) []string {
+	keys := make([]string, 0, len(tab.Tags)+1)
+
+	if artist := browseName(tab.Artist); artist != "" {
+		keys = append(keys, "browse:artist:"+artist)
+	}
+
+	for _, tag := range tab.Tags {
+		if tag := browseName(tag); tag != "" {
+			keys = append(keys, "browse:tag:"+tag)
+		}
+	}
+
+	return keys
+}
+
+// AddToBrowseIndex adds a tab to the sets for its artist and each of its
+// tags. The 'browse:artist-names' hashmap maps each artist in the index to
+// their name as it was written in one of their tabs, and the
+// 'browse:explicit' set holds the IDs of the explicit tabs.
+func (rs *RedisStore) AddToBrowseIndex(tab *Tab) error {
+	_, err := rs.db.Pipelined(func(pipe redis.Pipeliner) error {
+		pipeBrowseIndex(pipe, tab)
+		return nil
+	})
+
+	return err
+}
+
+// pipeBrowseIndex adds the commands which AddToBrowseIndex sends to a
+// pipeline, so that they can be sent along with others, such as in a
+// transaction.
+func pipeBrowseIndex(pipe redis.Pipeliner, tab *Tab) {
+	for _, key := range browseKeys(tab) {
+		pipe.SAdd(key, tab.ID)
+	}
+
+	if artist := browseName(tab.Artist); artist != "" {
+		pipe.HSet("browse:artist-names", artist, tab.Artist)
+	}
+
+	if tab.Explicit {
+		pipe.SAdd("browse:explicit", tab.ID)
+	}
+}
+
+// RemoveFromBrowseIndex takes a tab out of the sets for its artist and each
+// of its tags. If it was its artist's last tab, the artist's name is
+// forgotten too.
+func (rs *RedisStore) RemoveFromBrowseIndex(tab *Tab) error {
+	_, err := rs.db.Pipelined(func(pipe redis.Pipeliner) error {
+		pipeBrowseRemoval(pipe, tab)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	artist := browseName(tab.Artist)
+	if artist == "" {
+		return nil
+	}
+
+	remaining, err := rs.db.SCard("browse:artist:" + artist).Result()
+	if err != nil || remaining > 0 {
+		return err
+	}
+
+	return rs.db.HDel("browse:artist-names", artist).Err()
+}
+
+// pipeBrowseRemoval adds the commands which take a tab out of the sets in the
+// browse index to a pipeline. Unlike RemoveFromBrowseIndex, the artist's name
+// is kept, so it should only be used when the tab is added again under the
+// same artist.
+func pipeBrowseRemoval(pipe redis.Pipeliner, tab *Tab) {
+	for _, key := range browseKeys(tab) {
+		pipe.SRem(key, tab.ID)
+	}
+
+	pipe.SRem("browse:explicit", tab.ID)
+}
+
+// MarkBrowseExplicit changes whether the tab with the given ID is in the
+// 'browse:explicit' set.
+func (rs *RedisStore) MarkBrowseExplicit(id string, explicit bool) error {
+	if explicit {
+		return rs.db.SAdd("browse:explicit", id).Err()
+	}
+
+	return rs.db.SRem("browse:explicit", id).Err()
+}
+
+// BrowseIDs returns the IDs of the tabs in the browse index's set for the
+// given kind and name.
+func (rs *RedisStore) BrowseIDs(kind, name string) ([]string, error) {
+	return rs.db.SMembers("browse:" + kind + ":" + name).Result()
+}
+
+// ArtistCounts returns a map from each artist in the browse index, as their
+// name was written, to how many tabs they have. Each count is worked out by
+// Redis from the artist's set, so no tabs are fetched.
+func (rs *RedisStore) ArtistCounts(explicit bool) (map[string]int, error) {
+	names, err := rs.db.HGetAll("browse:artist-names").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	countCmds := make(map[string]*redis.IntCmd, len(names))
+	cleanCmds := make(map[string]*redis.StringSliceCmd, len(names))
+
+	_, err = rs.db.Pipelined(func(pipe redis.Pipeliner) error {
+		for artist := range names {
+			key := "browse:artist:" + artist
+
+			if explicit {
+				countCmds[artist] = pipe.SCard(key)
+			} else {
+				cleanCmds[artist] = pipe.SDiff(key, "browse:explicit")
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(names))
+
+	for artist, name := range names {
+		if explicit {
+			counts[name] += int(countCmds[artist].Val())
+		} else if clean := len(cleanCmds[artist].Val()); clean > 0 {
+			counts[name] += clean
+		}
+	}
+
+	return counts, nil
+}
+
+// ResetBrowseIndex removes every tab from the browse index, and returns how
+// many keys were removed.
+func (rs *RedisStore) ResetBrowseIndex() (int64, error) {
+	return deleteMatching(rs.db, "browse:*")
+}
+
+// ReindexTabs replaces the counters and index entries of each tab in old with
+// the ones of the tab with the same ID in current, in one transaction.
+func (rs *RedisStore) ReindexTabs(old []*Tab, current map[string]*Tab) error {
+	trigrams := make(map[string][]string, len(old))
+	for _, tab := range old {
+		var err error
+		if trigrams[tab.ID], err = rs.db.SMembers("tab:" + tab.ID + ":trigrams").Result(); err != nil {
+			return err
+		}
+	}
+
+	_, err := rs.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, tab := range old {
+			pipeStats(pipe, tab, -1)
+			pipeUnindexTab(pipe, tab.ID, trigrams[tab.ID])
+			pipeBrowseRemoval(pipe, tab)
+
+			if now, ok := current[tab.ID]; ok {
+				pipeStats(pipe, now, 1)
+				pipeIndexTab(pipe, now)
+				pipeBrowseIndex(pipe, now)
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// IndexVersion returns the version of the layout which the index with the
+// given name was built with, which is kept in the key NAME-index-version, or
+// an empty string if it hasn't been built.
+func (rs *RedisStore) IndexVersion(index string) (string, error) {
+	version, err := rs.db.Get(index + "-index-version").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	return version, err
+}
+
+// SetIndexVersion changes the version of the layout which the index with the
+// given name was built with. An empty version means that it hasn't been
+// built.
+func (rs *RedisStore) SetIndexVersion(index, version string) error {
+	if version == "" {
+		return rs.db.Del(index + "-index-version").Err()
+	}
+
+	return rs.db.Set(index+"-index-version", version, 0).Err()
+}
+
+// TagRules returns every tag rule, which are kept in the 'tag-rules'
+// hashmap.
+func (rs *RedisStore) TagRules() (map[string]string, error) {
+	return rs.db.HGetAll("tag-rules").Result()
+}
+
+// UpdateTagRules removes the rules for the tags in removed, and then adds or
+// changes the ones in changed, in one transaction.
+func (rs *RedisStore) UpdateTagRules(changed map[string]string, removed []string) error {
+	_, err := rs.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		if len(removed) > 0 {
+			pipe.HDel("tag-rules", removed...)
+		}
+
+		for tag, to := range changed {
+			pipe.HSet("tag-rules", tag, to)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// ReplaceTagRules replaces every tag rule, in one transaction.
+func (rs *RedisStore) ReplaceTagRules(rules map[string]string) error {
+	_, err := rs.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del("tag-rules")
+
+		for tag, to := range rules {
+			pipe.HSet("tag-rules", tag, to)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// EditLock returns the lock of the tab with the given ID, which is kept in
+// the key edit-lock:ID, encoded in JSON. The second return value is false if
+// it isn't locked.
+func (rs *RedisStore) EditLock(id string) (*editLock, bool, error) {
+	encoded, err := rs.db.Get("edit-lock:" + id).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	lock := &editLock{}
+	if err := json.Unmarshal(encoded, lock); err != nil {
+		return nil, false, err
+	}
+
+	return lock, true, nil
+}
+
+// PutEditLock locks the tab with the given ID. Redis expires the lock's key
+// once the duration has passed.
+func (rs *RedisStore) PutEditLock(id string, lock *editLock, duration time.Duration) error {
+	encoded, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	return rs.db.Set("edit-lock:"+id, encoded, duration).Err()
+}
+
+// DeleteEditLock unlocks the tab with the given ID.
+func (rs *RedisStore) DeleteEditLock(id string) error {
+	return rs.db.Del("edit-lock:" + id).Err()
+}
+
+// CollabVersion returns the version of the room of the tab with the given ID
+// when it was last saved, which are kept in the 'collab-versions' hashmap.
+// The second return value is false if it has never been saved.
+func (rs *RedisStore) CollabVersion(id string) (int, bool, error) {
+	version, err := rs.db.HGet("collab-versions", id).Int()
+	if err == redis.Nil {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	return version, true, nil
+}
+
+// SetCollabVersion changes the version of the room of the tab with the given
+// ID.
+func (rs *RedisStore) SetCollabVersion(id string, version int) error {
+	return rs.db.HSet("collab-versions", id, version).Err()
+}
+
+// KeepPreviousContent keeps some old content of the tab with the given ID in
+// the key previous-content:ID:HASH, which expires once the duration has
+// passed.
+func (rs *RedisStore) KeepPreviousContent(id, hash, content string, duration time.Duration) error {
+	return rs.db.Set("previous-content:"+id+":"+hash, content, duration).Err()
+}
+
+// PreviousContent returns the old content with the given hash of the tab
+// with the given ID. The second return value is false if it isn't being kept.
+func (rs *RedisStore) PreviousContent(id, hash string) (string, bool, error) {
+	content, err := rs.db.Get("previous-content:" + id + ":" + hash).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return content, true, nil
+}
+
+// IntegritySnapshots returns up to the given number of the most recent
+// snapshots, newest first, which are kept in the 'integrity-snapshots' list,
+// encoded in JSON.
+func (rs *RedisStore) IntegritySnapshots(count int) ([]*integritySnapshot, error) {
+	encoded, err := rs.db.LRange("integrity-snapshots", 0, int64(count)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*integritySnapshot, 0, len(encoded))
+
+	for _, data := range encoded {
+		snapshot := new(integritySnapshot)
+		if err := json.Unmarshal([]byte(data), snapshot); err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
+// IntegrityHashes returns a map from the ID of every tab in the latest
+// snapshot to its content hash, which is kept in the 'integrity-hashes'
+// hashmap.
+func (rs *RedisStore) IntegrityHashes() (map[string]string, error) {
+	return rs.db.HGetAll("integrity-hashes").Result()
+}
+
+// AddIntegritySnapshot stores a snapshot as the latest one, along with the
+// content hashes which were found, in one transaction.
+func (rs *RedisStore) AddIntegritySnapshot(snapshot *integritySnapshot, hashes map[string]string, keep int) error {
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	_, err = rs.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.LPush("integrity-snapshots", encoded)
+		pipe.LTrim("integrity-snapshots", 0, int64(keep)-1)
+		pipe.Del("integrity-hashes")
+
+		if len(hashes) > 0 {
+			fields := make(map[string]interface{}, len(hashes))
+			for id, hash := range hashes {
+				fields[id] = hash
+			}
+
+			pipe.HMSet("integrity-hashes", fields)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// interfaces converts a list of strings into a list of type []interface{},
+// which is the type that commands such as SADD need their arguments in.
+func interfaces(strs []string) []interface{} {
+	is := make([]interface{}, len(strs))
+	for i, str := range strs {
+		is[i] = str
+	}
+
+	return is
+}
+
+// boolString converts a bool into the form it is stored in the database in,
+// which is "1" or "0".
+func boolString(b bool) string {
+	if b {
+		return "1"
+	}
+
+	return "0"
+}
+
+// scanBatchSize is roughly how many keys deleteMatching asks Redis for at a
+// time, and deletes at once.
+const scanBatchSize = 500
+
+// deleteMatching deletes every key in the database which matches the given
+// pattern, such as "tab:*". It goes through the keys using SCAN rather than
+// KEYS, so Redis isn't blocked for a long time on big databases, and deletes
+// each batch of keys as it goes. It returns how many keys were deleted.
+func deleteMatching(db *redis.Client, pattern string) (int64, error) {
+	var (
+		cursor  uint64
+		deleted int64
+	)
+
+	for {
+		keys, next, err := db.Scan(cursor, pattern, scanBatchSize).Result()
+		if err != nil {
+			return deleted, err
+		}
+
+		// A batch can be empty even when there are more to come, and DEL
+		// needs at least one key, so it is only called if any matched.
+		if len(keys) > 0 {
+			n, err := db.Del(keys...).Result()
+			if err != nil {
+				return deleted, err
+			}
+
+			deleted += n
+		}
+
+		// SCAN is finished when it gives back a cursor of 0.
+		if next == 0 {
+			return deleted, nil
+		}
+
+		cursor = next
+	}
+}
@@ -0,0 +1,78 @@
+package src
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+// testRedisStore returns a RedisStore using the Redis server at the address
+// in TAB_SERVER_TEST_REDIS_ADDR, whose database is emptied first, so it
+// mustn't be one which matters. If it isn't set, the test is skipped.
+func testRedisStore(t *testing.T) *RedisStore {
+	addr := os.Getenv("TAB_SERVER_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TAB_SERVER_TEST_REDIS_ADDR isn't set, so there is no Redis to test against")
+	}
+
+	db := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.FlushDB().Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewRedisStore(db)
+}
+
+func TestRedisStoreRestoreTabOnce(t *testing.T) {
+	testRestoreTabOnce(t, testRedisStore(t))
+}
+
+func TestMemoryStoreRestoreTabOnce(t *testing.T) {
+	testRestoreTabOnce(t, NewMemoryStore(DefaultSettings()))
+}
+
+// testRestoreTabOnce checks that several restores of the same ID at once
+// only store one of the tabs.
+func testRestoreTabOnce(t *testing.T, store Store) {
+	// Each restore mustn't see the ID free and overwrite the others.
+	var (
+		wait     sync.WaitGroup
+		lock     sync.Mutex
+		restored int
+	)
+
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+
+		go func(i int) {
+			defer wait.Done()
+
+			tab := &Tab{ID: "5", Title: "Waterloo", Artist: "Abba", Filename: fmt.Sprintf("abba - waterloo %d.txt", i)}
+			if err := store.RestoreTab(tab); err == nil {
+				lock.Lock()
+				restored++
+				lock.Unlock()
+			}
+		}(i)
+	}
+
+	wait.Wait()
+
+	if restored != 1 {
+		t.Errorf("expected exactly one tab to be restored, got %d", restored)
+	}
+
+	next := &Tab{Title: "SOS", Artist: "Abba", Filename: "abba - sos.txt"}
+	if err := store.PutTab(next); err != nil {
+		t.Fatal(err)
+	}
+
+	if next.ID != "6" {
+		t.Errorf("expected new tabs to be given IDs after the restored one, got %q", next.ID)
+	}
+}
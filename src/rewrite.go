@@ -0,0 +1,115 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A jsonRewriter holds back a JSON response so that it can be rewritten once
+// it is finished, such as into the shape which the deprecated API paths used.
+// Any other response is passed on as it is.
+type jsonRewriter struct {
+	http.ResponseWriter
+
+	// rewrite is given the response's status and its decoded JSON, and
+	// returns what should be sent instead. Numbers are decoded as
+	// json.Number, so that they are sent back exactly as they were.
+	rewrite func(status int, value interface{}) interface{}
+
+	status    int
+	decided   bool
+	buffering bool
+	buffer    bytes.Buffer
+}
+
+// WriteHeader decides whether the response needs to be rewritten, which it
+// does if it is JSON with a body. Otherwise, the status is written straight
+// away.
+func (rw *jsonRewriter) WriteHeader(status int) {
+	if rw.decided {
+		return
+	}
+
+	rw.decided = true
+	rw.status = status
+
+	hasBody := status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+	if hasBody && strings.HasPrefix(rw.Header().Get("Content-Type"), "application/json") {
+		rw.buffering = true
+		return
+	}
+
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes some of the response, holding it back if it will be
+// rewritten.
+func (rw *jsonRewriter) Write(b []byte) (int, error) {
+	if !rw.decided {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if rw.buffering {
+		return rw.buffer.Write(b)
+	}
+
+	return rw.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes on, so that responses which are streamed, such as
+// server-sent events, still arrive as they are written. A response which is
+// being held back can't be sent until it is finished, so flushing it does
+// nothing.
+func (rw *jsonRewriter) Flush() {
+	if !rw.decided {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if rw.buffering {
+		return
+	}
+
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes hijacking on, so that connections can still be taken over.
+func (rw *jsonRewriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the connection can't be hijacked")
+	}
+
+	return hijacker.Hijack()
+}
+
+// close rewrites a response which was held back and sends it. If it can't be
+// decoded, it is sent as it was.
+func (rw *jsonRewriter) close() {
+	if !rw.buffering {
+		return
+	}
+
+	body := rw.buffer.Bytes()
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err == nil {
+		if rewritten, err := json.Marshal(rw.rewrite(rw.status, value)); err == nil {
+			body = rewritten
+		}
+	}
+
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.ResponseWriter.WriteHeader(rw.status)
+	rw.ResponseWriter.Write(body)
+}
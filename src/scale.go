@@ -0,0 +1,99 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+)
+
+// noteNames maps each pitch class (0 = C, 1 = C#, ..., 11 = B) to the
+// name which is used to label it on a diagram.
+var noteNames = []string{
+	"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B",
+}
+
+// scaleIntervals maps the name of each supported scale or arpeggio to the
+// list of intervals, in semitones above the root, which make it up. The
+// root itself is always the first interval, 0.
+var scaleIntervals = map[string][]int{
+	"major":            {0, 2, 4, 5, 7, 9, 11},
+	"minor":            {0, 2, 3, 5, 7, 8, 10},
+	"harmonic-minor":   {0, 2, 3, 5, 7, 8, 11},
+	"melodic-minor":    {0, 2, 3, 5, 7, 9, 11},
+	"dorian":           {0, 2, 3, 5, 7, 9, 10},
+	"phrygian":         {0, 1, 3, 5, 7, 8, 10},
+	"lydian":           {0, 2, 4, 6, 7, 9, 11},
+	"mixolydian":       {0, 2, 4, 5, 7, 9, 10},
+	"locrian":          {0, 1, 3, 5, 6, 8, 10},
+	"major-pentatonic": {0, 2, 4, 7, 9},
+	"minor-pentatonic": {0, 3, 5, 7, 10},
+	"blues":            {0, 3, 5, 6, 7, 10},
+
+	"major-arpeggio":      {0, 4, 7},
+	"minor-arpeggio":      {0, 3, 7},
+	"diminished-arpeggio": {0, 3, 6},
+	"augmented-arpeggio":  {0, 4, 8},
+	"major7-arpeggio":     {0, 4, 7, 11},
+	"minor7-arpeggio":     {0, 3, 7, 10},
+	"dominant7-arpeggio":  {0, 4, 7, 10},
+}
+
+// parseNote converts a note name such as "C", "F#", "Bb" or "fs" into its
+// pitch class. Since '#' has a special meaning in URLs, a trailing 's' is
+// also accepted as a sharp, and a trailing 'b' is a flat. The second return
+// value is false if the name is not a valid note.
+func parseNote(name string) (int, bool) {
+	if len(name) == 0 {
+		return 0, false
+	}
+
+	// Find the natural note first, which is always the first character
+	// of the name.
+	base := -1
+	for index, note := range noteNames {
+		if note == strings.ToUpper(name[:1]) {
+			base = index
+			break
+		}
+	}
+
+	if base < 0 {
+		return 0, false
+	}
+
+	// Then apply each accidental in turn, wrapping around the octave if
+	// necessary so, for example, Cb becomes B.
+	for _, accidental := range name[1:] {
+		switch accidental {
+		case '#', 's':
+			base++
+		case 'b':
+			base--
+		default:
+			return 0, false
+		}
+	}
+
+	return (base%12 + 12) % 12, true
+}
+
+// scalePitches returns the set of pitch classes which make up the named
+// scale in the given key, along with the pitch class of the root. An
+// error is returned if either the key or scale type isn't recognised.
+func scalePitches(key, scaleType string) (root int, pitches map[int]bool, err error) {
+	root, ok := parseNote(key)
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown key: %s", key)
+	}
+
+	intervals, ok := scaleIntervals[strings.ToLower(scaleType)]
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown scale type: %s", scaleType)
+	}
+
+	pitches = make(map[int]bool, len(intervals))
+	for _, interval := range intervals {
+		pitches[(root+interval)%12] = true
+	}
+
+	return root, pitches, nil
+}
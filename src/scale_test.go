@@ -0,0 +1,87 @@
+package src
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNote(t *testing.T) {
+	cases := []struct {
+		name  string
+		pitch int
+		ok    bool
+	}{
+		{"C", 0, true},
+		{"c", 0, true},
+		{"F#", 6, true},
+		{"fs", 6, true},
+		{"Bb", 10, true},
+		{"bb", 10, true},
+
+		// Accidentals wrap around the octave.
+		{"Cb", 11, true},
+		{"B#", 0, true},
+		{"E#", 5, true},
+		{"Fb", 4, true},
+		{"C##", 2, true},
+
+		{"", 0, false},
+		{"H", 0, false},
+		{"Cx", 0, false},
+		{"C#m", 0, false},
+	}
+
+	for _, c := range cases {
+		pitch, ok := parseNote(c.name)
+		if ok != c.ok || (ok && pitch != c.pitch) {
+			t.Errorf("%q: expected %d (%v), got %d (%v)", c.name, c.pitch, c.ok, pitch, ok)
+		}
+	}
+}
+
+func TestScalePitches(t *testing.T) {
+	cases := []struct {
+		key, scaleType string
+		root           int
+		pitches        []int
+	}{
+		{"C", "major", 0, []int{0, 2, 4, 5, 7, 9, 11}},
+
+		// A scale which starts near the top of the octave wraps past B
+		// back round to C.
+		{"A", "minor", 9, []int{9, 11, 0, 2, 4, 5, 7}},
+		{"Bb", "major-pentatonic", 10, []int{10, 0, 2, 5, 7}},
+		{"B", "major7-arpeggio", 11, []int{11, 3, 6, 10}},
+
+		// Enharmonic keys give the same pitches.
+		{"F#", "blues", 6, []int{6, 9, 11, 0, 1, 4}},
+		{"Gb", "blues", 6, []int{6, 9, 11, 0, 1, 4}},
+
+		{"e", "Minor-Arpeggio", 4, []int{4, 7, 11}},
+	}
+
+	for _, c := range cases {
+		root, pitches, err := scalePitches(c.key, c.scaleType)
+		if err != nil {
+			t.Errorf("%s %s: %s", c.key, c.scaleType, err)
+			continue
+		}
+
+		expected := make(map[int]bool)
+		for _, pitch := range c.pitches {
+			expected[pitch] = true
+		}
+
+		if root != c.root || !reflect.DeepEqual(pitches, expected) {
+			t.Errorf("%s %s: expected %d and %v, got %d and %v", c.key, c.scaleType, c.root, expected, root, pitches)
+		}
+	}
+}
+
+func TestScalePitchesUnknown(t *testing.T) {
+	for _, c := range [][2]string{{"H", "major"}, {"", "major"}, {"C", "bebop"}, {"C", ""}} {
+		if _, _, err := scalePitches(c[0], c[1]); err == nil {
+			t.Errorf("%q %q: expected an error", c[0], c[1])
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// The admin can give a Lua script in the settings which is run on each tab as
+// it is read from its file, to change its metadata or content in ways which
+// the filename patterns and the other settings can't. The script sees the tab
+// as a global table called 'tab', with these fields, which it can change:
+//
+//	title, artist   strings
+//	tags            a list of strings
+//	content         the tab's content
+//	language        the detected language, such as "en"
+//	explicit        whether the tab was detected as explicit
+//	filename        the tab's filename, which can't be changed
+//
+// For example, this moves "(live)" from the title into the tags:
+//
+//	if tab.title:find("%(live%)") then
+//	  tab.title = tab.title:gsub("%s*%(live%)", "")
+//	  table.insert(tab.tags, "live")
+//	end
+//
+// The script runs in a sandbox, with only the base, string, table and math
+// libraries, and without the functions which load code or touch the files.
+// It is stopped if it runs for longer than the time in the settings, and it
+// can't use more than maxScriptRegistry values at once. Lua doesn't let the
+// length of strings be limited in general, so only string.rep, which can make
+// a huge string in one call, is stopped from making strings longer than
+// maxScriptString; strings built up in other ways, such as by joining them in
+// a loop, are only limited by the timeout. If the script fails, the tab is
+// stored as it was read, and the error is written to the console.
+const (
+	// defaultTransformScriptTimeout is how many milliseconds the script can
+	// run for on each tab, if the settings don't say otherwise.
+	defaultTransformScriptTimeout = 100
+
+	// maxTransformScriptTimeout is the most milliseconds the settings can
+	// let the script run for on each tab.
+	maxTransformScriptTimeout = 10000
+
+	// maxScriptString is the longest string which string.rep can make.
+	maxScriptString = 1 << 20
+
+	// maxScriptRegistry is the most values which the script can have on its
+	// stack at once, and maxScriptCallStack is how deeply it can call
+	// functions.
+	maxScriptRegistry  = 64 * 1024
+	maxScriptCallStack = 200
+)
+
+// unsafeScriptGlobals are the functions from the base library which would let
+// the script escape the sandbox or load other code.
+var unsafeScriptGlobals = []string{
+	"dofile",
+	"loadfile",
+	"load",
+	"loadstring",
+	"require",
+	"module",
+	"getfenv",
+	"setfenv",
+	"collectgarbage",
+	"newproxy",
+}
+
+// A compiledScript is the compiled form of the transform script, which is kept
+// so that the script is only compiled once rather than for every tab.
+type compiledScript struct {
+	source string
+	proto  *lua.FunctionProto
+}
+
+// lastScript is the most recently compiled script.
+var (
+	lastScript     *compiledScript
+	lastScriptLock sync.Mutex
+)
+
+// compileScript compiles a transform script, returning an error if it isn't
+// valid Lua. The most recently compiled script is kept, so compiling the same
+// one again is free.
+func compileScript(source string) (*lua.FunctionProto, error) {
+	lastScriptLock.Lock()
+	defer lastScriptLock.Unlock()
+
+	if lastScript != nil && lastScript.source == source {
+		return lastScript.proto, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(source), "transform script")
+	if err != nil {
+		return nil, errors.New(strings.TrimSpace(err.Error()))
+	}
+
+	proto, err := lua.Compile(chunk, "transform script")
+	if err != nil {
+		return nil, err
+	}
+
+	lastScript = &compiledScript{source: source, proto: proto}
+	return proto, nil
+}
+
+// newScriptState returns a Lua state with only the libraries which are safe
+// for the transform script to use. Anything the script prints is given to
+// printLine, a line at a time.
+func newScriptState(printLine func(line string)) *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   maxScriptCallStack,
+		RegistryMaxSize: maxScriptRegistry,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	for _, name := range unsafeScriptGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	// string.rep is the easiest way to use up all of the memory, so it is
+	// replaced with one which can't make strings which are too long.
+	if str, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		str.RawSetString("rep", L.NewFunction(limitedRep))
+		str.RawSetString("dump", lua.LNil)
+	}
+
+	// Anything the script prints is passed on.
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, L.GetTop())
+		for i := range parts {
+			parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+
+		printLine(strings.Join(parts, "\t"))
+		return 0
+	}))
+
+	return L
+}
+
+// limitedRep is string.rep, but it raises an error rather than making a
+// string longer than maxScriptString.
+func limitedRep(L *lua.LState) int {
+	str := L.CheckString(1)
+	n := L.CheckInt(2)
+
+	if n > 0 && len(str)*n > maxScriptString {
+		L.RaiseError("string.rep would make a string longer than %d bytes", maxScriptString)
+		return 0
+	}
+
+	if n < 0 {
+		n = 0
+	}
+
+	L.Push(lua.LString(strings.Repeat(str, n)))
+	return 1
+}
+
+// transformTab runs the transform script from the settings on a tab which has
+// just been read from its file, changing the tab to whatever the script left
+// in the 'tab' table. If there is no script, nothing happens. If the script
+// changes the content, the content hash is worked out again, and so are the
+// language and whether the tab is explicit, unless the script set them too.
+func (s *Server) transformTab(tab *Tab) error {
+	return runTransformScript(tab, s.Settings.TransformScript, s.Settings.TransformScriptTimeout, func(line string) {
+		s.logMessage("info", "[transform script] %s", line)
+	})
+}
+
+// runTransformScript runs a transform script on a tab, as transformTab does
+// with the one from the settings, letting it run for up to timeout
+// milliseconds, or the default if it is 0. Anything the script prints is given
+// to printLine, a line at a time.
+func runTransformScript(tab *Tab, source string, timeout int, printLine func(line string)) error {
+	if strings.TrimSpace(source) == "" {
+		return nil
+	}
+
+	proto, err := compileScript(source)
+	if err != nil {
+		return err
+	}
+
+	if timeout <= 0 {
+		timeout = defaultTransformScriptTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	L := newScriptState(printLine)
+	defer L.Close()
+	L.SetContext(ctx)
+
+	tags := L.NewTable()
+	for _, tag := range tab.Tags {
+		tags.Append(lua.LString(tag))
+	}
+
+	table := L.NewTable()
+	table.RawSetString("title", lua.LString(tab.Title))
+	table.RawSetString("artist", lua.LString(tab.Artist))
+	table.RawSetString("tags", tags)
+	table.RawSetString("content", lua.LString(tab.Content))
+	table.RawSetString("language", lua.LString(tab.Language))
+	table.RawSetString("explicit", lua.LBool(tab.Explicit))
+	table.RawSetString("filename", lua.LString(tab.Filename))
+	L.SetGlobal("tab", table)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("the transform script took longer than %dms", timeout)
+		}
+
+		// Only the message is kept, without Lua's stack traceback, so
+		// that the warning fits on one line.
+		if luaErr, ok := err.(*lua.ApiError); ok {
+			return errors.New(luaErr.Object.String())
+		}
+
+		return err
+	}
+
+	// The script might have replaced the table, or its fields, with things
+	// of the wrong type, which are ignored.
+	result, ok := L.GetGlobal("tab").(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("the transform script replaced 'tab' with a %s", L.GetGlobal("tab").Type())
+	}
+
+	tab.Title = scriptString(result, "title", tab.Title)
+	tab.Artist = scriptString(result, "artist", tab.Artist)
+
+	if list, ok := result.RawGetString("tags").(*lua.LTable); ok {
+		tab.Tags = make([]string, 0, list.Len())
+
+		list.ForEach(func(_, value lua.LValue) {
+			if tag, ok := value.(lua.LString); ok && tag != "" {
+				tab.Tags = addTags(tab.Tags, []string{string(tag)})
+			}
+		})
+	}
+
+	language := scriptString(result, "language", tab.Language)
+	explicit := tab.Explicit
+	if value, ok := result.RawGetString("explicit").(lua.LBool); ok {
+		explicit = bool(value)
+	}
+
+	if content := scriptString(result, "content", tab.Content); content != tab.Content {
+		tab.Content = content
+		tab.ContentHash = HashContent([]byte(content))
+
+		if language == tab.Language {
+			language = detectLanguage(content)
+		}
+
+		if explicit == tab.Explicit {
+			explicit = detectExplicit(content)
+		}
+
+		tab.Tuning, tab.Capo = detectTuning(content)
+		tab.Chords = detectChords(content)
+	}
+
+	tab.Language = language
+	tab.Explicit = explicit
+
+	return nil
+}
+
+// scriptString returns the string field of the table with the given name, or
+// def if it isn't a string.
+func scriptString(table *lua.LTable, name, def string) string {
+	if value, ok := table.RawGetString(name).(lua.LString); ok {
+		return string(value)
+	}
+
+	return def
+}
@@ -0,0 +1,238 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// searchIndexVersion is the version of the layout of the search index. If
+// the index in the store was built with a different version, it is built
+// again from scratch when the server starts.
+const searchIndexVersion = "1"
+
+// The search index is a trigram index kept in the store, so it survives
+// restarts and only ever has to be updated a tab at a time. Each trigram
+// (three character sequence) maps to the IDs of the tabs containing it, and
+// the store remembers the trigrams each tab was indexed under so they can be
+// removed again later.
+
+// searchWords splits text into lower case words, made up of letters and
+// digits. Everything else separates words.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// indexTrigrams returns the set of trigrams which text should be indexed
+// under. Each word is padded with a space on either side first, so that even
+// one and two letter words have trigrams.
+func indexTrigrams(text string) map[string]bool {
+	trigrams := make(map[string]bool)
+
+	for _, word := range searchWords(text) {
+		runes := []rune(" " + word + " ")
+
+		for i := 0; i+3 <= len(runes); i++ {
+			trigrams[string(runes[i:i+3])] = true
+		}
+	}
+
+	return trigrams
+}
+
+// queryTrigrams returns the trigrams which a tab must have been indexed under
+// to contain the given word somewhere. Words of two letters can only be
+// looked up as the start of a word, and single letters can't be looked up at
+// all, so they return nothing and every tab is a candidate.
+func queryTrigrams(word string) []string {
+	runes := []rune(word)
+
+	if len(runes) == 2 {
+		return []string{" " + word}
+	}
+
+	trigrams := make([]string, 0)
+	for i := 0; i+3 <= len(runes); i++ {
+		trigrams = append(trigrams, string(runes[i:i+3]))
+	}
+
+	return trigrams
+}
+
+// searchText returns all of the text in a tab which can be searched for.
+func searchText(tab *Tab) string {
+	return strings.Join(append([]string{tab.Title, tab.Artist, tab.Content}, tab.Tags...), " ")
+}
+
+// indexTab adds a tab, which must already have its ID, to the search index.
+func (s *Server) indexTab(tab *Tab) error {
+	return s.Store.IndexTab(tab)
+}
+
+// unindexTab removes the tab with the given ID from the search index.
+func (s *Server) unindexTab(id string) error {
+	return s.Store.UnindexTab(id)
+}
+
+// resetSearchIndex removes every tab from the search index, and returns how
+// many things were removed.
+func (s *Server) resetSearchIndex() (int64, error) {
+	return s.Store.ResetSearchIndex()
+}
+
+// ensureSearchIndex checks that the search index in the store was built
+// with the current searchIndexVersion, and if it wasn't, builds it again
+// from the cached tabs. This is done when the server starts, so that the
+// index only has to be built from scratch once after an upgrade rather than
+// on every restart.
+func (s *Server) ensureSearchIndex() error {
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	version, err := s.Store.IndexVersion(indexSearch)
+	if err != nil {
+		return err
+	} else if version == searchIndexVersion {
+		return nil
+	}
+
+	fmt.Println("Building the search index...")
+
+	if _, err := s.resetSearchIndex(); err != nil {
+		return err
+	}
+
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		return err
+	}
+
+	tabs, err := s.Store.GetTabs(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, tab := range tabs {
+		if err := s.indexTab(tab); err != nil {
+			return err
+		}
+	}
+
+	return s.Store.SetIndexVersion(indexSearch, searchIndexVersion)
+}
+
+// searchTabs returns the tabs which contain every word in the query, in
+// their title, artist, tags or content. The index narrows down the tabs to
+// check, and then each candidate is checked properly, since having all of
+// the trigrams of a word doesn't mean having the word itself. Transformations
+// are applied to the results.
+func (s *Server) searchTabs(query string) ([]*Tab, error) {
+	words := searchWords(query)
+
+	trigrams := make([]string, 0)
+	for _, word := range words {
+		trigrams = append(trigrams, queryTrigrams(word)...)
+	}
+
+	var (
+		ids []string
+		err error
+	)
+
+	// If none of the words could be looked up in the index, every tab has to
+	// be checked.
+	if len(trigrams) == 0 {
+		ids, err = s.Store.ListIDs()
+	} else {
+		ids, err = s.Store.SearchIDs(trigrams)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := s.Store.GetTabs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	tabs := make([]*Tab, 0)
+
+outerLoop:
+	for _, tab := range candidates {
+		text := strings.Join(searchWords(searchText(tab)), " ")
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				continue outerLoop
+			}
+		}
+
+		tab.applyTransformations(s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
+		tabs = append(tabs, tab)
+	}
+
+	sort.Slice(tabs, func(i, j int) bool {
+		return tabs[i].Title < tabs[j].Title
+	})
+
+	return tabs, nil
+}
+
+// handleSearchAPI is called to respond to a HTTP request to /api/v1/search. It
+// responds with the tabs matching the query in the 'q' query value, and in
+// the language in the 'lang' query value and the tuning in the 'tuning' query
+// value if there are ones, encoded in JSON. Each 'chord' query value, such as
+// '?chord=Em7', only keeps the tabs which use that chord.
+func (s *Server) handleSearchAPI(w http.ResponseWriter, r *http.Request) {
+	// Disable caching for this request - caching will be managed
+	// manually by this program.
+	w.Header().Set("Cache-Control", "max-age=0")
+
+	tabs, err := s.searchTabs(r.FormValue("q"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !s.showsExplicit(r) {
+		tabs = filterExplicit(tabs)
+	}
+
+	if s.restrictsLicenses(r) {
+		tabs = s.filterLicensed(tabs)
+	}
+
+	if lang := r.FormValue("lang"); lang != "" {
+		tabs = filterLanguage(tabs, lang)
+	}
+
+	if tuning := r.FormValue("tuning"); tuning != "" {
+		tabs = filterTuning(tabs, tuning)
+	}
+
+	if chords := r.Form["chord"]; len(chords) > 0 {
+		tabs = filterChords(tabs, chords)
+	}
+
+	favourites, err := s.favouriteIDs(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	markFavourites(tabs, favourites)
+
+	jsonData, err := json.Marshal(tabs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
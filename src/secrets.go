@@ -0,0 +1,413 @@
+package src
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Session cookies and signed URLs are signed with secret keys, which used to
+// be one key each, so that replacing one which might have been leaked logged
+// the admin out everywhere, or broke every link which had been shared. Now
+// each purpose has a keyring of keys instead, and webhook deliveries, as
+// described in webhook.go, have one too. New things are always signed
+// with the current key, which is the newest, but the older keys are still
+// accepted until everything signed with them would have expired anyway, at
+// which point they are retired and removed.
+//
+// Rotating a purpose's key makes a new current key, and starts the old ones
+// retiring, so nothing stops working. A key which is known to have leaked
+// can be revoked on its own instead, which only stops the sessions or links
+// signed with it from working. Keys can also be rotated on a schedule, so that
+// a key which leaks without anyone noticing isn't useful for long.
+//
+// The keys themselves are never sent out by the API, only their IDs and
+// dates.
+const (
+	// secretSession signs the session cookies and their CSRF tokens.
+	secretSession = "session"
+
+	// secretURLSigning signs the signed URLs.
+	secretURLSigning = "url-signing"
+
+	// initialSecretID is the ID of the first key in a keyring, so that two
+	// requests making the first key at the same time end up using the
+	// same one.
+	initialSecretID = "initial"
+
+	// secretRotationRetry is how long to wait before trying the scheduled
+	// rotation again if the keys couldn't be fetched.
+	secretRotationRetry = time.Hour
+)
+
+// A secretPurpose describes what a keyring's keys are used for.
+type secretPurpose struct {
+	// lifetime is the longest that anything signed with one of the keys
+	// can be used for, which is how long a key is kept after it stops
+	// being the current key.
+	lifetime time.Duration
+}
+
+// secretPurposes are the purposes which have keyrings, by name.
+var secretPurposes = map[string]secretPurpose{
+	secretSession:    {lifetime: sessionDuration},
+	secretURLSigning: {lifetime: maxSignedURLLifetime},
+	secretWebhook:    {lifetime: webhookKeyLifetime},
+}
+
+// errUnknownSecret is returned when a key which doesn't exist is revoked.
+var errUnknownSecret = newAPIError(codeNotFound, "there is no key with that ID")
+
+// A signingSecret is one of the keys in a keyring.
+type signingSecret struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+
+	// Retires is when the key is removed, having been replaced. It is nil
+	// for the current key.
+	Retires *time.Time `json:"retires,omitempty"`
+}
+
+// newSigningSecret generates a new key, which was created at the given time.
+func newSigningSecret(id string, created time.Time) (signingSecret, error) {
+	if id == "" {
+		var err error
+		if id, err = randomHex(4); err != nil {
+			return signingSecret{}, err
+		}
+	}
+
+	key, err := randomHex(32)
+	if err != nil {
+		return signingSecret{}, err
+	}
+
+	return signingSecret{ID: id, Key: key, Created: created}, nil
+}
+
+// createInitialSecret makes the first key in a purpose's keyring, which is
+// the key from before there were keyrings if there was one, so that nothing
+// stops working when the server is upgraded. It always has the same ID, so
+// that if two requests do this at the same time, they both end up using the
+// same key.
+func (s *Server) createInitialSecret(purpose string) error {
+	secret, err := newSigningSecret(initialSecretID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return s.Store.AddInitialSecret(purpose, secret)
+}
+
+// secrets returns the keys in a purpose's keyring, newest first, removing any
+// which have retired. If there isn't a current key, such as the first time
+// the keyring is used or when the current key has just been revoked, a new
+// one is made.
+func (s *Server) secrets(purpose string) ([]signingSecret, error) {
+	if _, ok := secretPurposes[purpose]; !ok {
+		return nil, fmt.Errorf("unknown secret purpose: %s", purpose)
+	}
+
+	stored, err := s.Store.Secrets(purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now     = time.Now()
+		secrets = make([]signingSecret, 0, len(stored))
+		retired []string
+		current = false
+	)
+
+	for _, secret := range stored {
+		if secret.Retires != nil && !now.Before(*secret.Retires) {
+			retired = append(retired, secret.ID)
+			continue
+		}
+
+		current = current || secret.Retires == nil
+		secrets = append(secrets, secret)
+	}
+
+	if len(retired) > 0 {
+		if _, err := s.Store.DeleteSecrets(purpose, retired...); err != nil {
+			return nil, err
+		}
+	}
+
+	if !current {
+		if len(stored) == 0 {
+			err = s.createInitialSecret(purpose)
+		} else {
+			var secret signingSecret
+			if secret, err = newSigningSecret("", now); err == nil {
+				err = s.Store.PutSecrets(purpose, secret)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return s.secrets(purpose)
+	}
+
+	// The current key is the newest which isn't retiring. If two were made
+	// at the same time, the newest one is used, and the others are still
+	// accepted.
+	sort.Slice(secrets, func(i, j int) bool {
+		if (secrets[i].Retires == nil) != (secrets[j].Retires == nil) {
+			return secrets[i].Retires == nil
+		}
+
+		return secrets[i].Created.After(secrets[j].Created)
+	})
+
+	return secrets, nil
+}
+
+// currentSecret returns the key which new things are signed with for a
+// purpose.
+func (s *Server) currentSecret(purpose string) (string, error) {
+	secrets, err := s.secrets(purpose)
+	if err != nil {
+		return "", err
+	}
+
+	return secrets[0].Key, nil
+}
+
+// checkSignature reports whether a signature was made with any of the keys in
+// a purpose's keyring. sign computes what the signature would be with a key.
+func (s *Server) checkSignature(purpose, signature string, sign func(key string) string) (bool, error) {
+	secrets, err := s.secrets(purpose)
+	if err != nil {
+		return false, err
+	}
+
+	// hmac.Equal is used rather than == so that the time taken to compare
+	// the signatures doesn't give away how much of a forgery was correct.
+	for _, secret := range secrets {
+		if hmac.Equal([]byte(signature), []byte(sign(secret.Key))) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// rotateSecret makes a new current key for a purpose. The old keys retire
+// once everything signed with them would have expired, unless revoke is true,
+// in which case they are removed straight away, so that nothing signed with
+// them works any more. The new key is returned.
+func (s *Server) rotateSecret(purpose string, revoke bool) (signingSecret, error) {
+	secrets, err := s.secrets(purpose)
+	if err != nil {
+		return signingSecret{}, err
+	}
+
+	now := time.Now()
+
+	secret, err := newSigningSecret("", now)
+	if err != nil {
+		return signingSecret{}, err
+	}
+
+	if revoke {
+		// The keyring is replaced all at once, so that nothing can find it
+		// empty and make a key of its own in between.
+		return secret, s.Store.ReplaceSecrets(purpose, secret)
+	}
+
+	retires := now.Add(secretPurposes[purpose].lifetime)
+	changed := []signingSecret{secret}
+
+	for _, old := range secrets {
+		if old.Retires == nil {
+			old.Retires = &retires
+			changed = append(changed, old)
+		}
+	}
+
+	return secret, s.Store.PutSecrets(purpose, changed...)
+}
+
+// revokeSecret removes a key from a purpose's keyring, so that nothing signed
+// with it works any more. If it was the current key, a new one is made the
+// next time one is needed. errUnknownSecret is returned if there is no key
+// with that ID.
+func (s *Server) revokeSecret(purpose, id string) error {
+	removed, err := s.Store.DeleteSecrets(purpose, id)
+	if err != nil {
+		return err
+	} else if removed == 0 {
+		return errUnknownSecret
+	}
+
+	return nil
+}
+
+// A SecretsConfig says how often the keys are rotated by themselves.
+type SecretsConfig struct {
+	// RotationDays is how many days each purpose's current key is used for
+	// before a new one is made. If it is 0, the keys are only rotated by
+	// hand.
+	RotationDays int
+}
+
+// rotationPeriod returns how long each current key is used for, or 0 if the
+// keys aren't rotated by themselves.
+func (c SecretsConfig) rotationPeriod() time.Duration {
+	return time.Duration(c.RotationDays) * 24 * time.Hour
+}
+
+// rotateDueSecrets rotates the keys of each purpose whose current key is
+// older than the rotation period, and returns when the next one will be due.
+func (s *Server) rotateDueSecrets(now time.Time) (time.Time, error) {
+	period := s.Secrets.rotationPeriod()
+	next := now.Add(period)
+
+	for purpose := range secretPurposes {
+		secrets, err := s.secrets(purpose)
+		if err != nil {
+			return now.Add(secretRotationRetry), err
+		}
+
+		due := secrets[0].Created.Add(period)
+
+		if !due.After(now) {
+			if _, err := s.rotateSecret(purpose, false); err != nil {
+				return now.Add(secretRotationRetry), err
+			}
+
+			s.logMessage("info", "Rotated the %s key.", purpose)
+			continue
+		}
+
+		if due.Before(next) {
+			next = due
+		}
+	}
+
+	return next, nil
+}
+
+// startSecretRotation rotates each purpose's key whenever it gets older than
+// the rotation period, until the server shuts down.
+func (s *Server) startSecretRotation() {
+	if s.Secrets.rotationPeriod() <= 0 {
+		return
+	}
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+
+		stopping := s.background().Done()
+
+		for {
+			next, err := s.rotateDueSecrets(time.Now())
+			if err != nil {
+				s.logMessage("error", "warning: failed to rotate the keys: %s", err)
+			}
+
+			timer := time.NewTimer(time.Until(next))
+
+			select {
+			case <-stopping:
+				timer.Stop()
+				return
+
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// A secretInfo describes one of the keys in a keyring, without the key itself.
+type secretInfo struct {
+	ID      string     `json:"id"`
+	Created time.Time  `json:"created"`
+	Retires *time.Time `json:"retires,omitempty"`
+	Current bool       `json:"current"`
+}
+
+// handleSecretsAPI is called to respond to a HTTP request to
+// /api/v1/secrets. It responds with the keys in each purpose's keyring,
+// without the keys themselves, encoded in JSON.
+func (s *Server) handleSecretsAPI(w http.ResponseWriter, r *http.Request) {
+	keyrings := make(map[string][]secretInfo, len(secretPurposes))
+
+	for purpose := range secretPurposes {
+		secrets, err := s.secrets(purpose)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		infos := make([]secretInfo, len(secrets))
+		for i, secret := range secrets {
+			infos[i] = secretInfo{
+				ID:      secret.ID,
+				Created: secret.Created,
+				Retires: secret.Retires,
+				Current: i == 0,
+			}
+		}
+
+		keyrings[purpose] = infos
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keyrings)
+}
+
+// handleRotateSecretAPI is called to respond to a HTTP request to
+// /api/v1/secrets/{purpose}/rotate. It makes a new current key for the
+// purpose, and responds with its ID, encoded in JSON. If the 'revoke' form
+// value is "true", the old keys are removed straight away, so every session
+// or signed URL made with them stops working, rather than retiring once
+// they would have expired.
+func (s *Server) handleRotateSecretAPI(w http.ResponseWriter, r *http.Request) {
+	purpose := mux.Vars(r)["purpose"]
+	if _, ok := secretPurposes[purpose]; !ok {
+		writeError(w, http.StatusNotFound, errors.New("there is no key with that purpose"))
+		return
+	}
+
+	secret, err := s.rotateSecret(purpose, r.PostFormValue("revoke") == "true")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": secret.ID})
+}
+
+// handleRevokeSecretAPI is called to respond to a HTTP request to
+// /api/v1/secrets/{purpose}/{id}. It removes the key with that ID, so that
+// the sessions or signed URLs made with it stop working, and leaves the
+// others alone.
+func (s *Server) handleRevokeSecretAPI(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if _, ok := secretPurposes[vars["purpose"]]; !ok {
+		writeError(w, http.StatusNotFound, errors.New("there is no key with that purpose"))
+		return
+	}
+
+	if err := s.revokeSecret(vars["purpose"], vars["id"]); err == errUnknownSecret {
+		writeError(w, http.StatusNotFound, err)
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
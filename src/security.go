@@ -0,0 +1,47 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// contentSecurityPolicy only lets the pages load scripts, styles, images and
+// everything else from the server itself, so that if someone manages to get
+// some HTML into a tab which is shown as it is, it can't run any scripts.
+// That's also why the pages add their event handlers from their scripts
+// rather than in their HTML. Images can also be data URLs, which the chord
+// diagrams are drawn as, and styles can be set inline, which some of the
+// scripts do. The pages can't be put in frames on other sites at all.
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self'; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data:; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'"
+
+// hstsMaxAge is how many seconds browsers remember to only use HTTPS for the
+// server, once they have been told to.
+const hstsMaxAge = 365 * 24 * 60 * 60
+
+// securityHeaders is middleware which adds the headers which tell browsers
+// to be more careful with the responses: not to guess their content types,
+// not to show them in frames on other sites, not to send the full URL to
+// other sites when following a link, and to follow the content security
+// policy. When the server uses HTTPS, browsers are also told to keep using it.
+func (s *Server) securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		header.Set("Content-Security-Policy", contentSecurityPolicy)
+
+		if s.HTTPS {
+			header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", hstsMaxAge))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,12 +1,19 @@
 package src
 
 import (
+	"context"
 	"crypto/sha512"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/mux"
 )
 
@@ -28,43 +35,482 @@ type Server struct {
 	// Key is the filename of the HTTPS key.
 	Key string
 
+	// RedirectPort is the port to listen for plain HTTP requests on when
+	// using HTTPS, which are redirected to HTTPS. If it is 0, plain HTTP
+	// requests aren't listened for at all.
+	RedirectPort int
+
+	// StaticDirectory is the directory which the pages, scripts and other
+	// static files are served from. If it is empty, "www" is used.
+	StaticDirectory string
+
+	// RecordingDirectory is the directory which rehearsal recordings are
+	// kept in. If it is empty, "recordings" is used.
+	RecordingDirectory string
+
 	// Settings stores the settings of this server.
 	Settings *Settings
 
-	// Database allows access to the database from server methods.
-	Database *redis.Client
+	// Store holds everything the server keeps other than the tab files
+	// themselves, such as the cached tabs, the settings and the sessions.
+	// It must be set before the server starts listening.
+	Store Store
+
+	// Timeouts says how long store operations and requests to particular
+	// routes can take, and when the store's circuit breaker opens.
+	Timeouts TimeoutConfig
+
+	// cacheLock is held while tabs are being added to, updated in or
+	// removed from the cache, so that a file can't be cached twice by
+	// two things noticing it at the same time.
+	cacheLock sync.Mutex
+
+	// tabCache holds copies of the tabs from the last call to getTabs, so
+	// they can be returned again without going to the database until
+	// tabCacheExpiry. refreshingTabs is true while they are being fetched
+	// again in the background. tabCacheLock is held while any of them are
+	// being used.
+	tabCache       []*Tab
+	tabCacheExpiry time.Time
+	refreshingTabs bool
+	tabCacheLock   sync.Mutex
+
+	// watcher watches the tab directory for changes. watchedDirectory is
+	// the directory it is currently watching, watchedDepth is how many
+	// levels of folders inside it are watched, and watchedFolders is the
+	// set of all of the folders being watched. watchLock is held while
+	// any of them are being used.
+	watcher          *fsnotify.Watcher
+	watchedDirectory string
+	watchedDepth     int
+	watchedFolders   map[string]bool
+	watchLock        sync.Mutex
+
+	// runningJobs maps the IDs of the background jobs which are currently
+	// running to the functions which cancel their contexts.
+	runningJobs     map[string]context.CancelFunc
+	runningJobsLock sync.Mutex
+
+	// setlistLock is held while a setlist is being changed, so that two
+	// changes to the same setlist can't overwrite each other.
+	setlistLock sync.Mutex
+
+	// editLocksLock is held while a tab's edit lock is being taken or
+	// released, so that two people can't both take it.
+	editLocksLock sync.Mutex
+
+	// songRequestLock is held while the wishlist of requested songs is
+	// being changed, so that a song asked for twice at once is only added
+	// once.
+	songRequestLock sync.Mutex
+
+	// recordingLock is held while a recording is being changed, so that two
+	// changes to it can't overwrite each other.
+	recordingLock sync.Mutex
+
+	// importLock is held while a pending import is being committed or
+	// discarded, so that committing it twice at once can't import it twice.
+	importLock sync.Mutex
+
+	// collabRooms holds the rooms of the tabs which are being edited
+	// together, by tab ID. collabLock is held while any of them are being
+	// used.
+	collabRooms map[string]*collabRoom
+	collabLock  sync.Mutex
+
+	// pollsEnded is closed when the server starts shutting down, so that
+	// the requests waiting for events return straight away. pollLock is
+	// held while it is being made or closed.
+	pollsEnded chan struct{}
+	pollLock   sync.Mutex
+
+	// stopContext is cancelled by stopWorkers when the server starts
+	// shutting down, which tells the background workers to stop. workers
+	// counts the ones which are still running.
+	stopContext context.Context
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
+
+	// nowShowingFollowers holds a channel for each client which is
+	// following the tab on show over a WebSocket, which is sent each change.
+	// nowShowingLock is held while they are being sent to or changed.
+	nowShowingFollowers map[chan map[string]string]bool
+	nowShowingLock      sync.Mutex
+
+	// MQTT says which MQTT broker to publish events and the tab which is
+	// on show to, if any.
+	MQTT MQTTConfig
+
+	// mqtt sends the messages to the MQTT broker. It is nil if there isn't
+	// one.
+	mqtt *mqttPublisher
+
+	// Hooks says which commands to run at certain points, and hookQueue
+	// holds the post- hooks which are waiting to run in the background.
+	Hooks     HookConfig
+	hookQueue chan hookRun
+
+	// manifestChanged is sent to whenever the collection changes, so that
+	// the manifest is written again.
+	manifestChanged chan struct{}
+
+	// CORS says which other origins can use the API from a browser.
+	CORS CORSConfig
+
+	// Logging says how the requests to the server are logged, which is
+	// done by logger. logTail keeps the most recent entries for the admin.
+	Logging LogConfig
+	logger  *requestLogger
+	logTail *logTail
+
+	// Integrity says when the integrity snapshots, which catch tabs being
+	// lost without anyone noticing, are taken.
+	Integrity IntegrityConfig
+
+	// Secrets says how often the keys which sign sessions and URLs are
+	// rotated.
+	Secrets SecretsConfig
+
+	// DiskConcurrency is how many disk-heavy requests can run at once,
+	// which diskThrottle makes sure of. If it is 0,
+	// defaultDiskConcurrency is used.
+	DiskConcurrency int
+	diskThrottle    *throttle
 }
 
-// Listen starts the HTTP server running on the given address and port.
-func (s *Server) Listen() {
-	if err := s.resetCache(); err != nil {
-		fmt.Println("warning: failed to reset cache while starting up:", err)
+// errNoStore is returned when a server is started without a store.
+var errNoStore = errors.New("the server has no store to keep its data in")
+
+// Listen starts the HTTP server running on the given address and port. It
+// keeps running until the process is asked to stop, at which point it shuts
+// down gracefully, or until the server fails, in which case the error is
+// returned.
+func (s *Server) Listen() error {
+	if s.Store == nil {
+		return errNoStore
+	}
+
+	// Check the certificate and key, and the logging and integrity config,
+	// before anything else is started, so that the server doesn't get half
+	// way through starting up before finding out that it can't.
+	var tlsConfig *tls.Config
+
+	if s.HTTPS {
+		var err error
+		if tlsConfig, err = s.tlsConfig(); err != nil {
+			return err
+		}
 	}
 
-	// Create a new router, which will be used to listen to HTTP requests and
-	// decide what to do to respond back.
+	if _, _, _, err := s.Integrity.integrityTime(); err != nil {
+		return err
+	}
+
+	if err := s.prepare(); err != nil {
+		return err
+	}
+
+	// If the store has lost the tabs, put them back from the manifest so
+	// that they keep their IDs, and then keep the manifest up to date.
+	s.cacheLock.Lock()
+	restored, err := s.restoreFromManifest()
+	s.cacheLock.Unlock()
+
+	if err != nil {
+		fmt.Println("warning: failed to restore the tabs from the manifest:", err)
+	} else if restored > 0 {
+		fmt.Printf("Restored %d tabs from the manifest.\n", restored)
+	}
+
+	s.startManifestWriter()
+
+	s.ensureIndexes()
+
+	// Start watching the tab directory, so that changes to the files are
+	// picked up without the cache having to be reset. The server still works
+	// without it, so a failure is only a warning.
+	if err := s.startWatcher(); err != nil {
+		fmt.Println("warning: failed to start watching the tab directory:", err)
+	}
+
+	// Start the workers which run background jobs, such as rescans, and
+	// queue the integrity snapshot every night.
+	s.startJobWorkers()
+	s.startIntegrityChecks()
+
+	// Start rotating the signing keys, if they are rotated on a schedule.
+	s.startSecretRotation()
+
+	// Start purging the tabs which have been in the trash for long enough.
+	s.startTrashPurger()
+
+	// Start publishing to the MQTT broker, if there is one.
+	s.startMQTT()
+
+	// Start running the hooks in the background.
+	s.startHooks()
+
+	// Starts the HTTP server listening, using HTTPS if it has been turned
+	// on.
+	server := &http.Server{
+		Addr:      fmt.Sprintf("%s:%d", s.Address, s.Port),
+		Handler:   s.handler(),
+		TLSConfig: tlsConfig,
+	}
+
+	// Clients following the log or waiting for events would otherwise keep
+	// the server waiting for their requests to finish when it is asked to
+	// stop.
+	server.RegisterOnShutdown(s.logTail.close)
+	server.RegisterOnShutdown(s.endCollabStreams)
+	server.RegisterOnShutdown(s.endNowShowingStreams)
+	server.RegisterOnShutdown(s.endPolls)
+
+	redirect := s.redirectServer()
+
+	if s.HTTPS {
+		fmt.Printf("Server is running at %s using HTTPS...\n", server.Addr)
+	} else {
+		fmt.Printf("Server is running at %s...\n", server.Addr)
+	}
+
+	if redirect != nil {
+		fmt.Printf("Redirecting HTTP requests at %s to HTTPS...\n", redirect.Addr)
+	}
+
+	if err := s.serve(server, redirect); err != nil {
+		return err
+	}
+
+	fmt.Println("The server has stopped.")
+	return nil
+}
+
+// Handler returns the handler which Listen serves requests with, having set
+// up what it needs, such as the search index, so that the server's requests
+// can be served some other way, such as in tests. None of the work which
+// Listen does in the background, such as watching the tab directory or
+// running jobs, is started.
+func (s *Server) Handler() (http.Handler, error) {
+	if s.Store == nil {
+		return nil, errNoStore
+	}
+
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+
+	s.ensureIndexes()
+
+	return s.handler(), nil
+}
+
+// prepare sets up the request logger, the log tail and the context which
+// stops the background work, for Listen and Handler.
+func (s *Server) prepare() error {
+	logger, err := newRequestLogger(s.Logging)
+	if err != nil {
+		return err
+	}
+
+	s.logger = logger
+	s.logTail = newLogTail(logTailSize)
+
+	s.stopContext, s.stopWorkers = context.WithCancel(context.Background())
+
+	return nil
+}
+
+// ensureIndexes builds the search and browse indexes if they are out of
+// date. The cache and the indexes are kept in the database between runs, and
+// any files which changed while the server was stopped are noticed when the
+// tabs are next listed, so nothing else has to be rebuilt.
+func (s *Server) ensureIndexes() {
+	if err := s.ensureSearchIndex(); err != nil {
+		fmt.Println("warning: failed to build the search index:", err)
+	}
+
+	if err := s.ensureBrowseIndex(); err != nil {
+		fmt.Println("warning: failed to build the browse index:", err)
+	}
+}
+
+// handler returns the router, wrapped in the middleware which every request
+// goes through. Every request is logged, even the ones which the router
+// doesn't have a route for, every response has the security headers, the
+// requests from other origins are checked against the CORS config before
+// they get to the router, and responses are compressed for the clients which
+// can decompress them.
+func (s *Server) handler() http.Handler {
+	return s.logRequests(s.securityHeaders(s.handleCORS(compressResponses(s.newRouter()))))
+}
+
+// newRouter creates the router which decides how to respond to each HTTP
+// request, according to its path and method.
+func (s *Server) newRouter() *mux.Router {
+	s.diskThrottle = s.newDiskThrottle()
+
 	r := mux.NewRouter()
+	r.Use(s.enforceAccessMode, s.limitRouteTimes)
+
+	r.HandleFunc("/", s.handleIndex).Methods(readMethods...)
+	r.HandleFunc("/settings", s.handleSettings).Methods(readMethods...)
+	r.HandleFunc("/display/{id}", s.handleDisplay).Methods(readMethods...)
+	r.HandleFunc("/edit/{id}", s.handleEdit).Methods(readMethods...)
+	r.HandleFunc("/request", s.handleRequest).Methods(readMethods...)
+	r.HandleFunc("/recordings", s.handleRecordings).Methods(readMethods...)
+	r.HandleFunc("/readyz", s.handleReadyz).Methods(readMethods...)
+
+	// The API is versioned, so that clients can rely on the paths and the
+	// responses staying the same. Each version's routes are added by a
+	// function of their own, and are served under /api/vN. A change which
+	// older clients wouldn't understand goes in a new version, leaving the
+	// old one as it was. The first version is also served straight under
+	// /api, where it was before the API was versioned, but those paths are
+	// deprecated and will go away in a later version. Their JSON keeps the
+	// field names it had then, and which fields are selected with the
+	// 'fields' query value goes by those names too.
+	v1 := r.PathPrefix("/api/v1").Subrouter()
+	v1.Use(selectFields)
+	s.addAPIv1Routes(v1)
 
-	r.HandleFunc("/", s.handleIndex)
-	r.HandleFunc("/settings", s.handleSettings)
+	legacy := r.PathPrefix("/api").Subrouter()
+	legacy.Use(deprecatedAPI("/api/v1"), selectFields, legacyShapes)
+	s.addAPIv1Routes(legacy)
 
-	r.HandleFunc("/api/tabs", s.handleTabsAPI)
-	r.HandleFunc("/api/reset-cache", s.handleResetCacheAPI)
-	r.HandleFunc("/api/change-password", s.handleChangePassword)
-	r.HandleFunc("/api/delete-tab", s.handleDeleteTab)
-	r.HandleFunc("/api/settings", s.handleSettingsAPI)
-	r.HandleFunc("/api/change-settings", s.handleChangeSettingsAPI)
+	// Requests which don't match any route get a JSON error if they are for
+	// the API, and the ones which match a route's path but not its methods
+	// are told which methods it has.
+	r.NotFoundHandler = s.unmatchedRequests(r)
+	r.MethodNotAllowedHandler = s.unmatchedRequests(r)
+
+	// Handle the files which let the web app be installed and work offline.
+	r.HandleFunc("/manifest.webmanifest", s.handleWebManifest).Methods(readMethods...)
+	r.HandleFunc("/sw.js", s.handleServiceWorker).Methods(readMethods...)
 
 	// Handle static files
 	r.PathPrefix("/static/").Handler(
 		http.StripPrefix("/static/",
-			http.FileServer(http.Dir("./www/")),
+			http.FileServer(http.Dir(s.staticDirectory())),
 		),
-	)
+	).Methods(readMethods...)
+
+	return r
+}
 
-	// Starts the HTTP server listening using the router defined previously.
-	fmt.Printf("Server is running at %s:%d...\n", s.Address, s.Port)
-	http.ListenAndServe(fmt.Sprintf("%s:%d", s.Address, s.Port), r)
+// addAPIv1Routes adds the routes of version 1 of the API to the router, which
+// is mounted under the version's path. The endpoints which change things are
+// wrapped so that only the roles with the right permission can use them, and
+// only accept the methods which change things, so that following a link or
+// loading an image can't.
+func (s *Server) addAPIv1Routes(api *mux.Router) {
+	api.HandleFunc("/tabs", s.handleTabsAPI).Methods(readMethods...)
+	api.HandleFunc("/tabs/by-tag/{tag}", s.handleTabsByTagAPI).Methods(readMethods...)
+	api.HandleFunc("/tabs/by-artist/{artist}", s.handleTabsByArtistAPI).Methods(readMethods...)
+	api.HandleFunc("/tab/{id}", s.handleTabAPI).Methods(readMethods...)
+	api.HandleFunc("/tab/{id}/delta", s.handleTabDeltaAPI).Methods(readMethods...)
+	api.HandleFunc("/tab/{id}/transpose", s.handleTransposeAPI).Methods(readMethods...)
+	api.HandleFunc("/tab/{id}/file", s.throttleDisk(s.handleTabFileAPI)).Methods(readMethods...)
+	api.HandleFunc("/tab/{id}/download", s.throttleDisk(s.handleTabFileAPI)).Methods(readMethods...)
+	api.HandleFunc("/tab/{id}/musicxml", s.throttleDisk(s.handleMusicXMLAPI)).Methods(readMethods...)
+	api.HandleFunc("/tab/{id}/lock", s.handleEditLockAPI).Methods(readMethods...)
+	api.HandleFunc("/tab/{id}/lock", s.requirePermission(permissionEdit, s.handleEditLockAPI)).Methods("POST", "DELETE")
+	api.HandleFunc("/tab/{id}/collab", s.requirePermission(permissionEdit, s.handleCollabAPI)).Methods(readMethods...)
+	api.HandleFunc("/search", s.handleSearchAPI).Methods(readMethods...)
+	api.HandleFunc("/tags", s.handleTagsAPI).Methods(readMethods...)
+	api.HandleFunc("/artists", s.handleArtistsAPI).Methods(readMethods...)
+	api.HandleFunc("/tui", s.handleTUIHelpAPI).Methods(readMethods...)
+	api.HandleFunc("/tui/tabs", s.handleTUITabsAPI).Methods(readMethods...)
+	api.HandleFunc("/tui/tab/{id}", s.handleTUITabAPI).Methods(readMethods...)
+	api.HandleFunc("/login", s.rateLimit(s.handleLogin)).Methods("POST")
+	api.HandleFunc("/logout", s.handleLogout).Methods("POST")
+	api.HandleFunc("/csrf-token", s.handleCSRFTokenAPI).Methods(readMethods...)
+	api.HandleFunc("/tokens", s.requirePermission(permissionAdmin, s.handleTokensAPI)).Methods("GET", "POST", "DELETE")
+	api.HandleFunc("/reset-cache", s.rateLimit(s.requirePermission(permissionJobs, s.handleResetCacheAPI))).Methods("POST")
+	api.HandleFunc("/prune-orphans", s.requirePermission(permissionDelete, s.throttleDisk(s.handlePruneOrphansAPI))).Methods("POST")
+	api.HandleFunc("/change-password", s.rateLimit(s.requirePermission(permissionAdmin, s.handleChangePassword))).Methods("POST")
+	api.HandleFunc("/delete-tab", s.requirePermission(permissionDelete, s.handleDeleteTab)).Methods("POST")
+	api.HandleFunc("/trash", s.requirePermission(permissionDelete, s.handleTrashAPI)).Methods("GET", "HEAD", "DELETE")
+	api.HandleFunc("/restore-tab", s.requirePermission(permissionDelete, s.handleRestoreTabAPI)).Methods("POST")
+	api.HandleFunc("/set-explicit", s.requirePermission(permissionEdit, s.handleSetExplicitAPI)).Methods("POST")
+	api.HandleFunc("/set-source", s.requirePermission(permissionEdit, s.handleSetSourceAPI)).Methods("POST")
+	api.HandleFunc("/set-license", s.requirePermission(permissionEdit, s.handleSetLicenseAPI)).Methods("POST")
+	api.HandleFunc("/update-tab", s.requirePermission(permissionEdit, s.handleUpdateTabAPI)).Methods("POST")
+	api.HandleFunc("/rename-tag", s.requirePermission(permissionEdit, s.handleRenameTagAPI)).Methods("POST")
+	api.HandleFunc("/merge-tags", s.requirePermission(permissionEdit, s.handleMergeTagsAPI)).Methods("POST")
+	api.HandleFunc("/delete-tag", s.requirePermission(permissionEdit, s.handleDeleteTagAPI)).Methods("POST")
+	api.HandleFunc("/favourite", s.handleFavouriteAPI).Methods("POST")
+	api.HandleFunc("/unfavourite", s.handleUnfavouriteAPI).Methods("POST")
+	api.HandleFunc("/favourites", s.handleFavouritesAPI).Methods(readMethods...)
+	api.HandleFunc("/merge-tabs", s.requirePermission(permissionEdit, s.handleMergeTabsAPI)).Methods("POST")
+	api.HandleFunc("/download/{id}", s.throttleDisk(s.handleDownloadAPI)).Methods(readMethods...)
+	api.HandleFunc("/sign-url", s.requirePermission(permissionShare, s.handleSignURLAPI)).Methods("POST")
+	api.HandleFunc("/rotate-signing-key", s.requirePermission(permissionSettings, s.handleRotateSigningKeyAPI)).Methods("POST")
+	api.HandleFunc("/secrets", s.requirePermission(permissionAdmin, s.handleSecretsAPI)).Methods(readMethods...)
+	api.HandleFunc("/secrets/{purpose}/rotate", s.requirePermission(permissionAdmin, s.handleRotateSecretAPI)).Methods("POST")
+	api.HandleFunc("/secrets/{purpose}/{id}", s.requirePermission(permissionAdmin, s.handleRevokeSecretAPI)).Methods("DELETE")
+	api.HandleFunc("/webhooks/keys", s.handleWebhookKeysAPI).Methods(readMethods...)
+	api.HandleFunc("/settings", s.handleSettingsAPI).Methods(readMethods...)
+	api.HandleFunc("/change-settings", s.requirePermission(permissionSettings, s.handleChangeSettingsAPI)).Methods("POST")
+	api.HandleFunc("/pattern/infer", s.requirePermission(permissionSettings, s.throttleDisk(s.handleInferPatternAPI))).Methods("POST")
+	api.HandleFunc("/util/parse-filename", s.requirePermission(permissionSettings, s.handleParseFilenameAPI)).Methods("POST")
+	api.HandleFunc("/util/transform", s.requirePermission(permissionSettings, s.handleTransformAPI)).Methods("POST")
+	api.HandleFunc("/permissions", s.requirePermission(permissionAdmin, s.handlePermissionsAPI)).Methods("GET", "POST", "DELETE")
+	api.HandleFunc("/views", s.requirePermission(permissionSettings, s.handleViewsAPI)).Methods("GET", "POST", "DELETE")
+	api.HandleFunc("/views/{name}", s.handleViewAPI).Methods(readMethods...)
+	api.HandleFunc("/setlists", s.handleSetlistsAPI).Methods(readMethods...)
+	api.HandleFunc("/setlists", s.requirePermission(permissionSetlists, s.handleSetlistsAPI)).Methods("POST")
+	api.HandleFunc("/setlists/{id}", s.handleSetlistAPI).Methods(readMethods...)
+	api.HandleFunc("/setlists/{id}", s.requirePermission(permissionSetlists, s.handleSetlistAPI)).Methods("POST", "DELETE")
+	api.HandleFunc("/song-requests", s.rateLimit(s.handleSongRequestsAPI)).Methods("POST")
+	api.HandleFunc("/song-requests", s.requirePermission(permissionRequests, s.handleSongRequestsAPI)).Methods("GET", "HEAD", "DELETE")
+	api.HandleFunc("/song-requests/{id}", s.requirePermission(permissionRequests, s.handleSongRequestAPI)).Methods("GET", "HEAD", "POST", "DELETE")
+	api.HandleFunc("/song-requests/{id}/vote", s.requirePermission(permissionRequests, s.handleSongRequestVoteAPI)).Methods("POST", "DELETE")
+	api.HandleFunc("/recordings", s.requirePermission(permissionRecordings, s.handleRecordingsAPI)).Methods("GET", "HEAD")
+	api.HandleFunc("/recordings", s.requirePermission(permissionRecordings, s.throttleDisk(s.handleRecordingsAPI))).Methods("POST")
+	api.HandleFunc("/recordings/{id}", s.requirePermission(permissionRecordings, s.handleRecordingAPI)).Methods("GET", "HEAD", "POST", "DELETE")
+	api.HandleFunc("/recordings/{id}/audio", s.requirePermission(permissionRecordings, s.handleRecordingAudioAPI)).Methods("GET", "HEAD")
+	api.HandleFunc("/recordings/{id}/waveform", s.requirePermission(permissionRecordings, s.handleRecordingWaveformAPI)).Methods("GET", "HEAD")
+	api.HandleFunc("/now-showing", s.handleNowShowingAPI).Methods("GET", "POST")
+	api.HandleFunc("/events", s.handleEventsAPI).Methods(readMethods...)
+	api.HandleFunc("/jobs", s.requirePermission(permissionJobs, s.handleJobsAPI)).Methods("GET", "POST")
+	api.HandleFunc("/jobs/{id}", s.requirePermission(permissionJobs, s.handleJobAPI)).Methods("GET", "DELETE")
+	api.HandleFunc("/jobs/{id}/cancel", s.requirePermission(permissionJobs, s.handleCancelJobAPI)).Methods("POST", "DELETE")
+	api.HandleFunc("/admin/logs", s.requirePermission(permissionAdmin, s.handleLogsAPI)).Methods(readMethods...)
+	api.HandleFunc("/admin/overview", s.requirePermission(permissionAdmin, s.handleOverviewAPI)).Methods(readMethods...)
+	api.HandleFunc("/integrity", s.requirePermission(permissionJobs, s.handleIntegrityAPI)).Methods(readMethods...)
+	api.HandleFunc("/integrity/metrics", s.requirePermission(permissionJobs, s.handleIntegrityMetricsAPI)).Methods(readMethods...)
+	api.HandleFunc("/export", s.requirePermission(permissionAdmin, s.throttleDisk(s.handleExportAPI))).Methods(readMethods...)
+	api.HandleFunc("/import", s.requirePermission(permissionAdmin, s.throttleDisk(s.handleImportAPI))).Methods("POST")
+	api.HandleFunc("/import/preview", s.requirePermission(permissionEdit, s.throttleDisk(s.handleImportPreviewAPI))).Methods("POST")
+	api.HandleFunc("/import/zip", s.requirePermission(permissionEdit, s.throttleDisk(s.handleZipImportAPI))).Methods("POST")
+	api.HandleFunc("/import/{id:[0-9a-f]+}/commit", s.requirePermission(permissionEdit, s.throttleDisk(s.handleCommitImportAPI))).Methods("POST")
+	api.HandleFunc("/import/{id:[0-9a-f]+}", s.requirePermission(permissionEdit, s.handleDiscardImportAPI)).Methods("DELETE")
+	api.HandleFunc("/validate-collection", s.requirePermission(permissionEdit, s.handleValidateCollectionAPI)).Methods(readMethods...)
+	api.HandleFunc("/throttle", s.requirePermission(permissionJobs, s.handleThrottleAPI)).Methods(readMethods...)
+	api.HandleFunc("/stats/timeline", s.handleTimelineAPI).Methods(readMethods...)
+	api.HandleFunc("/scale/{key}/{type}.svg", s.handleScaleDiagram).Methods(readMethods...)
+	api.HandleFunc("/precache", s.handlePrecacheAPI).Methods(readMethods...)
+	api.HandleFunc("/errors", s.handleErrorsAPI).Methods(readMethods...)
+}
+
+// readMethods are the methods accepted by the routes which only read things.
+var readMethods = []string{"GET", "HEAD"}
+
+// deprecatedAPI is middleware for the router which marks the responses to
+// the API's unversioned paths as deprecated, pointing to the same path under
+// the given versioned prefix, which clients should use instead.
+func deprecatedAPI(successor string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := successor + strings.TrimPrefix(r.URL.Path, "/api")
+
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", path))
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
 // handleIndex is called to respond to a HTTP request to /.
@@ -73,10 +519,10 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "max-age=0")
 
 	// Shorthand for:
-	//  - opening www/html/index.html
+	//  - opening html/index.html in the static directory
 	//  - reading its contents
 	//  - serving that text, along with relavent metadata
-	http.ServeFile(w, r, "www/html/index.html")
+	http.ServeFile(w, r, s.staticPath("html/index.html"))
 }
 
 // handleSettings is called to respond to a HTTP request to /settings.
@@ -85,13 +531,15 @@ func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "max-age=0")
 
 	// Shorthand for:
-	//  - opening www/html/settings.html
+	//  - opening html/settings.html in the static directory
 	//  - reading its contents
 	//  - serving that text, along with relavent metadata
-	http.ServeFile(w, r, "www/html/settings.html")
+	http.ServeFile(w, r, s.staticPath("html/settings.html"))
 }
 
-// handleTabsAPI is called to respond to a HTTP request to /api/tabs.
+// handleTabsAPI is called to respond to a HTTP request to /api/v1/tabs. A
+// client which already has the current list, according to its ETag or its
+// Last-Modified time, is sent 304 Not Modified instead.
 func (s *Server) handleTabsAPI(w http.ResponseWriter, r *http.Request) {
 	// Disable caching for this request - caching will be managed
 	// manually by this program.
@@ -101,42 +549,319 @@ func (s *Server) handleTabsAPI(w http.ResponseWriter, r *http.Request) {
 	// don't attempt to display it as HTML.
 	w.Header().Set("Content-Type", "application/json")
 
-	// Get a list of tabs.
+	// Get a list of tabs. If the database can't be reached, or in the
+	// stale serving mode, the ones kept in memory might be used instead,
+	// and the client is told that they might be out of date.
 	// If there is an error, it will be returned as a HTTP error
 	// with the status code 500, or Internal Server Error.
-	tabs, err := s.getTabs()
+	tabs, stale, err := s.getTabsOrStale(r.Context())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
+	} else if stale {
+		markStale(w)
+	}
+
+	// Whether the explicit tabs, and in public mode the unlicensed ones,
+	// are left out depends on who is asking, as well as on the settings.
+	explicit := s.showsExplicit(r)
+	licensed := s.restrictsLicenses(r)
+
+	// The collection version and the time it last changed can't be found
+	// out without the database, so stale responses leave the version as 0,
+	// which won't match any version the client has seen, and don't have an
+	// ETag or a Last-Modified time. Their tabs aren't marked as favourites
+	// either, for the same reason.
+	var version int64
+
+	favourites := map[string]bool{}
+
+	if !stale {
+		if version, err = s.Store.CollectionVersion(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if favourites, err = s.favouriteIDs(r); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		modified, _, err := s.collectionModified()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// If the client already has this version of the list, it doesn't
+		// need to be sent again.
+		etag := favouritesETag(tabsETag(version, explicit, licensed), favourites)
+		setValidators(w, etag, modified)
+
+		if notModified(r, etag, modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// Leave out the explicit tabs if this client isn't allowed to see them,
+	// and the unlicensed ones if it can only see the licensed ones.
+	if !explicit {
+		tabs = filterExplicit(tabs)
+	}
+
+	if licensed {
+		tabs = s.filterLicensed(tabs)
 	}
 
-	// Convert the tabs into JSON so they can be transmitted over HTTP.
+	// The total is the size of the collection which this client can see,
+	// before any of the tabs are filtered out by what they asked for.
+	total := len(tabs)
+
+	// If a language was given, such as '?lang=es', only return the tabs in
+	// that language.
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		tabs = filterLanguage(tabs, lang)
+	}
+
+	// Likewise, '?source=import' only returns the tabs which were imported,
+	// '?tuning=DADGAD' only the ones in that tuning, however it was written,
+	// and '?chord=Em7' only the ones which use that chord.
+	if source := r.URL.Query().Get("source"); source != "" {
+		tabs = filterSource(tabs, source)
+	}
+
+	if tuning := r.URL.Query().Get("tuning"); tuning != "" {
+		tabs = filterTuning(tabs, tuning)
+	}
+
+	if chords := r.URL.Query()["chord"]; len(chords) > 0 {
+		tabs = filterChords(tabs, chords)
+	}
+
+	markFavourites(tabs, favourites)
+
+	// Clients which keep their own copies of the tabs' content can ask for
+	// the list without it, using the content hashes to decide which tabs
+	// they need to fetch from /api/v1/tab/{id}.
+	if r.URL.Query().Get("content") == "0" {
+		for _, tab := range tabs {
+			tab.Content = ""
+		}
+	}
+
+	// By default, the response is just the list of tabs. Clients which ask
+	// for the envelope get the list wrapped up with some information about
+	// the collection as a whole.
+	var response interface{} = tabs
+
+	if wantsEnvelope(r) {
+		response = &tabsEnvelope{
+			Total:             total,
+			Returned:          len(tabs),
+			CollectionVersion: version,
+			GeneratedAt:       time.Now(),
+			Tabs:              tabs,
+		}
+	}
+
+	// Convert the response into JSON so it can be transmitted over HTTP.
 	// If there is an error, it will be returned as a HTTP error
 	// with the status code 500, or Internal Server Error.
-	jsonData, err := json.Marshal(tabs)
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+// filterLanguage returns the tabs whose lyrics are in the language with the
+// given ISO 639-1 code.
+func filterLanguage(tabs []*Tab, lang string) []*Tab {
+	filtered := make([]*Tab, 0, len(tabs))
+
+	for _, tab := range tabs {
+		if tab.Language == lang {
+			filtered = append(filtered, tab)
+		}
+	}
+
+	return filtered
+}
+
+// handleTabAPI is called to respond to a HTTP request to /api/v1/tab/{id}. It
+// responds with the single tab with that ID, including its content, encoded
+// in JSON.
+func (s *Server) handleTabAPI(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	tab, ok, err := s.Store.GetTab(id)
+	stale := false
+
+	// If the database can't be reached, look for the tab in the ones kept
+	// in memory instead.
+	if err == errCircuitOpen {
+		if tabs, found := s.staleTabs(); found {
+			markStale(w)
+			err = nil
+			stale = true
+
+			for _, candidate := range tabs {
+				if candidate.ID == id {
+					tab, ok = candidate, true
+				}
+			}
+		}
+	}
+
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok || s.hidesTab(r, tab) {
+		writeError(w, http.StatusNotFound, errTabNotFound)
 		return
 	}
 
+	// Tabs are stored without transformations, so they have to be applied
+	// here in the same way as getTabs does.
+	tab.applyTransformations(s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
+
+	// A tab from memory is left unmarked, like the stale list of tabs.
+	if !stale {
+		favourites, err := s.favouriteIDs(r)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		tab.IsFavourite = favourites[tab.ID]
+	}
+
+	jsonData, err := json.Marshal(tab)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(jsonData)
 }
 
+// envelopeMediaType is the media type which a client can put in its Accept
+// header to ask for the tab list wrapped in a tabsEnvelope.
+const envelopeMediaType = "application/vnd.tab-server.envelope+json"
+
+// A tabsEnvelope wraps the list of tabs from /api/v1/tabs together with some
+// information about the collection, so that clients don't have to make any
+// extra requests to find it out.
+type tabsEnvelope struct {
+	// Total is the number of tabs in the collection.
+	Total int `json:"total"`
+
+	// Returned is the number of tabs in this response.
+	Returned int `json:"returned"`
+
+	// CollectionVersion changes whenever the collection does.
+	CollectionVersion int64 `json:"collectionVersion"`
+
+	// GeneratedAt is when the response was made.
+	GeneratedAt time.Time `json:"generatedAt"`
+
+	Tabs []*Tab `json:"tabs"`
+}
+
+// wantsEnvelope says whether the request asked for the tab list in an
+// envelope, either with the query value 'envelope=1' or by accepting the
+// envelope media type. Plain requests get a plain list of tabs, so older
+// clients aren't affected.
+func wantsEnvelope(r *http.Request) bool {
+	if r.URL.Query().Get("envelope") == "1" {
+		return true
+	}
+
+	return strings.Contains(r.Header.Get("Accept"), envelopeMediaType)
+}
+
 // handleResetCacheAPI is called to respond to a HTTP request to
-// /api/reset-cache.
+// /api/v1/reset-cache. It will only accept POST requests which have the admin
+// password in the 'password' form field, and responds with a summary of what
+// was removed, encoded in JSON.
 func (s *Server) handleResetCacheAPI(w http.ResponseWriter, r *http.Request) {
-	if err := s.resetCache(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Check that the request was made by a logged in admin, since
+	// resetting the cache affects everybody using the server.
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	// Every tab has to be read from its file again afterwards, so, as with
+	// changing the password, the password must be entered again to make
+	// sure that it's what the admin meant to do.
+	if status, err := s.validatePassword(r, "password"); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	summary, err := s.resetCache(s.requestActor(r))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// handlePruneOrphansAPI is called to respond to a HTTP request to
+// /api/v1/prune-orphans. It removes the cached tabs whose files no longer
+// exist, and responds with the number which were removed, encoded in JSON.
+func (s *Server) handlePruneOrphansAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	// If the tab directory can't be read, nothing is pruned, since otherwise
+	// a missing directory would cause every tab to be removed.
+	filenames, err := s.tabFilenames()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	removed, err := s.pruneOrphans(filenames, s.requestActor(r))
+	if err == errTabDirectoryUnmounted {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"removed": removed})
 }
 
 // handleChangePassword is called to respond to a HTTP request to
-// /api/change-password. It will only accept POST requests.
+// /api/v1/change-password. It will only accept POST requests.
 func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
-	// Validate the user's entered password, in the form field 'password', and
-	// if it is wrong send them a message and exit the function.
+	// Check that the request was made by a logged in admin.
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	// Even with a session, the current password must be entered again in
+	// the form field 'old', so someone using a logged in browser can't lock
+	// the admin out. If it is wrong send them a message and exit.
 	if status, err := s.validatePassword(r, "old"); err != nil {
-		http.Error(w, err.Error(), status)
+		writeError(w, status, err)
 		return
 	}
 
@@ -146,79 +871,198 @@ func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
 	// reporting any errors to the user.
 	//
 	// To do this, the new password must first be hashed. Then,
-	// the SET redis command is used to set the new password.
+	// the hash is stored in place of the old one.
 	newHash := fmt.Sprintf("%x", sha512.Sum512([]byte(r.PostFormValue("new"))))
-	if err := s.Database.Set("password-hash", newHash, 0).Err(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.Store.SetPasswordHash(newHash); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Anyone who was logged in with the old password is logged out, and the
+	// admin who changed it is given a new session, so they stay logged in.
+	if err := s.endAllSessions(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := s.createSession(w); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 }
 
 // handleDeleteTab is called to respond to a HTTP request to
-// /api/delete-tab. It will only accept POST requests because the
-// password is sent in the POST form data.
+// /api/v1/delete-tab. It will only accept POST requests from a logged in
+// admin.
 func (s *Server) handleDeleteTab(w http.ResponseWriter, r *http.Request) {
-	// Validate the user's entered password, in the form field 'password', and
-	// if it is wrong send them a message and exit the function.
+	// Check that the request was made by a logged in admin, and if it
+	// wasn't send them a message and exit the function.
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	tab, ok, err := s.Store.GetTab(r.PostFormValue("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errTabNotFound)
+		return
+	}
+
+	if status, err := s.checkEditLock(r, tab.ID); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	by := s.requestActor(r)
+
+	// The pre-delete hook, if there is one, gets the chance to stop the tab
+	// from being deleted.
+	if err := s.checkDelete(tab, by); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	// Now we know that the user is the admin, the tab can be deleted. This
+	// is done through the 'deleteTab' function inside the api.go file.
+	if err := s.deleteTab(tab.ID, by); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// handleLogin is called to respond to a HTTP request to /api/v1/login. If the
+// admin password in the 'password' form field is correct, a new session is
+// started and its cookie is sent back, which the other admin endpoints will
+// then accept instead of a password.
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	if status, err := s.validatePassword(r, "password"); err != nil {
-		http.Error(w, err.Error(), status)
+		writeError(w, status, err)
 		return
 	}
 
-	// Now we know that the user has entered the correct password, the
-	// tab can be deleted. This is done through the 'deleteTab' function
-	// inside the api.go file.
-	if err := s.deleteTab(r.PostFormValue("id")); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.createSession(w); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 }
 
-// handleSettingsAPI is called to a HTTP request to /api/settings. It will
-// respond with the current settings encoded in JSON. It will be able to
-// accept any request method type because the password is not transmitted.
+// handleLogout is called to respond to a HTTP request to /api/v1/logout. It
+// ends the current session, if there is one.
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errOnlyPOST)
+		return
+	}
+
+	if err := s.destroySession(w, r); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// handleSettingsAPI is called to a HTTP request to /api/v1/settings. It will
+// respond with the settings encoded in JSON. Only someone whose role has the
+// settings permission is sent all of them; anyone else, including clients
+// which haven't logged in, is only sent the public ones.
 func (s *Server) handleSettingsAPI(w http.ResponseWriter, r *http.Request) {
 	// Disable caching for this request - caching will be managed
-	// manually by this program.
+	// manually by this program. The response depends on who asked, so
+	// caches mustn't give one client's settings to another.
 	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Add("Vary", "Authorization, Cookie")
 
 	// Set the content type of the response to JSON so browsers
 	// don't attempt to display it as HTML.
 	w.Header().Set("Content-Type", "application/json")
 
-	passwordHash := s.Settings.PasswordHash
-	s.Settings.PasswordHash = ""
+	// A request which can't be authenticated isn't an error here, it just
+	// gets the public settings.
+	var settings interface{} = s.Settings.public()
+
+	if role, _, err := s.requestRole(r); err == nil {
+		allowed, err := s.hasPermission(role, permissionSettings)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if allowed {
+			settings = s.Settings
+		}
+	}
 
 	// Convert the settings into JSON so they can be transmitted over HTTP.
-	// If there is an error, it will be returned as a HTTP error with the
-	// status code 500, or Internal Server Error.
-	jsonData, err := json.Marshal(s.Settings)
+	// The password hash is never included. If there is an error, it will
+	// be returned as a HTTP error with the status code 500, or Internal
+	// Server Error.
+	jsonData, err := json.Marshal(settings)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	s.Settings.PasswordHash = passwordHash
-
 	w.Write(jsonData)
 }
 
 // handleChangeSettingsAPI is called to respond to a HTTP request to
-// /api/change-settings. It will update the settings in the running program's
-// memory and also in the database. It requires an admin password in the
-// 'password' form value, so only POST requests are accepted.
+// /api/v1/change-settings. It will update the settings in the running program's
+// memory and also in the database. It requires the request to come from a
+// logged in admin, and only POST requests are accepted.
 func (s *Server) handleChangeSettingsAPI(w http.ResponseWriter, r *http.Request) {
-	// Validate the user's entered password, in the form field 'password', and
-	// if it is wrong send them a message and exit the function.
-	if status, err := s.validatePassword(r, "password"); err != nil {
-		http.Error(w, err.Error(), status)
+	// Check that the request was made by a logged in admin, and if it
+	// wasn't send them a message and exit the function.
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
 		return
 	}
 
-	// Now we know that the user has entered the correct password, the
-	// settings can be updated using the 'changeSettings' server method.
+	// Now we know that the user is the admin, the settings can be updated
+	// using the 'changeSettings' server method. Invalid settings are the
+	// client's fault, and anything else is the server's.
 	if err := s.changeSettings(r); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+
+		var coded *apiError
+		if errors.As(err, &coded) && coded.code == codeInvalidSetting {
+			status = http.StatusBadRequest
+		}
+
+		writeError(w, status, err)
+		return
+	}
+}
+
+// handleScaleDiagram is called to respond to a HTTP request to
+// /api/v1/scale/{key}/{type}.svg. It responds with an SVG image of a
+// fretboard showing every position of the requested scale or arpeggio,
+// up to the number of frets given in the optional 'frets' query value. The
+// image is cached as described by serveDerived.
+func (s *Server) handleScaleDiagram(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	// Work out which notes are in the scale. If the key or scale type
+	// isn't known, respond with a Not Found status since there is no
+	// diagram at this URL.
+	root, pitches, err := scalePitches(vars["key"], vars["type"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
 		return
 	}
+
+	// Default to drawing the first twelve frets, which covers every
+	// position of the scale once, but allow the client to ask for
+	// anywhere between 1 and 24.
+	frets := 12
+	if value := r.URL.Query().Get("frets"); value != "" {
+		frets, err = strconv.Atoi(value)
+		if err != nil || frets < 1 || frets > 24 {
+			writeError(w, http.StatusBadRequest, errors.New("frets must be a number between 1 and 24"))
+			return
+		}
+	}
+
+	board := newScaleFretboard(standardTuning, frets, root, pitches)
+
+	serveDerived(w, r, "image/svg+xml", board.renderSVG())
 }
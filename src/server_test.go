@@ -0,0 +1,74 @@
+package src_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Zac-Garby/tab-server/src"
+	"github.com/Zac-Garby/tab-server/src/tabtest"
+)
+
+func TestMemoryServer(t *testing.T) {
+	_, handler := tabtest.NewServer(t, nil,
+		tabtest.NewTab("Abba", "Waterloo").Content("[C]My my").Build(),
+		tabtest.NewTab("The Beatles", "Help").Content("[G]Help").Build(),
+	)
+
+	// Logging in needs sessions, which are kept in the database rather
+	// than the store.
+	cookies := tabtest.LogIn(t, handler, tabtest.Password)
+
+	search := httptest.NewRecorder()
+	handler.ServeHTTP(search, tabtest.NewRequest("GET", "/api/v1/search?q=waterloo", nil, nil))
+
+	var found []*src.Tab
+	if err := json.Unmarshal(search.Body.Bytes(), &found); err != nil {
+		t.Fatal(err, search.Body)
+	}
+
+	if len(found) != 1 || found[0].Title != "Waterloo" {
+		t.Fatalf("expected to find Waterloo, got %s", search.Body)
+	}
+
+	deleted := httptest.NewRecorder()
+	handler.ServeHTTP(deleted, tabtest.NewRequest("POST", "/api/v1/delete-tab", url.Values{"id": {found[0].ID}}, cookies))
+	if deleted.Code != http.StatusOK {
+		t.Fatalf("expected to delete the tab, got %d: %s", deleted.Code, deleted.Body)
+	}
+
+	tabs := httptest.NewRecorder()
+	handler.ServeHTTP(tabs, tabtest.NewRequest("GET", "/api/v1/tabs", nil, nil))
+	if body := tabs.Body.String(); strings.Contains(body, "Waterloo") || !strings.Contains(body, "Help") {
+		t.Errorf("expected only Help to be left, got %s", body)
+	}
+}
+
+func TestScanCarriesOnPastUnreadableFiles(t *testing.T) {
+	s, handler := tabtest.NewServer(t, nil, tabtest.NewTab("Abba", "Waterloo").Build())
+
+	// A symlink to itself can be listed but never read.
+	dir := s.Settings.TabDirectory
+	if err := os.Symlink("Abba - Broken.txt", filepath.Join(dir, "Abba - Broken.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "Blur - Song 2.txt"), []byte("[E]Woo hoo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Rescan()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, tabtest.NewRequest("GET", "/api/v1/tabs", nil, nil))
+
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "Waterloo") || !strings.Contains(body, "Song 2") {
+		t.Errorf("expected the readable tabs to be listed, got %d: %s", w.Code, body)
+	}
+}
@@ -0,0 +1,193 @@
+package src
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionCookie is the name of the cookie which holds the session.
+	sessionCookie = "session"
+
+	// sessionDuration is how long a session lasts after logging in.
+	sessionDuration = 24 * time.Hour
+)
+
+// randomHex returns a string of n random bytes, encoded in hexadecimal. It
+// is used to generate session IDs and secrets which can't be guessed.
+func randomHex(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+// sessionSecret returns the current key used to sign session cookies, which
+// is kept in the session keyring as described in secrets.go.
+func (s *Server) sessionSecret() (string, error) {
+	return s.currentSecret(secretSession)
+}
+
+// signSession computes the signature of a session ID, which is the
+// HMAC-SHA256 of the ID using the session secret, in hexadecimal.
+func signSession(id, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sessionGeneration returns the current generation of sessions. Only the
+// sessions made in it are valid, so every session made before it is ended
+// when the generation is bumped.
+func (s *Server) sessionGeneration() (string, error) {
+	return s.Store.SessionGeneration()
+}
+
+// endAllSessions bumps the generation of sessions, so that every existing
+// session stops being valid, such as when the password is changed.
+func (s *Server) endAllSessions() error {
+	return s.Store.EndAllSessions()
+}
+
+// createSession stores a new session and sets a cookie containing its signed
+// ID on the response, along with the cookie holding its CSRF token.
+func (s *Server) createSession(w http.ResponseWriter) error {
+	secret, err := s.sessionSecret()
+	if err != nil {
+		return err
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	generation, err := s.sessionGeneration()
+	if err != nil {
+		return err
+	}
+
+	// The session is forgotten at the same time as the cookie expires, so
+	// old sessions don't build up. It remembers the generation it was made
+	// in.
+	if err := s.Store.CreateSession(id, generation, sessionDuration); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id + "." + signSession(id, secret),
+		Path:     "/",
+		Expires:  time.Now().Add(sessionDuration),
+		HttpOnly: true,
+		Secure:   s.HTTPS,
+		SameSite: s.sessionSameSite(),
+	})
+
+	token, err := s.csrfToken(id)
+	if err != nil {
+		return err
+	}
+
+	s.setCSRFCookie(w, token)
+
+	return nil
+}
+
+// sessionID returns the ID of the session in the request's cookie, having
+// checked its signature. If there is no cookie or the signature is wrong,
+// the second return value is false.
+func (s *Server) sessionID(r *http.Request) (string, bool, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false, nil
+	}
+
+	// The cookie's value is in the form ID.SIGNATURE, so split it into its
+	// two halves.
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return "", false, nil
+	}
+
+	// The cookie could have been signed with any of the keys which haven't
+	// retired yet, not just the current one.
+	ok, err := s.checkSignature(secretSession, parts[1], func(secret string) string {
+		return signSession(parts[0], secret)
+	})
+
+	if err != nil || !ok {
+		return "", false, err
+	}
+
+	return parts[0], true, nil
+}
+
+// validateSession checks that the request was made from a logged in
+// browser, and that it has the session's CSRF token if it needs one. If the
+// session is invalid, or the token is missing, an error and error status will
+// be returned.
+func (s *Server) validateSession(r *http.Request) (int, error) {
+	id, ok, err := s.sessionID(r)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !ok {
+		return http.StatusUnauthorized, errNotLoggedIn
+	}
+
+	// A correctly signed cookie is only valid if its session still exists,
+	// since it will have been removed if it expired or the admin logged out,
+	// and if it was made in the current generation, since it will have been
+	// ended if the password was changed since then.
+	made, ok, err := s.Store.Session(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !ok {
+		return http.StatusUnauthorized, errSessionExpired
+	}
+
+	generation, err := s.sessionGeneration()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if made != generation {
+		return http.StatusUnauthorized, errSessionExpired
+	}
+
+	return s.checkCSRF(r, id)
+}
+
+// destroySession removes the request's session from the store, if it
+// has one, and tells the client to forget its cookie.
+func (s *Server) destroySession(w http.ResponseWriter, r *http.Request) error {
+	id, ok, err := s.sessionID(r)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		if err := s.Store.DeleteSession(id); err != nil {
+			return err
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.HTTPS,
+		SameSite: s.sessionSameSite(),
+	})
+
+	s.setCSRFCookie(w, "")
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newSessionRequest logs in to a server and returns a request which sends the
+// session's cookies.
+func newSessionRequest(t *testing.T, s *Server) *http.Request {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	if err := s.createSession(w); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/tabs", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+
+	return r
+}
+
+func TestValidateSession(t *testing.T) {
+	s := &Server{Store: NewMemoryStore(DefaultSettings())}
+
+	r := newSessionRequest(t, s)
+	if status, err := s.validateSession(r); err != nil {
+		t.Fatalf("expected the session to be valid, got %d: %v", status, err)
+	}
+
+	// A cookie with the wrong signature isn't a session at all.
+	cookie, _ := r.Cookie(sessionCookie)
+
+	last := "0"
+	if strings.HasSuffix(cookie.Value, last) {
+		last = "1"
+	}
+
+	forged := httptest.NewRequest("GET", "/api/v1/tabs", nil)
+	forged.AddCookie(&http.Cookie{Name: sessionCookie, Value: cookie.Value[:len(cookie.Value)-1] + last})
+
+	if status, err := s.validateSession(forged); status != http.StatusUnauthorized || err != errNotLoggedIn {
+		t.Errorf("expected a forged session not to be logged in, got %d: %v", status, err)
+	}
+
+	if status, err := s.validateSession(httptest.NewRequest("GET", "/api/v1/tabs", nil)); status != http.StatusUnauthorized || err != errNotLoggedIn {
+		t.Errorf("expected no session not to be logged in, got %d: %v", status, err)
+	}
+}
+
+func TestEndAllSessions(t *testing.T) {
+	s := &Server{Store: NewMemoryStore(DefaultSettings())}
+
+	before := newSessionRequest(t, s)
+
+	if err := s.endAllSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sessions made before the generation was bumped have ended, even
+	// though their cookies are still signed correctly, but new ones work.
+	if status, err := s.validateSession(before); status != http.StatusUnauthorized || err != errSessionExpired {
+		t.Errorf("expected the old session to have ended, got %d: %v", status, err)
+	}
+
+	if status, err := s.validateSession(newSessionRequest(t, s)); err != nil {
+		t.Errorf("expected a new session to be valid, got %d: %v", status, err)
+	}
+}
+
+func TestDestroySession(t *testing.T) {
+	s := &Server{Store: NewMemoryStore(DefaultSettings())}
+
+	r := newSessionRequest(t, s)
+
+	if err := s.destroySession(httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, err := s.validateSession(r); status != http.StatusUnauthorized || err != errSessionExpired {
+		t.Errorf("expected the session to have ended, got %d: %v", status, err)
+	}
+}
@@ -0,0 +1,316 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A Setlist is an ordered list of tabs with a name, such as the songs for a
+// gig, so that they can all be pulled up with one request. The setlists are
+// kept in the 'setlists' hashmap, which maps each setlist's ID to it encoded
+// in JSON, and the last ID which was given out is kept in 'setlist-id'.
+//
+// When a tab is deleted it is taken out of every setlist it was in, and when
+// it is merged into another tab it is replaced by that tab, so a setlist
+// never refers to a tab which doesn't exist.
+type Setlist struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Notes string `json:"notes"`
+
+	// TabIDs are the IDs of the tabs in the setlist, in order. A tab can
+	// be in a setlist more than once, such as for an encore.
+	TabIDs []string `json:"tabIds"`
+
+	// Tabs are the tabs themselves, in the same order. They aren't
+	// stored, but are filled in when a single setlist is asked for.
+	Tabs []*Tab `json:"tabs,omitempty"`
+
+	Modified time.Time `json:"modified"`
+}
+
+// errSetlistNotFound is returned when there is no setlist with the ID which
+// was asked for.
+var errSetlistNotFound = newAPIError(codeSetlistNotFound, "no setlist with that ID")
+
+func init() {
+	tabReferenceMovers = append(tabReferenceMovers, (*Server).moveSetlistTabs)
+}
+
+// setlists returns every setlist, sorted by name.
+func (s *Server) setlists() ([]*Setlist, error) {
+	setlists, err := s.Store.Setlists()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(setlists, func(i, j int) bool {
+		return strings.ToLower(setlists[i].Name) < strings.ToLower(setlists[j].Name)
+	})
+
+	return setlists, nil
+}
+
+// getSetlist returns the setlist with the given ID. The second return value is
+// false if there is no such setlist.
+func (s *Server) getSetlist(id string) (*Setlist, bool, error) {
+	return s.Store.Setlist(id)
+}
+
+// saveSetlist stores a setlist, giving it an ID first if it doesn't have one
+// yet, and updates its modification time.
+func (s *Server) saveSetlist(setlist *Setlist) error {
+	if setlist.ID == "" {
+		id, err := s.Store.NextID(counterSetlists)
+		if err != nil {
+			return err
+		}
+
+		setlist.ID = id
+	}
+
+	if setlist.TabIDs == nil {
+		setlist.TabIDs = make([]string, 0)
+	}
+
+	setlist.Tabs = nil
+	setlist.Modified = time.Now()
+
+	return s.Store.PutSetlist(setlist)
+}
+
+// replaceSetlistTab replaces the tab with the ID from with the tab with the ID
+// to in every setlist, or takes it out of them if to is empty.
+func (s *Server) replaceSetlistTab(from, to string) error {
+	s.setlistLock.Lock()
+	defer s.setlistLock.Unlock()
+
+	setlists, err := s.setlists()
+	if err != nil {
+		return err
+	}
+
+	for _, setlist := range setlists {
+		ids := make([]string, 0, len(setlist.TabIDs))
+		changed := false
+
+		for _, id := range setlist.TabIDs {
+			switch {
+			case id != from:
+				ids = append(ids, id)
+
+			case to != "":
+				ids = append(ids, to)
+				changed = true
+
+			default:
+				changed = true
+			}
+		}
+
+		if !changed {
+			continue
+		}
+
+		setlist.TabIDs = ids
+
+		if err := s.saveSetlist(setlist); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeFromSetlists takes the tab with the given ID out of every setlist,
+// for when it has been deleted.
+func (s *Server) removeFromSetlists(id string) error {
+	return s.replaceSetlistTab(id, "")
+}
+
+// moveSetlistTabs puts the tab with the ID to in place of the tab with the ID
+// from in every setlist, for when the tabs are merged.
+func (s *Server) moveSetlistTabs(from, to string) error {
+	return s.replaceSetlistTab(from, to)
+}
+
+// setlistFromForm changes the setlist to have the name, notes and tabs in the
+// request's 'name', 'notes' and 'tabs' form values. The tabs are a JSON list
+// of tab IDs. Only the values which were given are changed, so that a new
+// setlist can be given all of them and an existing one just the ones which
+// have changed. If any of them are invalid, the setlist is left as it was
+// and the HTTP status which the error should be reported with is returned
+// along with it.
+func (s *Server) setlistFromForm(r *http.Request, setlist *Setlist) (int, error) {
+	if err := r.ParseForm(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	name, notes, ids := setlist.Name, setlist.Notes, setlist.TabIDs
+
+	if _, ok := r.PostForm["name"]; ok {
+		name = strings.TrimSpace(r.PostFormValue("name"))
+	}
+
+	if _, ok := r.PostForm["notes"]; ok {
+		notes = r.PostFormValue("notes")
+	}
+
+	if _, ok := r.PostForm["tabs"]; ok {
+		ids = nil
+
+		if err := json.Unmarshal([]byte(r.PostFormValue("tabs")), &ids); err != nil {
+			return http.StatusBadRequest, errors.New("the tabs must be a JSON list of tab IDs")
+		}
+
+		for _, id := range ids {
+			if _, ok, err := s.Store.GetTab(id); err != nil {
+				return http.StatusInternalServerError, err
+			} else if !ok {
+				return http.StatusBadRequest, newAPIError(codeTabNotFound, "no tab with the ID "+id)
+			}
+		}
+	}
+
+	if name == "" {
+		return http.StatusBadRequest, errors.New("a setlist needs a name")
+	}
+
+	setlist.Name, setlist.Notes, setlist.TabIDs = name, notes, ids
+
+	return http.StatusOK, nil
+}
+
+// handleSetlistsAPI is called to respond to a HTTP request to
+// /api/v1/setlists. A GET request responds with every setlist, sorted by name,
+// without their tabs, encoded in JSON. A POST request creates a new setlist
+// from the 'name', 'notes' and 'tabs' form values, where the tabs are a JSON
+// list of tab IDs such as ["4", "12", "7"], and responds with it.
+func (s *Server) handleSetlistsAPI(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		setlists, err := s.setlists()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		result = setlists
+
+	case "POST":
+		setlist := &Setlist{}
+
+		if status, err := s.setlistFromForm(r, setlist); err != nil {
+			writeError(w, status, err)
+			return
+		}
+
+		if err := s.saveSetlist(setlist); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		result = setlist
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET and POST are supported"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleSetlistAPI is called to respond to a HTTP request to
+// /api/v1/setlists/{id}. A GET request responds with the setlist, along with
+// each of its tabs in order, encoded in JSON. The tabs which the client isn't
+// allowed to see, such as explicit ones, are left out. A POST request changes
+// whichever of the 'name', 'notes' and 'tabs' form values are given, in the
+// same way as creating a setlist, and a DELETE request removes the setlist.
+func (s *Server) handleSetlistAPI(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	// Changing a setlist has to read it first, so nothing else can change
+	// it in between.
+	if r.Method == "POST" {
+		s.setlistLock.Lock()
+		defer s.setlistLock.Unlock()
+	}
+
+	setlist, ok, err := s.getSetlist(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errSetlistNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		tabs, err := s.Store.GetTabs(setlist.TabIDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		favourites, err := s.favouriteIDs(r)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		setlist.Tabs = make([]*Tab, 0, len(tabs))
+
+		for _, tab := range tabs {
+			if s.hidesTab(r, tab) {
+				continue
+			}
+
+			tab.applyTransformations(s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
+			setlist.Tabs = append(setlist.Tabs, tab)
+		}
+
+		markFavourites(setlist.Tabs, favourites)
+
+	case "POST":
+		if status, err := s.setlistFromForm(r, setlist); err != nil {
+			writeError(w, status, err)
+			return
+		}
+
+		if err := s.saveSetlist(setlist); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+	case "DELETE":
+		if err := s.Store.DeleteSetlist(id); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := s.detachSetlistRecordings(id); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		}
+
+		return
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET, POST and DELETE are supported"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(setlist)
+}
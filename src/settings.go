@@ -1,7 +1,8 @@
 package src
 
 import (
-	"github.com/go-redis/redis"
+	"path"
+	"strings"
 )
 
 // Settings is used to store the user settings of the application
@@ -10,70 +11,203 @@ import (
 // necessary for sending to clients via HTTP.
 type Settings struct {
 	// PasswordHash stores the SHA-256 hash of the admin
-	// password.
-	PasswordHash string `json:"password-hash"`
+	// password. It is never sent to clients.
+	PasswordHash string `json:"-"`
 
 	// TabDirectory is the absolute path to the directory
 	// in which to look for tabs.
-	TabDirectory string `json:"tab-directory"`
+	TabDirectory string `json:"tabDirectory"`
 
-	// FilenamePattern is the pattern to parse tabs with.
-	FilenamePattern string `json:"filename-pattern"`
+	// FilenamePatterns are the patterns to parse tabs
+	// with. Each tab is parsed with the first one which
+	// its filename matches.
+	FilenamePatterns []string `json:"filenamePatterns"`
 
 	// NonCapitalWords is the set of words which should
 	// not be capitalised when capitalising metadata.
-	NonCapitalWords []string `json:"non-capital-words"`
+	NonCapitalWords []string `json:"nonCapitalWords"`
 
 	// CharactersToRemove is the set of characters to
 	// get rid of from metadata.
-	CharactersToRemove string `json:"characters-to-remove"`
+	CharactersToRemove string `json:"charactersToRemove"`
+
+	// ScanDepth is how many levels of folders inside the
+	// tab directory to look for tabs in. 0 means that only
+	// the tab directory itself is scanned.
+	ScanDepth int `json:"scanDepth"`
+
+	// FolderMetadata is how the names of the folders which
+	// a tab is in are used. It is one of the folderMetadata
+	// constants.
+	FolderMetadata string `json:"folderMetadata"`
+
+	// IgnorePatterns is the set of glob patterns, such as
+	// "*.bak", for files and folders in the tab directory
+	// which aren't tabs and so shouldn't be parsed.
+	IgnorePatterns []string `json:"ignorePatterns"`
+
+	// HideExplicit is whether explicit tabs are hidden from
+	// everyone except the admin.
+	HideExplicit bool `json:"hideExplicit"`
+
+	// TabCacheTTL is how many seconds the list of tabs is
+	// kept in memory for. 0 means that it isn't kept at all.
+	TabCacheTTL int `json:"tabCacheTTL"`
+
+	// ServeStale is whether the list of tabs kept in memory
+	// is served straight away even when it is out of date,
+	// while a new one is fetched in the background.
+	ServeStale bool `json:"serveStale"`
+
+	// TransformScript is a Lua script which is run on each
+	// tab as it is read, to change its metadata or content.
+	// It is empty if there isn't one.
+	TransformScript string `json:"transformScript"`
+
+	// TransformScriptTimeout is how many milliseconds the
+	// transform script can run for on each tab.
+	TransformScriptTimeout int `json:"transformScriptTimeout"`
+
+	// PublicMode is whether the tabs without one of the
+	// AllowedLicenses are hidden from everyone except the
+	// admin.
+	PublicMode bool `json:"publicMode"`
+
+	// AllowedLicenses are the licenses which a tab must have
+	// one of to be shown to everyone in public mode.
+	AllowedLicenses []string `json:"allowedLicenses"`
+
+	// AutoTagRules are the rules which add tags to each tab
+	// as it is read, in addition to the ones in its filename.
+	AutoTagRules []AutoTagRule `json:"autoTagRules"`
+
+	// OpenMic is whether anyone can request a song, which
+	// is either matched with a tab or put on the wishlist.
+	OpenMic bool `json:"openMic"`
+
+	// AccessMode is who can use the API without logging in,
+	// which is one of the access constants in access.go.
+	AccessMode string `json:"accessMode"`
+
+	// TrashDays is how many days deleted tabs are kept in
+	// the trash for, so that they can be restored. 0 means
+	// that they are deleted straight away.
+	TrashDays int `json:"trashDays"`
+}
+
+// publicSettings are the settings which anyone can be sent, whether or not
+// they have logged in. The rest of the settings say where the tabs are kept
+// and how they are read, which is only the admin's business.
+type publicSettings struct {
+	// HideExplicit is whether explicit tabs are hidden from
+	// everyone except the admin.
+	HideExplicit bool `json:"hideExplicit"`
+
+	// OpenMic is whether anyone can request a song.
+	OpenMic bool `json:"openMic"`
+
+	// AccessMode is who can use the API without logging in,
+	// so that clients know whether to log in straight away.
+	AccessMode string `json:"accessMode"`
+}
+
+// public returns the subset of the settings which anyone can be sent.
+func (settings *Settings) public() *publicSettings {
+	return &publicSettings{
+		HideExplicit: settings.HideExplicit,
+		OpenMic:      settings.OpenMic,
+		AccessMode:   settings.AccessMode,
+	}
 }
 
-// LoadSettings creates a new instance of Settings by fetching
-// the settings from the given database connection. If there
-// is an error while fetching the data, an error will be
-// returned.
-func LoadSettings(db *redis.Client) (*Settings, error) {
-	// Get the password's SHA256 hash from the database, and
-	// check for any errors. If there is an error, this is
-	// returned from the function.
-	pw, err := db.Get("password-hash").Result()
-	if err != nil {
-		return nil, err
+// These are the possible values of Settings.FolderMetadata.
+const (
+	// folderMetadataNone ignores folder names.
+	folderMetadataNone = ""
+
+	// folderMetadataTags adds each folder name to the tab's tags.
+	folderMetadataTags = "tags"
+
+	// folderMetadataArtist uses the top level folder's name as the
+	// tab's artist, and adds the names of any folders inside that
+	// to its tags, which suits an artist/album layout.
+	folderMetadataArtist = "artist"
+)
+
+// check calls problem with each thing which is wrong with the settings, and
+// the name of the setting it's wrong with, such as "filename patterns". The
+// settings are checked in the same way wherever they come from, whether that
+// is the settings page, a restored dump, a preview on one of the utility
+// endpoints or the store as the server starts up, so each of those has the
+// same idea of which settings are valid.
+func (settings *Settings) check(problem func(setting, format string, args ...interface{})) {
+	if len(settings.FilenamePatterns) == 0 {
+		problem("filename patterns", "at least one filename pattern is needed")
+	}
+
+	for _, pattern := range settings.FilenamePatterns {
+		if err := checkFilenamePattern(pattern); err != nil {
+			problem("filename patterns", "the filename pattern %q is invalid: %s", pattern, err)
+		}
+	}
+
+	for _, pattern := range settings.IgnorePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			problem("ignore patterns", "invalid ignore pattern: %s", pattern)
+		}
+	}
+
+	switch settings.FolderMetadata {
+	case folderMetadataNone, folderMetadataTags, folderMetadataArtist:
+	default:
+		problem("folder metadata", "unknown folder metadata option: %s", settings.FolderMetadata)
+	}
+
+	if settings.ScanDepth < 0 {
+		problem("scan depth", "the scan depth must be a whole number, at least 0")
+	}
+
+	if settings.TabCacheTTL < 0 {
+		problem("tab cache TTL", "the tab cache TTL must be a whole number of seconds, at least 0")
 	}
 
-	// The same thing is done for each other field which must
-	// be fetched.
-	dir, err := db.Get("tab-directory").Result()
-	if err != nil {
-		return nil, err
+	// The transform script is compiled, so that a script which isn't valid
+	// Lua is refused rather than failing on every tab.
+	if strings.TrimSpace(settings.TransformScript) != "" {
+		if _, err := compileScript(settings.TransformScript); err != nil {
+			problem("transform script", "the transform script is invalid: %s", err)
+		}
 	}
 
-	pattern, err := db.Get("filename-pattern").Result()
-	if err != nil {
-		return nil, err
+	if settings.TransformScriptTimeout < 1 || settings.TransformScriptTimeout > maxTransformScriptTimeout {
+		problem("transform script timeout", "the transform script timeout must be a whole number of milliseconds, from 1 to %d", maxTransformScriptTimeout)
 	}
 
-	// This field is slightly different in that it is a set of
-	// strings instead of just a single string, which means
-	// that a different function must be used to fetch it.
-	nonCap, err := db.SMembers("non-capital-words").Result()
-	if err != nil {
-		return nil, err
+	for _, rule := range settings.AutoTagRules {
+		if err := rule.validate(); err != nil {
+			problem("auto-tag rules", "%s", err)
+		}
 	}
 
-	charsToRemove, err := db.Get("characters-to-remove").Result()
-	if err != nil {
-		return nil, err
+	if !validAccessMode(settings.AccessMode) {
+		problem("access mode", "unknown access mode: %s", settings.AccessMode)
 	}
 
-	// Create a new Settings instance populated with the fetched
-	// fields and return it.
-	return &Settings{
-		PasswordHash:       pw,
-		TabDirectory:       dir,
-		FilenamePattern:    pattern,
-		NonCapitalWords:    nonCap,
-		CharactersToRemove: charsToRemove,
-	}, nil
+	if settings.TrashDays < 0 {
+		problem("trash days", "the trash days must be a whole number, at least 0")
+	}
+}
+
+// validate returns the first thing which is wrong with the settings, as
+// found by check, as an invalid setting error, or nil if nothing is.
+func (settings *Settings) validate() error {
+	var err error
+
+	settings.check(func(setting, format string, args ...interface{}) {
+		if err == nil {
+			err = invalidSetting(format, args...)
+		}
+	})
+
+	return err
 }
@@ -0,0 +1,85 @@
+package src
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(settings *Settings)
+		valid  bool
+	}{
+		{"default settings", func(settings *Settings) {}, true},
+		{"no filename patterns", func(settings *Settings) { settings.FilenamePatterns = nil }, false},
+		{"pattern without variables", func(settings *Settings) { settings.FilenamePatterns = []string{"tab"} }, false},
+		{"bad ignore pattern", func(settings *Settings) { settings.IgnorePatterns = []string{"["} }, false},
+		{"unknown folder metadata", func(settings *Settings) { settings.FolderMetadata = "album" }, false},
+		{"negative scan depth", func(settings *Settings) { settings.ScanDepth = -1 }, false},
+		{"script which doesn't compile", func(settings *Settings) { settings.TransformScript = "tab.title = " }, false},
+		{"script which compiles", func(settings *Settings) { settings.TransformScript = "tab.title = 'x'" }, true},
+		{"no script timeout", func(settings *Settings) { settings.TransformScriptTimeout = 0 }, false},
+		{"bad auto-tag rule", func(settings *Settings) { settings.AutoTagRules = []AutoTagRule{{Field: "album"}} }, false},
+		{"unknown access mode", func(settings *Settings) { settings.AccessMode = "friends" }, false},
+		{"negative trash days", func(settings *Settings) { settings.TrashDays = -1 }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := DefaultSettings()
+			test.change(settings)
+
+			if err := settings.validate(); (err == nil) != test.valid {
+				t.Errorf("expected valid to be %v, got %v", test.valid, err)
+			}
+
+			// The startup check finds the same problems, as warnings.
+			report := &ConfigReport{}
+			settings.check(report.warn)
+
+			if (len(report.Problems) == 0) != test.valid {
+				t.Errorf("expected valid to be %v, got %s", test.valid, report)
+			}
+		})
+	}
+}
+
+func TestSettingBool(t *testing.T) {
+	tests := []struct {
+		name    string
+		form    url.Values
+		current bool
+		value   bool
+		valid   bool
+	}{
+		{"true", url.Values{"hide-explicit": {"true"}}, false, true, true},
+		{"false", url.Values{"hide-explicit": {"false"}}, true, false, true},
+		{"kept when not given", url.Values{}, true, true, true},
+		{"kept when empty", url.Values{"hide-explicit": {""}}, true, true, true},
+		{"anything else", url.Values{"hide-explicit": {"yes"}}, false, false, false},
+		{"capitalised", url.Values{"hide-explicit": {"True"}}, false, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/settings", strings.NewReader(test.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			value, err := settingBool(r, "hide-explicit", test.current)
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid to be %v, got %v", test.valid, err)
+			}
+
+			if err != nil {
+				if apiErr, ok := err.(*apiError); !ok || apiErr.code != codeInvalidSetting {
+					t.Errorf("expected an invalid_setting error, got %v", err)
+				}
+			} else if value != test.value {
+				t.Errorf("expected %v, got %v", test.value, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long the server waits for the requests which are
+// being handled, and the background work which is running, to finish when it
+// is asked to stop. Anything which hasn't finished by then is abandoned.
+const shutdownTimeout = 10 * time.Second
+
+// background returns the context which background work, such as jobs, runs
+// in. It is cancelled when the server starts shutting down.
+func (s *Server) background() context.Context {
+	if s.stopContext == nil {
+		return context.Background()
+	}
+
+	return s.stopContext
+}
+
+// serve runs the HTTP server, and the server which redirects to HTTPS if it
+// isn't nil, until one of them fails, or until the process is asked to stop
+// with SIGINT or SIGTERM. When that happens, the servers stop accepting
+// connections and wait for the requests they're handling to finish,
+// the background workers are stopped, and the database connection is closed.
+// An error is only returned if something went wrong, not if the server was
+// asked to stop.
+func (s *Server) serve(server, redirect *http.Server) error {
+	failed := make(chan error, 2)
+
+	go func() {
+		// The certificate and key are already in the server's TLS config.
+		if s.HTTPS {
+			failed <- server.ListenAndServeTLS("", "")
+		} else {
+			failed <- server.ListenAndServe()
+		}
+	}()
+
+	if redirect != nil {
+		go func() {
+			failed <- redirect.ListenAndServe()
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var err error
+
+	select {
+	case err = <-failed:
+	case sig := <-signals:
+		fmt.Printf("Received %s, shutting down...\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// If a server failed, it doesn't have any requests to wait for, so
+	// shutting it down just stops the other one.
+	if shutdownErr := server.Shutdown(ctx); err == nil {
+		err = shutdownErr
+	}
+
+	if redirect != nil {
+		if shutdownErr := redirect.Shutdown(ctx); err == nil {
+			err = shutdownErr
+		}
+	}
+
+	s.stopBackground(ctx)
+
+	if closeErr := s.Store.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+
+	return err
+}
+
+// stopBackground stops the file watcher and the job workers, cancelling any
+// jobs which are running, and waits for them to finish until the context is
+// done.
+func (s *Server) stopBackground(ctx context.Context) {
+	s.saveCollabRooms()
+
+	if s.stopWorkers != nil {
+		s.stopWorkers()
+	}
+
+	if s.watcher != nil {
+		s.watcher.Close()
+	}
+
+	finished := make(chan struct{})
+
+	go func() {
+		s.workers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		fmt.Println("warning: gave up waiting for the background work to stop")
+	}
+}
@@ -0,0 +1,200 @@
+package src
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultSignedURLLifetime is how long a signed URL lasts for if the
+	// admin doesn't say.
+	defaultSignedURLLifetime = time.Hour
+
+	// maxSignedURLLifetime is the longest a signed URL can last for.
+	maxSignedURLLifetime = 7 * 24 * time.Hour
+)
+
+// signablePrefixes are the paths which signed URLs can be made for. A signed
+// URL lets whoever has it make one request as if they were the admin, so
+// only paths which just give out files are allowed, never ones which change
+// anything.
+var signablePrefixes = []string{
+	"/api/v1/download/",
+	"/api/download/",
+}
+
+// A signed URL is a path with two query values added: 'expires', the Unix
+// time at which it stops working, and 'signature', the HMAC-SHA256 of the
+// path and the expiry time using the signing key. They can be handed to
+// other programs, like music players or printers, which can't log in.
+// Revoking the signing keys makes every signed URL given out so far stop
+// working at once, and the keys can also be rotated or revoked one at a time,
+// as described in secrets.go.
+
+// signingKey returns the current key used to sign URLs, which is kept in the
+// URL signing keyring as described in secrets.go.
+func (s *Server) signingKey() (string, error) {
+	return s.currentSecret(secretURLSigning)
+}
+
+// rotateSigningKey replaces the signing key with a new one, and revokes the
+// old ones straight away, so that none of the URLs signed with them work any
+// more.
+func (s *Server) rotateSigningKey() error {
+	_, err := s.rotateSecret(secretURLSigning, true)
+	return err
+}
+
+// signPath computes the signature of a path which expires at the given Unix
+// time, in hexadecimal.
+func signPath(p string, expires int64, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(p + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL returns a signed URL for the given path which works until lifetime
+// has passed. An error is returned if the path can't be signed.
+func (s *Server) signURL(p string, lifetime time.Duration) (string, error) {
+	p = path.Clean(p)
+
+	signable := false
+	for _, prefix := range signablePrefixes {
+		if strings.HasPrefix(p, prefix) {
+			signable = true
+		}
+	}
+
+	if !signable {
+		return "", errors.New("URLs can't be signed for that path")
+	}
+
+	key, err := s.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	expires := time.Now().Add(lifetime).Unix()
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", signPath(p, expires, key))
+
+	return p + "?" + query.Encode(), nil
+}
+
+// validSignature reports whether the request was made using a signed URL
+// which hasn't expired yet.
+func (s *Server) validSignature(r *http.Request) (bool, error) {
+	signature := r.FormValue("signature")
+	if signature == "" {
+		return false, nil
+	}
+
+	expires, err := strconv.ParseInt(r.FormValue("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false, nil
+	}
+
+	return s.checkSignature(secretURLSigning, signature, func(key string) string {
+		return signPath(r.URL.Path, expires, key)
+	})
+}
+
+// authenticateSigned checks that the request was either made by the admin,
+// in any of the ways authenticate accepts, or using a valid signed URL. If
+// neither is true, an error and error status will be returned.
+func (s *Server) authenticateSigned(r *http.Request) (int, error) {
+	ok, err := s.validSignature(r)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if ok {
+		return http.StatusOK, nil
+	}
+
+	return s.authenticate(r)
+}
+
+// handleDownloadAPI is called to respond to a HTTP request to
+// /api/v1/download/{id}. It responds with the original file of the tab with
+// that ID, as an attachment. Only the admin, or anyone with a signed URL,
+// can download files.
+func (s *Server) handleDownloadAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.authenticateSigned(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	tab, ok, err := s.Store.GetTab(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errTabNotFound)
+		return
+	}
+
+	s.serveTabFile(w, r, tab)
+}
+
+// handleSignURLAPI is called to respond to a HTTP request to /api/v1/sign-url.
+// It responds with a signed URL for the path in the 'path' form field,
+// encoded in JSON, which lasts for the number of seconds in the 'lifetime'
+// form field, or an hour if it isn't given. It will only accept POST
+// requests from a logged in admin.
+func (s *Server) handleSignURLAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	lifetime := defaultSignedURLLifetime
+
+	if value := r.PostFormValue("lifetime"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxSignedURLLifetime {
+			writeError(w, http.StatusBadRequest, errors.New("the lifetime must be a whole number of seconds, at most a week"))
+			return
+		}
+
+		lifetime = time.Duration(seconds) * time.Second
+	}
+
+	signed, err := s.signURL(r.PostFormValue("path"), lifetime)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"url": signed,
+	})
+}
+
+// handleRotateSigningKeyAPI is called to respond to a HTTP request to
+// /api/v1/rotate-signing-key. It replaces the signing keys, so every signed URL
+// given out so far stops working. It will only accept POST requests from a
+// logged in admin.
+func (s *Server) handleRotateSigningKeyAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if err := s.rotateSigningKey(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+}
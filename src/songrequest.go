@@ -0,0 +1,722 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// The wishlist keeps track of the songs which people want but which the
+// collection doesn't have a tab for yet, so that the band knows which ones
+// still need charts. In open mic mode, anyone can ask for a song at /request,
+// such as by scanning a QR code stuck to the stage. If the collection already
+// has a tab for it, they are sent links to the tab, so whoever is playing can
+// pull it up. Otherwise, the song goes on the wishlist. The band can add songs
+// to the wishlist whether or not open mic mode is on, and vote for the ones
+// they want most. A song which is asked for again counts as another vote on
+// its existing entry rather than being added twice.
+//
+// When a tab is added whose title and artist match a song on the wishlist,
+// the song is marked as fulfilled by it, and stays on the wishlist with a
+// link to the tab until it is removed.
+//
+// The wishlist is kept in the 'song-requests' hashmap, which maps each
+// entry's ID to it encoded in JSON, and the last ID which was given out is
+// kept in 'song-request-id'. Whoever has voted for each entry is kept in the
+// 'song-request-voters' hashmap, which maps its ID to a JSON list of them, so
+// that nobody can vote for a song twice.
+const (
+	// maxSongLength, maxSongArtistLength and maxRequesterNameLength are the
+	// most characters which a requested song, its artist and the name of
+	// whoever asked for it can have.
+	maxSongLength          = 200
+	maxSongArtistLength    = 100
+	maxRequesterNameLength = 50
+
+	// maxSongRequests is the most songs which can be on the wishlist at
+	// once, so that the audience can't fill the database up.
+	maxSongRequests = 500
+
+	// maxSongRequestNames is the most names which are kept for each song,
+	// after which the song is still counted when it's asked for again.
+	maxSongRequestNames = 20
+
+	// maxSongRequestMatches is the most tabs which a request is matched
+	// with.
+	maxSongRequestMatches = 5
+)
+
+// A SongRequest is a song on the wishlist.
+type SongRequest struct {
+	ID   string `json:"id"`
+	Song string `json:"song"`
+
+	// Artist is who the song is by, if whoever asked for it said.
+	Artist string `json:"artist"`
+
+	// RequestedBy are the names which the people who asked for the song
+	// gave, in the order they asked. Not everyone gives one, and only the
+	// first few are kept.
+	RequestedBy []string `json:"requestedBy"`
+
+	// Votes is how many times the song has been asked for or voted for.
+	Votes int `json:"votes"`
+
+	// Requested is when the song was first asked for, and LastRequested
+	// when it was most recently asked for.
+	Requested     time.Time `json:"requested"`
+	LastRequested time.Time `json:"lastRequested"`
+
+	// FulfilledBy is the ID of the tab which was added for the song, or
+	// empty if there isn't one yet.
+	FulfilledBy string `json:"fulfilledBy"`
+}
+
+// A songRequestMatch is a tab which a requested song was matched with, along
+// with the path of the page which displays it.
+type songRequestMatch struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	URL    string `json:"url"`
+}
+
+// A songRequestResult is the response to asking for a song. Either the tabs
+// which it matched are given, or the wishlist entry which it was added to.
+type songRequestResult struct {
+	Matches []songRequestMatch `json:"matches"`
+	Request *SongRequest       `json:"request,omitempty"`
+}
+
+var (
+	// errSongRequestNotFound is returned when there is no song on the
+	// wishlist with the ID which was asked for.
+	errSongRequestNotFound = newAPIError(codeSongRequestNotFound, "no song request with that ID")
+
+	// errSongRequestsClosed is returned when someone other than the band
+	// asks for a song while open mic mode is off.
+	errSongRequestsClosed = newAPIError(codeSongRequestsClosed, "songs can only be requested in open mic mode")
+
+	// errWishlistFull is returned when a song is asked for which isn't on
+	// the wishlist, but there is no room for it.
+	errWishlistFull = newAPIError(codeWishlistFull, "the wishlist is full")
+
+	// errAlreadyVoted and errNotVoted are returned when someone votes for a
+	// song twice, or takes back a vote which they didn't make.
+	errAlreadyVoted = newAPIError(codeConflict, "you have already voted for that song")
+	errNotVoted     = newAPIError(codeConflict, "you haven't voted for that song")
+)
+
+func init() {
+	tabReferenceMovers = append(tabReferenceMovers, (*Server).moveSongRequestTabs)
+}
+
+// songRequests returns every song on the wishlist, with the ones with the
+// most votes first, and the ones which were asked for first after that.
+func (s *Server) songRequests() ([]*SongRequest, error) {
+	requests, err := s.Store.SongRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].Votes != requests[j].Votes {
+			return requests[i].Votes > requests[j].Votes
+		}
+
+		return requests[i].Requested.Before(requests[j].Requested)
+	})
+
+	return requests, nil
+}
+
+// getSongRequest returns the song on the wishlist with the given ID. The
+// second return value is false if there is no such song.
+func (s *Server) getSongRequest(id string) (*SongRequest, bool, error) {
+	return s.Store.SongRequest(id)
+}
+
+// saveSongRequest stores a song request, giving it an ID first if it doesn't
+// have one yet.
+func (s *Server) saveSongRequest(request *SongRequest) error {
+	if request.ID == "" {
+		id, err := s.Store.NextID(counterSongRequests)
+		if err != nil {
+			return err
+		}
+
+		request.ID = id
+	}
+
+	return s.Store.PutSongRequest(request)
+}
+
+// removeSongRequests takes the songs with the given IDs off the wishlist,
+// along with the record of who voted for them.
+func (s *Server) removeSongRequests(ids ...string) error {
+	return s.Store.DeleteSongRequests(ids...)
+}
+
+// songRequestVoters returns everyone who has voted for the song on the
+// wishlist with the given ID.
+func (s *Server) songRequestVoters(id string) ([]string, error) {
+	return s.Store.SongRequestVoters(id)
+}
+
+// songRequestWords returns the words which a tab's title and artist need to
+// have between them for it to be the given song by the given artist. The
+// artist is often put in with the song, as in "Wonderwall by Oasis", so "by"
+// is left out.
+func songRequestWords(song, artist string) []string {
+	words := make([]string, 0)
+	for _, word := range searchWords(song + " " + artist) {
+		if word != "by" {
+			words = append(words, word)
+		}
+	}
+
+	return words
+}
+
+// tabHasWords reports whether a tab's title and artist have every one of the
+// given words between them.
+func tabHasWords(tab *Tab, words []string) bool {
+	named := make(map[string]bool)
+	for _, word := range searchWords(tab.Title + " " + tab.Artist) {
+		named[word] = true
+	}
+
+	for _, word := range words {
+		if !named[word] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchSongRequest returns the tabs which the request can see whose title and
+// artist, between them, have every word of the requested song and artist,
+// such as "wonderwall oasis" or "Wonderwall by Oasis". The content isn't
+// searched, since a song being mentioned in another song's lyrics doesn't
+// mean it's there.
+func (s *Server) matchSongRequest(r *http.Request, song, artist string) ([]songRequestMatch, error) {
+	words := songRequestWords(song, artist)
+
+	matches := make([]songRequestMatch, 0)
+	if len(words) == 0 {
+		return matches, nil
+	}
+
+	tabs, err := s.searchTabs(strings.Join(words, " "))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tab := range tabs {
+		if s.hidesTab(r, tab) || !tabHasWords(tab, words) {
+			continue
+		}
+
+		matches = append(matches, songRequestMatch{
+			ID:     tab.ID,
+			Title:  tab.Title,
+			Artist: tab.Artist,
+			URL:    "/display/" + tab.ID,
+		})
+
+		if len(matches) == maxSongRequestMatches {
+			break
+		}
+	}
+
+	return matches, nil
+}
+
+// isSong reports whether the song on the wishlist is the given song by the
+// given artist, which is decided in the same way as the browse index decides
+// whether two artists are the same. If only one of them says who the song is
+// by, it still counts as the same song.
+func (request *SongRequest) isSong(song, artist string) bool {
+	if browseName(request.Song) != browseName(song) {
+		return false
+	}
+
+	return request.Artist == "" || artist == "" || browseName(request.Artist) == browseName(artist)
+}
+
+// requestSong adds a song by the given artist, which can be empty, to the
+// wishlist, asked for by someone who gave the given name, which can be empty
+// too. If the song is already on the wishlist, it gets another vote instead.
+func (s *Server) requestSong(song, artist, name string) (*SongRequest, error) {
+	s.songRequestLock.Lock()
+	defer s.songRequestLock.Unlock()
+
+	requests, err := s.songRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	var request *SongRequest
+	for _, existing := range requests {
+		if existing.isSong(song, artist) {
+			request = existing
+			break
+		}
+	}
+
+	if request == nil {
+		if len(requests) >= maxSongRequests {
+			return nil, errWishlistFull
+		}
+
+		request = &SongRequest{Song: song, RequestedBy: []string{}, Requested: now}
+	}
+
+	if request.Artist == "" {
+		request.Artist = artist
+	}
+
+	request.Votes++
+	request.LastRequested = now
+
+	if name != "" && len(request.RequestedBy) < maxSongRequestNames {
+		request.RequestedBy = append(request.RequestedBy, name)
+	}
+
+	if err := s.saveSongRequest(request); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// voteForSong adds the given voter's vote to the song on the wishlist with the
+// given ID, or takes it back if vote is false. Each voter can only vote for
+// each song once. If there is an error, the HTTP status which it should be
+// reported with is returned along with it.
+func (s *Server) voteForSong(id, voter string, vote bool) (*SongRequest, int, error) {
+	s.songRequestLock.Lock()
+	defer s.songRequestLock.Unlock()
+
+	request, ok, err := s.getSongRequest(id)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	} else if !ok {
+		return nil, http.StatusNotFound, errSongRequestNotFound
+	}
+
+	voters, err := s.songRequestVoters(id)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	voted := -1
+	for i, existing := range voters {
+		if existing == voter {
+			voted = i
+		}
+	}
+
+	if vote {
+		if voted >= 0 {
+			return nil, http.StatusConflict, errAlreadyVoted
+		}
+
+		voters = append(voters, voter)
+		request.Votes++
+	} else {
+		if voted < 0 {
+			return nil, http.StatusConflict, errNotVoted
+		}
+
+		voters = append(voters[:voted], voters[voted+1:]...)
+		request.Votes--
+	}
+
+	if err := s.Store.SetSongRequestVoters(id, voters); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := s.saveSongRequest(request); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return request, http.StatusOK, nil
+}
+
+// fulfilSongRequests marks the songs on the wishlist which a newly added tab
+// is for as being fulfilled by it, on behalf of the given actor. Songs which
+// are already fulfilled by another tab are left alone.
+func (s *Server) fulfilSongRequests(tab *Tab, by actor) error {
+	// Most collections never use the wishlist, so they don't pay for it
+	// every time a tab is added.
+	if ids, err := s.Store.SongRequestIDs(); err != nil || len(ids) == 0 {
+		return err
+	}
+
+	s.songRequestLock.Lock()
+	defer s.songRequestLock.Unlock()
+
+	requests, err := s.songRequests()
+	if err != nil {
+		return err
+	}
+
+	for _, request := range requests {
+		if request.FulfilledBy != "" || !tabHasWords(tab, songRequestWords(request.Song, request.Artist)) {
+			continue
+		}
+
+		request.FulfilledBy = tab.ID
+
+		if err := s.saveSongRequest(request); err != nil {
+			return err
+		}
+
+		s.publishEvent(eventSongFulfilled, by, map[string]interface{}{
+			"id":   request.ID,
+			"song": request.Song,
+			"tab":  tabEventData(tab),
+		})
+	}
+
+	return nil
+}
+
+// replaceSongRequestTab makes every song on the wishlist which was fulfilled
+// by the tab with the ID from fulfilled by the tab with the ID to instead, or
+// not fulfilled at all if to is empty.
+func (s *Server) replaceSongRequestTab(from, to string) error {
+	s.songRequestLock.Lock()
+	defer s.songRequestLock.Unlock()
+
+	requests, err := s.songRequests()
+	if err != nil {
+		return err
+	}
+
+	for _, request := range requests {
+		if request.FulfilledBy != from {
+			continue
+		}
+
+		request.FulfilledBy = to
+
+		if err := s.saveSongRequest(request); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unfulfilSongRequests marks the songs on the wishlist which were fulfilled by
+// the tab with the given ID as not fulfilled, once the tab has been deleted.
+func (s *Server) unfulfilSongRequests(id string) error {
+	return s.replaceSongRequestTab(id, "")
+}
+
+// moveSongRequestTabs makes the songs on the wishlist which were fulfilled by
+// the tab with the ID from fulfilled by the tab with the ID to, when the two
+// tabs are merged.
+func (s *Server) moveSongRequestTabs(from, to string) error {
+	return s.replaceSongRequestTab(from, to)
+}
+
+// managesSongRequests reports whether the request was made by someone whose
+// role lets them manage the wishlist, such as a member of the band. Anyone
+// else, including someone who isn't logged in, doesn't.
+func (s *Server) managesSongRequests(r *http.Request) (bool, error) {
+	role, status, err := s.requestRole(r)
+	if status == http.StatusInternalServerError {
+		return false, err
+	} else if err != nil {
+		return false, nil
+	}
+
+	return s.hasPermission(role, permissionRequests)
+}
+
+// validateSongRequest checks that a song and its artist, either of which may
+// have been changed, can go on the wishlist.
+func validateSongRequest(song, artist string) error {
+	switch {
+	case browseName(song) == "":
+		return errors.New("a song needs to be given")
+
+	case utf8.RuneCountInString(song) > maxSongLength:
+		return fmt.Errorf("the song can't be longer than %d characters", maxSongLength)
+
+	case utf8.RuneCountInString(artist) > maxSongArtistLength:
+		return fmt.Errorf("the artist can't be longer than %d characters", maxSongArtistLength)
+	}
+
+	return nil
+}
+
+// songRequestFromForm returns the song, artist and name in the request's
+// 'song', 'artist' and 'name' form values.
+func songRequestFromForm(r *http.Request) (string, string, string, error) {
+	song := strings.TrimSpace(r.PostFormValue("song"))
+	artist := strings.TrimSpace(r.PostFormValue("artist"))
+	name := strings.TrimSpace(r.PostFormValue("name"))
+
+	if err := validateSongRequest(song, artist); err != nil {
+		return "", "", "", err
+	} else if utf8.RuneCountInString(name) > maxRequesterNameLength {
+		return "", "", "", fmt.Errorf("the name can't be longer than %d characters", maxRequesterNameLength)
+	}
+
+	return song, artist, name, nil
+}
+
+// changeSongRequest changes the song on the wishlist to have whichever of the
+// request's 'song', 'artist' and 'tab' form values were given, where the tab
+// is the ID of the tab which fulfils the song, or empty if none does. If any
+// of them are invalid, the song is left as it was and the HTTP status which
+// the error should be reported with is returned along with it.
+func (s *Server) changeSongRequest(r *http.Request, request *SongRequest) (int, error) {
+	if err := r.ParseForm(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	song, artist, tab := request.Song, request.Artist, request.FulfilledBy
+
+	if _, ok := r.PostForm["song"]; ok {
+		song = strings.TrimSpace(r.PostFormValue("song"))
+	}
+
+	if _, ok := r.PostForm["artist"]; ok {
+		artist = strings.TrimSpace(r.PostFormValue("artist"))
+	}
+
+	if _, ok := r.PostForm["tab"]; ok {
+		tab = r.PostFormValue("tab")
+	}
+
+	if err := validateSongRequest(song, artist); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if tab != "" {
+		if _, ok, err := s.Store.GetTab(tab); err != nil {
+			return http.StatusInternalServerError, err
+		} else if !ok {
+			return http.StatusBadRequest, newAPIError(codeTabNotFound, "no tab with the ID "+tab)
+		}
+	}
+
+	request.Song, request.Artist, request.FulfilledBy = song, artist, tab
+
+	return http.StatusOK, nil
+}
+
+// handleRequest is called to respond to a HTTP request to /request. The page
+// lets anyone ask for a song in open mic mode, and lets the band see the
+// wishlist, vote for the songs on it, and clear it.
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	//  Disable caching for this route.
+	w.Header().Set("Cache-Control", "max-age=0")
+
+	http.ServeFile(w, r, s.staticPath("html/request.html"))
+}
+
+// handleSongRequestsAPI is called to respond to a HTTP request to
+// /api/v1/song-requests. A POST request asks for the song in the 'song' form
+// value, by the artist in the optional 'artist' form value, on behalf of
+// whoever gave the optional name in the 'name' form value. Anyone can make
+// one in open mic mode, and the band can make one at any time. It responds
+// with the tabs which match the song, encoded in JSON, or if there aren't any,
+// the wishlist entry which the song was added to. A GET request responds with
+// the wishlist, with the most wanted songs first, or only the fulfilled or
+// unfulfilled songs if the 'fulfilled' query value is "1" or "0". A DELETE
+// request clears the wishlist.
+func (s *Server) handleSongRequestsAPI(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		requests, err := s.songRequests()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if fulfilled := r.FormValue("fulfilled"); fulfilled != "" {
+			filtered := make([]*SongRequest, 0, len(requests))
+
+			for _, request := range requests {
+				if (request.FulfilledBy != "") == (fulfilled == "1") {
+					filtered = append(filtered, request)
+				}
+			}
+
+			requests = filtered
+		}
+
+		result = requests
+
+	case "POST":
+		band, err := s.managesSongRequests(r)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if !band && !s.Settings.OpenMic {
+			writeError(w, http.StatusForbidden, errSongRequestsClosed)
+			return
+		}
+
+		song, artist, name, err := songRequestFromForm(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// The band ask for songs on their own behalf unless they say
+		// otherwise.
+		if band && name == "" {
+			name = s.requestActor(r).Name
+		}
+
+		matches, err := s.matchSongRequest(r, song, artist)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := songRequestResult{Matches: matches}
+
+		if len(matches) == 0 {
+			request, err := s.requestSong(song, artist, name)
+			if err == errWishlistFull {
+				writeError(w, http.StatusConflict, err)
+				return
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			// Everyone can ask for songs, but only the band can see who
+			// else asked for them.
+			response.Request = request
+			if !band {
+				public := *request
+				public.RequestedBy = []string{}
+				response.Request = &public
+			}
+
+			s.publishEvent(eventSongRequested, s.requestActor(r), map[string]interface{}{
+				"id":     request.ID,
+				"song":   request.Song,
+				"artist": request.Artist,
+				"votes":  request.Votes,
+			})
+		}
+
+		result = response
+
+	case "DELETE":
+		s.songRequestLock.Lock()
+		defer s.songRequestLock.Unlock()
+
+		ids, err := s.Store.SongRequestIDs()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := s.removeSongRequests(ids...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		}
+
+		return
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET, POST and DELETE are supported"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleSongRequestAPI is called to respond to a HTTP request to
+// /api/v1/song-requests/{id}. A GET request responds with the song on the
+// wishlist, encoded in JSON. A POST request changes whichever of the 'song',
+// 'artist' and 'tab' form values are given, such as to link the song to a tab
+// which was added under a different name, and responds with the changed
+// song. A DELETE request takes the song off the wishlist.
+func (s *Server) handleSongRequestAPI(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	s.songRequestLock.Lock()
+	defer s.songRequestLock.Unlock()
+
+	request, ok, err := s.getSongRequest(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errSongRequestNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+
+	case "POST":
+		if status, err := s.changeSongRequest(r, request); err != nil {
+			writeError(w, status, err)
+			return
+		}
+
+		if err := s.saveSongRequest(request); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+	case "DELETE":
+		if err := s.removeSongRequests(id); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		}
+
+		return
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET, POST and DELETE are supported"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(request)
+}
+
+// handleSongRequestVoteAPI is called to respond to a HTTP request to
+// /api/v1/song-requests/{id}/vote. A POST request votes for the song on the
+// wishlist on behalf of whoever made it, and a DELETE request takes their
+// vote back. Both respond with the song, encoded in JSON.
+func (s *Server) handleSongRequestVoteAPI(w http.ResponseWriter, r *http.Request) {
+	voter := s.requestActor(r)
+
+	request, status, err := s.voteForSong(mux.Vars(r)["id"], voter.Kind+":"+voter.Name, r.Method == "POST")
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(request)
+}
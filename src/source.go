@@ -0,0 +1,133 @@
+package src
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// These are the kinds of source which a tab can have, which say how it came
+// to be in the collection.
+const (
+	// sourceScan is a tab which was found in the tab directory, whether by
+	// the file watcher, a rescan, or listing the tabs. Tabs cached before
+	// sources were recorded are assumed to have been found this way.
+	sourceScan = "scan"
+
+	// sourceImport is a tab which was written into the tab directory by
+	// the import command, from another server's export.
+	sourceImport = "import"
+)
+
+// A TabSource says where a tab came from, so that the tabs which were added
+// in bulk can be found and cleaned up, and so that the people who wrote them
+// can be credited.
+type TabSource struct {
+	// Kind is how the tab was added, which is one of the source constants.
+	Kind string `json:"kind"`
+
+	// URL is where the tab was originally found, and Author is who wrote
+	// it. Either can be empty if it isn't known.
+	URL    string `json:"url,omitempty"`
+	Author string `json:"author,omitempty"`
+
+	// License is the license which the tab can be shared under, such as
+	// "CC-BY-4.0", or empty if it isn't known. It is set by the admin, and
+	// used in public mode, as described in license.go.
+	License string `json:"license,omitempty"`
+}
+
+// sourceKind returns the kind of source which a new tab cached by the given
+// actor has.
+func sourceKind(by actor) string {
+	if by.Kind == actorSystem && by.Name == systemImporter {
+		return sourceImport
+	}
+
+	return sourceScan
+}
+
+// filterSource returns the tabs with the given kind of source.
+func filterSource(tabs []*Tab, kind string) []*Tab {
+	filtered := make([]*Tab, 0, len(tabs))
+
+	for _, tab := range tabs {
+		if tab.Source.Kind == kind {
+			filtered = append(filtered, tab)
+		}
+	}
+
+	return filtered
+}
+
+// validSourceURL reports whether a tab's source URL can be stored, which it
+// can if it is empty or an absolute HTTP or HTTPS URL, so that it is always
+// safe to show as a link.
+func validSourceURL(raw string) bool {
+	if raw == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// setTabSource changes the URL and author of the source of the tab with the
+// given ID, on behalf of the given actor. The kind of source stays as it was,
+// since that is a record of how the tab was added. If there is an error, the
+// HTTP status which it should be reported with is returned along with it.
+func (s *Server) setTabSource(id, sourceURL, author string, by actor) (int, error) {
+	tab, exists, err := s.Store.GetTab(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !exists {
+		return http.StatusNotFound, errTabNotFound
+	}
+
+	if !validSourceURL(sourceURL) {
+		return http.StatusBadRequest, errors.New("the source URL must be an http or https URL")
+	}
+
+	tab.Source.URL = sourceURL
+	tab.Source.Author = author
+
+	if err := s.Store.SetSource(id, tab.Source); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if err := s.bumpCollectionVersion(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	s.publishEvent(eventTabUpdated, by, tabEventData(tab))
+
+	return http.StatusOK, nil
+}
+
+// handleSetSourceAPI is called to respond to a HTTP request to
+// /api/v1/set-source. It sets the URL and author of the source of the tab
+// with the ID in the 'id' form value to the 'url' and 'author' form values,
+// either of which can be empty to forget them. It will only accept POST
+// requests from a logged in admin.
+func (s *Server) handleSetSourceAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	id, sourceURL, author := r.PostFormValue("id"), r.PostFormValue("url"), r.PostFormValue("author")
+
+	if status, err := s.checkEditLock(r, id); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if status, err := s.setTabSource(id, sourceURL, author, s.requestActor(r)); err != nil {
+		writeError(w, status, err)
+		return
+	}
+}
@@ -0,0 +1,126 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// A monthCount is the number of tabs added in a particular month.
+type monthCount struct {
+	Month string `json:"month"`
+	Count int64  `json:"count"`
+}
+
+// A timeline holds the number of tabs added each month, both across the
+// whole collection and broken down by artist and by tag.
+type timeline struct {
+	Months  []monthCount            `json:"months"`
+	Artists map[string][]monthCount `json:"artists"`
+	Tags    map[string][]monthCount `json:"tags"`
+}
+
+// recordStats adds delta to each of the dated counters which the tab
+// contributes to: the month it was added in, overall and for its artist and
+// each of its tags. The counters map months, in the form YYYY-MM, to counts.
+// A delta of 1 is used when a tab is cached and -1 when it is deleted.
+func (s *Server) recordStats(tab *Tab, delta int64) error {
+	return s.Store.RecordStats(tab, delta)
+}
+
+// resetStats removes all of the dated counters, and returns how many things
+// were removed. They are rebuilt as the tabs are cached again, so this is
+// done whenever the cache is reset.
+func (s *Server) resetStats() (int64, error) {
+	return s.Store.ResetStats()
+}
+
+// monthCounts turns a counter into a list sorted by month, leaving out any
+// months which have dropped to zero. Each count is added to the
+// corresponding month in existing, so counters for two names which look the
+// same after transformations are merged together.
+func monthCounts(counts map[string]int64, existing []monthCount) []monthCount {
+	totals := make(map[string]int64)
+	for _, mc := range existing {
+		totals[mc.Month] = mc.Count
+	}
+
+	for month, count := range counts {
+		totals[month] += count
+	}
+
+	result := make([]monthCount, 0, len(totals))
+	for month, count := range totals {
+		if count > 0 {
+			result = append(result, monthCount{Month: month, Count: count})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Month < result[j].Month
+	})
+
+	return result
+}
+
+// getTimeline builds the timeline of the collection from the counters. The
+// artist and tag names are transformed in the same way as the tabs' are, so
+// they match what clients see in /api/v1/tabs.
+func (s *Server) getTimeline() (*timeline, error) {
+	counters, err := s.Store.StatCounters()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &timeline{
+		Months:  monthCounts(counters.Months, nil),
+		Artists: make(map[string][]monthCount),
+		Tags:    make(map[string][]monthCount),
+	}
+
+	// The artists and tags are handled in exactly the same way, so this
+	// loop goes through both of them, filling in the appropriate map.
+	for _, group := range []struct {
+		counters map[string]map[string]int64
+		into     map[string][]monthCount
+	}{
+		{counters.Artists, result.Artists},
+		{counters.Tags, result.Tags},
+	} {
+		for name, counter := range group.counters {
+			display := transformString(name, s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
+
+			if counts := monthCounts(counter, group.into[display]); len(counts) > 0 {
+				group.into[display] = counts
+			} else {
+				delete(group.into, display)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// handleTimelineAPI is called to respond to a HTTP request to
+// /api/v1/stats/timeline. It responds with the number of tabs added each
+// month, overall and per artist and tag, encoded in JSON.
+func (s *Server) handleTimelineAPI(w http.ResponseWriter, r *http.Request) {
+	// Disable caching for this request - caching will be managed
+	// manually by this program.
+	w.Header().Set("Cache-Control", "max-age=0")
+
+	timeline, err := s.getTimeline()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(timeline)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
@@ -0,0 +1,619 @@
+package src
+
+import (
+	"time"
+)
+
+// A Store is where everything which the server keeps is kept: the cached
+// tabs and the settings, and everything built up around them, such as the
+// sessions, the search index and the jobs. RedisStore is the one which is
+// normally used, and MemoryStore keeps everything in memory instead, but
+// anything else which can keep the same information can be used in their
+// place. Tabs are stored and returned without transformations applied.
+//
+// Each part of the store is its own interface, so that the code which only
+// needs one part of it can say so, and the Store is all of them together.
+type Store interface {
+	TabStore
+	SettingsStore
+	SessionStore
+	LoginStore
+	TokenStore
+	SecretStore
+	TrashStore
+	JobStore
+	EventStore
+	IndexStore
+	RecordingStore
+	IntegrityStore
+	SetlistStore
+	SongRequestStore
+	ViewStore
+	FavouriteStore
+	TagRuleStore
+	EditStore
+
+	// NextID increments the counter with the given name, such as
+	// counterSetlists, and returns its new value, which is the next ID
+	// to give out.
+	NextID(counter string) (string, error)
+
+	// IDCounter returns the value of the counter with the given name,
+	// which is 0 if no IDs have been given out yet, and SetIDCounter
+	// changes it. They are used to copy the counters to another store.
+	IDCounter(counter string) (int64, error)
+	SetIDCounter(counter string, value int64) error
+
+	// NowShowing returns the ID of the tab on show in each state, leaving
+	// out the states with nothing on show, and SetNowShowing changes the
+	// tab on show in one state. An empty ID means that nothing is.
+	NowShowing() (map[string]string, error)
+	SetNowShowing(state, id string) error
+
+	// CollectionModified returns when the collection last changed. The
+	// second return value is false if that isn't known.
+	// SetCollectionModified records when it did.
+	CollectionModified() (time.Time, bool, error)
+	SetCollectionModified(modified time.Time) error
+
+	// MountSentinel returns the tab directory which the mount sentinel
+	// was last seen in, or an empty string if it hasn't been seen, and
+	// SetMountSentinel changes it.
+	MountSentinel() (string, error)
+	SetMountSentinel(dir string) error
+
+	// Ping checks that the store can be reached.
+	Ping() error
+
+	// Close releases whatever the store holds on to, such as its
+	// connections to the database. It can't be used afterwards.
+	Close() error
+}
+
+// These are the names of the counters which the IDs of things other than tabs
+// are given out from, with NextID.
+const (
+	counterJobs         = "job-counter"
+	counterRecordings   = "recording-id"
+	counterSetlists     = "setlist-id"
+	counterSongRequests = "song-request-id"
+)
+
+// These are the names of the indexes which can be rebuilt from the tabs, whose
+// versions are kept with SetIndexVersion.
+const (
+	indexSearch = "search"
+	indexBrowse = "browse"
+)
+
+// A TabStore keeps the cached tabs.
+type TabStore interface {
+	// GetTab returns the tab with the given ID. If there is no such tab, the
+	// second return value is false.
+	GetTab(id string) (*Tab, bool, error)
+
+	// GetTabs returns the tabs with each of the given IDs, in the same order,
+	// leaving out any which don't exist.
+	GetTabs(ids []string) ([]*Tab, error)
+
+	// PutTab stores a tab. If the tab's ID is empty, it is stored as a new
+	// tab and its ID is set to the next available one. Otherwise, it replaces
+	// the tab with that ID, which must already exist. The tab's explicit
+	// override isn't stored; SetExplicitOverride is used to change that.
+	PutTab(tab *Tab) error
+
+	// RestoreTab stores a tab under the ID it already has, which mustn't be
+	// in use, and makes sure that new tabs are given higher IDs. It is used
+	// to put tabs back after the store has lost them, so that they keep
+	// their IDs.
+	RestoreTab(tab *Tab) error
+
+	// DeleteTab removes the tab with the given ID.
+	DeleteTab(id string) error
+
+	// ListIDs returns the IDs of every stored tab, in no particular order.
+	ListIDs() ([]string, error)
+
+	// Filenames returns a map from the filename of every stored tab to its
+	// ID.
+	Filenames() (map[string]string, error)
+
+	// TabID returns the ID of the tab with the given filename. If there is no
+	// such tab, the second return value is false.
+	TabID(filename string) (string, bool, error)
+
+	// SetModified changes just the modification time of the tab with the
+	// given ID.
+	SetModified(id string, modified time.Time) error
+
+	// SetExplicitOverride changes the explicit override of the tab with the
+	// given ID. An empty override removes it.
+	SetExplicitOverride(id, override string) error
+
+	// SetSource changes just the source of the tab with the given ID.
+	SetSource(id string, source TabSource) error
+
+	// SetPractice changes just the practice metadata of the tab with the
+	// given ID.
+	SetPractice(id string, practice TabPractice) error
+
+	// ExtraTags returns the tags which have been added to the tab with the
+	// given ID on top of the ones from its file.
+	ExtraTags(id string) ([]string, error)
+
+	// AddExtraTags adds to the extra tags of the tab with the given ID.
+	AddExtraTags(id string, tags []string) error
+
+	// RewriteTags replaces the tags of each tab in tags, and the extra tags
+	// of each tab in extraTags, which both map tab IDs to their new tags.
+	// Either every tab is changed or none of them are.
+	RewriteTags(tags, extraTags map[string][]string) error
+
+	// CollectionVersion returns the collection version, which is 0 before
+	// anything has changed.
+	CollectionVersion() (int64, error)
+
+	// BumpCollectionVersion increments the collection version.
+	BumpCollectionVersion() error
+
+	// ResetTabs removes every tab, so that the next tab stored gets the
+	// first ID again.
+	ResetTabs() error
+}
+
+// A SettingsStore keeps the settings and the admin password.
+type SettingsStore interface {
+	// LoadSettings returns the stored settings.
+	LoadSettings() (*Settings, error)
+
+	// SaveSettings stores all of the settings except from the password
+	// hash, which is changed with SetPasswordHash.
+	SaveSettings(settings *Settings) error
+
+	// PasswordHash returns the stored hash of the admin password.
+	PasswordHash() (string, error)
+
+	// SetPasswordHash changes the stored hash of the admin password.
+	SetPasswordHash(hash string) error
+}
+
+// A SessionStore keeps the admin's sessions, each of which remembers the
+// generation of sessions it was made in.
+type SessionStore interface {
+	// SessionGeneration returns the current generation of sessions, which
+	// is "0" until EndAllSessions is first called.
+	SessionGeneration() (string, error)
+
+	// EndAllSessions moves on to the next generation of sessions.
+	EndAllSessions() error
+
+	// CreateSession stores a session made in the given generation, which
+	// is forgotten once the duration has passed.
+	CreateSession(id, generation string, duration time.Duration) error
+
+	// Session returns the generation which the session with the given ID
+	// was made in. The second return value is false if there is no such
+	// session, such as when it has expired.
+	Session(id string) (string, bool, error)
+
+	// DeleteSession removes the session with the given ID.
+	DeleteSession(id string) error
+}
+
+// A LoginStore keeps track of how often each IP address has made requests to
+// the rate limited endpoints and entered the wrong password, and which of
+// them have been locked out because of it.
+type LoginStore interface {
+	// CountRequest counts a request from the IP address in the current
+	// window, which starts with the first request and lasts for the given
+	// duration. The return value is true if there have been more than limit
+	// requests in the window, along with how long is left of it.
+	CountRequest(ip string, limit int64, window time.Duration) (bool, time.Duration, error)
+
+	// Lockout returns how long is left of the IP address's lockout, or 0 if
+	// it isn't locked out.
+	Lockout(ip string) (time.Duration, error)
+
+	// LockOut locks out the IP address for the given duration.
+	LockOut(ip string, duration time.Duration) error
+
+	// CountFailedLogin counts a wrong password entered from the IP address,
+	// and returns how many there have been. They are forgotten once the
+	// given duration has passed without another one.
+	CountFailedLogin(ip string, memory time.Duration) (int64, error)
+
+	// ClearFailedLogins forgets the wrong passwords entered from the IP
+	// address.
+	ClearFailedLogins(ip string) error
+}
+
+// A TokenStore keeps the API tokens, by the hashes of the tokens, and the
+// roles' permissions.
+type TokenStore interface {
+	// PutToken stores a token under its hash, with a name and a role. If
+	// the role is empty, none is stored, as for the tokens from before
+	// there were roles, which are admins.
+	PutToken(hash, name, role string) error
+
+	// Tokens returns a map from the hash of every token to its name.
+	Tokens() (map[string]string, error)
+
+	// TokenName returns the name of the token with the given hash. The
+	// second return value is false if there is no such token.
+	TokenName(hash string) (string, bool, error)
+
+	// TokenRoles returns a map from the name of every token which has a
+	// role to its role, and TokenRole returns the role of one token. The
+	// second return value is false if it doesn't have one.
+	TokenRoles() (map[string]string, error)
+	TokenRole(name string) (string, bool, error)
+
+	// DeleteToken removes the token with the given hash and name.
+	DeleteToken(hash, name string) error
+
+	// Roles returns the permissions of every role. The second return value
+	// is false if they have never been saved, in which case the default
+	// roles are used.
+	Roles() (map[string][]string, bool, error)
+
+	// SaveRoles replaces every role.
+	SaveRoles(roles map[string][]string) error
+}
+
+// A SecretStore keeps the keyrings of the keys which sign things, by their
+// purposes.
+type SecretStore interface {
+	// Secrets returns every key in a purpose's keyring, in no particular
+	// order.
+	Secrets(purpose string) ([]signingSecret, error)
+
+	// PutSecrets adds or replaces keys in a purpose's keyring.
+	PutSecrets(purpose string, secrets ...signingSecret) error
+
+	// AddInitialSecret adds the first key to a purpose's keyring, unless
+	// it already has a key with the same ID, so that two things doing so
+	// at once both end up with the same key. If the store has the
+	// purpose's single key from before there were keyrings, its value is
+	// used instead of the new key's, and it is forgotten.
+	AddInitialSecret(purpose string, secret signingSecret) error
+
+	// ReplaceSecrets replaces a purpose's whole keyring with the one key,
+	// in one go, so nothing can find the keyring empty in between.
+	ReplaceSecrets(purpose string, secret signingSecret) error
+
+	// DeleteSecrets removes the keys with the given IDs from a purpose's
+	// keyring, and returns how many there were.
+	DeleteSecrets(purpose string, ids ...string) (int, error)
+}
+
+// A TrashStore keeps the records of the tabs in the trash, by their IDs.
+type TrashStore interface {
+	// TrashedTabs returns every tab in the trash, in no particular order.
+	TrashedTabs() ([]*trashedTab, error)
+
+	// TrashedTab returns the tab in the trash with the given ID. The
+	// second return value is false if there is no such tab.
+	TrashedTab(id string) (*trashedTab, bool, error)
+
+	// PutTrashedTab puts a tab in the trash under the given ID.
+	PutTrashedTab(id string, tab *trashedTab) error
+
+	// DeleteTrashedTab takes the tab with the given ID out of the trash.
+	DeleteTrashedTab(id string) error
+}
+
+// A JobStore keeps the records of the background jobs, and the queue of the
+// jobs which are waiting to run.
+type JobStore interface {
+	// CreateJob stores a new job, which must already have an ID, as the
+	// most recent one. Only the given number of the most recent jobs are
+	// kept, and the records of the rest are removed.
+	CreateJob(j *job, keep int) error
+
+	// UpdateJob stores the job's current state. Whether the job has been
+	// asked to cancel isn't stored, since only RequestJobCancel changes
+	// it.
+	UpdateJob(j *job) error
+
+	// SetJobProgress changes just how far through the job with the given
+	// ID is.
+	SetJobProgress(id string, done, total int) error
+
+	// RequestJobCancel notes that the job with the given ID has been asked
+	// to cancel.
+	RequestJobCancel(id string) error
+
+	// Job returns the job with the given ID. The second return value is
+	// false if there is no such job.
+	Job(id string) (*job, bool, error)
+
+	// Jobs returns every job which is still kept, most recent first.
+	Jobs() ([]*job, error)
+
+	// QueueJob adds the job with the given ID to the end of the queue.
+	QueueJob(id string) error
+
+	// NextQueuedJob takes the job at the front of the queue off it, waiting
+	// for up to the given duration for there to be one. The second return
+	// value is false if there still wasn't one.
+	NextQueuedJob(wait time.Duration) (string, bool, error)
+}
+
+// A loggedEvent is an entry in the event log. Actor and Data are JSON.
+type loggedEvent struct {
+	ID     string
+	Schema string
+	Type   string
+	Time   string
+	Actor  string
+	Data   string
+}
+
+// An EventStore keeps the event log. Each event is given an ID when it is
+// added, which is two numbers separated by a '-', such as "1526919030474-0",
+// and the IDs of later events are greater, comparing the first numbers and
+// then the second.
+type EventStore interface {
+	// AddEvent adds an event to the end of the log, ignoring its ID. The
+	// log is trimmed to roughly the given length.
+	AddEvent(event loggedEvent, max int64) error
+
+	// LatestEventID returns the ID of the newest event, or "0-0" if there
+	// aren't any.
+	LatestEventID() (string, error)
+
+	// EventsAfter returns up to count of the events after the one with the
+	// given ID, oldest first.
+	EventsAfter(id string, count int64) ([]loggedEvent, error)
+}
+
+// statCounters are the dated counters behind the statistics, which map
+// months, in the form YYYY-MM, to the number of tabs added in them, for the
+// whole collection and for each artist and tag.
+type statCounters struct {
+	Months  map[string]int64
+	Artists map[string]map[string]int64
+	Tags    map[string]map[string]int64
+}
+
+// An IndexStore keeps the indexes which are built from the tabs, so they can
+// be looked up without going through the whole collection: the dated
+// counters behind the statistics, the search index, which maps trigrams to
+// the tabs containing them, and the browse index, which maps artists and tags
+// to their tabs. They are kept up to date as the tabs change, and can always
+// be built again from the tabs.
+type IndexStore interface {
+	// RecordStats adds delta to each of the counters which the tab counts
+	// towards: the month it was added in, overall and for its artist and
+	// each of its tags.
+	RecordStats(tab *Tab, delta int64) error
+
+	// StatCounters returns every counter.
+	StatCounters() (*statCounters, error)
+
+	// ResetStats removes every counter, and returns how many things were
+	// removed.
+	ResetStats() (int64, error)
+
+	// IndexTab adds a tab, which must already have its ID, to the search
+	// index under the trigrams of its searchText.
+	IndexTab(tab *Tab) error
+
+	// UnindexTab removes the tab with the given ID from the search index.
+	UnindexTab(id string) error
+
+	// SearchIDs returns the IDs of the tabs indexed under every one of the
+	// given trigrams, of which there must be at least one.
+	SearchIDs(trigrams []string) ([]string, error)
+
+	// ResetSearchIndex removes every tab from the search index, and returns
+	// how many things were removed.
+	ResetSearchIndex() (int64, error)
+
+	// AddToBrowseIndex adds a tab, which must already have its ID, to the
+	// browse index, under its artist and each of its tags.
+	AddToBrowseIndex(tab *Tab) error
+
+	// RemoveFromBrowseIndex takes a tab out of the browse index. The tab
+	// must be the version which was added, so that it is taken out from
+	// under the same artist and tags.
+	RemoveFromBrowseIndex(tab *Tab) error
+
+	// MarkBrowseExplicit changes whether the browse index counts the tab
+	// with the given ID as explicit.
+	MarkBrowseExplicit(id string, explicit bool) error
+
+	// BrowseIDs returns the IDs of the tabs in the browse index under the
+	// given kind, "artist" or "tag", and browseName.
+	BrowseIDs(kind, name string) ([]string, error)
+
+	// ArtistCounts returns a map from each artist in the browse index, as
+	// their name was written in one of their tabs, to how many tabs they
+	// have. If explicit is false, explicit tabs aren't counted, and the
+	// artists who only have explicit tabs are left out.
+	ArtistCounts(explicit bool) (map[string]int, error)
+
+	// ResetBrowseIndex removes every tab from the browse index, and
+	// returns how many things were removed.
+	ResetBrowseIndex() (int64, error)
+
+	// ReindexTabs replaces the counters and index entries of each tab in
+	// old, as it was, with the ones of the tab with the same ID in current,
+	// all in one go, so that nothing sees some of them changed and others
+	// not. A tab which isn't in current is left out of the indexes.
+	ReindexTabs(old []*Tab, current map[string]*Tab) error
+
+	// IndexVersion returns the version of the layout which the index with
+	// the given name was built with, or an empty string if it hasn't been
+	// built, and SetIndexVersion changes it. An empty version means that it
+	// hasn't been built.
+	IndexVersion(index string) (string, error)
+	SetIndexVersion(index, version string) error
+}
+
+// A RecordingStore keeps the rehearsal recordings, and their waveforms. The
+// recordings' files are kept in the recording directory instead.
+type RecordingStore interface {
+	// Recordings returns every recording, in no particular order.
+	Recordings() ([]*Recording, error)
+
+	// Recording returns the recording with the given ID. The second return
+	// value is false if there is no such recording.
+	Recording(id string) (*Recording, bool, error)
+
+	// PutRecording stores a recording, which must already have an ID.
+	PutRecording(recording *Recording) error
+
+	// DeleteRecording removes the recording with the given ID, along with
+	// its waveform.
+	DeleteRecording(id string) error
+
+	// Waveform returns the JSON of the waveform of the recording with the
+	// given ID, and PutWaveform stores it. The second return value is false
+	// if it doesn't have one.
+	Waveform(id string) ([]byte, bool, error)
+	PutWaveform(id string, waveform []byte) error
+}
+
+// An IntegrityStore keeps the integrity snapshots, along with the tabs'
+// content hashes from the latest one.
+type IntegrityStore interface {
+	// IntegritySnapshots returns up to the given number of the most recent
+	// snapshots, newest first.
+	IntegritySnapshots(count int) ([]*integritySnapshot, error)
+
+	// IntegrityHashes returns a map from the ID of every tab in the latest
+	// snapshot to its content hash.
+	IntegrityHashes() (map[string]string, error)
+
+	// AddIntegritySnapshot stores a snapshot as the latest one, along with
+	// the content hashes which were found, in one go. Only the given number
+	// of the most recent snapshots are kept.
+	AddIntegritySnapshot(snapshot *integritySnapshot, hashes map[string]string, keep int) error
+}
+
+// A SetlistStore keeps the setlists, by their IDs.
+type SetlistStore interface {
+	// Setlists returns every setlist, in no particular order.
+	Setlists() ([]*Setlist, error)
+
+	// Setlist returns the setlist with the given ID. The second return
+	// value is false if there is no such setlist.
+	Setlist(id string) (*Setlist, bool, error)
+
+	// PutSetlist stores a setlist, which must already have an ID.
+	PutSetlist(setlist *Setlist) error
+
+	// DeleteSetlist removes the setlist with the given ID.
+	DeleteSetlist(id string) error
+}
+
+// A SongRequestStore keeps the wishlist of requested songs, by their IDs,
+// along with who has voted for each of them.
+type SongRequestStore interface {
+	// SongRequests returns every song on the wishlist, in no particular
+	// order, and SongRequestIDs returns just their IDs.
+	SongRequests() ([]*SongRequest, error)
+	SongRequestIDs() ([]string, error)
+
+	// SongRequest returns the song on the wishlist with the given ID. The
+	// second return value is false if there is no such song.
+	SongRequest(id string) (*SongRequest, bool, error)
+
+	// PutSongRequest stores a song request, which must already have an ID.
+	PutSongRequest(request *SongRequest) error
+
+	// DeleteSongRequests takes the songs with the given IDs off the
+	// wishlist, along with who voted for them.
+	DeleteSongRequests(ids ...string) error
+
+	// SongRequestVoters returns everyone who has voted for the song with
+	// the given ID, and SetSongRequestVoters changes them.
+	SongRequestVoters(id string) ([]string, error)
+	SetSongRequestVoters(id string, voters []string) error
+}
+
+// A ViewStore keeps the saved views, by their names.
+type ViewStore interface {
+	// Views returns every view, by name.
+	Views() (map[string]*view, error)
+
+	// View returns the view with the given name. The second return value
+	// is false if there is no such view.
+	View(name string) (*view, bool, error)
+
+	// PutView stores a view, replacing any which already has the same
+	// name.
+	PutView(name string, v *view) error
+
+	// DeleteView removes the view with the given name. The return value is
+	// false if there was no such view.
+	DeleteView(name string) (bool, error)
+}
+
+// A FavouriteStore keeps everyone's favourite tabs. Each set of favourites
+// has an owner, such as "token:NAME" for an API token, and can expire, so that
+// the favourites of browsers which never come back don't build up.
+type FavouriteStore interface {
+	// Favourites returns the IDs of the owner's favourite tabs.
+	Favourites(owner string) ([]string, error)
+
+	// AddFavourites adds to the owner's favourites, and RemoveFavourite
+	// takes one away. If expiry isn't 0, the owner's favourites are
+	// forgotten once it has passed without them changing again.
+	AddFavourites(owner string, ids []string, expiry time.Duration) error
+	RemoveFavourite(owner, id string, expiry time.Duration) error
+
+	// ExpireFavourites makes the owner's favourites last for the given
+	// duration from now.
+	ExpireFavourites(owner string, expiry time.Duration) error
+
+	// FavouriteOwners returns everyone who has any favourites.
+	FavouriteOwners() ([]string, error)
+
+	// MoveFavourites replaces the tab with the ID from with the tab with
+	// the ID to in everyone's favourites.
+	MoveFavourites(from, to string) error
+}
+
+// A TagRuleStore keeps the admin's tag rules, which map lower case tags to
+// the tags which replace them, or to an empty string for the ones which have
+// been deleted.
+type TagRuleStore interface {
+	// TagRules returns every rule.
+	TagRules() (map[string]string, error)
+
+	// UpdateTagRules adds or changes the rules in changed, and removes the
+	// ones for the tags in removed, in one go.
+	UpdateTagRules(changed map[string]string, removed []string) error
+
+	// ReplaceTagRules replaces every rule.
+	ReplaceTagRules(rules map[string]string) error
+}
+
+// An EditStore keeps what goes along with the tabs being edited: their edit
+// locks, the versions of their collaborative editing rooms, and their
+// previous content, which deltas are made from.
+type EditStore interface {
+	// EditLock returns the lock of the tab with the given ID. The second
+	// return value is false if it isn't locked.
+	EditLock(id string) (*editLock, bool, error)
+
+	// PutEditLock locks the tab with the given ID until the duration has
+	// passed, and DeleteEditLock unlocks it.
+	PutEditLock(id string, lock *editLock, duration time.Duration) error
+	DeleteEditLock(id string) error
+
+	// CollabVersion returns the version of the room of the tab with the
+	// given ID when it was last saved. The second return value is false if
+	// it has never been saved. SetCollabVersion changes it.
+	CollabVersion(id string) (int, bool, error)
+	SetCollabVersion(id string, version int) error
+
+	// KeepPreviousContent keeps some old content of the tab with the given
+	// ID, which has the given hash, until the duration has passed, and
+	// PreviousContent returns it. The second return value is false if it
+	// isn't being kept.
+	KeepPreviousContent(id, hash, content string, duration time.Duration) error
+	PreviousContent(id, hash string) (string, bool, error)
+}
@@ -1,66 +1,284 @@
 package src
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"regexp"
 	"strings"
+	"time"
 )
 
 // A Tab represents a tab from the database.
 type Tab struct {
-	Title    string   `json:"title"`
-	Artist   string   `json:"artist"`
-	Content  string   `json:"content"`
-	ID       string   `json:"ID"`
+	Title   string `json:"title"`
+	Artist  string `json:"artist"`
+	Content string `json:"content"`
+	ID      string `json:"id"`
+
+	// Binary is whether the tab's file is in a binary format, such as a
+	// Guitar Pro file, rather than text, and Format is which one, as
+	// described in binary.go. A binary tab has no content, so its file is
+	// downloaded instead.
+	Binary bool   `json:"binary"`
+	Format string `json:"format"`
+
+	// Filename is the path to the tab's file relative to the tab directory,
+	// using '/' to separate any folders it's in.
 	Filename string   `json:"filename"`
 	Tags     []string `json:"tags"`
+
+	// Pattern is the filename pattern which the filename was parsed with,
+	// which is the first one in the settings that it matched.
+	Pattern string `json:"pattern"`
+
+	// Language is the ISO 639-1 code of the language of the tab's lyrics,
+	// such as "es", or empty if it couldn't be detected.
+	Language string `json:"language"`
+
+	// Explicit is whether the tab's lyrics are explicit. It is detected from
+	// the lyrics, unless ExplicitOverride has been set by the admin to
+	// "explicit" or "clean".
+	Explicit         bool   `json:"explicit"`
+	ExplicitOverride string `json:"-"`
+
+	// Tuning and Capo are the tuning and the capo's fret which the tab's
+	// content says to use, as described in tuning.go. They are empty and 0 if
+	// it doesn't say. The admin's practice metadata takes precedence.
+	Tuning string `json:"tuning"`
+	Capo   int    `json:"capo"`
+
+	// Instruments are the names of the parts of a MusicXML score, such as
+	// "Classical Guitar", as described in musicxml.go. Other tabs don't
+	// have any.
+	Instruments []string `json:"instruments"`
+
+	// Chords are the distinct chords which the tab's content uses, such as
+	// "Em7" and "D/F#", in the order they first appear, as described in
+	// chords.go.
+	Chords []string `json:"chords"`
+
+	// Source says where the tab came from. It is set when the tab is first
+	// cached, and kept when its file is read again.
+	Source TabSource `json:"source"`
+
+	// Practice holds the details which help with playing the tab, such as
+	// its capo and tempo, which are set by the admin and kept when its file
+	// is read again.
+	Practice TabPractice `json:"practice"`
+
+	// Added is when the tab was added to the collection, which is taken
+	// to be the modification time of its file when it was first cached.
+	Added time.Time `json:"added"`
+
+	// Modified is the modification time of the tab's file when it was last
+	// read, and ContentHash is the SHA-256 hash of its content at that time.
+	// They are used to tell when the file has been edited, and clients can
+	// use the hash to tell whether the content they already have is current.
+	Modified    time.Time `json:"-"`
+	ContentHash string    `json:"contentHash"`
+
+	// IsFavourite is whether whoever asked for the tab has starred it. It
+	// isn't stored with the tab, but set on each response.
+	IsFavourite bool `json:"isFavourite"`
+}
+
+// HashContent computes the SHA-256 hash of a file's content, in hexadecimal,
+// which is the content hash of a tab with that content.
+func HashContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// A patternToken is one piece of a filename pattern. It is either
+// a variable, such as "[title]", a piece of literal text which the
+// filename must contain, or an optional group of other tokens,
+// which a filename can either match or leave out entirely.
+type patternToken struct {
+	// text is the variable, including its square brackets, or the
+	// literal text. It is empty for an optional group.
+	text     string
+	variable bool
+
+	// optional holds the tokens in an optional group.
+	optional []patternToken
+}
+
+// A filenamePattern is one of the filename patterns from the
+// settings, along with the matcher it was compiled into.
+type filenamePattern struct {
+	pattern string
+	matcher *patternMatcher
+}
+
+// tokenizePatterns compiles each of the filename patterns from
+// the settings, keeping them in the same order, which is the order
+// they are tried in.
+func tokenizePatterns(patterns []string) []filenamePattern {
+	tokenized := make([]filenamePattern, len(patterns))
+
+	for i, pattern := range patterns {
+		tokenized[i] = filenamePattern{
+			pattern: pattern,
+			matcher: compilePattern(tokenizePattern(pattern)),
+		}
+	}
+
+	return tokenized
+}
+
+// A patternCapture is the part of a filename which was matched by
+// one of the variables in its pattern.
+type patternCapture struct {
+	variable string
+	value    string
 }
 
 // tokenizePattern takes a string representing a filename pattern
 // and returns a list of its tokens, which can be given to the
 // parser to be parsed into the set of metadata of that particular
 // file.
-func tokenizePattern(pattern string) []string {
+//
+// As well as variables in square brackets, a pattern can contain
+// optional groups, written as "( ... )?", which a filename can
+// leave out. For example, "[artist] - [title]( \[[tag]\])?" matches
+// filenames both with and without a tag on the end. A backslash
+// makes the character after it literal if it is one of the
+// characters which mean something in a pattern, which are listed
+// in patternSpecial, so "\[" matches a real square bracket. Before
+// any other character, a backslash is just literal text, as it was
+// before patterns had escapes. A bracket which isn't part of a
+// variable or group, like the ones in "[title] (live)", is literal
+// text too.
+func tokenizePattern(pattern string) []patternToken {
+	tokens, _, _ := tokenizeGroup(lexPattern(pattern), 0, false)
+	return tokens
+}
+
+// patternSpecial holds the characters which mean something in a
+// filename pattern, and which a backslash makes literal.
+const patternSpecial = `\[]()?`
+
+// A patternRune is one of the characters of a filename pattern,
+// with its backslash taken off if it was escaped.
+type patternRune struct {
+	character rune
+	escaped   bool
+}
+
+// is reports whether the character is the given special character,
+// rather than an escaped one.
+func (r patternRune) is(character rune) bool {
+	return r.character == character && !r.escaped
+}
+
+// lexPattern splits a filename pattern into its characters, taking
+// off the backslashes which escape the special ones, so that every
+// part of the tokenizer treats escapes in the same way.
+func lexPattern(pattern string) []patternRune {
 	var (
-		// Initialise the list of tokens as a zero-length slice of
-		// strings. It makes sense to initialise no memory to start
-		// because the amount of tokens is not known at this point.
-		tokens = make([]string, 0)
-
-		// Buffer is used to build up the tokens as the pattern is
-		// traversed, and will be appended to tokens frequently
-		// during the execution of the algorithm.
+		characters = []rune(pattern)
+		lexed      = make([]patternRune, 0, len(characters))
+	)
+
+	for i := 0; i < len(characters); i++ {
+		if characters[i] == '\\' && i+1 < len(characters) && strings.ContainsRune(patternSpecial, characters[i+1]) {
+			i++
+			lexed = append(lexed, patternRune{characters[i], true})
+			continue
+		}
+
+		lexed = append(lexed, patternRune{characters[i], false})
+	}
+
+	return lexed
+}
+
+// patternText returns the characters of a pattern as a string.
+func patternText(pattern []patternRune) string {
+	text := make([]rune, len(pattern))
+	for i, r := range pattern {
+		text[i] = r.character
+	}
+
+	return string(text)
+}
+
+// tokenizeGroup tokenizes the pattern from the index start. If
+// inGroup is true, it stops at the ")?" which closes the group,
+// and the last return value says whether it was found. The second
+// return value is the index just after the last character used.
+func tokenizeGroup(pattern []patternRune, start int, inGroup bool) ([]patternToken, int, bool) {
+	var (
+		tokens = make([]patternToken, 0)
+
+		// Buffer is used to build up the literal text between the
+		// variables and groups, which is added to the tokens once
+		// something else is found.
 		buffer = ""
 	)
 
-	// Iterate through each character in the pattern, not keeping
-	// track of the index however since that is useless.
-	for _, character := range pattern {
-		// If the character denotes the beginning or end of a
-		// variable, act accordingly. Otherwise, just append
-		// the character to the buffer.
-		switch character {
-		case '[':
-			tokens = append(tokens, buffer)
-			buffer = "["
-
-		case ']':
-			buffer += string(character)
-			tokens = append(tokens, buffer)
+	flush := func() {
+		if len(buffer) > 0 {
+			tokens = append(tokens, patternToken{text: buffer})
 			buffer = ""
+		}
+	}
+
+	for i := start; i < len(pattern); i++ {
+		character := pattern[i]
+
+		switch {
+		case character.is('['):
+			// A variable lasts until the next closing bracket. If
+			// there isn't one, the rest of the pattern is literal.
+			length := 0
+			for i+length < len(pattern) && !pattern[i+length].is(']') {
+				length++
+			}
+
+			if i+length == len(pattern) {
+				buffer += patternText(pattern[i:])
+				i = len(pattern)
+				continue
+			}
+
+			flush()
+			tokens = append(tokens, patternToken{
+				text:     patternText(pattern[i : i+length+1]),
+				variable: true,
+			})
+			i += length
+
+		case character.is('('):
+			// This only starts a group if it's closed by ")?".
+			// Otherwise, the bracket is just literal text.
+			group, end, closed := tokenizeGroup(pattern, i+1, true)
+			if !closed {
+				buffer += string(character.character)
+				continue
+			}
+
+			flush()
+			if len(group) > 0 {
+				tokens = append(tokens, patternToken{optional: group})
+			}
+			i = end - 1
+
+		case character.is(')') && inGroup && i+1 < len(pattern) && pattern[i+1].is('?'):
+			flush()
+			return tokens, i + 2, true
 
 		default:
-			buffer += string(character)
+			buffer += string(character.character)
 		}
 	}
 
-	// If the buffer is non-empty, append it to tokens. This
-	// means that the piece of text at the end of the filename
-	// will still be tokenized.
-	if len(buffer) > 0 {
-		tokens = append(tokens, buffer)
-	}
+	// Make sure the piece of text at the end of the pattern is
+	// still tokenized.
+	flush()
 
-	return tokens
+	return tokens, len(pattern), false
 }
 
 // parseFilename parses a filename using the given tokens (which
@@ -71,7 +289,7 @@ func tokenizePattern(pattern string) []string {
 // will be equal to false.
 func parseFilename(
 	filename string,
-	tokens []string,
+	matcher *patternMatcher,
 ) (
 	title,
 	artist string,
@@ -84,91 +302,252 @@ func parseFilename(
 	artist = "Unnamed"
 	tags = make([]string, 0)
 
-	// Set ok to true, since it will only be false in one case
-	// and that case can set ok to false when it needs to.
-	ok = true
-
-	for index, token := range tokens {
-		// If the current token denotes a variable:
-		if isVariable(token) {
-			var (
-				// stop keeps track of the character which this
-				// token should stop parsing at.
-				stop byte
-
-				// buffer keeps track of the value of the
-				// variable being parsed.
-				buffer string
-			)
-
-			// If the next token is not a variable, set stop to
-			// the first character of that token.
-			if index+1 < len(tokens) && !isVariable(tokens[index+1]) {
-				stop = tokens[index+1][0]
-			}
+	// A match which uses up the whole filename is preferred, but
+	// if there isn't one, any text after the end of the pattern is
+	// ignored.
+	captures, ok := matcher.match(filename, true)
+	if !ok {
+		captures, ok = matcher.match(filename, false)
+	}
+
+	if !ok {
+		return
+	}
 
-			// While the filename is non-empty and its first
-			// character is not equal to 'stop'.
-			for len(filename) > 0 && filename[0] != stop {
-				// Append the first character of filename to
-				// the buffer.
-				buffer += string(filename[0])
-
-				// Remove the first character from filename
-				if len(filename) == 1 {
-					filename = ""
-				} else {
-					filename = filename[1:]
+	for _, capture := range captures {
+		// If the variable is a valid variable name, assign the
+		// captured value to the appropriate variable.
+		switch capture.variable {
+		case "[title]":
+			title = capture.value
+		case "[artist]":
+			artist = capture.value
+		case "[tag]":
+			tags = append(tags, capture.value)
+		default:
+			// A tag list variable holds any number of tags,
+			// separated by its delimiter.
+			if delimiter, isList := tagListDelimiter(capture.variable); isList {
+				for _, tag := range strings.Split(capture.value, delimiter) {
+					if tag = strings.TrimSpace(tag); tag != "" {
+						tags = addTags(tags, []string{tag})
+					}
 				}
 			}
+		}
+	}
+
+	return
+}
+
+// A patternMatcher matches filenames against the tokens of a
+// pattern. The pattern is compiled into regular expressions, which
+// take time in proportion to the length of the filename however
+// many variables the pattern has, rather than trying every way of
+// splitting the filename between them.
+//
+// A variable followed by some literal text matches as little as it
+// can, as long as the rest of the pattern can still match, so that
+// "[artist] - [title]" splits "The Band - Song" at the " - ". A
+// variable at the end of the pattern, or followed by another
+// variable, matches as much as it can. An optional group is matched
+// if possible, and left out otherwise.
+type patternMatcher struct {
+	// whole has to match the whole filename, while prefix only has
+	// to match the start of it. Either of them is nil if the pattern
+	// couldn't be compiled, in which case it matches nothing.
+	whole, prefix *regexp.Regexp
+
+	// variables holds the variable which each of the regular
+	// expressions' groups captures, in the order of the groups.
+	variables []string
+}
+
+// maxPatternGroups is the most optional groups which a pattern can
+// have, since each one doubles the ways of using or leaving them
+// out. A pattern with more is refused when the settings are
+// checked, and only the first maxPatternAlternatives ways are tried,
+// with the ones which use the groups first.
+const (
+	maxPatternGroups       = 6
+	maxPatternAlternatives = 1 << maxPatternGroups
+)
 
-			// If the current token is a valid variable name, assign
-			// the buffer's value to the appropriate variable.
-			switch token {
-			case "[title]":
-				title = buffer
-			case "[artist]":
-				artist = buffer
-			case "[tag]":
-				tags = append(tags, buffer)
+// compilePattern compiles the tokens of a pattern into a matcher.
+// Each way of using or leaving out the optional groups becomes one
+// alternative of the regular expressions, in the order they are
+// preferred in, so that the first one which matches is used.
+func compilePattern(tokens []patternToken) *patternMatcher {
+	var (
+		matcher      = &patternMatcher{}
+		alternatives = expandGroups(tokens, maxPatternAlternatives)
+		expressions  = make([]string, len(alternatives))
+	)
+
+	for i, alternative := range alternatives {
+		var expression strings.Builder
+
+		for j, token := range alternative {
+			switch {
+			case !token.variable:
+				expression.WriteString(regexp.QuoteMeta(token.text))
+			case j+1 < len(alternative) && !alternative[j+1].variable:
+				expression.WriteString("(.*?)")
+			default:
+				expression.WriteString("(.*)")
 			}
-		} else {
-			if strings.HasPrefix(filename, token) {
-				// In this case, filename begins with the correct
-				// characters such that it matches the pattern. The
-				// token is removed from the start of the filename
-				// and the function carries on iterating.
-				filename = filename[len(token):]
-			} else {
-				// In this case, the filename doesn't match the
-				// pattern so the function is returned from with
-				// ok = false.
-				ok = false
-				return
+
+			if token.variable {
+				matcher.variables = append(matcher.variables, token.text)
 			}
 		}
+
+		expressions[i] = expression.String()
 	}
 
-	return
+	whole, err := regexp.Compile(`^(?s:` + strings.Join(expressions, `$|`) + `$)`)
+	if err != nil {
+		return matcher
+	}
+
+	prefix, err := regexp.Compile(`^(?s:` + strings.Join(expressions, `|`) + `)`)
+	if err != nil {
+		return matcher
+	}
+
+	matcher.whole, matcher.prefix = whole, prefix
+	return matcher
+}
+
+// expandGroups returns each way of using or leaving out the
+// optional groups in the tokens, up to the given number of them,
+// with the ones which use each group before the ones which don't.
+func expandGroups(tokens []patternToken, limit int) [][]patternToken {
+	if limit <= 0 {
+		return nil
+	}
+
+	for i, token := range tokens {
+		if len(token.optional) == 0 {
+			continue
+		}
+
+		var (
+			head     = tokens[:i]
+			rest     = tokens[i+1:]
+			expanded [][]patternToken
+		)
+
+		for _, tail := range [][]patternToken{joinTokens(token.optional, rest), rest} {
+			for _, alternative := range expandGroups(tail, limit-len(expanded)) {
+				expanded = append(expanded, joinTokens(head, alternative))
+			}
+		}
+
+		return expanded
+	}
+
+	return [][]patternToken{tokens}
+}
+
+// joinTokens joins lists of tokens into a new list.
+func joinTokens(lists ...[]patternToken) []patternToken {
+	tokens := make([]patternToken, 0)
+	for _, list := range lists {
+		tokens = append(tokens, list...)
+	}
+
+	return tokens
+}
+
+// match matches a filename against the pattern, returning what each
+// of the variables matched, in order. If whole is true, the pattern
+// has to match the whole filename rather than just the start of it.
+func (m *patternMatcher) match(filename string, whole bool) ([]patternCapture, bool) {
+	expression := m.prefix
+	if whole {
+		expression = m.whole
+	}
+
+	if expression == nil {
+		return nil, false
+	}
+
+	indexes := expression.FindStringSubmatchIndex(filename)
+	if indexes == nil {
+		return nil, false
+	}
+
+	// Only the groups of the alternative which matched have captured
+	// anything, and the others are left out.
+	captures := make([]patternCapture, 0)
+	for i, variable := range m.variables {
+		if start, end := indexes[2*i+2], indexes[2*i+3]; start >= 0 {
+			captures = append(captures, patternCapture{variable, filename[start:end]})
+		}
+	}
+
+	return captures, true
 }
 
-// isVariable checks whether a string, str, begins and ends
-// with square brackets.
-func isVariable(str string) bool {
-	return len(str) > 1 && str[0] == '[' && str[len(str)-1] == ']'
+// defaultTagDelimiter separates the tags in a [tags] variable
+// which doesn't give its own delimiter.
+const defaultTagDelimiter = ","
+
+// tagListDelimiter checks whether a variable token is a tag list,
+// such as "[tags:, ]", which captures a list of tags separated by
+// the delimiter after the colon (in this case ", "). A plain
+// "[tags]" uses defaultTagDelimiter. If the token is a tag list,
+// its delimiter is returned, and the second return value is true.
+func tagListDelimiter(token string) (string, bool) {
+	name := token[1 : len(token)-1]
+
+	switch {
+	case name == "tags":
+		return defaultTagDelimiter, true
+	case strings.HasPrefix(name, "tags:") && len(name) > len("tags:"):
+		return name[len("tags:"):], true
+	}
+
+	return "", false
+}
+
+// addTags appends each of the new tags to tags, unless it is
+// already there, and returns the result.
+func addTags(tags, newTags []string) []string {
+outerLoop:
+	for _, tag := range newTags {
+		for _, existing := range tags {
+			if existing == tag {
+				continue outerLoop
+			}
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return tags
 }
 
 // removeCharacters removes the specified characters from the
 // tab's title and artist name.
 func (t *Tab) removeCharacters(chars string) {
+	t.Title = removeCharacters(t.Title, chars)
+	t.Artist = removeCharacters(t.Artist, chars)
+}
+
+// removeCharacters replaces each of the specified characters in
+// str with a space.
+func removeCharacters(str, chars string) string {
 	for _, character := range chars {
 		// Replace all instances of the current character with a
 		// space. The -1 signifies that infinitely many replacements
 		// can take place (as opposed to, if I gave a number like 5,
 		// a maximum of 5 replacements could happen.)
-		t.Title = strings.Replace(t.Title, string(character), " ", -1)
-		t.Artist = strings.Replace(t.Artist, string(character), " ", -1)
+		str = strings.Replace(str, string(character), " ", -1)
 	}
+
+	return str
 }
 
 // capitaliseString capitalises the first letter of each word except
@@ -212,6 +591,12 @@ func capitaliseString(str string, blacklist []string) string {
 		}
 	}
 
+	// If there weren't any words, there is no leading space to remove so
+	// the empty output can be returned as it is.
+	if output == "" {
+		return output
+	}
+
 	// Return all but the first character of the output string, which will
 	// exclude the leading space generated due to the method of joining
 	// the words by spaces.
@@ -221,111 +606,173 @@ func capitaliseString(str string, blacklist []string) string {
 // applyTransformations applies both metadata transformations to the tab.
 // characterCutset is the string containing the characters to be removed
 // from the metadata, and then capitalisationBlacklist contains the words
-// which should not be capitalised.
+// which should not be capitalised. Titles in languages which don't use
+// title case only have their first word capitalised, but artists' names
+// are always capitalised fully since they are names.
 func (t *Tab) applyTransformations(characterCutset string, capitalisationBlacklist []string) {
 	t.removeCharacters(characterCutset)
-	t.Title = capitaliseString(t.Title, capitalisationBlacklist)
 	t.Artist = capitaliseString(t.Artist, capitalisationBlacklist)
+
+	if sentenceCaseLanguages[t.Language] {
+		t.Title = sentenceCase(t.Title)
+	} else {
+		t.Title = capitaliseString(t.Title, capitalisationBlacklist)
+	}
 }
 
-// fetchTab finds the tab corresponding to the given ID in the database
-// and constructs a *Tab value to hold the information about that tab.
-// If the tab does not exist, the second return parameter will be false,
-// otherwise it will be true. Transformations will not be applied
-func (s *Server) fetchTab(id string) (*Tab, bool, error) {
-	// Compute the value of the tab's database key.
-	key := "tab:" + id
-
-	// Check whether the tab actually exists, by checking if it is a
-	// member of the 'tabs' set (recall that 'tabs' is a set containing
-	// the IDs of all tabs).
-	exists, err := s.Database.SIsMember("tabs", id).Result()
-	if err != nil {
-		return nil, false, err
-	} else if !exists {
-		return nil, false, nil
+// transformString applies both metadata transformations to a single
+// piece of metadata, such as an artist's name or a tag on its own.
+func transformString(str, characterCutset string, capitalisationBlacklist []string) string {
+	return capitaliseString(removeCharacters(str, characterCutset), capitalisationBlacklist)
+}
+
+// cacheNewTab stores a tab into the database, setting its ID to the next
+// available ID, on behalf of the given actor. It will return an error if
+// there is a problem with communicating with the database.
+func (s *Server) cacheNewTab(tab *Tab, by actor) error {
+	// Note where the tab came from, unless it is already known.
+	if tab.Source.Kind == "" {
+		tab.Source.Kind = sourceKind(by)
 	}
 
-	// Use the HGETALL Redis command to get all key-value pairs from
-	// the tab's hashmap. This will get all of the relavent data, except
-	// for the tags, which are stored in a separate key in the database
-	// and will have to be fetched separately.
-	data, err := s.Database.HGetAll(key).Result()
-	if err != nil {
-		return nil, false, err
+	// Store the tab, which gives it its ID.
+	if err := s.Store.PutTab(tab); err != nil {
+		return err
 	}
 
-	// Use the SMEMBERS Redis command to get a list of tags of the tab.
-	tags, err := s.Database.SMembers(key + ":tags").Result()
-	if err != nil {
-		return nil, false, err
+	// Count the new tab in the collection's statistics.
+	if err := s.recordStats(tab, 1); err != nil {
+		return err
+	}
+
+	// Make the tab searchable, and listed under its artist and tags.
+	if err := s.indexTab(tab); err != nil {
+		return err
+	}
+
+	if err := s.addToBrowseIndex(tab); err != nil {
+		return err
+	}
+
+	// Link the songs on the wishlist which the tab is for to it.
+	if err := s.fulfilSongRequests(tab, by); err != nil {
+		return err
+	}
+
+	// Finally, note that the collection has changed.
+	if err := s.bumpCollectionVersion(); err != nil {
+		return err
 	}
 
-	// Create the tab to return.
-	tab := &Tab{
-		ID:       data["id"],
-		Artist:   data["artist"],
-		Content:  data["content"],
-		Title:    data["title"],
-		Filename: data["filename"],
-		Tags:     tags,
+	s.publishEvent(eventTabAdded, by, tabEventData(tab))
+	s.queueHook(hookPostIngest, map[string]interface{}{
+		"event": eventTabAdded,
+		"actor": s.record(by),
+		"tab":   tabEventData(tab),
+	})
+
+	return nil
+}
+
+// bumpCollectionVersion increments the collection version, which is a
+// counter in the database that changes whenever anything about the tabs
+// changes, so clients can tell whether their copy is out of date. The tabs
+// kept in memory are out of date too, so they are marked as such, and the
+// manifest is written again.
+func (s *Server) bumpCollectionVersion() error {
+	s.forgetTabs()
+	s.noteManifestChanged()
+
+	if err := s.Store.BumpCollectionVersion(); err != nil {
+		return err
 	}
 
-	return tab, true, nil
+	return s.noteCollectionModified()
 }
 
-// cacheNewTab stores a tab into the database, setting its ID to the next
-// available ID. It will return an error if there is a problem with
-// communicating with the database.
-func (s *Server) cacheNewTab(tab *Tab) error {
-	// Increment the tab-counter in the database, using the new value
-	// as the ID.
-	id, err := s.Database.Incr("tab-counter").Result()
+// updateCachedTab replaces the data of the already cached tab with the given
+// ID with the data in tab, which will usually have just been re-read from its
+// file. The tab keeps its ID and the date it was added, so clients which
+// refer to it by ID won't notice anything other than the new data. The change
+// is recorded as being made by the given actor.
+func (s *Server) updateCachedTab(id string, tab *Tab, by actor) error {
+	old, ok, err := s.Store.GetTab(id)
 	if err != nil {
 		return err
+	} else if !ok {
+		return fmt.Errorf("no tab with the ID %s", id)
 	}
 
-	// Set the tab's ID to the ID from the database, converted to a
-	// string first.
-	tab.ID = fmt.Sprintf("%v", id)
+	tab.ID = old.ID
+	tab.Added = old.Added
+	tab.Source = old.Source
+	tab.Practice = old.Practice
 
-	// Append the ID to the tabs set.
-	if err := s.Database.SAdd("tabs", id).Err(); err != nil {
+	// Tags which were added to the tab by merging another tab into it aren't
+	// in its filename, so they have to be added back in.
+	extraTags, err := s.Store.ExtraTags(id)
+	if err != nil {
 		return err
 	}
 
-	// Add the filename-ID mapping to the filenames hashmap.
-	if err := s.Database.HSet("filenames", tab.Filename, id).Err(); err != nil {
+	tab.Tags = addTags(tab.Tags, extraTags)
+
+	// Keep the old content for a while, so that clients which have it can
+	// just download what changed.
+	if old.ContentHash != tab.ContentHash {
+		if err := s.keepPreviousContent(old); err != nil {
+			return err
+		}
+	}
+
+	// Take the old version of the tab out of the statistics, so that the new
+	// version can be counted instead once it has been stored.
+	if err := s.recordStats(old, -1); err != nil {
 		return err
 	}
 
-	// Create the tab's data hashmap, in the tab:ID key.
-	if err := s.Database.HMSet(fmt.Sprintf("tab:%v", id), map[string]interface{}{
-		"title":    tab.Title,
-		"artist":   tab.Artist,
-		"content":  tab.Content,
-		"id":       id,
-		"filename": tab.Filename,
-	}).Err(); err != nil {
+	// Store the new version of the tab, which also moves the filename-ID
+	// mapping over if the file has been renamed, and replaces its tags.
+	if err := s.Store.PutTab(tab); err != nil {
 		return err
 	}
 
-	// Construct a list of type []interface{} to hold the list of tags,
-	// since the SADD command requires the data to be in that format.
-	// This is done simply by casting each element into the interface{}
-	// type and then putting them in the correct positions in the new list.
-	tags := make([]interface{}, len(tab.Tags))
+	// The admin's explicit override is kept, since it was about the tab
+	// rather than about this version of its file.
+	tab.ExplicitOverride = old.ExplicitOverride
+	tab.applyExplicitOverride()
 
-	for i, tag := range tab.Tags {
-		tags[i] = interface{}(tag)
+	if err := s.recordStats(tab, 1); err != nil {
+		return err
 	}
 
-	if len(tags) > 0 {
-		// Create the tab's tag set, in the tab:ID:tags key.
-		if err := s.Database.SAdd(fmt.Sprintf("tab:%v:tags", id), tags...).Err(); err != nil {
-			return err
-		}
+	// Index the new version of the tab in place of the old one.
+	if err := s.unindexTab(id); err != nil {
+		return err
+	}
+
+	if err := s.indexTab(tab); err != nil {
+		return err
 	}
 
+	if err := s.removeFromBrowseIndex(old); err != nil {
+		return err
+	}
+
+	if err := s.addToBrowseIndex(tab); err != nil {
+		return err
+	}
+
+	if err := s.bumpCollectionVersion(); err != nil {
+		return err
+	}
+
+	s.publishEvent(eventTabUpdated, by, tabEventData(tab))
+	s.queueHook(hookPostIngest, map[string]interface{}{
+		"event": eventTabUpdated,
+		"actor": s.record(by),
+		"tab":   tabEventData(tab),
+	})
+
 	return nil
 }
@@ -0,0 +1,59 @@
+package src
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFilenameEscapes(t *testing.T) {
+	cases := []struct {
+		pattern, filename string
+		title, artist     string
+		tags              []string
+	}{
+		// Escaped brackets are literal, inside a group or not.
+		{`[artist] - [title]( \[[tag]\])?`, "Abba - SOS [live]", "SOS", "Abba", []string{"live"}},
+		{`[artist] - [title]( \[[tag]\])?`, "Abba - SOS", "SOS", "Abba", []string{}},
+		{`[artist] - [title] \(live\)?`, "Abba - SOS (live)?", "SOS", "Abba", []string{}},
+		{`\[[tag]\] [artist] - [title]`, "[demo] Abba - SOS", "SOS", "Abba", []string{"demo"}},
+
+		// An escaped backslash is a single literal one.
+		{`[artist]\\[title]`, `Abba\SOS`, "SOS", "Abba", []string{}},
+
+		// A backslash before anything else is just text, as it was
+		// before patterns had escapes.
+		{`[artist] \- [title]`, `Abba \- SOS`, "SOS", "Abba", []string{}},
+
+		// Escapes mean the same in text after a bracket which is never
+		// closed as they do anywhere else.
+		{`[title] - [artist \(demo\)`, "SOS - [artist (demo)", "SOS", "Unnamed", []string{}},
+
+		// An escaped closing bracket doesn't end a variable or a group.
+		{`[title]( \)?[tag])?`, "SOS )?live", "SOS", "Unnamed", []string{"live"}},
+	}
+
+	for _, c := range cases {
+		title, artist, tags, ok := parseFilename(c.filename, compilePattern(tokenizePattern(c.pattern)))
+		if !ok || title != c.title || artist != c.artist || !reflect.DeepEqual(tags, c.tags) {
+			t.Errorf("%s on %q: got %q, %q, %v (%v)", c.pattern, c.filename, title, artist, tags, ok)
+		}
+	}
+}
+
+func TestMatchPatternManyVariables(t *testing.T) {
+	// Trying every way of splitting the filename between the variables
+	// would take far too long for this to ever finish.
+	pattern := strings.Repeat("[tag] ", 20) + "[title]!"
+	filename := strings.Repeat("a ", 200)
+
+	start := time.Now()
+	if _, ok := compilePattern(tokenizePattern(pattern)).match(filename, true); ok {
+		t.Error("expected the filename not to match")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected matching to be quick, took %s", elapsed)
+	}
+}
@@ -0,0 +1,115 @@
+package tabtest
+
+import (
+	"github.com/Zac-Garby/tab-server/src"
+)
+
+// Password is the admin password of the settings built by a SettingsBuilder,
+// unless it is told otherwise, so that tests can log in.
+const Password = "password"
+
+// A SettingsBuilder builds a set of settings, one at a time, in the same way
+// as a TabBuilder builds a tab.
+type SettingsBuilder struct {
+	settings src.Settings
+}
+
+// NewSettings starts building a set of settings from the ones a fresh install
+// starts off with, except that the admin password is Password rather than a
+// random one, and the list of tabs isn't kept in memory, so that changes to
+// the store show up straight away.
+func NewSettings() *SettingsBuilder {
+	settings := *src.DefaultSettings()
+	settings.PasswordHash = src.HashPassword(Password)
+	settings.TabCacheTTL = 0
+
+	return &SettingsBuilder{settings: settings}
+}
+
+// Password sets the admin password.
+func (b *SettingsBuilder) Password(password string) *SettingsBuilder {
+	b.settings.PasswordHash = src.HashPassword(password)
+	return b
+}
+
+// TabDirectory sets the directory to look for tabs in.
+func (b *SettingsBuilder) TabDirectory(directory string) *SettingsBuilder {
+	b.settings.TabDirectory = directory
+	return b
+}
+
+// FilenamePatterns sets the patterns to parse the tabs' filenames with.
+func (b *SettingsBuilder) FilenamePatterns(patterns ...string) *SettingsBuilder {
+	b.settings.FilenamePatterns = append([]string{}, patterns...)
+	return b
+}
+
+// NonCapitalWords sets the words which aren't capitalised in metadata.
+func (b *SettingsBuilder) NonCapitalWords(words ...string) *SettingsBuilder {
+	b.settings.NonCapitalWords = append([]string{}, words...)
+	return b
+}
+
+// CharactersToRemove sets the characters which are removed from metadata.
+func (b *SettingsBuilder) CharactersToRemove(characters string) *SettingsBuilder {
+	b.settings.CharactersToRemove = characters
+	return b
+}
+
+// ScanDepth sets how many levels of folders inside the tab directory are
+// looked in for tabs.
+func (b *SettingsBuilder) ScanDepth(depth int) *SettingsBuilder {
+	b.settings.ScanDepth = depth
+	return b
+}
+
+// FolderMetadata sets how the names of the folders which a tab is in are
+// used, which is "tags", "artist" or empty for not at all.
+func (b *SettingsBuilder) FolderMetadata(mode string) *SettingsBuilder {
+	b.settings.FolderMetadata = mode
+	return b
+}
+
+// IgnorePatterns sets the glob patterns for the files and folders in the tab
+// directory which aren't tabs.
+func (b *SettingsBuilder) IgnorePatterns(patterns ...string) *SettingsBuilder {
+	b.settings.IgnorePatterns = append([]string{}, patterns...)
+	return b
+}
+
+// HideExplicit sets whether explicit tabs are hidden from everyone except the
+// admin.
+func (b *SettingsBuilder) HideExplicit(hide bool) *SettingsBuilder {
+	b.settings.HideExplicit = hide
+	return b
+}
+
+// TabCacheTTL sets how many seconds the list of tabs is kept in memory for.
+func (b *SettingsBuilder) TabCacheTTL(seconds int) *SettingsBuilder {
+	b.settings.TabCacheTTL = seconds
+	return b
+}
+
+// TransformScript sets the Lua script which is run on each tab as it is read.
+func (b *SettingsBuilder) TransformScript(script string) *SettingsBuilder {
+	b.settings.TransformScript = script
+	return b
+}
+
+// TrashDays sets how many days deleted tabs are kept in the trash for, or 0
+// for them to be deleted straight away.
+func (b *SettingsBuilder) TrashDays(days int) *SettingsBuilder {
+	b.settings.TrashDays = days
+	return b
+}
+
+// Build returns the settings which have been built. The builder can carry on
+// being used to build more settings without changing these ones.
+func (b *SettingsBuilder) Build() *src.Settings {
+	settings := b.settings
+	settings.FilenamePatterns = append([]string{}, b.settings.FilenamePatterns...)
+	settings.NonCapitalWords = append([]string{}, b.settings.NonCapitalWords...)
+	settings.IgnorePatterns = append([]string{}, b.settings.IgnorePatterns...)
+
+	return &settings
+}
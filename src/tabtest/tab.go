@@ -0,0 +1,139 @@
+package tabtest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Zac-Garby/tab-server/src"
+)
+
+// Time is the time which the tabs built by a TabBuilder were added and
+// modified at, unless it is told otherwise. It is fixed so that tests give the
+// same results every time they are run.
+var Time = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// A TabBuilder builds a tab, one field at a time. Each of its methods sets a
+// field and returns the builder, so that they can be chained, such as
+//
+//	tab := tabtest.NewTab("Queen", "Bohemian Rhapsody").Tags("rock").Build()
+type TabBuilder struct {
+	tab src.Tab
+}
+
+// NewTab starts building a tab with the given artist and title. Its filename
+// is the one which the default filename pattern, "[artist] - [title]", would
+// parse them from, it has no content, tags, chords or ID, it was found in the tab
+// directory, and it was added and modified at Time.
+func NewTab(artist, title string) *TabBuilder {
+	return &TabBuilder{tab: src.Tab{
+		Artist:   artist,
+		Title:    title,
+		Filename: fmt.Sprintf("%s - %s.txt", artist, title),
+		Pattern:  "[artist] - [title]",
+		Tags:     []string{},
+		Chords:   []string{},
+		Added:    Time,
+		Modified: Time,
+		Source:   src.TabSource{Kind: "scan"},
+	}}
+}
+
+// ID sets the tab's ID. If it isn't set, NewStore gives the tab the next
+// available one.
+func (b *TabBuilder) ID(id string) *TabBuilder {
+	b.tab.ID = id
+	return b
+}
+
+// Filename sets the tab's filename, relative to the tab directory.
+func (b *TabBuilder) Filename(filename string) *TabBuilder {
+	b.tab.Filename = filename
+	return b
+}
+
+// Pattern sets the filename pattern which the tab's filename was parsed with.
+func (b *TabBuilder) Pattern(pattern string) *TabBuilder {
+	b.tab.Pattern = pattern
+	return b
+}
+
+// Content sets the tab's content.
+func (b *TabBuilder) Content(content string) *TabBuilder {
+	b.tab.Content = content
+	return b
+}
+
+// Tags sets the tab's tags.
+func (b *TabBuilder) Tags(tags ...string) *TabBuilder {
+	b.tab.Tags = append([]string{}, tags...)
+	return b
+}
+
+// Language sets the ISO 639-1 code of the language of the tab's lyrics.
+func (b *TabBuilder) Language(language string) *TabBuilder {
+	b.tab.Language = language
+	return b
+}
+
+// Tuning sets the tuning and the capo's fret which the tab's content says to
+// use.
+func (b *TabBuilder) Tuning(tuning string, capo int) *TabBuilder {
+	b.tab.Tuning, b.tab.Capo = tuning, capo
+	return b
+}
+
+// Chords sets the chords which the tab's content uses.
+func (b *TabBuilder) Chords(chords ...string) *TabBuilder {
+	b.tab.Chords = append([]string{}, chords...)
+	return b
+}
+
+// Explicit sets whether the tab's lyrics were detected as explicit.
+func (b *TabBuilder) Explicit(explicit bool) *TabBuilder {
+	b.tab.Explicit = explicit
+	return b
+}
+
+// ExplicitOverride sets the admin's override of whether the tab is explicit,
+// which is "explicit", "clean" or empty for none.
+func (b *TabBuilder) ExplicitOverride(override string) *TabBuilder {
+	b.tab.ExplicitOverride = override
+	return b
+}
+
+// Source sets where the tab came from: its kind of source, such as "scan" or
+// "import", and the URL it was found at and its author, which can be empty.
+func (b *TabBuilder) Source(kind, url, author string) *TabBuilder {
+	b.tab.Source = src.TabSource{Kind: kind, URL: url, Author: author}
+	return b
+}
+
+// Practice sets the tab's practice metadata: the fret its capo goes on, its
+// tuning, its tempo in beats per minute and the notes on playing it.
+func (b *TabBuilder) Practice(capo int, tuning string, tempo int, notes string) *TabBuilder {
+	b.tab.Practice = src.TabPractice{Capo: capo, Tuning: tuning, Tempo: tempo, Notes: notes}
+	return b
+}
+
+// Added sets when the tab was added to the collection.
+func (b *TabBuilder) Added(added time.Time) *TabBuilder {
+	b.tab.Added = added
+	return b
+}
+
+// Modified sets the modification time of the tab's file.
+func (b *TabBuilder) Modified(modified time.Time) *TabBuilder {
+	b.tab.Modified = modified
+	return b
+}
+
+// Build returns the tab which has been built, with its content hash worked
+// out from its content in the same way as the server does. The builder can
+// carry on being used to build more tabs without changing this one.
+func (b *TabBuilder) Build() *src.Tab {
+	tab := b.tab
+	tab.Tags = append([]string{}, b.tab.Tags...)
+	tab.ContentHash = src.HashContent([]byte(tab.Content))
+
+	return &tab
+}
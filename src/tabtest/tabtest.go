@@ -0,0 +1,158 @@
+// Package tabtest provides things for testing code which uses the tab
+// server, such as code embedding it or clients of its API, without needing a
+// Redis database: a server which keeps everything in memory, a way to fill an
+// in-memory store with tabs, and builders for tabs and settings with sensible
+// defaults, so that a test only has to say what matters to it.
+package tabtest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Zac-Garby/tab-server/src"
+)
+
+// NewStore returns a MemoryStore with the given settings, holding the given
+// tabs. If settings is nil, the ones from NewSettings are used. Tabs without
+// an ID are given the next available one, which is set on the tab passed in,
+// and tabs with an ID keep it. If a tab can't be stored, such as when two
+// have the same ID, the test fails.
+func NewStore(tb testing.TB, settings *src.Settings, tabs ...*src.Tab) *src.MemoryStore {
+	tb.Helper()
+
+	if settings == nil {
+		settings = NewSettings().Build()
+	}
+
+	store := src.NewMemoryStore(settings)
+
+	for _, tab := range tabs {
+		var err error
+		if tab.ID == "" {
+			err = store.PutTab(tab)
+		} else {
+			err = store.RestoreTab(tab)
+		}
+
+		if err != nil {
+			tb.Fatalf("tabtest: could not store the tab %q: %v", tab.Filename, err)
+		}
+
+		// The store keeps the explicit override separately from the
+		// rest of the tab, so it has to be set on its own.
+		if tab.ExplicitOverride != "" {
+			if err := store.SetExplicitOverride(tab.ID, tab.ExplicitOverride); err != nil {
+				tb.Fatalf("tabtest: could not set the explicit override of the tab %q: %v", tab.Filename, err)
+			}
+		}
+	}
+
+	return store
+}
+
+// NewServer returns a Server which keeps everything in memory, as it does
+// with -store=memory, along with the handler which serves its requests, like
+// the one it listens with. Its store holds the given tabs, as with NewStore,
+// and its tab directory is a new temporary one, whatever the settings say,
+// holding each tab's content in its file, so that the server finds the files
+// it expects. Nothing it does in the background, such as watching the tab
+// directory, is started. If the server can't be set up, the test fails.
+func NewServer(tb testing.TB, settings *src.Settings, tabs ...*src.Tab) (*src.Server, http.Handler) {
+	tb.Helper()
+
+	if settings == nil {
+		settings = NewSettings().Build()
+	}
+
+	dir, err := ioutil.TempDir("", "tabtest")
+	if err != nil {
+		tb.Fatalf("tabtest: could not make the tab directory: %v", err)
+	}
+
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+
+	settings.TabDirectory = dir
+
+	for _, tab := range tabs {
+		path := filepath.Join(dir, filepath.FromSlash(tab.Filename))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatalf("tabtest: could not write the tab %q: %v", tab.Filename, err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(tab.Content), 0644); err != nil {
+			tb.Fatalf("tabtest: could not write the tab %q: %v", tab.Filename, err)
+		}
+
+		// The file's modification time is the tab's, so that the
+		// server doesn't think it has changed and read it again.
+		if err := os.Chtimes(path, tab.Modified, tab.Modified); err != nil {
+			tb.Fatalf("tabtest: could not write the tab %q: %v", tab.Filename, err)
+		}
+	}
+
+	s := &src.Server{
+		Store:   NewStore(tb, settings, tabs...),
+		Logging: src.LogConfig{Level: "none"},
+	}
+
+	tb.Cleanup(func() { s.Store.Close() })
+
+	if report, _ := s.CheckStartup(false); !report.OK() {
+		tb.Fatalf("tabtest: the server could not be set up:\n%s", report)
+	}
+
+	handler, err := s.Handler()
+	if err != nil {
+		tb.Fatalf("tabtest: the server could not be set up: %v", err)
+	}
+
+	return s, handler
+}
+
+// NewRequest returns a request to a server's handler with the given method
+// and target, from a browser with the given cookies, such as the ones from
+// LogIn. If form isn't nil, it is sent as the body, and the CSRF token from
+// the cookies is sent along with it, as the web app does.
+func NewRequest(method, target string, form url.Values, cookies []*http.Cookie) *http.Request {
+	var r *http.Request
+
+	if form != nil {
+		r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+
+		if cookie.Name == "csrf-token" && form != nil {
+			r.Header.Set("X-CSRF-Token", cookie.Value)
+		}
+	}
+
+	return r
+}
+
+// LogIn logs in to a server's handler with the given password, and returns
+// the cookies of the session, which requests made with NewRequest can send to
+// act as the admin. If it can't log in, the test fails.
+func LogIn(tb testing.TB, handler http.Handler, password string) []*http.Cookie {
+	tb.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, NewRequest("POST", "/api/v1/login", url.Values{"password": {password}}, nil))
+
+	if w.Code != http.StatusOK {
+		tb.Fatalf("tabtest: could not log in: %d %s", w.Code, w.Body)
+	}
+
+	return w.Result().Cookies()
+}
@@ -0,0 +1,152 @@
+package tabtest_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Zac-Garby/tab-server/src"
+	"github.com/Zac-Garby/tab-server/src/tabtest"
+)
+
+func TestNewTab(t *testing.T) {
+	tab := tabtest.NewTab("Abba", "Waterloo").Content("[C]My my").Build()
+
+	if tab.Filename != "Abba - Waterloo.txt" || tab.Pattern != "[artist] - [title]" {
+		t.Errorf("expected the filename the default pattern parses, got %q with %q", tab.Filename, tab.Pattern)
+	}
+
+	if !tab.Added.Equal(tabtest.Time) || !tab.Modified.Equal(tabtest.Time) {
+		t.Errorf("expected the tab to be added and modified at %s, got %s and %s", tabtest.Time, tab.Added, tab.Modified)
+	}
+
+	if tab.ContentHash != src.HashContent([]byte("[C]My my")) {
+		t.Errorf("expected the content hash to be worked out from the content, got %q", tab.ContentHash)
+	}
+}
+
+func TestTabBuilderReuse(t *testing.T) {
+	builder := tabtest.NewTab("Abba", "Waterloo").Tags("pop")
+
+	first := builder.Build()
+	second := builder.Tags("pop", "live").Modified(tabtest.Time.Add(time.Hour)).Build()
+
+	// Building another tab doesn't change the ones already built, even
+	// where they share a slice.
+	if !reflect.DeepEqual(first.Tags, []string{"pop"}) || !first.Modified.Equal(tabtest.Time) {
+		t.Errorf("expected the first tab to be left alone, got %v modified at %s", first.Tags, first.Modified)
+	}
+
+	if !reflect.DeepEqual(second.Tags, []string{"pop", "live"}) {
+		t.Errorf("expected the second tab's tags, got %v", second.Tags)
+	}
+
+	first.Tags[0] = "changed"
+	if second := builder.Build(); second.Tags[0] != "pop" {
+		t.Errorf("expected changing a built tab not to change the builder, got %v", second.Tags)
+	}
+}
+
+func TestSettingsBuilder(t *testing.T) {
+	builder := tabtest.NewSettings().IgnorePatterns("*.bak").TrashDays(30)
+
+	first := builder.Build()
+	second := builder.HideExplicit(true).IgnorePatterns("*.tmp").Build()
+
+	if first.HideExplicit || !reflect.DeepEqual(first.IgnorePatterns, []string{"*.bak"}) {
+		t.Errorf("expected the first settings to be left alone, got %+v", first)
+	}
+
+	if !second.HideExplicit || second.TrashDays != 30 || !reflect.DeepEqual(second.IgnorePatterns, []string{"*.tmp"}) {
+		t.Errorf("expected the second settings to have every change, got %+v", second)
+	}
+
+	if first.PasswordHash != src.HashPassword(tabtest.Password) {
+		t.Error("expected the password to be tabtest.Password")
+	}
+
+	if first.TabCacheTTL != 0 {
+		t.Errorf("expected the tabs not to be kept in memory, got a TTL of %d", first.TabCacheTTL)
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	store := tabtest.NewStore(t, nil,
+		tabtest.NewTab("Abba", "Waterloo").ID("7").Build(),
+		tabtest.NewTab("Abba", "SOS").ExplicitOverride("clean").Build(),
+	)
+
+	ids, err := store.ListIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 2 {
+		t.Fatalf("expected two tabs, got %v", ids)
+	}
+
+	if tab, ok, err := store.GetTab("7"); err != nil || !ok || tab.Title != "Waterloo" {
+		t.Errorf("expected the tab with an ID to keep it, got %v, %v, %v", tab, ok, err)
+	}
+
+	for _, id := range ids {
+		tab, _, err := store.GetTab(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tab.Title == "SOS" && tab.ExplicitOverride != "clean" {
+			t.Errorf("expected the explicit override to be stored, got %q", tab.ExplicitOverride)
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	s, handler := tabtest.NewServer(t, tabtest.NewSettings().TabDirectory("/does/not/exist").Build(),
+		tabtest.NewTab("Abba", "Waterloo").Filename("abba/waterloo.txt").Content("[C]My my").Build(),
+	)
+
+	// The tab directory is always a temporary one, holding the tabs'
+	// files.
+	if s.Settings.TabDirectory == "/does/not/exist" {
+		t.Fatal("expected a temporary tab directory")
+	}
+
+	path := filepath.Join(s.Settings.TabDirectory, "abba", "waterloo.txt")
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil || string(content) != "[C]My my" {
+		t.Errorf("expected the tab's content in its file, got %q, %v", content, err)
+	}
+
+	if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(tabtest.Time) {
+		t.Errorf("expected the file to be modified at the tab's time, got %v", err)
+	}
+
+	if cookies := tabtest.LogIn(t, handler, tabtest.Password); len(cookies) == 0 {
+		t.Error("expected logging in to give the session's cookies")
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	cookies := []*http.Cookie{{Name: "csrf-token", Value: "token"}, {Name: "session", Value: "session"}}
+
+	// The CSRF token is only sent along with a form, as the web app does.
+	if r := tabtest.NewRequest("GET", "/api/v1/tabs", nil, cookies); r.Header.Get("X-CSRF-Token") != "" || len(r.Cookies()) != 2 {
+		t.Errorf("expected only the cookies to be sent, got %v", r.Header)
+	}
+
+	r := tabtest.NewRequest("POST", "/api/v1/delete-tab", url.Values{"id": {"1"}}, cookies)
+	if r.Header.Get("X-CSRF-Token") != "token" {
+		t.Errorf("expected the CSRF token to be sent, got %v", r.Header)
+	}
+
+	if r.PostFormValue("id") != "1" {
+		t.Errorf("expected the form to be sent, got %v", r.PostForm)
+	}
+}
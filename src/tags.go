@@ -0,0 +1,387 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The admin can rename, merge and delete tags across the whole collection.
+// Since most tags come from the tabs' filenames, which aren't changed, the
+// change is also remembered as a tag rule in the store, which maps each old
+// tag, in lower case, to the tag which replaces it, or to "" if it was
+// deleted. The rules are applied whenever a file is read, so that the tags
+// stay changed when a tab is cached again.
+
+// A tagCount is a tag along with the number of tabs which have it.
+type tagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// countTags returns every tag which any of the tabs have, along with how many
+// of them have it, with the most used tags first. Tags which are used equally
+// are in alphabetical order.
+func countTags(tabs []*Tab) []tagCount {
+	counts := make(map[string]int)
+
+	for _, tab := range tabs {
+		// A tab which somehow has the same tag twice is only counted once.
+		seen := make(map[string]bool, len(tab.Tags))
+
+		for _, tag := range tab.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				counts[tag]++
+			}
+		}
+	}
+
+	tags := make([]tagCount, 0, len(counts))
+	for tag, count := range counts {
+		tags = append(tags, tagCount{Tag: tag, Count: count})
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+
+		return tags[i].Tag < tags[j].Tag
+	})
+
+	return tags
+}
+
+// handleTagsAPI is called to respond to a HTTP request to /api/v1/tags. It
+// responds with every tag in the collection and the number of tabs which
+// have it, encoded in JSON, so that clients can show the tags without
+// fetching every tab. The tags of explicit tabs are only counted for the
+// clients which can see them. Like /api/v1/tabs, a client which already has
+// the current list is sent 304 Not Modified instead.
+func (s *Server) handleTagsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+
+	tabs, stale, err := s.getTabsOrStale(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if stale {
+		markStale(w)
+	}
+
+	explicit := s.showsExplicit(r)
+	licensed := s.restrictsLicenses(r)
+
+	// The tags only change when the collection does, so the same
+	// validators as the list of tabs are used.
+	if !stale {
+		version, err := s.Store.CollectionVersion()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		modified, _, err := s.collectionModified()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		etag := tabsETag(version, explicit, licensed)
+		setValidators(w, etag, modified)
+
+		if notModified(r, etag, modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if !explicit {
+		tabs = filterExplicit(tabs)
+	}
+
+	if licensed {
+		tabs = s.filterLicensed(tabs)
+	}
+
+	jsonData, err := json.Marshal(countTags(tabs))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Write(jsonData)
+}
+
+// replaceTag returns the tags with every tag which is the same as from,
+// ignoring case, replaced by to, or removed if to is empty. A tab which
+// already had to doesn't end up with it twice.
+func replaceTag(tags []string, from, to string) []string {
+	replaced := make([]string, 0, len(tags))
+
+	for _, tag := range tags {
+		if strings.EqualFold(tag, from) {
+			if to == "" {
+				continue
+			}
+
+			tag = to
+		}
+
+		replaced = addTags(replaced, []string{tag})
+	}
+
+	return replaced
+}
+
+// hasTag reports whether any of the tags is the same as tag, ignoring case.
+func hasTag(tags []string, tag string) bool {
+	for _, existing := range tags {
+		if strings.EqualFold(existing, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyTagRules returns the tags with the admin's tag rules applied.
+func (s *Server) applyTagRules(tags []string) ([]string, error) {
+	rules, err := s.Store.TagRules()
+	if err != nil || len(rules) == 0 {
+		return tags, err
+	}
+
+	applied := make([]string, 0, len(tags))
+
+	for _, tag := range tags {
+		if to, ok := rules[strings.ToLower(tag)]; ok {
+			if to == "" {
+				continue
+			}
+
+			tag = to
+		}
+
+		applied = addTags(applied, []string{tag})
+	}
+
+	return applied, nil
+}
+
+// saveTagRule remembers that from has been replaced by to, or deleted if to
+// is empty. Any rule which replaced another tag with from is pointed at to
+// instead, so that the rules never have to be followed more than once, and
+// any rule for to itself is forgotten, since it is a tag again.
+func (s *Server) saveTagRule(from, to string) error {
+	rules, err := s.Store.TagRules()
+	if err != nil {
+		return err
+	}
+
+	changed := make(map[string]string)
+	for old, replacement := range rules {
+		if replacement != "" && strings.EqualFold(replacement, from) {
+			changed[old] = to
+		}
+	}
+
+	var removed []string
+	if to != "" {
+		delete(changed, strings.ToLower(to))
+		removed = append(removed, strings.ToLower(to))
+	}
+
+	changed[strings.ToLower(from)] = to
+
+	return s.Store.UpdateTagRules(changed, removed)
+}
+
+// A retagSummary says what a rename, merge or delete of a tag changed.
+type retagSummary struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Tabs int    `json:"tabs"`
+}
+
+// retag replaces the tag from with to on every tab which has it, ignoring
+// case, or removes it if to is empty, on behalf of the given actor. The tags
+// of every tab, including the extra tags which came from merging tabs, are
+// changed in one go by the store, and then the statistics, the search index
+// and the browse index are updated for the tabs which changed, as described
+// by reindexRetagged. The cache lock is held throughout, so no tab can be
+// cached part way through. If
+// rename is true, to mustn't already be a tag, so that two tags aren't
+// merged by mistake. If there is an error, the HTTP status which it should
+// be reported with is returned along with it.
+func (s *Server) retag(from, to string, rename bool, by actor) (*retagSummary, int, error) {
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+
+	if from == "" {
+		return nil, http.StatusBadRequest, errors.New("no tag was given")
+	}
+
+	if to != "" && browseName(to) == "" {
+		return nil, http.StatusBadRequest, errors.New("the new tag must have at least one letter or digit")
+	}
+
+	ids, err := s.Store.ListIDs()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	tabs, err := s.Store.GetTabs(ids)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// A tag which only differs from the old one by case is a rename of the
+	// same tag, rather than a different tag which is already used.
+	var changed []*Tab
+
+	for _, tab := range tabs {
+		if hasTag(tab.Tags, from) {
+			changed = append(changed, tab)
+		} else if rename && hasTag(tab.Tags, to) && !strings.EqualFold(from, to) {
+			return nil, http.StatusConflict, errors.New("the tag " + to + " is already used, so use merge-tags instead")
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil, http.StatusNotFound, errTagNotFound
+	}
+
+	tags := make(map[string][]string, len(changed))
+	extraTags := make(map[string][]string, len(changed))
+
+	for _, tab := range changed {
+		tags[tab.ID] = replaceTag(tab.Tags, from, to)
+
+		extra, err := s.Store.ExtraTags(tab.ID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		if hasTag(extra, from) {
+			extraTags[tab.ID] = replaceTag(extra, from, to)
+		}
+	}
+
+	if err := s.Store.RewriteTags(tags, extraTags); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// The rule is saved straight after the tags are changed, so that if
+	// anything goes wrong below, the tags still change back the next time
+	// the tabs are cached.
+	if err := s.saveTagRule(from, to); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := s.reindexRetagged(changed); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := s.bumpCollectionVersion(); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	summary := &retagSummary{From: from, To: to, Tabs: len(changed)}
+	s.publishEvent(eventTagsChanged, by, summary)
+
+	return summary, http.StatusOK, nil
+}
+
+// reindexRetagged updates the statistics, the search index and the browse
+// index for tabs whose tags have been changed by retag, given the tabs as they
+// were before. They aren't changed in one go along with the tags. Instead,
+// the tabs are read back from the store, so that the indexes are rebuilt from
+// the tags which were actually saved, and every tab's entries are replaced
+// in one go, so nothing sees the indexes with some of the tabs changed and
+// others not.
+func (s *Server) reindexRetagged(changed []*Tab) error {
+	ids := make([]string, len(changed))
+	for i, tab := range changed {
+		ids[i] = tab.ID
+	}
+
+	saved, err := s.Store.GetTabs(ids)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]*Tab, len(saved))
+	for _, tab := range saved {
+		current[tab.ID] = tab
+	}
+
+	// A tab which has gone from the store since it was read is left out of
+	// the indexes, as it would be if it had been deleted first.
+	return s.Store.ReindexTabs(changed, current)
+}
+
+// serveRetag responds to a request to rename, merge or delete a tag with a
+// summary of what changed, encoded in JSON.
+func (s *Server) serveRetag(w http.ResponseWriter, r *http.Request, from, to string, rename bool) {
+	if status, err := s.validateAdmin(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	summary, status, err := s.retag(from, to, rename, s.requestActor(r))
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// handleRenameTagAPI is called to respond to a HTTP request to
+// /api/v1/rename-tag. It renames the tag in the 'tag' form field to the one
+// in the 'to' form field on every tab, as long as no tab already has the new
+// tag. It will only accept POST requests from a logged in admin.
+func (s *Server) handleRenameTagAPI(w http.ResponseWriter, r *http.Request) {
+	to := r.PostFormValue("to")
+	if strings.TrimSpace(to) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("no new name for the tag was given"))
+		return
+	}
+
+	s.serveRetag(w, r, r.PostFormValue("tag"), to, true)
+}
+
+// handleMergeTagsAPI is called to respond to a HTTP request to
+// /api/v1/merge-tags. It replaces the tag in the 'tag' form field with the
+// one in the 'into' form field on every tab, such as to fix a misspelt tag.
+// It will only accept POST requests from a logged in admin.
+func (s *Server) handleMergeTagsAPI(w http.ResponseWriter, r *http.Request) {
+	into := r.PostFormValue("into")
+	if strings.TrimSpace(into) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("no tag to merge into was given"))
+		return
+	}
+
+	if strings.EqualFold(strings.TrimSpace(into), strings.TrimSpace(r.PostFormValue("tag"))) {
+		writeError(w, http.StatusBadRequest, errors.New("a tag can't be merged into itself"))
+		return
+	}
+
+	s.serveRetag(w, r, r.PostFormValue("tag"), into, false)
+}
+
+// handleDeleteTagAPI is called to respond to a HTTP request to
+// /api/v1/delete-tag. It removes the tag in the 'tag' form field from every
+// tab. The tabs themselves are kept. It will only accept POST requests from
+// a logged in admin.
+func (s *Server) handleDeleteTagAPI(w http.ResponseWriter, r *http.Request) {
+	s.serveRetag(w, r, r.PostFormValue("tag"), "", false)
+}
@@ -0,0 +1,54 @@
+package src_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Zac-Garby/tab-server/src"
+	"github.com/Zac-Garby/tab-server/src/tabtest"
+)
+
+func TestRenameTagIndexes(t *testing.T) {
+	_, handler := tabtest.NewServer(t, nil,
+		tabtest.NewTab("Abba", "Waterloo").Tags("live").Build(),
+		tabtest.NewTab("Abba", "SOS").Build(),
+	)
+
+	cookies := tabtest.LogIn(t, handler, tabtest.Password)
+
+	renamed := httptest.NewRecorder()
+	handler.ServeHTTP(renamed, tabtest.NewRequest("POST", "/api/v1/rename-tag", url.Values{"tag": {"live"}, "to": {"unplugged"}}, cookies))
+	if renamed.Code != http.StatusOK {
+		t.Fatalf("expected the tag to be renamed, got %d: %s", renamed.Code, renamed.Body)
+	}
+
+	// The browse index and the search index are both rebuilt from the tags
+	// which were saved.
+	tagged := func(tag string) []*src.Tab {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, tabtest.NewRequest("GET", "/api/v1/tabs/by-tag/"+tag, nil, nil))
+
+		var tabs []*src.Tab
+		json.Unmarshal(w.Body.Bytes(), &tabs)
+		return tabs
+	}
+
+	if tabs := tagged("unplugged"); len(tabs) != 1 || tabs[0].Title != "Waterloo" {
+		t.Errorf("expected Waterloo to be browsable by its new tag, got %v", tabs)
+	}
+
+	if tabs := tagged("live"); len(tabs) != 0 {
+		t.Errorf("expected nothing to have the old tag, got %v", tabs)
+	}
+
+	search := httptest.NewRecorder()
+	handler.ServeHTTP(search, tabtest.NewRequest("GET", "/api/v1/search?q=unplugged", nil, nil))
+
+	var found []*src.Tab
+	if err := json.Unmarshal(search.Body.Bytes(), &found); err != nil || len(found) != 1 {
+		t.Errorf("expected to find Waterloo by its new tag, got %s", search.Body)
+	}
+}
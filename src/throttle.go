@@ -0,0 +1,167 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The endpoints which read a lot from the tab directory, such as downloading
+// a tab's file or looking through every filename, can saturate a slow disk
+// like a Raspberry Pi's SD card if several of them run at once, which slows
+// down everything else. So only a few of them run at a time, and the rest
+// wait in a queue for their turn. If the queue is full, or a request has
+// waited for too long, it is told to try again later.
+const (
+	// defaultDiskConcurrency is how many disk-heavy requests run at once if
+	// the server isn't told.
+	defaultDiskConcurrency = 2
+
+	// diskQueuePerSlot is how many requests can wait in the queue for each
+	// one which can run at once.
+	diskQueuePerSlot = 4
+
+	// diskQueueWait is the longest a request waits in the queue before it
+	// gives up.
+	diskQueueWait = 10 * time.Second
+
+	// diskRetryAfter is how long a request which couldn't run is told to
+	// wait before trying again.
+	diskRetryAfter = 5 * time.Second
+)
+
+// A throttle limits how many requests run at once, queueing the ones which
+// can't run yet.
+type throttle struct {
+	// slots holds a value for each request which is running, so sending
+	// to it blocks while they all are.
+	slots chan struct{}
+
+	// queueLength is how many requests can wait for a slot. queued is how
+	// many are waiting, and rejected and completed count the requests which
+	// couldn't run and the ones which did. They are only used atomically.
+	queueLength int64
+	queued      int64
+	rejected    int64
+	completed   int64
+}
+
+// newThrottle creates a throttle which lets the given number of requests run
+// at once, with a queue of the given length.
+func newThrottle(slots, queueLength int) *throttle {
+	return &throttle{
+		slots:       make(chan struct{}, slots),
+		queueLength: int64(queueLength),
+	}
+}
+
+// acquire waits for a slot, returning false if the queue is full, the request
+// waited for too long, or its context was cancelled. If it returns true,
+// release must be called once the request has finished.
+func (t *throttle) acquire(ctx context.Context) bool {
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if atomic.AddInt64(&t.queued, 1) > t.queueLength {
+		atomic.AddInt64(&t.queued, -1)
+		atomic.AddInt64(&t.rejected, 1)
+		return false
+	}
+	defer atomic.AddInt64(&t.queued, -1)
+
+	timer := time.NewTimer(diskQueueWait)
+	defer timer.Stop()
+
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	atomic.AddInt64(&t.rejected, 1)
+	return false
+}
+
+// release gives back the slot of a request which has finished.
+func (t *throttle) release() {
+	<-t.slots
+	atomic.AddInt64(&t.completed, 1)
+}
+
+// A throttleStats says how busy a throttle is.
+type throttleStats struct {
+	// Slots is how many requests can run at once, and Running is how many
+	// are.
+	Slots   int `json:"slots"`
+	Running int `json:"running"`
+
+	// QueueLength is how many requests can wait, and Queued is how many
+	// are.
+	QueueLength int64 `json:"queueLength"`
+	Queued      int64 `json:"queued"`
+
+	// Rejected and Completed are how many requests have been turned away
+	// and how many have run since the server started.
+	Rejected  int64 `json:"rejected"`
+	Completed int64 `json:"completed"`
+}
+
+// stats returns how busy the throttle is right now.
+func (t *throttle) stats() throttleStats {
+	return throttleStats{
+		Slots:       cap(t.slots),
+		Running:     len(t.slots),
+		QueueLength: t.queueLength,
+		Queued:      atomic.LoadInt64(&t.queued),
+		Rejected:    atomic.LoadInt64(&t.rejected),
+		Completed:   atomic.LoadInt64(&t.completed),
+	}
+}
+
+// newDiskThrottle creates the throttle for the disk-heavy endpoints, with the
+// number of slots which the server was told to use.
+func (s *Server) newDiskThrottle() *throttle {
+	slots := s.DiskConcurrency
+	if slots <= 0 {
+		slots = defaultDiskConcurrency
+	}
+
+	return newThrottle(slots, slots*diskQueuePerSlot)
+}
+
+// throttleDisk wraps a handler for a disk-heavy endpoint so that it only runs
+// when there's a slot free for it, responding with Too Many Requests if there
+// isn't one soon enough.
+func (s *Server) throttleDisk(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.diskThrottle.acquire(r.Context()) {
+			tooManyRequests(w, diskRetryAfter)
+			return
+		}
+		defer s.diskThrottle.release()
+
+		next(w, r)
+	}
+}
+
+// handleThrottleAPI is called to respond to a HTTP request to
+// /api/v1/throttle. It responds with how busy the disk-heavy endpoints are,
+// encoded in JSON.
+func (s *Server) handleThrottleAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.authenticate(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]throttleStats{
+		"disk": s.diskThrottle.stats(),
+	})
+}
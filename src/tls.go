@@ -0,0 +1,66 @@
+package src
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// tlsConfig loads the HTTPS certificate and key, so that a missing or
+// mismatched file is reported as soon as the server starts, rather than
+// only when the first client connects.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.Certificate == "" || s.Key == "" {
+		return nil, fmt.Errorf("both a certificate and a key are needed to use HTTPS")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(s.Certificate, s.Key)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the HTTPS certificate and key: %s", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+	}, nil
+}
+
+// redirectServer returns the server which listens for plain HTTP requests on
+// RedirectPort and redirects them to the same URL using HTTPS, or nil if it
+// isn't needed.
+func (s *Server) redirectServer() *http.Server {
+	if !s.HTTPS || s.RedirectPort == 0 {
+		return nil
+	}
+
+	return &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", s.Address, s.RedirectPort),
+		Handler: http.HandlerFunc(s.redirectToHTTPS),
+	}
+}
+
+// redirectToHTTPS redirects a request to the same URL using HTTPS, on the
+// port which the main server listens on.
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// There wasn't a port in the host.
+		host = r.Host
+	}
+
+	if s.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(s.Port))
+	}
+
+	target := "https://" + host + r.URL.RequestURI()
+
+	// Requests which aren't GET or HEAD are redirected with 308 rather than
+	// 301, so that clients send the same method and body again.
+	status := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		status = http.StatusPermanentRedirect
+	}
+
+	http.Redirect(w, r, target, status)
+}
@@ -0,0 +1,195 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// hashToken computes the SHA-256 hash of an API token in hexadecimal. Only
+// the hash of each token is stored in the database, so the tokens can't be
+// recovered from a copy of it.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createToken generates a new API token with the given name and role, stores
+// its hash along with its name and role, and returns the token itself. If it can't be created, an error and error status are returned,
+// which is 400 if the name is empty or is already used by another token, or
+// if the role doesn't exist.
+func (s *Server) createToken(name, role string) (string, int, error) {
+	if name == "" {
+		return "", http.StatusBadRequest, errors.New("a token name is required")
+	}
+
+	// A token without a role has the admin role. Any other role has to
+	// exist already.
+	if role == "" {
+		role = roleAdmin
+	} else if role != roleAdmin {
+		roles, err := s.roles()
+		if err != nil {
+			return "", http.StatusInternalServerError, err
+		} else if _, ok := roles[role]; !ok {
+			return "", http.StatusBadRequest, fmt.Errorf("no role called %s", role)
+		}
+	}
+
+	names, err := s.tokenNames()
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	for _, existing := range names {
+		if existing == name {
+			return "", http.StatusBadRequest, errors.New("a token with that name already exists")
+		}
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	if err := s.Store.PutToken(hashToken(token), name, role); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	return token, http.StatusOK, nil
+}
+
+// tokenNames returns the sorted names of all of the API tokens.
+func (s *Server) tokenNames() ([]string, error) {
+	tokens, err := s.Store.Tokens()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(tokens))
+	for _, name := range tokens {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// revokeToken removes the API token with the given name, so it can't be
+// used any more. The second return value is false if there was no such
+// token.
+func (s *Server) revokeToken(name string) (bool, error) {
+	tokens, err := s.Store.Tokens()
+	if err != nil {
+		return false, err
+	}
+
+	// Since the tokens are stored by their hashes, a linear search is
+	// needed to find the one with the right name.
+	for hash, existing := range tokens {
+		if existing == name {
+			return true, s.Store.DeleteToken(hash, name)
+		}
+	}
+
+	return false, nil
+}
+
+// validateToken checks the token given in the request's 'Authorization:
+// Bearer <token>' header. If the token doesn't exist, an error and error
+// status will be returned.
+func (s *Server) validateToken(r *http.Request) (int, error) {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+
+	_, exists, err := s.Store.TokenName(hashToken(token))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !exists {
+		return http.StatusUnauthorized, errInvalidToken
+	}
+
+	return http.StatusOK, nil
+}
+
+// authenticate checks that the request was made by the admin, either using
+// an API token in the Authorization header or from a logged in browser. If
+// neither is valid, an error and error status will be returned.
+func (s *Server) authenticate(r *http.Request) (int, error) {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return s.validateToken(r)
+	}
+
+	return s.validateSession(r)
+}
+
+// validateAdmin checks that the request is a POST request made by the admin.
+// Like validatePassword, it only accepts POST requests since it is used to
+// protect actions which change things.
+func (s *Server) validateAdmin(r *http.Request) (int, error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, errOnlyPOST
+	}
+
+	return s.authenticate(r)
+}
+
+// handleTokensAPI is called to respond to a HTTP request to /api/v1/tokens.
+// A GET request lists the names of the existing tokens, a POST request
+// creates a new token with the name in the 'name' form field and the role in
+// the optional 'role' form field, and responds with it, and a DELETE request
+// revokes the token named in the 'name' query value. All of them can only be
+// made by the admin.
+func (s *Server) handleTokensAPI(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.authenticate(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		names, err := s.tokenNames()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(names)
+
+	case "POST":
+		name := r.PostFormValue("name")
+
+		token, status, err := s.createToken(name, r.PostFormValue("role"))
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+
+		// This is the only time the token is ever sent, since only its
+		// hash is kept, so the client must make a note of it now.
+		json.NewEncoder(w).Encode(map[string]string{
+			"name":  name,
+			"token": token,
+		})
+
+	case "DELETE":
+		found, err := s.revokeToken(r.FormValue("name"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if !found {
+			writeError(w, http.StatusNotFound, errTokenNotFound)
+			return
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET, POST and DELETE are supported"))
+	}
+}
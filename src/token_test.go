@@ -0,0 +1,55 @@
+package src_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Zac-Garby/tab-server/src"
+	"github.com/Zac-Garby/tab-server/src/tabtest"
+)
+
+// brokenTokenStore is a Store which can't store tokens.
+type brokenTokenStore struct {
+	src.Store
+}
+
+func (brokenTokenStore) PutToken(hash, name, role string) error {
+	return errors.New("the tokens can't be stored")
+}
+
+func TestCreateTokenStatus(t *testing.T) {
+	s, handler := tabtest.NewServer(t, nil)
+	cookies := tabtest.LogIn(t, handler, tabtest.Password)
+
+	create := func(form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, tabtest.NewRequest("POST", "/api/v1/tokens", form, cookies))
+		return w
+	}
+
+	cases := []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{"name": {"deploy"}}, http.StatusOK},
+		{url.Values{"name": {""}}, http.StatusBadRequest},
+		{url.Values{"name": {"deploy"}}, http.StatusBadRequest},
+		{url.Values{"name": {"backup"}, "role": {"nobody"}}, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		if w := create(c.form); w.Code != c.status {
+			t.Errorf("%v: expected %d, got %d: %s", c.form, c.status, w.Code, w.Body)
+		}
+	}
+
+	// A token which can't be stored isn't the client's fault.
+	s.Store = brokenTokenStore{s.Store}
+
+	if w := create(url.Values{"name": {"backup"}}); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected a database error to be a server error, got %d: %s", w.Code, w.Body)
+	}
+}
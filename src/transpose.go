@@ -0,0 +1,258 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// A tab can be transposed into another key, such as to suit a singer, by
+// shifting every chord it uses up or down by a number of semitones. Only the
+// chords which detectChords would find are changed, so the lyrics and any
+// tablature are left alone, and the stored tab isn't touched. Where a chord's
+// name gets longer or shorter, the spaces after it are shrunk or stretched to
+// match, so the chords stay over the words they were above.
+
+// maxTransposeSemitones is the furthest a tab can be transposed in either
+// direction. Anything further is the same as transposing by less, an octave
+// away.
+const maxTransposeSemitones = 11
+
+// flatNoteNames maps each pitch class to its name when it is written with a
+// flat, like noteNames does with sharps.
+var flatNoteNames = []string{
+	"C", "Db", "D", "Eb", "E", "F", "Gb", "G", "Ab", "A", "Bb", "B",
+}
+
+// These are the ways of writing the chords of a transposed tab, given in the
+// 'accidentals' query value.
+const (
+	accidentalsSharps = "sharps"
+	accidentalsFlats  = "flats"
+)
+
+// A transposedTab is a tab's content with its chords transposed.
+type transposedTab struct {
+	ID          string   `json:"id"`
+	Semitones   int      `json:"semitones"`
+	Accidentals string   `json:"accidentals"`
+	Content     string   `json:"content"`
+	Chords      []string `json:"chords"`
+}
+
+// transposeNote returns the note with the given name, such as "F#" or "Bb",
+// shifted by the given number of semitones, written with flats if flats is
+// true and with sharps otherwise. The second return value is false if the
+// name isn't a note.
+func transposeNote(name string, semitones int, flats bool) (string, bool) {
+	pitch, ok := parseNote(name)
+	if !ok {
+		return "", false
+	}
+
+	pitch = ((pitch+semitones)%12 + 12) % 12
+
+	if flats {
+		return flatNoteNames[pitch], true
+	}
+
+	return noteNames[pitch], true
+}
+
+// noteLength returns how many bytes at the start of a chord make up the note
+// it starts with, such as 2 for "F#m7" and 1 for "Am".
+func noteLength(chord string) int {
+	if len(chord) > 1 && (chord[1] == '#' || chord[1] == 'b') {
+		return 2
+	}
+
+	return 1
+}
+
+// transposeChord returns the chord shifted by the given number of semitones.
+// Both its root and the bass note of a slash chord, like the "F#" of "D/F#",
+// are shifted, and the rest is left as it is.
+func transposeChord(chord string, semitones int, flats bool) string {
+	chord = strings.NewReplacer("♯", "#", "♭", "b").Replace(chord)
+
+	quality, bass := chord[noteLength(chord):], ""
+	if slash := strings.LastIndexByte(quality, '/'); slash >= 0 {
+		quality, bass = quality[:slash], quality[slash+1:]
+	}
+
+	root, _ := transposeNote(chord[:noteLength(chord)], semitones, flats)
+	transposed := root + quality
+
+	if bass != "" {
+		if note, ok := transposeNote(bass, semitones, flats); ok {
+			transposed += "/" + note
+		} else {
+			transposed += "/" + bass
+		}
+	}
+
+	return transposed
+}
+
+// prefersFlats reports whether more of the chords in a tab's content are
+// written with flats than with sharps, in which case its transposed chords
+// are written with flats too.
+func prefersFlats(content string) bool {
+	flats, sharps := 0, 0
+
+	for _, chord := range detectChords(content) {
+		switch chord[noteLength(chord)-1] {
+		case 'b':
+			flats++
+		case '#':
+			sharps++
+		}
+	}
+
+	return flats > sharps
+}
+
+// transposeContent returns a tab's content with every chord shifted by the
+// given number of semitones, written with flats if flats is true and with
+// sharps otherwise.
+func transposeContent(content string, semitones int, flats bool) string {
+	lines := strings.Split(content, "\n")
+
+	for i, line := range lines {
+		if _, ok := chordLine(line); ok {
+			lines[i] = transposeChordLine(line, semitones, flats)
+		} else {
+			lines[i] = transposeBracketedChords(line, semitones, flats)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// transposeChordLine transposes each chord in a line of chords. When a chord
+// gets longer, as many of the spaces after it as possible are taken away to
+// make room, leaving at least one, and when it gets shorter, spaces are
+// added, so that the chords after it stay where they were, as long as they
+// are lined up with spaces.
+func transposeChordLine(line string, semitones int, flats bool) string {
+	var transposed strings.Builder
+
+	// shift is how many characters further right the rest of the line is
+	// than it was.
+	shift := 0
+
+	for len(line) > 0 {
+		// Copy the spaces before the next field, taking the shift back out
+		// of them where there are enough. How wide a tab character is
+		// depends on where it is, so ones with tabs are left alone.
+		spaces := len(line) - len(strings.TrimLeft(line, " \t"))
+		if spaces > 0 && transposed.Len() > 0 && shift != 0 && !strings.Contains(line[:spaces], "\t") {
+			keep := spaces - shift
+			if keep < 1 {
+				keep = 1
+			}
+
+			shift -= spaces - keep
+			transposed.WriteString(strings.Repeat(" ", keep))
+		} else {
+			transposed.WriteString(line[:spaces])
+		}
+
+		line = line[spaces:]
+
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+
+		field := line[:end]
+		line = line[end:]
+
+		if isChord(field) {
+			chord := transposeChord(field, semitones, flats)
+			shift += len(chord) - len(field)
+			field = chord
+		}
+
+		transposed.WriteString(field)
+	}
+
+	return transposed.String()
+}
+
+// transposeBracketedChords transposes the chords in square brackets in a line
+// of lyrics, like "[Am]Hello [G]there".
+func transposeBracketedChords(line string, semitones int, flats bool) string {
+	parts := strings.Split(line, "[")
+
+	for i, part := range parts[1:] {
+		end := strings.IndexByte(part, ']')
+		if end < 0 || !isChord(part[:end]) {
+			continue
+		}
+
+		parts[i+1] = transposeChord(part[:end], semitones, flats) + part[end:]
+	}
+
+	return strings.Join(parts, "[")
+}
+
+// handleTransposeAPI is called to respond to a HTTP request to
+// /api/v1/tab/{id}/transpose. It responds with the content of the tab with
+// that ID, with its chords shifted by the number of semitones in the
+// 'semitones' query value, which can be negative, encoded in JSON along with
+// the transposed chords. The 'accidentals' query value can be "sharps" or
+// "flats" to say how the chords should be written. Otherwise, flats are used
+// if the tab already uses more of them than sharps.
+func (s *Server) handleTransposeAPI(w http.ResponseWriter, r *http.Request) {
+	tab, ok, err := s.Store.GetTab(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok || s.hidesTab(r, tab) {
+		writeError(w, http.StatusNotFound, errTabNotFound)
+		return
+	}
+
+	semitones, err := strconv.Atoi(r.FormValue("semitones"))
+	if err != nil || semitones < -maxTransposeSemitones || semitones > maxTransposeSemitones {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("the semitones must be a whole number from %d to %d", -maxTransposeSemitones, maxTransposeSemitones))
+		return
+	}
+
+	accidentals := r.FormValue("accidentals")
+
+	if accidentals == "" {
+		accidentals = accidentalsSharps
+		if prefersFlats(tab.Content) {
+			accidentals = accidentalsFlats
+		}
+	} else if accidentals != accidentalsSharps && accidentals != accidentalsFlats {
+		writeError(w, http.StatusBadRequest, errors.New("the accidentals must be \"sharps\" or \"flats\""))
+		return
+	}
+
+	content := transposeContent(tab.Content, semitones, accidentals == accidentalsFlats)
+
+	jsonData, err := json.Marshal(&transposedTab{
+		ID:          tab.ID,
+		Semitones:   semitones,
+		Accidentals: accidentals,
+		Content:     content,
+		Chords:      detectChords(content),
+	})
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
@@ -0,0 +1,87 @@
+package src
+
+import "testing"
+
+func TestTransposeChord(t *testing.T) {
+	cases := []struct {
+		chord     string
+		semitones int
+		flats     bool
+		expected  string
+	}{
+		{"C", 2, false, "D"},
+		{"Am7", 3, false, "Cm7"},
+		{"F#m", -1, false, "Fm"},
+
+		// Transposing past B wraps back round to C, and the other way.
+		{"B", 1, false, "C"},
+		{"A#sus4", 3, false, "C#sus4"},
+		{"C", -1, false, "B"},
+		{"Db", -11, false, "D"},
+
+		// The same pitch is written with a sharp or a flat as asked,
+		// whichever way the chord was written before.
+		{"C", 1, true, "Db"},
+		{"C#", 0, true, "Db"},
+		{"Bb", 0, false, "A#"},
+		{"E♭maj7", 2, false, "Fmaj7"},
+
+		// The bass note of a slash chord is moved too, and left alone if it
+		// isn't a note.
+		{"D/F#", 2, false, "E/G#"},
+		{"G/B", 1, true, "Ab/C"},
+		{"Am/x", 2, false, "Bm/x"},
+	}
+
+	for _, c := range cases {
+		if transposed := transposeChord(c.chord, c.semitones, c.flats); transposed != c.expected {
+			t.Errorf("%s by %d: expected %q, got %q", c.chord, c.semitones, c.expected, transposed)
+		}
+	}
+}
+
+func TestTransposeContent(t *testing.T) {
+	cases := []struct {
+		name, content string
+		semitones     int
+		flats         bool
+		expected      string
+	}{
+		// The chords stay over the words they were above when their names
+		// get longer or shorter.
+		{"longer", "C   G   Am\nHello there friend", 1, false, "C#  G#  A#m\nHello there friend"},
+		{"shorter", "C#  G#  A#m\nHello there friend", -1, false, "C   G   Am\nHello there friend"},
+
+		// There is always a space left between chords.
+		{"crowded", "C G Am", 1, false, "C# G# A#m"},
+
+		// Chords in brackets are changed, but the lyrics, headings and
+		// tablature aren't.
+		{"bracketed", "[Chorus]\n[Am]Am I [G/B]there?", 2, false, "[Chorus]\n[Bm]Am I [A/C#]there?"},
+		{"tablature", "e|--3--|\nB|--1--|", 5, false, "e|--3--|\nB|--1--|"},
+
+		{"empty", "", 3, false, ""},
+	}
+
+	for _, c := range cases {
+		if transposed := transposeContent(c.content, c.semitones, c.flats); transposed != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, transposed)
+		}
+	}
+}
+
+func TestPrefersFlats(t *testing.T) {
+	cases := map[string]bool{
+		"Bb  Eb  F":  true,
+		"F#  C#  Bb": false,
+		"Bb  F#":     false,
+		"C  G  Am":   false,
+		"":           false,
+	}
+
+	for content, expected := range cases {
+		if flats := prefersFlats(content); flats != expected {
+			t.Errorf("%q: expected %v, got %v", content, expected, flats)
+		}
+	}
+}
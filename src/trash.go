@@ -0,0 +1,354 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// If the trash days setting isn't 0, deleting a tab doesn't delete its file.
+// Instead, the file is moved into the .trash folder in the tab directory, and
+// what is needed to put the tab back as it was, which is the same as what the
+// manifest keeps, is put in the trash in the store, by the deleted tab's ID.
+// The tab is taken out of the cache as
+// usual, so nothing else has to know about the trash, and since the folder's
+// name begins with a '.', the files in it are never mistaken for tabs.
+//
+// A deleted tab can be restored with /api/v1/restore-tab, which moves its file
+// back and caches it again with the same ID, date added and admin's changes,
+// until it is purged, which happens once it has been in the trash for the
+// number of days in the setting. The tab's places in setlists, and the
+// recordings and song requests which were linked to it, aren't put back,
+// since they were taken away when it was deleted.
+const (
+	// trashFolder is the folder in the tab directory which the files of
+	// deleted tabs are kept in, each in a folder named after its tab's ID.
+	trashFolder = ".trash"
+
+	// trashPurgeInterval is how often the trash is checked for tabs which
+	// have been there long enough to be purged.
+	trashPurgeInterval = time.Hour
+)
+
+// errNotInTrash is returned when a tab which isn't in the trash is restored
+// or purged.
+var errNotInTrash = newAPIError(codeNotFound, "there is no tab with that ID in the trash")
+
+// A trashedTab is a tab which has been deleted, and is kept in the trash. The
+// manifest entry is what it is restored from, and the title and artist are
+// kept so that it can be recognised in the list.
+type trashedTab struct {
+	manifestEntry
+
+	Title     string    `json:"title"`
+	Artist    string    `json:"artist"`
+	Deleted   time.Time `json:"deleted"`
+	DeletedBy actor     `json:"deletedBy"`
+
+	// Purges is when the tab will be purged from the trash. It isn't
+	// stored, since it depends on the setting, and is nil if the tab is
+	// only purged by hand.
+	Purges *time.Time `json:"purges,omitempty"`
+}
+
+// trashPath returns the path which the file of the deleted tab with the given
+// ID and filename is kept at.
+func (s *Server) trashPath(id, filename string) string {
+	return filepath.Join(s.Settings.TabDirectory, trashFolder, id, filepath.FromSlash(filename))
+}
+
+// trashTab removes the tab with the given ID from the database and moves its
+// file into the trash, on behalf of the given actor.
+func (s *Server) trashTab(id string, by actor) error {
+	// The admin's extra tags are fetched before the tab is taken out of the
+	// database, since they go with it.
+	extraTags, err := s.Store.ExtraTags(id)
+	if err != nil {
+		return err
+	}
+
+	tab, err := s.uncacheTab(id, by)
+	if err != nil {
+		return err
+	}
+
+	trashed := trashedTab{
+		manifestEntry: newManifestEntry(tab, extraTags),
+		Title:         tab.Title,
+		Artist:        tab.Artist,
+		Deleted:       time.Now(),
+		DeletedBy:     s.record(by),
+	}
+
+	if err := s.Store.PutTrashedTab(id, &trashed); err != nil {
+		return err
+	}
+
+	trashPath := s.trashPath(id, tab.Filename)
+
+	if err := os.MkdirAll(filepath.Dir(trashPath), 0755); err != nil {
+		return err
+	}
+
+	// If the file can't be moved, it is left where it is, and the tab is
+	// taken out of the trash again, so it will be cached as a new tab the
+	// next time the tab directory is scanned, rather than being lost.
+	if err := os.Rename(s.tabPath(tab.Filename), trashPath); err != nil {
+		s.Store.DeleteTrashedTab(id)
+		return err
+	}
+
+	return nil
+}
+
+// trashedTabs returns the tabs in the trash, most recently deleted first.
+func (s *Server) trashedTabs() ([]*trashedTab, error) {
+	trashed, err := s.Store.TrashedTabs()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Settings.TrashDays > 0 {
+		for _, tab := range trashed {
+			purges := tab.Deleted.AddDate(0, 0, s.Settings.TrashDays)
+			tab.Purges = &purges
+		}
+	}
+
+	sort.Slice(trashed, func(i, j int) bool {
+		return trashed[i].Deleted.After(trashed[j].Deleted)
+	})
+
+	return trashed, nil
+}
+
+// trashedTab returns the tab in the trash with the given ID, or
+// errNotInTrash if there isn't one.
+func (s *Server) trashedTab(id string) (*trashedTab, error) {
+	tab, ok, err := s.Store.TrashedTab(id)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errNotInTrash
+	}
+
+	return tab, nil
+}
+
+// restoreTrashedTab moves the file of the tab in the trash with the given ID
+// back to where it was, and caches it again with the same ID, date added and
+// admin's changes, on behalf of the given actor. If it can't be restored, an
+// error and error status are returned, and it is left in the trash. If
+// another tab has its ID, or a file has its filename, it can't be restored,
+// and the status is 409.
+func (s *Server) restoreTrashedTab(id string, by actor) (*Tab, int, error) {
+	// The cache lock is held so that the file watcher doesn't cache the
+	// file as a new tab as soon as it is moved back.
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	trashed, err := s.trashedTab(id)
+	if err == errNotInTrash {
+		return nil, http.StatusNotFound, err
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Another tab could have been given the ID since this one was deleted,
+	// such as one restored from a backup, and only one of them can have it.
+	if _, ok, err := s.Store.GetTab(id); err != nil {
+		return nil, http.StatusInternalServerError, err
+	} else if ok {
+		return nil, http.StatusConflict, newAPIError(codeConflict, fmt.Sprintf("there is already a tab with the ID %s, so the tab can't be put back", id))
+	}
+
+	filePath := s.tabPath(trashed.Filename)
+
+	if _, err := os.Stat(filePath); err == nil {
+		return nil, http.StatusConflict, newAPIError(codeConflict, fmt.Sprintf("there is already a file called %s, so the tab can't be put back", trashed.Filename))
+	} else if !os.IsNotExist(err) {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := os.Rename(s.trashPath(id, trashed.Filename), filePath); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	tab, ok, err := s.readTab(trashed.Filename, tokenizePatterns(s.Settings.FilenamePatterns))
+	if err != nil || !ok {
+		// The file is put back in the trash, so that it can be restored
+		// once the filename patterns match it again.
+		os.Rename(filePath, s.trashPath(id, trashed.Filename))
+
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		return nil, http.StatusConflict, newAPIError(codeConflict, fmt.Sprintf("the filename %s doesn't match any of the filename patterns any more", trashed.Filename))
+	}
+
+	if err := s.restoreTab(tab, trashed.manifestEntry); err != nil {
+		// As above, the file goes back in the trash, rather than being
+		// left in the tab directory for a tab which was never restored.
+		os.Rename(filePath, s.trashPath(id, trashed.Filename))
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := s.Store.DeleteTrashedTab(id); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	os.RemoveAll(filepath.Join(s.Settings.TabDirectory, trashFolder, id))
+
+	if err := s.bumpCollectionVersion(); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	s.publishEvent(eventTabAdded, by, tabEventData(tab))
+
+	return tab, http.StatusOK, nil
+}
+
+// purgeTrashedTab deletes the file of the tab in the trash with the given ID,
+// and takes it out of the trash, so that it can't be restored.
+func (s *Server) purgeTrashedTab(id string) error {
+	if err := os.RemoveAll(filepath.Join(s.Settings.TabDirectory, trashFolder, id)); err != nil {
+		return err
+	}
+
+	return s.Store.DeleteTrashedTab(id)
+}
+
+// purgeTrash purges the tabs which were deleted before the given time, and
+// returns the number which were purged.
+func (s *Server) purgeTrash(before time.Time) (int, error) {
+	trashed, err := s.trashedTabs()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+
+	for _, tab := range trashed {
+		if !tab.Deleted.Before(before) {
+			continue
+		}
+
+		if err := s.purgeTrashedTab(tab.ID); err != nil {
+			return purged, err
+		}
+
+		purged++
+	}
+
+	return purged, nil
+}
+
+// startTrashPurger purges the tabs which have been in the trash for longer
+// than the trash days setting every so often, until the server shuts down.
+// The setting is checked each time, so that changing it takes effect without
+// restarting the server.
+func (s *Server) startTrashPurger() {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+
+		stopping := s.background().Done()
+
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+
+		for {
+			if days := s.Settings.TrashDays; days > 0 {
+				purged, err := s.purgeTrash(time.Now().AddDate(0, 0, -days))
+				if err != nil {
+					s.logMessage("error", "warning: failed to purge the trash: %s", err)
+				} else if purged > 0 {
+					s.logMessage("info", "Purged %d tabs which had been in the trash for %d days.", purged, days)
+				}
+			}
+
+			select {
+			case <-stopping:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// handleTrashAPI is called to respond to a HTTP request to /api/v1/trash. A
+// GET request responds with the tabs in the trash, most recently deleted
+// first, encoded in JSON. A DELETE request purges the tab with the ID in the
+// 'id' query value from the trash, or every tab if it isn't given, and
+// responds with the number which were purged.
+func (s *Server) handleTrashAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		trashed, err := s.trashedTabs()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(trashed)
+		return
+	}
+
+	purged := 0
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		if _, err := s.trashedTab(id); err == errNotInTrash {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := s.purgeTrashedTab(id); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		purged = 1
+	} else {
+		var err error
+		if purged, err = s.purgeTrash(time.Now()); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
+
+// handleRestoreTabAPI is called to respond to a HTTP request to
+// /api/v1/restore-tab. It restores the tab in the trash with the ID in the
+// 'id' form value, and responds with the restored tab, encoded in JSON.
+func (s *Server) handleRestoreTabAPI(w http.ResponseWriter, r *http.Request) {
+	id := r.PostFormValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, errors.New("the ID of a tab in the trash needs to be given as 'id'"))
+		return
+	}
+
+	tab, status, err := s.restoreTrashedTab(id, s.requestActor(r))
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tab)
+}
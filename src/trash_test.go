@@ -0,0 +1,45 @@
+package src_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Zac-Garby/tab-server/src/tabtest"
+)
+
+func TestRestoreTrashedTabIDInUse(t *testing.T) {
+	settings := tabtest.NewSettings().TrashDays(30).Build()
+
+	s, handler := tabtest.NewServer(t, settings, tabtest.NewTab("Abba", "Waterloo").ID("1").Build())
+	cookies := tabtest.LogIn(t, handler, tabtest.Password)
+
+	deleted := httptest.NewRecorder()
+	handler.ServeHTTP(deleted, tabtest.NewRequest("POST", "/api/v1/delete-tab", url.Values{"id": {"1"}}, cookies))
+	if deleted.Code != http.StatusOK {
+		t.Fatalf("expected to delete the tab, got %d: %s", deleted.Code, deleted.Body)
+	}
+
+	// Another tab is given the deleted tab's ID, as restoring a backup
+	// could do.
+	if err := s.Store.RestoreTab(tabtest.NewTab("Abba", "SOS").ID("1").Build()); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := httptest.NewRecorder()
+	handler.ServeHTTP(restored, tabtest.NewRequest("POST", "/api/v1/restore-tab", url.Values{"id": {"1"}}, cookies))
+	if restored.Code != http.StatusConflict {
+		t.Fatalf("expected a conflict, got %d: %s", restored.Code, restored.Body)
+	}
+
+	if _, err := os.Stat(filepath.Join(settings.TabDirectory, ".trash", "1", "Abba - Waterloo.txt")); err != nil {
+		t.Errorf("expected the file to be left in the trash: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(settings.TabDirectory, "Abba - Waterloo.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected the file not to be put back: %v", err)
+	}
+}
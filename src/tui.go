@@ -0,0 +1,254 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// The /api/v1/tui endpoints respond with plain text which is already laid out
+// for a terminal, for browsing the tabs with curl over a slow connection,
+// without having to parse any JSON. Everything is split into pages, so that
+// a long list or a long tab doesn't have to be downloaded all at once, and
+// the end of each page says how to get the next one.
+const (
+	// tuiWidth is the width which the lists are laid out to fit, unless
+	// the 'width' query value asks for a different one between
+	// tuiMinWidth and tuiMaxWidth.
+	tuiWidth    = 80
+	tuiMinWidth = 40
+	tuiMaxWidth = 300
+
+	// tuiListPage is how many tabs are listed on each page, and
+	// tuiContentPage is how many lines of a tab are on each page. Either
+	// can be changed with the 'lines' query value.
+	tuiListPage    = 20
+	tuiContentPage = 60
+)
+
+// tuiHelp is the response to /api/v1/tui, which explains how to use the rest
+// of the endpoints.
+const tuiHelp = `Tab Server
+
+  /api/v1/tui/tabs              list the tabs
+  /api/v1/tui/tabs?q=words      search the tabs
+  /api/v1/tui/tab/{id}          show a tab
+
+Every endpoint takes ?page=N to choose a page, and ?lines=N to choose how
+many lines are on each page. The lists take ?width=N to fit a terminal
+which isn't 80 characters wide.
+`
+
+// tuiOptions are the options which a request to the text API can give.
+type tuiOptions struct {
+	page, lines, width int
+}
+
+// parseTUIOptions reads the options from the query, using the given number
+// of lines per page unless another is asked for.
+func parseTUIOptions(r *http.Request, lines int) tuiOptions {
+	opts := tuiOptions{page: 1, lines: lines, width: tuiWidth}
+
+	if page, err := strconv.Atoi(r.FormValue("page")); err == nil && page > 0 {
+		opts.page = page
+	}
+
+	if lines, err := strconv.Atoi(r.FormValue("lines")); err == nil && lines > 0 {
+		opts.lines = lines
+	}
+
+	if width, err := strconv.Atoi(r.FormValue("width")); err == nil {
+		opts.width = width
+
+		if width < tuiMinWidth {
+			opts.width = tuiMinWidth
+		} else if width > tuiMaxWidth {
+			opts.width = tuiMaxWidth
+		}
+	}
+
+	return opts
+}
+
+// paginate returns the bounds of the current page of a list with the given
+// number of items, and the number of pages. If the page is past the end, the
+// bounds are both the end of the list.
+func (opts tuiOptions) paginate(items int) (start, end, pages int) {
+	pages = (items + opts.lines - 1) / opts.lines
+	if pages == 0 {
+		pages = 1
+	}
+
+	start = (opts.page - 1) * opts.lines
+	if start > items {
+		start = items
+	}
+
+	end = start + opts.lines
+	if end > items {
+		end = items
+	}
+
+	return start, end, pages
+}
+
+// footer returns the line at the end of each page, which says which page it
+// is and how to get to the next one, keeping the rest of the query the same.
+func (opts tuiOptions) footer(r *http.Request, pages int) string {
+	footer := fmt.Sprintf("Page %d of %d.", opts.page, pages)
+
+	if opts.page < pages {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(opts.page+1))
+
+		next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		footer += " Next: " + next.String()
+	}
+
+	return footer + "\n"
+}
+
+// fitColumn pads or cuts the text so that it is exactly width characters
+// wide. Text which is cut ends in "..." to show that there is more.
+func fitColumn(text string, width int) string {
+	length := utf8.RuneCountInString(text)
+
+	if length <= width {
+		return text + strings.Repeat(" ", width-length)
+	} else if width <= 3 {
+		return string([]rune(text)[:width])
+	}
+
+	return string([]rune(text)[:width-3]) + "..."
+}
+
+// writeTUIText writes a plain text response.
+func writeTUIText(w http.ResponseWriter, text string) {
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(text))
+}
+
+// handleTUIHelpAPI is called to respond to a HTTP request to /api/v1/tui. It
+// responds with a summary of the text API.
+func (s *Server) handleTUIHelpAPI(w http.ResponseWriter, r *http.Request) {
+	writeTUIText(w, tuiHelp)
+}
+
+// handleTUITabsAPI is called to respond to a HTTP request to /api/v1/tui/tabs.
+// It responds with a page of the tabs, or of the ones matching the search in
+// the 'q' query value, as a table with a column each for their IDs, titles
+// and artists.
+func (s *Server) handleTUITabsAPI(w http.ResponseWriter, r *http.Request) {
+	var (
+		tabs  []*Tab
+		stale bool
+		err   error
+	)
+
+	if query := r.FormValue("q"); query != "" {
+		tabs, err = s.searchTabs(query)
+	} else if tabs, stale, err = s.getTabsOrStale(r.Context()); err == nil {
+		sort.Slice(tabs, func(i, j int) bool {
+			return tabs[i].Title < tabs[j].Title
+		})
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !s.showsExplicit(r) {
+		tabs = filterExplicit(tabs)
+	}
+
+	if s.restrictsLicenses(r) {
+		tabs = s.filterLicensed(tabs)
+	}
+
+	opts := parseTUIOptions(r, tuiListPage)
+	start, end, pages := opts.paginate(len(tabs))
+
+	// The ID column is as wide as the longest ID on the page, and the rest
+	// of the width is shared between the title and the artist, with a bit
+	// more for the title since titles tend to be longer.
+	idWidth := len("ID")
+	for _, tab := range tabs[start:end] {
+		if n := utf8.RuneCountInString(tab.ID); n > idWidth {
+			idWidth = n
+		}
+	}
+
+	rest := opts.width - idWidth - 4
+	titleWidth := rest * 3 / 5
+	artistWidth := rest - titleWidth
+
+	var text strings.Builder
+
+	if stale {
+		text.WriteString("These tabs might be out of date.\n\n")
+	}
+
+	row := func(id, title, artist string) {
+		line := fmt.Sprintf("%*s  %s  %s", idWidth, id, fitColumn(title, titleWidth), fitColumn(artist, artistWidth))
+		text.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+
+	row("ID", "TITLE", "ARTIST")
+	text.WriteString(strings.Repeat("-", opts.width) + "\n")
+
+	for _, tab := range tabs[start:end] {
+		row(tab.ID, tab.Title, tab.Artist)
+	}
+
+	if len(tabs) == 0 {
+		text.WriteString("No tabs found.\n")
+	}
+
+	text.WriteString("\n" + opts.footer(r, pages))
+
+	writeTUIText(w, text.String())
+}
+
+// handleTUITabAPI is called to respond to a HTTP request to
+// /api/v1/tui/tab/{id}. It responds with a page of the tab's content, under its
+// title and artist. The content's lines are never cut or wrapped, since that
+// would split the chords from the lyrics they go with.
+func (s *Server) handleTUITabAPI(w http.ResponseWriter, r *http.Request) {
+	tab, ok, err := s.Store.GetTab(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok || s.hidesTab(r, tab) {
+		http.Error(w, "no tab with that ID", http.StatusNotFound)
+		return
+	}
+
+	tab.applyTransformations(s.Settings.CharactersToRemove, s.Settings.NonCapitalWords)
+
+	lines := strings.Split(strings.TrimRight(tab.Content, "\n"), "\n")
+
+	opts := parseTUIOptions(r, tuiContentPage)
+	start, end, pages := opts.paginate(len(lines))
+
+	var text strings.Builder
+
+	heading := tab.Title + " - " + tab.Artist
+	text.WriteString(heading + "\n")
+	text.WriteString(strings.Repeat("=", utf8.RuneCountInString(heading)) + "\n\n")
+
+	for _, line := range lines[start:end] {
+		text.WriteString(strings.TrimRight(line, " \t\r") + "\n")
+	}
+
+	text.WriteString("\n" + opts.footer(r, pages))
+
+	writeTUIText(w, text.String())
+}
@@ -0,0 +1,286 @@
+package src
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tab files often say which tuning and capo to use near the top, in lines like
+// "Tuning: DADGAD", "Capo 3" or "Capo on the 2nd fret". They are picked out of
+// the content when it is read, and given a standard form, so that the tabs
+// can be filtered by tuning however each one wrote it. The admin's practice
+// metadata takes precedence over whatever was found.
+
+// maxHeaderLines is how many lines from the top of a tab's content are
+// searched for its tuning and capo, which keeps a lyric which happens to
+// mention a capo further down from being mistaken for one.
+const maxHeaderLines = 40
+
+var (
+	// capoPattern matches a capo, such as "Capo 3", "capo: 3rd fret",
+	// "Capo on the 2nd fret", "Capo III" or "Capo: none". The fret is
+	// captured.
+	capoPattern = regexp.MustCompile(`(?i)\bcapo\b[\s:=-]*(?:(?:on|at)\s+)?(?:the\s+)?(?:fret\s*)?(\d{1,2}|[ivx]{1,5}|none|no)(?:st|nd|rd|th)?\b`)
+
+	// tuningPattern matches a tuning, such as "Tuning: DADGAD", "Tuned to
+	// Drop D" or "Tuning = E A D G B E". The tuning is captured.
+	tuningPattern = regexp.MustCompile(`(?i)\b(?:tuning\s*[:=-]|tuned\s+(?:to|in)\b:?)\s*(.+)$`)
+
+	// tuningEnd matches where a tuning ends when something else follows it
+	// on the same line, such as "Tuning: DADGAD   Capo: 2" or "Tuning: Drop
+	// D (D A D G B E)".
+	tuningEnd = regexp.MustCompile(`\s{2,}|\t|\s*[|(\[;]`)
+
+	// tuningNote matches a single note of a tuning, such as "E", "F#" or
+	// "Bb". A flat is only recognised after a capital letter, so that "gb"
+	// in "eadgbe" isn't mistaken for G flat.
+	tuningNote = regexp.MustCompile(`^(?:[A-G](?:#|♯|b|♭)?|[a-g](?:#|♯|♭)?)`)
+)
+
+// namedTunings are the standard forms of the tunings which have a common
+// name, keyed by their notes from the lowest string up.
+var namedTunings = map[string]string{
+	"EADGBE":       "Standard",
+	"DADGBE":       "Drop D",
+	"CGCFAD":       "Drop C",
+	"EbAbDbGbBbEb": "Eb Standard",
+	"D#G#C#F#A#D#": "Eb Standard",
+	"DGCFAD":       "D Standard",
+	"DGDGBD":       "Open G",
+	"DADF#AD":      "Open D",
+	"EBEG#BE":      "Open E",
+	"CGCGCE":       "Open C",
+}
+
+// tuningAliases are the standard forms of the ways of writing a tuning's
+// name which aren't just its name in a different case, keyed by how they
+// look once they have been lower cased and their spaces and hyphens have
+// been tidied up.
+var tuningAliases = map[string]string{
+	"std":               "Standard",
+	"e standard":        "Standard",
+	"standard e":        "Standard",
+	"normal":            "Standard",
+	"dropd":             "Drop D",
+	"half step down":    "Eb Standard",
+	"1/2 step down":     "Eb Standard",
+	"down a half step":  "Eb Standard",
+	"down 1/2 step":     "Eb Standard",
+	"e flat":            "Eb Standard",
+	"eb":                "Eb Standard",
+	"whole step down":   "D Standard",
+	"down a whole step": "D Standard",
+}
+
+// detectTuning finds the tuning and capo which a tab's content says to use.
+// The tuning is given in its standard form, and is empty if the content
+// doesn't say, and the capo is the fret it goes on, or 0 if the content
+// doesn't say or there isn't one.
+func detectTuning(content string) (string, int) {
+	tuning, capo := "", 0
+	foundCapo := false
+
+	lines := strings.SplitN(content, "\n", maxHeaderLines+1)
+	if len(lines) > maxHeaderLines {
+		lines = lines[:maxHeaderLines]
+	}
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+
+		if tuning == "" {
+			if match := tuningPattern.FindStringSubmatch(line); match != nil {
+				// The rest of the line might hold a capo too.
+				value := match[1]
+				if end := tuningEnd.FindStringIndex(value); end != nil && end[0] > 0 {
+					value = value[:end[0]]
+				}
+
+				tuning = canonicalTuning(value)
+			}
+		}
+
+		if !foundCapo {
+			if match := capoPattern.FindStringSubmatch(line); match != nil {
+				if fret, ok := parseCapo(match[1]); ok {
+					capo, foundCapo = fret, true
+				}
+			}
+		}
+
+		if tuning != "" && foundCapo {
+			break
+		}
+	}
+
+	return tuning, capo
+}
+
+// parseCapo returns the fret which a capo was written as being on, which can
+// be a number, a Roman numeral, or "none" or "no" for no capo. The second
+// return value is false if it isn't a sensible fret.
+func parseCapo(text string) (int, bool) {
+	text = strings.ToLower(text)
+
+	if text == "none" || text == "no" {
+		return 0, true
+	}
+
+	fret, err := strconv.Atoi(text)
+	if err != nil {
+		fret = parseRomanNumeral(text)
+	}
+
+	return fret, fret > 0 && fret <= maxCapo
+}
+
+// parseRomanNumeral returns the value of a lower case Roman numeral made of
+// i, v and x, or 0 if it isn't a valid one.
+func parseRomanNumeral(text string) int {
+	values := map[byte]int{'i': 1, 'v': 5, 'x': 10}
+	total := 0
+
+	for i := 0; i < len(text); i++ {
+		value, ok := values[text[i]]
+		if !ok {
+			return 0
+		}
+
+		if i+1 < len(text) && values[text[i+1]] > value {
+			total -= value
+		} else {
+			total += value
+		}
+	}
+
+	// Numerals like "iiiii" and "vx" add up to something, but aren't
+	// written like that, so they're turned away by writing the total back
+	// out and checking it matches.
+	if formatRomanNumeral(total) != text {
+		return 0
+	}
+
+	return total
+}
+
+// formatRomanNumeral writes a number between 1 and 39 as a lower case Roman
+// numeral.
+func formatRomanNumeral(number int) string {
+	ones := []string{"", "i", "ii", "iii", "iv", "v", "vi", "vii", "viii", "ix"}
+
+	if number <= 0 || number >= 40 {
+		return ""
+	}
+
+	return strings.Repeat("x", number/10) + ones[number%10]
+}
+
+// canonicalTuning returns the standard form of a tuning, so that tunings which
+// were written differently can be compared. A tuning written as its notes,
+// such as "D A D G A D" or "dadgad", is written as the notes run together,
+// like "DADGAD", unless it has a common name, like "Drop D". Otherwise, the
+// name is tidied up and given capital letters, so that "drop-d", "Drop D
+// tuning" and "DROP D" all become "Drop D".
+func canonicalTuning(tuning string) string {
+	tuning = strings.Trim(tuning, " ()[].:;,")
+	if tuning == "" {
+		return ""
+	}
+
+	if notes, ok := tuningNotes(tuning); ok {
+		if name, ok := namedTunings[notes]; ok {
+			return name
+		}
+
+		return notes
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(tuning), func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-' || r == '_'
+	})
+
+	tidied := strings.Join(words, " ")
+
+	if alias, ok := tuningAliases[tidied]; ok {
+		return alias
+	}
+
+	tidied = strings.TrimSuffix(tidied, " tuning")
+
+	if alias, ok := tuningAliases[tidied]; ok {
+		return alias
+	}
+
+	for i, word := range words {
+		if word == "tuning" && i == len(words)-1 {
+			words = words[:i]
+			break
+		}
+
+		first, size := utf8.DecodeRuneInString(word)
+		words[i] = string(unicode.ToUpper(first)) + word[size:]
+	}
+
+	return strings.Join(words, " ")
+}
+
+// tuningNotes reads a tuning which is written as the notes of each string,
+// either run together or separated by spaces, hyphens or commas, and returns
+// them run together, with capital letters and '#' or 'b' for sharps and
+// flats. The second return value is false if the tuning isn't written as
+// between four and eight notes.
+func tuningNotes(tuning string) (string, bool) {
+	fields := strings.FieldsFunc(tuning, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-' || r == ','
+	})
+
+	var notes []string
+
+	for _, field := range fields {
+		for field != "" {
+			note := tuningNote.FindString(field)
+			if note == "" {
+				return "", false
+			}
+
+			field = field[len(note):]
+
+			note = strings.NewReplacer("♯", "#", "♭", "b").Replace(note)
+			notes = append(notes, strings.ToUpper(note[:1])+note[1:])
+		}
+	}
+
+	if len(notes) < 4 || len(notes) > 8 {
+		return "", false
+	}
+
+	return strings.Join(notes, ""), true
+}
+
+// tabTuning returns the tuning which the tab uses: the one in its practice
+// metadata if the admin has set one, and otherwise the one in its content.
+func tabTuning(tab *Tab) string {
+	if tab.Practice.Tuning != "" {
+		return canonicalTuning(tab.Practice.Tuning)
+	}
+
+	return tab.Tuning
+}
+
+// filterTuning returns the tabs which use the given tuning, however it is
+// written.
+func filterTuning(tabs []*Tab, tuning string) []*Tab {
+	tuning = canonicalTuning(tuning)
+	filtered := make([]*Tab, 0, len(tabs))
+
+	for _, tab := range tabs {
+		if strings.EqualFold(tabTuning(tab), tuning) {
+			filtered = append(filtered, tab)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,63 @@
+package src
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectTuning(t *testing.T) {
+	cases := []struct {
+		content string
+		tuning  string
+		capo    int
+	}{
+		{"Tuning: DADGAD\nCapo 3", "DADGAD", 3},
+		{"Tuning: E A D G B E", "Standard", 0},
+		{"Tuning = e-a-d-g-b-e", "Standard", 0},
+		{"Tuned to drop-d", "Drop D", 0},
+		{"tuning: Drop D tuning", "Drop D", 0},
+		{"Tuning: half step down", "Eb Standard", 0},
+
+		// The same tuning written with flats or with sharps is found as the
+		// same tuning.
+		{"Tuning: Eb Ab Db Gb Bb Eb", "Eb Standard", 0},
+		{"Tuning: D# G# C# F# A# D#", "Eb Standard", 0},
+		{"Tuning: E♭ A♭ D♭ G♭ B♭ E♭", "Eb Standard", 0},
+
+		// "gb" in lower case notes is G and B, not G flat.
+		{"Tuning: eadgbe", "Standard", 0},
+
+		// A tuning without a name is written as its notes run together.
+		{"Tuning: C G D G B D", "CGDGBD", 0},
+
+		// Something else on the same line isn't part of the tuning.
+		{"Tuning: DADGAD   Capo: 2", "DADGAD", 2},
+		{"Tuning: Drop D (D A D G B E)", "Drop D", 0},
+
+		{"Capo on the 2nd fret", "", 2},
+		{"capo: 5th fret", "", 5},
+		{"Capo III", "", 3},
+		{"Capo: none", "", 0},
+
+		// A capo further up the neck than any guitar goes isn't one.
+		{"Capo 30", "", 0},
+
+		{"", "", 0},
+		{"Just some lyrics\nwith no tuning at all", "", 0},
+	}
+
+	for _, c := range cases {
+		tuning, capo := detectTuning(c.content)
+		if tuning != c.tuning || capo != c.capo {
+			t.Errorf("%q: expected %q and %d, got %q and %d", c.content, c.tuning, c.capo, tuning, capo)
+		}
+	}
+}
+
+func TestDetectTuningOnlyNearTheTop(t *testing.T) {
+	content := strings.Repeat("la la la\n", maxHeaderLines) + "Tuning: DADGAD\nCapo 2"
+
+	if tuning, capo := detectTuning(content); tuning != "" || capo != 0 {
+		t.Errorf("expected nothing to be found so far down, got %q and %d", tuning, capo)
+	}
+}
@@ -0,0 +1,244 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The utility endpoints run the same steps which the server uses to read a
+// tab from its file on a filename or content given in the request, and
+// respond with the result, without reading or writing any files or caching
+// anything. They let the settings page preview changes to the filename
+// patterns or the transform script before they're saved, and let scripts
+// outside the server parse filenames exactly as it would.
+//
+// Each of them uses the current settings, but any of the settings which they
+// use can be given in the request instead, in the same form values as for
+// /api/v1/change-settings: 'filename-patterns', 'folder-metadata',
+// 'characters-to-remove', 'non-capital-words', 'auto-tag-rules',
+// 'transform-script' and 'transform-script-timeout'.
+
+// previewSettings returns the settings to use for a request to one of the
+// utility endpoints, which are the current settings with any of them which
+// were given in the request replaced. An error is returned if the settings
+// aren't valid, as they would be if they were saved.
+func (s *Server) previewSettings(r *http.Request) (*Settings, error) {
+	settings := *s.Settings
+
+	if value, ok := r.PostForm["filename-patterns"]; ok && len(value) > 0 {
+		settings.FilenamePatterns = nil
+		if err := json.Unmarshal([]byte(value[0]), &settings.FilenamePatterns); err != nil {
+			return nil, invalidSetting("the filename patterns are invalid: %s", err)
+		}
+	}
+
+	// Folder names are ignored when the option is empty, so it is used as
+	// long as it was given at all.
+	if value, ok := r.PostForm["folder-metadata"]; ok && len(value) > 0 {
+		settings.FolderMetadata = value[0]
+	}
+
+	if value, ok := r.PostForm["characters-to-remove"]; ok && len(value) > 0 {
+		settings.CharactersToRemove = value[0]
+	}
+
+	if value, ok := r.PostForm["non-capital-words"]; ok && len(value) > 0 {
+		settings.NonCapitalWords = nil
+		if err := json.Unmarshal([]byte(value[0]), &settings.NonCapitalWords); err != nil {
+			return nil, invalidSetting("the non-capital words are invalid: %s", err)
+		}
+	}
+
+	if value, ok := r.PostForm["auto-tag-rules"]; ok && len(value) > 0 {
+		settings.AutoTagRules = nil
+		if err := json.Unmarshal([]byte(value[0]), &settings.AutoTagRules); err != nil {
+			return nil, invalidSetting("the auto-tag rules are invalid: %s", err)
+		}
+	}
+
+	if value, ok := r.PostForm["transform-script"]; ok && len(value) > 0 {
+		settings.TransformScript = value[0]
+	}
+
+	if value := r.PostFormValue("transform-script-timeout"); value != "" {
+		timeout, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, invalidSetting("the transform script timeout must be a whole number of milliseconds, from 1 to %d", maxTransformScriptTimeout)
+		}
+
+		settings.TransformScriptTimeout = timeout
+	}
+
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+// A parsedFilename is what a filename is parsed as.
+type parsedFilename struct {
+	// Matched is whether the filename matches any of the patterns, and
+	// Pattern is the first one which it matches.
+	Matched bool   `json:"matched"`
+	Pattern string `json:"pattern"`
+
+	// Title, Artist and Tags are what the filename says, and the display
+	// ones are how the title and artist are shown, once the characters to
+	// remove have been removed and the words have been capitalised.
+	Title         string   `json:"title"`
+	Artist        string   `json:"artist"`
+	Tags          []string `json:"tags"`
+	DisplayTitle  string   `json:"displayTitle"`
+	DisplayArtist string   `json:"displayArtist"`
+}
+
+// parseFilenameWith parses a filename with the given settings.
+func parseFilenameWith(filename string, settings *Settings) parsedFilename {
+	var parsed parsedFilename
+
+	parsed.Title, parsed.Artist, parsed.Tags, parsed.Pattern, parsed.Matched = parseTabFilename(
+		filename, tokenizePatterns(settings.FilenamePatterns), settings.FolderMetadata,
+	)
+
+	if parsed.Tags == nil {
+		parsed.Tags = []string{}
+	}
+
+	parsed.DisplayTitle = transformString(parsed.Title, settings.CharactersToRemove, settings.NonCapitalWords)
+	parsed.DisplayArtist = transformString(parsed.Artist, settings.CharactersToRemove, settings.NonCapitalWords)
+
+	return parsed
+}
+
+// utilityRequest parses the form of a request to one of the utility
+// endpoints, and returns the settings to use for it and the filename it gives,
+// which it must. If it can't, the error is written to the response and nil is
+// returned.
+func (s *Server) utilityRequest(w http.ResponseWriter, r *http.Request) (*Settings, string) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, ""
+	}
+
+	settings, err := s.previewSettings(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, ""
+	}
+
+	filename := strings.TrimSpace(r.PostFormValue("filename"))
+	if filename == "" {
+		writeError(w, http.StatusBadRequest, errors.New("a filename needs to be given as 'filename'"))
+		return nil, ""
+	}
+
+	return settings, filename
+}
+
+// handleParseFilenameAPI is called to respond to a HTTP request to
+// /api/v1/util/parse-filename. It responds with what the filename in the
+// 'filename' form value would be parsed as, encoded in JSON.
+func (s *Server) handleParseFilenameAPI(w http.ResponseWriter, r *http.Request) {
+	settings, filename := s.utilityRequest(w, r)
+	if settings == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(parseFilenameWith(filename, settings))
+}
+
+// A transformPreview is what a tab would be once it had been read and the
+// transform script had been run on it.
+type transformPreview struct {
+	// Filename is what the tab's filename was parsed as. If it didn't
+	// match any of the patterns, the tab would be left out, but it is
+	// still transformed, with the filename as its title, so that the
+	// script can be tried out.
+	Filename parsedFilename `json:"filename"`
+
+	Title    string   `json:"title"`
+	Artist   string   `json:"artist"`
+	Tags     []string `json:"tags"`
+	Content  string   `json:"content"`
+	Language string   `json:"language"`
+	Explicit bool     `json:"explicit"`
+	Tuning   string   `json:"tuning"`
+	Capo     int      `json:"capo"`
+	Chords   []string `json:"chords"`
+
+	// Output is what the script printed, a line at a time, and Error is
+	// why it failed, if it did, in which case the tab is as it would be
+	// without the script, as when reading it from its file.
+	Output []string `json:"output"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// handleTransformAPI is called to respond to a HTTP request to
+// /api/v1/util/transform. It reads a tab with the filename in the 'filename'
+// form value and the content in the 'content' form value, adds the tags from
+// the auto-tag rules, runs the transform script on it and applies the tag
+// rules, as happens when a tab is read from its file, and responds with the
+// result, encoded in JSON. Only text tabs can be previewed.
+func (s *Server) handleTransformAPI(w http.ResponseWriter, r *http.Request) {
+	settings, filename := s.utilityRequest(w, r)
+	if settings == nil {
+		return
+	}
+
+	parsed := parseFilenameWith(filename, settings)
+
+	tab := &Tab{
+		Title:    parsed.Title,
+		Artist:   parsed.Artist,
+		Tags:     parsed.Tags,
+		Filename: filename,
+		Pattern:  parsed.Pattern,
+	}
+
+	if !parsed.Matched {
+		name := path.Base(filename)
+		tab.Title = strings.TrimSuffix(name, path.Ext(name))
+	}
+
+	if err := tab.setContent([]byte(r.PostFormValue("content"))); err != nil || tab.Binary {
+		writeError(w, http.StatusBadRequest, errors.New("only text tabs can be previewed"))
+		return
+	}
+
+	tab.applyAutoTags(settings.AutoTagRules)
+
+	preview := transformPreview{Filename: parsed, Output: []string{}}
+
+	transformed := *tab
+	if err := runTransformScript(&transformed, settings.TransformScript, settings.TransformScriptTimeout, func(line string) {
+		preview.Output = append(preview.Output, line)
+	}); err != nil {
+		preview.Error = err.Error()
+	} else {
+		tab = &transformed
+	}
+
+	// The tag rules are only read, never changed.
+	tags, err := s.applyTagRules(tab.Tags)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	preview.Title, preview.Artist, preview.Tags = tab.Title, tab.Artist, tags
+	preview.Content, preview.Language, preview.Explicit = tab.Content, tab.Language, tab.Explicit
+	preview.Tuning, preview.Capo, preview.Chords = tab.Tuning, tab.Capo, tab.Chords
+
+	if preview.Tags == nil {
+		preview.Tags = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
@@ -0,0 +1,376 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A large collection gathers tabs with poor metadata over time: files whose
+// names didn't fit the filename patterns very well, so that the artist is
+// missing or the tags have been left in the title, placeholder titles like
+// "Untitled 3", the same song saved twice, and empty files. The validation
+// report at /api/v1/validate-collection finds them in the cached tabs, and
+// says which requests to the API would fix each one, so that the admin can
+// tidy the collection up every so often. Only the cache is looked at, so new
+// files should be picked up with a rescan first.
+
+// These are the kinds of problem which the validation report looks for, in
+// the order they are reported in.
+const (
+	validationEmptyArtist  = "empty-artist"
+	validationUntitled     = "untitled"
+	validationDuplicate    = "duplicate"
+	validationUnparsedTags = "unparsed-tags"
+	validationEmptyContent = "empty-content"
+)
+
+// validationKinds lists the kinds of problem in the order they are reported
+// in.
+var validationKinds = []string{
+	validationEmptyArtist,
+	validationUntitled,
+	validationDuplicate,
+	validationUnparsedTags,
+	validationEmptyContent,
+}
+
+var (
+	// placeholderTitles are the titles which are given to tabs which were
+	// never named properly, once any numbers and punctuation have been
+	// taken off the end, like "Untitled 3" or "Track 01".
+	placeholderTitles = map[string]bool{
+		"untitled":  true,
+		"unknown":   true,
+		"no title":  true,
+		"new tab":   true,
+		"new file":  true,
+		"track":     true,
+		"new song":  true,
+		"new track": true,
+	}
+
+	// placeholderArtists are the artists which are as good as none.
+	placeholderArtists = map[string]bool{
+		"unknown":         true,
+		"unknown artist":  true,
+		"various":         true,
+		"various artists": true,
+		"artist":          true,
+	}
+)
+
+// unparsedTagCharacters are the characters which shouldn't be in a tag, or in
+// a title or an artist, since they are only left there by a filename pattern
+// which didn't pick the tags out properly, like "[rock] Song" or the tag
+// "rock, pop".
+const unparsedTagCharacters = "[]{}|;,"
+
+// A validationReport is the result of validating the collection.
+type validationReport struct {
+	// Checked is how many tabs were checked, and Generated is when.
+	Checked   int       `json:"checked"`
+	Generated time.Time `json:"generated"`
+
+	// Counts is how many problems of each kind were found.
+	Counts map[string]int `json:"counts"`
+
+	Issues []*validationIssue `json:"issues"`
+}
+
+// A validationIssue is a problem with the metadata of one tab, or of a few
+// tabs which are duplicates of each other, along with how to fix it.
+type validationIssue struct {
+	Kind    string           `json:"kind"`
+	Message string           `json:"message"`
+	Tabs    []validationTab  `json:"tabs"`
+	Fixes   []*validationFix `json:"fixes"`
+}
+
+// A validationTab identifies a tab with a problem, with a link to it.
+type validationTab struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Filename string `json:"filename"`
+	Link     string `json:"link"`
+}
+
+// A validationFix is a request which would fix a problem, such as merging
+// two duplicates, or would help to, such as suggesting better filename
+// patterns. Form holds the form values to send with it, and any which are
+// empty have to be filled in by the admin.
+type validationFix struct {
+	Description string            `json:"description"`
+	Method      string            `json:"method"`
+	Path        string            `json:"path"`
+	Form        map[string]string `json:"form,omitempty"`
+}
+
+// newValidationTab returns how a tab is identified in the validation report.
+func newValidationTab(tab *Tab) validationTab {
+	return validationTab{
+		ID:       tab.ID,
+		Title:    tab.Title,
+		Artist:   tab.Artist,
+		Filename: tab.Filename,
+		Link:     "/api/v1/tab/" + tab.ID,
+	}
+}
+
+// inferPatternsFix suggests better filename patterns, which fixes the
+// problems which come from filenames that weren't parsed well.
+var inferPatternsFix = &validationFix{
+	Description: "The title, artist and tags come from the filename, so suggest filename patterns which might parse it better, or rename the file",
+	Method:      "POST",
+	Path:        "/api/v1/pattern/infer",
+}
+
+// isPlaceholder says whether a title or an artist is one of the given
+// placeholders, once any numbers and punctuation on the end have been taken
+// off.
+func isPlaceholder(name string, placeholders map[string]bool) bool {
+	name = strings.TrimRightFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	return placeholders[strings.Join(strings.Fields(name), " ")]
+}
+
+// duplicateKey returns what two tabs have in common if they are the same
+// song, which is their title and artist, ignoring case and spacing.
+func duplicateKey(tab *Tab) string {
+	normalise := func(s string) string {
+		return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	}
+
+	return normalise(tab.Artist) + "\x00" + normalise(tab.Title)
+}
+
+// validateTab returns the problems with a single tab's metadata, leaving out
+// duplicates, which can only be found by looking at every tab.
+func validateTab(tab *Tab) []*validationIssue {
+	var issues []*validationIssue
+
+	one := []validationTab{newValidationTab(tab)}
+
+	if artist := strings.TrimSpace(tab.Artist); artist == "" || isPlaceholder(artist, placeholderArtists) {
+		issues = append(issues, &validationIssue{
+			Kind:    validationEmptyArtist,
+			Message: "the tab has no artist",
+			Tabs:    one,
+			Fixes:   []*validationFix{inferPatternsFix},
+		})
+	}
+
+	if title := strings.TrimSpace(tab.Title); title == "" || isPlaceholder(title, placeholderTitles) {
+		issues = append(issues, &validationIssue{
+			Kind:    validationUntitled,
+			Message: "the tab has no proper title",
+			Tabs:    one,
+			Fixes:   []*validationFix{inferPatternsFix},
+		})
+	}
+
+	if strings.ContainsAny(tab.Title, unparsedTagCharacters) || strings.ContainsAny(tab.Artist, unparsedTagCharacters) {
+		issues = append(issues, &validationIssue{
+			Kind:    validationUnparsedTags,
+			Message: "the title or artist looks like it has tags in it",
+			Tabs:    one,
+			Fixes:   []*validationFix{inferPatternsFix},
+		})
+	}
+
+	for _, tag := range tab.Tags {
+		if strings.TrimSpace(tag) != "" && !strings.ContainsAny(tag, unparsedTagCharacters) {
+			continue
+		}
+
+		issues = append(issues, &validationIssue{
+			Kind:    validationUnparsedTags,
+			Message: fmt.Sprintf("the tag %q looks like it wasn't split up or picked out properly", tag),
+			Tabs:    one,
+			Fixes: []*validationFix{
+				{
+					Description: "Rename the tag on every tab which has it",
+					Method:      "POST",
+					Path:        "/api/v1/rename-tag",
+					Form:        map[string]string{"tag": tag, "to": strings.TrimSpace(strings.Trim(tag, "[]{}()"))},
+				},
+				{
+					Description: "Remove the tag from every tab which has it",
+					Method:      "POST",
+					Path:        "/api/v1/delete-tag",
+					Form:        map[string]string{"tag": tag},
+				},
+				inferPatternsFix,
+			},
+		})
+	}
+
+	// A binary tab has no content, but its file does.
+	if !tab.Binary && strings.TrimSpace(tab.Content) == "" {
+		issues = append(issues, &validationIssue{
+			Kind:    validationEmptyContent,
+			Message: "the tab's file is empty",
+			Tabs:    one,
+			Fixes: []*validationFix{
+				{
+					Description: "Write the tab's content in the editor",
+					Method:      "GET",
+					Path:        "/edit/" + tab.ID,
+				},
+				{
+					Description: "Delete the tab and its file",
+					Method:      "POST",
+					Path:        "/api/v1/delete-tab",
+					Form:        map[string]string{"id": tab.ID},
+				},
+			},
+		})
+	}
+
+	return issues
+}
+
+// validateDuplicates returns an issue for each song which there is more than
+// one tab of. The one which was added first is suggested as the one to keep,
+// and the others to be merged into it. Tabs without a proper title aren't
+// counted, since they are already reported, and would all look the same.
+func validateDuplicates(tabs []*Tab) []*validationIssue {
+	songs := make(map[string][]*Tab)
+
+	for _, tab := range tabs {
+		if strings.TrimSpace(tab.Title) == "" || isPlaceholder(tab.Title, placeholderTitles) {
+			continue
+		}
+
+		key := duplicateKey(tab)
+		songs[key] = append(songs[key], tab)
+	}
+
+	var issues []*validationIssue
+
+	for _, copies := range songs {
+		if len(copies) < 2 {
+			continue
+		}
+
+		sort.Slice(copies, func(i, j int) bool {
+			if !copies[i].Added.Equal(copies[j].Added) {
+				return copies[i].Added.Before(copies[j].Added)
+			}
+
+			return copies[i].Filename < copies[j].Filename
+		})
+
+		keep := copies[0]
+
+		issue := &validationIssue{
+			Kind:    validationDuplicate,
+			Message: fmt.Sprintf("there are %d tabs of %s by %s", len(copies), keep.Title, keep.Artist),
+		}
+
+		for _, tab := range copies {
+			issue.Tabs = append(issue.Tabs, newValidationTab(tab))
+		}
+
+		for _, tab := range copies[1:] {
+			issue.Fixes = append(issue.Fixes, &validationFix{
+				Description: fmt.Sprintf("Merge %s into %s, which was added first", tab.Filename, keep.Filename),
+				Method:      "POST",
+				Path:        "/api/v1/merge-tabs",
+				Form:        map[string]string{"keep": keep.ID, "remove": tab.ID},
+			})
+		}
+
+		issues = append(issues, issue)
+	}
+
+	return issues
+}
+
+// validateCollection checks the metadata of every given tab, and returns the
+// report of what was found. If kinds isn't empty, only those kinds of problem
+// are reported.
+func validateCollection(tabs []*Tab, kinds map[string]bool) *validationReport {
+	report := &validationReport{
+		Checked:   len(tabs),
+		Generated: time.Now(),
+		Counts:    make(map[string]int),
+		Issues:    []*validationIssue{},
+	}
+
+	issues := validateDuplicates(tabs)
+	for _, tab := range tabs {
+		issues = append(issues, validateTab(tab)...)
+	}
+
+	for _, issue := range issues {
+		if len(kinds) == 0 || kinds[issue.Kind] {
+			report.Issues = append(report.Issues, issue)
+		}
+	}
+
+	// The issues are grouped by kind, and each kind is in order of the
+	// filename of the first tab it is about.
+	order := make(map[string]int)
+	for i, kind := range validationKinds {
+		order[kind] = i
+	}
+
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.Kind != b.Kind {
+			return order[a.Kind] < order[b.Kind]
+		}
+
+		return a.Tabs[0].Filename < b.Tabs[0].Filename
+	})
+
+	for _, kind := range validationKinds {
+		report.Counts[kind] = 0
+	}
+
+	for _, issue := range report.Issues {
+		report.Counts[issue.Kind]++
+	}
+
+	return report
+}
+
+// handleValidateCollectionAPI is called to respond to a HTTP request to
+// /api/v1/validate-collection. It responds with a report of the tabs with
+// suspicious metadata, encoded in JSON. The 'kind' query value can be given
+// any number of times to only report some kinds of problem.
+func (s *Server) handleValidateCollectionAPI(w http.ResponseWriter, r *http.Request) {
+	kinds := make(map[string]bool)
+
+	for _, kind := range r.URL.Query()["kind"] {
+		known := false
+		for _, k := range validationKinds {
+			known = known || k == kind
+		}
+
+		if !known {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("there is no kind of problem called %q; the kinds are %s", kind, strings.Join(validationKinds, ", ")))
+			return
+		}
+
+		kinds[kind] = true
+	}
+
+	tabs, err := s.cachedTabs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(validateCollection(tabs, kinds))
+}
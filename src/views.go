@@ -0,0 +1,349 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A view is a named way of listing the tabs, set up by the admin, which says
+// how they are sorted, which of them are included and which of their fields
+// are sent. Each view is served at /api/v1/views/{name}, so that a client
+// such as a kiosk or the stage tablet can always ask for the same path rather
+// than each of them building the same query string. The views are kept in
+// the 'views' hashmap, which maps each view's name to it encoded in JSON.
+type view struct {
+	// Sort is the field which the tabs are sorted by, which is one of the
+	// viewSorts, starting with '-' to sort them the other way round. If it
+	// is empty, the tabs are in the same order as /api/v1/tabs.
+	Sort string `json:"sort"`
+
+	// Tags are the tags which a tab must have all of to be included, and
+	// Language is the language which it must be in, if it isn't empty.
+	Tags     []string `json:"tags"`
+	Language string   `json:"lang"`
+
+	// Fields are the tabs' JSON fields which are sent, such as "title" and
+	// "artist". If there aren't any, all of them are sent.
+	Fields []string `json:"fields"`
+
+	// Limit is the most tabs which are sent, after they have been sorted.
+	// If it is 0, all of them are.
+	Limit int `json:"limit"`
+}
+
+// viewSorts maps each field which a view can sort the tabs by to the
+// function which says whether one tab comes before another by that field.
+var viewSorts = map[string]func(a, b *Tab) bool{
+	"title": func(a, b *Tab) bool {
+		return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+	},
+	"artist": func(a, b *Tab) bool {
+		return strings.ToLower(a.Artist) < strings.ToLower(b.Artist)
+	},
+	"added": func(a, b *Tab) bool {
+		return a.Added.Before(b.Added)
+	},
+	"filename": func(a, b *Tab) bool {
+		return a.Filename < b.Filename
+	},
+}
+
+// viewNamePattern is what a view's name has to match, so that it can be used
+// in a path as it is.
+var viewNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// tabFields returns the names of the fields which a tab has in JSON.
+func tabFields() map[string]bool {
+	fields := make(map[string]bool)
+	tabType := reflect.TypeOf(Tab{})
+
+	for i := 0; i < tabType.NumField(); i++ {
+		name := strings.Split(tabType.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+
+	return fields
+}
+
+// validate checks that everything in the view is allowed.
+func (v *view) validate() error {
+	if v.Sort != "" {
+		if _, ok := viewSorts[strings.TrimPrefix(v.Sort, "-")]; !ok {
+			return fmt.Errorf("the tabs can't be sorted by %s", v.Sort)
+		}
+	}
+
+	fields := tabFields()
+	for _, field := range v.Fields {
+		if !fields[field] {
+			return fmt.Errorf("tabs don't have a field called %s", field)
+		}
+	}
+
+	if v.Limit < 0 {
+		return errors.New("the limit can't be negative")
+	}
+
+	return nil
+}
+
+// apply returns the tabs which the view includes, in its order. The tabs
+// aren't changed, but the returned slice is a new one.
+func (v *view) apply(tabs []*Tab) []*Tab {
+	included := make([]*Tab, 0, len(tabs))
+
+	for _, tab := range tabs {
+		if v.Language != "" && tab.Language != v.Language {
+			continue
+		} else if !hasAllTags(tab, v.Tags) {
+			continue
+		}
+
+		included = append(included, tab)
+	}
+
+	if v.Sort != "" {
+		less := viewSorts[strings.TrimPrefix(v.Sort, "-")]
+		descending := strings.HasPrefix(v.Sort, "-")
+
+		// The sort is stable, so tabs which are the same by the view's
+		// field stay in the order they were in.
+		sort.SliceStable(included, func(i, j int) bool {
+			if descending {
+				return less(included[j], included[i])
+			}
+
+			return less(included[i], included[j])
+		})
+	}
+
+	if v.Limit > 0 && len(included) > v.Limit {
+		included = included[:v.Limit]
+	}
+
+	return included
+}
+
+// hasAllTags reports whether the tab has every one of the tags, ignoring
+// case.
+func hasAllTags(tab *Tab, tags []string) bool {
+	for _, wanted := range tags {
+		found := false
+
+		for _, tag := range tab.Tags {
+			if strings.EqualFold(tag, wanted) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encode encodes the tabs as a JSON list, with only the view's fields.
+func (v *view) encode(tabs []*Tab) ([]byte, error) {
+	if len(v.Fields) == 0 {
+		return json.Marshal(tabs)
+	}
+
+	selected := make([]map[string]json.RawMessage, len(tabs))
+
+	for i, tab := range tabs {
+		encoded, err := json.Marshal(tab)
+		if err != nil {
+			return nil, err
+		}
+
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(encoded, &all); err != nil {
+			return nil, err
+		}
+
+		selected[i] = make(map[string]json.RawMessage, len(v.Fields))
+		for _, field := range v.Fields {
+			selected[i][field] = all[field]
+		}
+	}
+
+	return json.Marshal(selected)
+}
+
+// views returns every view, by name.
+func (s *Server) views() (map[string]*view, error) {
+	return s.Store.Views()
+}
+
+// getView returns the view with the given name, along with its JSON, which
+// changes whenever the view does. The third return value is false if there
+// is no such view.
+func (s *Server) getView(name string) (*view, []byte, bool, error) {
+	v, ok, err := s.Store.View(name)
+	if err != nil || !ok {
+		return nil, nil, false, err
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return v, encoded, true, nil
+}
+
+// setView stores a view, replacing any which already has the same name.
+func (s *Server) setView(name string, v *view) error {
+	if !viewNamePattern.MatchString(name) {
+		return errors.New("a view's name must only have letters, digits, '-' and '_'")
+	}
+
+	if err := v.validate(); err != nil {
+		return err
+	}
+
+	return s.Store.PutView(name, v)
+}
+
+// deleteView removes the view with the given name. The second return value
+// is false if there was no such view.
+func (s *Server) deleteView(name string) (bool, error) {
+	return s.Store.DeleteView(name)
+}
+
+// viewETag returns the ETag of a view's list of tabs, which changes along
+// with the collection, the view itself, and which tabs are left out.
+func viewETag(version int64, explicit, licensed bool, definition []byte) string {
+	sum := sha256.Sum256(definition)
+	etag := tabsETag(version, explicit, licensed)
+
+	return strings.TrimSuffix(etag, `"`) + "-" + hex.EncodeToString(sum[:4]) + `"`
+}
+
+// handleViewsAPI is called to respond to a HTTP request to /api/v1/views. A
+// GET request responds with every view by name, encoded in JSON. A POST
+// request sets the view with the name in the 'name' form value to the JSON
+// object in the 'view' form value, such as
+// {"sort": "-added", "tags": ["rock"], "fields": ["title", "artist"]}, and a
+// DELETE request removes the view in the 'name' query value.
+func (s *Server) handleViewsAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		views, err := s.views()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(views)
+
+	case "POST":
+		v := &view{}
+
+		decoder := json.NewDecoder(strings.NewReader(r.PostFormValue("view")))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(v); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("the view must be a JSON object"))
+			return
+		}
+
+		if err := s.setView(r.PostFormValue("name"), v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+	case "DELETE":
+		found, err := s.deleteView(r.FormValue("name"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if !found {
+			writeError(w, http.StatusNotFound, errViewNotFound)
+			return
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET, POST and DELETE are supported"))
+	}
+}
+
+// handleViewAPI is called to respond to a HTTP request to
+// /api/v1/views/{name}. It responds with the tabs in the view with that name,
+// encoded in JSON, in the same way as /api/v1/tabs does, including leaving
+// out the explicit tabs and answering conditional requests.
+func (s *Server) handleViewAPI(w http.ResponseWriter, r *http.Request) {
+	v, definition, ok, err := s.getView(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, errViewNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Content-Type", "application/json")
+
+	tabs, stale, err := s.getTabsOrStale(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if stale {
+		markStale(w)
+	}
+
+	explicit := s.showsExplicit(r)
+	licensed := s.restrictsLicenses(r)
+
+	if !stale {
+		version, err := s.Store.CollectionVersion()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// The view can change without the collection changing, so there
+		// isn't a Last-Modified time, only an ETag.
+		etag := viewETag(version, explicit, licensed, definition)
+		w.Header().Set("ETag", etag)
+
+		if notModified(r, etag, time.Time{}) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if !explicit {
+		tabs = filterExplicit(tabs)
+	}
+
+	if licensed {
+		tabs = s.filterLicensed(tabs)
+	}
+
+	jsonData, err := v.encode(v.apply(tabs))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Write(jsonData)
+}
@@ -0,0 +1,326 @@
+package src
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDelay is how long the watcher waits after the last change to a file
+// before dealing with it. Editors often write a file in several steps, so
+// this avoids reading it while it's only partly written.
+const watchDelay = 250 * time.Millisecond
+
+// startWatcher starts watching the tab directory, and the folders inside it
+// down to the scan depth, for changes, which are then applied to the cache in
+// the background so that it never goes stale.
+func (s *Server) startWatcher() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	s.watcher = watcher
+
+	if err := s.watchDirectory(s.Settings.TabDirectory, s.Settings.ScanDepth); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		s.watchLoop()
+	}()
+
+	return nil
+}
+
+// watchDirectory changes the directory which the watcher is watching, along
+// with the folders inside it down to the given depth, apart from ignored
+// ones. It is called when the watcher is started, and again whenever the
+// settings are changed, since any of the folder settings could change which
+// folders need watching. If the watcher isn't running, it does nothing.
+func (s *Server) watchDirectory(dir string, depth int) error {
+	if s.watcher == nil {
+		return nil
+	}
+
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	// Stop watching the old folders, if there were any. An error here
+	// doesn't matter, since it will usually be because the old folders
+	// don't exist any more.
+	for folder := range s.watchedFolders {
+		s.watcher.Remove(folder)
+	}
+
+	s.watchedDirectory = ""
+	s.watchedFolders = make(map[string]bool)
+
+	_, folders, err := scanDirectory(dir, depth, s.Settings.IgnorePatterns)
+	if err != nil {
+		return err
+	}
+
+	for _, folder := range folders {
+		if err := s.watcher.Add(folder); err != nil {
+			return err
+		}
+
+		s.watchedFolders[folder] = true
+	}
+
+	s.watchedDirectory = dir
+	s.watchedDepth = depth
+
+	return nil
+}
+
+// watchNewFolders starts watching any folders which have appeared inside the
+// watched directory since it was last scanned, and returns the filenames of
+// all of the files which are in it now.
+func (s *Server) watchNewFolders() ([]string, error) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	filenames, folders, err := scanDirectory(s.watchedDirectory, s.watchedDepth, s.Settings.IgnorePatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, folder := range folders {
+		if s.watchedFolders[folder] {
+			continue
+		}
+
+		if err := s.watcher.Add(folder); err != nil {
+			return nil, err
+		}
+
+		s.watchedFolders[folder] = true
+	}
+
+	return filenames, nil
+}
+
+// unwatchFolder stops watching a folder which has been removed or moved. The
+// watcher stops watching deleted folders by itself, but a folder which has
+// been moved would otherwise carry on being watched under its old name.
+func (s *Server) unwatchFolder(folder string) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	if s.watchedFolders[folder] {
+		s.watcher.Remove(folder)
+		delete(s.watchedFolders, folder)
+	}
+}
+
+// ignoresFile reports whether the file with the given filename, or any of
+// the folders it's in, matches one of the ignore patterns.
+func (s *Server) ignoresFile(filename string) bool {
+	for name := filename; name != "."; name = path.Dir(name) {
+		if isIgnored(name, s.Settings.IgnorePatterns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watchedFilename turns the path of a file which the watcher has seen a
+// change to into a filename relative to the tab directory. The second return
+// value is false if the file isn't one which should be dealt with, such as a
+// hidden file.
+func (s *Server) watchedFilename(name string) (string, bool) {
+	s.watchLock.Lock()
+	rel, err := filepath.Rel(s.watchedDirectory, name)
+	s.watchLock.Unlock()
+
+	if err != nil {
+		return "", false
+	}
+
+	filename := filepath.ToSlash(rel)
+	if filename == "." || strings.HasPrefix(filename, "../") {
+		return "", false
+	}
+
+	// Hidden files and folders are ignored everywhere else, so they are
+	// ignored by the watcher too.
+	for _, part := range strings.Split(filename, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", false
+		}
+	}
+
+	return filename, true
+}
+
+// watchLoop receives events from the watcher until it is closed. The events
+// for each file are gathered up and dealt with once the file has stopped
+// changing for watchDelay.
+func (s *Server) watchLoop() {
+	var (
+		// timers holds a timer for each file which has changed recently.
+		// Each new event for a file pushes its timer back.
+		timers = make(map[string]*time.Timer)
+
+		// When a file's timer fires, its filename is sent down this channel
+		// so it can be dealt with here, in the same goroutine as the map.
+		fired = make(chan string)
+	)
+
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+
+			filename, ok := s.watchedFilename(event.Name)
+			if !ok {
+				continue
+			}
+
+			if timer, exists := timers[filename]; exists {
+				timer.Reset(watchDelay)
+				continue
+			}
+
+			timers[filename] = time.AfterFunc(watchDelay, func() {
+				fired <- filename
+			})
+
+		case filename := <-fired:
+			delete(timers, filename)
+
+			if err := s.syncPath(filename, systemActor(systemWatcher)); err != nil {
+				s.logMessage("error", "The change to %s could not be applied to the cache: %s", filename, err)
+			}
+
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			s.logMessage("warn", "warning: error while watching the tab directory: %s", err)
+		}
+	}
+}
+
+// syncPath brings the cache up to date with whatever is at the given path
+// relative to the tab directory, which might be a file or a folder. When a
+// folder appears, it is watched and every file inside it is synced, and when
+// one disappears, every cached file which was inside it is synced, which
+// removes them from the cache. The changes are made on behalf of the given
+// actor.
+func (s *Server) syncPath(filename string, by actor) error {
+	info, err := os.Stat(s.tabPath(filename))
+	if err == nil && !info.IsDir() {
+		return s.syncFile(filename, by)
+	}
+
+	var filenames []string
+
+	if err == nil {
+		if filenames, err = s.watchNewFolders(); err != nil {
+			return err
+		}
+	} else {
+		s.unwatchFolder(s.tabPath(filename))
+
+		// The path might have been a file or a folder, and there's no way
+		// to tell any more, so deal with it as both.
+		cached, err := s.Store.Filenames()
+		if err != nil {
+			return err
+		}
+
+		for inside := range cached {
+			filenames = append(filenames, inside)
+		}
+
+		if err := s.syncFile(filename, by); err != nil {
+			return err
+		}
+	}
+
+	for _, inside := range filenames {
+		if !strings.HasPrefix(inside, filename+"/") {
+			continue
+		}
+
+		if err := s.syncFile(inside, by); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncFile brings the cache up to date with the file with the given name in
+// the tab directory. A new file is parsed and cached, a changed file is
+// re-parsed and its cached data replaced, and a file which has been removed
+// (or renamed, which looks the same from here) is removed from the cache. The
+// changes are made on behalf of the given actor.
+func (s *Server) syncFile(filename string, by actor) error {
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	// Find out whether the file is already cached. If it is, id will be the
+	// ID of its tab.
+	id, cached, err := s.Store.TabID(filename)
+	if err != nil {
+		return err
+	}
+
+	// If the file doesn't exist any more, isn't a regular file, is in a
+	// folder deeper than the scan depth, or is ignored, it should no longer
+	// be in the cache.
+	info, err := os.Stat(s.tabPath(filename))
+	if err != nil || !info.Mode().IsRegular() || len(tabFolders(filename)) > s.Settings.ScanDepth || s.ignoresFile(filename) {
+		if !cached {
+			return nil
+		}
+
+		// A file which seems to have gone might only be missing because
+		// the tab directory has been unmounted.
+		if err != nil {
+			if err := s.checkMounted(); err != nil {
+				return err
+			}
+		}
+
+		_, err := s.uncacheTab(id, by)
+		return err
+	}
+
+	tab, ok, err := s.readTab(filename, tokenizePatterns(s.Settings.FilenamePatterns))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !ok && cached:
+		// The file has been changed so that it no longer matches any
+		// of the patterns, so the old version shouldn't be served any more.
+		_, err := s.uncacheTab(id, by)
+		return err
+
+	case !ok:
+		return nil
+
+	case cached:
+		return s.updateCachedTab(id, tab, by)
+
+	default:
+		return s.cacheNewTab(tab, by)
+	}
+}
@@ -0,0 +1,306 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// A recording's waveform is worked out once, when it is uploaded, so that the
+// page which plays it can draw it without downloading the whole file first.
+// WAV files are read directly, and anything else is decoded with ffmpeg, if
+// it is installed. If it isn't, the recording can still be played, but it
+// has no waveform.
+const (
+	// waveformPeaks is how many peaks a waveform has, which is enough for
+	// it to be drawn across a wide screen.
+	waveformPeaks = 800
+
+	// waveformBlocksPerSecond is how many peaks are found for each second
+	// of audio before they are squashed down to waveformPeaks, so that the
+	// whole recording doesn't have to be kept in memory.
+	waveformBlocksPerSecond = 100
+
+	// waveformSampleRate is the sample rate which ffmpeg decodes audio at,
+	// which is plenty for finding peaks.
+	waveformSampleRate = 8000
+
+	// waveformTimeout is how long ffmpeg can take to decode a recording.
+	waveformTimeout = 2 * time.Minute
+)
+
+// A Waveform is an outline of a recording, made up of the loudest sample in
+// each of a number of equal slices of it, from 0 for silence to 1 for as loud
+// as it can be.
+type Waveform struct {
+	Duration float64   `json:"duration"`
+	Peaks    []float64 `json:"peaks"`
+}
+
+// errNoWaveform is returned when a recording's waveform can't be worked out,
+// because it isn't a WAV file and ffmpeg isn't installed.
+var errNoWaveform = errors.New("only WAV files have waveforms unless ffmpeg is installed")
+
+// A peakCollector finds the peaks of a stream of samples, which are added one
+// at a time.
+type peakCollector struct {
+	rate      int
+	blockSize int
+
+	// blocks are the peaks of the blocks which have been filled, and
+	// current is the peak of the one which is being filled, which has
+	// count samples in it so far.
+	blocks  []float32
+	current float32
+	count   int
+
+	samples int64
+}
+
+// newPeakCollector returns a peakCollector for samples at the given rate.
+func newPeakCollector(rate int) *peakCollector {
+	blockSize := rate / waveformBlocksPerSecond
+	if blockSize < 1 {
+		blockSize = 1
+	}
+
+	return &peakCollector{rate: rate, blockSize: blockSize}
+}
+
+// add adds a sample, from -1 to 1.
+func (c *peakCollector) add(sample float64) {
+	if level := float32(math.Abs(sample)); level > c.current {
+		c.current = level
+	}
+
+	c.samples++
+	c.count++
+
+	if c.count == c.blockSize {
+		c.blocks = append(c.blocks, c.current)
+		c.current, c.count = 0, 0
+	}
+}
+
+// waveform returns the waveform of the samples which have been added.
+func (c *peakCollector) waveform() *Waveform {
+	blocks := c.blocks
+	if c.count > 0 {
+		blocks = append(blocks, c.current)
+	}
+
+	peaks := waveformPeaks
+	if len(blocks) < peaks {
+		peaks = len(blocks)
+	}
+
+	waveform := &Waveform{
+		Duration: float64(c.samples) / float64(c.rate),
+		Peaks:    make([]float64, peaks),
+	}
+
+	for i := range waveform.Peaks {
+		var peak float32
+		for _, block := range blocks[i*len(blocks)/peaks : (i+1)*len(blocks)/peaks] {
+			if block > peak {
+				peak = block
+			}
+		}
+
+		// Three decimal places are more than can be seen, and keep the
+		// JSON small.
+		waveform.Peaks[i] = math.Round(math.Min(float64(peak), 1)*1000) / 1000
+	}
+
+	return waveform
+}
+
+// makeWaveform works out the waveform of the recording in the file with the
+// given name, whose extension is given too.
+func makeWaveform(filename, ext string) (*Waveform, error) {
+	if ext == ".wav" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		return wavWaveform(bufio.NewReader(file))
+	}
+
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errNoWaveform
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), waveformTimeout)
+	defer cancel()
+
+	// ffmpeg turns the recording into mono 16 bit samples, which are read
+	// as they are decoded.
+	cmd := exec.CommandContext(ctx, ffmpeg, "-v", "error", "-i", filename,
+		"-ac", "1", "-ar", fmt.Sprint(waveformSampleRate), "-f", "s16le", "-")
+
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	collector := newPeakCollector(waveformSampleRate)
+	readErr := readPCM(bufio.NewReader(output), collector, 1, 16, false)
+
+	if err := cmd.Wait(); ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("ffmpeg took longer than %s", waveformTimeout)
+	} else if err != nil {
+		return nil, fmt.Errorf("ffmpeg couldn't decode the recording: %s", err)
+	} else if readErr != nil {
+		return nil, readErr
+	}
+
+	return collector.waveform(), nil
+}
+
+// wavWaveform works out the waveform of a WAV file, which can have integer
+// samples of 8, 16, 24 or 32 bits, or floating point samples of 32 bits.
+func wavWaveform(r io.Reader) (*Waveform, error) {
+	var header struct {
+		RIFF [4]byte
+		Size uint32
+		WAVE [4]byte
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil || string(header.RIFF[:]) != "RIFF" || string(header.WAVE[:]) != "WAVE" {
+		return nil, errors.New("the recording isn't a WAV file")
+	}
+
+	var (
+		format        uint16
+		channels      uint16
+		rate          uint32
+		bitsPerSample uint16
+		haveFormat    bool
+	)
+
+	// A WAV file is a list of chunks, each with an ID and a size. The fmt
+	// chunk says what the samples are like, and the data chunk has them.
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+
+		if err := binary.Read(r, binary.LittleEndian, &chunk); err != nil {
+			return nil, errors.New("the WAV file has no data")
+		}
+
+		switch string(chunk.ID[:]) {
+		case "fmt ":
+			if chunk.Size < 16 || chunk.Size > 64 {
+				return nil, errors.New("the WAV file's format can't be read")
+			}
+
+			fields := make([]byte, chunk.Size+chunk.Size%2)
+			if _, err := io.ReadFull(r, fields); err != nil {
+				return nil, errors.New("the WAV file's format can't be read")
+			}
+
+			format = binary.LittleEndian.Uint16(fields[0:])
+			channels = binary.LittleEndian.Uint16(fields[2:])
+			rate = binary.LittleEndian.Uint32(fields[4:])
+			bitsPerSample = binary.LittleEndian.Uint16(fields[14:])
+			haveFormat = true
+
+			// An extensible WAV file gives its real format at the start
+			// of the sub-format GUID.
+			if format == 0xFFFE && chunk.Size >= 26 {
+				format = binary.LittleEndian.Uint16(fields[24:])
+			}
+
+		case "data":
+			if !haveFormat || channels == 0 || rate == 0 {
+				return nil, errors.New("the WAV file's data comes before its format")
+			}
+
+			float := format == 3
+			if !(format == 1 && (bitsPerSample == 8 || bitsPerSample == 16 || bitsPerSample == 24 || bitsPerSample == 32)) && !(float && bitsPerSample == 32) {
+				return nil, fmt.Errorf("WAV files with %d bit samples in format %d aren't supported", bitsPerSample, format)
+			}
+
+			// A WAV file which was written as it was recorded might not
+			// say how much data it has, in which case it all is.
+			data := r
+			if chunk.Size != 0 && chunk.Size != math.MaxUint32 {
+				data = io.LimitReader(r, int64(chunk.Size))
+			}
+
+			collector := newPeakCollector(int(rate))
+			if err := readPCM(data, collector, int(channels), int(bitsPerSample), float); err != nil {
+				return nil, err
+			}
+
+			return collector.waveform(), nil
+
+		default:
+			// Chunks are padded to an even number of bytes.
+			if _, err := io.CopyN(ioutil.Discard, r, int64(chunk.Size+chunk.Size%2)); err != nil {
+				return nil, errors.New("the WAV file has no data")
+			}
+		}
+	}
+}
+
+// readPCM reads little endian samples with the given number of channels and
+// bits until the reader runs out, adding the loudest channel of each frame to
+// the collector. Integer samples are signed, apart from 8 bit ones, which
+// are unsigned. A frame which is cut off at the end is ignored.
+func readPCM(r io.Reader, collector *peakCollector, channels, bits int, float bool) error {
+	width := bits / 8
+	frame := make([]byte, channels*width)
+	scale := math.Pow(2, float64(bits-1))
+
+	for {
+		if _, err := io.ReadFull(r, frame); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		loudest := 0.0
+
+		for channel := 0; channel < channels; channel++ {
+			sample := frame[channel*width : (channel+1)*width]
+
+			var value float64
+			switch {
+			case float:
+				value = float64(math.Float32frombits(binary.LittleEndian.Uint32(sample)))
+			case bits == 8:
+				value = (float64(sample[0]) - 128) / scale
+			case bits == 16:
+				value = float64(int16(binary.LittleEndian.Uint16(sample))) / scale
+			case bits == 24:
+				value = float64(int32(uint32(sample[0])<<8|uint32(sample[1])<<16|uint32(sample[2])<<24)>>8) / scale
+			case bits == 32:
+				value = float64(int32(binary.LittleEndian.Uint32(sample))) / scale
+			}
+
+			if math.Abs(value) > math.Abs(loudest) {
+				loudest = value
+			}
+		}
+
+		collector.add(loudest)
+	}
+}
@@ -0,0 +1,181 @@
+package src
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// As well as running a command, each post- hook's payload can be POSTed to
+// some webhooks, which are URLs given by the admin, so that other services
+// can find out what happened without a script in between. The body is the
+// same JSON object which a hook's command is given.
+//
+// Each delivery is signed with the current key in the webhook keyring, as
+// described in secrets.go, so that the receiver can tell that it came from
+// the server and hasn't been changed. The signatures are Ed25519 rather
+// than HMAC, so that the receiver only needs the public keys, which anyone
+// can fetch from /api/v1/webhooks/keys, and the keys themselves are still
+// never sent out. These headers are sent with each delivery:
+//
+//	X-Tab-Server-Hook       the name of the hook
+//	X-Tab-Server-Key-ID     the ID of the key it was signed with
+//	X-Tab-Server-Timestamp  the Unix time it was signed at
+//	X-Tab-Server-Signature  the signature of the timestamp, a newline, and
+//	                        the body, in base64
+//
+// The timestamp is signed as well so that the receiver can refuse old
+// deliveries which someone is trying to send again.
+const (
+	// secretWebhook signs the webhook deliveries.
+	secretWebhook = "webhook"
+
+	// webhookKeyLifetime is how long a webhook key is still published after
+	// it is replaced, so that deliveries signed just before it was
+	// replaced can still be checked by receivers which cache the keys.
+	webhookKeyLifetime = 24 * time.Hour
+)
+
+// errBadWebhookKey is returned if a key in the webhook keyring isn't the seed
+// of an Ed25519 key.
+var errBadWebhookKey = errors.New("the webhook key isn't a valid Ed25519 seed")
+
+// webhookPrivateKey returns the Ed25519 key whose seed is a webhook key.
+func webhookPrivateKey(secret signingSecret) (ed25519.PrivateKey, error) {
+	seed, err := hex.DecodeString(secret.Key)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errBadWebhookKey
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signWebhook computes the signature of a delivery's body which was signed at
+// the given Unix time, in base64.
+func signWebhook(key ed25519.PrivateKey, timestamp int64, body []byte) string {
+	message := append([]byte(strconv.FormatInt(timestamp, 10)+"\n"), body...)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, message))
+}
+
+// deliverWebhooks POSTs a hook's payload to each of the webhooks, signed with
+// the current webhook key. Every webhook is tried, and the first error, if
+// any, is returned.
+func (s *Server) deliverWebhooks(hook string, payload map[string]interface{}) error {
+	if len(s.Hooks.Webhooks) == 0 {
+		return nil
+	}
+
+	payload["hook"] = hook
+	if _, ok := payload["time"]; !ok {
+		payload["time"] = time.Now().Format(time.RFC3339Nano)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	secrets, err := s.secrets(secretWebhook)
+	if err != nil {
+		return err
+	}
+
+	key, err := webhookPrivateKey(secrets[0])
+	if err != nil {
+		return err
+	}
+
+	var (
+		timestamp = time.Now().Unix()
+		signature = signWebhook(key, timestamp, body)
+		client    = &http.Client{Timeout: hookTimeout}
+		first     error
+	)
+
+	for _, url := range s.Hooks.Webhooks {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			first = firstError(first, err)
+			continue
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Tab-Server-Hook", hook)
+		req.Header.Set("X-Tab-Server-Key-ID", secrets[0].ID)
+		req.Header.Set("X-Tab-Server-Timestamp", strconv.FormatInt(timestamp, 10))
+		req.Header.Set("X-Tab-Server-Signature", signature)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			first = firstError(first, err)
+			continue
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			first = firstError(first, fmt.Errorf("%s responded with %s", url, resp.Status))
+		}
+	}
+
+	return first
+}
+
+// firstError returns err if there wasn't an error already, and the one there
+// was otherwise.
+func firstError(first, err error) error {
+	if first != nil {
+		return first
+	}
+
+	return err
+}
+
+// A webhookKeyInfo is one of the public keys which webhook deliveries are
+// signed with.
+type webhookKeyInfo struct {
+	ID        string     `json:"id"`
+	PublicKey string     `json:"publicKey"`
+	Created   time.Time  `json:"created"`
+	Retires   *time.Time `json:"retires,omitempty"`
+	Current   bool       `json:"current"`
+}
+
+// handleWebhookKeysAPI is called to respond to a HTTP request to
+// /api/v1/webhooks/keys. It responds with the public keys which webhook
+// deliveries are signed with, in base64, encoded in JSON. Anyone can see
+// them, since they can only be used to check signatures.
+func (s *Server) handleWebhookKeysAPI(w http.ResponseWriter, r *http.Request) {
+	secrets, err := s.secrets(secretWebhook)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	keys := make([]webhookKeyInfo, len(secrets))
+	for i, secret := range secrets {
+		key, err := webhookPrivateKey(secret)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		keys[i] = webhookKeyInfo{
+			ID:        secret.ID,
+			PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+			Created:   secret.Created,
+			Retires:   secret.Retires,
+			Current:   i == 0,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
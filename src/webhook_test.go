@@ -0,0 +1,114 @@
+package src
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWebhookPrivateKey(t *testing.T) {
+	cases := []struct {
+		name, key string
+		valid     bool
+	}{
+		{"seed", strings.Repeat("ab", ed25519.SeedSize), true},
+		{"too short", strings.Repeat("ab", ed25519.SeedSize-1), false},
+		{"not hexadecimal", strings.Repeat("zz", ed25519.SeedSize), false},
+		{"empty", "", false},
+	}
+
+	for _, c := range cases {
+		if _, err := webhookPrivateKey(signingSecret{Key: c.key}); (err == nil) != c.valid {
+			t.Errorf("%s: expected valid to be %v, got %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	var (
+		header http.Header
+		body   []byte
+	)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+
+	s := &Server{
+		Store: NewMemoryStore(DefaultSettings()),
+		Hooks: HookConfig{Webhooks: []string{receiver.URL}},
+	}
+
+	if err := s.deliverWebhooks(hookPostIngest, map[string]interface{}{"event": "tab.added"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err, string(body))
+	}
+
+	if payload["hook"] != hookPostIngest || payload["event"] != "tab.added" {
+		t.Errorf("expected the hook's payload, got %s", body)
+	}
+
+	// The signature can be checked with the public key, which is all a
+	// receiver has.
+	secrets, err := s.secrets(secretWebhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := header.Get("X-Tab-Server-Key-ID"); id != secrets[0].ID {
+		t.Errorf("expected the current key's ID, %q, got %q", secrets[0].ID, id)
+	}
+
+	key, err := webhookPrivateKey(secrets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(header.Get("X-Tab-Server-Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := header.Get("X-Tab-Server-Timestamp")
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		t.Fatalf("expected a Unix time, got %q", timestamp)
+	}
+
+	message := append([]byte(timestamp+"\n"), body...)
+	if !ed25519.Verify(key.Public().(ed25519.PublicKey), message, signature) {
+		t.Error("expected the signature to be valid")
+	}
+
+	// A delivery which has been changed doesn't match.
+	if ed25519.Verify(key.Public().(ed25519.PublicKey), append(message, ' '), signature) {
+		t.Error("expected a changed delivery not to match the signature")
+	}
+}
+
+func TestDeliverWebhooksFailure(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	s := &Server{
+		Store: NewMemoryStore(DefaultSettings()),
+		Hooks: HookConfig{Webhooks: []string{receiver.URL}},
+	}
+
+	if err := s.deliverWebhooks(hookPostIngest, map[string]interface{}{}); err == nil {
+		t.Error("expected an error when the webhook fails")
+	}
+}
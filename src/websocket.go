@@ -0,0 +1,61 @@
+package src
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// The parts of the API which change as people use them, such as a tab's room
+// while it is being edited and the tab which is being performed, can be
+// followed over a WebSocket, by sending a request to the same path which asks
+// to upgrade to one. The messages either way are JSON objects.
+//
+// Browsers send the session cookie along with a WebSocket handshake from any
+// site, and the handshake is a GET request, so it isn't checked for a CSRF
+// token. Instead, a handshake from a page is only accepted if the page is on
+// the server itself, or on an origin which the CORS config names. Clients
+// which aren't browsers don't send an Origin header, and are let in, since
+// they don't send anyone else's cookies.
+
+// isWebSocketRequest reports whether the request is asking to be upgraded to
+// a WebSocket.
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// checkWebSocketOrigin accepts a WebSocket handshake from the server's own
+// pages, from the origins which the CORS config names, and from clients which
+// don't send an origin. A wildcard in the CORS config doesn't count, for the
+// same reason that the origin isn't echoed back for one.
+func (s *Server) checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	} else if origin == nil {
+		return nil
+	}
+
+	config.Origin = origin
+
+	if strings.EqualFold(origin.Host, r.Host) {
+		return nil
+	}
+
+	for _, allowed := range s.CORS.Origins {
+		if allowed != "*" && strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin.Scheme+"://"+origin.Host) {
+			return nil
+		}
+	}
+
+	return errors.New("WebSockets can't be opened from other sites")
+}
+
+// serveWebSocket upgrades the request to a WebSocket, and hands it to the
+// handler, which has it until it returns.
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request, handler func(*websocket.Conn)) {
+	websocket.Server{Handshake: s.checkWebSocketOrigin, Handler: handler}.ServeHTTP(w, r)
+}
@@ -0,0 +1,277 @@
+package src
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A folder of tabs can be added to the collection by uploading it as a zip
+// archive to /api/v1/import/zip, rather than copying the files into the tab
+// directory by hand. Like any import over the API, the archive is previewed
+// first, as described in pendingimport.go, and nothing is written until the
+// plan is committed. Each file in the archive is planned to be written to the
+// same path in the tab directory, which can be changed, and is imported as
+// long as its filename matches one of the filename patterns and there isn't a
+// file there already. Files which can't be imported don't stop the others,
+// and the response to committing the plan says what happened to each of them.
+const (
+	// maxZipImportSize is the largest archive which can be uploaded, in
+	// bytes.
+	maxZipImportSize = 100 << 20
+
+	// maxZipImportContent is the most the files in an archive can add up
+	// to once they are extracted, in bytes, so that a small archive which
+	// expands into something huge can't fill the disk.
+	maxZipImportContent = 500 << 20
+)
+
+var (
+	// errArchiveTooLarge is returned when an archive is uploaded which is
+	// larger than maxZipImportSize, or whose files add up to more than
+	// maxZipImportContent.
+	errArchiveTooLarge = newAPIError(codeArchiveTooLarge, fmt.Sprintf("archives can't be larger than %d MB, or hold more than %d MB of files", maxZipImportSize>>20, maxZipImportContent>>20))
+
+	// errInvalidArchive is returned when the upload can't be read as a zip
+	// archive.
+	errInvalidArchive = newAPIError(codeInvalidArchive, "the upload isn't a zip archive")
+)
+
+// A zipImportReport says what importing a zip archive did.
+type zipImportReport struct {
+	Imported int               `json:"imported"`
+	Skipped  int               `json:"skipped"`
+	Failed   int               `json:"failed"`
+	Files    []zipImportedFile `json:"files"`
+}
+
+// A zipImportedFile says what happened to one of the files in an archive. If
+// it was imported, ID is the ID of its tab and Target is where it was written,
+// and otherwise Skipped is true if the plan said to skip it, or Error says why
+// it couldn't be imported.
+type zipImportedFile struct {
+	Filename string `json:"filename"`
+	Target   string `json:"target,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// skipZipEntry says whether a file in an archive should be left out without
+// being reported, because it is a folder, or the metadata which some
+// archivers add, rather than a file someone put there.
+func skipZipEntry(file *zip.File) bool {
+	name := strings.Replace(file.Name, "\\", "/", -1)
+	return file.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || path.Base(name) == ".DS_Store"
+}
+
+// planZipFile works out where a file in an archive would be imported to, and
+// what it would be parsed as, in the same way as planImport, along with the
+// problems which only files from archives can have.
+func (s *Server) planZipFile(file *zip.File, planned *plannedImport, patterns []filenamePattern, targets map[string]bool) {
+	// The target is checked in the same way as when a library is imported,
+	// with MusicXML scores allowed whatever their filenames are, as long as
+	// they turn out to be MusicXML once they're read.
+	format := ""
+	if musicXMLExtensions[strings.ToLower(path.Ext(planned.Target))] {
+		format = formatMusicXML
+	}
+
+	// Archives made on Windows can separate folders with backslashes, which
+	// are treated the same as slashes, so that they can't be used to get
+	// around the check that the target is inside the tab directory.
+	planned.Target = strings.Replace(planned.Target, "\\", "/", -1)
+	s.planImport(planned, format, patterns, targets)
+
+	if !file.Mode().IsRegular() {
+		planned.Problems = append(planned.Problems, "only regular files can be imported, not links or devices")
+	}
+
+	if len(tabFolders(planned.Target)) > s.Settings.ScanDepth {
+		planned.Problems = append(planned.Problems, "the file is in more folders than the scan depth allows")
+	} else if s.ignoresFile(planned.Target) {
+		planned.Problems = append(planned.Problems, "the file matches one of the ignore patterns")
+	}
+}
+
+// importZipFile writes a file from an archive to the given filename in the
+// tab directory and caches it, returning the ID of its tab. The filename
+// should have been checked by planZipFile. remaining is how many more bytes
+// can be extracted from the archive, which is reduced by the size of the file.
+func (s *Server) importZipFile(file *zip.File, filename string, remaining *int64, by actor) (string, error) {
+	content, err := readZipFile(file, remaining)
+	if err != nil {
+		return "", err
+	}
+
+	filePath := s.tabPath(filename)
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+		return "", err
+	}
+
+	if err := s.syncFile(filename, by); err != nil {
+		return "", err
+	}
+
+	id, cached, err := s.Store.TabID(filename)
+	if err != nil {
+		return "", err
+	} else if !cached {
+		// The file isn't left behind, since it would only be skipped by
+		// every rescan from now on.
+		os.Remove(filePath)
+		return "", errors.New("the file couldn't be read as a tab")
+	}
+
+	return id, nil
+}
+
+// readZipFile reads a file from an archive, as long as it isn't larger than
+// the remaining number of bytes, which is reduced by its size. The size in
+// the archive's header isn't trusted, since it can be wrong.
+func readZipFile(file *zip.File, remaining *int64) ([]byte, error) {
+	if int64(file.UncompressedSize64) > *remaining {
+		return nil, errArchiveTooLarge
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(reader, *remaining+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(content)) > *remaining {
+		return nil, errArchiveTooLarge
+	}
+
+	*remaining -= int64(len(content))
+
+	return content, nil
+}
+
+// planZipImport returns a plan for importing the files in a zip archive.
+// Each file is to be imported to the same path as in the archive, unless
+// there is a problem with it, in which case it is skipped.
+func (s *Server) planZipImport(archive *zip.Reader) *importPlan {
+	var (
+		plan     = &importPlan{Version: importPlanVersion, Tabs: []*plannedImport{}}
+		patterns = tokenizePatterns(s.Settings.FilenamePatterns)
+		targets  = make(map[string]bool)
+	)
+
+	for _, file := range archive.File {
+		if skipZipEntry(file) {
+			continue
+		}
+
+		planned := &plannedImport{Filename: file.Name, Target: file.Name}
+		s.planZipFile(file, planned, patterns, targets)
+
+		planned.Skip = planned.Exists || len(planned.Problems) > 0
+		plan.Tabs = append(plan.Tabs, planned)
+	}
+
+	return plan
+}
+
+// importPlannedZip imports the files in a zip archive as the plan says, and
+// returns a report of what happened to each of them. Files which aren't in
+// the plan are skipped, and every target is checked again before its file is
+// written, with the files which still have problems reported as failed. If
+// the plan names a file which isn't in the archive, nothing is imported, and
+// the error has the invalid_import_plan code.
+func (s *Server) importPlannedZip(archive *zip.Reader, plan *importPlan, by actor) (*zipImportReport, error) {
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, file := range archive.File {
+		if _, ok := files[file.Name]; !ok && !skipZipEntry(file) {
+			files[file.Name] = file
+		}
+	}
+
+	planned := make(map[string]*plannedImport, len(plan.Tabs))
+	for _, tab := range plan.Tabs {
+		if files[tab.Filename] == nil {
+			return nil, invalidImportPlan("%s: the file isn't in the archive", tab.Filename)
+		}
+
+		planned[tab.Filename] = tab
+	}
+
+	var (
+		report    = &zipImportReport{Files: []zipImportedFile{}}
+		patterns  = tokenizePatterns(s.Settings.FilenamePatterns)
+		targets   = make(map[string]bool)
+		remaining = int64(maxZipImportContent)
+	)
+
+	for _, file := range archive.File {
+		if files[file.Name] != file {
+			continue
+		}
+
+		imported := zipImportedFile{Filename: file.Name}
+
+		target, ok := planned[file.Name]
+		if !ok || target.Skip {
+			imported.Skipped = true
+			report.Skipped++
+			report.Files = append(report.Files, imported)
+			continue
+		}
+
+		s.planZipFile(file, target, patterns, targets)
+		imported.Target = target.Target
+
+		var err error
+		if len(target.Problems) > 0 {
+			err = errors.New(target.Problems[0])
+		} else if target.Exists {
+			err = errors.New("there is already a file with that name")
+		} else {
+			imported.ID, err = s.importZipFile(file, target.Target, &remaining, by)
+		}
+
+		if err != nil {
+			imported.Error = err.Error()
+			report.Failed++
+		} else {
+			report.Imported++
+		}
+
+		report.Files = append(report.Files, imported)
+	}
+
+	return report, nil
+}
+
+// handleZipImportAPI is called to respond to a HTTP request to
+// /api/v1/import/zip. It keeps the uploaded zip archive, which is either the
+// 'file' form value of a multipart form or the whole body, as a pending
+// import, and responds with a plan for importing it, as described in
+// pendingimport.go. Nothing is imported until the plan is committed.
+func (s *Server) handleZipImportAPI(w http.ResponseWriter, r *http.Request) {
+	s.stageImport(w, r, importKindZip, func(uploadPath string) (*importPlan, int, error) {
+		archive, err := zip.OpenReader(uploadPath)
+		if err != nil {
+			return nil, http.StatusBadRequest, errInvalidArchive
+		}
+		defer archive.Close()
+
+		return s.planZipImport(&archive.Reader), http.StatusOK, nil
+	})
+}
@@ -0,0 +1,151 @@
+package src
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newZipArchive returns an archive holding files with the given names and
+// contents.
+func newZipArchive(t *testing.T, files map[string]string) *zip.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+
+	for name, content := range files {
+		file, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file.Write([]byte(content))
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return archive
+}
+
+// newZipImportServer returns a server which keeps its tabs in memory and in a
+// temporary tab directory.
+func newZipImportServer(t *testing.T) *Server {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "zipimport")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	settings := DefaultSettings()
+	settings.TabDirectory = dir
+
+	return &Server{Store: NewMemoryStore(settings), Settings: settings, Logging: LogConfig{Level: "none"}}
+}
+
+func TestPlanZipImport(t *testing.T) {
+	s := newZipImportServer(t)
+
+	if err := ioutil.WriteFile(filepath.Join(s.Settings.TabDirectory, "Abba - Waterloo.txt"), []byte("[C]My my"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := newZipArchive(t, map[string]string{
+		"Abba - SOS.txt":             "[Dm]Where are those happy days",
+		"Abba - Waterloo.txt":        "[C]My my",
+		"readme":                     "Some notes",
+		".trash/Abba - Fernando.txt": "[A]Can you hear the drums",
+		"__MACOSX/._Abba - SOS.txt":  "",
+	})
+
+	cases := map[string]struct {
+		skip, exists, problems bool
+	}{
+		"Abba - SOS.txt":      {false, false, false},
+		"Abba - Waterloo.txt": {true, true, false},
+		"readme":              {true, false, true},
+
+		// Nothing can be imported into the trash, or any other hidden
+		// folder.
+		".trash/Abba - Fernando.txt": {true, false, true},
+	}
+
+	// The metadata which archivers add isn't in the plan at all.
+	plan := s.planZipImport(archive)
+	if len(plan.Tabs) != len(cases) {
+		t.Fatalf("expected %d files in the plan, got %d", len(cases), len(plan.Tabs))
+	}
+
+	for _, planned := range plan.Tabs {
+		c, ok := cases[planned.Filename]
+		if !ok {
+			t.Errorf("unexpected file in the plan: %s", planned.Filename)
+			continue
+		}
+
+		if planned.Skip != c.skip || planned.Exists != c.exists || (len(planned.Problems) > 0) != c.problems {
+			t.Errorf("%s: expected %+v, got %+v", planned.Filename, c, planned)
+		}
+	}
+}
+
+func TestImportPlannedZip(t *testing.T) {
+	s := newZipImportServer(t)
+
+	archive := newZipArchive(t, map[string]string{
+		"Abba - SOS.txt":      "[Dm]Where are those happy days",
+		"Abba - Waterloo.txt": "[C]My my",
+	})
+
+	// The plan can change where a file goes, and skip others, and nothing
+	// is written until it is imported.
+	plan := s.planZipImport(archive)
+
+	for _, planned := range plan.Tabs {
+		switch planned.Filename {
+		case "Abba - SOS.txt":
+			planned.Target = "Abba - Mamma Mia.txt"
+		case "Abba - Waterloo.txt":
+			planned.Skip = true
+		}
+	}
+
+	if files, _ := ioutil.ReadDir(s.Settings.TabDirectory); len(files) != 0 {
+		t.Fatalf("expected nothing to be written by planning, got %d files", len(files))
+	}
+
+	report, err := s.importPlannedZip(archive, plan, actor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Imported != 1 || report.Skipped != 1 || report.Failed != 0 {
+		t.Errorf("expected one file to be imported and one skipped, got %+v", report)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(s.Settings.TabDirectory, "Abba - Mamma Mia.txt"))
+	if err != nil || string(content) != "[Dm]Where are those happy days" {
+		t.Errorf("expected the file to be written to the changed target, got %q, %v", content, err)
+	}
+
+	// A plan which names a file that isn't in the archive is refused as a
+	// whole.
+	plan.Tabs = append(plan.Tabs, &plannedImport{Filename: "missing.txt", Target: "missing.txt"})
+
+	if _, err := s.importPlannedZip(archive, plan, actor{}); err == nil {
+		t.Error("expected a plan naming a missing file to be refused")
+	}
+}
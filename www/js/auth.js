@@ -0,0 +1,197 @@
+// adminRequest sends a POST request to an admin-only API endpoint, with the
+// given URLSearchParams as its form values. If the server responds saying
+// that the user isn't logged in, they will be asked for their password and
+// the request will be sent again once they have logged in. onSuccess is
+// called with the request object once the request has succeeded. The
+// session's CSRF token is sent along with the request, and if the server
+// says that it is wrong, a new one is fetched and the request is sent again.
+function adminRequest(path, params, onSuccess, retried) {
+    // Create a new HTTP request object, which will be used to send
+    // the request to the endpoint.
+    var req = new XMLHttpRequest()
+
+    // The onreadystatechange method of the HTTP request is called
+    // when the state of the request changes. In this case, only
+    // ready state 4 (which means that the response has been received)
+    // is relevant.
+    req.onreadystatechange = function() {
+        if (this.readyState == 4) {
+            if (this.status == 200) {
+                onSuccess(this)
+            } else if (this.status == 401) {
+                // 401 means that there is no valid session, so log in
+                // and then try sending the request again.
+                login(() => adminRequest(path, params, onSuccess))
+            } else if (this.status == 403 && errorCode(this) == "invalid_csrf_token" && !retried) {
+                // The CSRF token cookie has gone missing or is out of date,
+                // so ask the server for it again and then retry once.
+                refreshCSRFToken(() => adminRequest(path, params, onSuccess, true))
+            } else {
+                // If the execution gets here, an error has occured. Thus,
+                // send an error message to the user via an alert.
+                alert(this.status + ": " + errorMessage(this))
+            }
+        }
+    }
+
+    req.open("POST", location.origin + path, true)
+    req.setRequestHeader("X-CSRF-Token", csrfToken())
+    req.send(params)
+}
+
+// csrfToken returns the CSRF token of the current session, which the server
+// puts in the csrf-token cookie when logging in, or an empty string if there
+// isn't one.
+function csrfToken() {
+    for (var cookie of document.cookie.split(";")) {
+        var parts = cookie.trim().split("=")
+        if (parts[0] == "csrf-token") {
+            return decodeURIComponent(parts.slice(1).join("="))
+        }
+    }
+
+    return ""
+}
+
+// refreshCSRFToken asks /api/v1/csrf-token for the session's CSRF token,
+// which sets the csrf-token cookie again, and then calls callback.
+function refreshCSRFToken(callback) {
+    var req = new XMLHttpRequest()
+
+    req.onreadystatechange = function() {
+        if (this.readyState == 4) {
+            if (this.status == 200) {
+                callback()
+            } else {
+                alert(this.status + ": " + errorMessage(this))
+            }
+        }
+    }
+
+    req.open("GET", location.origin + "/api/v1/csrf-token", true)
+    req.send()
+}
+
+// login asks the user for the admin password and sends it to /api/v1/login,
+// which will set a session cookie if it is correct. callback is called
+// once the user has been logged in successfully.
+function login(callback) {
+    // Ask the user to enter their password by opening up a
+    // prompt dialog. If they press cancel, give up without
+    // sending anything.
+    var password = prompt("Enter your password:")
+    if (password === null) {
+        return
+    }
+
+    var req = new XMLHttpRequest()
+
+    req.onreadystatechange = function() {
+        if (this.readyState == 4) {
+            if (this.status == 200) {
+                callback()
+            } else {
+                alert(this.status + ": " + errorMessage(this))
+            }
+        }
+    }
+
+    var params = new URLSearchParams()
+    params.set("password", password)
+
+    req.open("POST", location.origin + "/api/v1/login", true)
+    req.send(params)
+}
+
+// loginIfRequired calls callback once the user can read the collection. If the
+// server's access mode says that only those who have logged in can, and the
+// user hasn't, they are asked to log in first.
+function loginIfRequired(callback) {
+    var req = new XMLHttpRequest()
+
+    req.onreadystatechange = function() {
+        if (this.readyState != 4) {
+            return
+        }
+
+        var settings = this.status == 200 ? JSON.parse(this.responseText) : {}
+        if (!settings.accessMode || settings.accessMode == "public") {
+            callback()
+            return
+        }
+
+        // Only a logged in browser can get its CSRF token, so that says
+        // whether the user has logged in.
+        var check = new XMLHttpRequest()
+
+        check.onreadystatechange = function() {
+            if (this.readyState == 4) {
+                if (this.status == 401) {
+                    login(callback)
+                } else {
+                    callback()
+                }
+            }
+        }
+
+        check.open("GET", location.origin + "/api/v1/csrf-token", true)
+        check.send()
+    }
+
+    req.open("GET", location.origin + "/api/v1/settings", true)
+    req.send()
+}
+
+// errorMessage returns the message from the JSON error which the server
+// responds to a failed API request with. If the response isn't one, such as
+// when a proxy in front of the server fails, its text is returned instead.
+function errorMessage(req) {
+    try {
+        return JSON.parse(req.responseText).error.message
+    } catch (e) {
+        return req.responseText
+    }
+}
+
+// errorCode returns the code from the JSON error which the server responds to
+// a failed API request with, or an empty string if the response isn't one.
+function errorCode(req) {
+    try {
+        return JSON.parse(req.responseText).error.code
+    } catch (e) {
+        return ""
+    }
+}
+
+// getJSON sends a GET request to the given path, and calls onSuccess with
+// the parsed JSON response if it succeeds, or onError with the request
+// object if it doesn't.
+function getJSON(path, onSuccess, onError) {
+    // Create a new HTTP request object, which will be used
+    // to fetch the data from the server.
+    var req = new XMLHttpRequest()
+
+    // The onreadystatechange method of the HTTP request is called
+    // when the state of the request changes. In this case, only
+    // ready state 4 (which means that the response has been received)
+    // is relevant.
+    req.onreadystatechange = function() {
+        if (this.readyState == 4) {
+            // If the status of the response is 200, the request was
+            // successful. 200 = OK.
+            if (this.status == 200) {
+                onSuccess(JSON.parse(this.responseText), this)
+            } else {
+                onError(this)
+            }
+        }
+    }
+
+    // location.origin is the URL without the current path appended,
+    // so if I'm running the server locally it would be
+    // http://localhost:8000. true as the third parameter indicates
+    // that the request is asynchronous, meaning that the user can
+    // still interact with the page while the request is loading.
+    req.open("GET", location.origin + path, true)
+    req.send()
+}
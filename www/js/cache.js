@@ -0,0 +1,139 @@
+// The tabs' content is kept in the browser's IndexedDB, keyed by its content
+// hash, so that it doesn't have to be downloaded again every time the page is
+// loaded. The last list of tabs is kept too, so that the page still works
+// when the server can't be reached.
+var cacheDatabase
+
+// tabListKey is the key which the last list of tabs is kept under. It changed
+// when the tabs' "ID" field was renamed to "id", so that lists kept from
+// before then aren't used.
+var tabListKey = "tabs-v1"
+
+// openCache opens the IndexedDB database, creating its object stores if they
+// don't exist yet, and then calls callback. If it is already open, callback
+// is called straight away. If IndexedDB isn't available, callback is still
+// called but nothing will be cached.
+function openCache(callback) {
+    if (cacheDatabase || !window.indexedDB) {
+        callback()
+        return
+    }
+
+    var req = indexedDB.open("tab-server", 1)
+
+    // onupgradeneeded is called when the database is first created, which
+    // is where the object stores have to be made.
+    req.onupgradeneeded = function() {
+        var db = this.result
+        db.createObjectStore("content")
+        db.createObjectStore("lists")
+    }
+
+    req.onsuccess = function() {
+        cacheDatabase = this.result
+        callback()
+    }
+
+    req.onerror = () => callback()
+}
+
+// cacheGet looks up the given key in one of the object stores, and calls
+// callback with the value, or undefined if it isn't there.
+function cacheGet(store, key, callback) {
+    if (!cacheDatabase) {
+        callback(undefined)
+        return
+    }
+
+    var req = cacheDatabase.transaction(store).objectStore(store).get(key)
+    req.onsuccess = function() { callback(this.result) }
+    req.onerror = () => callback(undefined)
+}
+
+// cachePut stores a value under the given key in one of the object stores.
+// Failing to store something isn't a problem, since it will just be
+// downloaded again next time, so errors are ignored.
+function cachePut(store, key, value) {
+    if (!cacheDatabase) {
+        return
+    }
+
+    cacheDatabase.transaction(store, "readwrite").objectStore(store).put(value, key)
+}
+
+// fillContent looks up the content of each of the tabs in the cache by their
+// content hashes, and calls callback with the list of tabs whose content
+// wasn't there.
+function fillContent(tabs, callback) {
+    var missing = []
+    var remaining = tabs.length
+
+    if (remaining == 0) {
+        callback(missing)
+        return
+    }
+
+    for (const tab of tabs) {
+        cacheGet("content", tab.contentHash, content => {
+            if (content === undefined) {
+                missing.push(tab)
+            } else {
+                tab.content = content
+            }
+
+            // Once every lookup has finished, the list of missing tabs is
+            // complete.
+            remaining--
+            if (remaining == 0) {
+                callback(missing)
+            }
+        })
+    }
+}
+
+// storeTabs puts the content of each of the tabs into the cache, and stores
+// the list of tabs without their content for when the server can't be
+// reached.
+function storeTabs(tabs) {
+    for (var tab of tabs) {
+        cachePut("content", tab.contentHash, tab.content)
+    }
+
+    cachePut("lists", tabListKey, tabs.map(tab => Object.assign({}, tab, { content: "" })))
+}
+
+// previousHashes calls callback with an object mapping the ID of each tab in
+// the last list which was stored to the hash of its content at the time.
+function previousHashes(callback) {
+    cacheGet("lists", tabListKey, list => {
+        var hashes = {}
+
+        for (var tab of list || []) {
+            hashes[tab.id] = tab.contentHash
+        }
+
+        callback(hashes)
+    })
+}
+
+// applyDelta turns a tab's old content into its new content, using the steps
+// from /api/v1/tab/{id}/delta. Each step either keeps some of the old lines,
+// skips some of them, or inserts new ones.
+function applyDelta(content, ops) {
+    var before = content.split("\n")
+    var after = []
+    var at = 0
+
+    for (var op of ops) {
+        if (op.keep) {
+            after.push(...before.slice(at, at + op.keep))
+            at += op.keep
+        } else if (op.delete) {
+            at += op.delete
+        } else if (op.insert) {
+            after.push(...op.insert)
+        }
+    }
+
+    return after.join("\n")
+}
@@ -0,0 +1,192 @@
+// The display shows a single tab in large type and scrolls through it on its
+// own, so that it can be cast to a TV. It is opened at /display/{id}, where
+// the ID is either a tab's ID, or "live" to show whichever tab is being
+// performed, which the server tells the display about over a WebSocket as
+// soon as it changes, so that it moves on as soon as the performer does. The
+// display is often on a network whose proxy won't pass a WebSocket through,
+// so if one can't be opened, the event log is long-polled instead.
+
+// displayedID is the ID of the tab which is currently being shown.
+var displayedID
+
+// scrollSpeed is how many pixels the tab scrolls by each second. It can be
+// given in the 'speed' query value, and changed with the arrow keys.
+var scrollSpeed = 30
+
+// paused is true while the scrolling is paused, which is toggled with the
+// space bar.
+var paused = false
+
+// eventCursor is the ID of the last event which the display has seen, so that
+// it doesn't miss any between waiting for them, when it is long-polling the
+// event log.
+var eventCursor
+
+// These say how long to wait before trying again when the server can't be
+// reached, and how often the page is scrolled, in milliseconds.
+var retryInterval = 3000
+var scrollInterval = 50
+
+// scrolled is how far the page should have scrolled, which is kept separately
+// from the page's actual scroll position because that is rounded to whole
+// pixels, and small steps would be lost.
+var scrolled = 0
+
+// The event handlers are added here rather than in the HTML, since the
+// content security policy doesn't allow inline scripts.
+window.addEventListener("load", onLoad)
+document.addEventListener("keydown", keyPressed)
+
+// This function will be called after the DOM has been completely
+// loaded.
+function onLoad() {
+    var speed = parseFloat(new URLSearchParams(location.search).get("speed"))
+    if (!isNaN(speed) && speed >= 0) {
+        scrollSpeed = speed
+    }
+
+    // The path is /display/{id}, so the ID is the last part of it.
+    var id = decodeURIComponent(location.pathname.split("/").pop())
+
+    if (id == "live") {
+        followPerformance()
+    } else {
+        showTab(id)
+    }
+
+    setInterval(scrollStep, scrollInterval)
+}
+
+// followPerformance opens a WebSocket which the server sends the tabs on
+// show over, straight away and then each time they change, and shows the one
+// being performed. If the connection drops, it is opened again, but if it
+// couldn't be opened at all, the event log is long-polled instead.
+function followPerformance() {
+    var protocol = location.protocol == "https:" ? "wss:" : "ws:"
+    var socket = new WebSocket(protocol + "//" + location.host + "/api/v1/now-showing")
+    var opened = false
+
+    socket.onopen = () => opened = true
+
+    socket.onmessage = evt => {
+        var performing = JSON.parse(evt.data).showing.performing
+        if (performing != undefined && performing != displayedID) {
+            showTab(performing)
+        }
+    }
+
+    socket.onclose = () => {
+        if (opened) {
+            setTimeout(followPerformance, retryInterval)
+        } else {
+            pollPerformance()
+        }
+    }
+}
+
+// pollPerformance asks the server which tab is being performed and shows
+// it, and then waits for it to change. The cursor is fetched before the tab
+// being performed, so that a change in between isn't missed.
+function pollPerformance() {
+    getJSON("/api/v1/events?types=now-showing.changed", result => {
+        eventCursor = result.cursor
+
+        getJSON("/api/v1/now-showing", showing => {
+            if (showing.performing != undefined && showing.performing != displayedID) {
+                showTab(showing.performing)
+            }
+
+            waitForPerformance()
+        }, () => setTimeout(pollPerformance, retryInterval))
+    }, () => setTimeout(pollPerformance, retryInterval))
+}
+
+// waitForPerformance waits for the tab being performed to change, shows the
+// new one, and then waits again.
+function waitForPerformance() {
+    var path = "/api/v1/events?types=now-showing.changed&cursor=" + encodeURIComponent(eventCursor)
+
+    getJSON(path, result => {
+        eventCursor = result.cursor
+
+        // Only the last of the tabs which were performed while the
+        // display was waiting is shown, since the others are over.
+        var performing = displayedID
+        for (var event of result.events) {
+            if (event.data.state == "performing" && event.data.id != "") {
+                performing = event.data.id
+            }
+        }
+
+        if (performing != displayedID) {
+            showTab(performing)
+        }
+
+        waitForPerformance()
+    }, () => setTimeout(waitForPerformance, retryInterval))
+}
+
+// showTab fetches the tab with the given ID and shows it, starting from the
+// top.
+function showTab(id) {
+    displayedID = id
+
+    getJSON("/api/v1/tab/" + encodeURIComponent(id), tab => {
+        document.getElementById("title").textContent = tab.title
+        document.getElementById("info").textContent = tab.artist
+        // A binary tab, such as a Guitar Pro file, has no content to show.
+        document.getElementById("content").textContent = tab.binary ? "This tab can only be opened in the program it was made with." : tab.content
+
+        scrolled = 0
+        window.scrollTo(0, 0)
+    }, req => {
+        document.getElementById("title").textContent = "This tab couldn't be shown"
+        document.getElementById("info").textContent = req.status + ": " + errorMessage(req)
+        document.getElementById("content").textContent = ""
+    })
+}
+
+// scrollStep scrolls the page down a little, unless the scrolling is paused.
+function scrollStep() {
+    if (paused) return
+
+    scrolled += scrollSpeed * scrollInterval / 1000
+    window.scrollTo(0, scrolled)
+
+    // Stop at the bottom, so that speeding up again later doesn't have to
+    // make up for all the time spent there.
+    var bottom = document.documentElement.scrollHeight - window.innerHeight
+    if (scrolled > bottom) {
+        scrolled = Math.max(bottom, 0)
+    }
+}
+
+// keyPressed lets the display be controlled with a keyboard or a remote
+// which sends key presses: space pauses and resumes the scrolling, up and
+// down change its speed, and home goes back to the top.
+function keyPressed(evt) {
+    switch (evt.key) {
+    case " ":
+        paused = !paused
+        document.getElementById("paused-notice").classList.toggle("invisible", !paused)
+        break
+
+    case "ArrowUp":
+        scrollSpeed = Math.max(scrollSpeed - 5, 0)
+        break
+
+    case "ArrowDown":
+        scrollSpeed += 5
+        break
+
+    case "Home":
+        scrolled = 0
+        window.scrollTo(0, 0)
+        break
+
+    default:
+        return
+    }
+
+    evt.preventDefault()
+}
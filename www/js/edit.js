@@ -0,0 +1,270 @@
+// The editor lets several people edit a tab's content at once, such as two
+// band members fixing a transcription together during a rehearsal. It is
+// opened at /edit/{id}, and joins the tab's room by opening a WebSocket at
+// /api/v1/tab/{id}/collab, which sends the content and then every change
+// which anyone makes to it. Changes made here are sent over the same
+// WebSocket one at a time, as an operation which replaces part of the
+// content, and the changes which haven't been applied by the server yet are
+// transformed against everyone else's as they arrive, in the same way as the
+// server does, so that everyone ends up with the same content.
+
+// tabID is the ID of the tab being edited.
+var tabID
+
+// clientID identifies the operations which this page sent, when the server
+// sends them back to everyone in the room.
+var clientID = Math.random().toString(36).slice(2)
+
+// version is the version of the content which the server last sent.
+var version
+
+// sent is the operation which has been sent to the server but hasn't come
+// back yet, if there is one.
+var sent = null
+
+// base is the content as it will be once the server has applied every
+// operation which it has sent and the one which was sent to it. Whatever has
+// changed in the textarea since is sent as the next operation.
+var base = ""
+
+// socket is the WebSocket connected to the tab's room.
+var socket
+
+// retryInterval is how long to wait before joining the room again when the
+// connection drops, in milliseconds.
+var retryInterval = 3000
+
+// The event handlers are added here rather than in the HTML, since the
+// content security policy doesn't allow inline scripts.
+window.addEventListener("load", onLoad)
+
+// This function will be called after the DOM has been completely
+// loaded.
+function onLoad() {
+    // The path is /edit/{id}, so the ID is the last part of it.
+    tabID = decodeURIComponent(location.pathname.split("/").pop())
+
+    document.getElementById("content").addEventListener("input", sendChanges)
+    document.getElementById("recordings-link").href = "/recordings?tab=" + encodeURIComponent(tabID)
+
+    getJSON("/api/v1/tab/" + encodeURIComponent(tabID), tab => {
+        document.getElementById("title").textContent = tab.title + " by " + tab.artist
+    }, () => {})
+
+    join()
+}
+
+// collabPath returns the path of the tab's room.
+function collabPath() {
+    return "/api/v1/tab/" + encodeURIComponent(tabID) + "/collab"
+}
+
+// join checks that the user is allowed to edit the tab, asking them to log in
+// if they aren't yet, and then joins its room.
+function join() {
+    getJSON(collabPath(), () => openRoom(), req => {
+        if (req.status == 401) {
+            login(join)
+        } else {
+            showStatus(req.status + ": " + errorMessage(req))
+        }
+    })
+}
+
+// openRoom connects to the tab's room, which sends the content again. Once
+// the content has arrived, the given message is shown, or a note that the tab
+// is being edited if there isn't one. If the connection drops, the room is
+// joined again.
+function openRoom(message) {
+    if (socket != undefined) {
+        socket.onclose = null
+        socket.close()
+    }
+
+    var protocol = location.protocol == "https:" ? "wss:" : "ws:"
+    socket = new WebSocket(protocol + "//" + location.host + collabPath())
+
+    // error is the error which the server sent before closing the
+    // connection, if it did.
+    var error
+
+    socket.onmessage = evt => {
+        var data = JSON.parse(evt.data)
+
+        if (data.snapshot) {
+            loadSnapshot(data.snapshot, message)
+            message = undefined
+        } else if (data.op) {
+            received(data.op)
+        } else if (data.error) {
+            error = data.error
+        }
+    }
+
+    socket.onclose = () => {
+        document.getElementById("content").disabled = true
+
+        // Whatever went wrong, the content here can't be trusted to match
+        // the server's any more, so the room is joined again.
+        if (error == undefined) {
+            showStatus("The connection was lost. Reconnecting...")
+            setTimeout(join, retryInterval)
+        } else if (error.code == "tab_locked") {
+            openRoom(error.message)
+        } else if (error.code == "conflict") {
+            openRoom("Fell too far behind, so the latest content has been loaded")
+        } else {
+            alert(error.message)
+            openRoom()
+        }
+    }
+}
+
+// loadSnapshot replaces the content with the room's snapshot of it, and
+// starts editing it, showing the given message, or a note that the tab is
+// being edited if there isn't one.
+function loadSnapshot(snapshot, message) {
+    var textarea = document.getElementById("content")
+    textarea.value = snapshot.content
+    textarea.disabled = false
+
+    version = snapshot.version
+    base = snapshot.content
+    sent = null
+
+    showStatus(message || "Editing. Changes are saved automatically.")
+}
+
+// received is called with each operation which the server applies to the
+// content. If it is the one which was sent from here, the next one can be
+// sent. Otherwise, it is someone else's, and it is transformed against the
+// changes made here which the server hasn't applied yet, and applied to the
+// textarea.
+function received(op) {
+    version = op.version
+
+    if (op.client == clientID && sent != null) {
+        sent = null
+        sendChanges()
+        return
+    }
+
+    var textarea = document.getElementById("content")
+
+    // The server applied this operation before the one which was sent, so
+    // it goes first when they are tied.
+    if (sent != null) {
+        var theirs = op
+        op = transform(op, sent, false)
+        sent = transform(sent, theirs, true)
+    }
+
+    var unsent = difference(base, textarea.value)
+
+    base = applyOp(base, op)
+    op = transform(op, unsent, false)
+
+    var start = movePosition(textarea.selectionStart, op)
+    var end = movePosition(textarea.selectionEnd, op)
+
+    textarea.value = applyOp(textarea.value, op)
+    textarea.setSelectionRange(start, end)
+}
+
+// sendChanges sends whatever has changed in the textarea since the last
+// operation was sent, unless that one hasn't come back yet.
+function sendChanges() {
+    var textarea = document.getElementById("content")
+
+    if (sent != null || textarea.value == base) return
+    if (socket == undefined || socket.readyState != WebSocket.OPEN) return
+
+    sent = difference(base, textarea.value)
+    base = textarea.value
+
+    socket.send(JSON.stringify({
+        version: version,
+        pos: sent.pos,
+        delete: sent.delete,
+        insert: sent.insert,
+        client: clientID,
+    }))
+}
+
+// difference returns the operation which turns the content from into the
+// content to, replacing everything between their common start and end.
+function difference(from, to) {
+    var start = 0
+    while (start < from.length && start < to.length && from[start] == to[start]) {
+        start++
+    }
+
+    var end = 0
+    while (end < from.length - start && end < to.length - start &&
+           from[from.length - end - 1] == to[to.length - end - 1]) {
+        end++
+    }
+
+    return {
+        pos: start,
+        delete: from.length - start - end,
+        insert: to.slice(start, to.length - end),
+    }
+}
+
+// applyOp returns the content with the operation applied to it.
+function applyOp(content, op) {
+    return content.slice(0, op.pos) + op.insert + content.slice(op.pos + op.delete)
+}
+
+// movePosition returns where a position in the content, such as the cursor,
+// is once the operation has been applied.
+function movePosition(position, op) {
+    if (position <= op.pos) {
+        return position
+    } else if (position >= op.pos + op.delete) {
+        return position + op.insert.length - op.delete
+    }
+
+    return op.pos + op.insert.length
+}
+
+// transform changes the operation a, which was made to the same content as b,
+// so that it does the same thing once b has been applied. It works in the
+// same way as the server's, which is described in collab.go. When both
+// insert text at the same place, or replace the same range, bFirst says
+// whether b's text goes first.
+function transform(a, b, bFirst) {
+    var aEnd = a.pos + a.delete
+    var bEnd = b.pos + b.delete
+    var shift = b.insert.length - b.delete
+
+    var overlapAfter = a.pos >= b.pos && aEnd >= bEnd
+    var overlapBefore = a.pos <= b.pos && aEnd <= bEnd
+
+    if (overlapAfter && overlapBefore) {
+        overlapAfter = bFirst
+        overlapBefore = !bFirst
+    }
+
+    if (a.delete == 0 && b.delete == 0 && a.pos == b.pos) {
+        return bFirst ? {pos: a.pos + b.insert.length, delete: 0, insert: a.insert} : a
+    } else if (aEnd <= b.pos) {
+        return a
+    } else if (a.pos >= bEnd) {
+        return {pos: a.pos + shift, delete: a.delete, insert: a.insert}
+    } else if (overlapAfter) {
+        return {pos: b.pos + b.insert.length, delete: aEnd - bEnd, insert: a.insert}
+    } else if (overlapBefore) {
+        return {pos: a.pos, delete: b.pos - a.pos, insert: a.insert}
+    } else if (a.pos < b.pos) {
+        return {pos: a.pos, delete: a.delete + shift, insert: a.insert}
+    }
+
+    return {pos: b.pos, delete: 0, insert: ""}
+}
+
+// showStatus shows a message under the title.
+function showStatus(message) {
+    document.getElementById("status").textContent = message
+}
@@ -3,58 +3,194 @@ var selectedID
 var chords
 var chordSymbols
 
+// performing is true while the selected tab is being announced as the one
+// being performed, so that choosing the next tab moves on to it.
+var performing = false
+
+window.addEventListener("load", onLoad)
+
 // This function will be called after the DOM has been completely
 // loaded, meaning that the DOM elements can be referenced from
 // inside this function.
 function onLoad() {
-    updateTabList()
-    loadChords()
+    // The event handlers are added here rather than in the HTML, since
+    // the content security policy doesn't allow inline scripts.
+    document.getElementById("search-bar").addEventListener("input", showTabs)
+    document.getElementById("sorting").addEventListener("input", showTabs)
+    document.getElementById("delete-button").addEventListener("click", deleteSelected)
+    document.getElementById("favourite-button").addEventListener("click", toggleFavourite)
+    document.getElementById("explicit-button").addEventListener("click", toggleExplicit)
+    document.getElementById("download-button").addEventListener("click", shareDownload)
+    document.getElementById("save-button").addEventListener("click", saveFile)
+    document.getElementById("perform-button").addEventListener("click", togglePerforming)
+    document.getElementById("display-button").addEventListener("click", openDisplay)
+    document.getElementById("edit-button").addEventListener("click", openEditor)
+
+    loginIfRequired(() => {
+        updateTabList()
+        loadChords()
+    })
+    registerServiceWorker()
 }
 
-function updateTabList() {
-    // Create a new HTTP request object, which will be used
-    // to fetch the list of tabs from the server.
-    var req = new XMLHttpRequest()
+// registerServiceWorker installs the service worker, which keeps copies of
+// the pages so they can be used offline, and asks it to update them.
+function registerServiceWorker() {
+    if (!("serviceWorker" in navigator)) {
+        return
+    }
 
-    // The onreadystatechange method of the HTTP request is called
-    // when the state of the request changes. In this case, only
-    // ready state 4 (which means that the response has been received)
-    // is relevant.
-    req.onreadystatechange = function() {
-        if (this.readyState == 4) {
-            // If the status of the response is 200, the request was
-            // successful. 200 = OK.
-            if (this.status == 200) {
-                // Parse the JSON response into a list of objects.
-                tabs = JSON.parse(this.responseText)
+    navigator.serviceWorker.register("/sw.js").then(reg => {
+        if (reg.active) {
+            reg.active.postMessage("update")
+        }
+    })
+}
 
-                // Show the tabs which are now stored in the global
-                // variable, taking into account the sorting and
-                // filtering options.
-                showTabs()
+// maxSeparateFetches is the most tabs whose content will be fetched one by
+// one from /api/v1/tab/{id}. If more than this are missing from the cache (such
+// as the first time the page is loaded), the whole list is fetched instead.
+const maxSeparateFetches = 20
 
-                // If there is at least one tab in the list of tabs,
-                // select it initially so there isn't a huge blank
-                // area covering most of the page.
-                if (tabs.length > 0) {
-                    selectTab(tabs[0].ID)
-                }
+// staleRetryDelay is how many milliseconds to wait before asking for the tabs
+// again, after the server has said that the ones it sent might be out of
+// date because it is still fetching the latest ones.
+const staleRetryDelay = 5000
+
+function updateTabList() {
+    // First, fetch the list of tabs without their content. The content
+    // hashes in the list are used to find which tabs' content is already
+    // in the browser's cache, so only the rest has to be downloaded.
+    openCache(() => getJSON("/api/v1/tabs?content=0", (list, req) => {
+        showStaleness(req)
+
+        fillContent(list, missing => {
+            if (missing.length > maxSeparateFetches) {
+                // Lots of tabs are missing, so it is quicker to just
+                // download all of them at once.
+                getJSON("/api/v1/tabs", full => {
+                    storeTabs(full)
+                    tabsLoaded(full)
+                }, showError)
             } else {
-                // If the execution gets here, an error has occured. Thus,
-                // send an error message to the user via an alert.
-                alert(this.status + ": " + this.responseText)
+                previousHashes(hashes => fetchContent(missing, hashes, () => {
+                    storeTabs(list)
+                    tabsLoaded(list)
+                }))
             }
+        })
+    }, req => {
+        // A status of 0 means that the server couldn't be reached at all,
+        // so show the tabs from the last time it could be, if there are
+        // any.
+        if (req.status != 0) {
+            showError(req)
+            return
         }
+
+        cacheGet("lists", tabListKey, list => {
+            if (list === undefined) {
+                showError(req)
+                return
+            }
+
+            fillContent(list, missing => tabsLoaded(list.filter(tab => !missing.includes(tab))))
+        })
+    }))
+}
+
+// showStaleness shows a notice if the server said that the tabs in its
+// response might be out of date, and asks for them again a bit later.
+function showStaleness(req) {
+    var stale = req.getResponseHeader("X-Stale") == "1"
+
+    document.getElementById("stale-notice").classList.toggle("invisible", !stale)
+
+    if (stale) {
+        setTimeout(updateTabList, staleRetryDelay)
     }
+}
 
-    // Send the HTTP GET request to /api/tabs. location.origin is
-    // the URL without the current path appended, so if I'm running
-    // the server locally it would be http://localhost:8000. true
-    // as the third parameter indicates that the request is
-    // asynchronous, meaning that the user can still interact with
-    // the page while the request is loading.
-    req.open("GET", location.origin + "/api/tabs", true)
-    req.send()
+// fetchContent downloads the content of each of the given tabs separately,
+// and calls callback once all of them have been fetched. previous maps the
+// IDs of the tabs to the hashes of their content the last time they were
+// stored, so that only the changes have to be downloaded for the ones which
+// were edited since then.
+function fetchContent(missing, previous, callback) {
+    var remaining = missing.length
+
+    if (remaining == 0) {
+        callback()
+        return
+    }
+
+    for (const tab of missing) {
+        fetchTabContent(tab, previous[tab.id], () => {
+            remaining--
+            if (remaining == 0) {
+                callback()
+            }
+        })
+    }
+}
+
+// fetchTabContent downloads the content of a tab, and calls callback once it
+// has been fetched. If the content with the previous hash is in the cache,
+// only the changes since then are downloaded and applied to it. Otherwise,
+// or if the server doesn't know about that version any more, the whole
+// content is downloaded.
+function fetchTabContent(tab, previousHash, callback) {
+    var fetchWhole = () => getJSON("/api/v1/tab/" + tab.id, fetched => {
+        tab.content = fetched.content
+        callback()
+    }, showError)
+
+    if (previousHash === undefined || previousHash == tab.contentHash) {
+        fetchWhole()
+        return
+    }
+
+    cacheGet("content", previousHash, old => {
+        if (old === undefined) {
+            fetchWhole()
+            return
+        }
+
+        getJSON("/api/v1/tab/" + tab.id + "/delta?from=" + previousHash, delta => {
+            // If the tab has changed again since the list was fetched,
+            // the delta won't give the content which the list expects.
+            if (delta.to != tab.contentHash) {
+                fetchWhole()
+                return
+            }
+
+            tab.content = applyDelta(old, delta.ops)
+            callback()
+        }, fetchWhole)
+    })
+}
+
+// tabsLoaded is called with the list of tabs once it has been loaded,
+// either from the server or from the cache.
+function tabsLoaded(list) {
+    tabs = list
+
+    // Show the tabs which are now stored in the global
+    // variable, taking into account the sorting and
+    // filtering options.
+    showTabs()
+
+    // If there is at least one tab in the list of tabs,
+    // select it initially so there isn't a huge blank
+    // area covering most of the page.
+    if (tabs.length > 0) {
+        selectTab(tabs[0].id)
+    }
+}
+
+// showError sends an error message to the user via an alert.
+function showError(req) {
+    alert(req.status + ": " + errorMessage(req))
 }
 
 function showTabs() {
@@ -82,9 +218,15 @@ function showTabs() {
     // element with its title and artist's name to the tab
     // list element.
     for (var tab of tabsToDisplay) {
-        const id = tab.ID
+        const id = tab.id
         var li = document.createElement("li")
         li.innerHTML = "<strong>" + tab.title + "</strong> &mdash; " + tab.artist
+        if (tab.isFavourite) {
+            li.innerHTML = "&#9733; " + li.innerHTML
+        }
+        if (tab.explicit) {
+            li.innerHTML += " <em>(explicit)</em>"
+        }
         li.onclick = () => selectTab(id)
         ul.appendChild(li)
     }
@@ -149,7 +291,7 @@ function selectTab(id) {
     // Linearly search through the list of tabs, looking for
     // the one with the requested ID.
     for (var tab of tabs) {
-        if (tab.ID == id) {
+        if (tab.id == id) {
             selected = tab
             break
         }
@@ -168,59 +310,239 @@ function selectTab(id) {
     // tab object.
     document.getElementById("title").innerHTML = selected.title
     document.getElementById("info").innerHTML = selected.artist + " (" + selected.tags + ")"
+    document.getElementById("practice").textContent = practiceSummary(selected)
+    document.getElementById("chord-list").textContent = chordSummary(selected)
     document.getElementById("content").innerHTML = selected.content
+    document.getElementById("favourite-button").innerHTML = selected.isFavourite ? "Unstar" : "Star"
+    document.getElementById("explicit-button").innerHTML = selected.explicit ? "Mark Clean" : "Mark Explicit"
+
+    showBinaryNotice(selected)
 
     showChords()
+    showEditLock(id)
+    announceSelected()
 }
 
-// deleteSelected sends a HTTP request to /api/delete-tab to
-// delete the currently selected tab. A prompt dialog box is
-// opened to ask the user to enter their password.
+// binaryFormatNames are the names of the binary formats which a tab's file
+// can be in, such as Guitar Pro.
+const binaryFormatNames = {
+    "guitar-pro": "Guitar Pro",
+    "guitar-pro-3": "Guitar Pro 3",
+    "guitar-pro-4": "Guitar Pro 4",
+    "guitar-pro-5": "Guitar Pro 5",
+    "guitar-pro-6": "Guitar Pro 6",
+    "guitar-pro-7": "Guitar Pro 7",
+    "power-tab": "Power Tab",
+    "musicxml": "MusicXML",
+    "musicxml-compressed": "compressed MusicXML",
+}
+
+// showBinaryNotice says that the tab is a binary file, if it is, with a link
+// to download it, since it has no content to show. A binary tab can't be
+// edited either, so the button to edit it is hidden.
+function showBinaryNotice(tab) {
+    document.getElementById("binary-notice").classList.toggle("invisible", !tab.binary)
+    document.getElementById("edit-button").classList.toggle("invisible", tab.binary)
+
+    if (tab.binary) {
+        document.getElementById("binary-format").textContent = binaryFormatNames[tab.format] || tab.format
+        document.getElementById("binary-link").href = "/api/v1/tab/" + encodeURIComponent(tab.id) + "/file"
+    }
+}
+
+// showEditLock warns that someone else is editing the tab with the given ID,
+// if they have locked it, since changes to it will be refused until they
+// have finished.
+function showEditLock(id) {
+    var warning = document.getElementById("lock-warning")
+    warning.textContent = ""
+
+    getJSON("/api/v1/tab/" + encodeURIComponent(id) + "/lock", status => {
+        if (status.locked && id == selectedID) {
+            warning.textContent = status.lock.name + " is editing this tab"
+        }
+    }, () => {})
+}
+
+// practiceSummary describes a tab's practice metadata in a line, such as
+// "Capo 2, DADGAD, 120 BPM. Skip the second verse", leaving out whatever
+// hasn't been set. The capo and tuning which were found in the tab's content
+// are used if the admin hasn't set them. Tabs cached by the page before
+// these existed don't have them.
+function practiceSummary(tab) {
+    var practice = tab.practice || {capo: 0, tuning: "", tempo: 0, notes: ""}
+    var capo = practice.capo || tab.capo
+    var tuning = practice.tuning || tab.tuning
+
+    var details = []
+
+    if (capo > 0) details.push("Capo " + capo)
+    if (tuning) details.push(tuning)
+    if (practice.tempo > 0) details.push(practice.tempo + " BPM")
+
+    var summary = details.join(", ")
+
+    if (practice.notes != "") {
+        summary += (summary == "" ? "" : ". ") + practice.notes
+    }
+
+    return summary
+}
+
+// chordSummary lists the chords which the server found in a tab, such as
+// "Chords: Em7, G, D/F#", or returns an empty string if it didn't find any.
+// Tabs cached by the page before chords were found don't have them.
+function chordSummary(tab) {
+    if (!tab.chords || tab.chords.length == 0) return ""
+
+    return "Chords: " + tab.chords.join(", ")
+}
+
+// announceSelected tells the server which tab is selected, so it can let any
+// home automation know. It is announced as being performed if a performance
+// has been started, and as being viewed otherwise. Announcing that it is
+// being viewed is only done quietly in the background, since most people
+// aren't logged in, and it doesn't matter if it fails.
+function announceSelected() {
+    var params = new URLSearchParams()
+    params.set("id", selectedID)
+
+    if (performing) {
+        params.set("state", "performing")
+        adminRequest("/api/v1/now-showing", params, () => {})
+        return
+    }
+
+    params.set("state", "viewing")
+
+    var req = new XMLHttpRequest()
+    req.open("POST", location.origin + "/api/v1/now-showing", true)
+    req.setRequestHeader("X-CSRF-Token", csrfToken())
+    req.send(params)
+}
+
+// togglePerforming starts announcing the selected tab as the one being
+// performed, and the tabs selected after it as they are moved on to, or
+// stops if a performance has already been started. If the user isn't logged
+// in yet, they will be asked to enter their password first.
+function togglePerforming() {
+    if (selectedID == undefined && !performing) return
+
+    var params = new URLSearchParams()
+    params.set("state", "performing")
+
+    if (!performing) {
+        params.set("id", selectedID)
+    }
+
+    adminRequest("/api/v1/now-showing", params, () => {
+        performing = !performing
+        document.getElementById("perform-button").innerHTML = performing ? "Stop Performing" : "Perform"
+    })
+}
+
+// deleteSelected sends a HTTP request to /api/v1/delete-tab to
+// delete the currently selected tab. If the user isn't logged
+// in yet, they will be asked to enter their password first.
 function deleteSelected() {
-    // Ask the user to enter their password by opening up a
-    // prompt dialog, displaying the message "Enter your password:".
-    // No validation needs to be done here, as the ID will be
-    // validated server-side.
-    var password = prompt("Enter your password:")
-
-    // Create a new HTTP request object, which will be used
-    // to request the tab be deleted.
+    // Create a URLSearchParams object to store the form values which will
+    // be sent in the POST request to the server.
+    var params = new URLSearchParams()
+    params.set("id", selectedID)
+
+    // Send the request to /api/v1/delete-tab. Once the tab has been
+    // successfully deleted from the server, the tab list should be
+    // reloaded to reflect those changes.
+    adminRequest("/api/v1/delete-tab", params, () => updateTabList())
+}
+
+// toggleExplicit marks the currently selected tab as explicit if it
+// isn't already, or as clean if it is, by sending a HTTP request to
+// /api/v1/set-explicit. If the user isn't logged in yet, they will be asked
+// to enter their password first.
+function toggleExplicit() {
+    var selected = tabs.find(tab => tab.id == selectedID)
+    if (selected == undefined) return
+
+    var params = new URLSearchParams()
+    params.set("id", selectedID)
+    params.set("value", selected.explicit ? "clean" : "explicit")
+
+    // Once the tab has been marked, reload the tab list to reflect the
+    // change, since it might now be hidden.
+    adminRequest("/api/v1/set-explicit", params, () => updateTabList())
+}
+
+// toggleFavourite stars the currently selected tab if it isn't already, or
+// unstars it if it is. Anyone can star tabs, so this doesn't need the user
+// to log in; the server remembers the favourites of this browser.
+function toggleFavourite() {
+    var selected = tabs.find(tab => tab.id == selectedID)
+    if (selected == undefined) return
+
+    var params = new URLSearchParams()
+    params.set("id", selectedID)
+
     var req = new XMLHttpRequest()
 
-    // The onreadystatechange method of the HTTP request is called
-    // when the state of the request changes. In this case, only
-    // ready state 4 (which means that the response has been received)
-    // is relevant.
     req.onreadystatechange = function() {
         if (this.readyState == 4) {
-            // If the status of the response is 200, the request was
-            // successful. 200 = OK.
             if (this.status == 200) {
-                // In this case, the tab has been successfully deleted from
-                // the server. So now, the tab list should be reloaded to reflect those changes.
-                updateTabList()
+                selected.isFavourite = !selected.isFavourite
+                document.getElementById("favourite-button").innerHTML = selected.isFavourite ? "Unstar" : "Star"
+                showTabs()
             } else {
-                // If the execution gets here, an error has occured. Thus,
-                // send an error message to the user via an alert.
-                alert(this.status + ": " + this.responseText)
+                console.log("error starring tab:", this.status)
             }
         }
     }
 
-    // Create a URLSearchParams object to store the form values which will
-    // be sent in the POST request to the server.
+    req.open("POST", location.origin + (selected.isFavourite ? "/api/v1/unfavourite" : "/api/v1/favourite"), true)
+    req.setRequestHeader("X-CSRF-Token", csrfToken())
+    req.send(params)
+}
+
+// shareDownload asks the server for a signed link to download the currently
+// selected tab's file, and shows it so that it can be copied into another
+// program, which won't need to log in to use it. If the user isn't logged in
+// yet, they will be asked to enter their password first.
+function shareDownload() {
+    if (selectedID == undefined) return
+
     var params = new URLSearchParams()
-    params.set("password", password)
-    params.set("id", selectedID)
+    params.set("path", "/api/v1/download/" + selectedID)
 
-    // Send the HTTP GET request to /api/delete-tab. location.origin is
-    // the URL without the current path appended, so if I'm running
-    // the server locally it would be http://localhost:8000. true
-    // as the third parameter indicates that the request is
-    // asynchronous, meaning that the user can still interact with
-    // the page while the request is loading.
-    req.open("POST", location.origin + "/api/delete-tab", true)
-    req.send(params)
+    adminRequest("/api/v1/sign-url", params, req => {
+        var signed = JSON.parse(req.responseText)
+        prompt("This link will work for an hour:", location.origin + signed.url)
+    })
+}
+
+// saveFile downloads the selected tab's file as it is on disk, rather than
+// its content as it is shown.
+function saveFile() {
+    if (selectedID != undefined) {
+        location.href = "/api/v1/tab/" + encodeURIComponent(selectedID) + "/download"
+    }
+}
+
+// openDisplay opens the display view in a new tab, ready to be cast to a TV.
+// During a performance, it follows along with the tab being performed, and
+// otherwise it shows the selected tab.
+function openDisplay() {
+    if (performing) {
+        window.open("/display/live")
+    } else if (selectedID != undefined) {
+        window.open("/display/" + encodeURIComponent(selectedID))
+    }
+}
+
+// openEditor opens the selected tab in the editor in a new tab, where
+// everyone who opens it can edit its content at the same time.
+function openEditor() {
+    if (selectedID != undefined) {
+        window.open("/edit/" + encodeURIComponent(selectedID))
+    }
 }
 
 function loadChords() {
@@ -262,7 +584,7 @@ function showChords() {
     // Linearly search through the list of tabs, looking for
     // the one with the selected ID.
     for (var tab of tabs) {
-        if (tab.ID == selectedID) {
+        if (tab.id == selectedID) {
             selected = tab
             break
         }
@@ -410,4 +732,4 @@ function chordSymbolClicked(evt) {
         
         box.appendChild(elem)
     }
-}
\ No newline at end of file
+}
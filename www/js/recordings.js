@@ -0,0 +1,221 @@
+// The recordings page plays the rehearsal recordings attached to a tab or a
+// setlist, whose ID is given in the 'tab' or 'setlist' query value, and lets
+// more be uploaded. Each recording's waveform is drawn above it, and clicking
+// on the waveform skips to that point.
+
+// attachment is the query value which says what the recordings are attached
+// to, such as "tab" or "setlist", and attachedID is its ID.
+var attachment
+var attachedID
+
+// The event handlers are added here rather than in the HTML, since the
+// content security policy doesn't allow inline scripts.
+window.addEventListener("load", onLoad)
+
+// This function will be called after the DOM has been completely
+// loaded.
+function onLoad() {
+    var query = new URLSearchParams(location.search)
+
+    for (var kind of ["tab", "setlist"]) {
+        if (query.get(kind)) {
+            attachment = kind
+            attachedID = query.get(kind)
+        }
+    }
+
+    document.getElementById("upload-form").addEventListener("submit", upload)
+
+    if (attachment == "tab") {
+        getJSON("/api/v1/tab/" + encodeURIComponent(attachedID), tab => {
+            document.getElementById("title").textContent = "Recordings of " + tab.title
+        }, () => {})
+    } else if (attachment == "setlist") {
+        getJSON("/api/v1/setlists/" + encodeURIComponent(attachedID), setlist => {
+            document.getElementById("title").textContent = "Recordings of " + setlist.name
+        }, () => {})
+    } else {
+        // Without a tab or setlist, every recording is shown, but there's
+        // nothing to attach a new one to.
+        document.getElementById("upload-form").classList.add("invisible")
+    }
+
+    loadRecordings()
+}
+
+// loadRecordings shows the recordings, asking the user to log in if they
+// haven't yet.
+function loadRecordings() {
+    var path = "/api/v1/recordings"
+    if (attachment != undefined) {
+        path += "?" + attachment + "=" + encodeURIComponent(attachedID)
+    }
+
+    getJSON(path, recordings => {
+        var div = document.getElementById("recordings")
+        div.innerHTML = ""
+
+        showStatus(recordings.length == 0 ? "There aren't any recordings yet." : "")
+
+        for (var recording of recordings) {
+            div.appendChild(recordingElement(recording))
+        }
+    }, req => {
+        if (req.status == 401) {
+            showStatus("Log in to listen to the recordings.")
+            login(loadRecordings)
+        } else {
+            showStatus(req.status + ": " + errorMessage(req))
+        }
+    })
+}
+
+// recordingElement returns the element which shows a recording, with its
+// waveform, a player and a button to delete it.
+function recordingElement(recording) {
+    var div = document.createElement("div")
+    div.className = "recording"
+
+    var h3 = document.createElement("h3")
+    h3.textContent = recording.title
+    div.appendChild(h3)
+
+    var details = document.createElement("p")
+    details.className = "details"
+    details.textContent = "Uploaded by " + recording.uploadedBy + " on " + new Date(recording.uploaded).toLocaleDateString()
+    if (recording.duration > 0) {
+        details.textContent += ", " + formatDuration(recording.duration)
+    }
+    div.appendChild(details)
+
+    var path = "/api/v1/recordings/" + encodeURIComponent(recording.id)
+
+    var audio = document.createElement("audio")
+    audio.controls = true
+    audio.preload = "metadata"
+    audio.src = path + "/audio"
+
+    if (recording.waveform) {
+        var canvas = document.createElement("canvas")
+        div.appendChild(canvas)
+
+        getJSON(path + "/waveform", waveform => {
+            var draw = () => drawWaveform(canvas, waveform.peaks, audio.currentTime / (audio.duration || waveform.duration))
+            draw()
+
+            audio.addEventListener("timeupdate", draw)
+            window.addEventListener("resize", draw)
+
+            canvas.addEventListener("click", evt => {
+                var fraction = evt.offsetX / canvas.clientWidth
+                audio.currentTime = fraction * (audio.duration || waveform.duration)
+                draw()
+            })
+        }, () => canvas.remove())
+    }
+
+    div.appendChild(audio)
+
+    var button = document.createElement("button")
+    button.textContent = "Delete"
+    button.addEventListener("click", () => {
+        if (confirm("Are you sure you want to delete " + recording.title + "?")) {
+            sendRequest("DELETE", path, null, loadRecordings)
+        }
+    })
+    div.appendChild(button)
+
+    return div
+}
+
+// drawWaveform draws the peaks of a waveform across the canvas, with the part
+// before the given fraction of the way through, which has been played, in a
+// darker colour.
+function drawWaveform(canvas, peaks, played) {
+    canvas.width = canvas.clientWidth * window.devicePixelRatio
+    canvas.height = canvas.clientHeight * window.devicePixelRatio
+
+    var ctx = canvas.getContext("2d")
+    var width = canvas.width / peaks.length
+    var middle = canvas.height / 2
+
+    ctx.clearRect(0, 0, canvas.width, canvas.height)
+
+    for (var i = 0; i < peaks.length; i++) {
+        var height = Math.max(peaks[i] * canvas.height, 1)
+
+        ctx.fillStyle = i / peaks.length < played ? "rgb(50, 50, 50)" : "rgb(180, 180, 180)"
+        ctx.fillRect(i * width, middle - height / 2, Math.max(width - 1, 1), height)
+    }
+}
+
+// formatDuration returns a number of seconds written as minutes and seconds,
+// such as "3:05".
+function formatDuration(seconds) {
+    seconds = Math.round(seconds)
+    return Math.floor(seconds / 60) + ":" + String(seconds % 60).padStart(2, "0")
+}
+
+// upload sends the file in the form to /api/v1/recordings, attached to the
+// tab or setlist, and shows it once it has been uploaded.
+function upload(evt) {
+    evt.preventDefault()
+
+    var data = new FormData()
+    data.set("file", document.getElementById("file").files[0])
+    data.set("title", document.getElementById("recording-title").value)
+    data.set(attachment, attachedID)
+
+    var button = document.getElementById("upload-button")
+    button.disabled = true
+
+    sendRequest("POST", "/api/v1/recordings", data, () => {
+        document.getElementById("upload-form").reset()
+        button.disabled = false
+        button.textContent = "Upload"
+        loadRecordings()
+    }, evt => {
+        button.textContent = "Uploading... " + Math.round(evt.loaded / evt.total * 100) + "%"
+    }, () => {
+        button.disabled = false
+        button.textContent = "Upload"
+    })
+}
+
+// sendRequest sends a request with the given method and body to an API
+// endpoint which needs the user to be logged in, along with the session's
+// CSRF token, and calls onSuccess once it has succeeded. onProgress is called
+// as the body is uploaded, and onFailure if it fails, if they are given.
+function sendRequest(method, path, body, onSuccess, onProgress, onFailure) {
+    var req = new XMLHttpRequest()
+
+    req.onreadystatechange = function() {
+        if (this.readyState != 4) return
+
+        if (this.status == 200) {
+            onSuccess()
+            return
+        }
+
+        if (onFailure) onFailure()
+
+        if (this.status == 401) {
+            login(() => sendRequest(method, path, body, onSuccess, onProgress, onFailure))
+        } else {
+            alert(this.status + ": " + errorMessage(this))
+        }
+    }
+
+    if (onProgress) {
+        req.upload.addEventListener("progress", onProgress)
+    }
+
+    req.open(method, location.origin + path, true)
+    req.setRequestHeader("X-CSRF-Token", csrfToken())
+    req.send(body)
+}
+
+// showStatus shows a message under the title.
+function showStatus(message) {
+    document.getElementById("status").textContent = message
+}
@@ -0,0 +1,185 @@
+// The request page lets anyone ask for a song while open mic mode is on. If
+// there is already a tab for it, they are given links to it, and otherwise it
+// is put on the wishlist. The band can ask for songs at any time, and see the
+// wishlist, vote for the songs on it, and clear it from the same page.
+
+// The event handlers are added here rather than in the HTML, since the
+// content security policy doesn't allow inline scripts.
+window.addEventListener("load", onLoad)
+
+// This function will be called after the DOM has been completely
+// loaded.
+function onLoad() {
+    document.getElementById("request-form").addEventListener("submit", requestSong)
+    document.getElementById("wishlist-button").addEventListener("click", loadWishlist)
+    document.getElementById("clear-button").addEventListener("click", clearWishlist)
+
+    // The form is only shown if songs can be requested at the moment.
+    getJSON("/api/v1/settings", settings => {
+        if (settings.openMic) {
+            document.getElementById("request-form").classList.remove("invisible")
+        } else {
+            showStatus("Songs can't be requested at the moment.")
+        }
+    }, req => showStatus(req.status + ": " + errorMessage(req)))
+}
+
+// requestSong sends the song in the form to /api/v1/song-requests, and shows
+// the tabs which it matched, or says that it was put on the wishlist.
+function requestSong(evt) {
+    evt.preventDefault()
+
+    var params = new URLSearchParams()
+    params.set("song", document.getElementById("song").value)
+    params.set("artist", document.getElementById("artist").value)
+    params.set("name", document.getElementById("name").value)
+
+    var req = new XMLHttpRequest()
+
+    req.onreadystatechange = function() {
+        if (this.readyState != 4) return
+
+        if (this.status != 200) {
+            showStatus(errorMessage(this))
+            return
+        }
+
+        var result = JSON.parse(this.responseText)
+        var ul = document.getElementById("matches")
+        ul.innerHTML = ""
+
+        if (result.matches.length == 0) {
+            showStatus("There isn't a tab for that yet, so it has been put on the wishlist.")
+        } else {
+            showStatus("That's already here! Show one of these to whoever is playing:")
+        }
+
+        for (var match of result.matches) {
+            var a = document.createElement("a")
+            a.href = match.url
+            a.textContent = match.title + " by " + match.artist
+
+            var li = document.createElement("li")
+            li.appendChild(a)
+            ul.appendChild(li)
+        }
+
+        document.getElementById("song").value = ""
+        document.getElementById("artist").value = ""
+    }
+
+    // The CSRF token is only there if the user has logged in, but then the
+    // session is sent along too, which needs it.
+    req.open("POST", location.origin + "/api/v1/song-requests", true)
+    req.setRequestHeader("X-CSRF-Token", csrfToken())
+    req.send(params)
+}
+
+// loadWishlist shows the songs on the wishlist, asking the user to log in if
+// they haven't yet. Whoever can see the wishlist can add to it too, so the
+// form is shown as well.
+function loadWishlist() {
+    getJSON("/api/v1/song-requests", requests => {
+        var ul = document.getElementById("wishlist")
+        ul.innerHTML = ""
+
+        if (requests.length == 0) {
+            ul.textContent = "Nobody has requested a song which isn't here."
+        }
+
+        for (var request of requests) {
+            ul.appendChild(wishlistItem(request))
+        }
+
+        document.getElementById("clear-button").classList.remove("invisible")
+        document.getElementById("request-form").classList.remove("invisible")
+    }, req => {
+        if (req.status == 401) {
+            login(loadWishlist)
+        } else {
+            alert(req.status + ": " + errorMessage(req))
+        }
+    })
+}
+
+// wishlistItem returns the list item which shows a song on the wishlist, such
+// as "Wonderwall by Oasis (3 votes) from Sam, Alex", with buttons to vote for
+// it and remove it. If a tab has been added for the song, it links to it.
+function wishlistItem(request) {
+    var li = document.createElement("li")
+    li.textContent = request.song
+
+    if (request.artist != "") {
+        li.textContent += " by " + request.artist
+    }
+
+    if (request.votes != 1) {
+        li.textContent += " (" + request.votes + " votes)"
+    }
+
+    if (request.requestedBy.length > 0) {
+        var names = document.createElement("span")
+        names.className = "names"
+        names.textContent = " from " + request.requestedBy.join(", ")
+        li.appendChild(names)
+    }
+
+    var path = "/api/v1/song-requests/" + encodeURIComponent(request.id)
+
+    if (request.fulfilledBy != "") {
+        li.classList.add("fulfilled")
+
+        var a = document.createElement("a")
+        a.href = "/display/" + encodeURIComponent(request.fulfilledBy)
+        a.textContent = " (tab added)"
+        li.appendChild(a)
+    } else {
+        var vote = document.createElement("button")
+        vote.textContent = "Vote"
+        vote.addEventListener("click", () => sendRequest("POST", path + "/vote", loadWishlist))
+        li.appendChild(vote)
+    }
+
+    var remove = document.createElement("button")
+    remove.textContent = "Remove"
+    remove.addEventListener("click", () => sendRequest("DELETE", path, loadWishlist))
+
+    li.appendChild(remove)
+    return li
+}
+
+// clearWishlist removes every song from the wishlist, once the user has
+// confirmed it.
+function clearWishlist() {
+    if (confirm("Are you sure you want to clear the wishlist?")) {
+        sendRequest("DELETE", "/api/v1/song-requests", loadWishlist)
+    }
+}
+
+// sendRequest sends a request with the given method to an API endpoint which
+// only the band can use, along with the session's CSRF token, and calls
+// onSuccess once it has succeeded.
+function sendRequest(method, path, onSuccess) {
+    var req = new XMLHttpRequest()
+
+    req.onreadystatechange = function() {
+        if (this.readyState != 4) return
+
+        if (this.status == 200) {
+            onSuccess()
+        } else if (this.status == 401) {
+            login(() => sendRequest(method, path, onSuccess))
+        } else {
+            alert(this.status + ": " + errorMessage(this))
+        }
+    }
+
+    req.open(method, location.origin + path, true)
+    req.setRequestHeader("X-CSRF-Token", csrfToken())
+    req.send()
+}
+
+// showStatus shows a message under the title.
+function showStatus(message) {
+    document.getElementById("status").textContent = message
+}
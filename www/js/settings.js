@@ -1,4 +1,25 @@
+window.addEventListener("load", onLoad)
+
 function onLoad() {
+    // The event handlers are added here rather than in the HTML, since
+    // the content security policy doesn't allow inline scripts.
+    document.getElementById("suggest-button").addEventListener("click", suggestPatterns)
+    document.getElementById("preview-button").addEventListener("click", previewFilename)
+    document.getElementById("apply-button").addEventListener("click", apply)
+    document.getElementById("reload-button").addEventListener("click", reloadTabs)
+    document.getElementById("revoke-button").addEventListener("click", rotateSigningKey)
+    document.getElementById("change-password-button").addEventListener("click", changePassword)
+    document.getElementById("log-button").addEventListener("click", followLog)
+    document.getElementById("trash-button").addEventListener("click", loadTrash)
+
+    loadSettings()
+}
+
+// loadSettings fetches the current settings from the server and fills in the
+// inputs with them. The server only sends all of the settings to someone who
+// is logged in, so if it only sent the public ones, the user is asked to log
+// in first.
+function loadSettings() {
     // Create a new HTTP request object, which will be used to fetch
     // the current settings from the server.
     var req = new XMLHttpRequest()
@@ -15,80 +36,87 @@ function onLoad() {
                 // Parse the JSON response into a list of objects.
                 settings = JSON.parse(this.responseText)
 
+                // The tab directory is only sent along with the rest of
+                // the settings to someone who is logged in.
+                if (settings.tabDirectory === undefined) {
+                    login(loadSettings)
+                    return
+                }
+
                 // Set the initial values of the various inputs to their
                 // corresponding settings values.
-                document.getElementById("tab-directory").value = settings["tab-directory"]
-                document.getElementById("filename-pattern").value = settings["filename-pattern"]
-                document.getElementById("non-capital-words").value = settings["non-capital-words"]
-                document.getElementById("characters-to-remove").value = settings["characters-to-remove"]
+                document.getElementById("tab-directory").value = settings.tabDirectory
+                document.getElementById("filename-patterns").value = settings.filenamePatterns.join("\n")
+                document.getElementById("non-capital-words").value = settings.nonCapitalWords
+                document.getElementById("characters-to-remove").value = settings.charactersToRemove
+                document.getElementById("ignore-patterns").value = settings.ignorePatterns
+                document.getElementById("scan-depth").value = settings.scanDepth
+                document.getElementById("folder-metadata").value = settings.folderMetadata
+                document.getElementById("hide-explicit").checked = settings.hideExplicit
+                document.getElementById("public-mode").checked = settings.publicMode
+                document.getElementById("allowed-licenses").value = settings.allowedLicenses
+                document.getElementById("open-mic").checked = settings.openMic
+                document.getElementById("access-mode").value = settings.accessMode
+                document.getElementById("trash-days").value = settings.trashDays
+                document.getElementById("tab-cache-ttl").value = settings.tabCacheTTL
+                document.getElementById("serve-stale").checked = settings.serveStale
+                document.getElementById("auto-tag-rules").value = (settings.autoTagRules || [])
+                    .map(rule => rule.field + " contains " + rule.contains + " -> " + rule.tag)
+                    .join("\n")
+                document.getElementById("transform-script").value = settings.transformScript
+                document.getElementById("transform-script-timeout").value = settings.transformScriptTimeout
+
+                loadWarnings()
             } else {
                 // If the execution gets here, an error has occured. Thus,
                 // send an error message to the user via an alert.
-                alert(this.status + ": " + this.responseText)
+                alert(this.status + ": " + errorMessage(this))
             }
         }
     }
 
-    // Send the HTTP GET request to /api/settings. location.origin is
+    // Send the HTTP GET request to /api/v1/settings. location.origin is
     // the URL without the current path appended, so if I'm running
     // the server locally it would be http://localhost:8000. true
     // as the third parameter indicates that the request is
     // asynchronous, meaning that the user can still interact with
     // the page while the request is loading.
-    req.open("GET", location.origin + "/api/settings", true)
+    req.open("GET", location.origin + "/api/v1/settings", true)
     req.send()
 }
 
-// changeSettings sends a request to /api/change-settings, sending the four
-// parameters as POST values. It will also prompt the user to enter their
-// password in a dialog box.
-function changeSettings(tabDirectory, filenamePattern, nonCapitalWords, charactersToRemove) {
-    // Ask the user to enter their password by opening up a
-    // prompt dialog, displaying the message "Enter your password:".
-    // No validation needs to be done here, as the ID will be
-    // validated server-side.
-    var password = prompt("Enter your password:")
-
-    // Create a new HTTP request object, which will be used to change the
-    // settings by sending a request.
-    var req = new XMLHttpRequest()
-
-    // The onreadystatechange method of the HTTP request is called
-    // when the state of the request changes. In this case, only
-    // ready state 4 (which means that the response has been received)
-    // is relevant.
-    req.onreadystatechange = function() {
-        if (this.readyState == 4) {
-            // If the status is 200, the request was OK and the settings
-            // change was successful.
-            if (this.status == 200) {
-                alert("The settings have been updated! You may want to reload the\
-tabs from their files, otherwise the changes won't show up until you do.")
-            } else {
-                // At this point, some error has occured, so send an error
-                // message to the user.
-                alert(this.status + ": " + this.responseText)
-            }
-        }
-    }
-
+// changeSettings sends a request to /api/v1/change-settings, sending the
+// eighteen parameters as POST values. If the user isn't logged in yet, they will be
+// asked to enter their password first.
+function changeSettings(tabDirectory, filenamePatterns, nonCapitalWords, charactersToRemove, ignorePatterns, scanDepth, folderMetadata, hideExplicit, tabCacheTTL, serveStale, transformScript, transformScriptTimeout, autoTagRules, publicMode, allowedLicenses, openMic, accessMode, trashDays) {
     // Create a URLSearchParams object to store the form values which will
     // be sent in the POST request to the server.
     var params = new URLSearchParams()
-    params.set("password", password)
     params.set("tab-directory", tabDirectory)
-    params.set("filename-pattern", filenamePattern)
+    params.set("filename-patterns", filenamePatterns)
     params.set("non-capital-words", nonCapitalWords)
     params.set("characters-to-remove", charactersToRemove)
+    params.set("ignore-patterns", ignorePatterns)
+    params.set("scan-depth", scanDepth)
+    params.set("folder-metadata", folderMetadata)
+    params.set("hide-explicit", hideExplicit)
+    params.set("tab-cache-ttl", tabCacheTTL)
+    params.set("serve-stale", serveStale)
+    params.set("transform-script", transformScript)
+    params.set("transform-script-timeout", transformScriptTimeout)
+    params.set("auto-tag-rules", autoTagRules)
+    params.set("public-mode", publicMode)
+    params.set("allowed-licenses", allowedLicenses)
+    params.set("open-mic", openMic)
+    params.set("access-mode", accessMode)
+    params.set("trash-days", trashDays)
 
-    // Send the HTTP GET request to /api/change-settings. location.origin is
-    // the URL without the current path appended, so if I'm running
-    // the server locally it would be http://localhost:8000. true
-    // as the third parameter indicates that the request is
-    // asynchronous, meaning that the user can still interact with
-    // the page while the request is loading.
-    req.open("POST", location.origin + "/api/change-settings", true)
-    req.send(params)
+    // Send the request to /api/v1/change-settings. If the request was OK,
+    // the settings change was successful.
+    adminRequest("/api/v1/change-settings", params, () => {
+        alert("The settings have been updated! You may want to reload the\
+tabs from their files, otherwise the changes won't show up until you do.")
+    })
 }
 
 // apply gets the values from the input fields in the settings form and calls
@@ -96,16 +124,70 @@ tabs from their files, otherwise the changes won't show up until you do.")
 function apply() {
     // Get the value of each input field, storing them in variables.
     var tabDirectory = document.getElementById("tab-directory").value
-    var filenamePattern = document.getElementById("filename-pattern").value
     var charactersToRemove = document.getElementById("characters-to-remove").value
+    var scanDepth = document.getElementById("scan-depth").value
+    var folderMetadata = document.getElementById("folder-metadata").value
+    var hideExplicit = document.getElementById("hide-explicit").checked
+    var tabCacheTTL = document.getElementById("tab-cache-ttl").value
+    var serveStale = document.getElementById("serve-stale").checked
+    var publicMode = document.getElementById("public-mode").checked
+    var openMic = document.getElementById("open-mic").checked
+    var accessMode = document.getElementById("access-mode").value
+    var trashDays = document.getElementById("trash-days").value
+    var transformScript = document.getElementById("transform-script").value
+    var transformScriptTimeout = document.getElementById("transform-script-timeout").value
 
-    // Perform input validation. The only constraints are that both the
-    // tab directory and filename pattern at at least one character long.
+    // The filename patterns are entered one per line, since a pattern can
+    // contain commas, and are encoded as a JSON array in the order they're
+    // tried in. Blank lines are left out.
+    var filenamePatterns = document
+        .getElementById("filename-patterns")
+        .value
+        .split("\n")
+        .filter(s => s.trim().length > 0)
+
+    // The auto-tag rules are entered one per line, in the form
+    // "content contains capo -> capo", and are encoded as a JSON array of
+    // objects. Blank lines are left out.
+    var autoTagRules = []
+    var autoTagLines = document
+        .getElementById("auto-tag-rules")
+        .value
+        .split("\n")
+        .filter(s => s.trim().length > 0)
+
+    for (var line of autoTagLines) {
+        var match = /^\s*(filename|title|artist|content)\s+contains\s+(.+?)\s*->\s*(.+?)\s*$/i.exec(line)
+        if (match === null) {
+            alert("Each auto-tag rule must look like \"content contains capo -> capo\", where the first word is filename, title, artist or content")
+            return
+        }
+
+        autoTagRules.push({field: match[1].toLowerCase(), contains: match[2], tag: match[3]})
+    }
+
+    // Perform input validation. The constraints are that the tab directory
+    // is at least one character long, that there is at least one filename
+    // pattern, that the folder depth, memory cache time and days to keep
+    // deleted tabs are whole numbers which aren't negative, and that the
+    // transform script's time limit is between 1ms and 10s.
     if (tabDirectory.length == 0) {
         alert("You must enter a value for the tab directory")
         return
-    } else if (filenamePattern.length == 0) {
-        alert("You must enter a value for the filename pattern")
+    } else if (filenamePatterns.length == 0) {
+        alert("You must enter at least one filename pattern")
+        return
+    } else if (!/^\d+$/.test(scanDepth)) {
+        alert("The folder depth must be a whole number, at least 0")
+        return
+    } else if (!/^\d+$/.test(tabCacheTTL)) {
+        alert("The memory cache time must be a whole number of seconds, at least 0")
+        return
+    } else if (!/^\d+$/.test(trashDays)) {
+        alert("The days to keep deleted tabs must be a whole number, at least 0")
+        return
+    } else if (!/^\d+$/.test(transformScriptTimeout) || transformScriptTimeout < 1 || transformScriptTimeout > 10000) {
+        alert("The transform script time limit must be a whole number of milliseconds, from 1 to 10000")
         return
     }
 
@@ -122,39 +204,152 @@ function apply() {
         .value
         .split(",")
         .map(s => s.trim()))
+
+    // The ignore patterns are entered and encoded in the same way, except
+    // that empty patterns are left out, so an empty field means that there
+    // are no patterns.
+    var ignorePatterns = JSON.stringify(
+        document
+        .getElementById("ignore-patterns")
+        .value
+        .split(",")
+        .map(s => s.trim())
+        .filter(s => s.length > 0))
+
+    // And so are the allowed licenses.
+    var allowedLicenses = JSON.stringify(
+        document
+        .getElementById("allowed-licenses")
+        .value
+        .split(",")
+        .map(s => s.trim())
+        .filter(s => s.length > 0))
     
-    changeSettings(tabDirectory, filenamePattern, nonCapitalWords, charactersToRemove)
+    changeSettings(tabDirectory, JSON.stringify(filenamePatterns), nonCapitalWords, charactersToRemove, ignorePatterns, scanDepth, folderMetadata, hideExplicit, tabCacheTTL, serveStale, transformScript, transformScriptTimeout, JSON.stringify(autoTagRules), publicMode, allowedLicenses, openMic, accessMode, trashDays)
 }
 
 // reloadTabs removes all of the cached tabs from the database by sending
-// a HTTP request to /api/reset-cache. It will send an alert to the user
-// to say if that was successful or not.
+// a HTTP request to /api/v1/reset-cache, once the user has entered their
+// password again. It will send an alert to the user to say if that was
+// successful.
 function reloadTabs() {
-    // Make a new HTTP request object which will be used to send the HTTP
-    // request.
-    var req = new XMLHttpRequest()
+    var password = prompt("Enter your password to reload the tabs:")
+    if (password === null) {
+        return
+    }
 
-    // The readystatechange will run the following function when the state
-    // of the request is changed, which includes receiving a response.
-    req.onreadystatechange = function() {
-        if (this.readyState == 4) {
-            // Check the response status and send an alert message based
-            // on that status, saying either that the request was successful
-            // or not.
-            if (this.status == 200) {
-                alert("The tabs have been removed from the database. They can be reloaded by navigating back to the home page.")
-            } else {
-                alert("Something went wrong and the tabs couldn't be reloaded!")
-            }
+    var params = new URLSearchParams()
+    params.set("password", password)
+
+    adminRequest("/api/v1/reset-cache", params, req => {
+        var summary = JSON.parse(req.responseText)
+        alert(summary.tabs + " tabs have been removed from the database. They can be reloaded by navigating back to the home page.")
+    })
+}
+
+// suggestPatterns asks the server to suggest filename patterns which match
+// the files in the tab directory, and lists them under the patterns field.
+// Clicking on a suggestion adds it to the end of the patterns.
+function suggestPatterns() {
+    adminRequest("/api/v1/pattern/infer", new URLSearchParams(), req => {
+        var result = JSON.parse(req.responseText)
+        var list = document.getElementById("pattern-suggestions")
+
+        list.innerHTML = ""
+
+        if (result.patterns.length == 0) {
+            var item = document.createElement("li")
+            item.innerText = "No patterns match any of the " + result.files + " files."
+            list.appendChild(item)
+            return
         }
+
+        for (var suggestion of result.patterns) {
+            var item = document.createElement("li")
+
+            var pattern = document.createElement("code")
+            pattern.innerText = suggestion.pattern
+            item.appendChild(pattern)
+
+            // Show how much of the directory it matches, and what it
+            // makes of one of the files, so the admin can tell whether
+            // the artist and title are the right way round.
+            var example = suggestion.example
+            item.appendChild(document.createTextNode(
+                " matches " + Math.round(suggestion.percentage) + "% of the files, e.g. " +
+                example.filename + " \u2192 \"" + example.title + "\" by " + example.artist))
+
+            item.onclick = addPattern.bind(null, suggestion.pattern)
+            list.appendChild(item)
+        }
+    })
+}
+
+// addPattern adds a pattern to the end of the filename patterns field, unless
+// it is already there.
+function addPattern(pattern) {
+    var field = document.getElementById("filename-patterns")
+    var patterns = field.value.split("\n").filter(s => s.trim().length > 0)
+
+    if (!patterns.includes(pattern)) {
+        patterns.push(pattern)
     }
 
-    // Send the HTTP request using the GET method to /api/reset-cache.
-    req.open("GET", location.origin + "/api/reset-cache", true)
-    req.send()
+    field.value = patterns.join("\n")
+}
+
+// previewFilename asks the server what the filename in the preview field would
+// be parsed as with the patterns, folder names option, non-capital words and
+// characters to remove in the form, before they've been saved, and shows the
+// result under the field.
+function previewFilename() {
+    var filenamePatterns = document
+        .getElementById("filename-patterns")
+        .value
+        .split("\n")
+        .filter(s => s.trim().length > 0)
+
+    var nonCapitalWords = document
+        .getElementById("non-capital-words")
+        .value
+        .split(",")
+        .map(s => s.trim())
+        .filter(s => s.length > 0)
+
+    var params = new URLSearchParams()
+    params.set("filename", document.getElementById("preview-filename").value)
+    params.set("filename-patterns", JSON.stringify(filenamePatterns))
+    params.set("non-capital-words", JSON.stringify(nonCapitalWords))
+    params.set("characters-to-remove", document.getElementById("characters-to-remove").value)
+    params.set("folder-metadata", document.getElementById("folder-metadata").value)
+
+    adminRequest("/api/v1/util/parse-filename", params, req => {
+        var result = JSON.parse(req.responseText)
+        var preview = document.getElementById("filename-preview")
+
+        if (!result.matched) {
+            preview.innerText = "That filename doesn't match any of the patterns, so it would be left out."
+            return
+        }
+
+        var text = "\"" + result.displayTitle + "\" by " + result.displayArtist
+        if (result.tags.length > 0) {
+            text += ", tagged " + result.tags.join(", ")
+        }
+
+        preview.innerText = text + " (matched by " + result.pattern + ")"
+    })
+}
+
+// rotateSigningKey sends a HTTP request to /api/v1/rotate-signing-key, which
+// stops every download link given out so far from working.
+function rotateSigningKey() {
+    adminRequest("/api/v1/rotate-signing-key", new URLSearchParams(), () => {
+        alert("All of the download links have been revoked.")
+    })
 }
 
-// changePassword sends an appropriate request to /api/change-password which
+// changePassword sends an appropriate request to /api/v1/change-password which
 // will update the password to the newly entered password in the input field,
 // but only if the user can enter the correct current password into a prompt.
 function changePassword() {
@@ -174,40 +369,179 @@ function changePassword() {
     // validated server-side.
     var oldPassword = prompt("Enter your current password:")
 
-    // Create a new HTTP request object, which will be used to change the
-    // settings by sending a request.
+    // Create a URLSearchParams object to store the form values which will
+    // be sent in the POST request to the server.
+    var params = new URLSearchParams()
+    params.set("old", oldPassword)
+    params.set("new", newPassword)
+
+    // Send the request to /api/v1/change-password. If the request was OK,
+    // the password change was successful.
+    adminRequest("/api/v1/change-password", params, () => {
+        alert("Your password has been changed successfully.")
+    })
+}
+
+// loadWarnings fetches the overview of the server from
+// /api/v1/admin/overview, and shows any warnings in it at the top of the page,
+// such as the tab directory not looking mounted. Only the admin can see the
+// overview, so nothing is shown to anyone else.
+function loadWarnings() {
     var req = new XMLHttpRequest()
 
-    // The onreadystatechange method of the HTTP request is called
-    // when the state of the request changes. In this case, only
-    // ready state 4 (which means that the response has been received)
-    // is relevant.
     req.onreadystatechange = function() {
-        if (this.readyState == 4) {
-            // If the status is 200, the request was OK and the settings
-            // change was successful.
-            if (this.status == 200) {
-                alert("Your password has been changed successfully.")
-            } else {
-                // At this point, some error has occured, so send an error
-                // message to the user.
-                alert(this.status + ": " + this.responseText)
+        if (this.readyState != 4 || this.status != 200) {
+            return
+        }
+
+        var list = document.getElementById("warnings")
+        list.textContent = ""
+
+        for (var warning of JSON.parse(this.responseText).warnings) {
+            var item = document.createElement("li")
+            item.textContent = warning
+            list.appendChild(item)
+        }
+    }
+
+    req.open("GET", location.origin + "/api/v1/admin/overview", true)
+    req.send()
+}
+
+// loadTrash lists the tabs in the trash under the button. Clicking on one
+// restores it.
+function loadTrash() {
+    var req = new XMLHttpRequest()
+
+    req.onreadystatechange = function() {
+        if (this.readyState != 4) {
+            return
+        } else if (this.status == 401) {
+            login(loadTrash)
+            return
+        } else if (this.status != 200) {
+            alert(this.status + ": " + errorMessage(this))
+            return
+        }
+
+        var list = document.getElementById("trash")
+        list.textContent = ""
+
+        var trashed = JSON.parse(this.responseText)
+        if (trashed.length == 0) {
+            var item = document.createElement("li")
+            item.textContent = "There aren't any deleted tabs."
+            list.appendChild(item)
+            return
+        }
+
+        for (var tab of trashed) {
+            var item = document.createElement("li")
+
+            var filename = document.createElement("code")
+            filename.textContent = tab.filename
+            item.appendChild(filename)
+
+            var text = " deleted " + new Date(tab.deleted).toLocaleString()
+            if (tab.purges) {
+                text += ", kept until " + new Date(tab.purges).toLocaleString()
             }
+
+            item.appendChild(document.createTextNode(text + ". Click to restore it."))
+            item.onclick = restoreTab.bind(null, tab.id)
+            list.appendChild(item)
         }
     }
 
-    // Create a URLSearchParams object to store the form values which will
-    // be sent in the POST request to the server.
+    req.open("GET", location.origin + "/api/v1/trash", true)
+    req.send()
+}
+
+// restoreTab takes the tab with the given ID out of the trash and puts it
+// back in the collection.
+function restoreTab(id) {
     var params = new URLSearchParams()
-    params.set("old", oldPassword)
-    params.set("new", newPassword)
+    params.set("id", id)
 
-    // Send the HTTP GET request to /api/change-settings. location.origin is
-    // the URL without the current path appended, so if I'm running
-    // the server locally it would be http://localhost:8000. true
-    // as the third parameter indicates that the request is
-    // asynchronous, meaning that the user can still interact with
-    // the page while the request is loading.
-    req.open("POST", location.origin + "/api/change-password", true)
-    req.send(params)
-}
\ No newline at end of file
+    adminRequest("/api/v1/restore-tab", params, req => {
+        var tab = JSON.parse(req.responseText)
+        alert("\"" + tab.title + "\" has been restored.")
+        loadTrash()
+    })
+}
+
+// logSource is the connection to /api/v1/admin/logs while the log is being
+// followed, or null if it isn't.
+var logSource = null
+
+// maxLogLines is how many lines of the log are shown before the oldest ones
+// are removed.
+var maxLogLines = 500
+
+// followLog starts showing the server's log entries at the chosen level, as
+// they are logged, starting with the recent ones. Pressing the button again
+// stops following it. The log is only sent to someone who is logged in, so
+// the user is asked to log in first if they aren't.
+function followLog() {
+    var button = document.getElementById("log-button")
+
+    if (logSource !== null) {
+        logSource.close()
+        logSource = null
+        button.textContent = "Follow the log"
+        return
+    }
+
+    var level = document.getElementById("log-level").value
+    var log = document.getElementById("log")
+
+    // Check that the user is allowed to see the log before following it,
+    // since an EventSource can't tell why it failed to connect.
+    var req = new XMLHttpRequest()
+
+    req.onreadystatechange = function() {
+        if (this.readyState != 4) {
+            return
+        }
+
+        if (this.status == 401) {
+            login(followLog)
+            return
+        } else if (this.status != 200) {
+            alert(this.status + ": " + errorMessage(this))
+            return
+        }
+
+        log.textContent = ""
+        button.textContent = "Stop following"
+
+        // The EventSource reconnects by itself if the connection drops,
+        // carrying on from the last entry it received.
+        logSource = new EventSource(location.origin + "/api/v1/admin/logs?level=" + encodeURIComponent(level))
+        logSource.onmessage = function(event) {
+            var entry = JSON.parse(event.data)
+
+            var line = document.createElement("div")
+            line.className = entry.level
+            line.textContent = entry.time + " " + entry.level.toUpperCase() + " " + entry.message
+
+            // Only scroll to the new line if the user was already looking
+            // at the bottom, so that reading older lines isn't interrupted.
+            var atBottom = log.scrollTop + log.clientHeight >= log.scrollHeight - 5
+
+            log.appendChild(line)
+            while (log.childElementCount > maxLogLines) {
+                log.removeChild(log.firstChild)
+            }
+
+            if (atBottom) {
+                log.scrollTop = log.scrollHeight
+            }
+        }
+    }
+
+    // Asking for the entries after the newest possible one checks the
+    // permission without sending any of them twice.
+    req.open("GET", location.origin + "/api/v1/admin/logs?after=" + Number.MAX_SAFE_INTEGER, true)
+    req.send()
+}
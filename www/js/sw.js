@@ -0,0 +1,67 @@
+// This is the service worker, which keeps copies of the pages and static
+// files so that the web app still works without a connection to the server.
+// The tabs' content is cached separately by the pages, in IndexedDB.
+//
+// The list of files to keep comes from /api/v1/precache, and each version of
+// that list gets its own cache, named after the version, so that an update
+// can't leave a mix of old and new files behind.
+const cachePrefix = "tab-server-"
+
+// precache fetches the precache manifest and, if its version doesn't have a
+// cache yet, downloads every asset into a new cache and removes the old ones.
+async function precache() {
+    var res = await fetch("/api/v1/precache", { cache: "no-store" })
+    if (!res.ok) {
+        return
+    }
+
+    var manifest = await res.json()
+    var name = cachePrefix + manifest.version
+
+    if (!await caches.has(name)) {
+        var cache = await caches.open(name)
+        await cache.addAll(manifest.assets.map(asset => asset.url))
+    }
+
+    for (var key of await caches.keys()) {
+        if (key.startsWith(cachePrefix) && key != name) {
+            await caches.delete(key)
+        }
+    }
+}
+
+self.addEventListener("install", event => {
+    // Start using the new service worker straight away, rather than waiting
+    // for every page using the old one to be closed.
+    self.skipWaiting()
+    event.waitUntil(precache())
+})
+
+self.addEventListener("activate", event => {
+    event.waitUntil(self.clients.claim())
+})
+
+// The pages send a message when they load, asking for the copies to be
+// brought up to date, since the service worker itself rarely changes.
+self.addEventListener("message", event => {
+    if (event.data == "update") {
+        event.waitUntil(precache().catch(() => {}))
+    }
+})
+
+self.addEventListener("fetch", event => {
+    var url = new URL(event.request.url)
+
+    // The API is left to the pages, which have their own offline handling,
+    // and only GET requests can be cached.
+    if (event.request.method != "GET" || url.origin != location.origin || url.pathname.startsWith("/api/")) {
+        return
+    }
+
+    // Try the network first, so that the newest version is always used when
+    // the server can be reached, and fall back to the cached copy otherwise.
+    event.respondWith(
+        fetch(event.request).catch(() =>
+            caches.match(event.request, { ignoreSearch: true }).then(cached =>
+                cached || Response.error())))
+})